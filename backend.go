@@ -23,8 +23,33 @@ type Backend interface {
 	// Name returns the name of the backend.
 	Name() string
 	// SendMetricsAsync flushes the metrics to the backend, preparing payload synchronously but doing the send asynchronously.
-	// Must not read/write MetricMap asynchronously.
+	// The MetricMap is shared with the other backends, so it must not be modified.
 	SendMetricsAsync(context.Context, *MetricMap, SendCallback)
 	// SendEvent sends event to the backend.
 	SendEvent(context.Context, *Event) error
 }
+
+// Spool is a persistent queue a backend adds the payloads it could not send to when their retries are exhausted,
+// instead of dropping them.
+type Spool interface {
+	// Spool adds a payload with the given number of datapoints to the queue.  It returns false if the payload could
+	// not be added, in which case it must be dropped.
+	Spool(ctx context.Context, payload []byte, datapoints uint64) bool
+}
+
+// MetadataBackend is a Backend which records the metadata of the metrics it is sent, such as their units.
+type MetadataBackend interface {
+	Backend
+	// SetMetadata gives the backend the metadata of the metrics it is sent.  It is called before anything is sent to
+	// the backend, only if there is any metadata.
+	SetMetadata(*MetadataRegistry)
+}
+
+// SpoolingBackend is a Backend which can spool the payloads it fails to send, and replay them later.
+type SpoolingBackend interface {
+	Backend
+	// SetSpool gives the backend the spool to add payloads to.  It is called before anything is sent to the backend.
+	SetSpool(Spool)
+	// Replay makes a single attempt to send a payload the backend spooled.
+	Replay(ctx context.Context, payload []byte) error
+}
@@ -24,7 +24,8 @@ type CloudProvider interface {
 	Name() string
 	// Instance returns instances details from the cloud provider.
 	// ip -> nil pointer if instance was not found.
-	// map is returned even in case of errors because it may contain partial data.
+	// map is returned even in case of errors because it may contain partial data.  If an error is returned, every ip
+	// without an instance is considered a failed lookup rather than not found.
 	Instance(context.Context, ...Source) (map[Source]*Instance, error)
 	// MaxInstancesBatch returns maximum number of instances that could be requested via the Instance method.
 	MaxInstancesBatch() int
@@ -60,4 +61,34 @@ type CacheOptions struct {
 	CacheEvictAfterIdlePeriod time.Duration
 	CacheTTL                  time.Duration
 	CacheNegativeTTL          time.Duration
+	// CachePersistDir is the directory the cache is saved to periodically, and loaded from on startup. "" disables
+	// persistence.
+	CachePersistDir string
+	// CachePersistPeriod is how often the cache is saved.
+	CachePersistPeriod time.Duration
+	// CacheRetryBackoff is how long until a failed lookup is retried, doubling for each consecutive failure. 0 means
+	// CacheNegativeTTL.
+	CacheRetryBackoff time.Duration
+	// CacheRetryMaxBackoff is the maximum time until a failed lookup is retried.
+	CacheRetryMaxBackoff time.Duration
+	// MaxConcurrentLookups is the maximum number of lookups in flight at once. 0 means 1.
+	MaxConcurrentLookups int
+	// CacheRefreshJitter is the fraction of the TTL before an entry expires that it may be refreshed, chosen randomly
+	// for each entry, so tag changes are picked up before the entry expires, and refreshes are spread out. 0 means
+	// entries are refreshed once they expire.
+	CacheRefreshJitter float64
+	// CacheMaxEntries is the maximum number of entries in the cache. 0 means unlimited.
+	CacheMaxEntries int
+	// CacheMaxBytes is the maximum estimated memory used by the cache. 0 means unlimited.
+	CacheMaxBytes int64
+	// CacheEvictionPolicy selects the entries evicted when the cache is over CacheMaxEntries or CacheMaxBytes, one of
+	// CacheEvictionLRU or CacheEvictionLFU.  "" means CacheEvictionLRU.
+	CacheEvictionPolicy string
 }
+
+const (
+	// CacheEvictionLRU evicts the least recently used entries first.
+	CacheEvictionLRU = "lru"
+	// CacheEvictionLFU evicts the least frequently used entries first.
+	CacheEvictionLFU = "lfu"
+)
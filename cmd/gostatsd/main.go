@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	_ "expvar"
 	"fmt"
 	"math/rand"
@@ -9,7 +11,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,9 +24,15 @@ import (
 	"github.com/hligit/gostatsd/internal/util"
 	"github.com/hligit/gostatsd/pkg/backends"
 	"github.com/hligit/gostatsd/pkg/cachedinstances"
+	"github.com/hligit/gostatsd/pkg/cachedinstances/chain"
 	"github.com/hligit/gostatsd/pkg/cachedinstances/cloudprovider"
+	"github.com/hligit/gostatsd/pkg/cachedinstances/static"
 	"github.com/hligit/gostatsd/pkg/cloudproviders"
+	"github.com/hligit/gostatsd/pkg/profiling"
+	"github.com/hligit/gostatsd/pkg/secrets"
+	"github.com/hligit/gostatsd/pkg/stats"
 	"github.com/hligit/gostatsd/pkg/statsd"
+	"github.com/hligit/gostatsd/pkg/tracing"
 	"github.com/hligit/gostatsd/pkg/transport"
 )
 
@@ -35,32 +43,174 @@ const (
 	ParamProfile = "profile"
 	// ParamJSON makes logger log in JSON format.
 	ParamJSON = "json"
+	// ParamLogSamplePerMinute limits how many times each message is logged per minute.
+	ParamLogSamplePerMinute = "log-sample-per-minute"
 	// ParamConfigPath provides file with configuration.
 	ParamConfigPath = "config-path"
 	// ParamVersion makes program output its version.
 	ParamVersion = "version"
+	// ParamCheckConfig makes program validate its configuration and exit.
+	ParamCheckConfig = "check-config"
+	// ParamPrintConfig makes program print its effective configuration and exit.
+	ParamPrintConfig = "print-config"
 )
 
+// The subcommands of the program.
+const (
+	commandRun     = "run"
+	commandCheck   = "check"
+	commandVersion = "version"
+	commandSend    = "send"
+	commandService = "service"
+	commandReplay  = "replay-dlq"
+)
+
+const usageHeader = `Usage: %[1]s [run|check|version|send|service|replay-dlq] [flags]
+
+Commands:
+  run         Run the server, the default if no command is given
+  check       Validate the configuration, including creating every backend, and exit
+  version     Print the version and exit
+  send        Send metrics and events in the statsd format, given as arguments or on stdin, to a running server,
+              or directly to the backends in the configuration with --direct
+  service     On Windows, install the service with "service install [flags]", which runs the server with the flags,
+              or remove it with "service uninstall"
+  replay-dlq  Send the archives given as arguments, or every archive in dead-letter-path, to the backends which
+              dropped them, or to --backend, and remove those which are sent
+
+Flags:
+`
+
+// logLevels changes the log level at runtime, from the admin endpoints or a signal.
+var logLevels = util.NewLogLevels(logrus.StandardLogger())
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	v, version, err := setupConfiguration()
+	command, args := parseCommand(os.Args[1:])
+	var sendOpts sendOptions
+	var replayOpts replayOptions
+	switch command {
+	case commandVersion:
+		printVersion()
+		return
+	case commandService:
+		if err := manageService(args); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+		return
+	case commandRun, commandCheck, commandSend, commandReplay:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q, must be run, check, version, send, service, or replay-dlq\n", command)
+		os.Exit(2)
+	}
+
+	var addFlags func(fs *pflag.FlagSet)
+	switch command {
+	case commandSend:
+		addFlags = sendOpts.addFlags
+	case commandReplay:
+		addFlags = replayOpts.addFlags
+	}
+	v, resolver, args, err := setupConfiguration(command, args, addFlags)
 	if err != nil {
 		if err == pflag.ErrHelp {
 			return
 		}
 		logrus.Fatalf("Error while parsing configuration: %v", err)
 	}
-	if version {
-		fmt.Printf("Version: %s - Commit: %s - Date: %s\n", Version, GitCommit, BuildDate)
-		return
+	if len(args) > 0 && command != commandSend && command != commandReplay {
+		logrus.Fatalf("Unexpected arguments: %s", strings.Join(args, " "))
+	}
+	switch {
+	case v.GetBool(ParamVersion):
+		printVersion()
+	case command == commandCheck || v.GetBool(ParamCheckConfig):
+		if err := checkConfig(v); err != nil {
+			logrus.Fatalf("Invalid configuration: %v", err)
+		}
+		fmt.Println("Configuration is valid")
+	case v.GetBool(ParamPrintConfig):
+		config, err := json.MarshalIndent(util.EffectiveConfig(v, resolver.IsSecret), "", "  ")
+		if err != nil {
+			logrus.Fatalf("Failed to encode configuration: %v", err)
+		}
+		fmt.Println(string(config))
+	case command == commandSend:
+		if err := sendOpts.send(v, args); err != nil {
+			logrus.Fatalf("Failed to send: %v", err)
+		}
+	case command == commandReplay:
+		if err := replayOpts.replay(v, args); err != nil {
+			logrus.Fatalf("Failed to replay: %v", err)
+		}
+	default:
+		err := runService(v.GetDuration(gostatsd.ParamDrainTimeout), func() error {
+			return run(v, resolver)
+		})
+		if err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+}
+
+// parseCommand returns the command given as the first argument, and the arguments which follow it.  The server is
+// run if no command is given, as it was before there were commands.
+func parseCommand(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commandRun, args
+	}
+	return args[0], args[1:]
+}
+
+func printVersion() {
+	fmt.Printf("Version: %s - Commit: %s - Date: %s\n", Version, GitCommit, BuildDate)
+}
+
+// checkConfig validates the configuration by creating everything the server is created with, including every
+// backend, without starting any of it.  It returns every problem found.
+func checkConfig(v *viper.Viper) error {
+	var errs []string
+	if mode := v.GetString(gostatsd.ParamServerMode); mode != "standalone" && mode != "forwarder" && mode != "relay" {
+		errs = append(errs, fmt.Sprintf("invalid %s %q, must be standalone, forwarder, or relay", gostatsd.ParamServerMode, mode))
 	}
-	if err := run(v); err != nil {
-		logrus.Fatalf("%v", err)
+	if err := statsd.CheckFilters(v); err != nil {
+		errs = append(errs, err.Error())
 	}
+	if err := statsd.CheckEventRoutes(v); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := statsd.CheckEventTemplates(v); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := statsd.CheckRules(v); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := gostatsd.CheckMetadata(v); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := backends.CheckSpool(v); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if _, err := constructServer(v); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
-func run(v *viper.Viper) error {
+func run(v *viper.Viper, resolver *secrets.Resolver) error {
 	logrus.Info("Starting server")
+	if err := tuneRuntime(v); err != nil {
+		return err
+	}
+	stopTracing, err := tracing.Install(logrus.StandardLogger(), tracing.OptionsFromViper(v), Version)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
 	s, err := constructServer(v)
 	if err != nil {
 		return err
@@ -76,6 +226,21 @@ func run(v *viper.Viper) error {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 	cancelOnInterrupt(ctx, cancelFunc)
+	s.FlushSignals = notifySignals(flushSignals)
+	s.ReloadSignals = notifySignals(reloadSignals)
+	s.DrainSignals = drainRequests()
+	s.OnReady = notifyReady
+	s.OnStopping = notifyStopping
+	if watchdog := serviceWatchdog(); watchdog != nil {
+		s.Runnables = append(s.Runnables, watchdog)
+	}
+	s.LogLevels = logLevels
+	toggleDebugOnSignal(ctx, notifySignals(logLevelSignals))
+	s.Secrets = resolver
+	s.OnReload = func(v *viper.Viper) error {
+		setupLogger(v)
+		return nil
+	}
 
 	if err := s.Run(ctx); err != nil && err != context.Canceled {
 		return fmt.Errorf("server error: %v", err)
@@ -83,6 +248,21 @@ func run(v *viper.Viper) error {
 	return nil
 }
 
+// tuneRuntime sets GOMAXPROCS and GOMEMLIMIT as configured, or from the limits of the container.
+func tuneRuntime(v *viper.Viper) error {
+	memoryLimit := int64(util.RuntimeLimitAuto)
+	switch setting := v.GetString(gostatsd.ParamGoMemLimit); setting {
+	case "auto":
+	case "off":
+		memoryLimit = util.RuntimeLimitOff
+	default:
+		if memoryLimit = int64(v.GetSizeInBytes(gostatsd.ParamGoMemLimit)); memoryLimit <= 0 {
+			return fmt.Errorf("invalid %s %q, must be a size, auto, or off", gostatsd.ParamGoMemLimit, setting)
+		}
+	}
+	return util.TuneRuntime(v.GetInt(gostatsd.ParamGoMaxProcs), memoryLimit, logrus.StandardLogger())
+}
+
 func constructServer(v *viper.Viper) (*statsd.Server, error) {
 	var runnables []gostatsd.Runnable
 	// Logger
@@ -98,40 +278,104 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 		logger.Info("No cloud provider specified")
 	} else {
 		var err error
-		// See if requested cloud provider is a native CachedInstances implementation
-		cachedInstances, err = cachedinstances.Get(logger, cloudProviderName, v, Version)
-		switch err {
-		case nil:
-		case cachedinstances.ErrUnknownProvider:
-			// See if requested cloud provider is a CloudProvider implementation
-			cloudProvider, err := cloudproviders.Get(logger, cloudProviderName, v, Version)
+		if cloudProviderName == chain.ProviderName {
+			cachedInstances, runnables, err = newChainFromViper(logger, v, runnables)
+		} else {
+			cachedInstances, runnables, err = newCachedInstances(logger, cloudProviderName, v, runnables)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cloudProviderName != static.ProviderName && static.IsFallback(v) {
+			// Use the static provider for anything the requested cloud provider can't find
+			fallback, err := static.NewProviderFromViper(v, logger.WithField("cloud_provider", static.ProviderName), Version)
 			if err != nil {
 				return nil, err
 			}
-			runnables = gostatsd.MaybeAppendRunnable(runnables, cloudProvider)
-			cachedInstances = newCachedInstancesFromViper(logger, cloudProvider, v)
-		default:
-			return nil, err
+			runnables = gostatsd.MaybeAppendRunnable(runnables, fallback)
+			cachedInstances = static.NewFallback(cachedInstances, fallback)
+			runnables = gostatsd.MaybeAppendRunnable(runnables, cachedInstances)
 		}
-		runnables = gostatsd.MaybeAppendRunnable(runnables, cachedInstances)
 	}
-	// Backends
-	backendNames := v.GetStringSlice(gostatsd.ParamBackends)
-	backendsList := make([]gostatsd.Backend, 0, len(backendNames))
-	for _, backendName := range backendNames {
-		backend, errBackend := backends.InitBackend(backendName, v, logger, pool)
+	// Backends, which are shared if they are used for both client and internal metrics
+	backendsByName := map[string]gostatsd.Backend{}
+	newBackends := func(backendNames []string) ([]gostatsd.Backend, error) {
+		backendsList := make([]gostatsd.Backend, 0, len(backendNames))
+		for _, backendName := range backendNames {
+			backend, ok := backendsByName[backendName]
+			if !ok {
+				var errBackend error
+				backend, errBackend = backends.NewReloadableBackend(backendName, v, logger, pool)
+				if errBackend != nil {
+					return nil, errBackend
+				}
+				backendsByName[backendName] = backend
+				runnables = gostatsd.MaybeAppendRunnable(runnables, backend)
+			}
+			backendsList = append(backendsList, backend)
+		}
+		return backendsList, nil
+	}
+	backendsList, err := newBackends(v.GetStringSlice(gostatsd.ParamBackends))
+	if err != nil {
+		return nil, err
+	}
+	internalBackendsList, err := newBackends(v.GetStringSlice(gostatsd.ParamInternalBackends))
+	if err != nil {
+		return nil, err
+	}
+	// Shadow backends, which are never shared, and are configured by the shadow section, such as [shadow.datadog], so
+	// they can send to a different account than the backend of the same name
+	shadowPercentage := v.GetFloat64(gostatsd.ParamShadowPercentage)
+	if shadowPercentage < 0 || shadowPercentage > 100 {
+		return nil, fmt.Errorf("%s must be from 0 to 100", gostatsd.ParamShadowPercentage)
+	}
+	var shadowBackendsList []gostatsd.Backend
+	for _, backendName := range v.GetStringSlice(gostatsd.ParamShadowBackends) {
+		backend, errBackend := backends.NewReloadableBackend(backendName, util.GetSubViper(v, "shadow"), logger.WithField("shadow", true), pool)
 		if errBackend != nil {
-			return nil, errBackend
+			return nil, fmt.Errorf("shadow %v", errBackend)
 		}
-		backendsList = append(backendsList, backend)
 		runnables = gostatsd.MaybeAppendRunnable(runnables, backend)
+		shadowBackendsList = append(shadowBackendsList, backend)
 	}
-	// Percentiles
-	pt, err := getPercentiles(v.GetStringSlice(gostatsd.ParamPercentThreshold))
+	// Percentiles, and the sub-metrics of timers, including those which only some backends are sent
+	pt, disabledSubTypes, err := gostatsd.AggregatedTimerSettings(
+		v,
+		append(v.GetStringSlice(gostatsd.ParamBackends), v.GetStringSlice(gostatsd.ParamInternalBackends)...),
+	)
 	if err != nil {
 		return nil, err
 	}
 
+	// Identity of this instance, which may come from its environment, so every instance can share a configuration
+	internalTags, err := util.ExpandAll(v.GetStringSlice(gostatsd.ParamInternalTags))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", gostatsd.ParamInternalTags, err)
+	}
+	defaultTags, err := util.ExpandAll(v.GetStringSlice(gostatsd.ParamDefaultTags))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", gostatsd.ParamDefaultTags, err)
+	}
+	hostname, err := util.Expand(v.GetString(gostatsd.ParamHostname))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", gostatsd.ParamHostname, err)
+	}
+	internalMetricsRename, err := stats.ParseRenames(v.GetStringSlice(gostatsd.ParamInternalMetricsRename))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", gostatsd.ParamInternalMetricsRename, err)
+	}
+	profiler, err := profiling.NewProfilerFromViper(v, logger, pool, gostatsd.Source(hostname))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create profiler: %v", err)
+	}
+
+	// The delays must leave time for the flush to be sent before the next one
+	flushJitter, flushSplay := v.GetDuration(gostatsd.ParamFlushJitter), v.GetDuration(gostatsd.ParamFlushSplay)
+	if flushJitter < 0 || flushSplay < 0 || (flushJitter+flushSplay > 0 && flushJitter+flushSplay >= v.GetDuration(gostatsd.ParamFlushInterval)) {
+		return nil, fmt.Errorf("%s and %s must not be negative, and together must be less than %s", gostatsd.ParamFlushJitter, gostatsd.ParamFlushSplay, gostatsd.ParamFlushInterval)
+	}
+
 	// Set defaults for expiry from the main expiry setting
 	v.SetDefault(gostatsd.ParamExpiryIntervalCounter, v.GetDuration(gostatsd.ParamExpiryInterval))
 	v.SetDefault(gostatsd.ParamExpiryIntervalGauge, v.GetDuration(gostatsd.ParamExpiryInterval))
@@ -140,60 +384,88 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 
 	// Create server
 	return &statsd.Server{
-		Runnables:             runnables,
-		Backends:              backendsList,
-		CachedInstances:       cachedInstances,
-		InternalTags:          v.GetStringSlice(gostatsd.ParamInternalTags),
-		InternalNamespace:     v.GetString(gostatsd.ParamInternalNamespace),
-		DefaultTags:           v.GetStringSlice(gostatsd.ParamDefaultTags),
-		Hostname:              gostatsd.Source(v.GetString(gostatsd.ParamHostname)),
-		ExpiryIntervalCounter: v.GetDuration(gostatsd.ParamExpiryIntervalCounter),
-		ExpiryIntervalGauge:   v.GetDuration(gostatsd.ParamExpiryIntervalGauge),
-		ExpiryIntervalSet:     v.GetDuration(gostatsd.ParamExpiryIntervalSet),
-		ExpiryIntervalTimer:   v.GetDuration(gostatsd.ParamExpiryIntervalTimer),
-		FlushInterval:         v.GetDuration(gostatsd.ParamFlushInterval),
-		FlushOffset:           v.GetDuration(gostatsd.ParamFlushOffset),
-		FlushAligned:          v.GetBool(gostatsd.ParamFlushAligned),
-		IgnoreHost:            v.GetBool(gostatsd.ParamIgnoreHost),
-		MaxReaders:            v.GetInt(gostatsd.ParamMaxReaders),
-		MaxParsers:            v.GetInt(gostatsd.ParamMaxParsers),
-		MaxWorkers:            v.GetInt(gostatsd.ParamMaxWorkers),
-		MaxQueueSize:          v.GetInt(gostatsd.ParamMaxQueueSize),
-		MaxConcurrentEvents:   v.GetInt(gostatsd.ParamMaxConcurrentEvents),
-		EstimatedTags:         v.GetInt(gostatsd.ParamEstimatedTags),
-		MetricsAddr:           v.GetString(gostatsd.ParamMetricsAddr),
-		Namespace:             v.GetString(gostatsd.ParamNamespace),
-		StatserType:           v.GetString(gostatsd.ParamStatserType),
-		PercentThreshold:      pt,
-		HeartbeatEnabled:      v.GetBool(gostatsd.ParamHeartbeatEnabled),
-		ReceiveBatchSize:      v.GetInt(gostatsd.ParamReceiveBatchSize),
-		ConnPerReader:         v.GetBool(gostatsd.ParamConnPerReader),
-		ServerMode:            v.GetString(gostatsd.ParamServerMode),
-		LogRawMetric:          v.GetBool(gostatsd.ParamLogRawMetric),
+		Runnables:        runnables,
+		Backends:         backendsList,
+		InternalBackends: internalBackendsList,
+		NewBackend: func(name string, v *viper.Viper) (gostatsd.Backend, error) {
+			return backends.NewReloadableBackend(name, v, logger, pool)
+		},
+		CachedInstances:             cachedInstances,
+		CloudStripSourceZone:        v.GetBool(gostatsd.ParamCloudStripSourceZone),
+		InternalTags:                internalTags,
+		InternalNamespace:           v.GetString(gostatsd.ParamInternalNamespace),
+		DefaultTags:                 defaultTags,
+		Hostname:                    gostatsd.Source(hostname),
+		ExpiryIntervalCounter:       v.GetDuration(gostatsd.ParamExpiryIntervalCounter),
+		ExpiryIntervalGauge:         v.GetDuration(gostatsd.ParamExpiryIntervalGauge),
+		ExpiryIntervalSet:           v.GetDuration(gostatsd.ParamExpiryIntervalSet),
+		ExpiryIntervalTimer:         v.GetDuration(gostatsd.ParamExpiryIntervalTimer),
+		FlushInterval:               v.GetDuration(gostatsd.ParamFlushInterval),
+		FlushOffset:                 v.GetDuration(gostatsd.ParamFlushOffset),
+		FlushAligned:                v.GetBool(gostatsd.ParamFlushAligned),
+		FlushJitter:                 v.GetDuration(gostatsd.ParamFlushJitter),
+		FlushSplay:                  v.GetDuration(gostatsd.ParamFlushSplay),
+		FlushQueueSize:              v.GetInt(gostatsd.ParamFlushQueueSize),
+		SecretRefreshInterval:       v.GetDuration(gostatsd.ParamSecretRefreshInterval),
+		ConfigWatchInterval:         v.GetDuration(gostatsd.ParamConfigWatchInterval),
+		DrainTimeout:                v.GetDuration(gostatsd.ParamDrainTimeout),
+		ShutdownFlushTimeout:        v.GetDuration(gostatsd.ParamShutdownFlushTimeout),
+		HAPeerURL:                   v.GetString(gostatsd.ParamHAPeerURL),
+		HAIndex:                     v.GetInt(gostatsd.ParamHAIndex),
+		HACheckInterval:             v.GetDuration(gostatsd.ParamHACheckInterval),
+		ShadowBackends:              shadowBackendsList,
+		ShadowPercentage:            shadowPercentage,
+		LeaderElectionLease:         v.GetString(gostatsd.ParamLeaderElectionLease),
+		LeaderElectionNamespace:     v.GetString(gostatsd.ParamLeaderElectionNamespace),
+		LeaderElectionIdentity:      v.GetString(gostatsd.ParamLeaderElectionIdentity),
+		LeaderElectionLeaseDuration: v.GetDuration(gostatsd.ParamLeaderElectionLeaseDuration),
+		LeaderElectionRenewDeadline: v.GetDuration(gostatsd.ParamLeaderElectionRenewDeadline),
+		LeaderElectionRetryPeriod:   v.GetDuration(gostatsd.ParamLeaderElectionRetryPeriod),
+		EventThrottleWindow:         v.GetDuration(gostatsd.ParamEventThrottleWindow),
+		EventThrottlePerKey:         v.GetInt(gostatsd.ParamEventThrottlePerKey),
+		IgnoreHost:                  v.GetBool(gostatsd.ParamIgnoreHost),
+		MaxReaders:                  v.GetInt(gostatsd.ParamMaxReaders),
+		MaxParsers:                  v.GetInt(gostatsd.ParamMaxParsers),
+		MaxWorkers:                  v.GetInt(gostatsd.ParamMaxWorkers),
+		MaxQueueSize:                v.GetInt(gostatsd.ParamMaxQueueSize),
+		MaxConcurrentEvents:         v.GetInt(gostatsd.ParamMaxConcurrentEvents),
+		EstimatedTags:               v.GetInt(gostatsd.ParamEstimatedTags),
+		MetricsAddr:                 v.GetString(gostatsd.ParamMetricsAddr),
+		MetricsSocket:               v.GetString(gostatsd.ParamMetricsSocket),
+		OriginDetection:             v.GetBool(gostatsd.ParamOriginDetection),
+		Namespace:                   v.GetString(gostatsd.ParamNamespace),
+		StatserType:                 v.GetString(gostatsd.ParamStatserType),
+		PercentThreshold:            pt,
+		HeartbeatEnabled:            v.GetBool(gostatsd.ParamHeartbeatEnabled),
+		RuntimeMetricsEnabled:       v.GetBool(gostatsd.ParamRuntimeMetricsEnabled),
+		ReceiveBatchSize:            v.GetInt(gostatsd.ParamReceiveBatchSize),
+		ConnPerReader:               v.GetBool(gostatsd.ParamConnPerReader),
+		ServerMode:                  v.GetString(gostatsd.ParamServerMode),
+		LogRawMetric:                v.GetBool(gostatsd.ParamLogRawMetric),
 		HeartbeatTags: gostatsd.Tags{
 			fmt.Sprintf("version:%s", Version),
 			fmt.Sprintf("commit:%s", GitCommit),
 		},
-		DisabledSubTypes:          gostatsd.DisabledSubMetrics(v),
+		DisabledSubTypes:          disabledSubTypes,
 		BadLineRateLimitPerSecond: rate.Limit(v.GetFloat64(gostatsd.ParamBadLinesPerMinute) / 60.0),
 		HistogramLimit:            v.GetUint32(gostatsd.ParamTimerHistogramLimit),
+		DroppedSummaryInterval:    v.GetDuration(gostatsd.ParamDroppedSummaryInterval),
+		RetryBudgetRatio:          v.GetFloat64(gostatsd.ParamRetryBudgetRatio),
+		RetryBudgetMinPerSecond:   v.GetFloat64(gostatsd.ParamRetryBudgetMinPerSecond),
+		MemoryLimit:               uint64(v.GetSizeInBytes(gostatsd.ParamMemoryLimit)),
+		AggregatorShards:          v.GetInt(gostatsd.ParamAggregatorShards),
+		AggregatorMaxSeries:       v.GetInt(gostatsd.ParamAggregatorMaxSeries),
+		AggregatorMaxSamples:      v.GetInt(gostatsd.ParamAggregatorMaxSamples),
+		DispatchBatchSize:         v.GetInt(gostatsd.ParamDispatchBatchSize),
+		DispatchBatchDelay:        v.GetDuration(gostatsd.ParamDispatchBatchDelay),
+		InternalMetricsRename:     internalMetricsRename,
+		InternalMetricsDisabled:   v.GetStringSlice(gostatsd.ParamInternalMetricsDisabled),
 		Viper:                     v,
 		TransportPool:             pool,
+		Profiler:                  profiler,
 	}, nil
 }
 
-func getPercentiles(s []string) ([]float64, error) {
-	percentThresholds := make([]float64, len(s))
-	for i, sPercentThreshold := range s {
-		pt, err := strconv.ParseFloat(sPercentThreshold, 64)
-		if err != nil {
-			return nil, err
-		}
-		percentThresholds[i] = pt
-	}
-	return percentThresholds, nil
-}
-
 // cancelOnInterrupt calls f when os.Interrupt or SIGTERM is received.
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	c := make(chan os.Signal, 1)
@@ -207,20 +479,60 @@ func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	}()
 }
 
-func setupConfiguration() (*viper.Viper, bool, error) {
+// notifySignals returns a channel which receives the signals, or nil if there are none on this platform.
+func notifySignals(signals []os.Signal) <-chan os.Signal {
+	if len(signals) == 0 {
+		return nil
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	return c
+}
+
+// toggleDebugOnSignal switches between debug logging and the configured log level every time a signal is received.
+func toggleDebugOnSignal(ctx context.Context, signals <-chan os.Signal) {
+	if signals == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-signals:
+				level := logLevels.ToggleDebug()
+				logrus.WithFields(logrus.Fields{
+					"signal": sig,
+					"level":  level,
+				}).Info("Changed log level on signal")
+			}
+		}
+	}()
+}
+
+// setupConfiguration parses the flags of the command from args, and reads the configuration file.  The flags added by
+// addFlags, if it is not nil, are only for the command, and are not part of the configuration.  It returns the
+// arguments which are not flags.
+func setupConfiguration(command string, args []string, addFlags func(fs *pflag.FlagSet)) (*viper.Viper, *secrets.Resolver, []string, error) {
 	v := viper.New()
 	defer setupLogger(v) // Apply logging configuration in case of early exit
 	util.InitViper(v, "")
 
-	var version bool
-
-	cmd := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	cmd := pflag.NewFlagSet(os.Args[0]+" "+command, pflag.ContinueOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, usageHeader, os.Args[0])
+		cmd.PrintDefaults()
+	}
 
-	cmd.BoolVar(&version, ParamVersion, false, "Print the version and exit")
+	cmd.Bool(ParamVersion, false, "Print the version and exit")
+	cmd.Bool(ParamCheckConfig, false, "Validate the configuration, including creating every backend, and exit")
+	cmd.Bool(ParamPrintConfig, false, "Print the effective configuration as json, with secrets masked, and exit")
 	cmd.Bool(ParamVerbose, false, "Verbose")
 	cmd.Bool(ParamJSON, false, "Log in JSON format")
+	cmd.Int(ParamLogSamplePerMinute, 0, "Maximum number of times each message is logged per minute, unlimited if 0")
 	cmd.String(ParamProfile, "", "Enable profiler endpoint on the specified address and port")
 	cmd.String(ParamConfigPath, "", "Path to the configuration file")
+	cmd.String(util.ParamConfigProfile, "", "Profile section of the configuration file to apply over the rest of it")
 
 	gostatsd.AddFlags(cmd)
 
@@ -229,38 +541,105 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 			panic(err) // Should never happen
 		}
 	})
+	if addFlags != nil {
+		addFlags(cmd)
+	}
 
-	if err := cmd.Parse(os.Args[1:]); err != nil {
-		return nil, false, err
+	if err := cmd.Parse(args); err != nil {
+		return nil, nil, nil, err
 	}
 
+	// Configured by flags and the environment, as it resolves the secrets in the configuration file
+	resolver, err := secrets.NewResolverFromViper(logrus.StandardLogger(), v)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	configPath := v.GetString(ParamConfigPath)
 	if configPath != "" {
 		v.SetConfigFile(configPath)
-		if err := v.ReadInConfig(); err != nil {
-			return nil, false, err
+		if err := util.ReadConfig(v, resolver.Resolve); err != nil {
+			return nil, nil, nil, err
 		}
 	}
 
-	return v, version, nil
+	return v, resolver, cmd.Args(), nil
 }
 
+// setupLogger applies the logging configuration.  It is called again when the configuration is reloaded, which undoes
+// any change to the log level made at runtime.
 func setupLogger(v *viper.Viper) {
+	level := logrus.InfoLevel
 	if v.GetBool(ParamVerbose) {
-		logrus.SetLevel(logrus.DebugLevel)
+		level = logrus.DebugLevel
 	}
+	var formatter logrus.Formatter = &logrus.TextFormatter{}
 	if v.GetBool(ParamJSON) {
-		logrus.SetFormatter(&logrus.JSONFormatter{})
+		formatter = &logrus.JSONFormatter{}
+	}
+	logLevels.Configure(level, util.NewSamplingFormatter(formatter, v.GetInt(ParamLogSamplePerMinute)))
+}
+
+// newCachedInstances creates the named cloud provider, and appends anything which needs to be run to runnables.
+func newCachedInstances(logger logrus.FieldLogger, name string, v *viper.Viper, runnables []gostatsd.Runnable) (gostatsd.CachedInstances, []gostatsd.Runnable, error) {
+	// See if requested cloud provider is a native CachedInstances implementation
+	cachedInstances, err := cachedinstances.Get(logger, name, v, Version)
+	switch err {
+	case nil:
+	case cachedinstances.ErrUnknownProvider:
+		// See if requested cloud provider is a CloudProvider implementation
+		cloudProvider, err := cloudproviders.Get(logger, name, v, Version)
+		if err != nil {
+			return nil, nil, err
+		}
+		runnables = gostatsd.MaybeAppendRunnable(runnables, cloudProvider)
+		cachedInstances, err = newCachedInstancesFromViper(logger, cloudProvider, v)
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, err
 	}
+	return cachedInstances, gostatsd.MaybeAppendRunnable(runnables, cachedInstances), nil
+}
+
+// newChainFromViper creates every cloud provider in the chain, and the chain itself.
+func newChainFromViper(logger logrus.FieldLogger, v *viper.Viper, runnables []gostatsd.Runnable) (gostatsd.CachedInstances, []gostatsd.Runnable, error) {
+	config, err := chain.ConfigFromViper(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	providers := make([]gostatsd.CachedInstances, 0, len(config.Providers))
+	for _, name := range config.Providers {
+		var provider gostatsd.CachedInstances
+		provider, runnables, err = newCachedInstances(logger, name, v, runnables)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create %s cloud provider: %v", name, err)
+		}
+		providers = append(providers, provider)
+	}
+	c, err := chain.New(providers, config.MergeTags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, gostatsd.MaybeAppendRunnable(runnables, c), nil
 }
 
 // newCachedInstancesFromViper initialises a new cached instances.
-func newCachedInstancesFromViper(logger logrus.FieldLogger, cloudProvider gostatsd.CloudProvider, v *viper.Viper) gostatsd.CachedInstances {
+func newCachedInstancesFromViper(logger logrus.FieldLogger, cloudProvider gostatsd.CloudProvider, v *viper.Viper) (gostatsd.CachedInstances, error) {
 	// Set the defaults in Viper based on the cloud provider values before we manipulate things
 	v.SetDefault(gostatsd.ParamCacheRefreshPeriod, gostatsd.DefaultCacheRefreshPeriod)
 	v.SetDefault(gostatsd.ParamCacheEvictAfterIdlePeriod, gostatsd.DefaultCacheEvictAfterIdlePeriod)
 	v.SetDefault(gostatsd.ParamCacheTTL, gostatsd.DefaultCacheTTL)
 	v.SetDefault(gostatsd.ParamCacheNegativeTTL, gostatsd.DefaultCacheNegativeTTL)
+	v.SetDefault(gostatsd.ParamCacheRetryBackoff, gostatsd.DefaultCacheRetryBackoff)
+	v.SetDefault(gostatsd.ParamCacheRetryMaxBackoff, gostatsd.DefaultCacheRetryMaxBackoff)
+	v.SetDefault(gostatsd.ParamMaxConcurrentCloudRequests, gostatsd.DefaultMaxConcurrentCloudRequests)
+	v.SetDefault(gostatsd.ParamCacheRefreshJitter, gostatsd.DefaultCacheRefreshJitter)
+	v.SetDefault(gostatsd.ParamCacheMaxEntries, gostatsd.DefaultCacheMaxEntries)
+	v.SetDefault(gostatsd.ParamCacheMaxBytes, gostatsd.DefaultCacheMaxBytes)
+	v.SetDefault(gostatsd.ParamCacheEvictionPolicy, gostatsd.DefaultCacheEvictionPolicy)
+	v.SetDefault(gostatsd.ParamCachePersistDir, gostatsd.DefaultCachePersistDir)
+	v.SetDefault(gostatsd.ParamCachePersistPeriod, gostatsd.DefaultCachePersistPeriod)
 	v.SetDefault(gostatsd.ParamMaxCloudRequests, gostatsd.DefaultMaxCloudRequests)
 	v.SetDefault(gostatsd.ParamBurstCloudRequests, gostatsd.DefaultBurstCloudRequests)
 
@@ -270,7 +649,24 @@ func newCachedInstancesFromViper(logger logrus.FieldLogger, cloudProvider gostat
 		CacheEvictAfterIdlePeriod: v.GetDuration(gostatsd.ParamCacheEvictAfterIdlePeriod),
 		CacheTTL:                  v.GetDuration(gostatsd.ParamCacheTTL),
 		CacheNegativeTTL:          v.GetDuration(gostatsd.ParamCacheNegativeTTL),
+		CacheRetryBackoff:         v.GetDuration(gostatsd.ParamCacheRetryBackoff),
+		CacheRetryMaxBackoff:      v.GetDuration(gostatsd.ParamCacheRetryMaxBackoff),
+		MaxConcurrentLookups:      v.GetInt(gostatsd.ParamMaxConcurrentCloudRequests),
+		CachePersistDir:           v.GetString(gostatsd.ParamCachePersistDir),
+		CachePersistPeriod:        v.GetDuration(gostatsd.ParamCachePersistPeriod),
+		CacheRefreshJitter:        v.GetFloat64(gostatsd.ParamCacheRefreshJitter),
+		CacheMaxEntries:           v.GetInt(gostatsd.ParamCacheMaxEntries),
+		CacheMaxBytes:             v.GetInt64(gostatsd.ParamCacheMaxBytes),
+		CacheEvictionPolicy:       v.GetString(gostatsd.ParamCacheEvictionPolicy),
+	}
+	if cacheOptions.CacheRefreshJitter < 0 || cacheOptions.CacheRefreshJitter >= 1 {
+		return nil, fmt.Errorf("%s must be at least 0 and less than 1", gostatsd.ParamCacheRefreshJitter)
+	}
+	switch cacheOptions.CacheEvictionPolicy {
+	case gostatsd.CacheEvictionLRU, gostatsd.CacheEvictionLFU:
+	default:
+		return nil, fmt.Errorf("unknown %s %q", gostatsd.ParamCacheEvictionPolicy, cacheOptions.CacheEvictionPolicy)
 	}
 	limiter := rate.NewLimiter(rate.Limit(v.GetInt(gostatsd.ParamMaxCloudRequests)), v.GetInt(gostatsd.ParamBurstCloudRequests))
-	return cloudprovider.NewCachedCloudProvider(logger, limiter, cloudProvider, cacheOptions)
+	return cloudprovider.NewCachedCloudProvider(logger, limiter, cloudProvider, cacheOptions), nil
 }
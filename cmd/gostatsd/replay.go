@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/backends"
+	"github.com/hligit/gostatsd/pkg/deadletter"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+// replayOptions are the flags of the replay-dlq command, which sends archives from the dead letter directory.
+type replayOptions struct {
+	backend string
+	keep    bool
+	timeout time.Duration
+}
+
+func (ro *replayOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&ro.backend, "backend", "", "Backend to send every archive to, instead of the backend which dropped it")
+	fs.BoolVar(&ro.keep, "keep", false, "Keep archives once they are sent, instead of removing them")
+	fs.DurationVar(&ro.timeout, "timeout", 5*time.Minute, "Maximum time to spend sending")
+}
+
+// replay sends each archive given, or every archive in the dead letter directory if none are given, to the backend
+// which dropped it, oldest first.  Archives which are sent are removed, and those which fail are kept, so the command
+// can be run again.
+func (ro *replayOptions) replay(v *viper.Viper, paths []string) error {
+	if len(paths) == 0 {
+		dir := v.GetString(gostatsd.ParamDeadLetterPath)
+		if dir == "" {
+			return fmt.Errorf("no archives given, and %s is not configured", gostatsd.ParamDeadLetterPath)
+		}
+		var err error
+		if paths, err = deadletter.List(dir); err != nil {
+			return fmt.Errorf("failed to list %s: %v", dir, err)
+		}
+		if len(paths) == 0 {
+			logrus.Infof("No archives in %s", dir)
+			return nil
+		}
+	}
+	// Archives which fail again are kept where they are, rather than archived a second time
+	v.Set(gostatsd.ParamDeadLetterPath, "")
+
+	logger := logrus.StandardLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), ro.timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	pool := transport.NewTransportPool(logger, v)
+	created := map[string]*backends.ReloadableBackend{}
+	getBackend := func(name string) (*backends.ReloadableBackend, error) {
+		if backend, ok := created[name]; ok {
+			return backend, nil
+		}
+		backend, err := backends.NewReloadableBackend(name, v, logger, pool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backend %q: %v", name, err)
+		}
+		created[name] = backend
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backend.Run(ctx)
+		}()
+		return backend, nil
+	}
+
+	var errs []string
+	replayed := 0
+	for _, path := range paths {
+		if err := ro.replayArchive(ctx, path, getBackend); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		replayed++
+		if !ro.keep {
+			if err := os.Remove(path); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to remove %s: %v", path, err))
+			}
+		}
+	}
+	logger.Infof("Replayed %d of %d archives", replayed, len(paths))
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// replayArchive sends the archive at path to its backend.
+func (ro *replayOptions) replayArchive(ctx context.Context, path string, getBackend func(string) (*backends.ReloadableBackend, error)) error {
+	record, err := deadletter.Read(path)
+	if err != nil {
+		return err
+	}
+	name := record.Backend
+	if ro.backend != "" {
+		name = ro.backend
+	}
+	backend, err := getBackend(name)
+	if err != nil {
+		return err
+	}
+
+	if record.Event != nil {
+		if err := backend.SendEvent(ctx, record.Event); err != nil {
+			return fmt.Errorf("failed to send %s to %s: %v", path, name, err)
+		}
+		return nil
+	}
+	done := make(chan []error, 1)
+	backend.SendMetricsAsync(ctx, record.Metrics, func(sendErrs []error) {
+		done <- sendErrs
+	})
+	select {
+	case sendErrs := <-done:
+		for _, err := range sendErrs {
+			if err != nil {
+				return fmt.Errorf("failed to send %s to %s: %v", path, name, err)
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send %s to %s: %v", path, name, ctx.Err())
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/backends"
+	"github.com/hligit/gostatsd/pkg/statsd"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+// sendOptions are the flags of the send command, which sends metrics and events for smoke testing.
+type sendOptions struct {
+	address string
+	direct  bool
+	timeout time.Duration
+}
+
+func (so *sendOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&so.address, "address", "localhost:8125", "Address of the running gostatsd to send to")
+	fs.BoolVar(&so.direct, "direct", false, "Send directly to the backends in the configuration, instead of to a running gostatsd")
+	fs.DurationVar(&so.timeout, "timeout", 10*time.Second, "Maximum time to spend sending")
+}
+
+// send validates every line as a metric or event in the statsd format, and sends them to a running gostatsd, or
+// directly to the backends in the configuration.  The lines are read from stdin if none are given.
+func (so *sendOptions) send(v *viper.Viper, lines []string) error {
+	if len(lines) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read stdin: %v", err)
+		}
+	}
+	if len(lines) == 0 {
+		return errors.New("nothing to send, give metrics or events as arguments or on stdin")
+	}
+
+	// A running gostatsd applies its own namespace
+	namespace := ""
+	if so.direct {
+		namespace = v.GetString(gostatsd.ParamNamespace)
+	}
+	var metrics []*gostatsd.Metric
+	var events []*gostatsd.Event
+	for _, line := range lines {
+		m, e, err := statsd.ParseLine([]byte(line), namespace)
+		if err != nil {
+			return fmt.Errorf("invalid line %q: %v", line, err)
+		}
+		if m != nil {
+			metrics = append(metrics, m)
+		}
+		if e != nil {
+			events = append(events, e)
+		}
+	}
+
+	if so.direct {
+		return so.sendToBackends(v, metrics, events)
+	}
+	return so.sendToServer(lines)
+}
+
+// sendToServer sends each line in its own datagram to the running gostatsd.
+func (so *sendOptions) sendToServer(lines []string) error {
+	conn, err := net.DialTimeout("udp", so.address, so.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(so.timeout)); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return fmt.Errorf("failed to send to %s: %v", so.address, err)
+		}
+	}
+	logrus.Infof("Sent %d lines to %s", len(lines), so.address)
+	return nil
+}
+
+// sendToBackends aggregates the metrics as a single flush, and sends them and the events to every backend in the
+// configuration, as the server would.
+func (so *sendOptions) sendToBackends(v *viper.Viper, metrics []*gostatsd.Metric, events []*gostatsd.Event) error {
+	logger := logrus.StandardLogger()
+	backendNames := v.GetStringSlice(gostatsd.ParamBackends)
+	if len(backendNames) == 0 {
+		return fmt.Errorf("no %s are configured", gostatsd.ParamBackends)
+	}
+	percentThresholds, disabled, err := gostatsd.AggregatedTimerSettings(v, backendNames)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", gostatsd.ParamPercentThreshold, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), so.timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	pool := transport.NewTransportPool(logger, v)
+	backendsList := make([]*backends.ReloadableBackend, 0, len(backendNames))
+	for _, name := range backendNames {
+		backend, err := backends.NewReloadableBackend(name, v, logger, pool)
+		if err != nil {
+			return fmt.Errorf("failed to create backend %q: %v", name, err)
+		}
+		backendsList = append(backendsList, backend)
+		wg.Add(1)
+		go func(backend *backends.ReloadableBackend) {
+			defer wg.Done()
+			backend.Run(ctx)
+		}(backend)
+	}
+
+	now := time.Now()
+	aggregator := statsd.NewMetricAggregator(percentThresholds, 0, 0, 0, 0, disabled, v.GetUint32(gostatsd.ParamTimerHistogramLimit), 1, 0, 0)
+	mm := gostatsd.NewMetricMap()
+	for _, m := range metrics {
+		m.Timestamp = gostatsd.Nanotime(now.UnixNano())
+		mm.Receive(m)
+	}
+	aggregator.ReceiveMap(mm)
+	aggregator.Flush(v.GetDuration(gostatsd.ParamFlushInterval))
+
+	var errs []string
+	aggregator.Process(func(mm *gostatsd.MetricMap) {
+		for _, backend := range backendsList {
+			if len(metrics) > 0 {
+				done := make(chan []error, 1)
+				backend.SendMetricsAsync(ctx, mm, func(sendErrs []error) {
+					done <- sendErrs
+				})
+				select {
+				case sendErrs := <-done:
+					for _, err := range sendErrs {
+						if err != nil {
+							errs = append(errs, fmt.Sprintf("failed to send metrics to %s: %v", backend.Name(), err))
+						}
+					}
+				case <-ctx.Done():
+					errs = append(errs, fmt.Sprintf("failed to send metrics to %s: %v", backend.Name(), ctx.Err()))
+				}
+			}
+			for _, e := range events {
+				if e.DateHappened == 0 {
+					e.DateHappened = now.Unix()
+				}
+				if err := backend.SendEvent(ctx, e); err != nil {
+					errs = append(errs, fmt.Sprintf("failed to send event to %s: %v", backend.Name(), err))
+				}
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	logger.Infof("Sent %d metrics and %d events to %s", len(metrics), len(events), strings.Join(backendNames, ", "))
+	return nil
+}
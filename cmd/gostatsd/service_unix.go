@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+// runService runs the server.  Under systemd with Type=notify, it is notified by notifyReady and notifyStopping.
+func runService(drainTimeout time.Duration, run func() error) error {
+	return run()
+}
+
+// manageService installs or uninstalls the Windows service.
+func manageService(args []string) error {
+	return errors.New("the service command is only supported on Windows, use a systemd unit with Type=notify instead")
+}
+
+// drainRequests returns the channel which triggers a drain.
+func drainRequests() <-chan os.Signal {
+	return notifySignals(drainSignals)
+}
+
+// notifyReady tells systemd the server is receiving metrics, if it was started with Type=notify.
+func notifyReady() {
+	sdNotify(util.SdReady)
+}
+
+// notifyStopping tells systemd the server is stopping, if it was started with Type=notify.
+func notifyStopping() {
+	sdNotify(util.SdStopping)
+}
+
+// serviceWatchdog returns a Runnable which keeps the systemd watchdog from restarting the server, or nil if the unit
+// has no WatchdogSec.
+func serviceWatchdog() gostatsd.Runnable {
+	interval := util.SdWatchdogInterval()
+	if interval == 0 {
+		return nil
+	}
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sdNotify(util.SdWatchdog)
+			}
+		}
+	}
+}
+
+func sdNotify(state string) {
+	if _, err := util.SdNotify(state); err != nil {
+		logrus.WithError(err).WithField("state", state).Warn("Failed to notify systemd")
+	}
+}
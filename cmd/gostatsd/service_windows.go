@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/hligit/gostatsd"
+)
+
+const (
+	// serviceName is the name the server is registered with the service control manager as.
+	serviceName = "gostatsd"
+	// serviceStopGrace is the time the service control manager is told stopping takes, on top of the drain.
+	serviceStopGrace = 10 * time.Second
+)
+
+var (
+	// serviceDrain triggers a drain when the service is stopped, nil unless the process is a service.
+	serviceDrain chan os.Signal
+	// serviceReady is closed once the server is receiving metrics, nil unless the process is a service.
+	serviceReady chan struct{}
+)
+
+// runService runs the server under the service control manager, if the process was started by it.  Stopping the
+// service drains the server.
+func runService(drainTimeout time.Duration, run func() error) error {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return fmt.Errorf("failed to detect if running as a service: %v", err)
+	}
+	if interactive {
+		return run()
+	}
+	serviceDrain = make(chan os.Signal, 1)
+	serviceReady = make(chan struct{})
+	return svc.Run(serviceName, &windowsService{run: run, drainTimeout: drainTimeout})
+}
+
+// windowsService runs the server, and relays the requests of the service control manager to it.
+type windowsService struct {
+	run          func() error
+	drainTimeout time.Duration
+}
+
+// Execute reports the service running once the server is receiving metrics, and drains it when the service is
+// stopped, or the machine shuts down.
+func (ws *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- ws.run()
+	}()
+	ready := serviceReady
+	for {
+		select {
+		case <-ready:
+			ready = nil
+			status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+		case err := <-done:
+			if err != nil {
+				logrus.WithError(err).Error("Service failed")
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((ws.drainTimeout + serviceStopGrace) / time.Millisecond)}
+				select {
+				case serviceDrain <- os.Interrupt:
+				default:
+					// Already draining
+				}
+			}
+		}
+	}
+}
+
+// manageService installs the service with the arguments given after install, which the server is run with, or
+// uninstalls it.
+func manageService(args []string) error {
+	if len(args) == 0 || (args[0] != "install" && args[0] != "uninstall") {
+		return errors.New("service must be followed by install or uninstall")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	if args[0] == "uninstall" {
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("failed to open service %s: %v", serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to uninstall service %s: %v", serviceName, err)
+		}
+		logrus.Infof("Uninstalled service %s", serviceName)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the executable: %v", err)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "gostatsd",
+		Description: "Statsd server which aggregates metrics and sends them to backends",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{commandRun}, args[1:]...)...)
+	if err != nil {
+		return fmt.Errorf("failed to install service %s: %v", serviceName, err)
+	}
+	s.Close()
+	logrus.Infof("Installed service %s", serviceName)
+	return nil
+}
+
+// drainRequests returns the channel which triggers a drain.
+func drainRequests() <-chan os.Signal {
+	if serviceDrain != nil {
+		return serviceDrain
+	}
+	return notifySignals(drainSignals)
+}
+
+// notifyReady reports the service running, if the process is a service.
+func notifyReady() {
+	if serviceReady != nil {
+		close(serviceReady)
+	}
+}
+
+// notifyStopping does nothing, as the service is reported stopping when the stop is requested.
+func notifyStopping() {
+}
+
+// serviceWatchdog returns nil, as the service control manager has no watchdog.
+func serviceWatchdog() gostatsd.Runnable {
+	return nil
+}
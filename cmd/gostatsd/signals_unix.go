@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// flushSignals are the signals which trigger an immediate flush.
+var flushSignals = []os.Signal{syscall.SIGUSR1}
+
+// reloadSignals are the signals which trigger a reload of the configuration.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// logLevelSignals are the signals which toggle debug logging.
+var logLevelSignals = []os.Signal{syscall.SIGUSR2}
+
+// drainSignals are the signals which trigger a drain, after which the server exits.
+var drainSignals = []os.Signal{syscall.SIGQUIT}
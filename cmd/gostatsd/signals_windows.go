@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+)
+
+// flushSignals are the signals which trigger an immediate flush.  Windows has no SIGUSR1.
+var flushSignals []os.Signal
+
+// reloadSignals are the signals which trigger a reload of the configuration.  Windows has no SIGHUP.
+var reloadSignals []os.Signal
+
+// logLevelSignals are the signals which toggle debug logging.  Windows has no SIGUSR2.
+var logLevelSignals []os.Signal
+
+// drainSignals are the signals which trigger a drain, after which the server exits.  Windows has no SIGQUIT.
+var drainSignals []os.Signal
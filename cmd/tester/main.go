@@ -47,6 +47,8 @@ func main() {
 			MaxReaders:            gostatsd.DefaultMaxReaders,
 			MaxWorkers:            gostatsd.DefaultMaxWorkers,
 			MaxQueueSize:          gostatsd.DefaultMaxQueueSize,
+			DispatchBatchSize:     gostatsd.DefaultDispatchBatchSize,
+			DispatchBatchDelay:    gostatsd.DefaultDispatchBatchDelay,
 			PercentThreshold:      gostatsd.DefaultPercentThreshold,
 			ReceiveBatchSize:      gostatsd.DefaultReceiveBatchSize,
 			Viper:                 viper.New(),
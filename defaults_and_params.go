@@ -21,6 +21,16 @@ var DefaultMaxReaders = minInt(8, runtime.NumCPU())
 // DefaultMaxWorkers is the default number of goroutines that aggregate metrics.
 var DefaultMaxWorkers = runtime.NumCPU()
 
+// DefaultAggregatorShards is the default number of shards each aggregator splits its metrics into.
+const DefaultAggregatorShards = 1
+
+// DefaultAggregatorMaxSeries is the default limit on the number of series in each aggregator, 0 for no limit.
+const DefaultAggregatorMaxSeries = 0
+
+// DefaultAggregatorMaxSamples is the default limit on the number of timer and set values in each aggregator, 0 for no
+// limit.
+const DefaultAggregatorMaxSamples = 0
+
 // DefaultMaxParsers is the default number of goroutines that parse datagrams into metrics.
 var DefaultMaxParsers = runtime.NumCPU()
 
@@ -57,12 +67,27 @@ const (
 	DefaultFlushOffset = 0
 	// DefaultFlushOffset is the default for whether metric flushing should be aligned
 	DefaultFlushAligned = false
+	// DefaultFlushJitter is the default maximum random delay of each flush, 0 to disable
+	DefaultFlushJitter = time.Duration(0)
+	// DefaultFlushSplay is the default maximum random delay of each backend sending a flush, 0 to disable
+	DefaultFlushSplay = time.Duration(0)
+	// DefaultFlushQueueSize is the default number of flushes queued for each backend while it sends an earlier flush
+	DefaultFlushQueueSize = 2
 	// DefaultIgnoreHost is the default value for whether the source should be used as the host
 	DefaultIgnoreHost = false
 	// DefaultMetricsAddr is the default address on which to listen for metrics.
 	DefaultMetricsAddr = ":8125"
+	// DefaultMetricsSocket is the default path of the unix socket on which to listen for metrics, empty to disable it.
+	DefaultMetricsSocket = ""
+	// DefaultOriginDetection is the default of whether the container of the sender of metrics on the unix socket is
+	// detected.
+	DefaultOriginDetection = false
 	// DefaultMaxQueueSize is the default maximum number of buffered metrics per worker.
 	DefaultMaxQueueSize = 10000 // arbitrary
+	// DefaultDispatchBatchSize is the default number of series accumulated for a worker before they are sent to it.
+	DefaultDispatchBatchSize = 1000
+	// DefaultDispatchBatchDelay is the default interval at which partially filled batches are sent to the workers.
+	DefaultDispatchBatchDelay = 100 * time.Millisecond
 	// DefaultMaxConcurrentEvents is the default maximum number of events sent concurrently.
 	DefaultMaxConcurrentEvents = 1024 // arbitrary
 	// DefaultCacheRefreshPeriod is the default cache refresh period.
@@ -73,10 +98,40 @@ const (
 	DefaultCacheTTL = 30 * time.Minute
 	// DefaultCacheNegativeTTL is the default cache TTL for failed lookups (errors or when instance was not found).
 	DefaultCacheNegativeTTL = 1 * time.Minute
+	// DefaultCacheRetryBackoff is the default initial backoff before retrying a failed lookup.
+	DefaultCacheRetryBackoff = DefaultCacheNegativeTTL
+	// DefaultCacheRetryMaxBackoff is the default maximum backoff before retrying a failed lookup.
+	DefaultCacheRetryMaxBackoff = 10 * time.Minute
+	// DefaultMaxConcurrentCloudRequests is the default maximum number of cloud provider requests in flight at once.
+	DefaultMaxConcurrentCloudRequests = 1
+	// DefaultCacheRefreshJitter is the default fraction of the TTL before expiry that cache entries may be refreshed.
+	DefaultCacheRefreshJitter = 0.1
+	// DefaultCacheMaxEntries is the default maximum number of entries in the cache. 0 means unlimited.
+	DefaultCacheMaxEntries = 0
+	// DefaultCacheMaxBytes is the default maximum estimated memory used by the cache. 0 means unlimited.
+	DefaultCacheMaxBytes = 0
+	// DefaultCacheEvictionPolicy is the default policy for evicting entries from a full cache.
+	DefaultCacheEvictionPolicy = CacheEvictionLRU
+	// DefaultCachePersistDir is the default directory to persist the cache to. "" disables persistence.
+	DefaultCachePersistDir = ""
+	// DefaultCachePersistPeriod is the default period for persisting the cache.
+	DefaultCachePersistPeriod = 1 * time.Minute
+	// DefaultCloudStripSourceZone is the default for ignoring the zone of IPv6 sources when looking up instances.
+	DefaultCloudStripSourceZone = false
 	// DefaultInternalNamespace is the default internal namespace
 	DefaultInternalNamespace = "statsd"
 	// DefaultHeartbeatEnabled is the default heartbeat enabled flag
 	DefaultHeartbeatEnabled = false
+	// DefaultRuntimeMetricsEnabled is the default runtime metrics enabled flag
+	DefaultRuntimeMetricsEnabled = false
+	// DefaultDroppedSummaryInterval is the default interval to log a summary of dropped data, 0 to disable
+	DefaultDroppedSummaryInterval = time.Duration(0)
+	// DefaultMemoryLimit is the default size of the heap at which the memory limiter applies mitigation, 0 to disable
+	DefaultMemoryLimit = "0"
+	// DefaultGoMaxProcs is the default GOMAXPROCS, 0 to set it from the CPU limit of the container
+	DefaultGoMaxProcs = 0
+	// DefaultGoMemLimit is the default GOMEMLIMIT, auto to set it from the memory limit of the container
+	DefaultGoMemLimit = "auto"
 	// DefaultReceiveBatchSize is the number of datagrams to read in each receive batch
 	DefaultReceiveBatchSize = 50
 	// DefaultEstimatedTags is the estimated number of expected tags on an individual metric submitted externally
@@ -93,11 +148,93 @@ const (
 	DefaultTimerHistogramLimit = math.MaxUint32
 	// DefaultLogRawMetric is the default value for whether to log the metrics received from network
 	DefaultLogRawMetric = false
+	// DefaultTraceOTLPAddress is the default address of the OTLP collector to export traces to. "" disables tracing.
+	DefaultTraceOTLPAddress = ""
+	// DefaultTraceOTLPInsecure is the default for whether to connect to the OTLP collector without TLS.
+	DefaultTraceOTLPInsecure = false
+	// DefaultTraceSampleRatio is the default fraction of traces which are sampled.
+	DefaultTraceSampleRatio = 1.0
+	// DefaultProfilingPushURL is the default URL of the pprof ingestion endpoint to push profiles to. "" disables pushing.
+	DefaultProfilingPushURL = ""
+	// DefaultProfilingAppName is the default name of the application pushed profiles belong to.
+	DefaultProfilingAppName = "gostatsd"
+	// DefaultProfilingInterval is the default interval at which profiles are pushed.
+	DefaultProfilingInterval = 1 * time.Minute
+	// DefaultProfilingCPUDuration is the default time the CPU is profiled for each time profiles are captured.
+	DefaultProfilingCPUDuration = 10 * time.Second
+	// DefaultProfilingDir is the default directory triggered profiles are written to. "" disables triggered profiles.
+	DefaultProfilingDir = ""
+	// DefaultProfilingTriggerCooldown is the default minimum time between triggered profiles.
+	DefaultProfilingTriggerCooldown = 10 * time.Minute
+	// DefaultSecretRefreshInterval is the default interval at which secrets are resolved again. 0 disables it.
+	DefaultSecretRefreshInterval = 5 * time.Minute
+	// DefaultConfigWatchInterval is the default interval at which the configuration file is checked for changes. 0
+	// disables it.
+	DefaultConfigWatchInterval = time.Duration(0)
+	// DefaultDrainTimeout is the default time a drain triggered by a signal is given to finish.
+	DefaultDrainTimeout = 30 * time.Second
+	// DefaultShutdownFlushTimeout is the default time the final flush is given when the server is stopped.
+	DefaultShutdownFlushTimeout = 10 * time.Second
+	// DefaultHAPeerURL is the default health endpoint of the peer of an active-active pair, empty to disable HA.
+	DefaultHAPeerURL = ""
+	// DefaultHAIndex is the default half of the series owned by a server of an active-active pair.
+	DefaultHAIndex = 0
+	// DefaultHACheckInterval is the default interval at which the health of the peer of an active-active pair is checked.
+	DefaultHACheckInterval = 5 * time.Second
+	// DefaultLeaderElectionLease is the default name of the Kubernetes Lease used to elect a leader, empty to disable
+	// leader election.
+	DefaultLeaderElectionLease = ""
+	// DefaultLeaderElectionNamespace is the default namespace of the Lease, empty for the namespace of the pod.
+	DefaultLeaderElectionNamespace = ""
+	// DefaultLeaderElectionIdentity is the default identity of this server in the election, empty for the hostname.
+	DefaultLeaderElectionIdentity = ""
+	// DefaultLeaderElectionLeaseDuration is the default time other replicas wait before taking over the Lease of a
+	// leader which stopped renewing it.
+	DefaultLeaderElectionLeaseDuration = 15 * time.Second
+	// DefaultLeaderElectionRenewDeadline is the default time the leader keeps retrying to renew the Lease, before it
+	// stops being the leader.
+	DefaultLeaderElectionRenewDeadline = 10 * time.Second
+	// DefaultLeaderElectionRetryPeriod is the default interval between attempts to acquire or renew the Lease.
+	DefaultLeaderElectionRetryPeriod = 2 * time.Second
+	// DefaultEventThrottleWindow is the default window in which repeated events are suppressed, 0 to disable it.
+	DefaultEventThrottleWindow = time.Duration(0)
+	// DefaultEventThrottlePerKey is the default number of events sent for each key in a window, 0 for no limit.
+	DefaultEventThrottlePerKey = 0
+	// DefaultClusterMembers is the default space separated list of the members of a cluster, empty to disable clustering.
+	DefaultClusterMembers = ""
+	// DefaultClusterSelf is the default address of this server in the list of the members of a cluster.
+	DefaultClusterSelf = ""
+	// DefaultRelayDownstreams is the default space separated list of the statsd servers metrics are relayed to in relay
+	// mode.
+	DefaultRelayDownstreams = ""
+	// DefaultRelayTCPTransport is the default of whether metrics are relayed over TCP, rather than UDP.
+	DefaultRelayTCPTransport = false
+	// DefaultShadowBackends is the default space separated list of the backends a copy of every flush is sent to,
+	// empty to disable mirroring.
+	DefaultShadowBackends = ""
+	// DefaultShadowPercentage is the default percentage of the series of every flush sent to the shadow backends.
+	DefaultShadowPercentage = 100.0
+	// DefaultRetryBudgetRatio is the default retries allowed per payload sent by every backend together, 0 to allow
+	// every retry.
+	DefaultRetryBudgetRatio = 0.0
+	// DefaultRetryBudgetMinPerSecond is the default retries allowed every second, in addition to the ratio.
+	DefaultRetryBudgetMinPerSecond = 1.0
+	// DefaultDeadLetterPath is the default directory where data finally dropped by backends is archived, empty to
+	// disable it.
+	DefaultDeadLetterPath = ""
+	// DefaultDeadLetterMaxBytes is the default maximum size of the dead letter directory.
+	DefaultDeadLetterMaxBytes = "1GiB"
+	// DefaultVaultAddress is the default address of Vault.  "" uses VAULT_ADDR.
+	DefaultVaultAddress = ""
+	// DefaultVaultToken is the default token used to read secrets from Vault.  "" uses VAULT_TOKEN.
+	DefaultVaultToken = ""
 )
 
 const (
 	// ParamBackends is the name of parameter with backends.
 	ParamBackends = "backends"
+	// ParamInternalBackends is the name of parameter with the backends internal metrics are sent to.
+	ParamInternalBackends = "internal-backends"
 	// ParamCloudProvider is the name of parameter with the name of cloud provider.
 	ParamCloudProvider = "cloud-provider"
 	// ParamMaxCloudRequests is the name of parameter with maximum number of cloud provider requests per second.
@@ -110,6 +247,10 @@ const (
 	ParamInternalTags = "internal-tags"
 	// ParamInternalNamespace is the name of parameter with the namespace for internal metrics.
 	ParamInternalNamespace = "internal-namespace"
+	// ParamInternalMetricsRename is the name of parameter with the list of internal metrics to rename.
+	ParamInternalMetricsRename = "internal-metrics-rename"
+	// ParamInternalMetricsDisabled is the name of parameter with the list of internal metrics which are not sent.
+	ParamInternalMetricsDisabled = "internal-metrics-disabled"
 	// ParamExpiryInterval is the name of parameter with expiry interval for metrics.
 	ParamExpiryInterval = "expiry-interval"
 	// ParamExpiryIntervalCounter is the name of parameter which overrides counter expiry interval for metrics.
@@ -126,6 +267,12 @@ const (
 	ParamFlushOffset = "flush-offset"
 	// ParamFlushInterval is the name of parameter with metrics flush interval alignment enable state.
 	ParamFlushAligned = "flush-aligned"
+	// ParamFlushJitter is the name of parameter with the maximum random delay of each flush.
+	ParamFlushJitter = "flush-jitter"
+	// ParamFlushSplay is the name of parameter with the maximum random delay of each backend sending a flush.
+	ParamFlushSplay = "flush-splay"
+	// ParamFlushQueueSize is the name of parameter with the number of flushes queued for each backend.
+	ParamFlushQueueSize = "flush-queue-size"
 	// ParamIgnoreHost is the name of parameter indicating if the source should be used as the host
 	ParamIgnoreHost = "ignore-host"
 	// ParamMaxReaders is the name of parameter with number of socket readers.
@@ -134,8 +281,18 @@ const (
 	ParamMaxParsers = "max-parsers"
 	// ParamMaxWorkers is the name of parameter with number of goroutines that aggregate metrics.
 	ParamMaxWorkers = "max-workers"
+	// ParamAggregatorShards is the name of parameter with number of shards each aggregator splits its metrics into.
+	ParamAggregatorShards = "aggregator-shards"
+	// ParamAggregatorMaxSeries is the name of parameter with the limit on the number of series in each aggregator.
+	ParamAggregatorMaxSeries = "aggregator-max-series"
+	// ParamAggregatorMaxSamples is the name of parameter with the limit on the number of timer and set values in each aggregator.
+	ParamAggregatorMaxSamples = "aggregator-max-samples"
 	// ParamMaxQueueSize is the name of parameter with maximum number of buffered metrics per worker.
 	ParamMaxQueueSize = "max-queue-size"
+	// ParamDispatchBatchSize is the name of parameter with number of series accumulated for a worker before they are sent to it.
+	ParamDispatchBatchSize = "dispatch-batch-size"
+	// ParamDispatchBatchDelay is the name of parameter with interval at which partially filled batches are sent to the workers.
+	ParamDispatchBatchDelay = "dispatch-batch-delay"
 	// ParamMaxConcurrentEvents is the name of parameter with maximum number of events sent concurrently.
 	ParamMaxConcurrentEvents = "max-concurrent-events"
 	// ParamEstimatedTags is the name of parameter with estimated number of tags per metric
@@ -146,10 +303,35 @@ const (
 	ParamCacheEvictAfterIdlePeriod = "cloud-cache-evict-after-idle-period"
 	// ParamCacheTTL is the name of parameter with cache TTL for successful lookups.
 	ParamCacheTTL = "cloud-cache-ttl"
-	// ParamCacheNegativeTTL is the name of parameter with cache TTL for failed lookups (errors or when instance was not found).
+	// ParamCacheNegativeTTL is the name of parameter with cache TTL for lookups where the instance was not found.
 	ParamCacheNegativeTTL = "cloud-cache-negative-ttl"
+	// ParamCacheRetryBackoff is the name of parameter with the initial backoff before retrying a failed lookup.
+	ParamCacheRetryBackoff = "cloud-cache-retry-backoff"
+	// ParamCacheRetryMaxBackoff is the name of parameter with the maximum backoff before retrying a failed lookup.
+	ParamCacheRetryMaxBackoff = "cloud-cache-retry-max-backoff"
+	// ParamMaxConcurrentCloudRequests is the name of parameter with maximum number of cloud provider requests in flight at once.
+	ParamMaxConcurrentCloudRequests = "max-concurrent-cloud-requests"
+	// ParamCacheRefreshJitter is the name of parameter with the fraction of the TTL before expiry that cache entries may be refreshed.
+	ParamCacheRefreshJitter = "cloud-cache-refresh-jitter"
+	// ParamCacheMaxEntries is the name of parameter with the maximum number of entries in the cache.
+	ParamCacheMaxEntries = "cloud-cache-max-entries"
+	// ParamCacheMaxBytes is the name of parameter with the maximum estimated memory used by the cache.
+	ParamCacheMaxBytes = "cloud-cache-max-bytes"
+	// ParamCacheEvictionPolicy is the name of parameter with the policy for evicting entries from a full cache.
+	ParamCacheEvictionPolicy = "cloud-cache-eviction-policy"
+	// ParamCachePersistDir is the name of parameter with the directory to persist the cache to.
+	ParamCachePersistDir = "cloud-cache-persist-dir"
+	// ParamCachePersistPeriod is the name of parameter with the period for persisting the cache.
+	ParamCachePersistPeriod = "cloud-cache-persist-period"
+	// ParamCloudStripSourceZone is the name of parameter for ignoring the zone of IPv6 sources when looking up instances.
+	ParamCloudStripSourceZone = "cloud-strip-source-zone"
 	// ParamMetricsAddr is the name of parameter with address on which to listen for metrics.
 	ParamMetricsAddr = "metrics-addr"
+	// ParamMetricsSocket is the name of parameter with the path of the unix socket on which to listen for metrics.
+	ParamMetricsSocket = "metrics-socket"
+	// ParamOriginDetection is the name of parameter with whether the container of the sender of metrics on the unix
+	// socket is detected.
+	ParamOriginDetection = "origin-detection"
 	// ParamNamespace is the name of parameter with namespace for all metrics.
 	ParamNamespace = "namespace"
 	// ParamStatserType is the name of parameter with type of statser.
@@ -158,6 +340,16 @@ const (
 	ParamPercentThreshold = "percent-threshold"
 	// ParamHeartbeatEnabled is the name of the parameter with the heartbeat enabled
 	ParamHeartbeatEnabled = "heartbeat-enabled"
+	// ParamRuntimeMetricsEnabled is the name of the parameter with the runtime metrics enabled
+	ParamRuntimeMetricsEnabled = "runtime-metrics-enabled"
+	// ParamDroppedSummaryInterval is the name of the parameter with the interval to log a summary of dropped data
+	ParamDroppedSummaryInterval = "dropped-summary-interval"
+	// ParamMemoryLimit is the name of the parameter with the size of the heap at which the memory limiter applies mitigation
+	ParamMemoryLimit = "memory-limit"
+	// ParamGoMaxProcs is the name of the parameter with the GOMAXPROCS of the server
+	ParamGoMaxProcs = "gomaxprocs"
+	// ParamGoMemLimit is the name of the parameter with the GOMEMLIMIT of the server
+	ParamGoMemLimit = "gomemlimit"
 	// ParamReceiveBatchSize is the name of the parameter with the number of datagrams to read in each receive batch
 	ParamReceiveBatchSize = "receive-batch-size"
 	// ParamConnPerReader is the name of the parameter indicating whether to create a connection per reader
@@ -172,6 +364,85 @@ const (
 	ParamTimerHistogramLimit = "timer-histogram-limit"
 	// ParamLogRawMetric enables custom metrics to be printed to stdout
 	ParamLogRawMetric = "log-raw-metric"
+	// ParamTraceOTLPAddress is the name of parameter with the address of the OTLP collector to export traces to.
+	ParamTraceOTLPAddress = "trace-otlp-address"
+	// ParamTraceOTLPInsecure is the name of parameter indicating whether to connect to the OTLP collector without TLS.
+	ParamTraceOTLPInsecure = "trace-otlp-insecure"
+	// ParamTraceSampleRatio is the name of parameter with the fraction of traces which are sampled.
+	ParamTraceSampleRatio = "trace-sample-ratio"
+	// ParamProfilingPushURL is the name of parameter with the URL of the pprof ingestion endpoint to push profiles to.
+	ParamProfilingPushURL = "profiling-push-url"
+	// ParamProfilingAppName is the name of parameter with the name of the application pushed profiles belong to.
+	ParamProfilingAppName = "profiling-app-name"
+	// ParamProfilingInterval is the name of parameter with the interval at which profiles are pushed.
+	ParamProfilingInterval = "profiling-interval"
+	// ParamProfilingCPUDuration is the name of parameter with the time the CPU is profiled for each time profiles are captured.
+	ParamProfilingCPUDuration = "profiling-cpu-duration"
+	// ParamProfilingDir is the name of parameter with the directory triggered profiles are written to.
+	ParamProfilingDir = "profiling-dir"
+	// ParamProfilingTriggerCooldown is the name of parameter with the minimum time between triggered profiles.
+	ParamProfilingTriggerCooldown = "profiling-trigger-cooldown"
+	// ParamSecretRefreshInterval is the name of parameter with the interval at which secrets are resolved again.
+	ParamSecretRefreshInterval = "secret-refresh-interval"
+	// ParamConfigWatchInterval is the name of parameter with the interval at which the configuration file is checked for
+	// changes.
+	ParamConfigWatchInterval = "config-watch-interval"
+	// ParamDrainTimeout is the name of parameter with the time a drain triggered by a signal is given to finish.
+	ParamDrainTimeout = "drain-timeout"
+	// ParamShutdownFlushTimeout is the name of parameter with the time the final flush is given when the server is stopped.
+	ParamShutdownFlushTimeout = "shutdown-flush-timeout"
+	// ParamHAPeerURL is the name of parameter with the health endpoint of the peer of an active-active pair.
+	ParamHAPeerURL = "ha-peer-url"
+	// ParamHAIndex is the name of parameter with the half of the series owned by a server of an active-active pair.
+	ParamHAIndex = "ha-index"
+	// ParamHACheckInterval is the name of parameter with the interval at which the health of the peer is checked.
+	ParamHACheckInterval = "ha-check-interval"
+	// ParamLeaderElectionLease is the name of parameter with the name of the Kubernetes Lease used to elect a leader.
+	ParamLeaderElectionLease = "leader-election-lease"
+	// ParamLeaderElectionNamespace is the name of parameter with the namespace of the Lease.
+	ParamLeaderElectionNamespace = "leader-election-namespace"
+	// ParamLeaderElectionIdentity is the name of parameter with the identity of this server in the election.
+	ParamLeaderElectionIdentity = "leader-election-identity"
+	// ParamLeaderElectionLeaseDuration is the name of parameter with the time before the Lease of a leader is taken over.
+	ParamLeaderElectionLeaseDuration = "leader-election-lease-duration"
+	// ParamLeaderElectionRenewDeadline is the name of parameter with the time the leader retries renewing the Lease.
+	ParamLeaderElectionRenewDeadline = "leader-election-renew-deadline"
+	// ParamLeaderElectionRetryPeriod is the name of parameter with the interval between attempts on the Lease.
+	ParamLeaderElectionRetryPeriod = "leader-election-retry-period"
+	// ParamEventThrottleWindow is the name of parameter with the window in which repeated events are suppressed.
+	ParamEventThrottleWindow = "event-throttle-window"
+	// ParamEventThrottlePerKey is the name of parameter with the number of events sent for each key in a window.
+	ParamEventThrottlePerKey = "event-throttle-per-key"
+	// ParamClusterMembers is the name of parameter with the addresses of the members of a cluster, including this server.
+	ParamClusterMembers = "cluster-members"
+	// ParamClusterSelf is the name of parameter with the address of this server in the list of the members of a cluster.
+	ParamClusterSelf = "cluster-self"
+	// ParamRelayDownstreams is the name of parameter with the addresses of the statsd servers metrics are relayed to.
+	ParamRelayDownstreams = "relay-downstreams"
+	// ParamRelayTCPTransport is the name of parameter with whether metrics are relayed over TCP, rather than UDP.
+	ParamRelayTCPTransport = "relay-tcp-transport"
+	// ParamShadowBackends is the name of parameter with the backends a copy of every flush is sent to.
+	ParamShadowBackends = "shadow-backends"
+	// ParamShadowPercentage is the name of parameter with the percentage of the series sent to the shadow backends.
+	ParamShadowPercentage = "shadow-percentage"
+	// ParamRetryBudgetRatio is the name of parameter with the retries allowed per payload sent by every backend together.
+	ParamRetryBudgetRatio = "retry-budget-ratio"
+	// ParamRetryBudgetMinPerSecond is the name of parameter with the retries allowed every second, in addition to the
+	// ratio.
+	ParamRetryBudgetMinPerSecond = "retry-budget-min-per-second"
+	// ParamMetricMetadata is the name of parameter with the names of the metadata sections, which describe the units
+	// and descriptions of metrics.  It is only read from the configuration file.
+	ParamMetricMetadata = "metric-metadata"
+	// ParamDeadLetterPath is the name of parameter with the directory where data finally dropped by backends is archived.
+	ParamDeadLetterPath = "dead-letter-path"
+	// ParamDeadLetterMaxBytes is the name of parameter with the maximum size of the dead letter directory.
+	ParamDeadLetterMaxBytes = "dead-letter-max-bytes"
+	// ParamVaultAddress is the name of parameter with the address of Vault.
+	ParamVaultAddress = "vault-address"
+	// ParamVaultToken is the name of parameter with the token used to read secrets from Vault.
+	ParamVaultToken = "vault-token"
+	// ParamDryRun is the name of parameter which makes backends do everything except send what they would send.
+	ParamDryRun = "dry-run"
 )
 
 // AddFlags adds flags to the specified FlagSet.
@@ -185,34 +456,99 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.Duration(ParamFlushInterval, DefaultFlushInterval, "How often to flush metrics to the backends")
 	fs.Duration(ParamFlushOffset, DefaultFlushOffset, "Flush offset to use when flush alignment is enabled")
 	fs.Bool(ParamFlushAligned, DefaultFlushAligned, "Enable aligned flush interval")
+	fs.Duration(ParamFlushJitter, DefaultFlushJitter, "Maximum random delay of each flush, so many servers do not flush at the same moment")
+	fs.Duration(ParamFlushSplay, DefaultFlushSplay, "Maximum random delay of each backend sending a flush, spreading the sends of a flush over that window")
+	fs.Int(ParamFlushQueueSize, DefaultFlushQueueSize, "Number of flushes queued for each backend while it sends an earlier flush, the oldest is dropped when it is full")
 	fs.Bool(ParamIgnoreHost, DefaultIgnoreHost, "Ignore the source for populating the hostname field of metrics")
 	fs.Int(ParamMaxReaders, DefaultMaxReaders, "Maximum number of socket readers")
 	fs.Int(ParamMaxParsers, DefaultMaxParsers, "Maximum number of workers to parse datagrams into metrics")
 	fs.Int(ParamMaxWorkers, DefaultMaxWorkers, "Maximum number of workers to process metrics")
+	fs.Int(ParamAggregatorShards, DefaultAggregatorShards, "Number of shards each aggregator splits its metrics into, which are flushed in parallel")
+	fs.Int(ParamAggregatorMaxSeries, DefaultAggregatorMaxSeries, "Maximum number of series in each aggregator, above which the series with the least traffic are evicted, 0 for no limit")
+	fs.Int(ParamAggregatorMaxSamples, DefaultAggregatorMaxSamples, "Maximum number of timer and set values in each aggregator, above which the series with the least traffic are evicted, 0 for no limit")
 	fs.Int(ParamMaxQueueSize, DefaultMaxQueueSize, "Maximum number of buffered metrics per worker")
+	fs.Int(ParamDispatchBatchSize, DefaultDispatchBatchSize, "Number of series accumulated for a worker before they are sent to it, 1 or less to send them immediately")
+	fs.Duration(ParamDispatchBatchDelay, DefaultDispatchBatchDelay, "Interval at which partially filled batches are sent to the workers")
 	fs.Int(ParamMaxConcurrentEvents, DefaultMaxConcurrentEvents, "Maximum number of events sent concurrently")
 	fs.Int(ParamEstimatedTags, DefaultEstimatedTags, "Estimated number of expected tags on an individual metric submitted externally")
 	fs.Duration(ParamCacheRefreshPeriod, DefaultCacheRefreshPeriod, "Cloud cache refresh period")
 	fs.Duration(ParamCacheEvictAfterIdlePeriod, DefaultCacheEvictAfterIdlePeriod, "Idle cloud cache eviction period")
 	fs.Duration(ParamCacheTTL, DefaultCacheTTL, "Cloud cache TTL for successful lookups")
 	fs.Duration(ParamCacheNegativeTTL, DefaultCacheNegativeTTL, "Cloud cache TTL for failed lookups")
+	fs.Duration(ParamCacheRetryBackoff, DefaultCacheRetryBackoff, "Cloud cache initial backoff before retrying a failed lookup, doubling for each consecutive failure")
+	fs.Duration(ParamCacheRetryMaxBackoff, DefaultCacheRetryMaxBackoff, "Cloud cache maximum backoff before retrying a failed lookup")
+	fs.Float64(ParamCacheRefreshJitter, DefaultCacheRefreshJitter, "Fraction of the cloud cache TTL before expiry that entries may be refreshed, chosen randomly per entry")
+	fs.Int(ParamCacheMaxEntries, DefaultCacheMaxEntries, "Maximum number of entries in the cloud cache, unlimited if 0")
+	fs.Int64(ParamCacheMaxBytes, DefaultCacheMaxBytes, "Maximum estimated memory used by the cloud cache in bytes, unlimited if 0")
+	fs.String(ParamCacheEvictionPolicy, DefaultCacheEvictionPolicy, "Policy for evicting entries when the cloud cache is full, lru or lfu")
+	fs.String(ParamCachePersistDir, DefaultCachePersistDir, "Directory to persist the cloud cache to across restarts, disabled if empty")
+	fs.Duration(ParamCachePersistPeriod, DefaultCachePersistPeriod, "Cloud cache persistence period")
+	fs.Bool(ParamCloudStripSourceZone, DefaultCloudStripSourceZone, "Ignore the zone of IPv6 sources when looking up instances")
 	fs.String(ParamMetricsAddr, DefaultMetricsAddr, "Address on which to listen for metrics")
+	fs.String(ParamMetricsSocket, DefaultMetricsSocket, "Path of a unix datagram socket on which to also listen for metrics")
+	fs.Bool(ParamOriginDetection, DefaultOriginDetection, "Detect the container of the sender of metrics on metrics-socket from its credentials, which is looked up by the cloud provider instead of the IP (Linux only)")
 	fs.String(ParamNamespace, "", "Namespace all metrics")
 	fs.String(ParamBackends, strings.Join(DefaultBackends, " "), "Space separated list of backends")
+	fs.String(ParamInternalBackends, "", "Space separated list of backends to send internal metrics to instead of the backends, if set")
 	fs.Int(ParamMaxCloudRequests, DefaultMaxCloudRequests, "Maximum number of cloud provider requests per second")
 	fs.Int(ParamBurstCloudRequests, DefaultBurstCloudRequests, "Burst number of cloud provider requests per second")
+	fs.Int(ParamMaxConcurrentCloudRequests, DefaultMaxConcurrentCloudRequests, "Maximum number of cloud provider requests in flight at once")
 	fs.String(ParamDefaultTags, strings.Join(DefaultTags, " "), "Space separated list of tags to add to all metrics")
 	fs.String(ParamInternalTags, strings.Join(DefaultInternalTags, " "), "Space separated list of tags to add to internal metrics")
 	fs.String(ParamInternalNamespace, DefaultInternalNamespace, "Namespace for internal metrics, may be \"\"")
+	fs.String(ParamInternalMetricsRename, "", "Space separated list of internal metrics or families to rename, as from=to")
+	fs.String(ParamInternalMetricsDisabled, "", "Space separated list of internal metrics or families which are not sent")
 	fs.String(ParamStatserType, DefaultStatserType, "Statser type to be used for sending metrics")
 	fs.String(ParamPercentThreshold, strings.Join(toStringSlice(DefaultPercentThreshold), " "), "Space separated list of percentiles")
 	fs.Bool(ParamHeartbeatEnabled, DefaultHeartbeatEnabled, "Enables heartbeat")
+	fs.Bool(ParamRuntimeMetricsEnabled, DefaultRuntimeMetricsEnabled, "Enables metrics about the Go runtime")
+	fs.Duration(ParamDroppedSummaryInterval, DefaultDroppedSummaryInterval, "How often to log a summary of dropped data, 0 to disable")
+	fs.String(ParamMemoryLimit, DefaultMemoryLimit, "Size of the heap, such as 2GB, at which caches are shrunk, then datagrams are shed, and finally receivers are paused, 0 to disable")
+	fs.Int(ParamGoMaxProcs, DefaultGoMaxProcs, "GOMAXPROCS, 0 to set it from the CPU limit of the container, -1 to leave it as Go sets it")
+	fs.String(ParamGoMemLimit, DefaultGoMemLimit, "GOMEMLIMIT, such as 2GB, auto to set it from the memory limit of the container, off to leave it as Go sets it")
 	fs.Int(ParamReceiveBatchSize, DefaultReceiveBatchSize, "The number of datagrams to read in each receive batch")
 	fs.Bool(ParamConnPerReader, DefaultConnPerReader, "Create a separate connection per reader (requires system support for reusing addresses)")
 	fs.String(ParamServerMode, DefaultServerMode, "The server mode to run in")
 	fs.String(ParamHostname, getHost(), "overrides the hostname of the server")
 	fs.Uint32(ParamTimerHistogramLimit, DefaultTimerHistogramLimit, "upper limit of timer histogram buckets (MaxUint32 by default)")
 	fs.Bool(ParamLogRawMetric, DefaultLogRawMetric, "Print metrics received from network to stdout in JSON format")
+	fs.String(ParamTraceOTLPAddress, DefaultTraceOTLPAddress, "Address of the OTLP collector to export traces of backend, forwarder, and cloud provider requests to, disabled if empty")
+	fs.Bool(ParamTraceOTLPInsecure, DefaultTraceOTLPInsecure, "Connect to the OTLP collector without TLS")
+	fs.Float64(ParamTraceSampleRatio, DefaultTraceSampleRatio, "Fraction of traces which are sampled")
+	fs.String(ParamProfilingPushURL, DefaultProfilingPushURL, "URL of a pprof ingestion endpoint, such as the /ingest endpoint of Pyroscope, to push CPU and heap profiles to, disabled if empty")
+	fs.String(ParamProfilingAppName, DefaultProfilingAppName, "Name of the application pushed profiles belong to")
+	fs.Duration(ParamProfilingInterval, DefaultProfilingInterval, "Interval at which profiles are pushed")
+	fs.Duration(ParamProfilingCPUDuration, DefaultProfilingCPUDuration, "Time the CPU is profiled for each time profiles are captured")
+	fs.String(ParamProfilingDir, DefaultProfilingDir, "Directory profiles are written to when a flush overruns or a channel is saturated, disabled if empty")
+	fs.Duration(ParamProfilingTriggerCooldown, DefaultProfilingTriggerCooldown, "Minimum time between profiles written to profiling-dir")
+	fs.Duration(ParamSecretRefreshInterval, DefaultSecretRefreshInterval, "Interval at which secrets referenced by the configuration are resolved again, and reloaded if they changed, 0 to disable")
+	fs.Duration(ParamConfigWatchInterval, DefaultConfigWatchInterval, "Interval at which the configuration file is checked for changes, and reloaded if it changed, 0 to disable")
+	fs.Duration(ParamDrainTimeout, DefaultDrainTimeout, "Time a drain triggered by a signal is given to send everything received, before exiting")
+	fs.Duration(ParamShutdownFlushTimeout, DefaultShutdownFlushTimeout, "Time the final flush is given to send everything received when the server is stopped, 0 to exit immediately")
+	fs.String(ParamHAPeerURL, DefaultHAPeerURL, "Health endpoint of the other server of an active-active pair, which divides the series with this server while it is healthy")
+	fs.Int(ParamHAIndex, DefaultHAIndex, "Which half of the series this server of an active-active pair owns, 0 or 1")
+	fs.Duration(ParamHACheckInterval, DefaultHACheckInterval, "How often the health of the other server of an active-active pair is checked")
+	fs.String(ParamLeaderElectionLease, DefaultLeaderElectionLease, "Name of the Kubernetes Lease used to elect the replica which sends the heartbeat and events, empty to disable")
+	fs.String(ParamLeaderElectionNamespace, DefaultLeaderElectionNamespace, "Namespace of the Kubernetes Lease, empty for the namespace of the pod")
+	fs.String(ParamLeaderElectionIdentity, DefaultLeaderElectionIdentity, "Identity of this server in the leader election, empty for the hostname")
+	fs.Duration(ParamLeaderElectionLeaseDuration, DefaultLeaderElectionLeaseDuration, "How long other replicas wait before taking over the Lease of a leader which stopped renewing it")
+	fs.Duration(ParamLeaderElectionRenewDeadline, DefaultLeaderElectionRenewDeadline, "How long the leader retries renewing the Lease before it stops being the leader")
+	fs.Duration(ParamLeaderElectionRetryPeriod, DefaultLeaderElectionRetryPeriod, "Interval between attempts to acquire or renew the Lease")
+	fs.Duration(ParamEventThrottleWindow, DefaultEventThrottleWindow, "Window in which events identical to one already sent are dropped, and events are limited per key, 0 to disable")
+	fs.Int(ParamEventThrottlePerKey, DefaultEventThrottlePerKey, "Maximum events sent for each aggregation key, or title, in each event-throttle-window, 0 for no limit")
+	fs.String(ParamClusterMembers, DefaultClusterMembers, "Space separated list of the addresses of the servers in a cluster, which divide the series between them")
+	fs.String(ParamClusterSelf, DefaultClusterSelf, "The address of this server in cluster-members")
+	fs.String(ParamRelayDownstreams, DefaultRelayDownstreams, "Space separated list of the host:port of the statsd servers metrics are relayed to in relay mode, by a consistent hash of their name")
+	fs.Bool(ParamRelayTCPTransport, DefaultRelayTCPTransport, "Relay metrics over TCP, rather than UDP, in relay mode")
+	fs.String(ParamShadowBackends, DefaultShadowBackends, "Space separated list of backends, configured in the shadow section, sent a copy of every flush without delaying the backends")
+	fs.Float64(ParamShadowPercentage, DefaultShadowPercentage, "Percentage of the series of every flush sent to the shadow backends, chosen by a hash of their name and tags")
+	fs.Float64(ParamRetryBudgetRatio, DefaultRetryBudgetRatio, "Retries allowed per payload sent, shared by every backend and the forwarder, 0 to allow every retry")
+	fs.Float64(ParamRetryBudgetMinPerSecond, DefaultRetryBudgetMinPerSecond, "Retries allowed every second, in addition to retry-budget-ratio")
+	fs.String(ParamDeadLetterPath, DefaultDeadLetterPath, "Directory where the metrics and events finally dropped by backends are archived, so they can be replayed with replay-dlq")
+	fs.String(ParamDeadLetterMaxBytes, DefaultDeadLetterMaxBytes, "Maximum size of the dead letter directory, after which nothing more is archived")
+	fs.String(ParamVaultAddress, DefaultVaultAddress, "Address of Vault, for vault:// secrets.  Defaults to VAULT_ADDR")
+	fs.String(ParamVaultToken, DefaultVaultToken, "Token used to read vault:// secrets, which may be ${file:PATH}.  Defaults to VAULT_TOKEN")
+	fs.Bool(ParamDryRun, false, "Backends serialize and batch metrics and events, but do not send them")
 }
 
 func minInt(a, b int) int {
@@ -0,0 +1,127 @@
+// Package intern deduplicates strings, so the same metric names and tags received in millions of datapoints share
+// one copy, rather than each being allocated when it is parsed.
+package intern
+
+import (
+	"sync"
+)
+
+// numShards is the number of independently locked shards, so concurrent parsers rarely contend.
+const numShards = 32
+
+// Interner returns a single copy of each string it is given.  It is bounded, so high cardinality strings such as ids
+// can't grow it forever: strings are kept in generations of up to capacity strings, and when the current generation
+// is full it replaces the previous one.  A string seen in the previous generation is moved to the current one, so
+// only the strings which have not been seen for a generation are dropped, and at most twice capacity are kept.
+//
+// A nil Interner does not deduplicate anything.
+type Interner struct {
+	capacity int // Per shard, per generation
+	shards   [numShards]shard
+}
+
+type shard struct {
+	lock     sync.Mutex
+	current  map[string]string
+	previous map[string]string
+}
+
+// New creates a new Interner which keeps up to capacity strings per generation, or nil if capacity is 0.
+func New(capacity int) *Interner {
+	if capacity <= 0 {
+		return nil
+	}
+	in := &Interner{
+		capacity: (capacity + numShards - 1) / numShards,
+	}
+	for idx := range in.shards {
+		in.shards[idx].current = make(map[string]string)
+	}
+	return in
+}
+
+// Bytes returns b as a string, which is shared with every other call for the same bytes.  It does not allocate if the
+// string has been seen recently.
+func (in *Interner) Bytes(b []byte) string {
+	if in == nil {
+		return string(b)
+	}
+	s := &in.shards[hashBytes(b)%numShards]
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// The compiler does not allocate for string(b) when it is only used as a map key
+	if str, ok := s.current[string(b)]; ok {
+		return str
+	}
+	str, ok := s.previous[string(b)]
+	if !ok {
+		str = string(b)
+	}
+	in.add(s, str)
+	return str
+}
+
+// String returns a string equal to str, which is shared with every other call for the same string.
+func (in *Interner) String(str string) string {
+	if in == nil {
+		return str
+	}
+	s := &in.shards[hashString(str)%numShards]
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if interned, ok := s.current[str]; ok {
+		return interned
+	}
+	if interned, ok := s.previous[str]; ok {
+		str = interned
+	}
+	in.add(s, str)
+	return str
+}
+
+// Reset drops every string, so the memory they use can be freed, such as when the server is running out of memory.
+func (in *Interner) Reset() {
+	if in == nil {
+		return
+	}
+	for idx := range in.shards {
+		s := &in.shards[idx]
+		s.lock.Lock()
+		s.current = make(map[string]string)
+		s.previous = nil
+		s.lock.Unlock()
+	}
+}
+
+// add adds str to the current generation of s, starting a new generation if it is full.  The lock must be held.
+func (in *Interner) add(s *shard, str string) {
+	if len(s.current) >= in.capacity {
+		s.previous = s.current
+		s.current = make(map[string]string, in.capacity)
+	}
+	s.current[str] = str
+}
+
+// FNV-1a, inlined to avoid allocating a hash.Hash32 for every string.
+const (
+	offset32 = 2166136261
+	prime32  = 16777619
+)
+
+func hashBytes(b []byte) uint32 {
+	h := uint32(offset32)
+	for _, c := range b {
+		h = (h ^ uint32(c)) * prime32
+	}
+	return h
+}
+
+func hashString(str string) uint32 {
+	h := uint32(offset32)
+	for idx := 0; idx < len(str); idx++ {
+		h = (h ^ uint32(str[idx])) * prime32
+	}
+	return h
+}
@@ -0,0 +1,77 @@
+package intern
+
+import (
+	"strconv"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// data returns a pointer to the backing storage of s, so tests can tell if two strings share it.
+func data(s string) uintptr {
+	return (*[2]uintptr)(unsafe.Pointer(&s))[0]
+}
+
+func TestInternerShares(t *testing.T) {
+	t.Parallel()
+	in := New(1000)
+
+	a := in.Bytes([]byte("env:prod"))
+	b := in.Bytes([]byte("env:prod"))
+	c := in.String(string([]byte("env:prod")))
+	assert.Equal(t, "env:prod", a)
+	assert.Equal(t, data(a), data(b))
+	assert.Equal(t, data(a), data(c))
+	assert.NotEqual(t, data(a), data(in.Bytes([]byte("env:dev"))))
+}
+
+func TestInternerBytesDoesNotAllocate(t *testing.T) {
+	in := New(1000)
+	b := []byte("metric.name")
+	in.Bytes(b)
+	allocs := testing.AllocsPerRun(100, func() {
+		in.Bytes(b)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestInternerGenerations(t *testing.T) {
+	t.Parallel()
+	in := New(numShards) // One string per shard per generation
+
+	// A string is kept while it is in either generation
+	first := in.String(string([]byte("first")))
+	s := &in.shards[hashString("first")%numShards]
+	s.lock.Lock()
+	in.add(s, "other")
+	s.lock.Unlock()
+	require.Equal(t, data(first), data(in.String(string([]byte("first")))))
+
+	// And dropped once it has not been seen for a generation
+	for i := 0; i < 2; i++ {
+		s.lock.Lock()
+		in.add(s, "other"+strconv.Itoa(i))
+		s.lock.Unlock()
+	}
+	assert.NotEqual(t, data(first), data(in.String(string([]byte("first")))))
+	assert.LessOrEqual(t, len(s.current)+len(s.previous), 2)
+}
+
+func TestInternerReset(t *testing.T) {
+	t.Parallel()
+	in := New(1024)
+	first := in.String(string([]byte("first")))
+	in.Reset()
+	assert.NotEqual(t, data(first), data(in.String(string([]byte("first")))))
+}
+
+func TestNilInterner(t *testing.T) {
+	t.Parallel()
+	var in *Interner
+	assert.Nil(t, New(0))
+	assert.Equal(t, "abc", in.Bytes([]byte("abc")))
+	assert.Equal(t, "abc", in.String("abc"))
+	in.Reset()
+}
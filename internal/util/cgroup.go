@@ -0,0 +1,194 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	procSelfCgroup = "/proc/self/cgroup"
+	cgroupMount    = "/sys/fs/cgroup"
+
+	// cgroupV1Unlimited is the memory limit above which cgroup v1 is treated as unlimited, as it reports the largest
+	// page aligned int64 rather than a marker.
+	cgroupV1Unlimited = 1 << 62
+)
+
+// CgroupLimits are the memory and CPU limits of the cgroup of the process, such as the limits of a container.
+type CgroupLimits struct {
+	MemoryBytes uint64  // 0 if there is no limit
+	CPUs        float64 // The CPU quota as a number of CPUs, or 0 if there is no limit
+}
+
+// ReadCgroupLimits reads the limits of the cgroup of the process, from either cgroup v1 or v2.  The limits of every
+// ancestor of the cgroup also apply, so the lowest of each is returned.  It returns no limits on platforms without
+// cgroups.
+func ReadCgroupLimits() (CgroupLimits, error) {
+	return readCgroupLimits(procSelfCgroup, cgroupMount)
+}
+
+func readCgroupLimits(procCgroup, mount string) (CgroupLimits, error) {
+	var limits CgroupLimits
+	f, err := os.Open(procCgroup)
+	if os.IsNotExist(err) {
+		return limits, nil
+	}
+	if err != nil {
+		return limits, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line is hierarchy-id:controllers:path, and cgroup v2 has an id of 0 and no controllers
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		controllers, cgroupPath := parts[1], parts[2]
+		if parts[0] == "0" && controllers == "" {
+			err = limits.readV2(mount, cgroupPath)
+		} else {
+			for _, controller := range strings.Split(controllers, ",") {
+				switch controller {
+				case "memory":
+					err = limits.readV1Memory(filepath.Join(mount, "memory"), cgroupPath)
+				case "cpu":
+					err = limits.readV1CPU(filepath.Join(mount, "cpu"), cgroupPath)
+				}
+			}
+		}
+		if err != nil {
+			return CgroupLimits{}, err
+		}
+	}
+	return limits, scanner.Err()
+}
+
+func (cl *CgroupLimits) readV2(mount, cgroupPath string) error {
+	return eachAncestor(mount, cgroupPath, func(dir string) error {
+		if memory, ok, err := readCgroupFile(dir, "memory.max"); err != nil {
+			return err
+		} else if ok && memory != "max" {
+			bytes, err := strconv.ParseUint(memory, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid memory.max %q: %v", memory, err)
+			}
+			cl.setMemory(bytes)
+		}
+		if cpu, ok, err := readCgroupFile(dir, "cpu.max"); err != nil {
+			return err
+		} else if ok {
+			// $MAX $PERIOD, where $MAX may be "max"
+			fields := strings.Fields(cpu)
+			if len(fields) == 2 && fields[0] != "max" {
+				if err := cl.setCPUs(fields[0], fields[1]); err != nil {
+					return fmt.Errorf("invalid cpu.max %q: %v", cpu, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (cl *CgroupLimits) readV1Memory(mount, cgroupPath string) error {
+	return eachAncestor(mount, cgroupPath, func(dir string) error {
+		memory, ok, err := readCgroupFile(dir, "memory.limit_in_bytes")
+		if err != nil || !ok {
+			return err
+		}
+		bytes, err := strconv.ParseUint(memory, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid memory.limit_in_bytes %q: %v", memory, err)
+		}
+		if bytes < cgroupV1Unlimited {
+			cl.setMemory(bytes)
+		}
+		return nil
+	})
+}
+
+func (cl *CgroupLimits) readV1CPU(mount, cgroupPath string) error {
+	return eachAncestor(mount, cgroupPath, func(dir string) error {
+		quota, ok, err := readCgroupFile(dir, "cpu.cfs_quota_us")
+		if err != nil || !ok || quota == "-1" {
+			return err
+		}
+		period, ok, err := readCgroupFile(dir, "cpu.cfs_period_us")
+		if err != nil || !ok {
+			return err
+		}
+		if err := cl.setCPUs(quota, period); err != nil {
+			return fmt.Errorf("invalid cpu.cfs_quota_us %q or cpu.cfs_period_us %q: %v", quota, period, err)
+		}
+		return nil
+	})
+}
+
+func (cl *CgroupLimits) setMemory(bytes uint64) {
+	if cl.MemoryBytes == 0 || bytes < cl.MemoryBytes {
+		cl.MemoryBytes = bytes
+	}
+}
+
+func (cl *CgroupLimits) setCPUs(quota, period string) error {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil {
+		return err
+	}
+	if q <= 0 || p <= 0 {
+		return nil
+	}
+	if cpus := q / p; cl.CPUs == 0 || cpus < cl.CPUs {
+		cl.CPUs = cpus
+	}
+	return nil
+}
+
+// eachAncestor calls f with the directory of the cgroup, and of each of its ancestors, which exist under mount.  In a
+// container, the path of the cgroup is usually outside of the namespace, so only the root is mounted.
+func eachAncestor(mount, cgroupPath string, f func(dir string) error) error {
+	for p := path.Clean("/" + cgroupPath); ; p = path.Dir(p) {
+		dir := filepath.Join(mount, filepath.FromSlash(p))
+		if _, err := os.Stat(dir); err == nil {
+			if err := f(dir); err != nil {
+				return err
+			}
+		}
+		if p == "/" {
+			return nil
+		}
+	}
+}
+
+// readCgroupFile returns the trimmed contents of a file of a cgroup, and false if it does not exist.
+func readCgroupFile(dir, name string) (string, bool, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(string(contents)), true, nil
+}
+
+// MaxProcs returns the number of CPUs the process can use without being throttled, rounded down and at least 1, or 0
+// if there is no limit.
+func (cl CgroupLimits) MaxProcs() int {
+	if cl.CPUs == 0 {
+		return 0
+	}
+	return int(math.Max(1, math.Floor(cl.CPUs)))
+}
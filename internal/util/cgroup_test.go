@@ -0,0 +1,117 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCgroupFiles writes files, by their path relative to dir.
+func writeCgroupFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0700))
+		require.NoError(t, ioutil.WriteFile(name, []byte(contents), 0600))
+	}
+}
+
+func TestReadCgroupLimits(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name     string
+		files    map[string]string
+		expected CgroupLimits
+	}{
+		{
+			name:  "no cgroups",
+			files: map[string]string{},
+		},
+		{
+			name: "v2",
+			files: map[string]string{
+				"proc":                           "0::/kubepods/pod1\n",
+				"mount/kubepods/pod1/memory.max": "1073741824\n",
+				"mount/kubepods/pod1/cpu.max":    "250000 100000\n",
+			},
+			expected: CgroupLimits{MemoryBytes: 1 << 30, CPUs: 2.5},
+		},
+		{
+			name: "v2 unlimited",
+			files: map[string]string{
+				"proc":             "0::/\n",
+				"mount/memory.max": "max\n",
+				"mount/cpu.max":    "max 100000\n",
+			},
+		},
+		{
+			name: "v2 lowest ancestor",
+			files: map[string]string{
+				"proc":                           "0::/kubepods/pod1\n",
+				"mount/kubepods/memory.max":      "1073741824\n",
+				"mount/kubepods/pod1/memory.max": "max\n",
+				"mount/kubepods/cpu.max":         "400000 100000\n",
+				"mount/kubepods/pod1/cpu.max":    "150000 100000\n",
+			},
+			expected: CgroupLimits{MemoryBytes: 1 << 30, CPUs: 1.5},
+		},
+		{
+			name: "v2 namespaced",
+			files: map[string]string{
+				"proc":             "0::/kubepods/pod1\n",
+				"mount/memory.max": "536870912\n",
+				"mount/cpu.max":    "50000 100000\n",
+			},
+			expected: CgroupLimits{MemoryBytes: 1 << 29, CPUs: 0.5},
+		},
+		{
+			name: "v1",
+			files: map[string]string{
+				"proc": "12:memory:/docker/abc\n4:cpu,cpuacct:/docker/abc\n1:name=systemd:/docker/abc\n",
+				"mount/memory/docker/abc/memory.limit_in_bytes": "268435456\n",
+				"mount/cpu/docker/abc/cpu.cfs_quota_us":         "200000\n",
+				"mount/cpu/docker/abc/cpu.cfs_period_us":        "100000\n",
+				"mount/memory/memory.limit_in_bytes":            "9223372036854771712\n",
+				"mount/cpu/cpu.cfs_quota_us":                    "-1\n",
+				"mount/cpu/cpu.cfs_period_us":                   "100000\n",
+			},
+			expected: CgroupLimits{MemoryBytes: 1 << 28, CPUs: 2},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir, err := ioutil.TempDir("", "cgroup")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			writeCgroupFiles(t, dir, tc.files)
+
+			limits, err := readCgroupLimits(filepath.Join(dir, "proc"), filepath.Join(dir, "mount"))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, limits)
+		})
+	}
+}
+
+func TestReadCgroupLimitsInvalid(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeCgroupFiles(t, dir, map[string]string{
+		"proc":             "0::/\n",
+		"mount/memory.max": "lots\n",
+	})
+
+	_, err = readCgroupLimits(filepath.Join(dir, "proc"), filepath.Join(dir, "mount"))
+	require.Error(t, err)
+}
+
+func TestCgroupLimitsMaxProcs(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, 0, CgroupLimits{}.MaxProcs())
+	require.Equal(t, 1, CgroupLimits{CPUs: 0.5}.MaxProcs())
+	require.Equal(t, 2, CgroupLimits{CPUs: 2.5}.MaxProcs())
+}
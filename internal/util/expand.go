@@ -0,0 +1,64 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// filePrefix selects the contents of a file rather than an environment variable, such as the files written by the
+// Kubernetes downward API.
+const filePrefix = "file:"
+
+// defaultSeparator separates the name of an environment variable from the value used if it is not set or empty.
+const defaultSeparator = ":-"
+
+// Expand replaces ${NAME} or $NAME in s with the value of the environment variable NAME, and ${file:PATH} with the
+// contents of the file at PATH, without leading or trailing whitespace.  ${NAME:-DEFAULT} is replaced by DEFAULT if
+// NAME is not set or is empty, and $$ by $.  It is an error if a variable without a default is not set, or a file can
+// not be read, so a misconfigured instance is not silently indistinguishable from the rest.
+func Expand(s string) (string, error) {
+	var err error
+	result := os.Expand(s, func(name string) string {
+		if err != nil {
+			return ""
+		}
+		if name == "$" {
+			return "$"
+		}
+		if i := strings.Index(name, defaultSeparator); i >= 0 {
+			if value := os.Getenv(name[:i]); value != "" {
+				return value
+			}
+			return name[i+len(defaultSeparator):]
+		}
+		if strings.HasPrefix(name, filePrefix) {
+			var contents []byte
+			contents, err = ioutil.ReadFile(name[len(filePrefix):])
+			return strings.TrimSpace(string(contents))
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// ExpandAll expands every string in ss with Expand.
+func ExpandAll(ss []string) ([]string, error) {
+	result := make([]string, 0, len(ss))
+	for _, s := range ss {
+		expanded, err := Expand(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded)
+	}
+	return result, nil
+}
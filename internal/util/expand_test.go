@@ -0,0 +1,45 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpand(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, os.Setenv("GOSTATSD_TEST_EXPAND_POD", "gostatsd-0"))
+	defer os.Unsetenv("GOSTATSD_TEST_EXPAND_POD")
+
+	dir, err := ioutil.TempDir("", "expand")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	namespace := filepath.Join(dir, "namespace")
+	require.NoError(t, ioutil.WriteFile(namespace, []byte("monitoring\n"), 0600))
+
+	expanded, err := ExpandAll([]string{
+		"pod:${GOSTATSD_TEST_EXPAND_POD}",
+		"pod:$GOSTATSD_TEST_EXPAND_POD",
+		"namespace:${file:" + namespace + "}",
+		"env:prod",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pod:gostatsd-0", "pod:gostatsd-0", "namespace:monitoring", "env:prod"}, expanded)
+
+	expanded, err = ExpandAll([]string{
+		"${GOSTATSD_TEST_EXPAND_MISSING:-default}",
+		"${GOSTATSD_TEST_EXPAND_POD:-default}",
+		"pa$$word",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default", "gostatsd-0", "pa$word"}, expanded)
+
+	_, err = Expand("node:${GOSTATSD_TEST_EXPAND_MISSING}")
+	assert.EqualError(t, err, "environment variable GOSTATSD_TEST_EXPAND_MISSING is not set")
+	_, err = Expand("namespace:${file:" + filepath.Join(dir, "missing") + "}")
+	assert.Error(t, err)
+}
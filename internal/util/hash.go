@@ -0,0 +1,25 @@
+package util
+
+import (
+	"hash/fnv"
+)
+
+// HashKey returns a well distributed hash of the key made of parts, such as the name and tags key of a series, which
+// is the same in every process, so servers and backends consistently choose the same series.
+func HashKey(parts ...string) uint64 {
+	h := fnv.New64a()
+	for i, part := range parts {
+		if i > 0 {
+			_, _ = h.Write([]byte{0})
+		}
+		_, _ = h.Write([]byte(part))
+	}
+	// fnv doesn't avalanche well for short keys which differ in the last bytes, so finish with the murmur3 mixer
+	k := h.Sum64()
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
@@ -13,3 +13,15 @@ func (nopWriteCloser) Close() error { return nil }
 func NopWriteCloser(w io.Writer) io.WriteCloser {
 	return nopWriteCloser{w}
 }
+
+// CountingWriteCloser counts the bytes written to the io.WriteCloser it wraps.
+type CountingWriteCloser struct {
+	io.WriteCloser
+	N int
+}
+
+func (cwc *CountingWriteCloser) Write(p []byte) (int, error) {
+	n, err := cwc.WriteCloser.Write(p)
+	cwc.N += n
+	return n, err
+}
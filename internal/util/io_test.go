@@ -10,3 +10,14 @@ import (
 func TestNopWriteCloser(t *testing.T) {
 	require.NoError(t, NopWriteCloser(&bytes.Buffer{}).Close())
 }
+
+func TestCountingWriteCloser(t *testing.T) {
+	var buf bytes.Buffer
+	cwc := &CountingWriteCloser{WriteCloser: NopWriteCloser(&buf)}
+	_, err := cwc.Write([]byte("abc"))
+	require.NoError(t, err)
+	_, err = cwc.Write([]byte("de"))
+	require.NoError(t, err)
+	require.Equal(t, 5, cwc.N)
+	require.NoError(t, cwc.Close())
+}
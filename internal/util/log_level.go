@@ -0,0 +1,136 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogLevels changes the log level of a logger at runtime, either for every entry, or only for entries with a field set
+// to a value, such as backend:datadog, so one component can be debugged without the noise of the others.  The logger
+// is set to the most verbose level, and its formatter drops the entries which are more verbose than their level.
+//
+// Like SamplingFormatter, it relies on logrus writing nothing when the formatter returns nothing.
+type LogLevels struct {
+	logger *logrus.Logger
+
+	lock       sync.RWMutex
+	formatter  logrus.Formatter
+	configured logrus.Level
+	level      logrus.Level
+	scopes     map[logScope]logrus.Level
+}
+
+type logScope struct {
+	field string
+	value string
+}
+
+// NewLogLevels creates a LogLevels for logger.  Nothing is changed until Configure is called.
+func NewLogLevels(logger *logrus.Logger) *LogLevels {
+	return &LogLevels{
+		logger:     logger,
+		configured: logger.GetLevel(),
+		level:      logger.GetLevel(),
+		scopes:     map[logScope]logrus.Level{},
+	}
+}
+
+// Configure sets the configured level and the formatter of the logger, and undoes every change made since.
+func (ll *LogLevels) Configure(level logrus.Level, formatter logrus.Formatter) {
+	ll.lock.Lock()
+	ll.formatter = formatter
+	ll.configured = level
+	ll.level = level
+	ll.scopes = map[logScope]logrus.Level{}
+	ll.lock.Unlock()
+
+	// The logger holds its own lock while formatting, so it must not be called while holding ours.
+	ll.logger.SetFormatter(ll)
+	ll.logger.SetLevel(level)
+}
+
+// SetLevel sets the level of the entries with field set to value, or of every entry if field is "".  A scope can only
+// make entries more verbose than the level of every entry.
+func (ll *LogLevels) SetLevel(level logrus.Level, field, value string) {
+	ll.lock.Lock()
+	if field == "" {
+		ll.level = level
+	} else {
+		ll.scopes[logScope{field: field, value: value}] = level
+	}
+	max := ll.maxLevel()
+	ll.lock.Unlock()
+	ll.logger.SetLevel(max)
+}
+
+// Reset restores the configured level, and removes every scope.
+func (ll *LogLevels) Reset() {
+	ll.lock.Lock()
+	ll.level = ll.configured
+	ll.scopes = map[logScope]logrus.Level{}
+	ll.lock.Unlock()
+	ll.logger.SetLevel(ll.configured)
+}
+
+// ToggleDebug sets the level of every entry to debug, or back to the configured level if it is already debug or more
+// verbose.  It returns the new level.
+func (ll *LogLevels) ToggleDebug() logrus.Level {
+	ll.lock.RLock()
+	level := logrus.DebugLevel
+	if ll.level >= logrus.DebugLevel {
+		level = ll.configured
+	}
+	ll.lock.RUnlock()
+	ll.SetLevel(level, "", "")
+	return level
+}
+
+// Levels returns the level of every entry, and the level of each scope by field:value.
+func (ll *LogLevels) Levels() (logrus.Level, map[string]logrus.Level) {
+	ll.lock.RLock()
+	defer ll.lock.RUnlock()
+	scopes := make(map[string]logrus.Level, len(ll.scopes))
+	for scope, level := range ll.scopes {
+		scopes[scope.field+":"+scope.value] = level
+	}
+	return ll.level, scopes
+}
+
+// Format formats the entry if it is at or below its level, or returns nothing if it is dropped.
+func (ll *LogLevels) Format(entry *logrus.Entry) ([]byte, error) {
+	ll.lock.RLock()
+	formatter := ll.formatter
+	ok := ll.enabled(entry)
+	ll.lock.RUnlock()
+
+	if !ok {
+		return nil, nil
+	}
+	return formatter.Format(entry)
+}
+
+func (ll *LogLevels) enabled(entry *logrus.Entry) bool {
+	if entry.Level <= ll.level {
+		return true
+	}
+	for scope, level := range ll.scopes {
+		if entry.Level <= level {
+			if value, ok := entry.Data[scope.field]; ok && fmt.Sprint(value) == scope.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ll *LogLevels) maxLevel() logrus.Level {
+	max := ll.level
+	for _, level := range ll.scopes {
+		if level > max {
+			max = level
+		}
+	}
+	return max
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLevels(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	ll := NewLogLevels(logger)
+	ll.Configure(logrus.InfoLevel, &logrus.TextFormatter{DisableTimestamp: true})
+
+	logged := func() []string {
+		defer buf.Reset()
+		logger.WithField("backend", "datadog").Debug("datadog")
+		logger.WithField("backend", "newrelic").Debug("newrelic")
+		logger.Debug("other")
+		logger.Info("info")
+		var messages []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			idx := strings.Index(line, "msg=")
+			require.NotEqual(t, -1, idx, line)
+			messages = append(messages, strings.Fields(line[idx+len("msg="):])[0])
+		}
+		return messages
+	}
+
+	assert.Equal(t, []string{"info"}, logged())
+
+	ll.SetLevel(logrus.DebugLevel, "backend", "datadog")
+	assert.Equal(t, logrus.DebugLevel, logger.GetLevel())
+	assert.Equal(t, []string{"datadog", "info"}, logged())
+	level, scopes := ll.Levels()
+	assert.Equal(t, logrus.InfoLevel, level)
+	assert.Equal(t, map[string]logrus.Level{"backend:datadog": logrus.DebugLevel}, scopes)
+
+	assert.Equal(t, logrus.DebugLevel, ll.ToggleDebug())
+	assert.Equal(t, []string{"datadog", "newrelic", "other", "info"}, logged())
+	assert.Equal(t, logrus.InfoLevel, ll.ToggleDebug())
+	assert.Equal(t, []string{"datadog", "info"}, logged())
+
+	ll.Reset()
+	assert.Equal(t, logrus.InfoLevel, logger.GetLevel())
+	assert.Equal(t, []string{"info"}, logged())
+}
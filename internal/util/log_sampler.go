@@ -0,0 +1,121 @@
+package util
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logSampleWindow = time.Minute
+	// logSampleMaxClasses bounds the memory used by messages which are formatted with their values, and so are each
+	// a class of their own.
+	logSampleMaxClasses = 10000
+)
+
+// SamplingFormatter is a logrus.Formatter which only formats the first perMinute entries of each class of message
+// every minute, and drops the rest.  A class is the level and message of an entry, without its fields, so a warning
+// logged for every failed request during an outage is logged perMinute times a minute, rather than flooding the log.
+// The next entry of a class after some were dropped has a suppressed field with how many.
+//
+// It relies on logrus writing nothing when the formatter returns nothing.  Fatal and panic entries are never dropped.
+type SamplingFormatter struct {
+	formatter logrus.Formatter
+	perMinute int
+	now       func() time.Time
+
+	lock    sync.Mutex
+	classes map[logSampleClass]*logSampleState
+}
+
+type logSampleClass struct {
+	level   logrus.Level
+	message string
+}
+
+type logSampleState struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+// NewSamplingFormatter returns a formatter which passes at most perMinute entries of each class a minute to
+// formatter.  If perMinute is 0, every entry is passed to formatter.
+func NewSamplingFormatter(formatter logrus.Formatter, perMinute int) logrus.Formatter {
+	if perMinute <= 0 {
+		return formatter
+	}
+	return &SamplingFormatter{
+		formatter: formatter,
+		perMinute: perMinute,
+		now:       time.Now,
+		classes:   map[logSampleClass]*logSampleState{},
+	}
+}
+
+// Format formats the entry, or returns nothing if the entry is dropped.
+func (sf *SamplingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level <= logrus.FatalLevel {
+		return sf.formatter.Format(entry)
+	}
+
+	suppressed, ok := sf.sample(logSampleClass{level: entry.Level, message: entry.Message})
+	if !ok {
+		return nil, nil
+	}
+	if suppressed > 0 {
+		// The fields may be shared with other entries, so they are copied rather than modified
+		sampled := *entry
+		sampled.Data = make(logrus.Fields, len(entry.Data)+1)
+		for k, v := range entry.Data {
+			sampled.Data[k] = v
+		}
+		sampled.Data["suppressed"] = suppressed
+		entry = &sampled
+	}
+	return sf.formatter.Format(entry)
+}
+
+// sample returns true if an entry of the class should be logged, and how many were dropped since the last one which
+// was.
+func (sf *SamplingFormatter) sample(class logSampleClass) (int, bool) {
+	now := sf.now()
+
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+
+	state, ok := sf.classes[class]
+	if !ok {
+		if len(sf.classes) >= logSampleMaxClasses {
+			sf.forgetIdle(now)
+		}
+		state = &logSampleState{windowStart: now}
+		sf.classes[class] = state
+	} else if now.Sub(state.windowStart) >= logSampleWindow {
+		state.windowStart = now
+		state.count = 0
+	}
+
+	if state.count >= sf.perMinute {
+		state.suppressed++
+		return 0, false
+	}
+	state.count++
+	suppressed := state.suppressed
+	state.suppressed = 0
+	return suppressed, true
+}
+
+// forgetIdle forgets every class which hasn't been logged in the current window, and has nothing suppressed.  If that
+// isn't enough, it forgets everything.
+func (sf *SamplingFormatter) forgetIdle(now time.Time) {
+	for class, state := range sf.classes {
+		if now.Sub(state.windowStart) >= logSampleWindow && state.suppressed == 0 {
+			delete(sf.classes, class)
+		}
+	}
+	if len(sf.classes) >= logSampleMaxClasses {
+		sf.classes = map[logSampleClass]*logSampleState{}
+	}
+}
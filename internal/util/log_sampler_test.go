@@ -0,0 +1,70 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSamplingFormatter(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(0, 0)
+	sf := NewSamplingFormatter(&logrus.JSONFormatter{}, 2).(*SamplingFormatter)
+	sf.now = func() time.Time { return now }
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = sf
+	entry := logger.WithField("backend", "datadog")
+
+	lines := func() []map[string]interface{} {
+		var result []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			fields := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(line), &fields))
+			result = append(result, fields)
+		}
+		buf.Reset()
+		return result
+	}
+
+	for i := 0; i < 5; i++ {
+		entry.Warn("failed to send")
+	}
+	entry.Info("failed to send") // A different level is a different class
+	logged := lines()
+	require.Len(t, logged, 3)
+	for _, fields := range logged {
+		assert.NotContains(t, fields, "suppressed")
+	}
+
+	now = now.Add(time.Minute)
+	entry.Warn("failed to send")
+	entry.Warn("failed to send")
+	logged = lines()
+	require.Len(t, logged, 2)
+	assert.EqualValues(t, 3, logged[0]["suppressed"])
+	assert.NotContains(t, logged[1], "suppressed")
+
+	// The suppressed field is not added to later entries with the same fields
+	entry.Error("unrelated")
+	logged = lines()
+	require.Len(t, logged, 1)
+	assert.NotContains(t, logged[0], "suppressed")
+}
+
+func TestSamplingFormatterUnlimited(t *testing.T) {
+	t.Parallel()
+	formatter := &logrus.TextFormatter{}
+	assert.Equal(t, formatter, NewSamplingFormatter(formatter, 0))
+}
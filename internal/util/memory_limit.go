@@ -0,0 +1,21 @@
+//go:build go1.19
+// +build go1.19
+
+package util
+
+import (
+	"runtime/debug"
+)
+
+// memoryLimitSupported is true if the Go runtime has a soft memory limit, which is only available from Go 1.19.
+const memoryLimitSupported = true
+
+// SetMemoryLimit sets the soft memory limit of the Go runtime, the same as GOMEMLIMIT, and returns the previous limit.
+func SetMemoryLimit(limit int64) int64 {
+	return debug.SetMemoryLimit(limit)
+}
+
+// MemoryLimit returns the soft memory limit of the Go runtime, which is math.MaxInt64 if there is none.
+func MemoryLimit() int64 {
+	return debug.SetMemoryLimit(-1)
+}
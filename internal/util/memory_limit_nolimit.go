@@ -0,0 +1,21 @@
+//go:build !go1.19
+// +build !go1.19
+
+package util
+
+import (
+	"math"
+)
+
+// memoryLimitSupported is false, as the soft memory limit of the Go runtime is only available from Go 1.19.
+const memoryLimitSupported = false
+
+// SetMemoryLimit does nothing, and returns math.MaxInt64, as there is no limit.
+func SetMemoryLimit(limit int64) int64 {
+	return math.MaxInt64
+}
+
+// MemoryLimit returns math.MaxInt64, as there is no limit.
+func MemoryLimit() int64 {
+	return math.MaxInt64
+}
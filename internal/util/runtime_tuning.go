@@ -0,0 +1,84 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Special values of the GOMAXPROCS and GOMEMLIMIT settings for TuneRuntime.
+const (
+	// RuntimeLimitAuto sets the limit from the limits of the cgroup, unless it is set by the environment.
+	RuntimeLimitAuto = 0
+	// RuntimeLimitOff leaves the limit as the Go runtime set it.
+	RuntimeLimitOff = -1
+)
+
+// memoryLimitRatio is the fraction of the memory limit of the cgroup which is used as the soft memory limit of the Go
+// runtime, leaving room for memory it does not manage, so it collects garbage harder before the process is killed.
+const memoryLimitRatio = 0.9
+
+// TuneRuntime sets GOMAXPROCS to maxProcs, and GOMEMLIMIT to memoryLimit bytes.  Either may be RuntimeLimitAuto to set
+// it from the limits of the cgroup of the process, such as a container, unless it is set in the environment, or
+// RuntimeLimitOff to leave it as it is.  Otherwise Go uses every CPU of the host, and the process is throttled by the
+// CPU quota of its container, which delays reading datagrams until the kernel drops them.
+func TuneRuntime(maxProcs int, memoryLimit int64, logger logrus.FieldLogger) error {
+	var cgroup CgroupLimits
+	if maxProcs == RuntimeLimitAuto || memoryLimit == RuntimeLimitAuto {
+		var err error
+		if cgroup, err = ReadCgroupLimits(); err != nil {
+			return fmt.Errorf("unable to read cgroup limits: %v", err)
+		}
+	}
+
+	maxProcs, memoryLimit = runtimeLimits(maxProcs, memoryLimit, cgroup, os.Getenv)
+	if maxProcs > 0 {
+		runtime.GOMAXPROCS(maxProcs)
+	}
+	if memoryLimit > 0 {
+		if !memoryLimitSupported {
+			logger.Warn("GOMEMLIMIT is not supported before Go 1.19, and is not set")
+		}
+		SetMemoryLimit(memoryLimit)
+	}
+
+	fields := logrus.Fields{
+		"gomaxprocs":    runtime.GOMAXPROCS(0),
+		"cgroup_cpus":   cgroup.CPUs,
+		"cgroup_memory": cgroup.MemoryBytes,
+	}
+	if limit := MemoryLimit(); limit != math.MaxInt64 {
+		fields["gomemlimit"] = limit
+	}
+	logger.WithFields(fields).Info("Go runtime limits")
+	return nil
+}
+
+// runtimeLimits returns the GOMAXPROCS and GOMEMLIMIT to set, or 0 for those which are left as they are.
+func runtimeLimits(maxProcs int, memoryLimit int64, cgroup CgroupLimits, getenv func(string) string) (int, int64) {
+	if maxProcs == RuntimeLimitAuto {
+		if getenv("GOMAXPROCS") == "" {
+			maxProcs = cgroup.MaxProcs()
+		} else {
+			maxProcs = 0
+		}
+	}
+	if maxProcs < 0 {
+		maxProcs = 0
+	}
+
+	if memoryLimit == RuntimeLimitAuto {
+		if getenv("GOMEMLIMIT") == "" {
+			memoryLimit = int64(float64(cgroup.MemoryBytes) * memoryLimitRatio)
+		} else {
+			memoryLimit = 0
+		}
+	}
+	if memoryLimit < 0 {
+		memoryLimit = 0
+	}
+	return maxProcs, memoryLimit
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeLimits(t *testing.T) {
+	t.Parallel()
+	cgroup := CgroupLimits{MemoryBytes: 1000, CPUs: 2.5}
+	noEnv := func(string) string { return "" }
+	env := func(name string) string {
+		return map[string]string{"GOMAXPROCS": "8", "GOMEMLIMIT": "1GiB"}[name]
+	}
+
+	for _, tc := range []struct {
+		name        string
+		maxProcs    int
+		memoryLimit int64
+		cgroup      CgroupLimits
+		getenv      func(string) string
+		expProcs    int
+		expMemory   int64
+	}{
+		{"auto", RuntimeLimitAuto, RuntimeLimitAuto, cgroup, noEnv, 2, 900},
+		{"auto unlimited", RuntimeLimitAuto, RuntimeLimitAuto, CgroupLimits{}, noEnv, 0, 0},
+		{"auto environment", RuntimeLimitAuto, RuntimeLimitAuto, cgroup, env, 0, 0},
+		{"off", RuntimeLimitOff, RuntimeLimitOff, cgroup, noEnv, 0, 0},
+		{"explicit", 4, 500, cgroup, env, 4, 500},
+	} {
+		procs, memory := runtimeLimits(tc.maxProcs, tc.memoryLimit, tc.cgroup, tc.getenv)
+		require.Equal(t, tc.expProcs, procs, tc.name)
+		require.Equal(t, tc.expMemory, memory, tc.name)
+	}
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States sent to systemd by SdNotify.
+const (
+	// SdReady tells systemd the service has finished starting.
+	SdReady = "READY=1"
+	// SdStopping tells systemd the service is shutting down.
+	SdStopping = "STOPPING=1"
+	// SdWatchdog tells systemd the service is alive, so the watchdog doesn't restart it.
+	SdWatchdog = "WATCHDOG=1"
+)
+
+// SdNotify sends state to systemd over the socket in $NOTIFY_SOCKET, which it sets for services with Type=notify.  It
+// returns false if the socket is not set, as the process was not started by systemd.
+func SdNotify(state string) (bool, error) {
+	return sdNotify(os.Getenv("NOTIFY_SOCKET"), state)
+}
+
+func sdNotify(socket, state string) (bool, error) {
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		// An abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdWatchdogInterval returns the interval at which SdWatchdog should be sent, which is half the timeout systemd set in
+// $WATCHDOG_USEC, or 0 if the watchdog is not enabled for this process.
+func SdWatchdogInterval() time.Duration {
+	return sdWatchdogInterval(os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID"), os.Getpid())
+}
+
+func sdWatchdogInterval(usec, pid string, self int) time.Duration {
+	if usec == "" {
+		return 0
+	}
+	if pid != "" && pid != strconv.Itoa(self) {
+		// The watchdog is for another process
+		return 0
+	}
+	timeout, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || timeout <= 0 {
+		return 0
+	}
+	return time.Duration(timeout) * time.Microsecond / 2
+}
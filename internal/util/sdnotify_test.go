@@ -0,0 +1,55 @@
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSdNotify(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("unixgram sockets are not supported")
+	}
+
+	sent, err := sdNotify("", SdReady)
+	require.NoError(t, err)
+	require.False(t, sent)
+
+	dir, err := ioutil.TempDir("", "sdnotify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sent, err = sdNotify(socket, SdReady)
+	require.NoError(t, err)
+	require.True(t, sent)
+	buf := make([]byte, 64)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, SdReady, string(buf[:n]))
+
+	_, err = sdNotify(filepath.Join(dir, "missing.sock"), SdReady)
+	require.Error(t, err)
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Parallel()
+	assert.Zero(t, sdWatchdogInterval("", "", 10))
+	assert.Zero(t, sdWatchdogInterval("invalid", "", 10))
+	assert.Zero(t, sdWatchdogInterval("0", "", 10))
+	assert.Zero(t, sdWatchdogInterval("30000000", "11", 10))
+	assert.Equal(t, 15*time.Second, sdWatchdogInterval("30000000", "", 10))
+	assert.Equal(t, 15*time.Second, sdWatchdogInterval("30000000", "10", 10))
+}
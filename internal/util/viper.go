@@ -1,7 +1,12 @@
 package util
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -9,6 +14,20 @@ import (
 // EnvPrefix is the prefix of the inspected environment variables.
 const EnvPrefix = "GSD" //Go Stats D
 
+// ParamConfigProfile is the name of the parameter with the profile of the configuration file to apply.
+const ParamConfigProfile = "config-profile"
+
+// secretWords are the words in the name of a setting which mark its value as secret.
+var secretWords = []string{"key", "token", "secret", "password", "credential"}
+
+// maskedValue replaces the value of a secret setting in the effective configuration.
+const maskedValue = "********"
+
+const (
+	includeKey = "include" // The files a configuration file includes, which it overrides
+	profileKey = "profile" // The sections of a configuration file which override the rest of it when selected
+)
+
 func GetSubViper(v *viper.Viper, key string) *viper.Viper {
 	n := v.Sub(key)
 	if n == nil {
@@ -31,3 +50,223 @@ func InitViper(v *viper.Viper, subViperName string) {
 	v.SetTypeByDefaultValue(true)
 	v.AutomaticEnv()
 }
+
+// ReadConfig reads the configuration file of v with LoadConfig, and applies it to v.
+func ReadConfig(v *viper.Viper, resolve func(value string) (string, error)) error {
+	cf, err := LoadConfig(v, resolve)
+	if err != nil {
+		return err
+	}
+	return cf.Apply(v)
+}
+
+// ConfigFile is a configuration file which has been read, so it can be applied to a viper later, or applied again to
+// undo a newer configuration.
+type ConfigFile struct {
+	path     string
+	raw      []byte
+	settings map[string]interface{}
+	files    []string // Every file read, including the files which are included
+}
+
+// LoadConfig reads the configuration file of v, which may be in any format viper supports, such as TOML or YAML,
+// without changing v.  The files listed in its include setting are read first, in order, relative to the file
+// including them, and every file overrides the settings of the files it includes.  Then the profile.<name> section
+// selected by ParamConfigProfile, if any, overrides the rest of the configuration, so a shared base can have small
+// overrides for each environment.  Finally, environment variables and files are substituted in every value with
+// Expand, and then every value is replaced by resolve, if it is not nil, so values may be references to secrets.
+func LoadConfig(v *viper.Viper, resolve func(value string) (string, error)) (*ConfigFile, error) {
+	path := v.ConfigFileUsed()
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	settings, err := readConfigFile(path, nil, &files)
+	if err != nil {
+		return nil, err
+	}
+	profiles, _ := settings[profileKey].(map[string]interface{})
+	delete(settings, profileKey)
+	if name := v.GetString(ParamConfigProfile); name != "" {
+		profile, ok := profiles[strings.ToLower(name)].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s %q has no %s.%s section", ParamConfigProfile, name, profileKey, name)
+		}
+		mergeSettings(settings, profile)
+	}
+	if err := expandSettings(settings, "", resolve); err != nil {
+		return nil, err
+	}
+	return &ConfigFile{
+		path:     path,
+		raw:      raw,
+		settings: settings,
+		files:    files,
+	}, nil
+}
+
+// Apply replaces the configuration file settings of v with the configuration file.  The defaults, flags, and
+// environment variables of v are kept.
+func (cf *ConfigFile) Apply(v *viper.Viper) error {
+	if err := v.ReadConfig(bytes.NewReader(cf.raw)); err != nil {
+		return fmt.Errorf("failed to read %s: %v", cf.path, err)
+	}
+	// MergeConfigMap keeps the sections of the map it is given, which must not be shared if it is applied again
+	return v.MergeConfigMap(copySettings(cf.settings))
+}
+
+// Files returns every file the configuration was read from, including the files which are included.
+func (cf *ConfigFile) Files() []string {
+	return cf.files
+}
+
+// copySettings returns a copy of settings, including the sections within it.
+func copySettings(settings map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if section, ok := value.(map[string]interface{}); ok {
+			value = copySettings(section)
+		}
+		copied[key] = value
+	}
+	return copied
+}
+
+// expandSettings expands every string value in settings, and in lists of values, with Expand, and then resolve.
+// prefix is the name of the section settings is in, to name the setting which could not be expanded.
+func expandSettings(settings map[string]interface{}, prefix string, resolve func(string) (string, error)) error {
+	expand := func(s string) (string, error) {
+		expanded, err := Expand(s)
+		if err != nil || resolve == nil {
+			return expanded, err
+		}
+		return resolve(expanded)
+	}
+	for key, value := range settings {
+		var err error
+		switch value := value.(type) {
+		case map[string]interface{}:
+			err = expandSettings(value, prefix+key+".", resolve)
+		case string:
+			settings[key], err = expand(value)
+		case []string:
+			for i, item := range value {
+				if value[i], err = expand(item); err != nil {
+					break
+				}
+			}
+		case []interface{}:
+			for i, item := range value {
+				if s, ok := item.(string); ok {
+					if value[i], err = expand(s); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			if _, ok := value.(map[string]interface{}); ok {
+				return err
+			}
+			return fmt.Errorf("invalid %s%s: %v", prefix, key, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile returns the settings of the configuration file at path, merged over the files it includes.
+// including is the files which included it, to detect a cycle, and every file read is added to files.
+func readConfigFile(path string, including []string, files *[]string) (map[string]interface{}, error) {
+	for _, p := range including {
+		if p == path {
+			return nil, fmt.Errorf("%s is included by itself, through %s", path, strings.Join(including, ", "))
+		}
+	}
+	fv := viper.New()
+	fv.SetConfigFile(path)
+	if err := fv.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	*files = append(*files, path)
+	settings := fv.AllSettings()
+	includes := fv.GetStringSlice(includeKey)
+	delete(settings, includeKey)
+
+	merged := map[string]interface{}{}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		included, err := readConfigFile(include, append(including, path), files)
+		if err != nil {
+			return nil, err
+		}
+		mergeSettings(merged, included)
+	}
+	mergeSettings(merged, settings)
+	return merged, nil
+}
+
+// mergeSettings merges src over dst, merging sections which are in both.
+func mergeSettings(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if srcSection, ok := value.(map[string]interface{}); ok {
+			if dstSection, ok := dst[key].(map[string]interface{}); ok {
+				mergeSettings(dstSection, srcSection)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// EffectiveConfig returns every setting of v as the server sees it, with the defaults, flags, environment variables,
+// and configuration file applied, so it can be encoded as json.  The value of a setting named like a secret, such as
+// api_key, or which isSecret returns true for, if it is not nil, is masked.
+func EffectiveConfig(v *viper.Viper, isSecret func(value string) bool) map[string]interface{} {
+	settings := v.AllSettings()
+	for key, value := range settings {
+		settings[key] = effectiveValue(key, value, isSecret)
+	}
+	return settings
+}
+
+// effectiveValue returns the value of the setting named key, with nested sections converted so they can be encoded as
+// json, and secrets masked.
+func effectiveValue(key string, value interface{}, isSecret func(string) bool) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = effectiveValue(k, v, isSecret)
+		}
+		return value
+	case map[interface{}]interface{}:
+		section := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			section[fmt.Sprint(k)] = effectiveValue(fmt.Sprint(k), v, isSecret)
+		}
+		return section
+	}
+	lower := strings.ToLower(key)
+	for _, word := range secretWords {
+		if strings.Contains(lower, word) && value != "" {
+			return maskedValue
+		}
+	}
+	switch value := value.(type) {
+	case []interface{}:
+		items := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			items = append(items, effectiveValue("", item, isSecret))
+		}
+		return items
+	case time.Duration:
+		return value.String()
+	case string:
+		if isSecret != nil && isSecret(value) {
+			return maskedValue
+		}
+	}
+	return value
+}
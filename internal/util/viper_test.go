@@ -0,0 +1,122 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	}
+}
+
+func TestReadConfigIncludesAndProfiles(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeConfigFiles(t, dir, map[string]string{
+		"base/common.toml": `
+backends = ['graphite']
+flush-interval = '10s'
+[graphite]
+address = 'base:2003'
+mode = 'tags'
+`,
+		"config.yaml": `
+include: [base/common.toml]
+flush-interval: 5s
+graphite:
+  address: staging:2003
+profile:
+  production:
+    graphite:
+      address: production:2003
+`,
+	})
+
+	v := viper.New()
+	v.SetConfigFile(filepath.Join(dir, "config.yaml"))
+	require.NoError(t, ReadConfig(v, nil))
+	assert.Equal(t, []string{"graphite"}, v.GetStringSlice("backends"))
+	assert.Equal(t, "5s", v.GetString("flush-interval"))
+	assert.Equal(t, "staging:2003", v.GetString("graphite.address"))
+	assert.Equal(t, "tags", v.GetString("graphite.mode"))
+
+	v.Set(ParamConfigProfile, "production")
+	require.NoError(t, ReadConfig(v, nil))
+	assert.Equal(t, "production:2003", v.GetString("graphite.address"))
+	assert.Equal(t, "tags", v.GetString("graphite.mode"))
+
+	v.Set(ParamConfigProfile, "development")
+	assert.EqualError(t, ReadConfig(v, nil), `config-profile "development" has no profile.development section`)
+}
+
+func TestReadConfigIncludeCycle(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeConfigFiles(t, dir, map[string]string{
+		"a.toml": "include = ['b.toml']\n",
+		"b.toml": "include = ['a.toml']\n",
+	})
+
+	v := viper.New()
+	v.SetConfigFile(filepath.Join(dir, "a.toml"))
+	assert.Error(t, ReadConfig(v, nil))
+}
+
+func TestReadConfigExpandsValues(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, os.Setenv("GOSTATSD_TEST_CONFIG_KEY", "secret"))
+	defer os.Unsetenv("GOSTATSD_TEST_CONFIG_KEY")
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeConfigFiles(t, dir, map[string]string{
+		"config.toml": `
+default-tags = ['env:${GOSTATSD_TEST_CONFIG_ENV:-dev}']
+[datadog]
+api_key = '${GOSTATSD_TEST_CONFIG_KEY}'
+`,
+		"missing.toml": `
+[datadog]
+api_key = '${GOSTATSD_TEST_CONFIG_MISSING}'
+`,
+	})
+
+	v := viper.New()
+	v.SetConfigFile(filepath.Join(dir, "config.toml"))
+	require.NoError(t, ReadConfig(v, nil))
+	assert.Equal(t, "secret", v.GetString("datadog.api_key"))
+	assert.Equal(t, []string{"env:dev"}, v.GetStringSlice("default-tags"))
+
+	v.SetConfigFile(filepath.Join(dir, "missing.toml"))
+	assert.EqualError(t, ReadConfig(v, nil), "invalid datadog.api_key: environment variable GOSTATSD_TEST_CONFIG_MISSING is not set")
+}
+
+func TestEffectiveConfigMasksSecrets(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetDefault("flush-interval", 10*time.Second)
+	v.Set("datadog", map[string]interface{}{"api_key": "abc", "address": "https://example.com"})
+	v.Set("newrelic", map[string]interface{}{"insert-url": "resolved"})
+
+	config := EffectiveConfig(v, func(value string) bool { return value == "resolved" })
+	assert.Equal(t, map[string]interface{}{
+		"flush-interval": "10s",
+		"datadog":        map[string]interface{}{"api_key": maskedValue, "address": "https://example.com"},
+		"newrelic":       map[string]interface{}{"insert-url": maskedValue},
+	}, config)
+}
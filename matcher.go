@@ -14,7 +14,18 @@ type StringMatch struct {
 
 type StringMatchList []StringMatch
 
+// NewStringMatch returns a StringMatch for s, and panics if it is an invalid regex.
 func NewStringMatch(s string) StringMatch {
+	sm, err := ParseStringMatch(s)
+	if err != nil {
+		panic(err)
+	}
+	return sm
+}
+
+// ParseStringMatch returns a StringMatch for s, which is an exact match, a prefix match if it ends with *, or a
+// regex if it starts with regex:, inverted if it starts with !.
+func ParseStringMatch(s string) (StringMatch, error) {
 	prefix := false
 	invert := strings.HasPrefix(s, "!")
 	if invert {
@@ -24,7 +35,10 @@ func NewStringMatch(s string) StringMatch {
 	var compiledRegex *regexp.Regexp = nil
 	if strings.HasPrefix(s, "regex:") {
 		s = s[6:]
-		compiledRegex = regexp.MustCompile(s)
+		var err error
+		if compiledRegex, err = regexp.Compile(s); err != nil {
+			return StringMatch{}, err
+		}
 	} else if strings.HasSuffix(s, "*") {
 		prefix = true
 		s = s[0 : len(s)-1]
@@ -34,7 +48,7 @@ func NewStringMatch(s string) StringMatch {
 		invertMatch: invert,
 		prefixMatch: prefix,
 		regex:       compiledRegex,
-	}
+	}, nil
 }
 
 // Match indicates if the provided string matches the criteria for this StringMatch
@@ -0,0 +1,122 @@
+package gostatsd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// MetricMetadata describes what a metric measures, for backends which can record it alongside the metric.
+type MetricMetadata struct {
+	// Unit is the unit of the values of the metric, such as millisecond, byte, or request, or "" if it has none.
+	Unit string
+	// Description is a description of the metric, or "".
+	Description string
+}
+
+// MetadataRegistry is the metadata of metrics, by the pattern of their name, so it is configured once for every
+// backend which supports it.
+type MetadataRegistry struct {
+	entries []metadataEntry
+}
+
+type metadataEntry struct {
+	match    StringMatchList // Any must match the name of a metric
+	metadata MetricMetadata
+}
+
+// metadataSettings are the settings of a metadata section.
+var metadataSettings = map[string]bool{
+	"match-metrics": true,
+	"unit":          true,
+	"description":   true,
+}
+
+// NewMetadataRegistryFromViper returns the metadata named in metric-metadata, each configured by its metadata section.
+func NewMetadataRegistryFromViper(v *viper.Viper) (*MetadataRegistry, error) {
+	registry := &MetadataRegistry{}
+	for _, name := range v.GetStringSlice(ParamMetricMetadata) {
+		vMetadata := v.Sub("metadata." + name)
+		if vMetadata == nil {
+			return nil, fmt.Errorf("metadata %q has no metadata.%s section", name, name)
+		}
+		entry, err := newMetadataEntryFromViper(name, vMetadata)
+		if err != nil {
+			return nil, err
+		}
+		registry.entries = append(registry.entries, entry)
+	}
+	return registry, nil
+}
+
+func newMetadataEntryFromViper(name string, v *viper.Viper) (metadataEntry, error) {
+	entry := metadataEntry{
+		metadata: MetricMetadata{
+			Unit:        v.GetString("unit"),
+			Description: v.GetString("description"),
+		},
+	}
+	for _, test := range v.GetStringSlice("match-metrics") {
+		sm, err := ParseStringMatch(test)
+		if err != nil {
+			return metadataEntry{}, fmt.Errorf("metadata.%s.match-metrics: %v", name, err)
+		}
+		entry.match = append(entry.match, sm)
+	}
+	if len(entry.match) == 0 {
+		return metadataEntry{}, fmt.Errorf("metadata.%s.match-metrics is required", name)
+	}
+	if entry.metadata == (MetricMetadata{}) {
+		return metadataEntry{}, fmt.Errorf("metadata.%s must have a unit or a description", name)
+	}
+	return entry, nil
+}
+
+// CheckMetadata returns an error listing every problem with the metadata, including every setting of a metadata
+// section which is not known, so a typo is not silently ignored.
+func CheckMetadata(v *viper.Viper) error {
+	var errs []string
+	for _, name := range v.GetStringSlice(ParamMetricMetadata) {
+		vMetadata := v.Sub("metadata." + name)
+		if vMetadata == nil {
+			errs = append(errs, fmt.Sprintf("metadata %q has no metadata.%s section", name, name))
+			continue
+		}
+		for _, key := range vMetadata.AllKeys() {
+			if !metadataSettings[key] {
+				errs = append(errs, fmt.Sprintf("unknown setting metadata.%s.%s", name, key))
+			}
+		}
+		if _, err := newMetadataEntryFromViper(name, vMetadata); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Len returns the number of metadata entries.  It is safe to call on a nil MetadataRegistry.
+func (r *MetadataRegistry) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.entries)
+}
+
+// Lookup returns the metadata of the first entry which matches the name of a metric, and if any did.  It is safe to
+// call on a nil MetadataRegistry.
+func (r *MetadataRegistry) Lookup(name string) (MetricMetadata, bool) {
+	if r == nil {
+		return MetricMetadata{}, false
+	}
+	for _, entry := range r.entries {
+		if entry.match.MatchAny(name) {
+			return entry.metadata, true
+		}
+	}
+	return MetricMetadata{}, false
+}
@@ -0,0 +1,76 @@
+package gostatsd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataRegistry(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+metric-metadata = ['latency', 'http']
+
+[metadata.latency]
+match-metrics = ['http.request.duration', 'regex:\.latency$']
+unit = 'millisecond'
+description = 'Time to serve a request'
+
+[metadata.http]
+match-metrics = ['http.*']
+unit = 'request'
+`)))
+	require.NoError(t, CheckMetadata(v))
+	registry, err := NewMetadataRegistryFromViper(v)
+	require.NoError(t, err)
+	assert.Equal(t, 2, registry.Len())
+
+	// The first entry which matches applies
+	md, ok := registry.Lookup("http.request.duration")
+	require.True(t, ok)
+	assert.Equal(t, MetricMetadata{Unit: "millisecond", Description: "Time to serve a request"}, md)
+	md, ok = registry.Lookup("db.latency")
+	require.True(t, ok)
+	assert.Equal(t, "millisecond", md.Unit)
+	md, ok = registry.Lookup("http.requests")
+	require.True(t, ok)
+	assert.Equal(t, MetricMetadata{Unit: "request"}, md)
+	_, ok = registry.Lookup("db.queries")
+	assert.False(t, ok)
+
+	var nilRegistry *MetadataRegistry
+	_, ok = nilRegistry.Lookup("http.requests")
+	assert.False(t, ok)
+	assert.Zero(t, nilRegistry.Len())
+}
+
+func TestCheckMetadata(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+metric-metadata = ['missing', 'typo', 'empty', 'nomatch']
+
+[metadata.typo]
+match-metrics = ['http.*']
+units = 'request'
+description = 'Requests'
+
+[metadata.empty]
+match-metrics = ['http.*']
+
+[metadata.nomatch]
+unit = 'byte'
+`)))
+	assert.EqualError(t, CheckMetadata(v), `metadata "missing" has no metadata.missing section; `+
+		`unknown setting metadata.typo.units; `+
+		`metadata.empty must have a unit or a description; `+
+		`metadata.nomatch.match-metrics is required`)
+	_, err := NewMetadataRegistryFromViper(v)
+	assert.Error(t, err)
+}
@@ -26,6 +26,7 @@ type MetricConsolidator struct {
 	maps          chan *MetricMap
 	sink          chan<- []*MetricMap
 	flushInterval time.Duration
+	flushRequests chan chan struct{} // Flushes requested by FlushNow, each closed once the flush is sent to the sink
 }
 
 func NewMetricConsolidator(spots int, flushInterval time.Duration, sink chan<- []*MetricMap) *MetricConsolidator {
@@ -34,6 +35,7 @@ func NewMetricConsolidator(spots int, flushInterval time.Duration, sink chan<- [
 	mc.Fill()
 	mc.flushInterval = flushInterval
 	mc.sink = sink
+	mc.flushRequests = make(chan chan struct{})
 	return mc
 }
 
@@ -47,10 +49,30 @@ func (mc *MetricConsolidator) Run(ctx context.Context) {
 			return
 		case <-t.C:
 			mc.Flush(ctx)
+		case done := <-mc.flushRequests:
+			mc.Flush(ctx)
+			close(done)
 		}
 	}
 }
 
+// FlushNow makes Run flush immediately, outside the flush interval, and waits until the MetricMaps have been sent to
+// the sink, or the context is done.
+func (mc *MetricConsolidator) FlushNow(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case mc.flushRequests <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Drain will collect all the MetricMaps in the MetricConsolidator and return them.  If the
 // context.Context is canceled before everything can be collected, they are returned to the
 // MetricConsolidator and nil is returned.
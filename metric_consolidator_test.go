@@ -65,6 +65,40 @@ func TestConsolidation(t *testing.T) {
 	require.EqualValues(t, expected, mm)
 }
 
+func TestConsolidatorFlushNow(t *testing.T) {
+	t.Parallel()
+	ctxTest, testDone := testContext(t)
+	defer testDone()
+
+	// The flush interval is never reached, so only FlushNow flushes
+	ch := make(chan []*MetricMap, 1)
+	mc := NewMetricConsolidator(2, time.Hour, ch)
+	mc.ReceiveMetrics([]*Metric{{Name: "foo", Type: COUNTER, Value: 1, Rate: 1}})
+
+	ctxRun, cancelRun := context.WithCancel(ctxTest)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		mc.Run(ctxRun)
+	}()
+	require.NoError(t, mc.FlushNow(ctxTest))
+	mms := <-ch
+	require.Len(t, mms, 2)
+	series := 0
+	for _, mm := range mms {
+		series += len(mm.Counters["foo"])
+	}
+	require.Equal(t, 1, series)
+	cancelRun()
+	wg.Wait()
+
+	// FlushNow gives up once the context is done, if Run has stopped
+	ctxCanceled, cancel := context.WithCancel(ctxTest)
+	cancel()
+	require.Equal(t, context.Canceled, mc.FlushNow(ctxCanceled))
+}
+
 func randomMetric(seed, variations int) *Metric {
 	m := &Metric{}
 	m.Type = MetricType(1 + (seed % 4))
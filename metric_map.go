@@ -54,93 +54,168 @@ func MergeMaps(mms []*MetricMap) *MetricMap {
 }
 
 func (mm *MetricMap) Merge(mmFrom *MetricMap) {
-	mmFrom.Counters.Each(func(metricName string, tagsKey string, counterFrom Counter) {
-		v, ok := mm.Counters[metricName]
+	mmFrom.MergeSharded([]*MetricMap{mm})
+}
+
+// MergeSharded merges every series of mmFrom into one of shards, chosen by the hash of its name and tags, so the same
+// series is always merged into the same shard.  It returns the number of series which were not in a shard, and the
+// number of timer and set values which were added.
+func (mm *MetricMap) MergeSharded(shards []*MetricMap) (series, samples int) {
+	shard := func(metricName, tagsKey string) *MetricMap {
+		if len(shards) == 1 {
+			return shards[0]
+		}
+		return shards[shardOf(metricName, tagsKey, len(shards))]
+	}
+	count := func(added bool, values int) {
+		if added {
+			series++
+		}
+		samples += values
+	}
+	mm.Counters.Each(func(metricName, tagsKey string, c Counter) {
+		count(shard(metricName, tagsKey).mergeCounter(metricName, tagsKey, c), 0)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g Gauge) {
+		count(shard(metricName, tagsKey).mergeGauge(metricName, tagsKey, g), 0)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t Timer) {
+		count(shard(metricName, tagsKey).mergeTimer(metricName, tagsKey, t), len(t.Values))
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s Set) {
+		count(shard(metricName, tagsKey).mergeSet(metricName, tagsKey, s))
+	})
+	return series, samples
+}
+
+// shardOf returns the shard of a series.  It hashes the tags as well as the name, unlike Bucket, so the series of
+// a metric are spread between shards, and the shards are independent of the Bucket which chose the aggregator.
+func shardOf(metricName, tagsKey string, count int) int {
+	// FNV-1a, inlined to avoid allocating a hash.Hash32 for every series
+	h := uint32(2166136261)
+	for idx := 0; idx < len(metricName); idx++ {
+		h = (h ^ uint32(metricName[idx])) * 16777619
+	}
+	for idx := 0; idx < len(tagsKey); idx++ {
+		h = (h ^ uint32(tagsKey[idx])) * 16777619
+	}
+	return int(h % uint32(count))
+}
+
+// mergeCounter merges a counter into the MetricMap, and returns true if it is a new series.
+func (mm *MetricMap) mergeCounter(metricName string, tagsKey string, counterFrom Counter) bool {
+	v, ok := mm.Counters[metricName]
+	if ok {
+		counterInto, ok := v[tagsKey]
 		if ok {
-			counterInto, ok := v[tagsKey]
-			if ok {
-				if counterInto.Timestamp < counterFrom.Timestamp {
-					counterInto.Timestamp = counterFrom.Timestamp
-				}
-				counterInto.Value += counterFrom.Value
-			} else {
-				counterInto = counterFrom
+			if counterInto.Timestamp < counterFrom.Timestamp {
+				counterInto.Timestamp = counterFrom.Timestamp
 			}
-			v[tagsKey] = counterInto
+			counterInto.Value += counterFrom.Value
 		} else {
-			mm.Counters[metricName] = map[string]Counter{
-				tagsKey: counterFrom,
-			}
+			counterInto = counterFrom
 		}
-	})
+		v[tagsKey] = counterInto
+		return !ok
+	}
+	mm.Counters[metricName] = map[string]Counter{
+		tagsKey: counterFrom,
+	}
+	return true
+}
 
-	mmFrom.Gauges.Each(func(metricName string, tagsKey string, gaugeFrom Gauge) {
-		v, ok := mm.Gauges[metricName]
+// mergeGauge merges a gauge into the MetricMap, and returns true if it is a new series.
+func (mm *MetricMap) mergeGauge(metricName string, tagsKey string, gaugeFrom Gauge) bool {
+	v, ok := mm.Gauges[metricName]
+	if ok {
+		gaugeInto, ok := v[tagsKey]
 		if ok {
-			gaugeInto, ok := v[tagsKey]
-			if ok {
-				if gaugeInto.Timestamp < gaugeFrom.Timestamp {
-					gaugeInto.Timestamp = gaugeFrom.Timestamp
-					gaugeInto.Value = gaugeFrom.Value
-				}
-			} else {
-				gaugeInto = gaugeFrom
+			if gaugeInto.Timestamp < gaugeFrom.Timestamp {
+				gaugeInto.Timestamp = gaugeFrom.Timestamp
+				gaugeInto.Value = gaugeFrom.Value
 			}
-			v[tagsKey] = gaugeInto
 		} else {
-			mm.Gauges[metricName] = map[string]Gauge{
-				tagsKey: gaugeFrom,
-			}
+			gaugeInto = gaugeFrom
 		}
-	})
+		v[tagsKey] = gaugeInto
+		return !ok
+	}
+	mm.Gauges[metricName] = map[string]Gauge{
+		tagsKey: gaugeFrom,
+	}
+	return true
+}
 
-	mmFrom.Timers.Each(func(metricName string, tagsKey string, timerFrom Timer) {
-		v, ok := mm.Timers[metricName]
+// mergeTimer merges a timer into the MetricMap, and returns true if it is a new series.
+func (mm *MetricMap) mergeTimer(metricName string, tagsKey string, timerFrom Timer) bool {
+	v, ok := mm.Timers[metricName]
+	if ok {
+		timerInto, ok := v[tagsKey]
 		if ok {
-			timerInto, ok := v[tagsKey]
-			if ok {
-				if timerInto.Timestamp < timerFrom.Timestamp {
-					timerInto.Timestamp = timerFrom.Timestamp
-				}
-				timerInto.Values = append(timerInto.Values, timerFrom.Values...)
-				timerInto.SampledCount += timerFrom.SampledCount
-			} else {
-				timerInto = timerFrom
+			if timerInto.Timestamp < timerFrom.Timestamp {
+				timerInto.Timestamp = timerFrom.Timestamp
 			}
-			v[tagsKey] = timerInto
+			timerInto.Values = append(timerInto.Values, timerFrom.Values...)
+			timerInto.SampledCount += timerFrom.SampledCount
 		} else {
-			mm.Timers[metricName] = map[string]Timer{
-				tagsKey: timerFrom,
-			}
+			timerInto = timerFrom
 		}
-	})
-	mmFrom.Sets.Each(func(metricName string, tagsKey string, setFrom Set) {
-		v, ok := mm.Sets[metricName]
+		v[tagsKey] = timerInto
+		return !ok
+	}
+	mm.Timers[metricName] = map[string]Timer{
+		tagsKey: timerFrom,
+	}
+	return true
+}
+
+// mergeSet merges a set into the MetricMap, and returns true if it is a new series, and the number of values added.
+func (mm *MetricMap) mergeSet(metricName string, tagsKey string, setFrom Set) (bool, int) {
+	v, ok := mm.Sets[metricName]
+	if ok {
+		setInto, ok := v[tagsKey]
 		if ok {
-			setInto, ok := v[tagsKey]
-			if ok {
-				if setInto.Timestamp < setFrom.Timestamp {
-					setInto.Timestamp = setFrom.Timestamp
-				}
-				for setValue := range setFrom.Values {
-					setInto.Values[setValue] = struct{}{}
-				}
-			} else {
-				setInto = setFrom
+			if setInto.Timestamp < setFrom.Timestamp {
+				setInto.Timestamp = setFrom.Timestamp
 			}
-			v[tagsKey] = setInto
-		} else {
-			mm.Sets[metricName] = map[string]Set{
-				tagsKey: setFrom,
+			before := len(setInto.Values)
+			for setValue := range setFrom.Values {
+				setInto.Values[setValue] = struct{}{}
 			}
+			v[tagsKey] = setInto
+			return false, len(setInto.Values) - before
 		}
-	})
+		v[tagsKey] = setFrom
+		return true, len(setFrom.Values)
+	}
+	mm.Sets[metricName] = map[string]Set{
+		tagsKey: setFrom,
+	}
+	return true, len(setFrom.Values)
 }
 
 func (mm *MetricMap) IsEmpty() bool {
 	return len(mm.Counters)+len(mm.Timers)+len(mm.Sets)+len(mm.Gauges) == 0
 }
 
+// Len returns the number of series in the MetricMap.
+func (mm *MetricMap) Len() int {
+	n := 0
+	for _, series := range mm.Counters {
+		n += len(series)
+	}
+	for _, series := range mm.Timers {
+		n += len(series)
+	}
+	for _, series := range mm.Sets {
+		n += len(series)
+	}
+	for _, series := range mm.Gauges {
+		n += len(series)
+	}
+	return n
+}
+
 // Split will split a MetricMap up in to multiple MetricMaps, where each one contains metrics only for its buckets.
 func (mm *MetricMap) Split(count int) []*MetricMap {
 	maps := make([]*MetricMap, count)
@@ -184,6 +259,19 @@ func (mm *MetricMap) Split(count int) []*MetricMap {
 	return maps
 }
 
+// SplitByBucket will split a MetricMap up in to count MetricMaps, where bucket returns the index of the MetricMap each
+// series belongs in.
+func (mm *MetricMap) SplitByBucket(count int, bucket func(metricName string, tagsKey string) int) []*MetricMap {
+	maps := make([]*MetricMap, count)
+	for i := 0; i < count; i++ {
+		maps[i] = NewMetricMap()
+	}
+	mm.copyEach(func(metricName string, tagsKey string, _ Source) *MetricMap {
+		return maps[bucket(metricName, tagsKey)]
+	})
+	return maps
+}
+
 func tagsMatch(tagNames []string, tagsKey string) string {
 	res := make([]string, 0)
 	for _, tv := range strings.Split(tagsKey, ",") {
@@ -261,6 +349,111 @@ func (mm *MetricMap) SplitByTags(tagNames []string) map[string]*MetricMap {
 	return maps
 }
 
+// SplitBySource will split a MetricMap up in to multiple MetricMaps, where each one contains metrics only from a
+// single source.
+func (mm *MetricMap) SplitBySource() map[Source]*MetricMap {
+	maps := make(map[Source]*MetricMap)
+	mm.copyEach(func(_ string, _ string, source Source) *MetricMap {
+		mmSplit, ok := maps[source]
+		if !ok {
+			mmSplit = NewMetricMap()
+			maps[source] = mmSplit
+		}
+		return mmSplit
+	})
+	return maps
+}
+
+// copyEach copies each series in to the MetricMap returned by dest for it.  Series are not merged, so dest must not
+// return a MetricMap which already has the series.
+func (mm *MetricMap) copyEach(dest func(metricName string, tagsKey string, source Source) *MetricMap) {
+	mm.Counters.Each(func(metricName string, tagsKey string, c Counter) {
+		mmDest := dest(metricName, tagsKey, c.Source)
+		if v, ok := mmDest.Counters[metricName]; ok {
+			v[tagsKey] = c
+		} else {
+			mmDest.Counters[metricName] = map[string]Counter{tagsKey: c}
+		}
+	})
+	mm.Gauges.Each(func(metricName string, tagsKey string, g Gauge) {
+		mmDest := dest(metricName, tagsKey, g.Source)
+		if v, ok := mmDest.Gauges[metricName]; ok {
+			v[tagsKey] = g
+		} else {
+			mmDest.Gauges[metricName] = map[string]Gauge{tagsKey: g}
+		}
+	})
+	mm.Timers.Each(func(metricName string, tagsKey string, t Timer) {
+		mmDest := dest(metricName, tagsKey, t.Source)
+		if v, ok := mmDest.Timers[metricName]; ok {
+			v[tagsKey] = t
+		} else {
+			mmDest.Timers[metricName] = map[string]Timer{tagsKey: t}
+		}
+	})
+	mm.Sets.Each(func(metricName string, tagsKey string, s Set) {
+		mmDest := dest(metricName, tagsKey, s.Source)
+		if v, ok := mmDest.Sets[metricName]; ok {
+			v[tagsKey] = s
+		} else {
+			mmDest.Sets[metricName] = map[string]Set{tagsKey: s}
+		}
+	})
+}
+
+// AddTagsSetSource adds tags to every metric in the MetricMap, and sets their source.  Metrics which end up with the
+// same name, tags and source are merged.
+func (mm *MetricMap) AddTagsSetSource(additionalTags Tags, newSource Source) {
+	counters, gauges, timers, sets := mm.Counters, mm.Gauges, mm.Timers, mm.Sets
+	mm.Counters, mm.Gauges, mm.Timers, mm.Sets = Counters{}, Gauges{}, Timers{}, Sets{}
+
+	counters.Each(func(metricName string, _ string, c Counter) {
+		c.Tags = c.Tags.Concat(additionalTags)
+		c.Source = newSource
+		mm.mergeCounter(metricName, FormatTagsKey(c.Source, c.Tags), c)
+	})
+	gauges.Each(func(metricName string, _ string, g Gauge) {
+		g.Tags = g.Tags.Concat(additionalTags)
+		g.Source = newSource
+		mm.mergeGauge(metricName, FormatTagsKey(g.Source, g.Tags), g)
+	})
+	timers.Each(func(metricName string, _ string, t Timer) {
+		t.Tags = t.Tags.Concat(additionalTags)
+		t.Source = newSource
+		mm.mergeTimer(metricName, FormatTagsKey(t.Source, t.Tags), t)
+	})
+	sets.Each(func(metricName string, _ string, s Set) {
+		s.Tags = s.Tags.Concat(additionalTags)
+		s.Source = newSource
+		mm.mergeSet(metricName, FormatTagsKey(s.Source, s.Tags), s)
+	})
+}
+
+// ReplaceTag replaces any tag with the given name on every metric in the MetricMap with "name:value", so a client
+// can't set it themselves.  If value is "", the tag is only removed.  Metrics which end up with the same name, tags and
+// source are merged.
+func (mm *MetricMap) ReplaceTag(name, value string) {
+	counters, gauges, timers, sets := mm.Counters, mm.Gauges, mm.Timers, mm.Sets
+	mm.Counters, mm.Gauges, mm.Timers, mm.Sets = Counters{}, Gauges{}, Timers{}, Sets{}
+
+	counters.Each(func(metricName string, _ string, c Counter) {
+		c.Tags = c.Tags.ReplaceTag(name, value)
+		mm.mergeCounter(metricName, FormatTagsKey(c.Source, c.Tags), c)
+	})
+	gauges.Each(func(metricName string, _ string, g Gauge) {
+		g.Tags = g.Tags.ReplaceTag(name, value)
+		mm.mergeGauge(metricName, FormatTagsKey(g.Source, g.Tags), g)
+	})
+	timers.Each(func(metricName string, _ string, t Timer) {
+		t.Tags = t.Tags.ReplaceTag(name, value)
+		mm.mergeTimer(metricName, FormatTagsKey(t.Source, t.Tags), t)
+	})
+	sets.Each(func(metricName string, _ string, s Set) {
+		s.Tags = s.Tags.ReplaceTag(name, value)
+		mm.mergeSet(metricName, FormatTagsKey(s.Source, s.Tags), s)
+	})
+}
+
 func (mm *MetricMap) receiveCounter(m *Metric, tagsKey string) {
 	value := int64(m.Value / m.Rate)
 	v, ok := mm.Counters[m.Name]
@@ -307,6 +307,178 @@ func TestMetricMapSplit(t *testing.T) {
 	require.EqualValues(t, mmOriginal, mmMerged)
 }
 
+func TestMetricMapMergeSharded(t *testing.T) {
+	t.Parallel()
+	mmOriginal := NewMetricMap()
+	for _, m := range metricsFixtures() {
+		mmOriginal.Receive(m)
+	}
+
+	timerValues, setValues := 0, 0
+	mmOriginal.Timers.Each(func(metricName, tagsKey string, t Timer) {
+		timerValues += len(t.Values)
+	})
+	mmOriginal.Sets.Each(func(metricName, tagsKey string, s Set) {
+		setValues += len(s.Values)
+	})
+
+	shards := []*MetricMap{NewMetricMap(), NewMetricMap(), NewMetricMap()}
+	series, samples := mmOriginal.MergeSharded(shards)
+	require.Equal(t, mmOriginal.Len(), series)
+	require.Equal(t, timerValues+setValues, samples)
+	series, samples = mmOriginal.MergeSharded(shards) // Each series is merged into the shard it is already in
+	require.Zero(t, series)
+	require.Equal(t, timerValues, samples) // Timer values are appended again, but set values are already in the set
+
+	expected := NewMetricMap()
+	expected.Merge(mmOriginal)
+	expected.Merge(mmOriginal)
+	mmMerged := NewMetricMap()
+	for _, shard := range shards {
+		require.False(t, shard.IsEmpty())
+		mmMerged.Merge(shard)
+	}
+	require.Equal(t, expected.Len(), mmMerged.Len())
+	require.EqualValues(t, expected, mmMerged)
+}
+
+func TestMetricMapSplitByBucket(t *testing.T) {
+	mmOriginal := NewMetricMap()
+	mmOriginal.Counters["m"] = map[string]Counter{
+		"t.s.h1": {Tags: Tags{"t"}, Source: "h1", Value: 10},
+		"t.s.h2": {Tags: Tags{"t"}, Source: "h2", Value: 20},
+	}
+	mmOriginal.Gauges["m"] = map[string]Gauge{
+		"t.s.h1": {Tags: Tags{"t"}, Source: "h1", Value: 10},
+		"t.s.h2": {Tags: Tags{"t"}, Source: "h2", Value: 20},
+	}
+	mmOriginal.Timers["m"] = map[string]Timer{
+		"t.s.h1": {Tags: Tags{"t"}, Source: "h1", Values: []float64{10, 50}},
+		"t.s.h2": {Tags: Tags{"t"}, Source: "h2", Values: []float64{20, 40}},
+	}
+	mmOriginal.Sets["m"] = map[string]Set{
+		"t.s.h1": {Tags: Tags{"t"}, Source: "h1", Values: map[string]struct{}{"10": {}, "50": {}}},
+		"t.s.h2": {Tags: Tags{"t"}, Source: "h2", Values: map[string]struct{}{"20": {}, "40": {}}},
+	}
+
+	mms := mmOriginal.SplitByBucket(2, func(metricName string, tagsKey string) int {
+		if tagsKey == "t.s.h1" {
+			return 0
+		}
+		return 1
+	})
+	require.Len(t, mms, 2)
+	for i, host := range []string{"t.s.h1", "t.s.h2"} {
+		require.Len(t, mms[i].Counters["m"], 1)
+		require.Contains(t, mms[i].Counters["m"], host)
+		require.Len(t, mms[i].Gauges["m"], 1)
+		require.Contains(t, mms[i].Gauges["m"], host)
+		require.Len(t, mms[i].Timers["m"], 1)
+		require.Contains(t, mms[i].Timers["m"], host)
+		require.Len(t, mms[i].Sets["m"], 1)
+		require.Contains(t, mms[i].Sets["m"], host)
+	}
+}
+
+func TestMetricMapSplitBySource(t *testing.T) {
+	mmOriginal := NewMetricMap()
+	mmOriginal.Counters["m"] = map[string]Counter{
+		"t,s:h1": {Tags: Tags{"t"}, Source: "h1", Value: 10},
+		"t,s:h2": {Tags: Tags{"t"}, Source: "h2", Value: 20},
+	}
+	mmOriginal.Gauges["m"] = map[string]Gauge{
+		"t,s:h1": {Tags: Tags{"t"}, Source: "h1", Value: 10},
+		"t,s:h3": {Tags: Tags{"t"}, Source: "h3", Value: 30},
+	}
+	mmOriginal.Timers["m"] = map[string]Timer{
+		"t,s:h2": {Tags: Tags{"t"}, Source: "h2", Values: []float64{20, 40}},
+	}
+	mmOriginal.Sets["m"] = map[string]Set{
+		"t,s:h3": {Tags: Tags{"t"}, Source: "h3", Values: map[string]struct{}{"30": {}}},
+	}
+
+	mms := mmOriginal.SplitBySource()
+	require.Len(t, mms, 3)
+	mmMerged := NewMetricMap()
+	for source, mmSplit := range mms {
+		mmSplit.Counters.Each(func(_ string, _ string, c Counter) { require.Equal(t, source, c.Source) })
+		mmSplit.Gauges.Each(func(_ string, _ string, g Gauge) { require.Equal(t, source, g.Source) })
+		mmSplit.Timers.Each(func(_ string, _ string, t2 Timer) { require.Equal(t, source, t2.Source) })
+		mmSplit.Sets.Each(func(_ string, _ string, s Set) { require.Equal(t, source, s.Source) })
+		mmMerged.Merge(mmSplit)
+	}
+	// Make sure when merge back they are the same
+	require.EqualValues(t, mmOriginal, mmMerged)
+}
+
+func TestMetricMapAddTagsSetSource(t *testing.T) {
+	mm := NewMetricMap()
+	mm.Counters["m"] = map[string]Counter{
+		"t,s:h1": {Tags: Tags{"t"}, Source: "h1", Value: 10, Timestamp: 10},
+		"t,s:h2": {Tags: Tags{"t"}, Source: "h2", Value: 20, Timestamp: 20},
+	}
+	mm.Gauges["m"] = map[string]Gauge{
+		"t,s:h1": {Tags: Tags{"t"}, Source: "h1", Value: 10, Timestamp: 10},
+	}
+	mm.Timers["m"] = map[string]Timer{
+		"t,s:h1": {Tags: Tags{"t"}, Source: "h1", Values: []float64{10}},
+	}
+	mm.Sets["m"] = map[string]Set{
+		"t,s:h1": {Tags: Tags{"t"}, Source: "h1", Values: map[string]struct{}{"10": {}}},
+	}
+
+	mm.AddTagsSetSource(Tags{"a:b"}, "i-1")
+
+	// Both counters now have the same tags and source, so they are merged
+	expected := NewMetricMap()
+	expected.Counters["m"] = map[string]Counter{
+		"a:b,t,s:i-1": {Tags: Tags{"a:b", "t"}, Source: "i-1", Value: 30, Timestamp: 20},
+	}
+	expected.Gauges["m"] = map[string]Gauge{
+		"a:b,t,s:i-1": {Tags: Tags{"a:b", "t"}, Source: "i-1", Value: 10, Timestamp: 10},
+	}
+	expected.Timers["m"] = map[string]Timer{
+		"a:b,t,s:i-1": {Tags: Tags{"a:b", "t"}, Source: "i-1", Values: []float64{10}},
+	}
+	expected.Sets["m"] = map[string]Set{
+		"a:b,t,s:i-1": {Tags: Tags{"a:b", "t"}, Source: "i-1", Values: map[string]struct{}{"10": {}}},
+	}
+	require.EqualValues(t, expected, mm)
+}
+
+func TestMetricMapReplaceTag(t *testing.T) {
+	mm := NewMetricMap()
+	mm.Counters["m"] = map[string]Counter{
+		"t,s:h1":              {Tags: Tags{"t"}, Source: "h1", Value: 10, Timestamp: 10},
+		"t,tenant:other,s:h1": {Tags: Tags{"t", "tenant:other"}, Source: "h1", Value: 20, Timestamp: 20},
+	}
+	mm.Gauges["m"] = map[string]Gauge{
+		"tenant,s:h1": {Tags: Tags{"tenant"}, Source: "h1", Value: 10, Timestamp: 10},
+	}
+
+	mm.ReplaceTag("tenant", "team-a")
+
+	// Both counters now have the same tags and source, so they are merged
+	expected := NewMetricMap()
+	expected.Counters["m"] = map[string]Counter{
+		"t,tenant:team-a,s:h1": {Tags: Tags{"t", "tenant:team-a"}, Source: "h1", Value: 30, Timestamp: 20},
+	}
+	expected.Gauges["m"] = map[string]Gauge{
+		"tenant:team-a,s:h1": {Tags: Tags{"tenant:team-a"}, Source: "h1", Value: 10, Timestamp: 10},
+	}
+	require.EqualValues(t, expected, mm)
+
+	mm.ReplaceTag("tenant", "")
+	expected = NewMetricMap()
+	expected.Counters["m"] = map[string]Counter{
+		"t,s:h1": {Tags: Tags{"t"}, Source: "h1", Value: 30, Timestamp: 20},
+	}
+	expected.Gauges["m"] = map[string]Gauge{
+		",s:h1": {Tags: Tags{}, Source: "h1", Value: 10, Timestamp: 10},
+	}
+	require.EqualValues(t, expected, mm)
+}
+
 func TestMetricMapIsEmpty(t *testing.T) {
 	mm := NewMetricMap()
 	require.True(t, mm.IsEmpty())
@@ -336,6 +508,18 @@ func TestMetricMapIsEmpty(t *testing.T) {
 	require.True(t, mm.IsEmpty())
 }
 
+func TestMetricMapLen(t *testing.T) {
+	mm := NewMetricMap()
+	require.Zero(t, mm.Len())
+
+	mm.Counters["m"] = map[string]Counter{"t.s.h1": {}, "t.s.h2": {}}
+	mm.Gauges["m"] = map[string]Gauge{"t.s.h1": {}}
+	mm.Timers["m"] = map[string]Timer{"t.s.h1": {}}
+	mm.Timers["n"] = map[string]Timer{"t.s.h1": {}}
+	mm.Sets["m"] = map[string]Set{"t.s.h1": {}}
+	require.Equal(t, 6, mm.Len())
+}
+
 func TestTagsMatch(t *testing.T) {
 	tagsKey := "author:bob,env:dev,region:us-east-1,service:monitor,other:abc"
 
@@ -3,6 +3,9 @@ package gostatsd
 import (
 	"fmt"
 	"hash/adler32"
+	"sync"
+
+	"github.com/hligit/gostatsd/internal/intern"
 )
 
 // MetricType is an enumeration of all the possible types of Metric.
@@ -107,12 +110,47 @@ func (m *Metric) FormatTagsKey() string {
 	return m.TagsKey
 }
 
+// tagsKeys shares the tags keys of series between every MetricMap, as the same series are aggregated again every
+// flush, and by every stage of the pipeline.
+var tagsKeys = intern.New(1 << 16)
+
+// ResetTagsKeys drops the tags keys shared between MetricMaps, so the memory they use can be freed.  They are shared
+// again as they are formatted.
+func ResetTagsKeys() {
+	tagsKeys.Reset()
+}
+
+// maxTagsKeyBuffer is the largest buffer kept for formatting tags keys, so an unusually large tag set does not pin
+// its memory.
+const maxTagsKeyBuffer = 4096
+
+// tagsKeyBuffers holds the buffers tags keys are formatted in, so formatting a key which is already in tagsKeys does
+// not allocate.
+var tagsKeyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+// FormatTagsKey returns the tags and source rendered as a string which uniquely identifies the tagset in a map.  The
+// tags are sorted in place.
 func FormatTagsKey(source Source, tags Tags) string {
-	t := tags.SortedString()
-	if source == "" {
-		return t
+	tags.Sort()
+	bp := tagsKeyBuffers.Get().(*[]byte)
+	b := tags.appendTo((*bp)[:0])
+	if source != "" {
+		b = append(b, ',')
+		b = append(b, StatsdSourceID...)
+		b = append(b, ':')
+		b = append(b, source...)
+	}
+	key := tagsKeys.Bytes(b)
+	if cap(b) <= maxTagsKeyBuffer {
+		*bp = b
+		tagsKeyBuffers.Put(bp)
 	}
-	return t + "," + StatsdSourceID + ":" + string(source)
+	return key
 }
 
 // AggregatedMetrics is an interface for aggregated metrics.
@@ -1,6 +1,8 @@
 package gostatsd
 
 import (
+	"fmt"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -53,3 +55,47 @@ func TestUpdateTags(t *testing.T) {
 	m.FormatTagsKey()
 	require.EqualValues(t, "foo,foo2,s:source2", m.TagsKey)
 }
+
+func TestFormatTagsKey(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		source   Source
+		tags     Tags
+		expected string
+	}{
+		{"", nil, ""},
+		{"", Tags{"b", "a"}, "a,b"},
+		{"source", nil, ",s:source"},
+		{"source", Tags{"a:1", "b:2"}, "a:1,b:2,s:source"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, FormatTagsKey(tt.source, tt.tags))
+		require.True(t, sort.StringsAreSorted(tt.tags), "tags are sorted in place")
+	}
+}
+
+func BenchmarkFormatTagsKey(b *testing.B) {
+	tags := Tags{"env:prod", "instance:i-0123456789", "region:us-east-1", "service:api", "version:1.2.3"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		FormatTagsKey("10.0.0.1", tags)
+	}
+}
+
+// BenchmarkFormatTagsKeyParallel measures the contention on the shared tags keys when every parser formats them at
+// once, with enough distinct series that they spread across the shards of the interner.
+func BenchmarkFormatTagsKeyParallel(b *testing.B) {
+	sources := make([]Source, 1024)
+	for idx := range sources {
+		sources[idx] = Source(fmt.Sprintf("10.0.%d.%d", idx/256, idx%256))
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		tags := Tags{"env:prod", "instance:i-0123456789", "region:us-east-1", "service:api", "version:1.2.3"}
+		idx := 0
+		for pb.Next() {
+			FormatTagsKey(sources[idx%len(sources)], tags)
+			idx++
+		}
+	})
+}
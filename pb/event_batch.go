@@ -0,0 +1,38 @@
+package pb
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// MarshalEventBatch serializes a batch of events, as the body of /v2/event in ProtocolVersion3.  Each event is
+// prefixed with its length as a varint.
+func MarshalEventBatch(events []*EventV2) ([]byte, error) {
+	buf := proto.NewBuffer(nil)
+	for _, event := range events {
+		if err := buf.EncodeMessage(event); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalEventBatch parses a batch of events serialized by MarshalEventBatch.
+func UnmarshalEventBatch(b []byte) ([]*EventV2, error) {
+	var events []*EventV2
+	for len(b) > 0 {
+		size, n := proto.DecodeVarint(b)
+		if n == 0 || size > uint64(len(b)-n) {
+			return nil, errors.New("truncated event batch")
+		}
+		b = b[n:]
+		event := &EventV2{}
+		if err := proto.Unmarshal(b[:size], event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		b = b[size:]
+	}
+	return events, nil
+}
@@ -0,0 +1,30 @@
+package pb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBatchRoundTrip(t *testing.T) {
+	t.Parallel()
+	events := []*EventV2{
+		{Title: "deploy", Text: "deployed api", Tags: []string{"service:api"}, Type: EventV2_Success},
+		{Title: "rollback", AggregationKey: "api", Priority: EventV2_Low},
+	}
+	b, err := MarshalEventBatch(events)
+	require.NoError(t, err)
+
+	decoded, err := UnmarshalEventBatch(b)
+	require.NoError(t, err)
+	require.Len(t, decoded, 2)
+	assert.Equal(t, "deploy", decoded[0].Title)
+	assert.Equal(t, []string{"service:api"}, decoded[0].Tags)
+	assert.Equal(t, EventV2_Success, decoded[0].Type)
+	assert.Equal(t, "api", decoded[1].AggregationKey)
+	assert.Equal(t, EventV2_Low, decoded[1].Priority)
+
+	_, err = UnmarshalEventBatch(b[:len(b)-1])
+	assert.Error(t, err)
+}
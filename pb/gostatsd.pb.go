@@ -3,9 +3,16 @@
 
 package pb
 
-import proto "github.com/golang/protobuf/proto"
-import fmt "fmt"
-import math "math"
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	empty "github.com/golang/protobuf/ptypes/empty"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
@@ -16,7 +23,7 @@ var _ = math.Inf
 // is compatible with the proto package it is being compiled against.
 // A compilation error at this line likely means your copy of the
 // proto package needs to be updated.
-const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type EventV2_EventPriority int32
 
@@ -29,6 +36,7 @@ var EventV2_EventPriority_name = map[int32]string{
 	0: "Normal",
 	1: "Low",
 }
+
 var EventV2_EventPriority_value = map[string]int32{
 	"Normal": 0,
 	"Low":    1,
@@ -37,8 +45,9 @@ var EventV2_EventPriority_value = map[string]int32{
 func (x EventV2_EventPriority) String() string {
 	return proto.EnumName(EventV2_EventPriority_name, int32(x))
 }
+
 func (EventV2_EventPriority) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{9, 0}
+	return fileDescriptor_fb943a1cf70635ae, []int{9, 0}
 }
 
 type EventV2_AlertType int32
@@ -56,6 +65,7 @@ var EventV2_AlertType_name = map[int32]string{
 	2: "Error",
 	3: "Success",
 }
+
 var EventV2_AlertType_value = map[string]int32{
 	"Info":    0,
 	"Warning": 1,
@@ -66,8 +76,9 @@ var EventV2_AlertType_value = map[string]int32{
 func (x EventV2_AlertType) String() string {
 	return proto.EnumName(EventV2_AlertType_name, int32(x))
 }
+
 func (EventV2_AlertType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{9, 1}
+	return fileDescriptor_fb943a1cf70635ae, []int{9, 1}
 }
 
 type RawMessageV2 struct {
@@ -84,16 +95,17 @@ func (m *RawMessageV2) Reset()         { *m = RawMessageV2{} }
 func (m *RawMessageV2) String() string { return proto.CompactTextString(m) }
 func (*RawMessageV2) ProtoMessage()    {}
 func (*RawMessageV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{0}
+	return fileDescriptor_fb943a1cf70635ae, []int{0}
 }
+
 func (m *RawMessageV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawMessageV2.Unmarshal(m, b)
 }
 func (m *RawMessageV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_RawMessageV2.Marshal(b, m, deterministic)
 }
-func (dst *RawMessageV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_RawMessageV2.Merge(dst, src)
+func (m *RawMessageV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RawMessageV2.Merge(m, src)
 }
 func (m *RawMessageV2) XXX_Size() int {
 	return xxx_messageInfo_RawMessageV2.Size(m)
@@ -143,16 +155,17 @@ func (m *CounterTagV2) Reset()         { *m = CounterTagV2{} }
 func (m *CounterTagV2) String() string { return proto.CompactTextString(m) }
 func (*CounterTagV2) ProtoMessage()    {}
 func (*CounterTagV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{1}
+	return fileDescriptor_fb943a1cf70635ae, []int{1}
 }
+
 func (m *CounterTagV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_CounterTagV2.Unmarshal(m, b)
 }
 func (m *CounterTagV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_CounterTagV2.Marshal(b, m, deterministic)
 }
-func (dst *CounterTagV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_CounterTagV2.Merge(dst, src)
+func (m *CounterTagV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CounterTagV2.Merge(m, src)
 }
 func (m *CounterTagV2) XXX_Size() int {
 	return xxx_messageInfo_CounterTagV2.Size(m)
@@ -181,16 +194,17 @@ func (m *GaugeTagV2) Reset()         { *m = GaugeTagV2{} }
 func (m *GaugeTagV2) String() string { return proto.CompactTextString(m) }
 func (*GaugeTagV2) ProtoMessage()    {}
 func (*GaugeTagV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{2}
+	return fileDescriptor_fb943a1cf70635ae, []int{2}
 }
+
 func (m *GaugeTagV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GaugeTagV2.Unmarshal(m, b)
 }
 func (m *GaugeTagV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_GaugeTagV2.Marshal(b, m, deterministic)
 }
-func (dst *GaugeTagV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_GaugeTagV2.Merge(dst, src)
+func (m *GaugeTagV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GaugeTagV2.Merge(m, src)
 }
 func (m *GaugeTagV2) XXX_Size() int {
 	return xxx_messageInfo_GaugeTagV2.Size(m)
@@ -219,16 +233,17 @@ func (m *SetTagV2) Reset()         { *m = SetTagV2{} }
 func (m *SetTagV2) String() string { return proto.CompactTextString(m) }
 func (*SetTagV2) ProtoMessage()    {}
 func (*SetTagV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{3}
+	return fileDescriptor_fb943a1cf70635ae, []int{3}
 }
+
 func (m *SetTagV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_SetTagV2.Unmarshal(m, b)
 }
 func (m *SetTagV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_SetTagV2.Marshal(b, m, deterministic)
 }
-func (dst *SetTagV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_SetTagV2.Merge(dst, src)
+func (m *SetTagV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SetTagV2.Merge(m, src)
 }
 func (m *SetTagV2) XXX_Size() int {
 	return xxx_messageInfo_SetTagV2.Size(m)
@@ -257,16 +272,17 @@ func (m *TimerTagV2) Reset()         { *m = TimerTagV2{} }
 func (m *TimerTagV2) String() string { return proto.CompactTextString(m) }
 func (*TimerTagV2) ProtoMessage()    {}
 func (*TimerTagV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{4}
+	return fileDescriptor_fb943a1cf70635ae, []int{4}
 }
+
 func (m *TimerTagV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_TimerTagV2.Unmarshal(m, b)
 }
 func (m *TimerTagV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_TimerTagV2.Marshal(b, m, deterministic)
 }
-func (dst *TimerTagV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_TimerTagV2.Merge(dst, src)
+func (m *TimerTagV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TimerTagV2.Merge(m, src)
 }
 func (m *TimerTagV2) XXX_Size() int {
 	return xxx_messageInfo_TimerTagV2.Size(m)
@@ -297,16 +313,17 @@ func (m *RawCounterV2) Reset()         { *m = RawCounterV2{} }
 func (m *RawCounterV2) String() string { return proto.CompactTextString(m) }
 func (*RawCounterV2) ProtoMessage()    {}
 func (*RawCounterV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{5}
+	return fileDescriptor_fb943a1cf70635ae, []int{5}
 }
+
 func (m *RawCounterV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawCounterV2.Unmarshal(m, b)
 }
 func (m *RawCounterV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_RawCounterV2.Marshal(b, m, deterministic)
 }
-func (dst *RawCounterV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_RawCounterV2.Merge(dst, src)
+func (m *RawCounterV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RawCounterV2.Merge(m, src)
 }
 func (m *RawCounterV2) XXX_Size() int {
 	return xxx_messageInfo_RawCounterV2.Size(m)
@@ -351,16 +368,17 @@ func (m *RawGaugeV2) Reset()         { *m = RawGaugeV2{} }
 func (m *RawGaugeV2) String() string { return proto.CompactTextString(m) }
 func (*RawGaugeV2) ProtoMessage()    {}
 func (*RawGaugeV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{6}
+	return fileDescriptor_fb943a1cf70635ae, []int{6}
 }
+
 func (m *RawGaugeV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawGaugeV2.Unmarshal(m, b)
 }
 func (m *RawGaugeV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_RawGaugeV2.Marshal(b, m, deterministic)
 }
-func (dst *RawGaugeV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_RawGaugeV2.Merge(dst, src)
+func (m *RawGaugeV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RawGaugeV2.Merge(m, src)
 }
 func (m *RawGaugeV2) XXX_Size() int {
 	return xxx_messageInfo_RawGaugeV2.Size(m)
@@ -405,16 +423,17 @@ func (m *RawSetV2) Reset()         { *m = RawSetV2{} }
 func (m *RawSetV2) String() string { return proto.CompactTextString(m) }
 func (*RawSetV2) ProtoMessage()    {}
 func (*RawSetV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{7}
+	return fileDescriptor_fb943a1cf70635ae, []int{7}
 }
+
 func (m *RawSetV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawSetV2.Unmarshal(m, b)
 }
 func (m *RawSetV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_RawSetV2.Marshal(b, m, deterministic)
 }
-func (dst *RawSetV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_RawSetV2.Merge(dst, src)
+func (m *RawSetV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RawSetV2.Merge(m, src)
 }
 func (m *RawSetV2) XXX_Size() int {
 	return xxx_messageInfo_RawSetV2.Size(m)
@@ -460,16 +479,17 @@ func (m *RawTimerV2) Reset()         { *m = RawTimerV2{} }
 func (m *RawTimerV2) String() string { return proto.CompactTextString(m) }
 func (*RawTimerV2) ProtoMessage()    {}
 func (*RawTimerV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{8}
+	return fileDescriptor_fb943a1cf70635ae, []int{8}
 }
+
 func (m *RawTimerV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawTimerV2.Unmarshal(m, b)
 }
 func (m *RawTimerV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_RawTimerV2.Marshal(b, m, deterministic)
 }
-func (dst *RawTimerV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_RawTimerV2.Merge(dst, src)
+func (m *RawTimerV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RawTimerV2.Merge(m, src)
 }
 func (m *RawTimerV2) XXX_Size() int {
 	return xxx_messageInfo_RawTimerV2.Size(m)
@@ -528,16 +548,17 @@ func (m *EventV2) Reset()         { *m = EventV2{} }
 func (m *EventV2) String() string { return proto.CompactTextString(m) }
 func (*EventV2) ProtoMessage()    {}
 func (*EventV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{9}
+	return fileDescriptor_fb943a1cf70635ae, []int{9}
 }
+
 func (m *EventV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_EventV2.Unmarshal(m, b)
 }
 func (m *EventV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_EventV2.Marshal(b, m, deterministic)
 }
-func (dst *EventV2) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_EventV2.Merge(dst, src)
+func (m *EventV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EventV2.Merge(m, src)
 }
 func (m *EventV2) XXX_Size() int {
 	return xxx_messageInfo_EventV2.Size(m)
@@ -619,6 +640,8 @@ func (m *EventV2) GetType() EventV2_AlertType {
 }
 
 func init() {
+	proto.RegisterEnum("pb.EventV2_EventPriority", EventV2_EventPriority_name, EventV2_EventPriority_value)
+	proto.RegisterEnum("pb.EventV2_AlertType", EventV2_AlertType_name, EventV2_AlertType_value)
 	proto.RegisterType((*RawMessageV2)(nil), "pb.RawMessageV2")
 	proto.RegisterMapType((map[string]*CounterTagV2)(nil), "pb.RawMessageV2.CountersEntry")
 	proto.RegisterMapType((map[string]*GaugeTagV2)(nil), "pb.RawMessageV2.GaugesEntry")
@@ -637,55 +660,239 @@ func init() {
 	proto.RegisterType((*RawSetV2)(nil), "pb.RawSetV2")
 	proto.RegisterType((*RawTimerV2)(nil), "pb.RawTimerV2")
 	proto.RegisterType((*EventV2)(nil), "pb.EventV2")
-	proto.RegisterEnum("pb.EventV2_EventPriority", EventV2_EventPriority_name, EventV2_EventPriority_value)
-	proto.RegisterEnum("pb.EventV2_AlertType", EventV2_AlertType_name, EventV2_AlertType_value)
 }
 
-func init() { proto.RegisterFile("pb/gostatsd.proto", fileDescriptor_gostatsd_02649f73f2826ea1) }
-
-var fileDescriptor_gostatsd_02649f73f2826ea1 = []byte{
-	// 684 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0x5d, 0x6f, 0xd3, 0x30,
-	0x14, 0x9d, 0x9b, 0xb4, 0x4d, 0x6e, 0xbb, 0x29, 0x58, 0x03, 0x85, 0x6a, 0x42, 0x55, 0x34, 0x4d,
-	0xe5, 0xa5, 0xa0, 0x02, 0x12, 0xda, 0xdb, 0x04, 0xd5, 0x56, 0x8d, 0x4d, 0x93, 0x5b, 0x8d, 0x67,
-	0x77, 0x33, 0x51, 0x45, 0x9b, 0x44, 0x8e, 0xbb, 0xd2, 0x1f, 0xc0, 0x13, 0x4f, 0xf0, 0x67, 0xf8,
-	0x7b, 0xc8, 0x76, 0x9a, 0xc6, 0x6d, 0xd0, 0x36, 0xc1, 0x53, 0x7d, 0x3f, 0xce, 0xb9, 0xc7, 0xe7,
-	0x46, 0x2e, 0x3c, 0x49, 0xc6, 0xaf, 0xc2, 0x38, 0x15, 0x54, 0xa4, 0xb7, 0xdd, 0x84, 0xc7, 0x22,
-	0xc6, 0x95, 0x64, 0x1c, 0xfc, 0xb2, 0xa1, 0x49, 0xe8, 0xe2, 0x82, 0xa5, 0x29, 0x0d, 0xd9, 0x75,
-	0x0f, 0x1f, 0x83, 0xf3, 0x21, 0x9e, 0x47, 0x82, 0xf1, 0xd4, 0x47, 0x6d, 0xab, 0xd3, 0xe8, 0xbd,
-	0xe8, 0x26, 0xe3, 0x6e, 0xb1, 0xa7, 0xbb, 0x6a, 0xe8, 0x47, 0x82, 0x2f, 0x49, 0xde, 0x8f, 0xdf,
-	0x42, 0xed, 0x94, 0xce, 0x43, 0x96, 0xfa, 0x15, 0x85, 0x3c, 0xd8, 0x42, 0xea, 0xb2, 0xc6, 0x65,
-	0xbd, 0xb8, 0x0b, 0xf6, 0x90, 0x89, 0xd4, 0xb7, 0x14, 0xa6, 0xb5, 0x85, 0x91, 0x45, 0x8d, 0x50,
-	0x7d, 0x72, 0xca, 0x68, 0x32, 0x93, 0xfa, 0xec, 0xbf, 0x4c, 0xd1, 0xe5, 0x6c, 0x8a, 0x0e, 0x5a,
-	0x17, 0xb0, 0x6b, 0xc8, 0xc6, 0x1e, 0x58, 0x5f, 0xd9, 0xd2, 0x47, 0x6d, 0xd4, 0x71, 0x89, 0x3c,
-	0xe2, 0x23, 0xa8, 0xde, 0xd1, 0xe9, 0x9c, 0xf9, 0x95, 0x36, 0xea, 0x34, 0x7a, 0x9e, 0xe4, 0xcd,
-	0x30, 0x23, 0x1a, 0x5e, 0xf7, 0x88, 0x2e, 0x1f, 0x57, 0xde, 0xa3, 0xd6, 0x00, 0x1a, 0x85, 0xbb,
-	0x94, 0x90, 0x1d, 0x9a, 0x64, 0x7b, 0x92, 0x4c, 0x21, 0xb6, 0xa8, 0xfa, 0xe0, 0xe6, 0x57, 0x2c,
-	0x21, 0x0a, 0x4c, 0xa2, 0xa6, 0x24, 0x1a, 0x32, 0x51, 0xa6, 0xa8, 0x70, 0xef, 0x07, 0x2a, 0x52,
-	0x88, 0x4d, 0xaa, 0xe0, 0x27, 0x82, 0x66, 0xf1, 0xe2, 0xca, 0x72, 0x1a, 0x5e, 0xd0, 0x24, 0xfb,
-	0x24, 0x0e, 0x36, 0xad, 0xe9, 0xea, 0xf2, 0xca, 0x72, 0x15, 0xb4, 0xce, 0xa1, 0x51, 0x48, 0x3f,
-	0xd0, 0x70, 0x42, 0x17, 0x19, 0xb1, 0xa9, 0xe9, 0x07, 0x02, 0x58, 0xfb, 0x87, 0x7b, 0x1b, 0x8a,
-	0x5a, 0xa6, 0xbf, 0xa5, 0x7a, 0x06, 0xf7, 0xe9, 0x29, 0x73, 0x88, 0xd0, 0x85, 0xa2, 0x35, 0xd5,
-	0x7c, 0x47, 0xe0, 0xac, 0x96, 0x80, 0x5f, 0x6f, 0x68, 0xf1, 0x8b, 0x2b, 0x2a, 0x55, 0x72, 0x7a,
-	0x9f, 0x92, 0xb2, 0xa5, 0x13, 0xba, 0x18, 0x32, 0xb1, 0xed, 0xca, 0x7a, 0x87, 0xe5, 0xae, 0xac,
-	0xeb, 0xff, 0xd5, 0x15, 0x45, 0x6b, 0xaa, 0x19, 0xa9, 0xb7, 0x24, 0x5f, 0x1f, 0xc6, 0x60, 0x8f,
-	0x68, 0xa8, 0xdf, 0x11, 0x97, 0xa8, 0x33, 0x6e, 0x81, 0x73, 0x16, 0xa7, 0x22, 0xa2, 0x33, 0x4d,
-	0xe8, 0x92, 0x3c, 0xc6, 0xfb, 0x50, 0xbd, 0x56, 0x93, 0xac, 0x36, 0xea, 0x58, 0x44, 0x07, 0x01,
-	0x01, 0x58, 0x2f, 0xe1, 0xdf, 0x38, 0xd1, 0x9a, 0xd3, 0x59, 0xd9, 0xf9, 0x68, 0xc6, 0x67, 0x50,
-	0x53, 0x24, 0xfa, 0xc5, 0x72, 0x49, 0x16, 0x05, 0x77, 0x4a, 0x67, 0x66, 0xcb, 0xa3, 0x59, 0xdb,
-	0xd0, 0x18, 0xd2, 0x59, 0x32, 0x65, 0xca, 0xbe, 0x4c, 0x6d, 0x31, 0x55, 0x98, 0x2b, 0xdf, 0x3d,
-	0x94, 0xcf, 0xfd, 0x6d, 0x41, 0xbd, 0x7f, 0xc7, 0x22, 0x79, 0x97, 0x7d, 0xa8, 0x8e, 0x26, 0x62,
-	0xca, 0xb2, 0xfd, 0xe9, 0x40, 0x69, 0x61, 0xdf, 0x44, 0x36, 0x53, 0x9d, 0x71, 0x00, 0xcd, 0x8f,
-	0x54, 0xb0, 0x33, 0x9a, 0x24, 0x2c, 0x62, 0xb7, 0x99, 0xe5, 0x46, 0xce, 0xd0, 0x6b, 0x6f, 0xe8,
-	0x3d, 0x82, 0xbd, 0x93, 0x30, 0xe4, 0x2c, 0xa4, 0x62, 0x12, 0x47, 0xe7, 0x6c, 0xe9, 0x57, 0x55,
-	0xc7, 0x46, 0x56, 0xf6, 0x0d, 0xe3, 0x39, 0xbf, 0x61, 0xa3, 0x65, 0xc2, 0x2e, 0x25, 0x53, 0x4d,
-	0xf7, 0x99, 0xd9, 0xdc, 0xaf, 0xba, 0xe9, 0x97, 0xee, 0x1a, 0x5c, 0xf9, 0x8e, 0x9e, 0xbf, 0x8a,
-	0xf1, 0x3b, 0x70, 0xae, 0xf8, 0x24, 0xe6, 0x13, 0xb1, 0xf4, 0xdd, 0x36, 0xea, 0xec, 0xf5, 0x9e,
-	0xcb, 0x0f, 0x33, 0x33, 0x42, 0xff, 0xae, 0x1a, 0x48, 0xde, 0x8a, 0x5f, 0x82, 0x2d, 0x47, 0xfa,
-	0xa0, 0x20, 0x4f, 0x8b, 0x90, 0x93, 0x29, 0xe3, 0x42, 0x16, 0x89, 0x6a, 0x09, 0x0e, 0x61, 0xd7,
-	0x60, 0xc1, 0x00, 0xb5, 0xcb, 0x98, 0xcf, 0xe8, 0xd4, 0xdb, 0xc1, 0x75, 0xb0, 0x3e, 0xc5, 0x0b,
-	0x0f, 0x05, 0xc7, 0xe0, 0xe6, 0x40, 0xec, 0x80, 0x3d, 0x88, 0xbe, 0xc4, 0xde, 0x0e, 0x6e, 0x40,
-	0xfd, 0x33, 0xe5, 0xd1, 0x24, 0x0a, 0x3d, 0x84, 0x5d, 0xa8, 0xf6, 0x39, 0x8f, 0xb9, 0x57, 0x91,
-	0xf9, 0xe1, 0xfc, 0xe6, 0x86, 0xa5, 0xa9, 0x67, 0x8d, 0x6b, 0xea, 0x7f, 0xf8, 0xcd, 0x9f, 0x00,
-	0x00, 0x00, 0xff, 0xff, 0x08, 0x18, 0x8e, 0x08, 0x9c, 0x07, 0x00, 0x00,
+func init() {
+	proto.RegisterFile("pb/gostatsd.proto", fileDescriptor_fb943a1cf70635ae)
+}
+
+var fileDescriptor_fb943a1cf70635ae = []byte{
+	// 751 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0x5d, 0x6f, 0xda, 0x48,
+	0x14, 0xcd, 0x60, 0xbe, 0x7c, 0x4d, 0x22, 0xef, 0x28, 0x1b, 0x79, 0xbd, 0xab, 0x15, 0xb2, 0xa2,
+	0x88, 0x7d, 0x71, 0xb2, 0xb4, 0x55, 0xab, 0xbc, 0x45, 0x2d, 0x4d, 0x50, 0x4a, 0x14, 0x19, 0x94,
+	0x3e, 0x0f, 0x64, 0x62, 0xa1, 0x82, 0xc7, 0x1a, 0x0f, 0xa1, 0xfc, 0x80, 0x3e, 0xf5, 0xa9, 0xfd,
+	0x33, 0xfd, 0x7b, 0xd5, 0xcc, 0x18, 0xb0, 0xc1, 0x6d, 0x12, 0xb5, 0x4f, 0xf8, 0xde, 0x7b, 0xee,
+	0xb9, 0x67, 0xce, 0x45, 0x33, 0xf0, 0x47, 0x3c, 0x3c, 0x0e, 0x59, 0x22, 0x88, 0x48, 0x6e, 0xfd,
+	0x98, 0x33, 0xc1, 0x70, 0x29, 0x1e, 0xba, 0x7f, 0x87, 0x8c, 0x85, 0x13, 0x7a, 0xac, 0x32, 0xc3,
+	0xd9, 0xdd, 0x31, 0x9d, 0xc6, 0x62, 0xa1, 0x01, 0xde, 0xd7, 0x32, 0x34, 0x02, 0x32, 0xef, 0xd1,
+	0x24, 0x21, 0x21, 0xbd, 0x69, 0xe3, 0x53, 0xa8, 0xbf, 0x66, 0xb3, 0x48, 0x50, 0x9e, 0x38, 0xa8,
+	0x69, 0xb4, 0xac, 0xf6, 0xbf, 0x7e, 0x3c, 0xf4, 0xb3, 0x18, 0x7f, 0x09, 0xe8, 0x44, 0x82, 0x2f,
+	0x82, 0x15, 0x1e, 0x3f, 0x87, 0xea, 0x39, 0x99, 0x85, 0x34, 0x71, 0x4a, 0xaa, 0xf3, 0x9f, 0xad,
+	0x4e, 0x5d, 0xd6, 0x7d, 0x29, 0x16, 0xfb, 0x50, 0xee, 0x53, 0x91, 0x38, 0x86, 0xea, 0x71, 0xb7,
+	0x7a, 0x64, 0x51, 0x77, 0x28, 0x9c, 0x9c, 0x32, 0x18, 0x4f, 0xa5, 0xbe, 0xf2, 0x0f, 0xa6, 0xe8,
+	0x72, 0x3a, 0x45, 0x07, 0x6e, 0x0f, 0x76, 0x73, 0xb2, 0xb1, 0x0d, 0xc6, 0x07, 0xba, 0x70, 0x50,
+	0x13, 0xb5, 0xcc, 0x40, 0x7e, 0xe2, 0x23, 0xa8, 0xdc, 0x93, 0xc9, 0x8c, 0x3a, 0xa5, 0x26, 0x6a,
+	0x59, 0x6d, 0x5b, 0xf2, 0xa6, 0x3d, 0x03, 0x12, 0xde, 0xb4, 0x03, 0x5d, 0x3e, 0x2d, 0xbd, 0x42,
+	0x6e, 0x17, 0xac, 0xcc, 0x59, 0x0a, 0xc8, 0x0e, 0xf3, 0x64, 0x7b, 0x92, 0x4c, 0x75, 0x6c, 0x51,
+	0x75, 0xc0, 0x5c, 0x1d, 0xb1, 0x80, 0xc8, 0xcb, 0x13, 0x35, 0x24, 0x51, 0x9f, 0x8a, 0x22, 0x45,
+	0x99, 0x73, 0x3f, 0x52, 0x91, 0xea, 0xd8, 0xa4, 0xf2, 0xbe, 0x20, 0x68, 0x64, 0x0f, 0xae, 0x2c,
+	0x27, 0x61, 0x8f, 0xc4, 0x0e, 0x5a, 0x5b, 0x9e, 0x45, 0xf8, 0xba, 0xbc, 0xb4, 0x5c, 0x05, 0xee,
+	0x25, 0x58, 0x99, 0xf4, 0x23, 0x0d, 0x0f, 0xc8, 0x3c, 0x25, 0xce, 0x6b, 0xfa, 0x8c, 0x00, 0xd6,
+	0xfe, 0xe1, 0xf6, 0x86, 0x22, 0x37, 0xef, 0x6f, 0xa1, 0x9e, 0xee, 0x43, 0x7a, 0x8a, 0x1c, 0x0a,
+	0xc8, 0x5c, 0xd1, 0xe6, 0xd5, 0x7c, 0x42, 0x50, 0x5f, 0x2e, 0x01, 0x9f, 0x6c, 0x68, 0x71, 0xb2,
+	0x2b, 0x2a, 0x54, 0x72, 0xfe, 0x90, 0x92, 0xa2, 0xa5, 0x07, 0x64, 0xde, 0xa7, 0x62, 0xdb, 0x95,
+	0xf5, 0x0e, 0x8b, 0x5d, 0x59, 0xd7, 0x7f, 0xab, 0x2b, 0x8a, 0x36, 0xaf, 0x66, 0x00, 0x8d, 0xec,
+	0xfa, 0x30, 0x86, 0xf2, 0x80, 0x84, 0xfa, 0x1e, 0x31, 0x03, 0xf5, 0x8d, 0x5d, 0xa8, 0x5f, 0xb0,
+	0x44, 0x44, 0x64, 0xaa, 0x09, 0xcd, 0x60, 0x15, 0xe3, 0x7d, 0xa8, 0xdc, 0xa8, 0x49, 0x46, 0x13,
+	0xb5, 0x8c, 0x40, 0x07, 0x5e, 0x00, 0xb0, 0x5e, 0xc2, 0xaf, 0x71, 0xa2, 0x35, 0x67, 0x7d, 0x69,
+	0xe7, 0x93, 0x19, 0x0f, 0xa0, 0xaa, 0x48, 0xf4, 0x8d, 0x65, 0x06, 0x69, 0xe4, 0xdd, 0x03, 0xac,
+	0x6d, 0x79, 0x32, 0x6b, 0x13, 0xac, 0x3e, 0x99, 0xc6, 0x13, 0xaa, 0xec, 0x4b, 0xd5, 0x66, 0x53,
+	0x99, 0xb9, 0xf2, 0xde, 0x43, 0xab, 0xb9, 0xdf, 0x0c, 0xa8, 0x75, 0xee, 0x69, 0x24, 0xcf, 0xb2,
+	0x0f, 0x95, 0xc1, 0x58, 0x4c, 0x68, 0xba, 0x3f, 0x1d, 0x28, 0x2d, 0xf4, 0xa3, 0x48, 0x67, 0xaa,
+	0x6f, 0xec, 0x41, 0xe3, 0x0d, 0x11, 0xf4, 0x82, 0xc4, 0x31, 0x8d, 0xe8, 0x6d, 0x6a, 0x79, 0x2e,
+	0x97, 0xd3, 0x5b, 0xde, 0xd0, 0x7b, 0x04, 0x7b, 0x67, 0x61, 0xc8, 0x69, 0x48, 0xc4, 0x98, 0x45,
+	0x97, 0x74, 0xe1, 0x54, 0x14, 0x62, 0x23, 0x2b, 0x71, 0x7d, 0x36, 0xe3, 0x23, 0x3a, 0x58, 0xc4,
+	0xf4, 0x4a, 0x32, 0x55, 0x35, 0x2e, 0x9f, 0x5d, 0xf9, 0x55, 0xcb, 0xfb, 0xa5, 0x51, 0xdd, 0x6b,
+	0xa7, 0xae, 0xe7, 0x2f, 0x63, 0xfc, 0x02, 0xea, 0xd7, 0x7c, 0xcc, 0xf8, 0x58, 0x2c, 0x1c, 0xb3,
+	0x89, 0x5a, 0x7b, 0xed, 0xbf, 0xe4, 0x1f, 0x33, 0x35, 0x42, 0xff, 0x2e, 0x01, 0xc1, 0x0a, 0x8a,
+	0xff, 0x83, 0xb2, 0x1c, 0xe9, 0x80, 0x6a, 0xf9, 0x33, 0xdb, 0x72, 0x36, 0xa1, 0x5c, 0xc8, 0x62,
+	0xa0, 0x20, 0xde, 0x21, 0xec, 0xe6, 0x58, 0x30, 0x40, 0xf5, 0x8a, 0xf1, 0x29, 0x99, 0xd8, 0x3b,
+	0xb8, 0x06, 0xc6, 0x3b, 0x36, 0xb7, 0x91, 0x77, 0x0a, 0xe6, 0xaa, 0x11, 0xd7, 0xa1, 0xdc, 0x8d,
+	0xee, 0x98, 0xbd, 0x83, 0x2d, 0xa8, 0xbd, 0x27, 0x3c, 0x1a, 0x47, 0xa1, 0x8d, 0xb0, 0x09, 0x95,
+	0x0e, 0xe7, 0x8c, 0xdb, 0x25, 0x99, 0xef, 0xcf, 0x46, 0x23, 0x9a, 0x24, 0xb6, 0xd1, 0x5e, 0x80,
+	0xf5, 0x96, 0xf1, 0x39, 0xe1, 0xb7, 0xea, 0x2f, 0xf3, 0x12, 0x6a, 0x3d, 0x2a, 0xf8, 0x78, 0x94,
+	0x60, 0x7b, 0xf3, 0x4d, 0x73, 0x0f, 0x7c, 0xfd, 0x8c, 0xfb, 0xcb, 0x67, 0xdc, 0xef, 0xc8, 0x67,
+	0xbc, 0x85, 0x4e, 0x10, 0xfe, 0x1f, 0xaa, 0x4a, 0x69, 0x82, 0xad, 0xcc, 0x81, 0x7e, 0xd6, 0x32,
+	0xac, 0xaa, 0xdc, 0xb3, 0xef, 0x03, 0x00, 0x1c, 0x18, 0xb8, 0x8d, 0x34, 0x08, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// ForwarderV2Client is the client API for ForwarderV2 service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ForwarderV2Client interface {
+	Metrics(ctx context.Context, opts ...grpc.CallOption) (ForwarderV2_MetricsClient, error)
+	Events(ctx context.Context, opts ...grpc.CallOption) (ForwarderV2_EventsClient, error)
+}
+
+type forwarderV2Client struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewForwarderV2Client(cc grpc.ClientConnInterface) ForwarderV2Client {
+	return &forwarderV2Client{cc}
+}
+
+func (c *forwarderV2Client) Metrics(ctx context.Context, opts ...grpc.CallOption) (ForwarderV2_MetricsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ForwarderV2_serviceDesc.Streams[0], "/pb.ForwarderV2/Metrics", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &forwarderV2MetricsClient{stream}
+	return x, nil
+}
+
+type ForwarderV2_MetricsClient interface {
+	Send(*RawMessageV2) error
+	Recv() (*empty.Empty, error)
+	grpc.ClientStream
+}
+
+type forwarderV2MetricsClient struct {
+	grpc.ClientStream
+}
+
+func (x *forwarderV2MetricsClient) Send(m *RawMessageV2) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *forwarderV2MetricsClient) Recv() (*empty.Empty, error) {
+	m := new(empty.Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *forwarderV2Client) Events(ctx context.Context, opts ...grpc.CallOption) (ForwarderV2_EventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ForwarderV2_serviceDesc.Streams[1], "/pb.ForwarderV2/Events", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &forwarderV2EventsClient{stream}
+	return x, nil
+}
+
+type ForwarderV2_EventsClient interface {
+	Send(*EventV2) error
+	Recv() (*empty.Empty, error)
+	grpc.ClientStream
+}
+
+type forwarderV2EventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *forwarderV2EventsClient) Send(m *EventV2) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *forwarderV2EventsClient) Recv() (*empty.Empty, error) {
+	m := new(empty.Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ForwarderV2Server is the server API for ForwarderV2 service.
+type ForwarderV2Server interface {
+	Metrics(ForwarderV2_MetricsServer) error
+	Events(ForwarderV2_EventsServer) error
+}
+
+// UnimplementedForwarderV2Server can be embedded to have forward compatible implementations.
+type UnimplementedForwarderV2Server struct {
+}
+
+func (*UnimplementedForwarderV2Server) Metrics(srv ForwarderV2_MetricsServer) error {
+	return status.Errorf(codes.Unimplemented, "method Metrics not implemented")
+}
+func (*UnimplementedForwarderV2Server) Events(srv ForwarderV2_EventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method Events not implemented")
+}
+
+func RegisterForwarderV2Server(s *grpc.Server, srv ForwarderV2Server) {
+	s.RegisterService(&_ForwarderV2_serviceDesc, srv)
+}
+
+func _ForwarderV2_Metrics_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ForwarderV2Server).Metrics(&forwarderV2MetricsServer{stream})
+}
+
+type ForwarderV2_MetricsServer interface {
+	Send(*empty.Empty) error
+	Recv() (*RawMessageV2, error)
+	grpc.ServerStream
+}
+
+type forwarderV2MetricsServer struct {
+	grpc.ServerStream
+}
+
+func (x *forwarderV2MetricsServer) Send(m *empty.Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *forwarderV2MetricsServer) Recv() (*RawMessageV2, error) {
+	m := new(RawMessageV2)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ForwarderV2_Events_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ForwarderV2Server).Events(&forwarderV2EventsServer{stream})
+}
+
+type ForwarderV2_EventsServer interface {
+	Send(*empty.Empty) error
+	Recv() (*EventV2, error)
+	grpc.ServerStream
+}
+
+type forwarderV2EventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *forwarderV2EventsServer) Send(m *empty.Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *forwarderV2EventsServer) Recv() (*EventV2, error) {
+	m := new(EventV2)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _ForwarderV2_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "pb.ForwarderV2",
+	HandlerType: (*ForwarderV2Server)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Metrics",
+			Handler:       _ForwarderV2_Metrics_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Events",
+			Handler:       _ForwarderV2_Events_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pb/gostatsd.proto",
 }
@@ -0,0 +1,77 @@
+package pb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The version of the forwarding protocol is negotiated, so the payloads can change while forwarders and servers of
+// different versions are running.  Servers list the versions they support in the ProtocolVersionsHeader of every
+// response, and forwarders send the newest version supported by both in the ProtocolVersionHeader.  A forwarder
+// sends ProtocolVersion2 until it has seen the versions supported by a server, as it is the only version a server
+// which doesn't negotiate supports.  A server rejects a version it doesn't support with 415 Unsupported Media Type.
+const (
+	// ProtocolVersionHeader is the http header, or grpc metadata, with the version of the payload.  Payloads without
+	// it are ProtocolVersion2.
+	ProtocolVersionHeader = "Gostatsd-Protocol-Version"
+	// ProtocolVersionsHeader is the http header listing the versions supported by a server.
+	ProtocolVersionsHeader = "Gostatsd-Protocol-Versions"
+
+	// ProtocolVersion2 is RawMessageV2 and EventV2 on the /v2/raw and /v2/event endpoints.
+	ProtocolVersion2 = 2
+	// ProtocolVersion3 is ProtocolVersion2, with a batch of events on the /v2/event endpoint, see MarshalEventBatch.
+	// The messages of grpc streams are unchanged.
+	ProtocolVersion3 = 3
+)
+
+// ProtocolVersions are the supported versions of the forwarding protocol, newest first.
+var ProtocolVersions = []int{ProtocolVersion3, ProtocolVersion2}
+
+// SupportsProtocolVersion returns true if the version is in ProtocolVersions.
+func SupportsProtocolVersion(version int) bool {
+	for _, v := range ProtocolVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProtocolVersion parses the value of a ProtocolVersionHeader.  An empty value is ProtocolVersion2.
+func ParseProtocolVersion(value string) (int, error) {
+	if value == "" {
+		return ProtocolVersion2, nil
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol version %q", value)
+	}
+	return version, nil
+}
+
+// FormatProtocolVersions formats versions as the value of a ProtocolVersionsHeader.
+func FormatProtocolVersions(versions []int) string {
+	s := make([]string, 0, len(versions))
+	for _, v := range versions {
+		s = append(s, strconv.Itoa(v))
+	}
+	return strings.Join(s, ", ")
+}
+
+// NegotiateProtocolVersion returns the newest version in ProtocolVersions which is listed in the value of a
+// ProtocolVersionsHeader, and is no newer than maxVersion.  It returns false if there is none.
+func NegotiateProtocolVersion(value string, maxVersion int) (int, bool) {
+	offered := map[int]bool{}
+	for _, s := range strings.Split(value, ",") {
+		if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			offered[v] = true
+		}
+	}
+	for _, v := range ProtocolVersions {
+		if v <= maxVersion && offered[v] {
+			return v, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,39 @@
+package pb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProtocolVersion(t *testing.T) {
+	t.Parallel()
+	version, err := ParseProtocolVersion("")
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolVersion2, version)
+
+	version, err = ParseProtocolVersion(" 3 ")
+	require.NoError(t, err)
+	assert.Equal(t, 3, version)
+
+	_, err = ParseProtocolVersion("two")
+	assert.Error(t, err)
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	t.Parallel()
+	version, ok := NegotiateProtocolVersion(FormatProtocolVersions(ProtocolVersions), ProtocolVersions[0])
+	require.True(t, ok)
+	assert.Equal(t, ProtocolVersions[0], version)
+
+	version, ok = NegotiateProtocolVersion("1, 2, 99", ProtocolVersion2)
+	require.True(t, ok)
+	assert.Equal(t, ProtocolVersion2, version)
+
+	_, ok = NegotiateProtocolVersion("1, 99", ProtocolVersions[0])
+	assert.False(t, ok)
+
+	_, ok = NegotiateProtocolVersion("2", 1)
+	assert.False(t, ok)
+}
@@ -0,0 +1,213 @@
+package backends
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+const (
+	// paramSendEvents is the name of the backend setting which enables sending events to it.
+	paramSendEvents = "send-events"
+	// paramSendMetrics is the name of the backend setting which enables sending metrics to it.
+	paramSendMetrics = "send-metrics"
+	// paramMetricTypes is the name of the backend setting with the types of metrics sent to it.
+	paramMetricTypes = "metric-types"
+	// paramSampleMetrics is the name of the backend setting with the percentage of the series of matching metrics sent
+	// to it.
+	paramSampleMetrics = "sample-metrics"
+)
+
+// sampleBuckets is the resolution of the percentage of series sampled, which is to 0.01%.
+const sampleBuckets = 10000
+
+// capabilities are what is sent to a backend, configured in its section, so a backend can be given a subset of what
+// it supports.
+type capabilities struct {
+	events   bool
+	metrics  bool
+	counters bool
+	gauges   bool
+	timers   bool
+	sets     bool
+
+	percentiles map[string]struct{} // The names of the timer percentiles sent, or nil to send all of them
+	samples     []sampleRule        // The first which matches the name of a metric samples its series
+}
+
+// sampleRule sends a percentage of the series of the metrics whose name matches.
+type sampleRule struct {
+	match     gostatsd.StringMatch
+	threshold uint64 // The series whose hash modulo sampleBuckets is below the threshold are sent
+}
+
+// capabilitiesFromViper returns the capabilities configured in the section of the named backend.  Everything is sent
+// by default.
+func capabilitiesFromViper(name string, v *viper.Viper) (capabilities, error) {
+	sub := util.GetSubViper(v, name)
+	sub.SetDefault(paramSendEvents, true)
+	sub.SetDefault(paramSendMetrics, true)
+	sub.SetDefault(paramMetricTypes, []string{"counters", "gauges", "timers", "sets"})
+	c := capabilities{
+		events:  sub.GetBool(paramSendEvents),
+		metrics: sub.GetBool(paramSendMetrics),
+	}
+	for _, metricType := range sub.GetStringSlice(paramMetricTypes) {
+		switch metricType {
+		case "counters":
+			c.counters = true
+		case "gauges":
+			c.gauges = true
+		case "timers":
+			c.timers = true
+		case "sets":
+			c.sets = true
+		default:
+			return capabilities{}, fmt.Errorf("invalid %s.%s %q, must be counters, gauges, timers, or sets", name, paramMetricTypes, metricType)
+		}
+	}
+	percentiles, err := percentilesFromViper(name, v)
+	if err != nil {
+		return capabilities{}, err
+	}
+	c.percentiles = percentiles
+	for _, sample := range sub.GetStringSlice(paramSampleMetrics) {
+		rule, err := parseSampleRule(sample)
+		if err != nil {
+			return capabilities{}, fmt.Errorf("invalid %s.%s %q: %v", name, paramSampleMetrics, sample, err)
+		}
+		c.samples = append(c.samples, rule)
+	}
+	return c, nil
+}
+
+// parseSampleRule parses a sample rule of a match and a percentage, such as "debug.*=10".
+func parseSampleRule(s string) (sampleRule, error) {
+	idx := strings.LastIndexByte(s, '=')
+	if idx < 0 {
+		return sampleRule{}, fmt.Errorf("must be like 'debug.*=10'")
+	}
+	match, err := gostatsd.ParseStringMatch(s[:idx])
+	if err != nil {
+		return sampleRule{}, err
+	}
+	percentage, err := strconv.ParseFloat(s[idx+1:], 64)
+	if err != nil || percentage < 0 || percentage > 100 {
+		return sampleRule{}, fmt.Errorf("the percentage must be from 0 to 100")
+	}
+	return sampleRule{match: match, threshold: uint64(percentage / 100 * sampleBuckets)}, nil
+}
+
+// percentilesFromViper returns the names of the timer percentiles sent to the named backend, or nil if it is sent
+// everything the aggregators calculate.  The aggregators calculate the percentiles of every backend, so a backend is
+// only sent its own when some backend overrides them.
+func percentilesFromViper(name string, v *viper.Viper) (map[string]struct{}, error) {
+	percentThresholds, err := gostatsd.BackendPercentThresholds(v, name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", gostatsd.ParamPercentThreshold, err)
+	}
+	percentiles := gostatsd.PercentileNames(percentThresholds, gostatsd.BackendDisabledSubMetrics(v, name))
+
+	aggregatedThresholds, aggregatedDisabled, err := gostatsd.AggregatedTimerSettings(
+		v,
+		append(v.GetStringSlice(gostatsd.ParamBackends), v.GetStringSlice(gostatsd.ParamInternalBackends)...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", gostatsd.ParamPercentThreshold, err)
+	}
+	aggregated := gostatsd.PercentileNames(aggregatedThresholds, aggregatedDisabled)
+	if len(aggregated) == len(percentiles) {
+		// The percentiles of the backend are a subset of those calculated, so they are the same
+		return nil, nil
+	}
+	return percentiles, nil
+}
+
+// filterMetrics returns the metrics of the types which are sent, or nil if none are.  The MetricMap returned shares
+// its contents with mm, and must not be modified.
+func (c capabilities) filterMetrics(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	if !c.metrics || !(c.counters || c.gauges || c.timers || c.sets) {
+		return nil
+	}
+	if c.counters && c.gauges && c.timers && c.sets && (c.percentiles == nil || len(mm.Timers) == 0) {
+		return mm
+	}
+	filtered := gostatsd.NewMetricMap()
+	if c.counters {
+		filtered.Counters = mm.Counters
+	}
+	if c.gauges {
+		filtered.Gauges = mm.Gauges
+	}
+	if c.timers {
+		filtered.Timers = c.filterPercentiles(mm.Timers)
+	}
+	if c.sets {
+		filtered.Sets = mm.Sets
+	}
+	return filtered
+}
+
+// sampleMetrics returns the series of mm which are sent, and the number which are not.  The series of a metric which
+// matches a sample rule are chosen by a hash of their name and tags, so the same series are sent in every flush.  mm is
+// returned if no series are sampled, and nil if none are sent.
+func (c capabilities) sampleMetrics(mm *gostatsd.MetricMap) (*gostatsd.MetricMap, int) {
+	if len(c.samples) == 0 {
+		return mm, 0
+	}
+	thresholds := map[string]uint64{} // The threshold of each name, by the first rule which matches it
+	sampled := mm.SplitByBucket(2, func(metricName string, tagsKey string) int {
+		threshold, ok := thresholds[metricName]
+		if !ok {
+			threshold = sampleBuckets
+			for _, rule := range c.samples {
+				if rule.match.Match(metricName) {
+					threshold = rule.threshold
+					break
+				}
+			}
+			thresholds[metricName] = threshold
+		}
+		if threshold >= sampleBuckets || util.HashKey(metricName, tagsKey)%sampleBuckets < threshold {
+			return 0
+		}
+		return 1
+	})[0]
+	skipped := mm.Len() - sampled.Len()
+	if skipped == 0 {
+		return mm, 0
+	}
+	if sampled.IsEmpty() {
+		return nil, skipped
+	}
+	return sampled, skipped
+}
+
+// filterPercentiles returns the timers with only the percentiles which are sent.  The timers are copied if any
+// percentiles are removed, as they are shared with the other backends.
+func (c capabilities) filterPercentiles(timers gostatsd.Timers) gostatsd.Timers {
+	if c.percentiles == nil {
+		return timers
+	}
+	filtered := make(gostatsd.Timers, len(timers))
+	for name, tagged := range timers {
+		filteredTagged := make(map[string]gostatsd.Timer, len(tagged))
+		for tagsKey, timer := range tagged {
+			percentiles := make(gostatsd.Percentiles, 0, len(timer.Percentiles))
+			for _, pct := range timer.Percentiles {
+				if _, ok := c.percentiles[pct.Str]; ok {
+					percentiles = append(percentiles, pct)
+				}
+			}
+			timer.Percentiles = percentiles
+			filteredTagged[tagsKey] = timer
+		}
+		filtered[name] = filteredTagged
+	}
+	return filtered
+}
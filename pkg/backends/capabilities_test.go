@@ -0,0 +1,137 @@
+package backends
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestCapabilitiesFilterMetrics(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "g", Value: 1, Type: gostatsd.GAUGE})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Type: gostatsd.TIMER})
+
+	v := viper.New()
+	c, err := capabilitiesFromViper("fake", v)
+	require.NoError(t, err)
+	assert.True(t, c.events)
+	assert.Equal(t, mm, c.filterMetrics(mm))
+
+	v.Set("fake.metric-types", []string{"counters", "timers"})
+	v.Set("fake.send-events", false)
+	c, err = capabilitiesFromViper("fake", v)
+	require.NoError(t, err)
+	assert.False(t, c.events)
+	filtered := c.filterMetrics(mm)
+	require.NotNil(t, filtered)
+	assert.Equal(t, mm.Counters, filtered.Counters)
+	assert.Equal(t, mm.Timers, filtered.Timers)
+	assert.Empty(t, filtered.Gauges)
+	assert.Empty(t, filtered.Sets)
+
+	v.Set("fake.send-metrics", false)
+	c, err = capabilitiesFromViper("fake", v)
+	require.NoError(t, err)
+	assert.Nil(t, c.filterMetrics(mm))
+
+	v.Set("fake.metric-types", []string{"histograms"})
+	_, err = capabilitiesFromViper("fake", v)
+	assert.Error(t, err)
+}
+
+func TestCapabilitiesFilterPercentiles(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Type: gostatsd.TIMER})
+	mm.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+		timer.Percentiles.Set("count_90", 1)
+		timer.Percentiles.Set("upper_90", 1)
+		timer.Percentiles.Set("count_99", 1)
+		timer.Percentiles.Set("upper_99", 1)
+		mm.Timers[name][tagsKey] = timer
+	})
+
+	v := viper.New()
+	v.Set(gostatsd.ParamBackends, []string{"fake", "other"})
+	v.Set(gostatsd.ParamPercentThreshold, []string{"90"})
+	v.Set("disabled-sub-metrics.mean-pct", true)
+	v.Set("disabled-sub-metrics.sum-pct", true)
+	v.Set("disabled-sub-metrics.sum-squares-pct", true)
+	v.Set("fake.percent-threshold", []string{"99"})
+	v.Set("fake.disabled-sub-metrics.count-pct", true)
+	v.Set("fake.disabled-sub-metrics.mean-pct", true)
+	v.Set("fake.disabled-sub-metrics.sum-pct", true)
+	v.Set("fake.disabled-sub-metrics.sum-squares-pct", true)
+
+	c, err := capabilitiesFromViper("fake", v)
+	require.NoError(t, err)
+	filtered := c.filterMetrics(mm)
+	require.NotNil(t, filtered)
+	filtered.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+		assert.Equal(t, gostatsd.Percentiles{{Float: 1, Str: "upper_99"}}, timer.Percentiles)
+	})
+	mm.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+		assert.Len(t, timer.Percentiles, 4)
+	})
+
+	c, err = capabilitiesFromViper("other", v)
+	require.NoError(t, err)
+	filtered = c.filterMetrics(mm)
+	require.NotNil(t, filtered)
+	filtered.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+		assert.Equal(t, gostatsd.Percentiles{{Float: 1, Str: "count_90"}, {Float: 1, Str: "upper_90"}}, timer.Percentiles)
+	})
+}
+
+func TestCapabilitiesSampleMetrics(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 100; i++ {
+		tags := gostatsd.Tags{fmt.Sprintf("i:%d", i)}
+		mm.Receive(&gostatsd.Metric{Name: "debug.c", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.COUNTER})
+		mm.Receive(&gostatsd.Metric{Name: "debug.verbose", Value: 1, Tags: tags, Type: gostatsd.GAUGE})
+		mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.COUNTER})
+	}
+
+	v := viper.New()
+	c, err := capabilitiesFromViper("fake", v)
+	require.NoError(t, err)
+	sampled, skipped := c.sampleMetrics(mm)
+	assert.Equal(t, mm, sampled)
+	assert.Zero(t, skipped)
+
+	// The first rule which matches a name applies
+	v.Set("fake.sample-metrics", []string{"debug.verbose=0", "debug.*=25"})
+	c, err = capabilitiesFromViper("fake", v)
+	require.NoError(t, err)
+	sampled, skipped = c.sampleMetrics(mm)
+	require.NotNil(t, sampled)
+	assert.Equal(t, mm.Counters["c"], sampled.Counters["c"])
+	assert.Empty(t, sampled.Gauges)
+	assert.InDelta(t, 25, len(sampled.Counters["debug.c"]), 10)
+	assert.Equal(t, 200-len(sampled.Counters["debug.c"]), skipped)
+
+	// The same series are sent every time
+	again, _ := c.sampleMetrics(mm)
+	assert.Equal(t, sampled, again)
+
+	v.Set("fake.sample-metrics", []string{"*=0"})
+	c, err = capabilitiesFromViper("fake", v)
+	require.NoError(t, err)
+	sampled, skipped = c.sampleMetrics(mm)
+	assert.Nil(t, sampled)
+	assert.Equal(t, 300, skipped)
+
+	for _, invalid := range []string{"debug.*", "debug.*=101", "debug.*=ten", "regex:(=10"} {
+		v.Set("fake.sample-metrics", []string{invalid})
+		_, err = capabilitiesFromViper("fake", v)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,179 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+const (
+	// paramCircuitBreakerFailures is the name of the backend setting with the number of consecutive failed sends which
+	// open the circuit breaker.
+	paramCircuitBreakerFailures = "circuit-breaker-failures"
+	// paramCircuitBreakerOpenTime is the name of the backend setting with how long the circuit breaker stays open
+	// before a probe is sent.
+	paramCircuitBreakerOpenTime = "circuit-breaker-open-time"
+
+	defaultCircuitBreakerOpenTime = 30 * time.Second
+)
+
+// States of a circuitBreaker, which are also the value of its state gauge.
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker fails sends to a backend fast once it has failed too many times in a row, so a backend which is down
+// does not hold the buffers and requests of every flush while it retries.  After it has been open for the open time,
+// a single send is allowed through as a probe, which closes it if it succeeds, or opens it again if it fails.  It is
+// disabled if the number of failures is 0.
+type circuitBreaker struct {
+	logger logrus.FieldLogger
+
+	lock        sync.Mutex
+	failures    int
+	openTime    time.Duration
+	state       int
+	consecutive int       // The number of sends which have failed in a row
+	openedAt    time.Time // When the breaker was last opened
+	probing     bool      // If the probe of a half open breaker has not completed
+
+	rejected uint64 // atomic - sends failed because the breaker was open
+	opened   uint64 // atomic - times the breaker was opened
+}
+
+// circuitBreakerSettings returns the circuit breaker settings in the section of the named backend.
+func circuitBreakerSettings(name string, v *viper.Viper) (int, time.Duration, error) {
+	sub := util.GetSubViper(v, name)
+	sub.SetDefault(paramCircuitBreakerOpenTime, defaultCircuitBreakerOpenTime)
+	failures := sub.GetInt(paramCircuitBreakerFailures)
+	if failures < 0 {
+		return 0, 0, fmt.Errorf("%s.%s must not be negative", name, paramCircuitBreakerFailures)
+	}
+	openTime := sub.GetDuration(paramCircuitBreakerOpenTime)
+	if failures > 0 && openTime <= 0 {
+		return 0, 0, fmt.Errorf("%s.%s must be positive", name, paramCircuitBreakerOpenTime)
+	}
+	return failures, openTime, nil
+}
+
+// configure changes the settings of the breaker, and closes it if it is disabled.
+func (cb *circuitBreaker) configure(failures int, openTime time.Duration) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.failures = failures
+	cb.openTime = openTime
+	if failures == 0 {
+		cb.state = circuitClosed
+		cb.consecutive = 0
+		cb.probing = false
+	}
+}
+
+// allow returns true if a send may be made now, in which case its result must be given to done.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if now.Sub(cb.openedAt) < cb.openTime {
+			break
+		}
+		cb.logger.Info("circuit breaker is half open, probing")
+		cb.state = circuitHalfOpen
+		cb.probing = true
+		return true
+	case circuitHalfOpen:
+		if cb.probing {
+			break
+		}
+		cb.probing = true
+		return true
+	default:
+		return true
+	}
+	atomic.AddUint64(&cb.rejected, 1)
+	return false
+}
+
+// done records the result of a send which was allowed.
+func (cb *circuitBreaker) done(now time.Time, failed bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.failures == 0 {
+		return
+	}
+	if !failed {
+		if cb.state != circuitClosed {
+			cb.logger.Info("circuit breaker closed")
+		}
+		cb.state = circuitClosed
+		cb.consecutive = 0
+		cb.probing = false
+		return
+	}
+	cb.consecutive++
+	if cb.state == circuitHalfOpen || (cb.state == circuitClosed && cb.consecutive >= cb.failures) {
+		cb.logger.WithFields(logrus.Fields{
+			"failures":  cb.consecutive,
+			"open-time": cb.openTime,
+		}).Warn("circuit breaker opened")
+		cb.state = circuitOpen
+		cb.openedAt = now
+		cb.probing = false
+		atomic.AddUint64(&cb.opened, 1)
+	}
+}
+
+// status returns if the breaker is enabled, and its state.
+func (cb *circuitBreaker) status() (bool, int) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.failures > 0, cb.state
+}
+
+// runMetrics writes the state of the breaker, and its accumulated counters, every flush until the context is done.
+// Nothing is written while the breaker is disabled.
+func (cb *circuitBreaker) runMetrics(ctx context.Context, name string) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + name})
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			enabled, state := cb.status()
+			if !enabled {
+				continue
+			}
+			statser.Gauge("backend.circuit.state", float64(state), nil)
+			statser.Gauge("backend.circuit.opened", float64(atomic.LoadUint64(&cb.opened)), nil)
+			statser.Gauge("backend.circuit.rejected", float64(atomic.LoadUint64(&cb.rejected)), nil)
+		}
+	}
+}
+
+// anyError returns true if any of the errors of a send is not nil.
+func anyError(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
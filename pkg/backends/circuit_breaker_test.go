@@ -0,0 +1,120 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	cb := &circuitBreaker{logger: logrus.New()}
+	cb.configure(2, time.Minute)
+
+	require.True(t, cb.allow(now))
+	cb.done(now, true)
+	require.True(t, cb.allow(now))
+	cb.done(now, true)
+	// Opened after 2 failures in a row
+	require.False(t, cb.allow(now))
+	require.False(t, cb.allow(now.Add(59*time.Second)))
+
+	// A single probe is allowed once it has been open for the open time, and it is opened again if the probe fails
+	now = now.Add(time.Minute)
+	require.True(t, cb.allow(now))
+	require.False(t, cb.allow(now))
+	cb.done(now, true)
+	require.False(t, cb.allow(now))
+
+	// And closed if it succeeds
+	now = now.Add(time.Minute)
+	require.True(t, cb.allow(now))
+	cb.done(now, false)
+	require.True(t, cb.allow(now))
+	require.True(t, cb.allow(now))
+	assert.EqualValues(t, 2, cb.opened)
+	assert.EqualValues(t, 4, cb.rejected)
+
+	// A success resets the count of failures
+	cb.done(now, true)
+	cb.done(now, false)
+	cb.done(now, true)
+	require.True(t, cb.allow(now))
+
+	// Disabling it closes it
+	cb.done(now, true)
+	require.False(t, cb.allow(now))
+	cb.configure(0, time.Minute)
+	require.True(t, cb.allow(now))
+}
+
+// failingBackend fails every send.
+type failingBackend struct {
+	sends int
+}
+
+func (fb *failingBackend) Name() string {
+	return "failing"
+}
+
+func (fb *failingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	fb.sends++
+	cb([]error{errors.New("failed")})
+}
+
+func (fb *failingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	fb.sends++
+	return errors.New("failed")
+}
+
+func TestReloadableBackendCircuitBreaker(t *testing.T) {
+	backend := &failingBackend{}
+	backends["failing"] = func(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
+		return backend, nil
+	}
+	defer delete(backends, "failing")
+
+	logger := logrus.StandardLogger()
+	v := viper.New()
+	v.Set("failing.circuit-breaker-failures", 2)
+	rb, err := NewReloadableBackend("failing", v, logger, transport.NewTransportPool(logger, v))
+	require.NoError(t, err)
+
+	drops := stats.NewDropAccounting(logger, 0)
+	ctx := stats.NewDropAccountingContext(clock.Context(context.Background(), clock.NewMock(time.Unix(1000, 0))), drops)
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "counter", Value: 1, Type: gostatsd.COUNTER})
+	for i := 0; i < 2; i++ {
+		require.Error(t, rb.SendEvent(ctx, &gostatsd.Event{}))
+	}
+	// The breaker is open, so the backend is not sent anything
+	err = rb.SendEvent(ctx, &gostatsd.Event{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), errCircuitOpen.Error())
+	var errs []error
+	rb.SendMetricsAsync(ctx, mm, func(e []error) {
+		errs = e
+	})
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), errCircuitOpen.Error())
+	assert.Equal(t, 2, backend.sends)
+	assert.EqualValues(t, 1, drops.Total())
+
+	// Disabled by a reload
+	v.Set("failing.circuit-breaker-failures", 0)
+	require.NoError(t, rb.ReloadConfig(ctx, v))
+	require.Error(t, rb.SendEvent(ctx, &gostatsd.Event{}))
+	assert.Equal(t, 3, backend.sends)
+}
@@ -2,6 +2,7 @@ package cloudwatch
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"strconv"
 	"strings"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/internal/util"
+	awsprovider "github.com/hligit/gostatsd/pkg/cloudproviders/aws"
 	"github.com/hligit/gostatsd/pkg/transport"
 )
 
@@ -41,25 +43,58 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	g := util.GetSubViper(v, "cloudwatch")
 	g.SetDefault("namespace", "StatsD")
 	g.SetDefault("transport", "default")
+	g.SetDefault("region", "")
+	g.SetDefault("require_imdsv2", false)
+
+	region := g.GetString("region")
+	if region == "" {
+		var err error
+		region, err = defaultRegion(g.GetBool("require_imdsv2"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return NewClient(
 		g.GetString("namespace"),
 		g.GetString("transport"),
-		gostatsd.DisabledSubMetrics(v),
+		region,
+		gostatsd.BackendDisabledSubMetrics(v, BackendName),
 		logger,
 		pool,
 	)
 }
 
-// NewClient constructs a AWS Cloudwatch backend.
-func NewClient(namespace, transport string, disabled gostatsd.TimerSubtypes, logger logrus.FieldLogger, pool *transport.TransportPool) (*Client, error) {
+// defaultRegion returns the region from the environment or shared config if it is set, otherwise the region of the
+// instance from the EC2 instance metadata service.
+func defaultRegion(requireIMDSv2 bool) (string, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return "", err
+	}
+	if region := aws.StringValue(sess.Config.Region); region != "" {
+		return region, nil
+	}
+	region, err := awsprovider.NewMetadata(sess, requireIMDSv2).Region()
+	if err != nil {
+		return "", fmt.Errorf("error getting AWS region: %v", err)
+	}
+	return region, nil
+}
+
+// NewClient constructs a AWS Cloudwatch backend.  If region is "", the region is taken from the environment.
+func NewClient(namespace, transport, region string, disabled gostatsd.TimerSubtypes, logger logrus.FieldLogger, pool *transport.TransportPool) (*Client, error) {
 	httpClient, err := pool.Get(transport)
 	if err != nil {
 		return nil, err
 	}
-	sess, err := session.NewSession(&aws.Config{
+	config := &aws.Config{
 		HTTPClient: httpClient.Client,
-	})
+	}
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+	sess, err := session.NewSession(config)
 	if err != nil {
 		return nil, err
 	}
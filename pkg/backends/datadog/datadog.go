@@ -2,8 +2,8 @@ package datadog
 
 import (
 	"bytes"
-	"compress/zlib"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,6 +16,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/ash2k/stager/wait"
 	"github.com/cenkalti/backoff"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/sirupsen/logrus"
@@ -24,7 +25,9 @@ import (
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/compression"
 	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/tracing"
 	"github.com/hligit/gostatsd/pkg/transport"
 )
 
@@ -37,6 +40,11 @@ const (
 	defaultMaxRequestElapsedTime = 15 * time.Second
 	// defaultMetricsPerBatch is the default number of metrics to send in a single batch.
 	defaultMetricsPerBatch = 1000
+	// maxSplitRequests is the most requests made for the halves of a batch which was rejected, enough to find about two
+	// invalid series in a batch of defaultMetricsPerBatch.
+	maxSplitRequests = 40
+	// defaultSeriesCacheSize is the default number of encoded series to keep between flushes, in each of two generations.
+	defaultSeriesCacheSize = 100000
 	// maxResponseSize is the maximum response size we are willing to read.
 	maxResponseSize     = 1024
 	maxConcurrentEvents = 20
@@ -56,27 +64,35 @@ var (
 
 // Client represents a Datadog client.
 type Client struct {
-	batchesCreated uint64            // Accumulated number of batches created
-	batchesDropped uint64            // Accumulated number of batches aborted (data loss)
-	batchesSent    uint64            // Accumulated number of batches successfully sent
-	seriesSent     uint64            // Accumulated number of series successfully sent
-	batchesRetried stats.ChangeGauge // Accumulated number of batches retried (first send is not a retry)
+	backendStats *stats.BackendStats
 
 	logger                logrus.FieldLogger
 	apiKey                string
+	applicationKey        string // Required to send the metadata of metrics, as it is changed through the API
 	apiEndpoint           string
 	userAgent             string
 	maxRequestElapsedTime time.Duration
+	requestTimeout        time.Duration // The time allowed for each attempt, or 0 for the client-timeout of the transport
 	client                *http.Client
 	metricsPerBatch       uint
+	seriesCache           *seriesCache
 	metricsBufferSem      chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
 	eventsBufferSem       chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
-	compressPayload       bool
+	compressor            compression.Codec  // nil if payloads are not compressed
+	spool                 gostatsd.Spool     // nil if payloads are not spooled
+	metadata              *metadataSender    // nil if the metadata of metrics is not sent
 
 	disabledSubtypes gostatsd.TimerSubtypes
 	flushInterval    time.Duration
 }
 
+// spooledPost describes a payload which was spooled.  It is stored as a line of json, followed by the body.
+type spooledPost struct {
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
 // event represents an event data structure for Datadog.
 type event struct {
 	Title          string   `json:"title"`
@@ -92,6 +108,9 @@ type event struct {
 
 // SendMetricsAsync flushes the metrics to Datadog, preparing payload synchronously but doing the send asynchronously.
 func (d *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	if d.metadata != nil {
+		d.queueMetadata(metrics)
+	}
 	counter := 0
 	results := make(chan error)
 
@@ -100,7 +119,7 @@ func (d *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricM
 		// This section would be likely be better if it pushed all ts's in to a single channel
 		// which n goroutines then read from.  Current behavior still spins up many goroutines
 		// and has them all hit the same channel.
-		atomic.AddUint64(&d.batchesCreated, 1)
+		atomic.AddUint64(&d.backendStats.BatchesCreated, 1)
 		go func() {
 			select {
 			case <-ctx.Done():
@@ -137,39 +156,30 @@ func (d *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricM
 }
 
 func (d *Client) Run(ctx context.Context) {
-	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:datadog"})
-
-	flushed, unregister := statser.RegisterFlush()
-	defer unregister()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-flushed:
-			statser.Gauge("backend.created", float64(atomic.LoadUint64(&d.batchesCreated)), nil)
-			d.batchesRetried.SendIfChanged(statser, "backend.retried", nil)
-			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&d.batchesDropped)), nil)
-			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&d.batchesSent)), nil)
-			statser.Gauge("backend.series.sent", float64(atomic.LoadUint64(&d.seriesSent)), nil)
-		}
+	if d.metadata != nil {
+		var wg wait.Group
+		defer wg.Wait()
+		wg.StartWithContext(ctx, d.runMetadata)
 	}
+	d.backendStats.RunMetrics(ctx, stats.FromContext(ctx))
 }
 
 func (d *Client) processMetrics(now float64, metrics *gostatsd.MetricMap, cb func(*timeSeries)) {
 	fl := flush{
 		ts: &timeSeries{
-			Series: make([]metric, 0, d.metricsPerBatch),
+			Series:    make([]metric, 0, d.metricsPerBatch),
+			timestamp: now,
 		},
 		timestamp:        now,
 		flushIntervalSec: d.flushInterval.Seconds(),
 		metricsPerBatch:  d.metricsPerBatch,
+		cache:            d.seriesCache,
 		cb:               cb,
 	}
 
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		fl.addMetric(rate, counter.PerSecond, counter.Source, counter.Tags, key)
-		fl.addMetricf(gauge, float64(counter.Value), counter.Source, counter.Tags, "%s.count", key)
+		fl.addMetric(seriesKey{name: key, source: counter.Source, tagsKey: tagsKey, metricType: rate}, counter.Tags, counter.PerSecond)
+		fl.addMetric(seriesKey{name: key, suffix: "count", source: counter.Source, tagsKey: tagsKey, metricType: gauge}, counter.Tags, float64(counter.Value))
 		fl.maybeFlush()
 	})
 
@@ -180,52 +190,53 @@ func (d *Client) processMetrics(now float64, metrics *gostatsd.MetricMap, cb fun
 				if !math.IsInf(float64(histogramThreshold), 1) {
 					bucketTag = "le:" + strconv.FormatFloat(float64(histogramThreshold), 'f', -1, 64)
 				}
-				newTags := timer.Tags.Concat(gostatsd.Tags{bucketTag})
-				fl.addMetricf(counter, float64(count), timer.Source, newTags, "%s.histogram", key)
+				fl.addMetric(seriesKey{name: key, suffix: "histogram", source: timer.Source, tagsKey: tagsKey, bucket: bucketTag, metricType: counter}, timer.Tags, float64(count))
 			}
 		} else {
-
+			timerKey := func(suffix string, metricType metricType) seriesKey {
+				return seriesKey{name: key, suffix: suffix, source: timer.Source, tagsKey: tagsKey, metricType: metricType}
+			}
 			if !d.disabledSubtypes.Lower {
-				fl.addMetricf(gauge, timer.Min, timer.Source, timer.Tags, "%s.lower", key)
+				fl.addMetric(timerKey("lower", gauge), timer.Tags, timer.Min)
 			}
 			if !d.disabledSubtypes.Upper {
-				fl.addMetricf(gauge, timer.Max, timer.Source, timer.Tags, "%s.upper", key)
+				fl.addMetric(timerKey("upper", gauge), timer.Tags, timer.Max)
 			}
 			if !d.disabledSubtypes.Count {
-				fl.addMetricf(gauge, float64(timer.Count), timer.Source, timer.Tags, "%s.count", key)
+				fl.addMetric(timerKey("count", gauge), timer.Tags, float64(timer.Count))
 			}
 			if !d.disabledSubtypes.CountPerSecond {
-				fl.addMetricf(rate, timer.PerSecond, timer.Source, timer.Tags, "%s.count_ps", key)
+				fl.addMetric(timerKey("count_ps", rate), timer.Tags, timer.PerSecond)
 			}
 			if !d.disabledSubtypes.Mean {
-				fl.addMetricf(gauge, timer.Mean, timer.Source, timer.Tags, "%s.mean", key)
+				fl.addMetric(timerKey("mean", gauge), timer.Tags, timer.Mean)
 			}
 			if !d.disabledSubtypes.Median {
-				fl.addMetricf(gauge, timer.Median, timer.Source, timer.Tags, "%s.median", key)
+				fl.addMetric(timerKey("median", gauge), timer.Tags, timer.Median)
 			}
 			if !d.disabledSubtypes.StdDev {
-				fl.addMetricf(gauge, timer.StdDev, timer.Source, timer.Tags, "%s.std", key)
+				fl.addMetric(timerKey("std", gauge), timer.Tags, timer.StdDev)
 			}
 			if !d.disabledSubtypes.Sum {
-				fl.addMetricf(gauge, timer.Sum, timer.Source, timer.Tags, "%s.sum", key)
+				fl.addMetric(timerKey("sum", gauge), timer.Tags, timer.Sum)
 			}
 			if !d.disabledSubtypes.SumSquares {
-				fl.addMetricf(gauge, timer.SumSquares, timer.Source, timer.Tags, "%s.sum_squares", key)
+				fl.addMetric(timerKey("sum_squares", gauge), timer.Tags, timer.SumSquares)
 			}
 			for _, pct := range timer.Percentiles {
-				fl.addMetricf(gauge, pct.Float, timer.Source, timer.Tags, "%s.%s", key, pct.Str)
+				fl.addMetric(timerKey(pct.Str, gauge), timer.Tags, pct.Float)
 			}
 		}
 		fl.maybeFlush()
 	})
 
 	metrics.Gauges.Each(func(key, tagsKey string, g gostatsd.Gauge) {
-		fl.addMetric(gauge, g.Value, g.Source, g.Tags, key)
+		fl.addMetric(seriesKey{name: key, source: g.Source, tagsKey: tagsKey, metricType: gauge}, g.Tags, g.Value)
 		fl.maybeFlush()
 	})
 
 	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		fl.addMetric(gauge, float64(len(set.Values)), set.Source, set.Tags, key)
+		fl.addMetric(seriesKey{name: key, source: set.Source, tagsKey: tagsKey, metricType: gauge}, set.Tags, float64(len(set.Values)))
 		fl.maybeFlush()
 	})
 
@@ -233,13 +244,59 @@ func (d *Client) processMetrics(now float64, metrics *gostatsd.MetricMap, cb fun
 }
 
 func (d *Client) postMetrics(ctx context.Context, buffer *bytes.Buffer, ts *timeSeries) error {
-	if err := d.post(ctx, buffer, "/api/v1/series", "metrics", ts); err != nil {
+	splits := maxSplitRequests
+	accepted, err := d.postSeries(ctx, buffer, ts, &splits)
+	if err != nil {
 		return err
 	}
-	atomic.AddUint64(&d.seriesSent, uint64(len(ts.Series)))
+	if accepted == 0 {
+		return fmt.Errorf("[%s] every series in the batch was rejected", BackendName)
+	}
 	return nil
 }
 
+// postSeries sends a batch of series, and returns how many were accepted.  If Datadog rejects the batch as invalid,
+// it is split in half and each half is sent, so only the series which are invalid are dropped, rather than the whole
+// batch.  At most splits requests are made for the halves, after which the series rejected are dropped.
+func (d *Client) postSeries(ctx context.Context, buffer *bytes.Buffer, ts *timeSeries, splits *int) (int, error) {
+	buffer.Reset()
+	err := d.post(ctx, buffer, "/api/v1/series", "metrics", uint64(len(ts.Series)), ts)
+	if err == nil {
+		atomic.AddUint64(&d.backendStats.SeriesSent, uint64(len(ts.Series)))
+		return len(ts.Series), nil
+	}
+	if _, ok := err.(*rejectedError); !ok {
+		return 0, err
+	}
+	if len(ts.Series) == 1 || *splits < 2 {
+		d.backendStats.Dropped(ctx, "metrics", stats.DropReasonRejected, uint64(len(ts.Series)))
+		d.logger.WithFields(logrus.Fields{
+			"series": len(ts.Series),
+			"error":  err,
+		}).Warn("series rejected, dropped")
+		return 0, nil
+	}
+	*splits -= 2
+	half := len(ts.Series) / 2
+	accepted := 0
+	var errs []string
+	for _, part := range []*timeSeries{
+		{Series: ts.Series[:half], timestamp: ts.timestamp},
+		{Series: ts.Series[half:], timestamp: ts.timestamp},
+	} {
+		// Both halves are sent even if the first fails, so every series is sent, spooled, or counted as dropped
+		n, err := d.postSeries(ctx, buffer, part, splits)
+		accepted += n
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return accepted, errors.New(strings.Join(errs, "; "))
+	}
+	return accepted, nil
+}
+
 // SendEvent sends an event to Datadog.
 func (d *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 	select {
@@ -250,7 +307,7 @@ func (d *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 			buffer.Reset()
 			d.eventsBufferSem <- buffer
 		}()
-		return d.post(ctx, buffer, "/api/v1/events", "events", &event{
+		return d.post(ctx, buffer, "/api/v1/events", "events", 0, &event{
 			Title:          e.Title,
 			Text:           e.Text,
 			DateHappened:   e.DateHappened,
@@ -269,27 +326,60 @@ func (d *Client) Name() string {
 	return BackendName
 }
 
-func (d *Client) post(ctx context.Context, buffer *bytes.Buffer, path, typeOfPost string, data interface{}) error {
+// post sends data, retrying until it is sent or max-request-elapsed-time has passed.  The datapoints are the number of
+// series in data, which are counted as dropped if it isn't sent.  Data which is rejected as invalid is not retried, and
+// a *rejectedError is returned without counting it as dropped, so the caller can decide what to drop.
+func (d *Client) post(ctx context.Context, buffer *bytes.Buffer, path, typeOfPost string, datapoints uint64, data interface{}) (err error) {
+	ctx, span := tracing.Start(ctx, "backend.post", tracing.BackendKey.String(BackendName), tracing.TypeKey.String(typeOfPost))
+	attempts := 0
+	defer func() {
+		span.SetAttributes(tracing.AttemptsKey.Int(attempts))
+		tracing.End(span, err)
+	}()
+
 	post, err := d.constructPost(ctx, buffer, path, typeOfPost, data)
 	if err != nil {
-		atomic.AddUint64(&d.batchesDropped, 1)
+		d.backendStats.Dropped(ctx, typeOfPost, stats.DropReasonSerialize, datapoints)
 		return err
 	}
+	span.SetAttributes(tracing.PayloadBytesKey.Int(buffer.Len()))
 
 	b := backoff.NewExponentialBackOff()
 	clck := clock.FromContext(ctx)
 	b.Clock = clck
 	b.Reset()
 	b.MaxElapsedTime = d.maxRequestElapsedTime
+	budget := stats.RetryBudgetFromContext(ctx)
+	budget.Sent(clck.Now())
 	for {
-		if err = post(); err == nil {
-			atomic.AddUint64(&d.batchesSent, 1)
+		attempts++
+		postTimer := d.backendStats.NewPostTimer(ctx, typeOfPost)
+		err = post()
+		postTimer.Send()
+		if err == nil {
+			atomic.AddUint64(&d.backendStats.BatchesSent, 1)
 			return nil
 		}
+		if _, ok := err.(*rejectedError); ok {
+			// It would be rejected again, so it is neither retried nor spooled
+			span.SetAttributes(tracing.OutcomeKey.String("rejected"))
+			return err
+		}
 
 		next := b.NextBackOff()
+		reason := stats.DropReasonRetriesExhausted
+		if next != backoff.Stop && !budget.Retry(clck.Now()) {
+			next, reason = backoff.Stop, stats.DropReasonRetryBudget
+		}
 		if next == backoff.Stop {
-			atomic.AddUint64(&d.batchesDropped, 1)
+			if d.spoolPost(ctx, buffer.Bytes(), path, typeOfPost, datapoints) {
+				d.logger.WithFields(logrus.Fields{
+					"type":  typeOfPost,
+					"error": err,
+				}).Warn("failed to send, spooled")
+				return nil
+			}
+			d.backendStats.Dropped(ctx, typeOfPost, reason, datapoints)
 			return fmt.Errorf("[%s] %v", BackendName, err)
 		}
 
@@ -298,16 +388,18 @@ func (d *Client) post(ctx context.Context, buffer *bytes.Buffer, path, typeOfPos
 			"sleep": next,
 			"error": err,
 		}).Warn("failed to send")
+		tracing.Retry(ctx, span, attempts, err, next)
 
 		timer := clck.NewTimer(next)
 		select {
 		case <-ctx.Done():
 			timer.Stop()
+			d.backendStats.Dropped(ctx, typeOfPost, stats.DropReasonCanceled, datapoints)
 			return ctx.Err()
 		case <-timer.C:
 		}
 
-		atomic.AddUint64(&d.batchesRetried.Cur, 1)
+		atomic.AddUint64(&d.backendStats.BatchesRetried.Cur, 1)
 	}
 }
 
@@ -315,16 +407,24 @@ func (d *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, path,
 	authenticatedURL := d.authenticatedURL(path)
 	// Selectively compress payload based on knowledge of whether the endpoint supports deflate encoding.
 	// The metrics endpoint does, the events endpoint does not.
-	compressPayload := d.compressPayload && typeOfPost == "metrics"
+	compressPayload := d.compressor != nil && typeOfPost == "metrics"
+	var rawBytes int
 	marshal := func(w io.Writer) error {
-		stream := jsonConfig.BorrowStream(w)
+		cw := &util.CountingWriteCloser{WriteCloser: util.NopWriteCloser(w)}
+		stream := jsonConfig.BorrowStream(cw)
 		defer jsonConfig.ReturnStream(stream)
-		stream.WriteVal(data)
-		return stream.Flush()
+		if ts, ok := data.(*timeSeries); ok {
+			ts.writeJSON(stream)
+		} else {
+			stream.WriteVal(data)
+		}
+		err := stream.Flush()
+		rawBytes = cw.N
+		return err
 	}
 	var err error
 	if compressPayload {
-		err = deflate(buffer, marshal)
+		err = compress(d.compressor, buffer, marshal)
 	} else {
 		err = marshal(buffer)
 	}
@@ -332,43 +432,134 @@ func (d *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, path,
 		return nil, fmt.Errorf("[%s] unable to marshal %s: %v", BackendName, typeOfPost, err)
 	}
 	body := buffer.Bytes()
+	d.backendStats.Payload(ctx, typeOfPost, rawBytes, len(body))
 
+	encoding := ""
+	if compressPayload {
+		encoding = d.compressor.Encoding()
+	}
 	return func() error {
-		headers := map[string]string{
-			"Content-Type":         "application/json",
-			"DD-Dogstatsd-Version": dogstatsdVersion,
-			"User-Agent":           d.userAgent,
-		}
-		if compressPayload {
-			headers["Content-Encoding"] = "deflate"
-		}
-		req, err := http.NewRequest("POST", authenticatedURL, bytes.NewReader(body))
-		if err != nil {
-			return fmt.Errorf("unable to create http.Request: %v", err)
-		}
-		req = req.WithContext(ctx)
-		for header, v := range headers {
-			req.Header.Set(header, v)
-		}
-		resp, err := d.client.Do(req)
-		if err != nil {
-			return fmt.Errorf("error POSTing: %s", strings.Replace(err.Error(), d.apiKey, "*****", -1))
-		}
-		defer resp.Body.Close()
-		body := io.LimitReader(resp.Body, maxResponseSize)
-		if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
-			b, _ := ioutil.ReadAll(body)
-			d.logger.WithFields(logrus.Fields{
-				"status": resp.StatusCode,
-				"body":   string(b),
-			}).Info("request failed")
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
-		}
-		_, _ = io.Copy(ioutil.Discard, body)
-		return nil
+		return d.doPost(ctx, authenticatedURL, typeOfPost, encoding, body)
 	}, nil
 }
 
+// doPost makes a single attempt to send a body which has already been encoded.
+func (d *Client) doPost(ctx context.Context, authenticatedURL, typeOfPost, encoding string, body []byte) error {
+	ctx, cancel := transport.AttemptContext(ctx, d.requestTimeout)
+	defer cancel()
+	headers := map[string]string{
+		"Content-Type":         "application/json",
+		"DD-Dogstatsd-Version": dogstatsdVersion,
+		"User-Agent":           d.userAgent,
+	}
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+	req, err := http.NewRequest("POST", authenticatedURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	for header, v := range headers {
+		req.Header.Set(header, v)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		d.backendStats.Response(ctx, typeOfPost, 0)
+		return fmt.Errorf("error POSTing: %s", strings.Replace(err.Error(), d.apiKey, "*****", -1))
+	}
+	defer resp.Body.Close()
+	d.backendStats.Response(ctx, typeOfPost, resp.StatusCode)
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		d.logger.WithFields(logrus.Fields{
+			"status": resp.StatusCode,
+			"body":   string(b),
+		}).Info("request failed")
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+			return newRejectedError(resp.StatusCode, b)
+		}
+		return fmt.Errorf("received bad status code %d", resp.StatusCode)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// rejectedError is returned when Datadog rejects a payload as invalid or too large, so it would be rejected again if
+// it was retried.
+type rejectedError struct {
+	status int
+	errors []string // The reasons given in the response, if any
+}
+
+// newRejectedError returns a rejectedError with the reasons in the body of the response, which is
+// {"errors": ["reason", ...]}.
+func newRejectedError(status int, body []byte) *rejectedError {
+	var response struct {
+		Errors []string `json:"errors"`
+	}
+	_ = jsonConfig.Unmarshal(body, &response)
+	return &rejectedError{status: status, errors: response.Errors}
+}
+
+func (re *rejectedError) Error() string {
+	if len(re.errors) == 0 {
+		return fmt.Sprintf("[%s] rejected with status code %d", BackendName, re.status)
+	}
+	return fmt.Sprintf("[%s] rejected with status code %d: %s", BackendName, re.status, strings.Join(re.errors, "; "))
+}
+
+// SetSpool sets the spool payloads are added to when they exhaust their retries.
+func (d *Client) SetSpool(spool gostatsd.Spool) {
+	d.spool = spool
+}
+
+// spoolPost adds a body which could not be sent to the spool, and returns false if it was not spooled.
+func (d *Client) spoolPost(ctx context.Context, body []byte, path, typeOfPost string, datapoints uint64) bool {
+	if d.spool == nil {
+		return false
+	}
+	entry := spooledPost{
+		Path: path,
+		Type: typeOfPost,
+	}
+	if d.compressor != nil && typeOfPost == "metrics" {
+		entry.Encoding = d.compressor.Encoding()
+	}
+	header, err := jsonConfig.Marshal(&entry)
+	if err != nil {
+		return false
+	}
+	payload := make([]byte, 0, len(header)+1+len(body))
+	payload = append(append(append(payload, header...), '\n'), body...)
+	return d.spool.Spool(ctx, payload, datapoints)
+}
+
+// Replay makes a single attempt to send a payload which was spooled.  It is sent with the current api key and
+// endpoint, so a payload spooled before a reload is sent to where the backend now sends.
+func (d *Client) Replay(ctx context.Context, payload []byte) error {
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 {
+		return fmt.Errorf("[%s] spooled payload is missing its header", BackendName)
+	}
+	var entry spooledPost
+	if err := jsonConfig.Unmarshal(payload[:end], &entry); err != nil {
+		return fmt.Errorf("[%s] spooled payload has an invalid header: %v", BackendName, err)
+	}
+	ctx, span := tracing.Start(ctx, "backend.replay", tracing.BackendKey.String(BackendName), tracing.TypeKey.String(entry.Type))
+	postTimer := d.backendStats.NewPostTimer(ctx, entry.Type)
+	err := d.doPost(ctx, d.authenticatedURL(entry.Path), entry.Type, entry.Encoding, payload[end+1:])
+	postTimer.Send()
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	atomic.AddUint64(&d.backendStats.BatchesSent, 1)
+	return nil
+}
+
 func (d *Client) authenticatedURL(path string) string {
 	q := url.Values{
 		"api_key": []string{d.apiKey},
@@ -381,26 +572,39 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	dd := util.GetSubViper(v, "datadog")
 	dd.SetDefault("api_endpoint", apiURL)
 	dd.SetDefault("metrics_per_batch", defaultMetricsPerBatch)
+	dd.SetDefault("series_cache_size", defaultSeriesCacheSize)
 	dd.SetDefault("compress_payload", true)
 	dd.SetDefault("max_request_elapsed_time", defaultMaxRequestElapsedTime)
+	dd.SetDefault("request_timeout", 0)
 	dd.SetDefault("max_requests", defaultMaxRequests)
 	dd.SetDefault("user-agent", defaultUserAgent)
 	dd.SetDefault("transport", "default")
 
-	return NewClient(
+	requestTimeout := dd.GetDuration("request_timeout")
+	if requestTimeout < 0 {
+		return nil, fmt.Errorf("[%s] request_timeout must not be negative", BackendName)
+	}
+	client, err := NewClient(
 		dd.GetString("api_endpoint"),
 		dd.GetString("api_key"),
 		dd.GetString("user-agent"),
 		dd.GetString("transport"),
 		dd.GetInt("metrics_per_batch"),
+		dd.GetInt("series_cache_size"),
 		uint(dd.GetInt("max_requests")),
 		dd.GetBool("compress_payload"),
 		dd.GetDuration("max_request_elapsed_time"),
 		v.GetDuration("flush-interval"), // Main viper, not sub-viper
-		gostatsd.DisabledSubMetrics(v),
+		gostatsd.BackendDisabledSubMetrics(v, BackendName),
 		logger,
 		pool,
 	)
+	if err != nil {
+		return nil, err
+	}
+	client.requestTimeout = requestTimeout
+	client.applicationKey = dd.GetString("application_key")
+	return client, nil
 }
 
 // NewClient returns a new Datadog API client.
@@ -409,7 +613,8 @@ func NewClient(
 	apiKey,
 	userAgent,
 	transport string,
-	metricsPerBatch int,
+	metricsPerBatch,
+	seriesCacheSize int,
 	maxRequests uint,
 	compressPayload bool,
 	maxRequestElapsedTime,
@@ -443,9 +648,18 @@ func NewClient(
 		"max-request-elapsed-time": maxRequestElapsedTime,
 		"max-requests":             maxRequests,
 		"metrics-per-batch":        metricsPerBatch,
+		"series-cache-size":        seriesCacheSize,
 		"compress-payload":         compressPayload,
 	}).Info("created backend")
 
+	var compressor compression.Codec
+	if compressPayload {
+		compressor, err = compression.New(compression.Deflate, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	metricsBufferSem := make(chan *bytes.Buffer, maxRequests)
 	for i := uint(0); i < maxRequests; i++ {
 		metricsBufferSem <- &bytes.Buffer{}
@@ -455,6 +669,7 @@ func NewClient(
 		eventsBufferSem <- &bytes.Buffer{}
 	}
 	return &Client{
+		backendStats:          stats.NewBackendStats(BackendName),
 		logger:                logger,
 		apiKey:                apiKey,
 		apiEndpoint:           apiEndpoint,
@@ -462,20 +677,19 @@ func NewClient(
 		maxRequestElapsedTime: maxRequestElapsedTime,
 		client:                httpClient.Client,
 		metricsPerBatch:       uint(metricsPerBatch),
+		seriesCache:           newSeriesCache(seriesCacheSize),
 		metricsBufferSem:      metricsBufferSem,
 		eventsBufferSem:       eventsBufferSem,
-		compressPayload:       compressPayload,
+		compressor:            compressor,
 		flushInterval:         flushInterval,
 		disabledSubtypes:      disabled,
 	}, nil
 }
 
-func deflate(w io.Writer, f func(io.Writer) error) error {
-	compressor, err := zlib.NewWriterLevel(w, zlib.BestCompression)
-	if err != nil {
-		return fmt.Errorf("unable to create zlib writer: %v", err)
-	}
-	err = f(compressor)
+// compress writes what f writes to w, compressed by the codec.
+func compress(codec compression.Codec, w io.Writer, f func(io.Writer) error) error {
+	compressor := codec.NewWriter(w)
+	err := f(compressor)
 	if err != nil {
 		return fmt.Errorf("unable to write compressed payload: %v", err)
 	}
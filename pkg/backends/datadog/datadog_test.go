@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"compress/zlib"
 	"context"
+	"encoding/json"
 	"index/suffixarray"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -20,6 +22,7 @@ import (
 	"github.com/tilinna/clock"
 
 	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
 	"github.com/hligit/gostatsd/pkg/transport"
 )
 
@@ -48,7 +51,7 @@ func TestRetries(t *testing.T) {
 		assert.NotEmpty(t, data)
 		if n == 1 {
 			// Return error on first request to trigger a retry
-			w.WriteHeader(http.StatusBadRequest)
+			w.WriteHeader(http.StatusServiceUnavailable)
 		}
 	})
 	ts := httptest.NewServer(mux)
@@ -57,11 +60,12 @@ func TestRetries(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultSeriesCacheSize, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 	res := make(chan []error, 1)
 	clck := clock.NewMock(time.Unix(0, 0))
-	ctx := clock.Context(context.Background(), clck)
+	statser := stats.NewPrometheusStatser(stats.NewNullStatser(), "", nil)
+	ctx := stats.NewContext(clock.Context(context.Background(), clck), statser)
 	ch := make(chan struct{})
 	go advanceTime(clck, ch)
 	client.SendMetricsAsync(ctx, twoCounters(), func(errs []error) {
@@ -73,6 +77,118 @@ func TestRetries(t *testing.T) {
 	}
 	assert.EqualValues(t, 2, requestNum)
 	ch <- struct{}{}
+
+	// Every attempt is timed
+	rec := httptest.NewRecorder()
+	statser.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `backend_post_time_count{backend="datadog",type="metrics"} 2`)
+	// As is every response
+	assert.Contains(t, body, `backend_responses{backend="datadog",status="5xx",type="metrics"} 1`)
+	assert.Contains(t, body, `backend_responses{backend="datadog",status="2xx",type="metrics"} 1`)
+	assert.Contains(t, body, `backend_bytes{backend="datadog",encoding="compressed",type="metrics"}`)
+	assert.Contains(t, body, `backend_bytes{backend="datadog",encoding="raw",type="metrics"}`)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		if atomic.AddUint32(&requestNum, 1) == 1 {
+			// Hang the first request until the client gives up on it
+			<-r.Context().Done()
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set("transport.default.client-timeout", time.Minute)
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultSeriesCacheSize, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	require.NoError(t, err)
+	client.requestTimeout = 50 * time.Millisecond
+	res := make(chan []error, 1)
+
+	// The hung attempt fails, rather than using up the time allowed for retries
+	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
+		res <- errs
+	})
+	select {
+	case errs := <-res:
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the hung request was not timed out")
+	}
+	assert.EqualValues(t, 2, atomic.LoadUint32(&requestNum))
+}
+
+// fakeSpool keeps every payload it is given.
+type fakeSpool struct {
+	payloads   [][]byte
+	datapoints uint64
+}
+
+func (fs *fakeSpool) Spool(ctx context.Context, payload []byte, datapoints uint64) bool {
+	fs.payloads = append(fs.payloads, append([]byte(nil), payload...))
+	fs.datapoints += datapoints
+	return true
+}
+
+func TestSpoolWhenRetriesExhausted(t *testing.T) {
+	t.Parallel()
+	var failing uint32 = 1
+	var received [][]byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if atomic.LoadUint32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "deflate", r.Header.Get("Content-Encoding"))
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received = append(received, data)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultSeriesCacheSize, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	require.NoError(t, err)
+	spool := &fakeSpool{}
+	client.SetSpool(spool)
+
+	res := make(chan []error, 1)
+	clck := clock.NewMock(time.Unix(0, 0))
+	ctx := clock.Context(context.Background(), clck)
+	ch := make(chan struct{})
+	go advanceTime(clck, ch)
+	client.SendMetricsAsync(ctx, twoCounters(), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	ch <- struct{}{}
+	for _, err := range errs {
+		// Spooled payloads are not an error
+		assert.NoError(t, err)
+	}
+	require.Len(t, spool.payloads, 1)
+	// Each counter is sent as a count and a rate
+	assert.EqualValues(t, 4, spool.datapoints)
+
+	require.Error(t, client.Replay(ctx, spool.payloads[0]))
+	atomic.StoreUint32(&failing, 0)
+	require.NoError(t, client.Replay(ctx, spool.payloads[0]))
+	require.Len(t, received, 1)
+	assert.True(t, bytes.HasSuffix(spool.payloads[0], received[0]))
+
+	require.Error(t, client.Replay(ctx, []byte("no header")))
 }
 
 func TestSendMetricsInMultipleBatches(t *testing.T) {
@@ -94,7 +210,7 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1, defaultSeriesCacheSize, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 	res := make(chan []error, 1)
 	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
@@ -107,6 +223,126 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 	assert.EqualValues(t, 2, requestNum)
 }
 
+func TestRejectedSeriesAreSplitOut(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requestNum, 1)
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if bytes.Contains(data, []byte(`"stat2"`)) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors": ["Invalid metric"]}`))
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultSeriesCacheSize, defaultMaxRequests, false, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	require.NoError(t, err)
+	drops := stats.NewDropAccounting(logrus.New(), 0)
+	ctx := stats.NewDropAccountingContext(context.Background(), drops)
+
+	gauges := func(names ...string) *gostatsd.MetricMap {
+		mm := gostatsd.NewMetricMap()
+		for _, name := range names {
+			mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Type: gostatsd.GAUGE})
+		}
+		return mm
+	}
+
+	// Only the rejected series is dropped, and it is not retried
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(ctx, gauges("stat1", "stat2", "stat3"), func(errs []error) {
+		res <- errs
+	})
+	for _, err := range <-res {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 2, atomic.LoadUint64(&client.backendStats.SeriesSent))
+	assert.EqualValues(t, 1, drops.Total())
+	// The batch of 3, its halves of 1 and 2, and the halves of the 2 if it has the rejected series
+	requests := atomic.LoadUint32(&requestNum)
+	assert.True(t, requests == 3 || requests == 5, "%d requests", requests)
+
+	// A batch in which every series is rejected fails
+	client.SendMetricsAsync(ctx, gauges("stat2"), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 1)
+	assert.Error(t, errs[0])
+}
+
+func TestSplitBatchSendsBothHalvesWhenOneFails(t *testing.T) {
+	t.Parallel()
+	var lock sync.Mutex
+	failing := "" // The series of the first half, which fails with a 500
+	var received []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Series []struct {
+				Metric string `json:"metric"`
+			} `json:"series"`
+		}
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&body)) {
+			return
+		}
+		if len(body.Series) > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if failing == "" {
+			failing = body.Series[0].Metric
+		}
+		if body.Series[0].Metric == failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received = append(received, body.Series[0].Metric)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultSeriesCacheSize, defaultMaxRequests, false, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	require.NoError(t, err)
+	drops := stats.NewDropAccounting(logrus.New(), 0)
+	clck := clock.NewMock(time.Unix(0, 0))
+	ctx := clock.Context(stats.NewDropAccountingContext(context.Background(), drops), clck)
+	ch := make(chan struct{})
+	go advanceTime(clck, ch)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "stat1", Value: 1, Type: gostatsd.GAUGE})
+	mm.Receive(&gostatsd.Metric{Name: "stat2", Value: 1, Type: gostatsd.GAUGE})
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(ctx, mm, func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	ch <- struct{}{}
+	require.Len(t, errs, 1)
+	assert.Error(t, errs[0])
+
+	// The second half is sent after the first exhausts its retries, which is counted as dropped
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, received, 1)
+	assert.NotEqual(t, failing, received[0])
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.backendStats.SeriesSent))
+	assert.EqualValues(t, 1, drops.Total())
+}
+
 func TestSendMetrics(t *testing.T) {
 	t.Parallel()
 	mux := http.NewServeMux()
@@ -147,7 +383,7 @@ func TestSendMetrics(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	cli, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	cli, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultSeriesCacheSize, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 
 	c := clock.NewMock(time.Unix(100, 0))
@@ -265,7 +501,7 @@ func TestSendHistogram(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultSeriesCacheSize, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 	ctx := clock.Context(context.Background(), clock.NewMock(time.Unix(100, 0)))
 	res := make(chan []error, 1)
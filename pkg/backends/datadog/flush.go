@@ -1,9 +1,10 @@
 package datadog
 
 import (
-	"fmt"
 	"math"
 
+	jsoniter "github.com/json-iterator/go"
+
 	"github.com/hligit/gostatsd"
 )
 
@@ -24,42 +25,53 @@ type flush struct {
 	timestamp        float64
 	flushIntervalSec float64
 	metricsPerBatch  uint
+	cache            *seriesCache
 	cb               func(*timeSeries)
 }
 
 // timeSeries represents a time series data structure.
 type timeSeries struct {
-	Series []metric `json:"series"`
+	Series    []metric
+	timestamp float64
 }
 
-// metric represents a metric data structure for Datadog.
+// metric is a single point of a series, and the JSON of the rest of the series, which is the same every flush.
 type metric struct {
-	Host     string     `json:"host,omitempty"`
-	Interval float64    `json:"interval,omitempty"`
-	Metric   string     `json:"metric"`
-	Points   [1]point   `json:"points"`
-	Tags     []string   `json:"tags,omitempty"`
-	Type     metricType `json:"type,omitempty"`
+	series *encodedSeries
+	value  float64
 }
 
-// point is a Datadog data point.
-type point [2]float64
-
-// addMetricf adds a metric to the series.
-func (f *flush) addMetricf(metricType metricType, value float64, source gostatsd.Source, tags gostatsd.Tags, nameFormat string, a ...interface{}) {
-	f.addMetric(metricType, value, source, tags, fmt.Sprintf(nameFormat, a...))
+// writeJSON writes the time series in the format of the Datadog series API, which is {"series":[...]}.  Only the
+// points are encoded, the rest of each series was encoded when it was first seen.
+func (ts *timeSeries) writeJSON(stream *jsoniter.Stream) {
+	stream.WriteObjectStart()
+	stream.WriteObjectField("series")
+	stream.WriteArrayStart()
+	for idx, m := range ts.Series {
+		if idx > 0 {
+			stream.WriteMore()
+		}
+		_, _ = stream.Write(m.series.json[:m.series.point])
+		stream.WriteFloat64(ts.timestamp)
+		stream.WriteMore()
+		stream.WriteFloat64(m.value)
+		_, _ = stream.Write(m.series.json[m.series.point:])
+	}
+	stream.WriteArrayEnd()
+	stream.WriteObjectEnd()
 }
 
-// addMetric adds a metric to the series.
+// addMetric adds a point of the series identified by key, which has tags, to the time series.
 // If the value is non-numeric (in the case of NaN and Inf values), the value is coerced into a numeric value.
-func (f *flush) addMetric(metricType metricType, value float64, source gostatsd.Source, tags gostatsd.Tags, name string) {
+func (f *flush) addMetric(key seriesKey, tags gostatsd.Tags, value float64) {
+	series := f.cache.get(key, tags)
+	if series == nil {
+		series = encodeSeries(key, tags, f.flushIntervalSec)
+		f.cache.add(key, series)
+	}
 	f.ts.Series = append(f.ts.Series, metric{
-		Host:     string(source),
-		Interval: f.flushIntervalSec,
-		Metric:   name,
-		Points:   [1]point{{f.timestamp, coerceToNumeric(value)}},
-		Tags:     tags,
-		Type:     metricType,
+		series: series,
+		value:  coerceToNumeric(value),
 	})
 }
 
@@ -80,7 +92,8 @@ func (f *flush) maybeFlush() {
 	if uint(len(f.ts.Series))+20 >= f.metricsPerBatch { // flush before it reaches max size and grows the slice
 		f.cb(f.ts)
 		f.ts = &timeSeries{
-			Series: make([]metric, 0, f.metricsPerBatch),
+			Series:    make([]metric, 0, f.metricsPerBatch),
+			timestamp: f.timestamp,
 		}
 	}
 }
@@ -0,0 +1,237 @@
+package datadog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+const (
+	// metadataQueueSize is the number of metadata updates which can wait to be sent.  Updates which do not fit are
+	// dropped, and queued again at the next flush.
+	metadataQueueSize = 1000
+	// metadataSeenSize is the number of metrics remembered before they are all forgotten, so the memory used is bounded
+	// however many metrics are flushed.  The metadata of the metrics which have any is sent again.
+	metadataSeenSize = 100000
+)
+
+// metricMetadata is the metadata of a metric in the Datadog metric metadata API.
+type metricMetadata struct {
+	Type           metricType `json:"type,omitempty"`
+	Description    string     `json:"description,omitempty"`
+	Unit           string     `json:"unit,omitempty"`
+	PerUnit        string     `json:"per_unit,omitempty"`
+	StatsdInterval int        `json:"statsd_interval,omitempty"`
+}
+
+// metadataUpdate is the metadata of a Datadog metric, which is one of those sent for a metric.
+type metadataUpdate struct {
+	metric   string // The name of the metric it was sent for
+	name     string // The name of the Datadog metric
+	metadata metricMetadata
+}
+
+// metadataSender sends the metadata of the metrics which have any to Datadog the first time each is flushed, so their
+// units and descriptions follow the configuration, rather than being edited by hand.
+type metadataSender struct {
+	registry *gostatsd.MetadataRegistry
+
+	lock  sync.Mutex
+	seen  map[string]struct{} // The metrics which have been looked up, and whose metadata is queued or sent
+	queue chan metadataUpdate
+}
+
+func newMetadataSender(registry *gostatsd.MetadataRegistry) *metadataSender {
+	return &metadataSender{
+		registry: registry,
+		seen:     map[string]struct{}{},
+		queue:    make(chan metadataUpdate, metadataQueueSize),
+	}
+}
+
+// SetMetadata sets the metadata sent for the metrics flushed.  It requires the application_key, as the metadata is
+// changed through the API, rather than sent with the series.
+func (d *Client) SetMetadata(registry *gostatsd.MetadataRegistry) {
+	if d.applicationKey == "" {
+		d.logger.Warn("metric metadata is not sent, as it requires an application_key")
+		return
+	}
+	d.metadata = newMetadataSender(registry)
+}
+
+// queueMetadata queues the metadata of every metric which has not been flushed before.
+func (d *Client) queueMetadata(metrics *gostatsd.MetricMap) {
+	ms := d.metadata
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	lookup := func(name string) (gostatsd.MetricMetadata, bool) {
+		if _, ok := ms.seen[name]; ok {
+			return gostatsd.MetricMetadata{}, false
+		}
+		if len(ms.seen) >= metadataSeenSize {
+			ms.seen = map[string]struct{}{}
+		}
+		ms.seen[name] = struct{}{}
+		return ms.registry.Lookup(name)
+	}
+	interval := int(d.flushInterval.Seconds())
+
+	for name := range metrics.Counters {
+		if md, ok := lookup(name); ok {
+			ms.enqueue(name, "", metricMetadata{Type: rate, Description: md.Description, Unit: md.Unit, PerUnit: "second", StatsdInterval: interval})
+			ms.enqueue(name, "count", metricMetadata{Type: gauge, Description: md.Description, Unit: md.Unit})
+		}
+	}
+	for name, timers := range metrics.Timers {
+		md, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		for _, timer := range timers {
+			if timer.Histogram != nil {
+				ms.enqueue(name, "histogram", metricMetadata{Type: counter, Description: md.Description})
+				break
+			}
+			// Only the sub-metrics which are durations have the unit of the timer
+			withUnit := metricMetadata{Type: gauge, Description: md.Description, Unit: md.Unit}
+			withoutUnit := metricMetadata{Type: gauge, Description: md.Description}
+			for _, sub := range []struct {
+				suffix   string
+				disabled bool
+				metadata metricMetadata
+			}{
+				{"lower", d.disabledSubtypes.Lower, withUnit},
+				{"upper", d.disabledSubtypes.Upper, withUnit},
+				{"count", d.disabledSubtypes.Count, withoutUnit},
+				{"count_ps", d.disabledSubtypes.CountPerSecond, metricMetadata{Type: rate, Description: md.Description, PerUnit: "second", StatsdInterval: interval}},
+				{"mean", d.disabledSubtypes.Mean, withUnit},
+				{"median", d.disabledSubtypes.Median, withUnit},
+				{"std", d.disabledSubtypes.StdDev, withUnit},
+				{"sum", d.disabledSubtypes.Sum, withUnit},
+				{"sum_squares", d.disabledSubtypes.SumSquares, withoutUnit},
+			} {
+				if !sub.disabled {
+					ms.enqueue(name, sub.suffix, sub.metadata)
+				}
+			}
+			for _, pct := range timer.Percentiles {
+				if strings.HasPrefix(pct.Str, "count_") || strings.HasPrefix(pct.Str, "sum_squares_") {
+					ms.enqueue(name, pct.Str, withoutUnit)
+				} else {
+					ms.enqueue(name, pct.Str, withUnit)
+				}
+			}
+			break // Every series of a timer has the same sub-metrics
+		}
+	}
+	for name := range metrics.Gauges {
+		if md, ok := lookup(name); ok {
+			ms.enqueue(name, "", metricMetadata{Type: gauge, Description: md.Description, Unit: md.Unit})
+		}
+	}
+	for name := range metrics.Sets {
+		if md, ok := lookup(name); ok {
+			ms.enqueue(name, "", metricMetadata{Type: gauge, Description: md.Description, Unit: md.Unit})
+		}
+	}
+}
+
+// enqueue queues the metadata of the Datadog metric with the suffix sent for a metric.  If the queue is full, the
+// metric is looked up again at the next flush.  It must be called with the lock held.
+func (ms *metadataSender) enqueue(metric, suffix string, metadata metricMetadata) {
+	name := metric
+	if suffix != "" {
+		name += "." + suffix
+	}
+	select {
+	case ms.queue <- metadataUpdate{metric: metric, name: name, metadata: metadata}:
+	default:
+		delete(ms.seen, metric)
+	}
+}
+
+// forget makes a metric be looked up again at the next flush, so metadata which failed to be sent is sent again.
+func (ms *metadataSender) forget(metric string) {
+	ms.lock.Lock()
+	delete(ms.seen, metric)
+	ms.lock.Unlock()
+}
+
+// runMetadata sends the metadata queued, one update at a time, until the context is done.  Metadata which is rejected
+// is not sent again, as it would be rejected again, and other failures are sent again at the next flush.
+func (d *Client) runMetadata(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update := <-d.metadata.queue:
+			err := d.putMetadata(ctx, update)
+			if err == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger := d.logger.WithFields(logrus.Fields{
+				"metric": update.name,
+				"error":  err,
+			})
+			if _, ok := err.(*rejectedError); ok {
+				logger.Warn("metric metadata rejected, not sent again")
+				continue
+			}
+			logger.Warn("failed to send metric metadata")
+			d.metadata.forget(update.metric)
+		}
+	}
+}
+
+// putMetadata makes a single attempt to replace the metadata of a Datadog metric.
+func (d *Client) putMetadata(ctx context.Context, update metadataUpdate) error {
+	ctx, cancel := transport.AttemptContext(ctx, d.requestTimeout)
+	defer cancel()
+	body, err := jsonConfig.Marshal(&update.metadata)
+	if err != nil {
+		return fmt.Errorf("[%s] unable to marshal metadata: %v", BackendName, err)
+	}
+	req, err := http.NewRequest("PUT", d.apiEndpoint+"/api/v1/metrics/"+url.PathEscape(update.name), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", d.userAgent)
+	req.Header.Set("DD-API-KEY", d.apiKey)
+	req.Header.Set("DD-APPLICATION-KEY", d.applicationKey)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error PUTting: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		switch resp.StatusCode {
+		case http.StatusNotFound, http.StatusRequestTimeout, http.StatusTooManyRequests:
+			// Not found until the metric is created from its series, or throttled, so it is sent again
+		default:
+			if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode < http.StatusInternalServerError {
+				return newRejectedError(resp.StatusCode, b)
+			}
+		}
+		return fmt.Errorf("received bad status code %d: %s", resp.StatusCode, b)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
@@ -0,0 +1,166 @@
+package datadog
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+func TestSendMetadata(t *testing.T) {
+	t.Parallel()
+	var lock sync.Mutex
+	received := map[string]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/v1/metrics/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "apiKey123", r.Header.Get("DD-API-KEY"))
+		assert.Equal(t, "appKey456", r.Header.Get("DD-APPLICATION-KEY"))
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		lock.Lock()
+		defer lock.Unlock()
+		received[r.URL.Path[len("/api/v1/metrics/"):]] = string(data)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	v.Set(gostatsd.ParamMetricMetadata, []string{"latency", "requests"})
+	v.Set("metadata.latency.match-metrics", []string{"t1"})
+	v.Set("metadata.latency.unit", "millisecond")
+	v.Set("metadata.requests.match-metrics", []string{"c1"})
+	v.Set("metadata.requests.unit", "request")
+	v.Set("metadata.requests.description", "Requests served")
+	registry, err := gostatsd.NewMetadataRegistryFromViper(v)
+	require.NoError(t, err)
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultSeriesCacheSize, defaultMaxRequests, true, 2*time.Second, 10*time.Second, gostatsd.TimerSubtypes{Median: true}, logrus.New(), p)
+	require.NoError(t, err)
+	client.applicationKey = "appKey456"
+	client.SetMetadata(registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(ctx, metricsOneOfEach(), func(errs []error) {
+		res <- errs
+	})
+	<-res
+
+	expected := map[string]string{
+		"c1":             `{"type":"rate","description":"Requests served","unit":"request","per_unit":"second","statsd_interval":10}`,
+		"c1.count":       `{"type":"gauge","description":"Requests served","unit":"request"}`,
+		"t1.lower":       `{"type":"gauge","unit":"millisecond"}`,
+		"t1.upper":       `{"type":"gauge","unit":"millisecond"}`,
+		"t1.count":       `{"type":"gauge"}`,
+		"t1.count_ps":    `{"type":"rate","per_unit":"second","statsd_interval":10}`,
+		"t1.mean":        `{"type":"gauge","unit":"millisecond"}`,
+		"t1.std":         `{"type":"gauge","unit":"millisecond"}`,
+		"t1.sum":         `{"type":"gauge","unit":"millisecond"}`,
+		"t1.sum_squares": `{"type":"gauge"}`,
+		"t1.count_90":    `{"type":"gauge"}`,
+	}
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == len(expected)
+	}, 5*time.Second, 10*time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, expected, received)
+	lock.Unlock()
+
+	// The metadata of each metric is only sent once
+	client.SendMetricsAsync(ctx, metricsOneOfEach(), func(errs []error) {
+		res <- errs
+	})
+	<-res
+	assert.Empty(t, client.metadata.queue)
+}
+
+func TestMetadataRejectedIsNotSentAgain(t *testing.T) {
+	t.Parallel()
+	var lock sync.Mutex
+	requests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/v1/metrics/", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/api/v1/metrics/t1") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	v.Set(gostatsd.ParamMetricMetadata, []string{"latency", "requests"})
+	v.Set("metadata.latency.match-metrics", []string{"t1"})
+	v.Set("metadata.latency.unit", "millisecond")
+	v.Set("metadata.requests.match-metrics", []string{"c1"})
+	v.Set("metadata.requests.unit", "request")
+	registry, err := gostatsd.NewMetadataRegistryFromViper(v)
+	require.NoError(t, err)
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultSeriesCacheSize, defaultMaxRequests, true, 2*time.Second, 10*time.Second, gostatsd.TimerSubtypes{Median: true}, logrus.New(), p)
+	require.NoError(t, err)
+	client.applicationKey = "appKey456"
+	client.SetMetadata(registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(ctx, metricsOneOfEach(), func(errs []error) {
+		res <- errs
+	})
+	<-res
+
+	// The metadata of t1 is rejected, and only the metadata of c1, which failed, is looked up again
+	ms := client.metadata
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		sent := requests
+		lock.Unlock()
+		ms.lock.Lock()
+		defer ms.lock.Unlock()
+		_, seen := ms.seen["c1"]
+		return sent == 11 && !seen
+	}, 5*time.Second, 10*time.Millisecond)
+	ms.lock.Lock()
+	assert.Contains(t, ms.seen, "t1")
+	ms.lock.Unlock()
+
+	// Once too many metrics have been seen, they are all forgotten
+	ms.lock.Lock()
+	for i := len(ms.seen); i < metadataSeenSize; i++ {
+		ms.seen[fmt.Sprintf("m%d", i)] = struct{}{}
+	}
+	ms.lock.Unlock()
+	client.queueMetadata(metricsOneOfEach())
+	ms.lock.Lock()
+	assert.Less(t, len(ms.seen), 10)
+	assert.Contains(t, ms.seen, "t1")
+	ms.lock.Unlock()
+}
@@ -0,0 +1,157 @@
+package datadog
+
+import (
+	"sync"
+
+	"github.com/hligit/gostatsd"
+)
+
+// seriesKey identifies a series sent to Datadog.  The name, host, tags, and type of a series are the same every flush,
+// so they are only encoded when it is first seen.
+type seriesKey struct {
+	name       string // The name of the metric
+	suffix     string // The sub-metric appended to the name, such as lower for timers, or "" if there is none
+	source     gostatsd.Source
+	tagsKey    string
+	bucket     string // The tag of the histogram bucket appended to the tags, or "" if there is none
+	metricType metricType
+}
+
+// encodedSeries is the JSON of a series, except its point, which is written at point.
+type encodedSeries struct {
+	json  []byte
+	point int
+	tags  gostatsd.Tags // The tags the series was encoded with, which must match to use it
+}
+
+// encodeSeries encodes a series, in the same format as it would be marshalled by jsonConfig.
+func encodeSeries(key seriesKey, tags gostatsd.Tags, interval float64) *encodedSeries {
+	stream := jsonConfig.BorrowStream(nil)
+	defer jsonConfig.ReturnStream(stream)
+
+	stream.WriteObjectStart()
+	if key.source != "" {
+		stream.WriteObjectField("host")
+		stream.WriteString(string(key.source))
+		stream.WriteMore()
+	}
+	if interval != 0 {
+		stream.WriteObjectField("interval")
+		stream.WriteFloat64(interval)
+		stream.WriteMore()
+	}
+	stream.WriteObjectField("metric")
+	if key.suffix == "" {
+		stream.WriteString(key.name)
+	} else {
+		stream.WriteString(key.name + "." + key.suffix)
+	}
+	stream.WriteMore()
+	stream.WriteObjectField("points")
+	stream.WriteRaw("[[")
+	point := stream.Buffered()
+	stream.WriteRaw("]]")
+	allTags := tags
+	if key.bucket != "" {
+		allTags = tags.Concat(gostatsd.Tags{key.bucket})
+	}
+	if len(allTags) > 0 {
+		stream.WriteMore()
+		stream.WriteObjectField("tags")
+		stream.WriteArrayStart()
+		for idx, tag := range allTags {
+			if idx > 0 {
+				stream.WriteMore()
+			}
+			stream.WriteString(tag)
+		}
+		stream.WriteArrayEnd()
+	}
+	if key.metricType != "" {
+		stream.WriteMore()
+		stream.WriteObjectField("type")
+		stream.WriteString(string(key.metricType))
+	}
+	stream.WriteObjectEnd()
+
+	return &encodedSeries{
+		json:  append([]byte(nil), stream.Buffer()...),
+		point: point,
+		tags:  tags,
+	}
+}
+
+// seriesCache keeps the encoded series which have been sent recently.  Like intern.Interner, it is bounded by keeping
+// series in generations of up to capacity series, and when the current generation is full it replaces the previous
+// one, so only the series which have not been sent for a generation are dropped.
+//
+// A nil seriesCache does not keep anything.
+type seriesCache struct {
+	capacity int
+
+	lock     sync.Mutex
+	current  map[seriesKey]*encodedSeries
+	previous map[seriesKey]*encodedSeries
+}
+
+// newSeriesCache creates a new seriesCache which keeps up to capacity series per generation, or nil if capacity is 0.
+func newSeriesCache(capacity int) *seriesCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &seriesCache{
+		capacity: capacity,
+		current:  make(map[seriesKey]*encodedSeries),
+	}
+}
+
+// get returns the encoded series for key, or nil if it has not been sent recently, or it was encoded with other tags.
+// The tags are compared as the tags key of a series may not have been formatted from its tags.
+func (sc *seriesCache) get(key seriesKey, tags gostatsd.Tags) *encodedSeries {
+	if sc == nil {
+		return nil
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	series, ok := sc.current[key]
+	if !ok {
+		if series, ok = sc.previous[key]; !ok {
+			return nil
+		}
+		sc.addLocked(key, series)
+	}
+	if !equalTags(series.tags, tags) {
+		return nil
+	}
+	return series
+}
+
+// add keeps the encoded series for key.
+func (sc *seriesCache) add(key seriesKey, series *encodedSeries) {
+	if sc == nil {
+		return
+	}
+	sc.lock.Lock()
+	sc.addLocked(key, series)
+	sc.lock.Unlock()
+}
+
+func (sc *seriesCache) addLocked(key seriesKey, series *encodedSeries) {
+	if len(sc.current) >= sc.capacity {
+		sc.previous = sc.current
+		sc.current = make(map[seriesKey]*encodedSeries, sc.capacity)
+	}
+	sc.current[key] = series
+}
+
+func equalTags(a, b gostatsd.Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package datadog
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestEncodeSeries(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		key      seriesKey
+		tags     gostatsd.Tags
+		interval float64
+		expected string
+	}{
+		{
+			name:     "all fields",
+			key:      seriesKey{name: "t1", suffix: "count_ps", source: "h1", tagsKey: "a", metricType: rate},
+			tags:     gostatsd.Tags{"a"},
+			interval: 10,
+			expected: `{"host":"h1","interval":10,"metric":"t1.count_ps","points":[[100,1.5]],"tags":["a"],"type":"rate"}`,
+		},
+		{
+			name:     "empty fields are omitted",
+			key:      seriesKey{name: "g1"},
+			expected: `{"metric":"g1","points":[[100,1.5]]}`,
+		},
+		{
+			name:     "bucket",
+			key:      seriesKey{name: "t1", suffix: "histogram", bucket: "le:20", metricType: counter},
+			expected: `{"metric":"t1.histogram","points":[[100,1.5]],"tags":["le:20"],"type":"count"}`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ts := &timeSeries{
+				Series:    []metric{{series: encodeSeries(tt.key, tt.tags, tt.interval), value: 1.5}},
+				timestamp: 100,
+			}
+			stream := jsonConfig.BorrowStream(nil)
+			defer jsonConfig.ReturnStream(stream)
+			ts.writeJSON(stream)
+			assert.Equal(t, `{"series":[`+tt.expected+`]}`, string(stream.Buffer()))
+			assert.True(t, jsoniter.Valid(stream.Buffer()))
+		})
+	}
+}
+
+func TestSeriesCache(t *testing.T) {
+	t.Parallel()
+	sc := newSeriesCache(2)
+	key := func(name string) seriesKey {
+		return seriesKey{name: name, tagsKey: "a"}
+	}
+	tags := gostatsd.Tags{"a"}
+	add := func(name string) *encodedSeries {
+		series := encodeSeries(key(name), tags, 0)
+		sc.add(key(name), series)
+		return series
+	}
+
+	s1 := add("s1")
+	require.Same(t, s1, sc.get(key("s1"), tags))
+	require.Nil(t, sc.get(key("s1"), gostatsd.Tags{"b"}), "tags must match")
+	require.Nil(t, sc.get(key("s2"), tags))
+
+	// s1 and s2 move to the previous generation, and s1 moves back when it is used
+	s2 := add("s2")
+	add("s3")
+	require.Same(t, s1, sc.get(key("s1"), tags))
+	require.Len(t, sc.current, 2)
+
+	// s2 was not used for a generation
+	add("s4")
+	require.Nil(t, sc.get(key("s2"), tags))
+	require.True(t, s2 != add("s2"), "s2 is encoded again")
+}
+
+func TestNilSeriesCache(t *testing.T) {
+	t.Parallel()
+	sc := newSeriesCache(0)
+	require.Nil(t, sc)
+	key := seriesKey{name: "s1"}
+	sc.add(key, encodeSeries(key, nil, 0))
+	require.Nil(t, sc.get(key, nil))
+}
+
+func TestProcessMetricsUsesSeriesCache(t *testing.T) {
+	t.Parallel()
+	client := &Client{
+		metricsPerBatch: 1000,
+		seriesCache:     newSeriesCache(100),
+	}
+	marshal := func(now float64) string {
+		var out string
+		client.processMetrics(now, metricsOneOfEach(), func(ts *timeSeries) {
+			stream := jsonConfig.BorrowStream(nil)
+			defer jsonConfig.ReturnStream(stream)
+			ts.writeJSON(stream)
+			out += string(stream.Buffer())
+		})
+		return out
+	}
+
+	first := marshal(100)
+	cached := len(client.seriesCache.current)
+	require.Equal(t, 14, cached)
+	second := marshal(200)
+	assert.Len(t, client.seriesCache.current, cached)
+	assert.Contains(t, second, `"metric":"c1","points":[[200,1.1]]`)
+	assert.Equal(t, first, strings.ReplaceAll(second, "[[200,", "[[100,"))
+}
+
+func BenchmarkMarshalSeries(b *testing.B) {
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 1000; i++ {
+		tags := gostatsd.Tags{"env:prod", "service:api", "instance:" + strconv.Itoa(i)}
+		mm.Receive(&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Tags: tags, Source: "host", Type: gostatsd.COUNTER})
+		mm.Receive(&gostatsd.Metric{Name: "gauge", Value: 1, Rate: 1, Tags: tags, Source: "host", Type: gostatsd.GAUGE})
+	}
+	for _, size := range []int{0, defaultSeriesCacheSize} {
+		client := &Client{
+			metricsPerBatch: defaultMetricsPerBatch,
+			seriesCache:     newSeriesCache(size),
+			flushInterval:   10 * time.Second,
+		}
+		b.Run("cache="+strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			stream := jsonConfig.BorrowStream(nil)
+			defer jsonConfig.ReturnStream(stream)
+			for i := 0; i < b.N; i++ {
+				client.processMetrics(float64(i), mm, func(ts *timeSeries) {
+					stream.Reset(nil)
+					ts.writeJSON(stream)
+				})
+			}
+		})
+	}
+}
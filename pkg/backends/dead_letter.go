@@ -0,0 +1,53 @@
+package backends
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/deadletter"
+)
+
+// deadLetterFromViper returns the archive for data which backends finally drop, or nil if dead-letter-path is not set.
+func deadLetterFromViper(v *viper.Viper) (*deadletter.Archive, error) {
+	path := v.GetString(gostatsd.ParamDeadLetterPath)
+	if path == "" {
+		return nil, nil
+	}
+	return deadletter.New(path, int64(v.GetSizeInBytes(gostatsd.ParamDeadLetterMaxBytes)))
+}
+
+// archiveMetrics writes a flush of metrics which the backend dropped to the dead letter archive, if there is one.
+func (rb *ReloadableBackend) archiveMetrics(now time.Time, mm *gostatsd.MetricMap, errs []error) {
+	if rb.deadLetter == nil {
+		return
+	}
+	if err := rb.deadLetter.WriteMetrics(now, rb.name, joinErrors(errs), mm); err != nil {
+		rb.logger.WithError(err).WithField("datapoints", mm.Len()).Warn("failed to archive dropped metrics")
+	}
+}
+
+// archiveEvent writes an event which the backend dropped to the dead letter archive, if there is one.
+func (rb *ReloadableBackend) archiveEvent(now time.Time, e *gostatsd.Event, sendErr error) {
+	if rb.deadLetter == nil {
+		return
+	}
+	if err := rb.deadLetter.WriteEvent(now, rb.name, sendErr.Error(), e); err != nil {
+		rb.logger.WithError(err).WithFields(logrus.Fields{
+			"title": e.Title,
+		}).Warn("failed to archive dropped event")
+	}
+}
+
+func joinErrors(errs []error) string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	return strings.Join(messages, "; ")
+}
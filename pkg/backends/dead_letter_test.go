@@ -0,0 +1,57 @@
+package backends
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/deadletter"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+func TestReloadableBackendDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend := &failingBackend{}
+	backends["failing"] = func(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
+		return backend, nil
+	}
+	defer delete(backends, "failing")
+
+	logger := logrus.StandardLogger()
+	v := viper.New()
+	v.Set(gostatsd.ParamDeadLetterPath, dir)
+	rb, err := NewReloadableBackend("failing", v, logger, transport.NewTransportPool(logger, v))
+	require.NoError(t, err)
+
+	clck := clock.NewMock(time.Unix(1000, 0))
+	ctx := clock.Context(context.Background(), clck)
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "counter", Value: 1, Type: gostatsd.COUNTER})
+	rb.SendMetricsAsync(ctx, mm, func(errs []error) {})
+	clck.Add(time.Second)
+	require.Error(t, rb.SendEvent(ctx, &gostatsd.Event{Title: "title"}))
+
+	paths, err := deadletter.List(dir)
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+	record, err := deadletter.Read(paths[0])
+	require.NoError(t, err)
+	assert.Equal(t, "failing", record.Backend)
+	assert.Equal(t, "failed", record.Reason)
+	assert.Equal(t, mm, record.Metrics)
+	record, err = deadletter.Read(paths[1])
+	require.NoError(t, err)
+	assert.Equal(t, "title", record.Event.Title)
+}
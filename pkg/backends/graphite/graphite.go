@@ -235,7 +235,7 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	g.SetDefault("prefix_set", DefaultPrefixSet)
 	g.SetDefault("global_suffix", DefaultGlobalSuffix)
 	g.SetDefault("mode", DefaultMode)
-	return NewClient(
+	client, err := NewClient(
 		g.GetString("address"),
 		g.GetDuration("dial_timeout"),
 		g.GetDuration("write_timeout"),
@@ -246,9 +246,16 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		g.GetString("prefix_set"),
 		g.GetString("global_suffix"),
 		g.GetString("mode"),
-		gostatsd.DisabledSubMetrics(v),
+		gostatsd.BackendDisabledSubMetrics(v, BackendName),
 		logger,
 	)
+	if err != nil {
+		return nil, err
+	}
+	if v.GetBool(gostatsd.ParamDryRun) {
+		client.sender.ConnFactory = sender.DiscardConnFactory(logger)
+	}
+	return client, nil
 }
 
 // NewClient constructs a Graphite backend object.
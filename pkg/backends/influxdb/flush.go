@@ -11,19 +11,20 @@ import (
 	"sync/atomic"
 
 	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
 )
 
 // flush represents a send operation.
 type flush struct {
 	buffer           *bytes.Buffer
-	writer           io.WriteCloser
+	writer           *util.CountingWriteCloser
 	metricCount      uint64
 	metricsPerBatch  uint64
 	timestampSeconds int64
 	flushIntervalSec float64
 	disabledSubtypes gostatsd.TimerSubtypes
 	errorCounter     *uint64
-	cb               func(buf *bytes.Buffer, seriesCount uint64)
+	cb               func(buf *bytes.Buffer, rawBytes int, seriesCount uint64)
 	getBuffer        func() (*bytes.Buffer, io.WriteCloser)
 	releaseBuffer    func(buf *bytes.Buffer)
 }
@@ -246,11 +247,18 @@ func (f *flush) flush() {
 	// can theoretically produce, so we won't ignore the error.
 	err := f.writer.Close()
 	if err == nil {
-		f.cb(f.buffer, f.metricCount)
+		f.cb(f.buffer, f.writer.N, f.metricCount)
 	} else {
 		atomic.AddUint64(f.errorCounter, 1)
 		f.releaseBuffer(f.buffer)
 	}
 	f.metricCount = 0
-	f.buffer, f.writer = f.getBuffer()
+	f.nextBuffer()
+}
+
+// nextBuffer gets the buffer for the next batch, and counts what is written to it before it's compressed.
+func (f *flush) nextBuffer() {
+	var w io.WriteCloser
+	f.buffer, w = f.getBuffer()
+	f.writer = &util.CountingWriteCloser{WriteCloser: w}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -23,7 +24,9 @@ import (
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/compression"
 	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/tracing"
 	"github.com/hligit/gostatsd/pkg/transport"
 )
 
@@ -43,6 +46,7 @@ const (
 	paramCredentials           = "credentials"
 	paramMaxRequestElapsedTime = "max-request-elapsed-time"
 	paramMaxRequests           = "max-requests"
+	paramRequestTimeout        = "request-timeout"
 	paramMetricsPerBatch       = "metrics-per-batch"
 	paramTransport             = "transport"
 
@@ -58,17 +62,13 @@ var (
 	errMaxRequestsIsNotPositive     = errors.New("[" + BackendName + "] " + paramMaxRequests + " must be above zero")
 	errMaxRequestElapsedTimeInvalid = errors.New("[" + BackendName + "] " + paramMaxRequestElapsedTime + " must be positive or -1")
 	errMetricsPerBatchIsNotPositive = errors.New("[" + BackendName + "] " + paramMetricsPerBatch + " must be positive")
+	errRequestTimeoutNegative       = errors.New("[" + BackendName + "] " + paramRequestTimeout + " must not be negative")
 	errPostEventFailed              = errors.New("[" + BackendName + "] failed to post event")
 )
 
 // Client represents an InfluxDB client.
 type Client struct {
-	batchesCreated      uint64            // Accumulated number of batches created
-	batchesDropped      uint64            // Accumulated number of batches aborted (data loss)
-	batchesCreateFailed uint64            // Accumulated number of batches which failed to serialize (data loss, no retry is possible)
-	batchesSent         uint64            // Accumulated number of batches successfully sent
-	seriesSent          uint64            // Accumulated number of series successfully sent
-	batchesRetried      stats.ChangeGauge // Accumulated number of batches retried (first send is not a retry)
+	backendStats *stats.BackendStats
 
 	logger logrus.FieldLogger
 
@@ -76,15 +76,23 @@ type Client struct {
 	url         string
 
 	maxRequestElapsedTime time.Duration
+	requestTimeout        time.Duration // The time allowed for each attempt, or 0 for the client-timeout of the transport
 	client                *http.Client
 	metricsPerBatch       uint64
 	reqBufferSem          chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
-	compressPayload       bool
+	compressor            compression.Codec
+	spool                 gostatsd.Spool // nil if payloads are not spooled
 
 	disabledSubtypes gostatsd.TimerSubtypes
 	flushInterval    time.Duration
 }
 
+// spooledPost describes a payload which was spooled.  It is stored as a line of json, followed by the body.
+type spooledPost struct {
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+}
+
 // NewClientFromViper returns a new InfluxDB API client.
 func NewClientFromViper(
 	v *viper.Viper,
@@ -98,6 +106,7 @@ func NewClientFromViper(
 	influxViper.SetDefault(paramMaxRequestElapsedTime, defaultMaxRequestElapsedTime)
 	influxViper.SetDefault(paramMaxRequests, defaultMaxRequests)
 	influxViper.SetDefault(paramMetricsPerBatch, defaultMetricsPerBatch)
+	influxViper.SetDefault(paramRequestTimeout, 0)
 	influxViper.SetDefault(paramTransport, "default")
 
 	cfg, err := newConfigFromViper(influxViper, logger)
@@ -105,7 +114,11 @@ func NewClientFromViper(
 		return nil, err
 	}
 
-	return NewClient(
+	requestTimeout := influxViper.GetDuration(paramRequestTimeout)
+	if requestTimeout < 0 {
+		return nil, errRequestTimeoutNegative
+	}
+	client, err := NewClient(
 		influxViper.GetString(paramApiEndpoint),
 		influxViper.GetBool(paramCompressPayload),
 		influxViper.GetString(paramCredentials),
@@ -114,10 +127,15 @@ func NewClientFromViper(
 		influxViper.GetUint64(paramMetricsPerBatch),
 		influxViper.GetString(paramTransport),
 		cfg,
-		gostatsd.DisabledSubMetrics(v),
+		gostatsd.BackendDisabledSubMetrics(v, BackendName),
 		logger,
 		pool,
 	)
+	if err != nil {
+		return nil, err
+	}
+	client.requestTimeout = requestTimeout
+	return client, nil
 }
 
 // NewClient returns a new InfluxDB API client.
@@ -159,6 +177,15 @@ func NewClient(
 		return nil, err
 	}
 
+	encoding := compression.Identity
+	if compressPayload {
+		encoding = compression.Gzip
+	}
+	compressor, err := compression.New(encoding, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
 	reqBufferSem := make(chan *bytes.Buffer, maxRequests)
 	for i := uint(0); i < maxRequests; i++ {
 		reqBufferSem <- &bytes.Buffer{}
@@ -188,9 +215,10 @@ func NewClient(
 	logger.WithFields(creationFields).Info("created backend")
 
 	return &Client{
+		backendStats:          stats.NewBackendStats(BackendName),
 		logger:                logger,
 		url:                   parsedEndpoint.String(),
-		compressPayload:       compressPayload,
+		compressor:            compressor,
 		credentials:           credentials,
 		maxRequestElapsedTime: maxRequestElapsedTime,
 		metricsPerBatch:       metricsPerBatch,
@@ -205,13 +233,7 @@ func (idb *Client) getBuffer(ctx context.Context) (*bytes.Buffer, io.WriteCloser
 	case <-ctx.Done():
 		return nil, nil
 	case buf := <-idb.reqBufferSem:
-		if !idb.compressPayload {
-			return buf, util.NopWriteCloser(buf)
-		}
-		// No error check, per the documentation: "The error returned will be nil if the level is valid."
-		// We may need to re-assess this if we make the level user configurable.
-		g, _ := gzip.NewWriterLevel(buf, gzip.BestCompression)
-		return buf, g
+		return buf, idb.compressor.NewWriter(buf)
 	}
 }
 
@@ -226,10 +248,10 @@ func (idb *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Metri
 	results := make(chan error)
 
 	now := clock.FromContext(ctx).Now().Unix()
-	idb.processMetrics(ctx, now, metrics, func(buf *bytes.Buffer, seriesCount uint64) {
-		atomic.AddUint64(&idb.batchesCreated, 1)
+	idb.processMetrics(ctx, now, metrics, func(buf *bytes.Buffer, rawBytes int, seriesCount uint64) {
+		atomic.AddUint64(&idb.backendStats.BatchesCreated, 1)
 		go func() {
-			err := idb.postData(ctx, buf, seriesCount)
+			err := idb.postData(ctx, "metrics", buf, rawBytes, seriesCount)
 			idb.releaseBuffer(buf)
 			select {
 			case <-ctx.Done():
@@ -255,33 +277,16 @@ func (idb *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Metri
 }
 
 func (idb *Client) Run(ctx context.Context) {
-	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:influxdb"})
-
-	flushed, unregister := statser.RegisterFlush()
-	defer unregister()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-flushed:
-			statser.Gauge("backend.created", float64(atomic.LoadUint64(&idb.batchesCreated)), nil)
-			statser.Gauge("backend.create.failed", float64(atomic.LoadUint64(&idb.batchesCreateFailed)), nil)
-			idb.batchesRetried.SendIfChanged(statser, "backend.retried", nil)
-			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&idb.batchesDropped)), nil)
-			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&idb.batchesSent)), nil)
-			statser.Gauge("backend.series.sent", float64(atomic.LoadUint64(&idb.seriesSent)), nil)
-		}
-	}
+	idb.backendStats.RunMetrics(ctx, stats.FromContext(ctx))
 }
 
-func (idb *Client) processMetrics(ctx context.Context, nowSeconds int64, metrics *gostatsd.MetricMap, cb func(buf *bytes.Buffer, seriesCount uint64)) {
+func (idb *Client) processMetrics(ctx context.Context, nowSeconds int64, metrics *gostatsd.MetricMap, cb func(buf *bytes.Buffer, rawBytes int, seriesCount uint64)) {
 	fl := flush{
 		timestampSeconds: nowSeconds,
 		flushIntervalSec: idb.flushInterval.Seconds(),
 		metricsPerBatch:  idb.metricsPerBatch,
 		disabledSubtypes: idb.disabledSubtypes,
-		errorCounter:     &idb.batchesCreateFailed,
+		errorCounter:     &idb.backendStats.BatchesCreateFailed,
 		cb:               cb,
 		getBuffer: func() (*bytes.Buffer, io.WriteCloser) {
 			return idb.getBuffer(ctx)
@@ -289,7 +294,7 @@ func (idb *Client) processMetrics(ctx context.Context, nowSeconds int64, metrics
 		releaseBuffer: idb.releaseBuffer,
 	}
 
-	fl.buffer, fl.writer = fl.getBuffer()
+	fl.nextBuffer()
 
 	metrics.Counters.Each(func(metricName, tagsKey string, counter gostatsd.Counter) {
 		if fl.buffer == nil {
@@ -331,11 +336,11 @@ func (idb *Client) processMetrics(ctx context.Context, nowSeconds int64, metrics
 	fl.finish()
 }
 
-func (idb *Client) postData(ctx context.Context, buffer *bytes.Buffer, seriesCount uint64) error {
-	if err := idb.post(ctx, buffer); err != nil {
+func (idb *Client) postData(ctx context.Context, typeOfPost string, buffer *bytes.Buffer, rawBytes int, seriesCount uint64) error {
+	if err := idb.post(ctx, typeOfPost, buffer, rawBytes, seriesCount); err != nil {
 		return err
 	}
-	atomic.AddUint64(&idb.seriesSent, seriesCount)
+	atomic.AddUint64(&idb.backendStats.SeriesSent, seriesCount)
 	return nil
 }
 
@@ -393,14 +398,15 @@ func (idb *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 	}
 	defer idb.releaseBuffer(buf)
 
-	writeEvent(writer, e)
+	cw := &util.CountingWriteCloser{WriteCloser: writer}
+	writeEvent(cw, e)
 
-	err := writer.Close()
+	err := cw.Close()
 	if err != nil {
 		return fmt.Errorf("[%s] failed to flush event buffer: %v", BackendName, err)
 	}
 
-	err = idb.postData(ctx, buf, 0)
+	err = idb.postData(ctx, "events", buf, cw.N, 0)
 	if err != nil {
 		return errPostEventFailed
 	}
@@ -421,24 +427,49 @@ func (idb *Client) newBackoff(clck clock.Clock) backoff.BackOff {
 	return b
 }
 
-func (idb *Client) post(ctx context.Context, buffer *bytes.Buffer) error {
-	post, err := idb.constructPost(ctx, buffer)
+func (idb *Client) post(ctx context.Context, typeOfPost string, buffer *bytes.Buffer, rawBytes int, seriesCount uint64) (err error) {
+	ctx, span := tracing.Start(ctx, "backend.post", tracing.BackendKey.String(BackendName), tracing.TypeKey.String(typeOfPost), tracing.PayloadBytesKey.Int(buffer.Len()))
+	attempts := 0
+	defer func() {
+		span.SetAttributes(tracing.AttemptsKey.Int(attempts))
+		tracing.End(span, err)
+	}()
+
+	post, err := idb.constructPost(ctx, typeOfPost, buffer)
 	if err != nil {
-		atomic.AddUint64(&idb.batchesDropped, 1)
+		idb.backendStats.Dropped(ctx, typeOfPost, stats.DropReasonSerialize, seriesCount)
 		return err
 	}
+	idb.backendStats.Payload(ctx, typeOfPost, rawBytes, buffer.Len())
 
 	clck := clock.FromContext(ctx)
 	bo := idb.newBackoff(clck)
+	budget := stats.RetryBudgetFromContext(ctx)
+	budget.Sent(clck.Now())
 	for {
-		if err = post(); err == nil {
-			atomic.AddUint64(&idb.batchesSent, 1)
+		attempts++
+		postTimer := idb.backendStats.NewPostTimer(ctx, typeOfPost)
+		err = post()
+		postTimer.Send()
+		if err == nil {
+			atomic.AddUint64(&idb.backendStats.BatchesSent, 1)
 			return nil
 		}
 
 		next := bo.NextBackOff()
+		reason := stats.DropReasonRetriesExhausted
+		if next != backoff.Stop && !budget.Retry(clck.Now()) {
+			next, reason = backoff.Stop, stats.DropReasonRetryBudget
+		}
 		if next == backoff.Stop {
-			atomic.AddUint64(&idb.batchesDropped, 1)
+			if idb.spoolPost(ctx, buffer.Bytes(), typeOfPost, seriesCount) {
+				idb.logger.WithFields(logrus.Fields{
+					"type":  typeOfPost,
+					"error": err,
+				}).Warn("failed to send, spooled")
+				return nil
+			}
+			idb.backendStats.Dropped(ctx, typeOfPost, reason, seriesCount)
 			return fmt.Errorf("[%s] %v", BackendName, err)
 		}
 
@@ -446,57 +477,109 @@ func (idb *Client) post(ctx context.Context, buffer *bytes.Buffer) error {
 			"sleep": next,
 			"error": err,
 		}).Warn("failed to send")
+		tracing.Retry(ctx, span, attempts, err, next)
 
 		timer := clck.NewTimer(next)
 		select {
 		case <-ctx.Done():
 			timer.Stop()
+			idb.backendStats.Dropped(ctx, typeOfPost, stats.DropReasonCanceled, seriesCount)
 			return ctx.Err()
 		case <-timer.C:
 		}
 
-		atomic.AddUint64(&idb.batchesRetried.Cur, 1)
+		atomic.AddUint64(&idb.backendStats.BatchesRetried.Cur, 1)
 	}
 }
 
-func (idb *Client) constructPost(ctx context.Context, buffer *bytes.Buffer) (func() error /*doPost*/, error) {
+func (idb *Client) constructPost(ctx context.Context, typeOfPost string, buffer *bytes.Buffer) (func() error /*doPost*/, error) {
 	body := buffer.Bytes()
-
+	encoding := idb.compressor.Encoding()
 	return func() error {
-		headers := map[string]string{
-			"User-Agent": "gostatsd (influxdb)",
-		}
-		if idb.compressPayload {
-			headers["Content-Encoding"] = "gzip"
-		} else {
-			headers["Content-Encoding"] = "identity"
-		}
-		if idb.credentials != "" {
-			headers["Authorization"] = "Token " + idb.credentials
-		}
-
-		req, err := http.NewRequestWithContext(ctx, "POST", idb.url, bytes.NewReader(body))
-		if err != nil {
-			return fmt.Errorf("unable to create http.Request: %v", err)
-		}
-		for header, v := range headers {
-			req.Header.Set(header, v)
-		}
-		resp, err := idb.client.Do(req)
-		if err != nil {
-			return fmt.Errorf("error POSTing: %v", err)
-		}
-		defer resp.Body.Close()
-		body := io.LimitReader(resp.Body, maxResponseSize)
-		if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
-			b, _ := ioutil.ReadAll(body)
-			idb.logger.WithFields(logrus.Fields{
-				"status": resp.StatusCode,
-				"body":   string(b),
-			}).Info("request failed")
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
-		}
-		_, _ = io.Copy(ioutil.Discard, body)
-		return nil
+		return idb.doPost(ctx, typeOfPost, encoding, body)
 	}, nil
 }
+
+// doPost makes a single attempt to send a body which has already been encoded.
+func (idb *Client) doPost(ctx context.Context, typeOfPost, encoding string, body []byte) error {
+	headers := map[string]string{
+		"User-Agent": "gostatsd (influxdb)",
+	}
+	headers["Content-Encoding"] = encoding
+	if idb.credentials != "" {
+		headers["Authorization"] = "Token " + idb.credentials
+	}
+
+	ctx, cancel := transport.AttemptContext(ctx, idb.requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", idb.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	for header, v := range headers {
+		req.Header.Set(header, v)
+	}
+	resp, err := idb.client.Do(req)
+	if err != nil {
+		idb.backendStats.Response(ctx, typeOfPost, 0)
+		return fmt.Errorf("error POSTing: %v", err)
+	}
+	defer resp.Body.Close()
+	idb.backendStats.Response(ctx, typeOfPost, resp.StatusCode)
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		idb.logger.WithFields(logrus.Fields{
+			"status": resp.StatusCode,
+			"body":   string(b),
+		}).Info("request failed")
+		return fmt.Errorf("received bad status code %d", resp.StatusCode)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// SetSpool sets the spool payloads are added to when they exhaust their retries.
+func (idb *Client) SetSpool(spool gostatsd.Spool) {
+	idb.spool = spool
+}
+
+// spoolPost adds a body which could not be sent to the spool, and returns false if it was not spooled.
+func (idb *Client) spoolPost(ctx context.Context, body []byte, typeOfPost string, datapoints uint64) bool {
+	if idb.spool == nil {
+		return false
+	}
+	header, err := json.Marshal(&spooledPost{
+		Type:     typeOfPost,
+		Encoding: idb.compressor.Encoding(),
+	})
+	if err != nil {
+		return false
+	}
+	payload := make([]byte, 0, len(header)+1+len(body))
+	payload = append(append(append(payload, header...), '\n'), body...)
+	return idb.spool.Spool(ctx, payload, datapoints)
+}
+
+// Replay makes a single attempt to send a payload which was spooled.  It is sent with the current credentials and
+// endpoint, so a payload spooled before a reload is sent to where the backend now sends.
+func (idb *Client) Replay(ctx context.Context, payload []byte) error {
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 {
+		return fmt.Errorf("[%s] spooled payload is missing its header", BackendName)
+	}
+	var entry spooledPost
+	if err := json.Unmarshal(payload[:end], &entry); err != nil {
+		return fmt.Errorf("[%s] spooled payload has an invalid header: %v", BackendName, err)
+	}
+	ctx, span := tracing.Start(ctx, "backend.replay", tracing.BackendKey.String(BackendName), tracing.TypeKey.String(entry.Type))
+	postTimer := idb.backendStats.NewPostTimer(ctx, entry.Type)
+	err := idb.doPost(ctx, entry.Type, entry.Encoding, payload[end+1:])
+	postTimer.Send()
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	atomic.AddUint64(&idb.backendStats.BatchesSent, 1)
+	return nil
+}
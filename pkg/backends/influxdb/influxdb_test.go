@@ -128,6 +128,82 @@ func TestRetries(t *testing.T) {
 	assert.EqualValues(t, cap(cli.reqBufferSem), len(cli.reqBufferSem))
 }
 
+// fakeSpool keeps every payload it is given.
+type fakeSpool struct {
+	payloads   [][]byte
+	datapoints uint64
+}
+
+func (fs *fakeSpool) Spool(ctx context.Context, payload []byte, datapoints uint64) bool {
+	fs.payloads = append(fs.payloads, append([]byte(nil), payload...))
+	fs.datapoints += datapoints
+	return true
+}
+
+func TestSpoolWhenRetriesExhausted(t *testing.T) {
+	t.Parallel()
+	var failing uint32 = 1
+	var received [][]byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if atomic.LoadUint32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Token creds", r.Header.Get("Authorization"))
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received = append(received, data)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cli, err := NewClient(
+		ts.URL,
+		true,
+		"creds",
+		defaultMaxRequests,
+		1*time.Second,
+		defaultMetricsPerBatch,
+		"default",
+		configV2{
+			bucket: "bucket",
+			org:    "org",
+		},
+		gostatsd.TimerSubtypes{},
+		logrus.New(),
+		p,
+	)
+	require.NoError(t, err)
+	spool := &fakeSpool{}
+	cli.SetSpool(spool)
+
+	res := make(chan []error, 1)
+	ctx, cancel := fixtures.NewAdvancingClock(context.Background())
+	defer cancel()
+	cli.SendMetricsAsync(ctx, twoCounters(), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	for _, err := range errs {
+		// Spooled payloads are not an error
+		assert.NoError(t, err)
+	}
+	require.Len(t, spool.payloads, 1)
+	assert.EqualValues(t, 2, spool.datapoints)
+
+	require.Error(t, cli.Replay(ctx, spool.payloads[0]))
+	atomic.StoreUint32(&failing, 0)
+	require.NoError(t, cli.Replay(ctx, spool.payloads[0]))
+	require.Len(t, received, 1)
+	assert.True(t, bytes.HasSuffix(spool.payloads[0], received[0]))
+
+	require.Error(t, cli.Replay(ctx, []byte("no header")))
+}
+
 func TestSendMetricsInMultipleBatches(t *testing.T) {
 	t.Parallel()
 	var requestNum uint32
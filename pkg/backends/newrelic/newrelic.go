@@ -2,7 +2,6 @@ package newrelic
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -23,7 +22,9 @@ import (
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/compression"
 	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/tracing"
 	"github.com/hligit/gostatsd/pkg/transport"
 )
 
@@ -77,22 +78,26 @@ type Client struct {
 	timerSum        string
 	timerSumSquares string
 
-	batchesCreated uint64            // Accumulated number of batches created
-	batchesDropped uint64            // Accumulated number of batches aborted (data loss)
-	batchesSent    uint64            // Accumulated number of batches successfully sent
-	seriesSent     uint64            // Accumulated number of series successfully sent
-	batchesRetried stats.ChangeGauge // Accumulated number of batches retried (first send is not a retry)
+	backendStats *stats.BackendStats
 
 	userAgent             string
 	maxRequestElapsedTime time.Duration
+	requestTimeout        time.Duration // The time allowed for each attempt, or 0 for the client-timeout of the transport
 	client                *http.Client
 	metricsPerBatch       uint
 	metricsBufferSem      chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
+	compressor            compression.Codec
+	spool                 gostatsd.Spool // nil if payloads are not spooled
 
 	disabledSubtypes gostatsd.TimerSubtypes
 	flushInterval    time.Duration
 }
 
+// spooledPost describes a payload which was spooled.  It is stored as a line of json, followed by the body.
+type spooledPost struct {
+	Encoding string `json:"encoding,omitempty"`
+}
+
 // NRInfraPayload represents New Relic Infrastructure Payload format
 // https://github.com/newrelic/infra-integrations-sdk/blob/master/docs/v2tov3.md#v2-json-full-sample
 type NRInfraPayload struct {
@@ -135,7 +140,7 @@ func (n *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricM
 		// This section would be likely be better if it pushed all ts's in to a single channel
 		// which n goroutines then read from.  Current behavior still spins up many goroutines
 		// and has them all hit the same channel.
-		atomic.AddUint64(&n.batchesCreated, 1)
+		atomic.AddUint64(&n.backendStats.BatchesCreated, 1)
 		go func() {
 			select {
 			case <-ctx.Done():
@@ -145,9 +150,9 @@ func (n *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricM
 					buffer.Reset()
 					n.metricsBufferSem <- buffer
 				}()
-				err := n.post(ctx, buffer, ts)
-				if err != nil {
-					atomic.AddUint64(&n.seriesSent, uint64(len(ts.Metrics)))
+				err := n.post(ctx, buffer, uint64(len(ts.Metrics)), ts)
+				if err == nil {
+					atomic.AddUint64(&n.backendStats.SeriesSent, uint64(len(ts.Metrics)))
 				}
 
 				select {
@@ -174,25 +179,14 @@ func (n *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricM
 	}()
 }
 
+// Run runs the backend's metrics until the context is done.
+func (n *Client) Run(ctx context.Context) {
+	n.RunMetrics(ctx, stats.FromContext(ctx))
+}
+
 // RunMetrics run metrics
 func (n *Client) RunMetrics(ctx context.Context, statser stats.Statser) {
-	statser = statser.WithTags(gostatsd.Tags{"backend:newrelic"})
-
-	flushed, unregister := statser.RegisterFlush()
-	defer unregister()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-flushed:
-			statser.Gauge("backend.created", float64(atomic.LoadUint64(&n.batchesCreated)), nil)
-			n.batchesRetried.SendIfChanged(statser, "backend.retried", nil)
-			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&n.batchesDropped)), nil)
-			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&n.batchesSent)), nil)
-			statser.Gauge("backend.series.sent", float64(atomic.LoadUint64(&n.seriesSent)), nil)
-		}
-	}
+	n.backendStats.RunMetrics(ctx, statser)
 }
 
 func (n *Client) processMetrics(now float64, metrics *gostatsd.MetricMap, cb func(*timeSeries)) {
@@ -250,12 +244,15 @@ func (n *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 			return err
 		}
 
+		ctx, span := tracing.Start(ctx, "backend.post", tracing.BackendKey.String(BackendName), tracing.TypeKey.String("events"), tracing.AttemptsKey.Int(1))
 		post, err := n.postWrapper(ctx, b, "events")
-		if err != nil {
-			return err
+		if err == nil {
+			postTimer := n.backendStats.NewPostTimer(ctx, "events")
+			err = post()
+			postTimer.Send()
 		}
-
-		return post()
+		tracing.End(span, err)
+		return err
 	}
 	return nil
 }
@@ -292,27 +289,51 @@ func (n *Client) Name() string {
 	return BackendName
 }
 
-func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, data interface{}) error {
-	post, err := n.constructPost(ctx, buffer, data)
+func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, datapoints uint64, data interface{}) (err error) {
+	ctx, span := tracing.Start(ctx, "backend.post", tracing.BackendKey.String(BackendName), tracing.TypeKey.String("metrics"))
+	attempts := 0
+	defer func() {
+		span.SetAttributes(tracing.AttemptsKey.Int(attempts))
+		tracing.End(span, err)
+	}()
+
+	body, encoding, err := n.constructPost(ctx, data)
 	if err != nil {
-		atomic.AddUint64(&n.batchesDropped, 1)
+		n.backendStats.Dropped(ctx, "metrics", stats.DropReasonSerialize, datapoints)
 		return err
 	}
+	post := func() error {
+		return n.doPost(ctx, "metrics", encoding, body)
+	}
 
 	b := backoff.NewExponentialBackOff()
 	clck := clock.FromContext(ctx)
 	b.Clock = clck
 	b.Reset()
 	b.MaxElapsedTime = n.maxRequestElapsedTime
+	budget := stats.RetryBudgetFromContext(ctx)
+	budget.Sent(clck.Now())
 	for {
-		if err = post(); err == nil {
-			atomic.AddUint64(&n.batchesSent, 1)
+		attempts++
+		postTimer := n.backendStats.NewPostTimer(ctx, "metrics")
+		err = post()
+		postTimer.Send()
+		if err == nil {
+			atomic.AddUint64(&n.backendStats.BatchesSent, 1)
 			return nil
 		}
 
 		next := b.NextBackOff()
+		reason := stats.DropReasonRetriesExhausted
+		if next != backoff.Stop && !budget.Retry(clck.Now()) {
+			next, reason = backoff.Stop, stats.DropReasonRetryBudget
+		}
 		if next == backoff.Stop {
-			atomic.AddUint64(&n.batchesDropped, 1)
+			if n.spoolPost(ctx, body, encoding, datapoints) {
+				n.logger.WithError(err).Warn("failed to send, spooled")
+				return nil
+			}
+			n.backendStats.Dropped(ctx, "metrics", reason, datapoints)
 			return fmt.Errorf("[%s] %v", BackendName, err)
 		}
 
@@ -320,20 +341,23 @@ func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, data interface{
 			"sleep": next,
 			"error": err,
 		}).Warn("failed to send, sleeping")
+		tracing.Retry(ctx, span, attempts, err, next)
 
 		timer := clck.NewTimer(next)
 		select {
 		case <-ctx.Done():
 			timer.Stop()
+			n.backendStats.Dropped(ctx, "metrics", stats.DropReasonCanceled, datapoints)
 			return ctx.Err()
 		case <-timer.C:
 		}
 
-		atomic.AddUint64(&n.batchesRetried.Cur, 1)
+		atomic.AddUint64(&n.backendStats.BatchesRetried.Cur, 1)
 	}
 }
 
-func (n *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, data interface{}) (func() error /*doPost*/, error) {
+// constructPost returns the body to send for the data, and its Content-Encoding, or "" if it is not compressed.
+func (n *Client) constructPost(ctx context.Context, data interface{}) ([]byte, string, error) {
 	var mJSON []byte
 	var mErr error
 	switch n.flushType {
@@ -349,75 +373,134 @@ func (n *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, data i
 	}
 
 	if mErr != nil {
-		return nil, fmt.Errorf("[%s] unable to marshal: %v", BackendName, mErr)
+		return nil, "", fmt.Errorf("[%s] unable to marshal: %v", BackendName, mErr)
 	}
 
-	return n.postWrapper(ctx, mJSON, "metrics")
+	return n.encodePost(ctx, mJSON, "metrics")
 }
 
 // postWrapper compresses JSON for Insights
 func (n *Client) postWrapper(ctx context.Context, json []byte, dataType string) (func() error, error) {
+	body, encoding, err := n.encodePost(ctx, json, dataType)
+	if err != nil {
+		return nil, err
+	}
 	return func() error {
-		headers := map[string]string{
-			"Content-Type": "application/json",
-			"User-Agent":   n.userAgent,
+		return n.doPost(ctx, dataType, encoding, body)
+	}, nil
+}
+
+// encodePost compresses JSON for Insights and the Metrics API, and returns the body and its Content-Encoding, or "" if
+// it is not compressed.
+func (n *Client) encodePost(ctx context.Context, json []byte, dataType string) ([]byte, string, error) {
+	// Insights Event API requires gzip or deflate compression
+	// https://docs.newrelic.com/docs/insights/insights-data-sources/custom-data/introduction-event-api#h2-basic-workflow
+	// Metrics API requires gzip or identity
+	// https://docs.newrelic.com/docs/data-ingest-apis/get-data-new-relic/metric-api/report-metrics-metric-api#headers-query-parameters
+	// Use GZIP as standard across both
+	rawBytes := len(json)
+	encoding := ""
+	if (n.flushType == flushTypeInsights || n.flushType == flushTypeMetrics) && n.apiKey != "" {
+		encoding = n.compressor.Encoding()
+
+		// compress json once, rather than on every attempt
+		compressed, err := n.compressor.Compress(json)
+		if err != nil {
+			return nil, "", err
 		}
+		json = compressed
+	}
 
-		// Insights Event API requires gzip or deflate compression
-		// https://docs.newrelic.com/docs/insights/insights-data-sources/custom-data/introduction-event-api#h2-basic-workflow
-		// Metrics API requires gzip or identity
-		// https://docs.newrelic.com/docs/data-ingest-apis/get-data-new-relic/metric-api/report-metrics-metric-api#headers-query-parameters
-		// Use GZIP as standard across both
-		if (n.flushType == flushTypeInsights || n.flushType == flushTypeMetrics) && n.apiKey != "" {
-			headers["X-Insert-Key"] = n.apiKey
-			headers["Content-Encoding"] = "gzip"
-
-			// compress json
-			var buf bytes.Buffer
-			zw := gzip.NewWriter(&buf)
-			_, err := zw.Write([]byte(json))
-			if err != nil {
-				return err
-			}
+	tracing.SetAttributes(ctx, tracing.PayloadBytesKey.Int(len(json)))
+	n.backendStats.Payload(ctx, dataType, rawBytes, len(json))
+	return json, encoding, nil
+}
 
-			// Close to ensure a flush
-			if err := zw.Close(); err != nil {
-				return err
-			}
-			json = buf.Bytes()
-		}
+// doPost makes a single attempt to send a body which has already been encoded.
+func (n *Client) doPost(ctx context.Context, dataType, encoding string, body []byte) error {
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		"User-Agent":   n.userAgent,
+	}
+	if encoding != "" {
+		headers["X-Insert-Key"] = n.apiKey
+		headers["Content-Encoding"] = encoding
+	}
+	address := n.address
+	if n.flushType == flushTypeMetrics && dataType == "metrics" {
+		address = n.addressMetrics
+	}
 
-		address := n.address
-		if n.flushType == flushTypeMetrics && dataType == "metrics" {
-			address = n.addressMetrics
-		}
+	ctx, cancel := transport.AttemptContext(ctx, n.requestTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", address, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	for header, v := range headers {
+		req.Header.Set(header, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		n.backendStats.Response(ctx, dataType, 0)
+		return fmt.Errorf("error POSTing: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	n.backendStats.Response(ctx, dataType, resp.StatusCode)
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		n.logger.WithFields(logrus.Fields{
+			"status": resp.StatusCode,
+			"body":   string(b),
+		}).Info("request failed")
+		return fmt.Errorf("received bad status code %d", resp.StatusCode)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
 
-		req, err := http.NewRequest("POST", address, bytes.NewBuffer(json))
-		if err != nil {
-			return fmt.Errorf("unable to create http.Request: %v", err)
-		}
-		req = req.WithContext(ctx)
-		for header, v := range headers {
-			req.Header.Set(header, v)
-		}
-		resp, err := n.client.Do(req)
-		if err != nil {
-			return fmt.Errorf("error POSTing: %s", err.Error())
-		}
-		defer resp.Body.Close()
-		body := io.LimitReader(resp.Body, maxResponseSize)
-		if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
-			b, _ := ioutil.ReadAll(body)
-			n.logger.WithFields(logrus.Fields{
-				"status": resp.StatusCode,
-				"body":   string(b),
-			}).Info("request failed")
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
-		}
-		_, _ = io.Copy(ioutil.Discard, body)
-		return nil
-	}, nil
+// SetSpool sets the spool payloads of metrics are added to when they exhaust their retries.
+func (n *Client) SetSpool(spool gostatsd.Spool) {
+	n.spool = spool
+}
 
+// spoolPost adds a body which could not be sent to the spool, and returns false if it was not spooled.
+func (n *Client) spoolPost(ctx context.Context, body []byte, encoding string, datapoints uint64) bool {
+	if n.spool == nil {
+		return false
+	}
+	header, err := json.Marshal(&spooledPost{Encoding: encoding})
+	if err != nil {
+		return false
+	}
+	payload := make([]byte, 0, len(header)+1+len(body))
+	payload = append(append(append(payload, header...), '\n'), body...)
+	return n.spool.Spool(ctx, payload, datapoints)
+}
+
+// Replay makes a single attempt to send a payload of metrics which was spooled.  It is sent with the current api key
+// and address, so a payload spooled before a reload is sent to where the backend now sends.
+func (n *Client) Replay(ctx context.Context, payload []byte) error {
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 {
+		return fmt.Errorf("[%s] spooled payload is missing its header", BackendName)
+	}
+	var entry spooledPost
+	if err := json.Unmarshal(payload[:end], &entry); err != nil {
+		return fmt.Errorf("[%s] spooled payload has an invalid header: %v", BackendName, err)
+	}
+	ctx, span := tracing.Start(ctx, "backend.replay", tracing.BackendKey.String(BackendName), tracing.TypeKey.String("metrics"))
+	postTimer := n.backendStats.NewPostTimer(ctx, "metrics")
+	err := n.doPost(ctx, "metrics", entry.Encoding, payload[end+1:])
+	postTimer.Send()
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	atomic.AddUint64(&n.backendStats.BatchesSent, 1)
+	return nil
 }
 
 // NewClientFromViper returns a new New Relic client.
@@ -452,6 +535,7 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 
 	nr.SetDefault("metrics-per-batch", defaultMetricsPerBatch)
 	nr.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	nr.SetDefault("request-timeout", 0)
 	nr.SetDefault("max-requests", defaultMaxRequests)
 	nr.SetDefault("user-agent", defaultUserAgent)
 
@@ -462,7 +546,11 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		logger.Info("internal metrics OFF, to enable set 'statser-type' to 'logging' or 'internal'")
 	}
 
-	return NewClient(
+	requestTimeout := nr.GetDuration("request-timeout")
+	if requestTimeout < 0 {
+		return nil, fmt.Errorf("[%s] request-timeout must not be negative", BackendName)
+	}
+	client, err := NewClient(
 		nr.GetString("transport"),
 		nr.GetString("address"),
 		nr.GetString("address-metrics"),
@@ -487,10 +575,15 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		uint(nr.GetInt("max-requests")),
 		nr.GetDuration("max-request-elapsed-time"),
 		v.GetDuration("flush-interval"), // Main viper, not sub-viper
-		gostatsd.DisabledSubMetrics(v),
+		gostatsd.BackendDisabledSubMetrics(v, BackendName),
 		logger,
 		pool,
 	)
+	if err != nil {
+		return nil, err
+	}
+	client.requestTimeout = requestTimeout
+	return client, nil
 }
 
 // NewClient returns a new New Relic client.
@@ -534,11 +627,17 @@ func NewClient(transport, address, addressMetrics, eventType, flushType, apiKey,
 		"flush-interval":           flushInterval,
 	}).Info("created backend")
 
+	compressor, err := compression.New(compression.Gzip, 0)
+	if err != nil {
+		return nil, err
+	}
+
 	metricsBufferSem := make(chan *bytes.Buffer, maxRequests)
 	for i := uint(0); i < maxRequests; i++ {
 		metricsBufferSem <- &bytes.Buffer{}
 	}
 	return &Client{
+		backendStats:          stats.NewBackendStats(BackendName),
 		logger:                logger,
 		address:               address,
 		addressMetrics:        addressMetrics,
@@ -563,6 +662,7 @@ func NewClient(transport, address, addressMetrics, eventType, flushType, apiKey,
 		client:                httpClient.Client,
 		metricsPerBatch:       uint(metricsPerBatch),
 		metricsBufferSem:      metricsBufferSem,
+		compressor:            compressor,
 		flushInterval:         flushInterval,
 		disabledSubtypes:      disabled,
 	}, nil
@@ -1,6 +1,7 @@
 package newrelic
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/json"
@@ -80,6 +81,74 @@ func TestRetries(t *testing.T) {
 	ch <- struct{}{}
 }
 
+// fakeSpool keeps every payload it is given.
+type fakeSpool struct {
+	payloads   [][]byte
+	datapoints uint64
+}
+
+func (fs *fakeSpool) Spool(ctx context.Context, payload []byte, datapoints uint64) bool {
+	fs.payloads = append(fs.payloads, append([]byte(nil), payload...))
+	fs.datapoints += datapoints
+	return true
+}
+
+func TestSpoolWhenRetriesExhausted(t *testing.T) {
+	t.Parallel()
+	var failing uint32 = 1
+	var received [][]byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metric/v1", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if atomic.LoadUint32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "apiKey123", r.Header.Get("X-Insert-Key"))
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received = append(received, data)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	client, err := NewClient("default", ts.URL+"/v1/data", ts.URL+"/metric/v1", "GoStatsD", "metrics", "apiKey123", "",
+		"metric_name", "metric_type", "metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
+		"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
+		defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	require.NoError(t, err)
+	spool := &fakeSpool{}
+	client.SetSpool(spool)
+
+	res := make(chan []error, 1)
+	clck := clock.NewMock(time.Unix(0, 0))
+	ctx := clock.Context(context.Background(), clck)
+	ch := make(chan struct{})
+	go advanceTime(clck, ch)
+	client.SendMetricsAsync(ctx, twoCounters(), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	ch <- struct{}{}
+	for _, err := range errs {
+		// Spooled payloads are not an error
+		assert.NoError(t, err)
+	}
+	require.Len(t, spool.payloads, 1)
+	// Each counter is sent as a count and a rate
+	assert.EqualValues(t, 4, spool.datapoints)
+
+	require.Error(t, client.Replay(ctx, spool.payloads[0]))
+	atomic.StoreUint32(&failing, 0)
+	require.NoError(t, client.Replay(ctx, spool.payloads[0]))
+	require.Len(t, received, 1)
+	assert.True(t, bytes.HasSuffix(spool.payloads[0], received[0]))
+
+	require.Error(t, client.Replay(ctx, []byte("no header")))
+}
+
 func TestSendMetricsInMultipleBatches(t *testing.T) {
 	t.Parallel()
 	var requestNum uint32
@@ -0,0 +1,370 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/deadletter"
+	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+// ReloadableBackend is a Backend which can be recreated from a new configuration without losing data.  The new
+// backend is used for every send started after a reload, and the previous backend is stopped once the sends it was
+// given have completed.
+type ReloadableBackend struct {
+	name       string
+	logger     logrus.FieldLogger
+	pool       *transport.TransportPool
+	spool      *backendSpool // nil if spooling is not enabled
+	breaker    *circuitBreaker
+	deadLetter *deadletter.Archive // Archives what the backend finally drops, nil if it is not enabled
+	restarts   uint64              // atomic - times the watchdog restarted the backend
+	sampled    uint64              // atomic - series not sent by the sample rules
+
+	lock            sync.RWMutex
+	current         *runningBackend
+	v               *viper.Viper    // The configuration the current backend was created from
+	watchdogTimeout time.Duration   // 0 if the watchdog is disabled
+	ctx             context.Context // The context of Run, or nil if it has not been started
+	wg              sync.WaitGroup  // Tracks the goroutines of every backend which has been started
+
+	closeOnce sync.Once
+	closed    chan struct{} // Closed by Close, to stop Run before its context is done
+}
+
+type runningBackend struct {
+	backend      gostatsd.Backend
+	capabilities capabilities       // What is sent to the backend
+	inflight     sync.WaitGroup     // Tracks the sends which have not completed
+	cancel       context.CancelFunc // Stops the backend, or nil if it is not a Runner
+
+	sendsLock sync.Mutex
+	sends     map[*trackedSend]struct{} // The sends which have not completed, for the watchdog
+}
+
+func newRunningBackend(backend gostatsd.Backend, c capabilities) *runningBackend {
+	return &runningBackend{
+		backend:      backend,
+		capabilities: c,
+		sends:        map[*trackedSend]struct{}{},
+	}
+}
+
+// NewReloadableBackend creates an instance of the named backend, which can be reloaded.  Only the events and types of
+// metrics configured in its section are sent to it.
+func NewReloadableBackend(name string, v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (*ReloadableBackend, error) {
+	c, err := capabilitiesFromViper(name, v)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := InitBackend(name, v, logger, pool)
+	if err != nil {
+		return nil, err
+	}
+	if err := setMetadata(backend, v); err != nil {
+		return nil, err
+	}
+	failures, openTime, err := circuitBreakerSettings(name, v)
+	if err != nil {
+		return nil, err
+	}
+	watchdogTimeout, err := watchdogSettings(name, v)
+	if err != nil {
+		return nil, err
+	}
+	deadLetter, err := deadLetterFromViper(v)
+	if err != nil {
+		return nil, err
+	}
+	spool, err := spoolFromViper(name, v, logger)
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.WithField("backend", name)
+	breaker := &circuitBreaker{logger: logger}
+	breaker.configure(failures, openTime)
+	rb := &ReloadableBackend{
+		name:            name,
+		logger:          logger,
+		pool:            pool,
+		spool:           spool,
+		breaker:         breaker,
+		deadLetter:      deadLetter,
+		current:         newRunningBackend(backend, c),
+		v:               v,
+		watchdogTimeout: watchdogTimeout,
+		closed:          make(chan struct{}),
+	}
+	if err := rb.setSpool(backend); err != nil {
+		spool.close()
+		return nil, err
+	}
+	return rb, nil
+}
+
+// Name returns the name of the backend.
+func (rb *ReloadableBackend) Name() string {
+	return rb.name
+}
+
+// Run runs the backend, and any backend it is reloaded with, until the context is done or the backend is closed.
+func (rb *ReloadableBackend) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rb.lock.Lock()
+	rb.ctx = ctx
+	rb.start(rb.current)
+	rb.wg.Add(3)
+	go func() {
+		defer rb.wg.Done()
+		rb.breaker.runMetrics(ctx, rb.name)
+	}()
+	go func() {
+		defer rb.wg.Done()
+		rb.runWatchdog(ctx)
+	}()
+	go func() {
+		defer rb.wg.Done()
+		rb.runSampleMetrics(ctx)
+	}()
+	if rb.spool != nil {
+		rb.wg.Add(2)
+		go func() {
+			defer rb.wg.Done()
+			rb.spool.replay(ctx, rb.replay)
+		}()
+		go func() {
+			defer rb.wg.Done()
+			rb.spool.runMetrics(ctx)
+		}()
+	}
+	rb.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+	case <-rb.closed:
+		cancel()
+	}
+	rb.wg.Wait()
+	if rb.spool != nil {
+		rb.spool.close()
+	}
+}
+
+// runSampleMetrics writes the number of series not sent by the sample rules since the last flush, every flush until the
+// context is done.
+func (rb *ReloadableBackend) runSampleMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + rb.name})
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			if sampled := atomic.SwapUint64(&rb.sampled, 0); sampled > 0 {
+				statser.Count("backend.series.sampled", float64(sampled), nil)
+			}
+		}
+	}
+}
+
+// Close stops the backend, once it has been removed from the configuration.  Nothing may be sent to it afterwards.
+func (rb *ReloadableBackend) Close() error {
+	rb.closeOnce.Do(func() {
+		close(rb.closed)
+	})
+	return nil
+}
+
+// start runs the backend in a new goroutine if it is a Runner.  It must be called with the lock held, after Run.
+func (rb *ReloadableBackend) start(rbe *runningBackend) {
+	runner, ok := rbe.backend.(gostatsd.Runner)
+	if !ok {
+		return
+	}
+	var ctx context.Context
+	ctx, rbe.cancel = context.WithCancel(rb.ctx)
+	rb.wg.Add(1)
+	go func() {
+		defer rb.wg.Done()
+		runner.Run(ctx)
+	}()
+}
+
+// acquire returns the current backend, and tracks a send against it.  The caller must call inflight.Done when the
+// send has completed.
+func (rb *ReloadableBackend) acquire() *runningBackend {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+	rbe := rb.current
+	rbe.inflight.Add(1)
+	return rbe
+}
+
+// SendMetricsAsync sends the metrics of the types it is configured to receive to the current backend.
+func (rb *ReloadableBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	rbe := rb.acquire()
+	if mm = rbe.capabilities.filterMetrics(mm); mm != nil {
+		var sampled int
+		mm, sampled = rbe.capabilities.sampleMetrics(mm)
+		atomic.AddUint64(&rb.sampled, uint64(sampled))
+	}
+	if mm == nil {
+		rbe.inflight.Done()
+		cb(nil)
+		return
+	}
+	clck := clock.FromContext(ctx)
+	if !rb.breaker.allow(clck.Now()) {
+		rbe.inflight.Done()
+		stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonCircuitOpen, rb.name, uint64(mm.Len()))
+		errs := []error{fmt.Errorf("[%s] %v", rb.name, errCircuitOpen)}
+		rb.archiveMetrics(clck.Now(), mm, errs)
+		cb(errs)
+		return
+	}
+	send := rbe.track(clck.Now(), uint64(mm.Len()), func(errs []error) {
+		defer rbe.inflight.Done()
+		failed := anyError(errs)
+		rb.breaker.done(clck.Now(), failed)
+		if failed {
+			rb.archiveMetrics(clck.Now(), mm, errs)
+		}
+		cb(errs)
+	})
+	rbe.backend.SendMetricsAsync(ctx, mm, func(errs []error) {
+		send.complete(rbe, errs)
+	})
+}
+
+// SendEvent sends the event to the current backend, if it is configured to receive events.
+func (rb *ReloadableBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	rbe := rb.acquire()
+	defer rbe.inflight.Done()
+	if !rbe.capabilities.events {
+		return nil
+	}
+	clck := clock.FromContext(ctx)
+	if !rb.breaker.allow(clck.Now()) {
+		err := fmt.Errorf("[%s] %v", rb.name, errCircuitOpen)
+		rb.archiveEvent(clck.Now(), e, err)
+		return err
+	}
+	err := rbe.backend.SendEvent(ctx, e)
+	rb.breaker.done(clck.Now(), err != nil)
+	if err != nil {
+		rb.archiveEvent(clck.Now(), e, err)
+	}
+	return err
+}
+
+// CheckReady reports if the current backend is ready, if it can report readiness.
+func (rb *ReloadableBackend) CheckReady() error {
+	rb.lock.RLock()
+	backend := rb.current.backend
+	rb.lock.RUnlock()
+	if c, ok := backend.(gostatsd.ReadinessChecker); ok {
+		return c.CheckReady()
+	}
+	return nil
+}
+
+// ReloadConfig creates a new backend from v, and replaces the current backend with it.  If the new backend can not
+// be created, the current backend is kept.
+func (rb *ReloadableBackend) ReloadConfig(ctx context.Context, v *viper.Viper) error {
+	c, err := capabilitiesFromViper(rb.name, v)
+	if err != nil {
+		return fmt.Errorf("could not reload backend %q: %v", rb.name, err)
+	}
+	failures, openTime, err := circuitBreakerSettings(rb.name, v)
+	if err != nil {
+		return fmt.Errorf("could not reload backend %q: %v", rb.name, err)
+	}
+	watchdogTimeout, err := watchdogSettings(rb.name, v)
+	if err != nil {
+		return fmt.Errorf("could not reload backend %q: %v", rb.name, err)
+	}
+	backend, err := GetBackend(rb.name, v, rb.logger, rb.pool)
+	if err != nil {
+		return fmt.Errorf("could not reload backend %q: %v", rb.name, err)
+	}
+	if err := rb.setSpool(backend); err != nil {
+		return fmt.Errorf("could not reload backend %q: %v", rb.name, err)
+	}
+	if err := setMetadata(backend, v); err != nil {
+		return fmt.Errorf("could not reload backend %q: %v", rb.name, err)
+	}
+	next := newRunningBackend(backend, c)
+	rb.breaker.configure(failures, openTime)
+
+	rb.lock.Lock()
+	previous := rb.current
+	rb.current = next
+	rb.v = v
+	rb.watchdogTimeout = watchdogTimeout
+	if rb.ctx != nil {
+		rb.start(next)
+	}
+	// No new sends can be given to the previous backend once it is replaced
+	rb.wg.Add(1)
+	rb.lock.Unlock()
+
+	go func() {
+		defer rb.wg.Done()
+		previous.inflight.Wait()
+		if previous.cancel != nil {
+			previous.cancel()
+		}
+	}()
+	rb.logger.Info("Reloaded backend")
+	return nil
+}
+
+// setSpool gives the spool to a new instance of the backend, if spooling is enabled.  The spool is opened once, so
+// changes to its settings require a restart.
+func (rb *ReloadableBackend) setSpool(backend gostatsd.Backend) error {
+	if rb.spool == nil {
+		return nil
+	}
+	spooling, ok := backend.(gostatsd.SpoolingBackend)
+	if !ok {
+		return fmt.Errorf("backend %q does not support %s", rb.name, paramSpoolPath)
+	}
+	spooling.SetSpool(rb.spool)
+	return nil
+}
+
+// setMetadata gives the metadata of metrics in v to a new instance of the backend, if it records metadata.  Backends
+// which do not are sent the same metrics without it.
+func setMetadata(backend gostatsd.Backend, v *viper.Viper) error {
+	registry, err := gostatsd.NewMetadataRegistryFromViper(v)
+	if err != nil {
+		return err
+	}
+	if mb, ok := backend.(gostatsd.MetadataBackend); ok && registry.Len() > 0 {
+		mb.SetMetadata(registry)
+	}
+	return nil
+}
+
+// replay sends a spooled payload to the current backend.
+func (rb *ReloadableBackend) replay(ctx context.Context, payload []byte) error {
+	rbe := rb.acquire()
+	defer rbe.inflight.Done()
+	spooling, ok := rbe.backend.(gostatsd.SpoolingBackend)
+	if !ok {
+		return fmt.Errorf("backend %q does not support %s", rb.name, paramSpoolPath)
+	}
+	return spooling.Replay(ctx, payload)
+}
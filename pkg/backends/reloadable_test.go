@@ -0,0 +1,103 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+type fakeBackend struct {
+	setting string
+	sent    chan gostatsd.SendCallback // Receives the callback of every send, which is completed by the test
+	started chan struct{}
+	stopped chan struct{}
+}
+
+func (fb *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (fb *fakeBackend) Run(ctx context.Context) {
+	close(fb.started)
+	<-ctx.Done()
+	close(fb.stopped)
+}
+
+func (fb *fakeBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	fb.sent <- cb
+}
+
+func (fb *fakeBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestReloadableBackend(t *testing.T) {
+	var lock sync.Mutex
+	var created []*fakeBackend
+	backends["fake"] = func(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		fb := &fakeBackend{
+			setting: v.GetString("setting"),
+			sent:    make(chan gostatsd.SendCallback, 1),
+			started: make(chan struct{}),
+			stopped: make(chan struct{}),
+		}
+		created = append(created, fb)
+		return fb, nil
+	}
+	defer delete(backends, "fake")
+
+	logger := logrus.StandardLogger()
+	v := viper.New()
+	v.Set("setting", "first")
+	rb, err := NewReloadableBackend("fake", v, logger, transport.NewTransportPool(logger, v))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		rb.Run(ctx)
+		close(runDone)
+	}()
+
+	// Start a send on the first backend, which is not completed until after the reload
+	sendDone := make(chan struct{})
+	rb.SendMetricsAsync(ctx, gostatsd.NewMetricMap(), func(errs []error) {
+		close(sendDone)
+	})
+	first := created[0]
+	firstCb := <-first.sent
+	<-first.started
+
+	v.Set("setting", "second")
+	require.NoError(t, rb.ReloadConfig(ctx, v))
+	require.Len(t, created, 2)
+	second := created[1]
+	assert.Equal(t, "second", second.setting)
+	<-second.started
+
+	rb.SendMetricsAsync(ctx, gostatsd.NewMetricMap(), func(errs []error) {})
+	(<-second.sent)(nil)
+
+	select {
+	case <-first.stopped:
+		t.Fatal("first backend stopped before its send completed")
+	default:
+	}
+	firstCb(nil)
+	<-sendDone
+	<-first.stopped
+
+	cancel()
+	<-runDone
+	<-second.stopped
+}
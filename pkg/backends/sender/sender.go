@@ -3,6 +3,7 @@ package sender
 import (
 	"bytes"
 	"context"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -136,3 +137,59 @@ func (s *Sender) cleanup(ctx context.Context) {
 		stream.Cb([]error{ctx.Err()})
 	}
 }
+
+// DiscardConnFactory returns a ConnFactory which creates connections that discard everything written to them, so a
+// dry run does everything up to sending the data.
+func DiscardConnFactory(logger logrus.FieldLogger) ConnFactory {
+	return func() (net.Conn, error) {
+		return &discardConn{logger: logger}, nil
+	}
+}
+
+// discardConn is a net.Conn which discards everything written to it, and has nothing to read.
+type discardConn struct {
+	logger logrus.FieldLogger
+}
+
+func (dc *discardConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (dc *discardConn) Write(b []byte) (int, error) {
+	dc.logger.WithField("bytes", len(b)).Debug("Dry run, not sending data")
+	return len(b), nil
+}
+
+func (dc *discardConn) Close() error {
+	return nil
+}
+
+func (dc *discardConn) LocalAddr() net.Addr {
+	return discardAddr{}
+}
+
+func (dc *discardConn) RemoteAddr() net.Addr {
+	return discardAddr{}
+}
+
+func (dc *discardConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *discardConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *discardConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type discardAddr struct{}
+
+func (discardAddr) Network() string {
+	return "discard"
+}
+
+func (discardAddr) String() string {
+	return "discard"
+}
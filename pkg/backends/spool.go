@@ -0,0 +1,193 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/backends/datadog"
+	"github.com/hligit/gostatsd/pkg/backends/influxdb"
+	"github.com/hligit/gostatsd/pkg/backends/newrelic"
+	"github.com/hligit/gostatsd/pkg/diskqueue"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+const (
+	// paramSpoolPath is the name of the backend setting with the directory payloads are spooled in.
+	paramSpoolPath = "spool-path"
+	// paramSpoolMaxBytes is the name of the backend setting with the maximum size of the spool.
+	paramSpoolMaxBytes = "spool-max-bytes"
+	// paramSpoolMaxAge is the name of the backend setting with the maximum age of a spooled payload.
+	paramSpoolMaxAge = "spool-max-age"
+	// paramSpoolReplayRate is the name of the backend setting with the maximum number of payloads replayed per second.
+	paramSpoolReplayRate = "spool-replay-rate"
+
+	defaultSpoolMaxBytes   = 100 * 1024 * 1024
+	defaultSpoolMaxAge     = 1 * time.Hour
+	defaultSpoolReplayRate = 10
+
+	// spoolPollInterval is how often an empty spool is checked for payloads to replay.
+	spoolPollInterval = 1 * time.Second
+	// spoolRetryInterval is how long to wait after a payload could not be replayed.
+	spoolRetryInterval = 5 * time.Second
+)
+
+// spoolingBackends are the backends which implement gostatsd.SpoolingBackend, so spool-path can be set for them.
+var spoolingBackends = map[string]bool{
+	datadog.BackendName:  true,
+	influxdb.BackendName: true,
+	newrelic.BackendName: true,
+}
+
+// CheckSpool returns an error listing every backend which has spool-path set, but can not spool, so the setting is not
+// silently ignored.
+func CheckSpool(v *viper.Viper) error {
+	var errs []string
+	checked := map[string]bool{}
+	check := func(section string, v *viper.Viper, names []string) {
+		for _, name := range names {
+			if checked[section+name] {
+				continue
+			}
+			checked[section+name] = true
+			if !spoolingBackends[name] && util.GetSubViper(v, name).GetString(paramSpoolPath) != "" {
+				errs = append(errs, fmt.Sprintf("backend %q does not support %s%s.%s", name, section, name, paramSpoolPath))
+			}
+		}
+	}
+	// Backends used for both client and internal metrics are shared, and shadow backends have their own section
+	check("", v, append(v.GetStringSlice(gostatsd.ParamBackends), v.GetStringSlice(gostatsd.ParamInternalBackends)...))
+	check("shadow.", util.GetSubViper(v, "shadow"), v.GetStringSlice(gostatsd.ParamShadowBackends))
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// backendSpool is the persistent queue of a backend, which payloads are added to when they exhaust their retries, and
+// replayed from oldest first.  It is shared by every instance of the backend as it is reloaded.
+type backendSpool struct {
+	name           string
+	logger         logrus.FieldLogger
+	queue          *diskqueue.Queue
+	replayInterval time.Duration
+
+	spooled  uint64 // atomic - payloads added to the spool
+	replayed uint64 // atomic - spooled payloads successfully sent
+	dropped  uint64 // atomic - spooled payloads evicted, expired, or unreadable
+}
+
+// spoolFromViper opens the spool configured in the section of the named backend, or returns nil if spooling is not
+// enabled.
+func spoolFromViper(name string, v *viper.Viper, logger logrus.FieldLogger) (*backendSpool, error) {
+	sub := util.GetSubViper(v, name)
+	sub.SetDefault(paramSpoolMaxBytes, defaultSpoolMaxBytes)
+	sub.SetDefault(paramSpoolMaxAge, defaultSpoolMaxAge)
+	sub.SetDefault(paramSpoolReplayRate, defaultSpoolReplayRate)
+	path := sub.GetString(paramSpoolPath)
+	if path == "" {
+		return nil, nil
+	}
+	replayRate := sub.GetFloat64(paramSpoolReplayRate)
+	if replayRate <= 0 {
+		return nil, fmt.Errorf("%s.%s must be positive", name, paramSpoolReplayRate)
+	}
+	logger = logger.WithFields(logrus.Fields{
+		"backend":   name,
+		"component": "backend-spool",
+	})
+	queue, err := diskqueue.Open(logger, path, sub.GetInt64(paramSpoolMaxBytes), sub.GetDuration(paramSpoolMaxAge))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s spool: %v", name, err)
+	}
+	return &backendSpool{
+		name:           name,
+		logger:         logger,
+		queue:          queue,
+		replayInterval: time.Duration(float64(time.Second) / replayRate),
+	}, nil
+}
+
+// Spool adds a payload to the end of the spool, evicting the oldest payloads if it is full.
+func (bs *backendSpool) Spool(ctx context.Context, payload []byte, datapoints uint64) bool {
+	dropped, err := bs.queue.Push(clock.FromContext(ctx).Now(), payload, datapoints)
+	bs.drop(ctx, dropped)
+	if err != nil {
+		bs.logger.WithError(err).Warn("failed to spool payload")
+		return false
+	}
+	atomic.AddUint64(&bs.spooled, 1)
+	return true
+}
+
+func (bs *backendSpool) drop(ctx context.Context, dropped diskqueue.Dropped) {
+	if dropped.Records == 0 {
+		return
+	}
+	atomic.AddUint64(&bs.dropped, uint64(dropped.Records))
+	stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonBackend, bs.name, dropped.Items)
+}
+
+// replay sends the spooled payloads with replay, oldest first, until the context is done.  A payload is only removed
+// once it has been sent, so later payloads wait until it is sent, expires, or is evicted.
+func (bs *backendSpool) replay(ctx context.Context, replay func(context.Context, []byte) error) {
+	clck := clock.FromContext(ctx)
+	for {
+		wait := bs.replayInterval
+		record, dropped := bs.queue.Peek(clck.Now())
+		bs.drop(ctx, dropped)
+		if record == nil {
+			wait = spoolPollInterval
+		} else if err := replay(ctx, record.Payload); err != nil {
+			bs.logger.WithError(err).Debug("failed to replay spooled payload")
+			wait = spoolRetryInterval
+		} else {
+			bs.queue.Remove(record)
+			atomic.AddUint64(&bs.replayed, 1)
+		}
+
+		timer := clock.NewTimer(ctx, wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// runMetrics writes the accumulated counters and the size of the spool every flush until the context is done.
+func (bs *backendSpool) runMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + bs.name})
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			queueStats := bs.queue.Stats()
+			statser.Gauge("backend.spool.spooled", float64(atomic.LoadUint64(&bs.spooled)), nil)
+			statser.Gauge("backend.spool.replayed", float64(atomic.LoadUint64(&bs.replayed)), nil)
+			statser.Gauge("backend.spool.dropped", float64(atomic.LoadUint64(&bs.dropped)), nil)
+			statser.Gauge("backend.spool.payloads", float64(queueStats.Records), nil)
+			statser.Gauge("backend.spool.bytes", float64(queueStats.Bytes), nil)
+		}
+	}
+}
+
+func (bs *backendSpool) close() {
+	if err := bs.queue.Close(); err != nil {
+		bs.logger.WithError(err).Warn("failed to close spool")
+	}
+}
@@ -0,0 +1,115 @@
+package backends
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/backends/datadog"
+	"github.com/hligit/gostatsd/pkg/backends/influxdb"
+	"github.com/hligit/gostatsd/pkg/backends/newrelic"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+// spoolingBackend spools the payload of every send, and records the payloads replayed.
+type spoolingBackend struct {
+	spool    gostatsd.Spool
+	replayed chan string
+}
+
+func (sb *spoolingBackend) Name() string {
+	return "spooling"
+}
+
+func (sb *spoolingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	sb.spool.Spool(ctx, []byte("payload"), uint64(mm.Len()))
+	cb(nil)
+}
+
+func (sb *spoolingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (sb *spoolingBackend) SetSpool(spool gostatsd.Spool) {
+	sb.spool = spool
+}
+
+func (sb *spoolingBackend) Replay(ctx context.Context, payload []byte) error {
+	sb.replayed <- string(payload)
+	return nil
+}
+
+func TestReloadableBackendSpool(t *testing.T) {
+	replayed := make(chan string, 1)
+	backends["spooling"] = func(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
+		return &spoolingBackend{replayed: replayed}, nil
+	}
+	defer delete(backends, "spooling")
+
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := logrus.StandardLogger()
+	v := viper.New()
+	v.Set("spooling.spool-path", dir)
+	v.Set("spooling.spool-replay-rate", 1000)
+	rb, err := NewReloadableBackend("spooling", v, logger, transport.NewTransportPool(logger, v))
+	require.NoError(t, err)
+
+	// Spooled before the backend runs, and replayed by the instance it is reloaded with
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rb.SendMetricsAsync(ctx, gostatsd.NewMetricMap(), func(errs []error) {})
+	require.NoError(t, rb.ReloadConfig(ctx, v))
+	runDone := make(chan struct{})
+	go func() {
+		rb.Run(ctx)
+		close(runDone)
+	}()
+
+	select {
+	case payload := <-replayed:
+		assert.Equal(t, "payload", payload)
+	case <-ctx.Done():
+		t.Fatal("payload was not replayed")
+	}
+	cancel()
+	<-runDone
+	assert.Zero(t, rb.spool.queue.Stats().Records)
+
+	// Spooling requires support from the backend
+	v.Set("null.spool-path", dir)
+	_, err = NewReloadableBackend("null", v, logger, transport.NewTransportPool(logger, v))
+	require.Error(t, err)
+}
+
+func TestCheckSpool(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set(gostatsd.ParamBackends, []string{"datadog", "graphite"})
+	v.Set(gostatsd.ParamInternalBackends, []string{"graphite", "newrelic"})
+	v.Set(gostatsd.ParamShadowBackends, []string{"cloudwatch", "influxdb"})
+	require.NoError(t, CheckSpool(v))
+
+	for _, name := range []string{"datadog", "graphite", "newrelic", "shadow.cloudwatch", "shadow.influxdb"} {
+		v.Set(name+".spool-path", "/var/spool/gostatsd")
+	}
+	assert.EqualError(t, CheckSpool(v), `backend "graphite" does not support graphite.spool-path; `+
+		`backend "cloudwatch" does not support shadow.cloudwatch.spool-path`)
+}
+
+// Every backend which spool-path is allowed for can spool.
+var (
+	_ gostatsd.SpoolingBackend = (*datadog.Client)(nil)
+	_ gostatsd.SpoolingBackend = (*influxdb.Client)(nil)
+	_ gostatsd.SpoolingBackend = (*newrelic.Client)(nil)
+)
@@ -115,8 +115,14 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 		}
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		// Sampled values are sent with the rate they were sampled at, so the count of the timer is kept.  Only the
+		// rate of every value together is known, so it is sent with each of them.
+		format := "%s:%f|ms"
+		if n := float64(len(timer.Values)); timer.SampledCount > n {
+			format += "|@" + strconv.FormatFloat(n/timer.SampledCount, 'g', -1, 64)
+		}
 		for _, tr := range timer.Values {
-			writeLine("%s:%f|ms", key, tagsKey, tr)
+			writeLine(format, key, tagsKey, tr)
 		}
 	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
@@ -273,7 +279,7 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(
+	client, err := NewClient(
 		g.GetString("address"),
 		g.GetDuration("dial_timeout"),
 		g.GetDuration("write_timeout"),
@@ -282,6 +288,13 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		maybeTLSConfig,
 		logger,
 	)
+	if err != nil {
+		return nil, err
+	}
+	if v.GetBool(gostatsd.ParamDryRun) {
+		client.sender.ConnFactory = sender.DiscardConnFactory(logger)
+	}
+	return client, nil
 }
 
 // Name returns the name of the backend.
@@ -87,3 +87,23 @@ func TestProcessMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessSampledTimers(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "sampled", Value: 1, Rate: 0.25, Type: gostatsd.TIMER})
+	mm.Receive(&gostatsd.Metric{Name: "sampled", Value: 2, Rate: 0.25, Type: gostatsd.TIMER})
+	mm.Receive(&gostatsd.Metric{Name: "unsampled", Value: 3, Rate: 1, Type: gostatsd.TIMER})
+	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, nil, logrus.New())
+	require.NoError(t, err)
+	var lines []string
+	c.processMetrics(mm, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		lines = append(lines, strings.Split(strings.TrimSpace(buf.String()), "\n")...)
+		return new(bytes.Buffer), false
+	})
+	assert.ElementsMatch(t, []string{
+		"sampled:1.000000|ms|@0.25",
+		"sampled:2.000000|ms|@0.25",
+		"unsampled:3.000000|ms",
+	}, lines)
+}
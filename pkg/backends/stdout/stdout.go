@@ -27,7 +27,7 @@ type Client struct {
 // NewClientFromViper constructs a stdout backend.
 func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
 	return NewClient(
-		gostatsd.DisabledSubMetrics(v),
+		gostatsd.BackendDisabledSubMetrics(v, BackendName),
 	)
 }
 
@@ -0,0 +1,193 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+const (
+	// paramWatchdogTimeout is the name of the backend setting with how long a send can take before the watchdog
+	// restarts the backend.
+	paramWatchdogTimeout = "watchdog-timeout"
+
+	// watchdogCheckInterval is how often the watchdog checks for sends which have not completed.
+	watchdogCheckInterval = time.Second
+)
+
+var errWatchdog = errors.New("send did not complete before the watchdog timeout, the backend was restarted")
+
+// trackedSend is a send given to a backend, which the watchdog completes with an error if the backend does not.
+type trackedSend struct {
+	started    time.Time
+	datapoints uint64
+	once       sync.Once
+	done       func(errs []error)
+}
+
+// complete completes the send with errs, and returns true, unless it has already completed.  A backend which
+// completes a send after the watchdog has failed it is ignored.
+func (ts *trackedSend) complete(rbe *runningBackend, errs []error) bool {
+	completed := false
+	ts.once.Do(func() {
+		completed = true
+		rbe.untrack(ts)
+		ts.done(errs)
+	})
+	return completed
+}
+
+// watchdogSettings returns the watchdog timeout in the section of the named backend.
+func watchdogSettings(name string, v *viper.Viper) (time.Duration, error) {
+	timeout := util.GetSubViper(v, name).GetDuration(paramWatchdogTimeout)
+	if timeout < 0 {
+		return 0, fmt.Errorf("%s.%s must not be negative", name, paramWatchdogTimeout)
+	}
+	return timeout, nil
+}
+
+// track records a send given to the backend, which calls done when it completes.
+func (rbe *runningBackend) track(now time.Time, datapoints uint64, done func(errs []error)) *trackedSend {
+	ts := &trackedSend{
+		started:    now,
+		datapoints: datapoints,
+		done:       done,
+	}
+	rbe.sendsLock.Lock()
+	rbe.sends[ts] = struct{}{}
+	rbe.sendsLock.Unlock()
+	return ts
+}
+
+func (rbe *runningBackend) untrack(ts *trackedSend) {
+	rbe.sendsLock.Lock()
+	delete(rbe.sends, ts)
+	rbe.sendsLock.Unlock()
+}
+
+// stuck returns true if a send has not completed within timeout.
+func (rbe *runningBackend) stuck(now time.Time, timeout time.Duration) bool {
+	rbe.sendsLock.Lock()
+	defer rbe.sendsLock.Unlock()
+	for ts := range rbe.sends {
+		if now.Sub(ts.started) >= timeout {
+			return true
+		}
+	}
+	return false
+}
+
+// pending returns the sends which have not completed.
+func (rbe *runningBackend) pending() []*trackedSend {
+	rbe.sendsLock.Lock()
+	defer rbe.sendsLock.Unlock()
+	sends := make([]*trackedSend, 0, len(rbe.sends))
+	for ts := range rbe.sends {
+		sends = append(sends, ts)
+	}
+	return sends
+}
+
+// runWatchdog restarts the backend whenever a send has not completed within the watchdog timeout, and writes the
+// number of restarts every flush, until the context is done.  Nothing is checked while the timeout is 0.
+func (rb *ReloadableBackend) runWatchdog(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + rb.name})
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+	clck := clock.FromContext(ctx)
+	ticker := clck.NewTicker(watchdogCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			if restarts := atomic.SwapUint64(&rb.restarts, 0); restarts > 0 {
+				statser.Count("backend.watchdog.restarts", float64(restarts), nil)
+			}
+		case <-ticker.C:
+			rb.lock.RLock()
+			rbe, timeout := rb.current, rb.watchdogTimeout
+			rb.lock.RUnlock()
+			if timeout > 0 && rbe.stuck(clck.Now(), timeout) {
+				rb.restart(ctx, rbe, timeout)
+			}
+		}
+	}
+}
+
+// restart replaces a backend which is stuck with a new instance, stops it, and fails the sends it has not completed,
+// so the flushes waiting for them can continue.  The backend is kept if a new instance can not be created.
+func (rb *ReloadableBackend) restart(ctx context.Context, stuck *runningBackend, timeout time.Duration) {
+	rb.lock.RLock()
+	v := rb.v
+	rb.lock.RUnlock()
+	backend, err := GetBackend(rb.name, v, rb.logger, rb.pool)
+	if err == nil {
+		err = rb.setSpool(backend)
+	}
+	if err == nil {
+		err = setMetadata(backend, v)
+	}
+	if err != nil {
+		rb.logger.WithError(err).Error("Backend is stuck, but could not be restarted")
+		return
+	}
+
+	rb.lock.Lock()
+	if rb.current != stuck {
+		// Replaced by a reload in the meantime
+		rb.lock.Unlock()
+		return
+	}
+	next := newRunningBackend(backend, stuck.capabilities)
+	rb.current = next
+	rb.start(next)
+	rb.lock.Unlock()
+
+	if stuck.cancel != nil {
+		stuck.cancel()
+	}
+	var failed int
+	var datapoints uint64
+	drops := stats.DropAccountingFromContext(ctx)
+	for _, ts := range stuck.pending() {
+		if ts.complete(stuck, []error{fmt.Errorf("[%s] %v", rb.name, errWatchdog)}) {
+			failed++
+			datapoints += ts.datapoints
+			drops.Dropped(stats.DropReasonWatchdog, rb.name, ts.datapoints)
+		}
+	}
+	atomic.AddUint64(&rb.restarts, 1)
+
+	rb.logger.WithFields(logrus.Fields{
+		"timeout":    timeout,
+		"sends":      failed,
+		"datapoints": datapoints,
+	}).Error("Backend was stuck, restarted it")
+	e := &gostatsd.Event{
+		Title: "Gostatsd backend restarted",
+		Text: fmt.Sprintf(
+			"Backend %s did not complete a send within %s, so it was restarted, and the %d datapoints in the %d sends it had not completed were dropped",
+			rb.name, timeout, datapoints, failed,
+		),
+		DateHappened: clock.FromContext(ctx).Now().Unix(),
+		Tags:         gostatsd.Tags{"backend:" + rb.name},
+		Priority:     gostatsd.PriNormal,
+		AlertType:    gostatsd.AlertError,
+	}
+	// Sent in the background, as dispatching it may block on the queues of the aggregators.
+	go stats.FromContext(ctx).Event(ctx, e)
+}
@@ -0,0 +1,102 @@
+package backends
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+// stuckBackend never completes a send, until it is released.
+type stuckBackend struct {
+	callbacks chan gostatsd.SendCallback
+}
+
+func (sb *stuckBackend) Name() string {
+	return "stuck"
+}
+
+func (sb *stuckBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	sb.callbacks <- cb
+}
+
+func (sb *stuckBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestReloadableBackendWatchdog(t *testing.T) {
+	var created []*stuckBackend
+	backends["stuck"] = func(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
+		backend := &stuckBackend{callbacks: make(chan gostatsd.SendCallback, 1)}
+		created = append(created, backend)
+		return backend, nil
+	}
+	defer delete(backends, "stuck")
+
+	logger := logrus.StandardLogger()
+	v := viper.New()
+	v.Set("stuck.watchdog-timeout", 5*time.Second)
+	rb, err := NewReloadableBackend("stuck", v, logger, transport.NewTransportPool(logger, v))
+	require.NoError(t, err)
+
+	clck := clock.NewMock(time.Unix(1000, 0))
+	drops := stats.NewDropAccounting(logger, 0)
+	ctx, cancel := context.WithCancel(stats.NewDropAccountingContext(clock.Context(context.Background(), clck), drops))
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rb.Run(ctx)
+	}()
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "counter", Value: 1, Type: gostatsd.COUNTER})
+	result := make(chan []error, 2)
+	rb.SendMetricsAsync(ctx, mm, func(errs []error) {
+		result <- errs
+	})
+	late := <-created[0].callbacks
+
+	// The send is failed once it has not completed within the timeout, and the backend is replaced
+	var errs []error
+	require.Eventually(t, func() bool {
+		clck.Add(time.Second)
+		select {
+		case errs = <-result:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), errWatchdog.Error())
+	assert.EqualValues(t, 1, drops.Total())
+	require.Len(t, created, 2)
+
+	// A send completed by the previous backend afterwards is ignored
+	late(nil)
+	select {
+	case <-result:
+		t.Fatal("completed twice")
+	default:
+	}
+
+	// New sends go to the new backend
+	rb.SendMetricsAsync(ctx, mm, func(errs []error) {
+		result <- errs
+	})
+	(<-created[1].callbacks)(nil)
+	assert.Empty(t, <-result)
+
+	cancel()
+	<-done
+}
@@ -8,12 +8,14 @@ import (
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/pkg/cachedinstances/k8s"
+	"github.com/hligit/gostatsd/pkg/cachedinstances/static"
 )
 
 var (
 	// All registered native CachedInstances implementations.
 	providers = map[string]gostatsd.CachedInstancesFactory{
-		k8s.ProviderName: k8s.NewProviderFromViper,
+		k8s.ProviderName:    k8s.NewProviderFromViper,
+		static.ProviderName: static.NewProviderFromViper,
 	}
 
 	ErrUnknownProvider = errors.New("unknown cloud provider")
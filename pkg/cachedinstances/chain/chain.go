@@ -0,0 +1,323 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+const (
+	// ProviderName is the name of the chain cloud provider.
+	ProviderName = "chain"
+
+	// ParamProviders is the ordered list of cloud providers to look up instances in.
+	ParamProviders = "providers"
+	// ParamMergeTags is true if the tags from every provider which found an instance should be merged, rather than
+	// using the first instance found.
+	ParamMergeTags = "merge-tags"
+
+	// DefaultMergeTags is the default for merging tags from all providers.
+	DefaultMergeTags = false
+)
+
+// Config holds the configuration of a chain.
+type Config struct {
+	// Providers is the ordered list of provider names.
+	Providers []string
+	// MergeTags is true if tags from every provider should be merged.
+	MergeTags bool
+}
+
+// ConfigFromViper reads the chain configuration.
+func ConfigFromViper(v *viper.Viper) (Config, error) {
+	c := util.GetSubViper(v, ProviderName)
+	c.SetDefault(ParamProviders, []string{})
+	c.SetDefault(ParamMergeTags, DefaultMergeTags)
+
+	providers := c.GetStringSlice(ParamProviders)
+	if len(providers) == 0 {
+		return Config{}, fmt.Errorf("%s.%s must list at least one cloud provider", ProviderName, ParamProviders)
+	}
+	for _, name := range providers {
+		if name == ProviderName {
+			return Config{}, fmt.Errorf("%s can not contain itself", ProviderName)
+		}
+	}
+	return Config{
+		Providers: providers,
+		MergeTags: c.GetBool(ParamMergeTags),
+	}, nil
+}
+
+// providerInfo is an InstanceInfo from the provider at index.
+type providerInfo struct {
+	index int
+	info  gostatsd.InstanceInfo
+}
+
+// lookup tracks the result of each provider for an IP which is being looked up.
+type lookup struct {
+	instances []*gostatsd.Instance
+	resolved  []bool
+}
+
+// Chain is a CachedInstances which looks up instances in an ordered list of CachedInstances.  The first provider
+// which finds an instance wins, unless tags are merged, in which case the ID is taken from the first provider which
+// found an instance and the tags of all providers which found an instance are combined.
+//
+// The providers are not run by Chain, they must be started independently.
+type Chain struct {
+	providers      []gostatsd.CachedInstances
+	mergeTags      bool
+	ipSinkSource   chan gostatsd.Source
+	infoSinkSource chan gostatsd.InstanceInfo
+}
+
+// New returns a new Chain of the providers, in order of priority.
+func New(providers []gostatsd.CachedInstances, mergeTags bool) (*Chain, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("a chain requires at least one provider")
+	}
+	return &Chain{
+		providers:      providers,
+		mergeTags:      mergeTags,
+		ipSinkSource:   make(chan gostatsd.Source),
+		infoSinkSource: make(chan gostatsd.InstanceInfo),
+	}, nil
+}
+
+func (c *Chain) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool /*is a cache hit*/) {
+	l := c.newLookup()
+	for i, p := range c.providers {
+		l.instances[i], l.resolved[i] = p.Peek(ip)
+		if !l.resolved[i] || (!c.mergeTags && l.instances[i] != nil) {
+			// Later providers can't change the outcome
+			break
+		}
+	}
+	return c.combine(l)
+}
+
+func (c *Chain) IpSink() chan<- gostatsd.Source {
+	return c.ipSinkSource
+}
+
+func (c *Chain) InfoSource() <-chan gostatsd.InstanceInfo {
+	return c.infoSinkSource
+}
+
+func (c *Chain) EstimatedTags() int {
+	result := 0
+	for _, p := range c.providers {
+		tags := p.EstimatedTags()
+		if c.mergeTags {
+			result += tags
+		} else if tags > result {
+			result = tags
+		}
+	}
+	return result
+}
+
+// RunMetrics runs the metrics of every provider which has them.
+func (c *Chain) RunMetrics(ctx context.Context, statser stats.Statser) {
+	var wg wait.Group
+	defer wg.Wait()
+	for _, p := range c.providers {
+		if me, ok := p.(interface {
+			RunMetrics(context.Context, stats.Statser)
+		}); ok {
+			wg.Start(func() {
+				me.RunMetrics(ctx, statser)
+			})
+		}
+	}
+}
+
+// CheckReady reports if every provider which can report readiness is ready.
+func (c *Chain) CheckReady() error {
+	for _, provider := range c.providers {
+		if checker, ok := provider.(gostatsd.ReadinessChecker); ok {
+			if err := checker.CheckReady(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Chain) Run(ctx context.Context) {
+	results := make(chan providerInfo)
+	ipSinks := make([]chan gostatsd.Source, len(c.providers))
+	var wg wait.Group
+	defer wg.Wait()
+	for i, p := range c.providers {
+		i, p := i, p
+		ipSinks[i] = make(chan gostatsd.Source)
+		wg.StartWithContext(ctx, func(ctx context.Context) {
+			runProvider(ctx, i, p, ipSinks[i], results)
+		})
+	}
+
+	var (
+		infoSink   chan<- gostatsd.InstanceInfo
+		info       gostatsd.InstanceInfo
+		infoToSend []gostatsd.InstanceInfo
+	)
+	pending := make(map[gostatsd.Source]*lookup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ip := <-c.ipSinkSource:
+			if _, ok := pending[ip]; ok {
+				// Already being looked up
+				break
+			}
+			l := c.newLookup()
+			for i, p := range c.providers {
+				l.instances[i], l.resolved[i] = p.Peek(ip)
+			}
+			if instance, ok := c.combine(l); ok {
+				infoToSend = append(infoToSend, gostatsd.InstanceInfo{IP: ip, Instance: instance})
+				break
+			}
+			pending[ip] = l
+			for i := range c.providers {
+				if l.resolved[i] {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case ipSinks[i] <- ip:
+				}
+			}
+		case result := <-results:
+			l, ok := pending[result.info.IP]
+			if !ok || l.resolved[result.index] {
+				break
+			}
+			l.instances[result.index] = result.info.Instance
+			l.resolved[result.index] = true
+			if instance, ok := c.combine(l); ok {
+				delete(pending, result.info.IP)
+				infoToSend = append(infoToSend, gostatsd.InstanceInfo{IP: result.info.IP, Instance: instance})
+			}
+		case infoSink <- info:
+			info = gostatsd.InstanceInfo{} // enable GC
+			infoSink = nil                 // info has been sent; if there is nothing to send, the case is disabled
+		}
+		if infoSink == nil && len(infoToSend) > 0 {
+			last := len(infoToSend) - 1
+			info = infoToSend[last]
+			infoToSend[last] = gostatsd.InstanceInfo{} // enable GC
+			infoToSend = infoToSend[:last]
+			infoSink = c.infoSinkSource
+		}
+	}
+}
+
+// runProvider sends IPs to the provider, and returns the information it provides as results, without ever blocking
+// either side.
+func runProvider(ctx context.Context, index int, p gostatsd.CachedInstances, ips <-chan gostatsd.Source, results chan<- providerInfo) {
+	var (
+		ipSink       chan<- gostatsd.Source
+		ip           gostatsd.Source
+		ipsToSend    []gostatsd.Source
+		resultSink   chan<- providerInfo
+		result       providerInfo
+		resultToSend []providerInfo
+	)
+	infoSource := p.InfoSource()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case newIP := <-ips:
+			ipsToSend = append(ipsToSend, newIP)
+		case ipSink <- ip:
+			ipSink = nil // ip has been sent; if there is nothing to send, the case is disabled
+		case info := <-infoSource:
+			resultToSend = append(resultToSend, providerInfo{index: index, info: info})
+		case resultSink <- result:
+			result = providerInfo{} // enable GC
+			resultSink = nil        // result has been sent; if there is nothing to send, the case is disabled
+		}
+		if ipSink == nil && len(ipsToSend) > 0 {
+			last := len(ipsToSend) - 1
+			ip = ipsToSend[last]
+			ipsToSend = ipsToSend[:last]
+			ipSink = p.IpSink()
+		}
+		if resultSink == nil && len(resultToSend) > 0 {
+			last := len(resultToSend) - 1
+			result = resultToSend[last]
+			resultToSend[last] = providerInfo{} // enable GC
+			resultToSend = resultToSend[:last]
+			resultSink = results
+		}
+	}
+}
+
+func (c *Chain) newLookup() *lookup {
+	return &lookup{
+		instances: make([]*gostatsd.Instance, len(c.providers)),
+		resolved:  make([]bool, len(c.providers)),
+	}
+}
+
+// combine returns the instance for an IP given the results from each provider, and true if enough providers have
+// resolved the IP to decide on the result.
+func (c *Chain) combine(l *lookup) (*gostatsd.Instance, bool) {
+	if !c.mergeTags {
+		for i, instance := range l.instances {
+			if !l.resolved[i] {
+				return nil, false
+			}
+			if instance != nil {
+				return instance, true
+			}
+		}
+		return nil, true
+	}
+
+	var result *gostatsd.Instance
+	for i, instance := range l.instances {
+		if !l.resolved[i] {
+			return nil, false
+		}
+		if instance == nil {
+			continue
+		}
+		if result == nil {
+			result = &gostatsd.Instance{
+				ID:   instance.ID,
+				Tags: instance.Tags.Copy(),
+			}
+			continue
+		}
+		for _, tag := range instance.Tags {
+			if !contains(result.Tags, tag) {
+				result.Tags = append(result.Tags, tag)
+			}
+		}
+	}
+	return result, true
+}
+
+func contains(tags gostatsd.Tags, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
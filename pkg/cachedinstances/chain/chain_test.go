@@ -0,0 +1,116 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+// fakeProvider only knows about IPs after they have been looked up through the IpSink.
+type fakeProvider struct {
+	ipSink     chan gostatsd.Source
+	infoSource chan gostatsd.InstanceInfo
+	instances  map[gostatsd.Source]*gostatsd.Instance
+	cached     map[gostatsd.Source]bool
+}
+
+func newFakeProvider(instances map[gostatsd.Source]*gostatsd.Instance) *fakeProvider {
+	return &fakeProvider{
+		ipSink:     make(chan gostatsd.Source),
+		infoSource: make(chan gostatsd.InstanceInfo),
+		instances:  instances,
+		cached:     make(map[gostatsd.Source]bool),
+	}
+}
+
+func (f *fakeProvider) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool) {
+	if !f.cached[ip] {
+		return nil, false
+	}
+	return f.instances[ip], true
+}
+func (f *fakeProvider) IpSink() chan<- gostatsd.Source           { return f.ipSink }
+func (f *fakeProvider) InfoSource() <-chan gostatsd.InstanceInfo { return f.infoSource }
+func (f *fakeProvider) EstimatedTags() int                       { return 2 }
+
+// lookup resolves an IP in the fake provider, as its Run method would.
+func (f *fakeProvider) lookup() {
+	ip := <-f.ipSink
+	f.cached[ip] = true
+	f.infoSource <- gostatsd.InstanceInfo{IP: ip, Instance: f.instances[ip]}
+}
+
+func TestChain(t *testing.T) {
+	t.Parallel()
+	first := newFakeProvider(map[gostatsd.Source]*gostatsd.Instance{
+		"10.0.0.1": {ID: "pod-1", Tags: gostatsd.Tags{"pod:1"}},
+	})
+	second := newFakeProvider(map[gostatsd.Source]*gostatsd.Instance{
+		"10.0.0.1": {ID: "i-1", Tags: gostatsd.Tags{"instance:1"}},
+		"10.0.0.2": {ID: "i-2", Tags: gostatsd.Tags{"instance:2"}},
+	})
+	c, err := New([]gostatsd.CachedInstances{first, second}, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, c.EstimatedTags())
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg.StartWithContext(ctx, c.Run)
+
+	_, cacheHit := c.Peek("10.0.0.2")
+	assert.False(t, cacheHit)
+	c.IpSink() <- "10.0.0.2"
+	first.lookup()
+	second.lookup()
+	info := <-c.InfoSource()
+	assert.Equal(t, gostatsd.InstanceInfo{IP: "10.0.0.2", Instance: second.instances["10.0.0.2"]}, info)
+
+	// The first provider wins, without the second being consulted
+	c.IpSink() <- "10.0.0.1"
+	first.lookup()
+	info = <-c.InfoSource()
+	assert.Equal(t, gostatsd.InstanceInfo{IP: "10.0.0.1", Instance: first.instances["10.0.0.1"]}, info)
+
+	instance, cacheHit := c.Peek("10.0.0.1")
+	assert.True(t, cacheHit)
+	assert.Equal(t, first.instances["10.0.0.1"], instance)
+}
+
+func TestChainMergeTags(t *testing.T) {
+	t.Parallel()
+	first := newFakeProvider(map[gostatsd.Source]*gostatsd.Instance{
+		"10.0.0.1": {ID: "pod-1", Tags: gostatsd.Tags{"pod:1", "env:prod"}},
+	})
+	second := newFakeProvider(map[gostatsd.Source]*gostatsd.Instance{
+		"10.0.0.1": {ID: "i-1", Tags: gostatsd.Tags{"instance:1", "env:prod"}},
+	})
+	c, err := New([]gostatsd.CachedInstances{first, second}, true)
+	require.NoError(t, err)
+	assert.Equal(t, 4, c.EstimatedTags())
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg.StartWithContext(ctx, c.Run)
+
+	c.IpSink() <- "10.0.0.1"
+	first.lookup()
+	second.lookup()
+	info := <-c.InfoSource()
+	expected := &gostatsd.Instance{ID: "pod-1", Tags: gostatsd.Tags{"pod:1", "env:prod", "instance:1"}}
+	assert.Equal(t, expected, info.Instance)
+
+	instance, cacheHit := c.Peek("10.0.0.1")
+	assert.True(t, cacheHit)
+	assert.Equal(t, expected, instance)
+	// The original instance must not be modified
+	assert.Equal(t, gostatsd.Tags{"pod:1", "env:prod"}, first.instances["10.0.0.1"].Tags)
+}
@@ -2,6 +2,7 @@ package cloudprovider
 
 import (
 	"context"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,6 +26,7 @@ func NewCachedCloudProvider(logger logrus.FieldLogger, limiter *rate.Limiter, cl
 		infoSinkSource: make(chan gostatsd.InstanceInfo),
 		emitChan:       make(chan stats.Statser),
 		cache:          make(map[gostatsd.Source]*instanceHolder),
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
@@ -34,6 +36,16 @@ type CachedCloudProvider struct {
 	statsCacheRefreshNegative uint64 // Cumulative number of negative refreshes (ie, a refresh which failed and used old data)
 	statsCachePositive        uint64 // Absolute number of positive entries in cache
 	statsCacheNegative        uint64 // Absolute number of negative entries in cache
+	statsLookupFound          uint64 // Cumulative number of lookups which found an instance
+	statsLookupNotFound       uint64 // Cumulative number of lookups which did not find an instance
+	statsLookupFailed         uint64 // Cumulative number of lookups which failed
+	statsCacheBytes           int64  // Absolute estimated memory used by the cache
+	statsCacheEvictedIdle     uint64 // Cumulative number of entries evicted because they were not used recently
+	statsCacheEvictedLimit    uint64 // Cumulative number of entries evicted because the cache was full
+
+	// These fields must be accessed atomically
+	statsCacheHit  uint64 // Cumulative number of Peek calls which found an entry
+	statsCacheMiss uint64 // Cumulative number of Peek calls which did not find an entry
 
 	logger         logrus.FieldLogger
 	limiter        *rate.Limiter
@@ -42,12 +54,15 @@ type CachedCloudProvider struct {
 	ipSinkSource   chan gostatsd.Source
 	infoSinkSource chan gostatsd.InstanceInfo
 
+	// dispatcher is only set while Run is running
+	dispatcher *cloudProviderLookupDispatcher
 	// emitChan triggers a write of all the current stats when it is given a Statser
 	emitChan     chan stats.Statser
 	rw           sync.RWMutex // Protects cache
 	cache        map[gostatsd.Source]*instanceHolder
 	toLookupIPs  []gostatsd.Source
 	toReturnInfo []gostatsd.InstanceInfo
+	rand         *rand.Rand // Only used by the Run goroutine
 }
 
 func (ccp *CachedCloudProvider) Run(ctx context.Context) {
@@ -61,14 +76,16 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 	)
 	// this goroutine needs to populate/update the cache so an intermediate InstanceInfo channel is used below that allows
 	// to intercept, update the cache and then push the information through to the cache consumer.
-	ownInfoSource := make(chan gostatsd.InstanceInfo)
-	ld := cloudProviderLookupDispatcher{
+	ownInfoSource := make(chan lookupResult)
+	ld := &cloudProviderLookupDispatcher{
 		logger:        ccp.logger,
 		limiter:       ccp.limiter,
 		cloudProvider: ccp.cloudProvider,
+		maxConcurrent: ccp.cacheOpts.MaxConcurrentLookups,
 		ipSource:      ccp.ipSinkSource, // our sink is their source
 		infoSink:      ownInfoSource,    // their sink is our source
 	}
+	ccp.dispatcher = ld
 
 	defer wg.Wait() // Wait for cloudProviderLookupDispatcher to stop
 
@@ -80,6 +97,15 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 	refreshTicker := clck.NewTicker(ccp.cacheOpts.CacheRefreshPeriod)
 
 	defer refreshTicker.Stop()
+
+	var persistC <-chan time.Time
+	if ccp.cacheOpts.CachePersistDir != "" {
+		ccp.loadCache(clck.Now())
+		ccp.enforceLimits(gostatsd.UnknownSource)
+		persistTicker := clck.NewTicker(ccp.cacheOpts.CachePersistPeriod)
+		defer persistTicker.Stop()
+		persistC = persistTicker.C
+	}
 	// No locking for ccp.cache READ access required - this goroutine owns the object and only it mutates it.
 	// So reads from the same goroutine are always safe (no concurrent mutations).
 	// When we mutate the cache, we hold the exclusive (write) lock to avoid concurrent reads.
@@ -87,6 +113,7 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
+			ccp.saveCache()
 			return
 		case toLookupC <- toLookupIP:
 			toLookupIP = gostatsd.UnknownSource // enable GC
@@ -94,10 +121,12 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 		case toReturnInfoC <- toReturnInfo:
 			toReturnInfo = gostatsd.InstanceInfo{} // enable GC
 			toReturnInfoC = nil                    // info has been sent; if there is nothing to send, the case is disabled
-		case info := <-ownInfoSource:
-			ccp.handleInstanceInfo(info)
+		case result := <-ownInfoSource:
+			ccp.handleLookupResult(result)
 		case t := <-refreshTicker.C:
 			ccp.doRefresh(t)
+		case <-persistC:
+			ccp.saveCache()
 		case statser := <-ccp.emitChan:
 			ccp.emit(statser)
 		}
@@ -119,12 +148,18 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 }
 
 func (ccp *CachedCloudProvider) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool /*is a cache hit*/) {
+	if _, ok := ip.ContainerID(); ok {
+		// Cloud providers look up instances by IP, and a container is not an instance
+		return nil, true
+	}
 	ccp.rw.RLock()
 	holder, existsInCache := ccp.cache[ip]
 	ccp.rw.RUnlock()
 	if !existsInCache {
+		atomic.AddUint64(&ccp.statsCacheMiss, 1)
 		return nil, false
 	}
+	atomic.AddUint64(&ccp.statsCacheHit, 1)
 	holder.updateAccess()
 	return holder.instance, true // can be nil, true
 }
@@ -171,11 +206,26 @@ func (ccp *CachedCloudProvider) scheduleEmit(ctx context.Context, statser stats.
 }
 
 func (ccp *CachedCloudProvider) emit(statser stats.Statser) {
+	statser = statser.WithTags(gostatsd.Tags{"provider:" + ccp.cloudProvider.Name()})
+	ageMean, ageMax := ccp.cacheAge(time.Now())
 	// regular
 	statser.Gauge("cloudprovider.cache_positive", float64(ccp.statsCachePositive), nil)
 	statser.Gauge("cloudprovider.cache_negative", float64(ccp.statsCacheNegative), nil)
 	statser.Gauge("cloudprovider.cache_refresh_positive", float64(ccp.statsCacheRefreshPositive), nil)
 	statser.Gauge("cloudprovider.cache_refresh_negative", float64(ccp.statsCacheRefreshNegative), nil)
+	statser.Gauge("cloudprovider.cache_bytes", float64(ccp.statsCacheBytes), nil)
+	statser.Gauge("cloudprovider.cache_hit", float64(atomic.LoadUint64(&ccp.statsCacheHit)), nil)
+	statser.Gauge("cloudprovider.cache_miss", float64(atomic.LoadUint64(&ccp.statsCacheMiss)), nil)
+	statser.Gauge("cloudprovider.cache_evicted", float64(ccp.statsCacheEvictedIdle), gostatsd.Tags{"reason:idle"})
+	statser.Gauge("cloudprovider.cache_evicted", float64(ccp.statsCacheEvictedLimit), gostatsd.Tags{"reason:limit"})
+	statser.Gauge("cloudprovider.cache_age_mean_ms", float64(ageMean)/float64(time.Millisecond), nil)
+	statser.Gauge("cloudprovider.cache_age_max_ms", float64(ageMax)/float64(time.Millisecond), nil)
+	statser.Gauge("cloudprovider.lookup_found", float64(ccp.statsLookupFound), nil)
+	statser.Gauge("cloudprovider.lookup_not_found", float64(ccp.statsLookupNotFound), nil)
+	statser.Gauge("cloudprovider.lookup_failed", float64(ccp.statsLookupFailed), nil)
+	statser.Gauge("cloudprovider.lookup_queued", float64(len(ccp.toLookupIPs)+int(atomic.LoadInt64(&ccp.dispatcher.statsQueued))), nil)
+	statser.Gauge("cloudprovider.lookup_throttled", float64(atomic.LoadUint64(&ccp.dispatcher.statsThrottled)), nil)
+	statser.Gauge("cloudprovider.lookup_throttled_ms", float64(atomic.LoadUint64(&ccp.dispatcher.statsThrottledTime))/float64(time.Millisecond), nil)
 }
 
 func (ccp *CachedCloudProvider) doRefresh(t time.Time) {
@@ -187,12 +237,8 @@ func (ccp *CachedCloudProvider) doRefresh(t time.Time) {
 		if now-holder.lastAccess() > idleNano {
 			// Entry was not used recently, remove it.
 			toDelete = append(toDelete, ip)
-			if holder.instance == nil {
-				ccp.statsCacheNegative--
-			} else {
-				ccp.statsCachePositive--
-			}
-		} else if t.After(holder.expires) {
+			ccp.forget(holder)
+		} else if t.After(holder.refresh) {
 			// Entry needs a refresh.
 			ccp.toLookupIPs = append(ccp.toLookupIPs, ip)
 		}
@@ -204,22 +250,40 @@ func (ccp *CachedCloudProvider) doRefresh(t time.Time) {
 		for _, ip := range toDelete {
 			delete(ccp.cache, ip)
 		}
+		ccp.statsCacheEvictedIdle += uint64(len(toDelete))
 	}
 }
 
-func (ccp *CachedCloudProvider) handleInstanceInfo(info gostatsd.InstanceInfo) {
-	var ttl time.Duration
-	if info.Instance == nil {
+func (ccp *CachedCloudProvider) handleLookupResult(result lookupResult) {
+	info := result.info
+	currentHolder := ccp.cache[info.IP]
+	var (
+		ttl      time.Duration
+		failures int
+	)
+	switch {
+	case result.failed:
+		ccp.statsLookupFailed++
+		if currentHolder != nil {
+			failures = currentHolder.failures
+		}
+		failures++
+		ttl = ccp.retryBackoff(failures)
+	case info.Instance == nil:
+		ccp.statsLookupNotFound++
 		ttl = ccp.cacheOpts.CacheNegativeTTL
-	} else {
+	default:
+		ccp.statsLookupFound++
 		ttl = ccp.cacheOpts.CacheTTL
 	}
 	now := time.Now()
 	newHolder := &instanceHolder{
 		expires:  now.Add(ttl),
+		refresh:  now.Add(ttl),
+		updated:  now,
 		instance: info.Instance,
+		failures: failures,
 	}
-	currentHolder := ccp.cache[info.IP]
 	if currentHolder == nil {
 		// Not in cache, count it
 		if info.Instance == nil {
@@ -230,7 +294,9 @@ func (ccp *CachedCloudProvider) handleInstanceInfo(info gostatsd.InstanceInfo) {
 		newHolder.lastAccessNano = now.UnixNano()
 	} else {
 		// In cache, don't count it
+		ccp.statsCacheBytes -= currentHolder.size
 		newHolder.lastAccessNano = currentHolder.lastAccess()
+		newHolder.hits = atomic.LoadUint64(&currentHolder.hits)
 		if info.Instance == nil {
 			// Use the old instance if there was a lookup error.
 			newHolder.instance = currentHolder.instance
@@ -244,20 +310,56 @@ func (ccp *CachedCloudProvider) handleInstanceInfo(info gostatsd.InstanceInfo) {
 			ccp.statsCacheRefreshPositive++
 		}
 	}
+	if !result.failed && ccp.cacheOpts.CacheRefreshJitter > 0 {
+		// Refresh early, so changes are picked up before the entry expires, and refreshes of entries looked up at the
+		// same time are spread out.
+		early := time.Duration(ccp.rand.Float64() * ccp.cacheOpts.CacheRefreshJitter * float64(ttl))
+		newHolder.refresh = newHolder.expires.Add(-early)
+	}
+	newHolder.size = holderSize(info.IP, newHolder)
+	ccp.statsCacheBytes += newHolder.size
 	ccp.rw.Lock()
 	ccp.cache[info.IP] = newHolder
 	ccp.rw.Unlock()
+	if currentHolder == nil {
+		ccp.enforceLimits(info.IP)
+	}
 	ccp.toReturnInfo = append(ccp.toReturnInfo, info)
 }
 
+// retryBackoff returns how long until a lookup which has failed the provided number of consecutive times is retried.
+func (ccp *CachedCloudProvider) retryBackoff(failures int) time.Duration {
+	backoff := ccp.cacheOpts.CacheRetryBackoff
+	if backoff <= 0 {
+		backoff = ccp.cacheOpts.CacheNegativeTTL
+	}
+	maxBackoff := ccp.cacheOpts.CacheRetryMaxBackoff
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
 type instanceHolder struct {
 	lastAccessNano int64
+	hits           uint64             // The number of times the entry was used, must be accessed atomically
 	expires        time.Time          // When this record expires.
+	refresh        time.Time          // When this record is refreshed, at or before expires.
+	updated        time.Time          // When this record was last looked up.
 	instance       *gostatsd.Instance // Can be nil if the lookup resulted in an error or instance was not found
+	failures       int                // The number of consecutive failed lookups
+	size           int64              // The estimated memory used by the entry
 }
 
 func (ih *instanceHolder) updateAccess() {
 	atomic.StoreInt64(&ih.lastAccessNano, time.Now().UnixNano())
+	atomic.AddUint64(&ih.hits, 1)
 }
 
 func (ih *instanceHolder) lastAccess() int64 {
@@ -0,0 +1,118 @@
+package cloudprovider
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hligit/gostatsd"
+)
+
+const (
+	// holderOverhead is a rough estimate of the bytes used by an instanceHolder, its map entry, and the
+	// gostatsd.Instance, excluding the strings.
+	holderOverhead = 160
+	// evictionLowWater is the fraction of a limit the cache is trimmed to when it goes over the limit, so a full cache
+	// is not sorted for every new entry.
+	evictionLowWater = 0.9
+)
+
+// holderSize returns the estimated memory used by a cache entry.
+func holderSize(ip gostatsd.Source, holder *instanceHolder) int64 {
+	size := int64(holderOverhead + len(ip))
+	if holder.instance != nil {
+		size += int64(len(holder.instance.ID))
+		for _, tag := range holder.instance.Tags {
+			size += int64(len(tag)) + 16 // string header
+		}
+	}
+	return size
+}
+
+// forget removes the entry from the stats, but not from the cache.  It must only be called from the Run goroutine.
+func (ccp *CachedCloudProvider) forget(holder *instanceHolder) {
+	if holder.instance == nil {
+		ccp.statsCacheNegative--
+	} else {
+		ccp.statsCachePositive--
+	}
+	ccp.statsCacheBytes -= holder.size
+}
+
+// overLimit returns true if the cache has more entries or uses more memory than the limits scaled by fraction.
+func (ccp *CachedCloudProvider) overLimit(entries int, bytes int64, fraction float64) bool {
+	if ccp.cacheOpts.CacheMaxEntries > 0 && float64(entries) > float64(ccp.cacheOpts.CacheMaxEntries)*fraction {
+		return true
+	}
+	return ccp.cacheOpts.CacheMaxBytes > 0 && float64(bytes) > float64(ccp.cacheOpts.CacheMaxBytes)*fraction
+}
+
+// enforceLimits evicts entries according to the eviction policy if the cache is over CacheMaxEntries or
+// CacheMaxBytes, until it is under evictionLowWater of them.  The entry for keep is never evicted, so a new entry is
+// not evicted before it is used.  It must only be called from the Run goroutine.
+func (ccp *CachedCloudProvider) enforceLimits(keep gostatsd.Source) {
+	if !ccp.overLimit(len(ccp.cache), ccp.statsCacheBytes, 1) {
+		return
+	}
+
+	type candidate struct {
+		ip         gostatsd.Source
+		holder     *instanceHolder
+		lastAccess int64
+		hits       uint64
+	}
+	// No lock is required, this goroutine is the only one mutating the cache
+	candidates := make([]candidate, 0, len(ccp.cache))
+	for ip, holder := range ccp.cache {
+		if ip == keep {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			ip:         ip,
+			holder:     holder,
+			lastAccess: holder.lastAccess(),
+			hits:       atomic.LoadUint64(&holder.hits),
+		})
+	}
+	lfu := ccp.cacheOpts.CacheEvictionPolicy == gostatsd.CacheEvictionLFU
+	sort.Slice(candidates, func(i, j int) bool {
+		if lfu && candidates[i].hits != candidates[j].hits {
+			return candidates[i].hits < candidates[j].hits
+		}
+		return candidates[i].lastAccess < candidates[j].lastAccess
+	})
+
+	entries := len(ccp.cache)
+	bytes := ccp.statsCacheBytes
+	var evict int
+	for evict < len(candidates) && ccp.overLimit(entries, bytes, evictionLowWater) {
+		entries--
+		bytes -= candidates[evict].holder.size
+		evict++
+	}
+
+	ccp.rw.Lock()
+	defer ccp.rw.Unlock()
+	for _, c := range candidates[:evict] {
+		ccp.forget(c.holder)
+		delete(ccp.cache, c.ip)
+	}
+	ccp.statsCacheEvictedLimit += uint64(evict)
+}
+
+// cacheAge returns the mean and maximum time since the entries in the cache were looked up.  It must only be called
+// from the Run goroutine.
+func (ccp *CachedCloudProvider) cacheAge(now time.Time) (mean, max time.Duration) {
+	if len(ccp.cache) == 0 {
+		return 0, 0
+	}
+	var total time.Duration
+	for _, holder := range ccp.cache {
+		age := now.Sub(holder.updated)
+		total += age
+		if age > max {
+			max = age
+		}
+	}
+	return total / time.Duration(len(ccp.cache)), max
+}
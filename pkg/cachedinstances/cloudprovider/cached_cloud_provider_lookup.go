@@ -2,27 +2,53 @@ package cloudprovider
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
+	"github.com/ash2k/stager/wait"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 
 	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/tracing"
 )
 
 const (
 	batchDuration = 10 * time.Millisecond
 )
 
+// lookupResult is the outcome of looking up an IP.
+type lookupResult struct {
+	info gostatsd.InstanceInfo
+	// failed is true if the lookup failed, rather than the instance not being found.  info.Instance is always nil if
+	// the lookup failed.
+	failed bool
+}
+
 type cloudProviderLookupDispatcher struct {
+	// These fields must be accessed atomically
+	statsThrottled     uint64 // Cumulative number of lookup batches which were delayed by the rate limiter
+	statsThrottledTime uint64 // Cumulative nanoseconds lookup batches were delayed by the rate limiter
+	statsQueued        int64  // Absolute number of ips received but not yet sent to the cloud provider
+
 	logger        logrus.FieldLogger
 	limiter       *rate.Limiter
 	cloudProvider gostatsd.CloudProvider
+	maxConcurrent int
 	ipSource      <-chan gostatsd.Source
-	infoSink      chan<- gostatsd.InstanceInfo
+	infoSink      chan<- lookupResult
 }
 
 func (ld *cloudProviderLookupDispatcher) run(ctx context.Context) {
+	var wg wait.Group
+	defer wg.Wait()
+	maxConcurrent := ld.maxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	inFlight := make(chan struct{}, maxConcurrent)
+
 	maxLookupIPs := ld.cloudProvider.MaxInstancesBatch()
 	ips := make([]gostatsd.Source, 0, maxLookupIPs)
 	var c <-chan time.Time
@@ -31,6 +57,7 @@ func (ld *cloudProviderLookupDispatcher) run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case ip := <-ld.ipSource:
+			atomic.AddInt64(&ld.statsQueued, 1)
 			ips = append(ips, ip)
 			if len(ips) >= maxLookupIPs {
 				break // enough ips, exit select
@@ -43,33 +70,73 @@ func (ld *cloudProviderLookupDispatcher) run(ctx context.Context) {
 		}
 		c = nil
 
-		if err := ld.limiter.Wait(ctx); err != nil {
-			if err != context.Canceled && err != context.DeadlineExceeded {
-				// This could be an error caused by context signaling done.
-				// Or something nasty but it is very unlikely.
-				ld.logger.Warnf("Error from limiter: %v", err)
-			}
+		if !ld.wait(ctx) {
 			return
 		}
-		ld.doLookup(ctx, ips)
-		for i := range ips { // cleanup pointers for GC
-			ips[i] = gostatsd.UnknownSource
+		select {
+		case <-ctx.Done():
+			return
+		case inFlight <- struct{}{}:
 		}
-		ips = ips[:0] // reset slice
+		batch := ips
+		atomic.AddInt64(&ld.statsQueued, -int64(len(batch)))
+		wg.Start(func() {
+			defer func() { <-inFlight }()
+			ld.doLookup(ctx, batch)
+		})
+		ips = make([]gostatsd.Source, 0, maxLookupIPs)
+	}
+}
+
+// wait blocks until the rate limiter allows a lookup, and returns false if the context is done first.
+func (ld *cloudProviderLookupDispatcher) wait(ctx context.Context) bool {
+	r := ld.limiter.Reserve()
+	if !r.OK() {
+		// Only happens if the burst is 0, which would block forever
+		ld.logger.Warn("Rate limiter does not allow any cloud provider lookups")
+		<-ctx.Done()
+		return false
+	}
+	delay := r.Delay()
+	if delay <= 0 {
+		return true
+	}
+	atomic.AddUint64(&ld.statsThrottled, 1)
+	atomic.AddUint64(&ld.statsThrottledTime, uint64(delay))
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return false
+	case <-t.C:
+		return true
 	}
 }
 
 func (ld *cloudProviderLookupDispatcher) doLookup(ctx context.Context, ips []gostatsd.Source) {
+	lookupCtx, span := tracing.Start(ctx, "cloudprovider.lookup",
+		tracing.CloudProviderKey.String(ld.cloudProvider.Name()),
+		tracing.IPsKey.Int(len(ips)),
+	)
+	lookupTimer := stats.FromContext(ctx).NewTimer("cloudprovider.lookup_time", gostatsd.Tags{"provider:" + ld.cloudProvider.Name()})
 	// instances may contain partial result even if err != nil
-	instances, err := ld.cloudProvider.Instance(ctx, ips...)
+	instances, err := ld.cloudProvider.Instance(lookupCtx, ips...)
+	lookupTimer.Send()
+	span.SetAttributes(tracing.InstancesKey.Int(len(instances)))
+	tracing.End(span, err)
 	if err != nil {
 		// Something bad happened, but process what we have still
 		ld.logger.Infof("Error retrieving instance details from cloud provider: %v", err)
 	}
 	for _, ip := range ips {
-		res := gostatsd.InstanceInfo{
-			IP:       ip,
-			Instance: instances[ip],
+		instance := instances[ip]
+		res := lookupResult{
+			info: gostatsd.InstanceInfo{
+				IP:       ip,
+				Instance: instance,
+			},
+			failed: err != nil && instance == nil,
 		}
 		select {
 		case <-ctx.Done():
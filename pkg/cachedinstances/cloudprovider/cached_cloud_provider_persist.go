@@ -0,0 +1,157 @@
+package cloudprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+)
+
+// persistVersion is the version of the persisted cache format.  A file with a different version is ignored.
+const persistVersion = 1
+
+type persistedCache struct {
+	Version  int               `json:"version"`
+	Provider string            `json:"provider"`
+	Entries  []persistedHolder `json:"entries"`
+}
+
+type persistedHolder struct {
+	IP      gostatsd.Source `json:"ip"`
+	Expires time.Time       `json:"expires"`
+	// Instance is nil for negative entries
+	Instance *persistedInstance `json:"instance,omitempty"`
+}
+
+type persistedInstance struct {
+	ID   gostatsd.Source `json:"id"`
+	Tags gostatsd.Tags   `json:"tags"`
+}
+
+// persistFile returns the path the cache is persisted to, or "" if persistence is disabled.
+func (ccp *CachedCloudProvider) persistFile() string {
+	if ccp.cacheOpts.CachePersistDir == "" {
+		return ""
+	}
+	return filepath.Join(ccp.cacheOpts.CachePersistDir, "cloud-cache-"+ccp.cloudProvider.Name()+".json")
+}
+
+// loadCache populates the cache from the persisted file, if there is one.  It must only be called from the Run
+// goroutine.
+func (ccp *CachedCloudProvider) loadCache(now time.Time) {
+	file := ccp.persistFile()
+	if file == "" {
+		return
+	}
+	logger := ccp.logger.WithField("file", file)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.WithError(err).Warn("failed to read persisted cloud cache")
+		}
+		return
+	}
+	var pc persistedCache
+	if err := json.Unmarshal(data, &pc); err != nil {
+		logger.WithError(err).Warn("failed to parse persisted cloud cache")
+		return
+	}
+	if pc.Version != persistVersion || pc.Provider != ccp.cloudProvider.Name() {
+		logger.WithFields(logrus.Fields{
+			"version":  pc.Version,
+			"provider": pc.Provider,
+		}).Info("ignoring persisted cloud cache from a different version or provider")
+		return
+	}
+
+	ccp.rw.Lock()
+	defer ccp.rw.Unlock()
+	for _, entry := range pc.Entries {
+		if _, ok := ccp.cache[entry.IP]; ok {
+			continue
+		}
+		// Expired entries are still loaded, so there is something to use until they are refreshed
+		holder := &instanceHolder{
+			lastAccessNano: now.UnixNano(),
+			expires:        entry.Expires,
+			refresh:        entry.Expires,
+			updated:        now,
+		}
+		if entry.Instance == nil {
+			ccp.statsCacheNegative++
+		} else {
+			holder.instance = &gostatsd.Instance{
+				ID:   entry.Instance.ID,
+				Tags: entry.Instance.Tags,
+			}
+			ccp.statsCachePositive++
+		}
+		holder.size = holderSize(entry.IP, holder)
+		ccp.statsCacheBytes += holder.size
+		ccp.cache[entry.IP] = holder
+	}
+	logger.WithField("entries", len(pc.Entries)).Info("loaded persisted cloud cache")
+}
+
+// saveCache writes the cache to the persisted file.  It must only be called from the Run goroutine.
+func (ccp *CachedCloudProvider) saveCache() {
+	file := ccp.persistFile()
+	if file == "" {
+		return
+	}
+	pc := persistedCache{
+		Version:  persistVersion,
+		Provider: ccp.cloudProvider.Name(),
+		Entries:  make([]persistedHolder, 0, len(ccp.cache)),
+	}
+	// No lock is required, this goroutine is the only one mutating the cache
+	for ip, holder := range ccp.cache {
+		entry := persistedHolder{
+			IP:      ip,
+			Expires: holder.expires,
+		}
+		if holder.instance != nil {
+			entry.Instance = &persistedInstance{
+				ID:   holder.instance.ID,
+				Tags: holder.instance.Tags,
+			}
+		}
+		pc.Entries = append(pc.Entries, entry)
+	}
+	if err := writeFileAtomic(file, &pc); err != nil {
+		ccp.logger.WithError(err).WithField("file", file).Warn("failed to persist cloud cache")
+	}
+}
+
+// writeFileAtomic writes v as json to a temporary file, then renames it over file so a partially written file is
+// never read.
+func writeFileAtomic(file string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to rename %s: %v", tmp.Name(), err)
+	}
+	return nil
+}
@@ -2,6 +2,10 @@ package cloudprovider
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -66,3 +70,193 @@ func TestCachedCloudProviderExpirationAndRefresh(t *testing.T) {
 	assert.GreaterOrEqual(t, len(fp.IPs()), 2) // Ensure it does at least 1 lookup + 1 refresh
 	assert.Zero(t, len(ci.cache))              // Ensure it eventually expired
 }
+
+func TestCachedCloudProviderPersistence(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "cloudcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cacheOpts := gostatsd.CacheOptions{
+		CacheRefreshPeriod:        time.Hour,
+		CacheEvictAfterIdlePeriod: time.Hour,
+		CacheTTL:                  time.Hour,
+		CacheNegativeTTL:          time.Hour,
+		CachePersistDir:           dir,
+		CachePersistPeriod:        time.Hour,
+	}
+	const ip gostatsd.Source = "1.2.3.4"
+
+	// Lookup an IP, and persist it on shutdown
+	fp := &fakeprovider.IP{}
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), fp, cacheOpts)
+	var wg wait.Group
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	wg.StartWithContext(ctx, ci.Run)
+	ci.IpSink() <- ip
+	info := <-ci.InfoSource()
+	require.NotNil(t, info.Instance)
+	cancelFunc()
+	wg.Wait()
+
+	// A new provider has the IP cached without a lookup
+	fp = &fakeprovider.IP{}
+	ci = NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), fp, cacheOpts)
+	defer wg.Wait()
+	ctx, cancelFunc = context.WithCancel(context.Background())
+	defer cancelFunc()
+	wg.StartWithContext(ctx, ci.Run)
+	require.Eventually(t, func() bool {
+		_, cacheHit := ci.Peek(ip)
+		return cacheHit
+	}, time.Second, 10*time.Millisecond)
+	instance, _ := ci.Peek(ip)
+	assert.Equal(t, info.Instance, instance)
+	assert.Empty(t, fp.IPs())
+}
+
+func TestCachedCloudProviderRetryBackoff(t *testing.T) {
+	t.Parallel()
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), &fakeprovider.Failing{}, gostatsd.CacheOptions{
+		CacheTTL:             time.Hour,
+		CacheNegativeTTL:     time.Minute,
+		CacheRetryBackoff:    time.Second,
+		CacheRetryMaxBackoff: 5 * time.Second,
+	})
+	const ip gostatsd.Source = "1.2.3.4"
+	failed := lookupResult{info: gostatsd.InstanceInfo{IP: ip}, failed: true}
+
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		before := time.Now()
+		ci.handleLookupResult(failed)
+		holder := ci.cache[ip]
+		assert.WithinDuration(t, before.Add(expected), holder.expires, 500*time.Millisecond)
+	}
+	assert.EqualValues(t, 5, ci.cache[ip].failures)
+	assert.EqualValues(t, 5, ci.statsLookupFailed)
+
+	// A lookup which doesn't fail resets the backoff
+	ci.handleLookupResult(lookupResult{info: gostatsd.InstanceInfo{IP: ip}})
+	assert.Zero(t, ci.cache[ip].failures)
+	assert.EqualValues(t, 1, ci.statsLookupNotFound)
+	before := time.Now()
+	ci.handleLookupResult(failed)
+	assert.WithinDuration(t, before.Add(time.Second), ci.cache[ip].expires, 500*time.Millisecond)
+
+	ci.handleLookupResult(lookupResult{info: gostatsd.InstanceInfo{IP: ip, Instance: &gostatsd.Instance{ID: "i-1"}}})
+	assert.Zero(t, ci.cache[ip].failures)
+	assert.EqualValues(t, 1, ci.statsLookupFound)
+}
+
+func TestCachedCloudProviderLookupThrottled(t *testing.T) {
+	t.Parallel()
+	ld := &cloudProviderLookupDispatcher{
+		logger:  logrus.StandardLogger(),
+		limiter: rate.NewLimiter(rate.Every(50*time.Millisecond), 1),
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	require.True(t, ld.wait(ctx))
+	assert.Zero(t, ld.statsThrottled)
+	require.True(t, ld.wait(ctx))
+	assert.EqualValues(t, 1, ld.statsThrottled)
+	assert.NotZero(t, ld.statsThrottledTime)
+
+	cancelFunc()
+	require.False(t, ld.wait(ctx))
+}
+
+func TestCachedCloudProviderEviction(t *testing.T) {
+	t.Parallel()
+	newProvider := func(policy string) *CachedCloudProvider {
+		ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), &fakeprovider.IP{}, gostatsd.CacheOptions{
+			CacheTTL:            time.Hour,
+			CacheNegativeTTL:    time.Minute,
+			CacheMaxEntries:     10,
+			CacheEvictionPolicy: policy,
+		})
+		for i := 0; i < 10; i++ {
+			ci.handleLookupResult(lookupResult{info: gostatsd.InstanceInfo{IP: gostatsd.Source(fmt.Sprintf("10.0.0.%d", i))}})
+			// Entries must be ordered by last access
+			ci.cache[gostatsd.Source(fmt.Sprintf("10.0.0.%d", i))].lastAccessNano = int64(i)
+		}
+		require.Len(t, ci.cache, 10)
+		return ci
+	}
+
+	ci := newProvider(gostatsd.CacheEvictionLRU)
+	ci.Peek("10.0.0.0")
+	ci.Peek("10.0.0.1")
+	ci.handleLookupResult(lookupResult{info: gostatsd.InstanceInfo{IP: "10.0.0.10"}})
+	assert.Len(t, ci.cache, 9) // trimmed below the limit
+	assert.Contains(t, ci.cache, gostatsd.Source("10.0.0.0"))
+	assert.Contains(t, ci.cache, gostatsd.Source("10.0.0.1"))
+	assert.NotContains(t, ci.cache, gostatsd.Source("10.0.0.2"))
+	assert.NotContains(t, ci.cache, gostatsd.Source("10.0.0.3"))
+	assert.Contains(t, ci.cache, gostatsd.Source("10.0.0.10"))
+	assert.EqualValues(t, 2, ci.statsCacheEvictedLimit)
+	assert.EqualValues(t, 9, ci.statsCacheNegative)
+
+	ci = newProvider(gostatsd.CacheEvictionLFU)
+	for i := 0; i < 10; i++ {
+		if i != 7 && i != 8 {
+			ci.Peek(gostatsd.Source(fmt.Sprintf("10.0.0.%d", i)))
+		}
+	}
+	ci.handleLookupResult(lookupResult{info: gostatsd.InstanceInfo{IP: "10.0.0.10"}})
+	assert.Len(t, ci.cache, 9)
+	assert.NotContains(t, ci.cache, gostatsd.Source("10.0.0.7"))
+	assert.NotContains(t, ci.cache, gostatsd.Source("10.0.0.8"))
+	assert.Contains(t, ci.cache, gostatsd.Source("10.0.0.10"))
+	assert.EqualValues(t, 8, atomic.LoadUint64(&ci.statsCacheHit))
+}
+
+func TestCachedCloudProviderMaxBytes(t *testing.T) {
+	t.Parallel()
+	instance := &gostatsd.Instance{ID: "i-1", Tags: gostatsd.Tags{"a:b", "c:d"}}
+	size := holderSize("10.0.0.0", &instanceHolder{instance: instance})
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), &fakeprovider.IP{}, gostatsd.CacheOptions{
+		CacheTTL:         time.Hour,
+		CacheNegativeTTL: time.Minute,
+		CacheMaxBytes:    5 * size,
+	})
+	for i := 0; i < 20; i++ {
+		ci.handleLookupResult(lookupResult{info: gostatsd.InstanceInfo{IP: gostatsd.Source(fmt.Sprintf("10.0.0.%d", i)), Instance: instance}})
+		assert.LessOrEqual(t, ci.statsCacheBytes, 5*size)
+	}
+	var total int64
+	for ip, holder := range ci.cache {
+		total += holderSize(ip, holder)
+	}
+	assert.Equal(t, total, ci.statsCacheBytes)
+	assert.EqualValues(t, len(ci.cache), ci.statsCachePositive)
+}
+
+func TestCachedCloudProviderRefreshJitter(t *testing.T) {
+	t.Parallel()
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), &fakeprovider.IP{}, gostatsd.CacheOptions{
+		CacheEvictAfterIdlePeriod: 2 * time.Hour,
+		CacheTTL:                  time.Hour,
+		CacheNegativeTTL:          time.Minute,
+		CacheRefreshJitter:        0.5,
+	})
+	before := time.Now()
+	for i := 0; i < 100; i++ {
+		ci.handleLookupResult(lookupResult{info: gostatsd.InstanceInfo{
+			IP:       gostatsd.Source(fmt.Sprintf("10.0.0.%d", i)),
+			Instance: &gostatsd.Instance{ID: "i-1"},
+		}})
+	}
+	after := time.Now()
+	refreshes := map[time.Time]struct{}{}
+	for _, holder := range ci.cache {
+		assert.False(t, holder.refresh.Before(before.Add(30*time.Minute)))
+		assert.False(t, holder.refresh.After(holder.expires))
+		refreshes[holder.refresh] = struct{}{}
+	}
+	assert.Greater(t, len(refreshes), 1) // spread out
+
+	// Every entry is due for a refresh by the time it expires
+	ci.doRefresh(after.Add(time.Hour - time.Millisecond))
+	assert.Len(t, ci.toLookupIPs, 100)
+	assert.Len(t, ci.cache, 100)
+}
@@ -0,0 +1,53 @@
+package k8s
+
+import (
+	"context"
+
+	"github.com/ash2k/stager/wait"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/cachedinstances/chain"
+)
+
+// ClusterConfig is the configuration of a cluster when watching multiple clusters.
+type ClusterConfig struct {
+	// Name is used as the cluster tag, and to prefix instance IDs.
+	Name string `mapstructure:"name"`
+	// KubeconfigPath is the path to the kubeconfig file to use for auth, or "" if using in-cluster auth.
+	KubeconfigPath string `mapstructure:"kubeconfig-path"`
+	// KubeconfigContext is the name of the context to use inside KubeconfigPath.
+	KubeconfigContext string `mapstructure:"kubeconfig-context"`
+}
+
+// Clusters is a CachedInstances which looks up pods in multiple clusters, for a central gostatsd which receives
+// metrics forwarded from several clusters.  If an IP is in use in more than one cluster, the first cluster wins.
+type Clusters struct {
+	*chain.Chain
+	providers []*Provider
+}
+
+// NewClusters returns a new Clusters which looks up pods in each provider, in order.
+func NewClusters(providers []*Provider) (*Clusters, error) {
+	cachedInstances := make([]gostatsd.CachedInstances, 0, len(providers))
+	for _, p := range providers {
+		cachedInstances = append(cachedInstances, p)
+	}
+	c, err := chain.New(cachedInstances, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Clusters{
+		Chain:     c,
+		providers: providers,
+	}, nil
+}
+
+// Run runs the provider of every cluster, and the chain of them.
+func (c *Clusters) Run(ctx context.Context) {
+	var wg wait.Group
+	defer wg.Wait()
+	for _, p := range c.providers {
+		wg.StartWithContext(ctx, p.Run)
+	}
+	c.Chain.Run(ctx)
+}
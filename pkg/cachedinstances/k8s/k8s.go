@@ -2,8 +2,11 @@ package k8s
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,6 +39,10 @@ const (
 	ProviderName = "k8s"
 	// PodsByIPIndexName is the name of the index function storing pods by IP.
 	PodsByIPIndexName = "PodByIP"
+	// PodsByNodeIndexName is the name of the index function storing pods by node name.
+	PodsByNodeIndexName = "PodByNode"
+	// PodsByContainerIDIndexName is the name of the index function storing pods by the IDs of their containers.
+	PodsByContainerIDIndexName = "PodByContainerID"
 	// AnnotationPrefix is the annotation prefix that is turned into tags by default.
 	AnnotationPrefix = "gostatsd.atlassian.com/"
 	// TagNameRegexSubexp is the name of the regex subexpression that is used to parse tag names from label/annotation
@@ -55,6 +62,10 @@ const (
 	// pattern will be included as tags on metrics emitted by that pod. The tag name for these labels will
 	// be the capture group named "tag". "" means ignore all labels.
 	ParamLabelTagRegex = "label-tag-regex"
+	// ParamNodeLabelTagRegex is a regex to check the labels of the node a pod is running on against. Any node labels
+	// matching this pattern will be included as tags on metrics emitted by pods on that node. The tag name for these
+	// labels will be the capture group named "tag". "" means ignore all node labels, and nodes are not watched.
+	ParamNodeLabelTagRegex = "node-label-tag-regex"
 	// KubeconfigContextis the name of the context to use inside a provided ParamKubeconfigPath. If ParamKubeconfigPath
 	// is unset this has no effect.
 	ParamKubeconfigContext = "kubeconfig-context"
@@ -70,6 +81,13 @@ const (
 	// ParamWatchCluster is true if we should watch pods in the entire cluster, false if we should watch pods on our
 	// own node.
 	ParamWatchCluster = "watch-cluster"
+	// ParamNamespaces is the list of namespaces to watch pods in. Empty means all namespaces.
+	ParamNamespaces = "namespaces"
+	// ParamExcludeNamespaces is the list of namespaces to not watch pods in. Can not be used with ParamNamespaces.
+	ParamExcludeNamespaces = "exclude-namespaces"
+	// ParamClusters is a list of ClusterConfig, for watching multiple clusters. Empty means watching the single
+	// cluster configured by ParamKubeconfigPath and ParamKubeconfigContext.
+	ParamClusters = "clusters"
 
 	// DefaultAPIQPS is the default maximum amount of queries per second we allow to the Kubernetes API server.
 	DefaultAPIQPS = 5
@@ -82,6 +100,8 @@ const (
 	DefaultKubeconfigPath = ""
 	// DefaultLabelTagRegex is the default ParamLabelTagRegex. Every label is ignored by default.
 	DefaultLabelTagRegex = ""
+	// DefaultNodeLabelTagRegex is the default ParamNodeLabelTagRegex. Every node label is ignored by default.
+	DefaultNodeLabelTagRegex = ""
 	// DefaultNodeName is the default node name to watch pods on when ParamWatchCluster is false. Defaults to unset
 	// as this will fail fast and alert users to set this appropriately.
 	DefaultNodeName = ""
@@ -98,16 +118,23 @@ type PodInformerOptions struct {
 	ResyncPeriod time.Duration
 	WatchCluster bool
 	NodeName     string
+	// Namespaces to watch, empty means all namespaces.
+	Namespaces []string
+	// ExcludeNamespaces are not watched, can not be used with Namespaces.
+	ExcludeNamespaces []string
 }
 
 // Provider represents a k8s provider.
 type Provider struct {
 	logger logrus.FieldLogger
 
-	podsInf         cache.SharedIndexInformer
-	factory         informers.SharedInformerFactory
-	annotationRegex *regexp.Regexp // can be nil to disable annotation matching
-	labelRegex      *regexp.Regexp // can be nil to disable label matching
+	podsInfs       []cache.SharedIndexInformer // one per watched namespace
+	nodesInf       cache.SharedIndexInformer   // nil if node labels are not used
+	factories      []informers.SharedInformerFactory
+	tags           *tagExtractor
+	namespaceTags  map[string]*tagExtractor // overrides tags for pods in the namespace
+	nodeLabelRegex *regexp.Regexp           // can be nil to disable node label matching
+	clusterName    string                   // "" if not watching multiple clusters
 
 	ipSinkSource   chan gostatsd.Source
 	infoSinkSource chan gostatsd.InstanceInfo
@@ -136,7 +163,9 @@ func (p *Provider) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool /*is a cac
 
 func (p *Provider) Run(ctx context.Context) {
 	p.logger.Debug("Starting informer cache")
-	p.factory.Start(ctx.Done())
+	for _, factory := range p.factories {
+		factory.Start(ctx.Done())
+	}
 	var (
 		infoSink   chan<- gostatsd.InstanceInfo
 		info       gostatsd.InstanceInfo
@@ -165,6 +194,19 @@ func (p *Provider) Run(ctx context.Context) {
 	}
 }
 
+// CheckReady reports if every informer has synced.  Until they have, pods may not be found.
+func (p *Provider) CheckReady() error {
+	for _, podsInf := range p.podsInfs {
+		if !podsInf.HasSynced() {
+			return errors.New("k8s pod informer has not synced")
+		}
+	}
+	if p.nodesInf != nil && !p.nodesInf.HasSynced() {
+		return errors.New("k8s node informer has not synced")
+	}
+	return nil
+}
+
 func (p *Provider) instanceFromCache(ip gostatsd.Source) *gostatsd.Instance {
 	p.rw.RLock()
 	instance := p.cache[ip]
@@ -187,7 +229,12 @@ func (p *Provider) instanceFromCache(ip gostatsd.Source) *gostatsd.Instance {
 func (p *Provider) instanceFromInformer(ip gostatsd.Source) *gostatsd.Instance {
 	logger := p.logger.WithField("ip", ip)
 	// Instance not found in cache. Fetch it from informer's cache and post-process.
-	objs, err := p.podsInf.GetIndexer().ByIndex(PodsByIPIndexName, string(ip))
+	indexName, key := PodsByIPIndexName, string(ip)
+	if containerID, ok := ip.ContainerID(); ok {
+		// The origin of the metrics was detected, which also finds host network pods
+		indexName, key = PodsByContainerIDIndexName, containerID
+	}
+	objs, err := p.podsByIndex(indexName, key)
 	if err != nil {
 		logger.WithError(err).Error("got error from informer")
 		return nil
@@ -202,25 +249,19 @@ func (p *Provider) instanceFromInformer(ip gostatsd.Source) *gostatsd.Instance {
 	pod := objs[0].(*core_v1.Pod)
 
 	// Turn the pod metadata into tags
-	var tags gostatsd.Tags
-	// TODO: deduplicate labels and annotations in their tag format, rather than overwriting
-	if p.labelRegex != nil {
-		for k, v := range pod.ObjectMeta.Labels {
-			tagName := getTagNameFromRegex(p.labelRegex, k)
-			if tagName != "" {
-				tags = append(tags, tagName+":"+v)
-			}
-		}
+	te := p.tags
+	if nsTags, ok := p.namespaceTags[pod.Namespace]; ok {
+		te = nsTags
 	}
-	if p.annotationRegex != nil {
-		for k, v := range pod.ObjectMeta.Annotations {
-			tagName := getTagNameFromRegex(p.annotationRegex, k)
-			if tagName != "" {
-				tags = append(tags, tagName+":"+v)
-			}
-		}
+	tags := te.tags(pod)
+	if p.nodeLabelRegex != nil {
+		tags = append(tags, p.nodeTags(logger, pod.Spec.NodeName)...)
 	}
 	instanceID := pod.Namespace + "/" + pod.Name
+	if p.clusterName != "" {
+		tags = append(tags, "cluster:"+p.clusterName)
+		instanceID = p.clusterName + "/" + instanceID
+	}
 	logger.WithFields(logrus.Fields{
 		"instance": instanceID,
 		"tags":     tags,
@@ -231,97 +272,212 @@ func (p *Provider) instanceFromInformer(ip gostatsd.Source) *gostatsd.Instance {
 	}
 }
 
-// NewProviderFromViper returns a new k8s provider.
+// podsByIndex returns the pods with the key in the named index of every pod informer.
+func (p *Provider) podsByIndex(indexName, key string) ([]interface{}, error) {
+	var result []interface{}
+	for _, podsInf := range p.podsInfs {
+		objs, err := podsInf.GetIndexer().ByIndex(indexName, key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, objs...)
+	}
+	return result, nil
+}
+
+// nodeTags returns the tags from the labels of the named node.
+func (p *Provider) nodeTags(logger logrus.FieldLogger, nodeName string) gostatsd.Tags {
+	if nodeName == "" {
+		return nil
+	}
+	obj, exists, err := p.nodesInf.GetStore().GetByKey(nodeName)
+	if err != nil {
+		logger.WithError(err).Error("got error from node informer")
+		return nil
+	}
+	if !exists {
+		logger.WithField("node", nodeName).Debug("Could not find node in cache")
+		return nil
+	}
+	node := obj.(*core_v1.Node)
+	var tags gostatsd.Tags
+	for k, v := range node.ObjectMeta.Labels {
+		tagName := getTagNameFromRegex(p.nodeLabelRegex, k)
+		if tagName != "" {
+			tags = append(tags, tagName+":"+v)
+		}
+	}
+	return tags
+}
+
+// NewProviderFromViper returns a new k8s provider, or a Clusters if multiple clusters are configured.
 func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, version string) (gostatsd.CachedInstances, error) {
 	k := util.GetSubViper(v, "k8s")
 	setViperDefaults(k, version)
 
-	// Set up the k8s client
-	clientset, err := createKubernetesClient(k.GetString(ParamUserAgent), k.GetString(ParamKubeconfigPath),
-		k.GetString(ParamKubeconfigContext), k.GetFloat64(ParamAPIQPS), k.GetFloat64(ParamAPIQPSBurst))
+	tagOpts, err := tagOptionsFromViper(k)
 	if err != nil {
 		return nil, err
 	}
-	var (
-		annotationRegex *regexp.Regexp
-		labelRegex      *regexp.Regexp
-	)
-	annotationTagRegex := k.GetString(ParamAnnotationTagRegex)
-	if annotationTagRegex != "" {
-		annotationRegex, err = regexp.Compile(annotationTagRegex)
+	var nodeLabelRegex *regexp.Regexp
+	nodeLabelTagRegex := k.GetString(ParamNodeLabelTagRegex)
+	if nodeLabelTagRegex != "" {
+		nodeLabelRegex, err = regexp.Compile(nodeLabelTagRegex)
+		if err != nil {
+			return nil, fmt.Errorf("bad node label regex: %s: %v", nodeLabelTagRegex, err)
+		}
+	}
+	podInfOpts := PodInformerOptions{
+		ResyncPeriod:      k.GetDuration(ParamResyncPeriod),
+		WatchCluster:      k.GetBool(ParamWatchCluster),
+		NodeName:          k.GetString(ParamNodeName),
+		Namespaces:        k.GetStringSlice(ParamNamespaces),
+		ExcludeNamespaces: k.GetStringSlice(ParamExcludeNamespaces),
+	}
+	var clusters []ClusterConfig
+	if err := k.UnmarshalKey(ParamClusters, &clusters); err != nil {
+		return nil, fmt.Errorf("bad %s: %v", ParamClusters, err)
+	}
+	if len(clusters) == 0 {
+		// Set up the k8s client
+		clientset, err := createKubernetesClient(k.GetString(ParamUserAgent), k.GetString(ParamKubeconfigPath),
+			k.GetString(ParamKubeconfigContext), k.GetFloat64(ParamAPIQPS), k.GetFloat64(ParamAPIQPSBurst))
 		if err != nil {
-			return nil, fmt.Errorf("bad annotation regex: %s: %v", annotationTagRegex, err)
+			return nil, err
 		}
+		return NewProvider(logger, clientset, podInfOpts, tagOpts, nodeLabelRegex)
 	}
-	labelTagRegex := k.GetString(ParamLabelTagRegex)
-	if labelTagRegex != "" {
-		labelRegex, err = regexp.Compile(labelTagRegex)
+
+	providers := make([]*Provider, 0, len(clusters))
+	names := make(map[string]bool, len(clusters))
+	for _, cluster := range clusters {
+		if cluster.Name == "" {
+			return nil, fmt.Errorf("every cluster in %s must have a name", ParamClusters)
+		}
+		if names[cluster.Name] {
+			return nil, fmt.Errorf("duplicate cluster name %s", cluster.Name)
+		}
+		names[cluster.Name] = true
+		clientset, err := createKubernetesClient(k.GetString(ParamUserAgent), cluster.KubeconfigPath,
+			cluster.KubeconfigContext, k.GetFloat64(ParamAPIQPS), k.GetFloat64(ParamAPIQPSBurst))
 		if err != nil {
-			return nil, fmt.Errorf("bad label regex: %s: %v", labelTagRegex, err)
+			return nil, fmt.Errorf("cluster %s: %v", cluster.Name, err)
 		}
+		clusterTagOpts := tagOpts
+		clusterTagOpts.ClusterName = cluster.Name
+		p, err := NewProvider(logger.WithField("cluster", cluster.Name), clientset, podInfOpts, clusterTagOpts, nodeLabelRegex)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %v", cluster.Name, err)
+		}
+		providers = append(providers, p)
 	}
-	return NewProvider(
-		logger,
-		clientset,
-		PodInformerOptions{
-			ResyncPeriod: k.GetDuration(ParamResyncPeriod),
-			WatchCluster: k.GetBool(ParamWatchCluster),
-			NodeName:     k.GetString(ParamNodeName),
-		},
-		annotationRegex,
-		labelRegex)
+	return NewClusters(providers)
 }
 
 // NewProvider returns a new k8s provider.
-// annotationRegex and/or labelRegex can be nil to disable annotation/label matching.
+// nodeLabelRegex can be nil to disable node label matching.
 func NewProvider(logger logrus.FieldLogger, clientset kubernetes.Interface, podInfOpts PodInformerOptions,
-	annotationRegex, labelRegex *regexp.Regexp) (*Provider, error) {
+	tagOpts TagOptions, nodeLabelRegex *regexp.Regexp) (*Provider, error) {
+
+	tags, err := newTagExtractor(tagOpts)
+	if err != nil {
+		return nil, err
+	}
+	namespaceTags := make(map[string]*tagExtractor, len(tagOpts.NamespaceOverrides))
+	for namespace, nsOpts := range tagOpts.NamespaceOverrides {
+		namespaceTags[namespace], err = newTagExtractor(nsOpts)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s: %v", namespace, err)
+		}
+	}
+
+	if len(podInfOpts.Namespaces) > 0 && len(podInfOpts.ExcludeNamespaces) > 0 {
+		return nil, fmt.Errorf("%s and %s can not be used together", ParamNamespaces, ParamExcludeNamespaces)
+	}
+	namespaces := podInfOpts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{meta_v1.NamespaceAll}
+	}
 
 	// This list operation is for debugging purposes and failing fast. If this fails then the cache will likely fail.
-	_, err := clientset.CoreV1().Pods(meta_v1.NamespaceAll).List(meta_v1.ListOptions{})
+	_, err = clientset.CoreV1().Pods(namespaces[0]).List(meta_v1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
 
 	// If we're not watching the entire cluster we need to limit our watch to pods with our node name
-	customWatchOptions := func(*meta_v1.ListOptions) {}
+	var selectors []fields.Selector
 	if !podInfOpts.WatchCluster {
 		if podInfOpts.NodeName == "" {
 			return nil, fmt.Errorf("watch-cluster set to false, and node name not supplied")
 		}
-		fieldSelector := fields.OneTermEqualSelector("spec.nodeName", podInfOpts.NodeName).String()
+		selectors = append(selectors, fields.OneTermEqualSelector("spec.nodeName", podInfOpts.NodeName))
+	}
+	for _, namespace := range podInfOpts.ExcludeNamespaces {
+		selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", namespace))
+	}
+	customWatchOptions := func(*meta_v1.ListOptions) {}
+	if len(selectors) > 0 {
+		fieldSelector := fields.AndSelectors(selectors...).String()
 		logger.WithField("fieldSelector", fieldSelector).Debug("set fieldSelector for informers")
 		customWatchOptions = func(lo *meta_v1.ListOptions) {
 			lo.FieldSelector = fieldSelector
 		}
 	}
 
-	// Create a shared informer factory that watches the correct nodes
-	factory := informers.NewSharedInformerFactoryWithOptions(
-		clientset,
-		podInfOpts.ResyncPeriod,
-		informers.WithTweakListOptions(customWatchOptions))
-
-	// Set up the pod informer which fills an index with the pods we care about
-	podsInf := factory.Core().V1().Pods().Informer()
-	indexers := cache.Indexers{
-		PodsByIPIndexName: podByIpIndexFunc,
+	p := &Provider{
+		logger:         logger,
+		tags:           tags,
+		namespaceTags:  namespaceTags,
+		nodeLabelRegex: nodeLabelRegex,
+		clusterName:    tagOpts.ClusterName,
+		ipSinkSource:   make(chan gostatsd.Source),
+		infoSinkSource: make(chan gostatsd.InstanceInfo),
+		cache:          make(map[gostatsd.Source]*gostatsd.Instance),
 	}
-	err = podsInf.AddIndexers(indexers)
-	if err != nil {
-		return nil, err
+
+	// An informer can only watch one namespace or all of them, so there is one per namespace
+	for _, namespace := range namespaces {
+		// Create a shared informer factory that watches the correct nodes
+		factory := informers.NewSharedInformerFactoryWithOptions(
+			clientset,
+			podInfOpts.ResyncPeriod,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(customWatchOptions))
+
+		// Set up the pod informer which fills an index with the pods we care about
+		podsInf := factory.Core().V1().Pods().Informer()
+		indexers := cache.Indexers{
+			PodsByIPIndexName:          podByIpIndexFunc,
+			PodsByNodeIndexName:        podByNodeIndexFunc,
+			PodsByContainerIDIndexName: podByContainerIDIndexFunc,
+		}
+		err = podsInf.AddIndexers(indexers)
+		if err != nil {
+			return nil, err
+		}
+		podsInf.AddEventHandler(cacheInvalidationHandler{p: p})
+		p.podsInfs = append(p.podsInfs, podsInf)
+		p.factories = append(p.factories, factory)
 	}
-	p := &Provider{
-		logger:          logger,
-		podsInf:         podsInf,
-		factory:         factory,
-		annotationRegex: annotationRegex,
-		labelRegex:      labelRegex,
-		ipSinkSource:    make(chan gostatsd.Source),
-		infoSinkSource:  make(chan gostatsd.InstanceInfo),
-		cache:           make(map[gostatsd.Source]*gostatsd.Instance),
+
+	if nodeLabelRegex != nil {
+		// Nodes can't be watched with the pod field selector, so they need a separate factory
+		nodeWatchOptions := func(*meta_v1.ListOptions) {}
+		if !podInfOpts.WatchCluster {
+			fieldSelector := fields.OneTermEqualSelector("metadata.name", podInfOpts.NodeName).String()
+			nodeWatchOptions = func(lo *meta_v1.ListOptions) {
+				lo.FieldSelector = fieldSelector
+			}
+		}
+		nodeFactory := informers.NewSharedInformerFactoryWithOptions(
+			clientset,
+			podInfOpts.ResyncPeriod,
+			informers.WithTweakListOptions(nodeWatchOptions))
+		p.nodesInf = nodeFactory.Core().V1().Nodes().Informer()
+		p.nodesInf.AddEventHandler(nodeCacheInvalidationHandler{p: p})
+		p.factories = append(p.factories, nodeFactory)
 	}
-	podsInf.AddEventHandler(cacheInvalidationHandler{p: p})
 
 	// TODO: we should emit prometheus metrics to fit in with the k8s ecosystem
 	// TODO: we should emit events to the k8s API to fit in with the k8s ecosystem
@@ -381,7 +537,68 @@ func podByIpIndexFunc(obj interface{}) ([]string, error) {
 		// Do not index irrelevant Pods
 		return nil, nil
 	}
-	return []string{pod.Status.PodIP}, nil
+	return podIPs(pod), nil
+}
+
+// podIPs returns every IP of the pod in normalized form.  Dual-stack pods have an IPv4 and an IPv6 address.
+func podIPs(pod *core_v1.Pod) []string {
+	ips := []string{string(gostatsd.NormalizeSource(gostatsd.Source(pod.Status.PodIP), true))}
+	for _, podIP := range pod.Status.PodIPs {
+		ip := string(gostatsd.NormalizeSource(gostatsd.Source(podIP.IP), true))
+		if ip != "" && ip != ips[0] {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func podByContainerIDIndexFunc(obj interface{}) ([]string, error) {
+	pod := obj.(*core_v1.Pod)
+	if podIsFinishedRunning(pod) {
+		return nil, nil
+	}
+	return podContainerIDs(pod), nil
+}
+
+// podContainerIDs returns the IDs of the containers of the pod, without the runtime, which is the ID in the cgroup of
+// the processes of the container.  Host network pods are included, as the container does not depend on the IP.
+func podContainerIDs(pod *core_v1.Pod) []string {
+	var ids []string
+	for _, statuses := range [][]core_v1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			// The ID is <runtime>://<id>, and is empty until the container is created
+			id := status.ContainerID
+			if i := strings.Index(id, "://"); i >= 0 {
+				id = id[i+3:]
+			}
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// podSources returns the Sources the pod is cached by.
+func podSources(pod *core_v1.Pod) []gostatsd.Source {
+	var sources []gostatsd.Source
+	if isIndexablePod(pod) {
+		for _, ip := range podIPs(pod) {
+			sources = append(sources, gostatsd.Source(ip))
+		}
+	}
+	for _, id := range podContainerIDs(pod) {
+		sources = append(sources, gostatsd.ContainerSource(id))
+	}
+	return sources
+}
+
+func podByNodeIndexFunc(obj interface{}) ([]string, error) {
+	pod := obj.(*core_v1.Pod)
+	if pod.Spec.NodeName == "" {
+		return nil, nil
+	}
+	return []string{pod.Spec.NodeName}, nil
 }
 
 func podIsHostNetwork(pod *core_v1.Pod) bool {
@@ -399,6 +616,8 @@ func setViperDefaults(v *viper.Viper, version string) {
 	v.SetDefault(ParamKubeconfigContext, DefaultKubeconfigContext)
 	v.SetDefault(ParamKubeconfigPath, DefaultKubeconfigPath)
 	v.SetDefault(ParamLabelTagRegex, DefaultLabelTagRegex)
+	v.SetDefault(ParamNodeLabelTagRegex, DefaultNodeLabelTagRegex)
+	v.SetDefault(ParamOwnerTags, DefaultOwnerTags)
 	// This is intended to be taken in primarily as an environment variable when running inside k8s, as that is the
 	// k8s standard way of providing variable information to pods via the downwards API.
 	// See: https://kubernetes.io/docs/tasks/inject-data-application/environment-variable-expose-pod-information/
@@ -406,6 +625,8 @@ func setViperDefaults(v *viper.Viper, version string) {
 	v.SetDefault(ParamResyncPeriod, DefaultResyncPeriod)
 	v.SetDefault(ParamUserAgent, DefaultUserAgent+"/"+version)
 	v.SetDefault(ParamWatchCluster, DefaultWatchCluster)
+	v.SetDefault(ParamNamespaces, []string{})
+	v.SetDefault(ParamExcludeNamespaces, []string{})
 }
 
 // getTagNameFromRegex gets a tag name from the regex. This is either the entire input string, or a subset matching
@@ -456,13 +677,55 @@ func (e cacheInvalidationHandler) OnDelete(obj interface{}) {
 }
 
 func (e cacheInvalidationHandler) maybeInvalidateCacheForPod(pod *core_v1.Pod) {
-	if !isIndexablePod(pod) {
-		// This Pod was not in the IP->Pod index so it could have not been used for lookups so it
-		// should be ignored. Don't want to invalidate the cache for it's IP because there may be another Pod
-		// with the same IP that is indexable, for which the cache holds something useful.
+	// If this Pod was not in the IP->Pod index it could have not been looked up by IP, so its IP is not invalidated,
+	// because there may be another Pod with the same IP that is indexable, for which the cache holds something useful.
+	// Container IDs are unique, so they are always invalidated.
+	sources := podSources(pod)
+	if len(sources) == 0 {
 		return
 	}
 	e.p.rw.Lock()
-	delete(e.p.cache, gostatsd.Source(pod.Status.PodIP))
+	for _, source := range sources {
+		delete(e.p.cache, source)
+	}
 	e.p.rw.Unlock()
 }
+
+// nodeCacheInvalidationHandler invalidates the cache for every pod on a node when the node is added or changes, so
+// the new node labels are picked up.
+type nodeCacheInvalidationHandler struct {
+	p *Provider
+}
+
+func (e nodeCacheInvalidationHandler) OnAdd(obj interface{}) {
+	// Pods may have been looked up before their node was known
+	e.invalidateCacheForNode(obj.(*core_v1.Node))
+}
+
+func (e nodeCacheInvalidationHandler) OnUpdate(oldObj, newObj interface{}) {
+	oldNode := oldObj.(*core_v1.Node)
+	newNode := newObj.(*core_v1.Node)
+	if reflect.DeepEqual(oldNode.Labels, newNode.Labels) {
+		return
+	}
+	e.invalidateCacheForNode(newNode)
+}
+
+func (e nodeCacheInvalidationHandler) OnDelete(obj interface{}) {
+	// Nothing to do, the pods on the node will be deleted
+}
+
+func (e nodeCacheInvalidationHandler) invalidateCacheForNode(node *core_v1.Node) {
+	objs, err := e.p.podsByIndex(PodsByNodeIndexName, node.Name)
+	if err != nil {
+		e.p.logger.WithError(err).Error("got error from informer")
+		return
+	}
+	e.p.rw.Lock()
+	defer e.p.rw.Unlock()
+	for _, obj := range objs {
+		for _, source := range podSources(obj.(*core_v1.Pod)) {
+			delete(e.p.cache, source)
+		}
+	}
+}
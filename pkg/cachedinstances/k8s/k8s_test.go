@@ -3,6 +3,7 @@ package k8s
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"testing"
 	"time"
 
@@ -90,20 +91,40 @@ func pod2() *core_v1.Pod {
 	}
 }
 
+func node() *core_v1.Node {
+	return &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name: nodeName,
+			Labels: map[string]string{
+				"topology.kubernetes.io/zone":      "zone1",
+				"node.kubernetes.io/instance-type": "m5.large",
+				"kubernetes.io/hostname":           nodeName,
+			},
+		},
+	}
+}
+
 type testFixture struct {
 	fakeClient *mainFake.Clientset
 	provider   *Provider
 	podsWatch  *watch.FakeWatcher
+	nodesWatch *watch.FakeWatcher
 }
 
 func setupTest(t *testing.T, test func(*testing.T, *testFixture), v *viper.Viper, nn string) {
 	fakeClient := mainFake.NewSimpleClientset()
 	podsWatch := watch.NewFake()
 	fakeClient.PrependWatchReactor("pods", kube_testing.DefaultWatchReactor(podsWatch, nil))
+	nodesWatch := watch.NewFake()
+	fakeClient.PrependWatchReactor("nodes", kube_testing.DefaultWatchReactor(nodesWatch, nil))
 
 	// We have to set these to the defaults manually here as we're sidestepping the Viper creation path
 	// to inject things
 	setViperDefaults(v, "test")
+	var nodeLabelRegex *regexp.Regexp
+	if re := v.GetString(ParamNodeLabelTagRegex); re != "" {
+		nodeLabelRegex = regexp.MustCompile(re)
+	}
 
 	cloudProvider, err := NewProvider(
 		logrus.StandardLogger(),
@@ -113,8 +134,11 @@ func setupTest(t *testing.T, test func(*testing.T, *testFixture), v *viper.Viper
 			WatchCluster: v.GetBool(ParamWatchCluster),
 			NodeName:     nn,
 		},
-		regexp.MustCompile(v.GetString(ParamAnnotationTagRegex)),
-		regexp.MustCompile(v.GetString(ParamLabelTagRegex)),
+		TagOptions{
+			AnnotationRegex: regexp.MustCompile(v.GetString(ParamAnnotationTagRegex)),
+			LabelRegex:      regexp.MustCompile(v.GetString(ParamLabelTagRegex)),
+		},
+		nodeLabelRegex,
 	)
 	require.NoError(t, err)
 	stgr := stager.New()
@@ -125,6 +149,7 @@ func setupTest(t *testing.T, test func(*testing.T, *testFixture), v *viper.Viper
 		fakeClient: fakeClient,
 		provider:   cloudProvider,
 		podsWatch:  podsWatch,
+		nodesWatch: nodesWatch,
 	})
 }
 
@@ -194,7 +219,7 @@ var ipTagTests = []tagTest{
 
 func (f *testFixture) waitForCacheSize(t *testing.T, numExpectedPods int) {
 	// Wait for the cache to fill up before moving on
-	indexer := f.provider.podsInf.GetIndexer()
+	indexer := f.provider.podsInfs[0].GetIndexer()
 	for i := 1; i < 100 && len(indexer.List()) != numExpectedPods; i++ {
 		time.Sleep(10 * time.Millisecond)
 	}
@@ -248,6 +273,57 @@ func TestNoHostNetworkPodsCached(t *testing.T) {
 	}, viper.New(), nodeName)
 }
 
+func TestContainerIDToTags(t *testing.T) {
+	t.Parallel()
+
+	setupTest(t, func(t *testing.T, fixtures *testFixture) {
+		hostNetworkPod := pod()
+		hostNetworkPod.Status.HostIP = ipAddr
+		hostNetworkPod.Spec.HostNetwork = true
+		hostNetworkPod.Status.ContainerStatuses = []core_v1.ContainerStatus{{ContainerID: "containerd://abc123"}}
+		fixtures.podsWatch.Add(hostNetworkPod)
+		fixtures.waitForCacheSize(t, 1)
+
+		// A host network pod can not be found by its IP, but can be by its container
+		instance, cacheHit := fixtures.provider.Peek(gostatsd.ContainerSource("abc123"))
+		require.True(t, cacheHit)
+		require.NotNil(t, instance)
+		assert.Equal(t, gostatsd.Source(namespace+"/"+podName1), instance.ID)
+
+		instance, _ = fixtures.provider.Peek(gostatsd.ContainerSource("def456"))
+		assert.Nil(t, instance)
+
+		// The cached container is invalidated when it is replaced
+		updated := hostNetworkPod.DeepCopy()
+		updated.Status.ContainerStatuses[0].ContainerID = "containerd://def456"
+		fixtures.podsWatch.Modify(updated)
+		require.Eventually(t, func() bool {
+			instance, _ := fixtures.provider.Peek(gostatsd.ContainerSource("abc123"))
+			return instance == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		instance, _ = fixtures.provider.Peek(gostatsd.ContainerSource("def456"))
+		assert.NotNil(t, instance)
+	}, viper.New(), nodeName)
+}
+
+func TestDualStackPod(t *testing.T) {
+	t.Parallel()
+
+	setupTest(t, func(t *testing.T, fixtures *testFixture) {
+		dualStackPod := pod()
+		dualStackPod.Status.PodIPs = []core_v1.PodIP{{IP: ipAddr}, {IP: "FD00:0::1"}}
+		fixtures.podsWatch.Add(dualStackPod)
+		fixtures.waitForCacheSize(t, 1)
+
+		for _, ip := range []gostatsd.Source{ipAddr, "fd00::1"} {
+			instance, cacheHit := fixtures.provider.Peek(ip)
+			require.True(t, cacheHit)
+			require.NotNil(t, instance, "%s", ip)
+			assert.Equal(t, gostatsd.Source(namespace+"/"+podName1), instance.ID)
+		}
+	}, viper.New(), nodeName)
+}
+
 func TestWatchNodeFailsNoNodeName(t *testing.T) {
 	t.Parallel()
 
@@ -263,12 +339,104 @@ func TestWatchNodeFailsNoNodeName(t *testing.T) {
 			WatchCluster: false, // the important bit
 			NodeName:     "",
 		},
-		regexp.MustCompile(DefaultAnnotationTagRegex),
-		regexp.MustCompile(DefaultLabelTagRegex),
+		TagOptions{
+			AnnotationRegex: regexp.MustCompile(DefaultAnnotationTagRegex),
+			LabelRegex:      regexp.MustCompile(DefaultLabelTagRegex),
+		},
+		nil,
 	)
 	require.Error(t, err, "creating k8s provider to watch node with no node name should fail")
 }
 
+func TestNodeLabelTags(t *testing.T) {
+	t.Parallel()
+
+	v := viper.New()
+	v.Set(ParamAnnotationTagRegex, "")
+	v.Set(ParamNodeLabelTagRegex, `^(topology\.kubernetes\.io/(?P<tag>zone)|node\.kubernetes\.io/(?P<tag>instance-type))$`)
+	setupTest(t, func(t *testing.T, fixtures *testFixture) {
+		p := pod()
+		p.Spec.NodeName = nodeName
+		fixtures.podsWatch.Add(p)
+		fixtures.waitForCacheSize(t, 1)
+
+		// The node isn't known yet
+		instance, cacheHit := fixtures.provider.Peek(ipAddr)
+		require.True(t, cacheHit)
+		require.NotNil(t, instance)
+		assert.Empty(t, instance.Tags)
+
+		// Adding the node invalidates the cache for its pods
+		fixtures.nodesWatch.Add(node())
+		require.NoError(t, wait.Poll(10*time.Millisecond, 10*time.Second, func() (done bool, err error) {
+			instance, _ := fixtures.provider.Peek(ipAddr)
+			return len(instance.Tags) == 2, nil
+		}))
+		instance, _ = fixtures.provider.Peek(ipAddr)
+		assert.ElementsMatch(t, gostatsd.Tags{"zone:zone1", "instance-type:m5.large"}, instance.Tags)
+
+		// Changing the labels of the node invalidates the cache for its pods
+		n := node()
+		n.Labels["topology.kubernetes.io/zone"] = "zone2"
+		fixtures.nodesWatch.Modify(n)
+		require.NoError(t, wait.Poll(10*time.Millisecond, 10*time.Second, func() (done bool, err error) {
+			instance, _ := fixtures.provider.Peek(ipAddr)
+			tags := instance.Tags.Copy()
+			sort.Strings(tags)
+			return assert.ObjectsAreEqual(gostatsd.Tags{"instance-type:m5.large", "zone:zone2"}, tags), nil
+		}))
+	}, v, nodeName)
+}
+
+func TestNamespaces(t *testing.T) {
+	t.Parallel()
+
+	newProvider := func(podInfOpts PodInformerOptions) (*Provider, error) {
+		return NewProvider(logrus.StandardLogger(), mainFake.NewSimpleClientset(), podInfOpts, TagOptions{}, nil)
+	}
+	p, err := newProvider(PodInformerOptions{WatchCluster: true, Namespaces: []string{"a", "b"}})
+	require.NoError(t, err)
+	assert.Len(t, p.podsInfs, 2)
+
+	p, err = newProvider(PodInformerOptions{WatchCluster: true, ExcludeNamespaces: []string{"kube-system"}})
+	require.NoError(t, err)
+	assert.Len(t, p.podsInfs, 1)
+
+	_, err = newProvider(PodInformerOptions{WatchCluster: true, Namespaces: []string{"a"}, ExcludeNamespaces: []string{"b"}})
+	require.Error(t, err)
+}
+
+func TestClusterName(t *testing.T) {
+	t.Parallel()
+
+	fakeClient := mainFake.NewSimpleClientset()
+	podsWatch := watch.NewFake()
+	fakeClient.PrependWatchReactor("pods", kube_testing.DefaultWatchReactor(podsWatch, nil))
+	p, err := NewProvider(
+		logrus.StandardLogger(),
+		fakeClient,
+		PodInformerOptions{WatchCluster: true},
+		TagOptions{ClusterName: "syd"},
+		nil,
+	)
+	require.NoError(t, err)
+	c, err := NewClusters([]*Provider{p})
+	require.NoError(t, err)
+	stgr := stager.New()
+	defer stgr.Shutdown()
+	stgr.NextStage().StartWithContext(c.Run)
+
+	podsWatch.Add(pod())
+	fixtures := &testFixture{provider: p}
+	fixtures.waitForCacheSize(t, 1)
+
+	instance, cacheHit := c.Peek(ipAddr)
+	require.True(t, cacheHit)
+	require.NotNil(t, instance)
+	assert.Equal(t, gostatsd.Source("syd/"+namespace+"/"+podName1), instance.ID)
+	assert.Equal(t, gostatsd.Tags{"cluster:syd"}, instance.Tags)
+}
+
 func TestGetTagNameFromRegex(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,264 @@
+package k8s
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+	core_v1 "k8s.io/api/core/v1"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+const (
+	// TagValueRegexSubexp is the name of the regex subexpression that is used to parse tag values from label/annotation
+	// values in a TagRule.
+	TagValueRegexSubexp = "value"
+
+	// TagRuleSourceAnnotation is the TagRule source for pod annotations.
+	TagRuleSourceAnnotation = "annotation"
+	// TagRuleSourceLabel is the TagRule source for pod labels.
+	TagRuleSourceLabel = "label"
+
+	// ParamTagRules is a list of TagRule which create tags from pod labels and annotations, in addition to
+	// ParamAnnotationTagRegex and ParamLabelTagRegex.
+	ParamTagRules = "tag-rules"
+	// ParamOwnerTags is true if the kind and name of the controller of a pod should be included as a tag, for
+	// example deployment:web.
+	ParamOwnerTags = "owner-tags"
+	// ParamNamespaceOverrides is a map of namespace to settings which override ParamAnnotationTagRegex,
+	// ParamLabelTagRegex, ParamTagRules and ParamOwnerTags for pods in that namespace.
+	ParamNamespaceOverrides = "namespace-overrides"
+
+	// DefaultOwnerTags is the default ParamOwnerTags.
+	DefaultOwnerTags = false
+
+	// podTemplateHashLabel is the label added to pods of a deployment, which is also appended to the name of the
+	// deployment to create the name of the replica set.
+	podTemplateHashLabel = "pod-template-hash"
+)
+
+// TagRule creates a tag from every pod label or annotation with a key matching KeyRegex, and a value matching
+// ValueRegex.
+type TagRule struct {
+	// Source is either TagRuleSourceLabel or TagRuleSourceAnnotation.
+	Source string `mapstructure:"source"`
+	// KeyRegex is matched against the key of every label or annotation of Source.
+	KeyRegex string `mapstructure:"key-regex"`
+	// ValueRegex is matched against the value of the label or annotation, if the key matched.  "" matches
+	// everything.
+	ValueRegex string `mapstructure:"value-regex"`
+	// Name is a template for the tag name, expanded using the submatches of KeyRegex as per regexp.Expand.  If "",
+	// the capture group named "tag" is used if it matched, otherwise the entire key.
+	Name string `mapstructure:"name"`
+	// Value is a template for the tag value, expanded using the submatches of ValueRegex as per regexp.Expand.  If
+	// "", the capture group named "value" is used if it matched, otherwise the entire value.
+	Value string `mapstructure:"value"`
+}
+
+// TagOptions holds the tag extraction options for pods.
+type TagOptions struct {
+	// AnnotationRegex can be nil to disable annotation matching.
+	AnnotationRegex *regexp.Regexp
+	// LabelRegex can be nil to disable label matching.
+	LabelRegex *regexp.Regexp
+	Rules      []TagRule
+	OwnerTags  bool
+	// NamespaceOverrides replaces the options for pods in the namespace.  NamespaceOverrides and ClusterName of the
+	// overrides are ignored.
+	NamespaceOverrides map[string]TagOptions
+	// ClusterName is added to every pod as the cluster tag, and prefixed to the instance ID, if it's not "".
+	ClusterName string
+}
+
+type tagRule struct {
+	source     string
+	keyRegex   *regexp.Regexp
+	valueRegex *regexp.Regexp // can be nil to match any value
+	name       string
+	value      string
+}
+
+// tagExtractor turns pod metadata into tags.
+type tagExtractor struct {
+	annotationRegex *regexp.Regexp // can be nil to disable annotation matching
+	labelRegex      *regexp.Regexp // can be nil to disable label matching
+	rules           []tagRule
+	ownerTags       bool
+}
+
+func newTagExtractor(opts TagOptions) (*tagExtractor, error) {
+	te := &tagExtractor{
+		annotationRegex: opts.AnnotationRegex,
+		labelRegex:      opts.LabelRegex,
+		ownerTags:       opts.OwnerTags,
+	}
+	for _, rule := range opts.Rules {
+		if rule.Source != TagRuleSourceLabel && rule.Source != TagRuleSourceAnnotation {
+			return nil, fmt.Errorf("bad tag rule source %q, must be %q or %q", rule.Source, TagRuleSourceLabel, TagRuleSourceAnnotation)
+		}
+		keyRegex, err := regexp.Compile(rule.KeyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("bad tag rule key regex: %s: %v", rule.KeyRegex, err)
+		}
+		var valueRegex *regexp.Regexp
+		if rule.ValueRegex != "" {
+			valueRegex, err = regexp.Compile(rule.ValueRegex)
+			if err != nil {
+				return nil, fmt.Errorf("bad tag rule value regex: %s: %v", rule.ValueRegex, err)
+			}
+		}
+		te.rules = append(te.rules, tagRule{
+			source:     rule.Source,
+			keyRegex:   keyRegex,
+			valueRegex: valueRegex,
+			name:       rule.Name,
+			value:      rule.Value,
+		})
+	}
+	return te, nil
+}
+
+func (te *tagExtractor) tags(pod *core_v1.Pod) gostatsd.Tags {
+	var tags gostatsd.Tags
+	// TODO: deduplicate labels and annotations in their tag format, rather than overwriting
+	if te.labelRegex != nil {
+		for k, v := range pod.ObjectMeta.Labels {
+			tagName := getTagNameFromRegex(te.labelRegex, k)
+			if tagName != "" {
+				tags = append(tags, tagName+":"+v)
+			}
+		}
+	}
+	if te.annotationRegex != nil {
+		for k, v := range pod.ObjectMeta.Annotations {
+			tagName := getTagNameFromRegex(te.annotationRegex, k)
+			if tagName != "" {
+				tags = append(tags, tagName+":"+v)
+			}
+		}
+	}
+	for _, rule := range te.rules {
+		source := pod.ObjectMeta.Labels
+		if rule.source == TagRuleSourceAnnotation {
+			source = pod.ObjectMeta.Annotations
+		}
+		for k, v := range source {
+			if tag := rule.apply(k, v); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if te.ownerTags {
+		if tag := ownerTag(pod); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// apply returns the tag for the key and value, or "" if the rule does not match.
+func (r *tagRule) apply(key, value string) string {
+	var name string
+	if r.name == "" {
+		name = getTagNameFromRegex(r.keyRegex, key)
+	} else {
+		match := r.keyRegex.FindStringSubmatchIndex(key)
+		if match == nil {
+			return ""
+		}
+		name = string(r.keyRegex.ExpandString(nil, r.name, key, match))
+	}
+	if name == "" {
+		return ""
+	}
+	if r.valueRegex == nil {
+		return name + ":" + value
+	}
+	match := r.valueRegex.FindStringSubmatchIndex(value)
+	if match == nil {
+		return ""
+	}
+	if r.value != "" {
+		return name + ":" + string(r.valueRegex.ExpandString(nil, r.value, value, match))
+	}
+	for i, subexpName := range r.valueRegex.SubexpNames() {
+		if subexpName == TagValueRegexSubexp && match[2*i] >= 0 {
+			return name + ":" + value[match[2*i]:match[2*i+1]]
+		}
+	}
+	return name + ":" + value
+}
+
+// ownerTag returns a tag made from the kind and name of the controller of the pod, or "" if it has none.  Pods
+// controlled by a replica set of a deployment are tagged with the deployment.
+func ownerTag(pod *core_v1.Pod) string {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		kind := strings.ToLower(ref.Kind)
+		name := ref.Name
+		if ref.Kind == "ReplicaSet" {
+			if hash := pod.Labels[podTemplateHashLabel]; hash != "" && strings.HasSuffix(name, "-"+hash) {
+				kind = "deployment"
+				name = strings.TrimSuffix(name, "-"+hash)
+			}
+		}
+		return kind + ":" + name
+	}
+	return ""
+}
+
+// tagOptionsFromViper reads the tag options, including namespace overrides.
+func tagOptionsFromViper(k *viper.Viper) (TagOptions, error) {
+	opts, err := tagOptionsFromViperNoOverrides(k)
+	if err != nil {
+		return TagOptions{}, err
+	}
+	for namespace := range k.GetStringMap(ParamNamespaceOverrides) {
+		n := util.GetSubViper(k, ParamNamespaceOverrides+"."+namespace)
+		// Anything not overridden is inherited
+		n.SetDefault(ParamAnnotationTagRegex, k.GetString(ParamAnnotationTagRegex))
+		n.SetDefault(ParamLabelTagRegex, k.GetString(ParamLabelTagRegex))
+		n.SetDefault(ParamTagRules, k.Get(ParamTagRules))
+		n.SetDefault(ParamOwnerTags, k.GetBool(ParamOwnerTags))
+		nsOpts, err := tagOptionsFromViperNoOverrides(n)
+		if err != nil {
+			return TagOptions{}, fmt.Errorf("namespace %s: %v", namespace, err)
+		}
+		if opts.NamespaceOverrides == nil {
+			opts.NamespaceOverrides = make(map[string]TagOptions)
+		}
+		opts.NamespaceOverrides[namespace] = nsOpts
+	}
+	return opts, nil
+}
+
+func tagOptionsFromViperNoOverrides(k *viper.Viper) (TagOptions, error) {
+	var (
+		opts TagOptions
+		err  error
+	)
+	annotationTagRegex := k.GetString(ParamAnnotationTagRegex)
+	if annotationTagRegex != "" {
+		opts.AnnotationRegex, err = regexp.Compile(annotationTagRegex)
+		if err != nil {
+			return TagOptions{}, fmt.Errorf("bad annotation regex: %s: %v", annotationTagRegex, err)
+		}
+	}
+	labelTagRegex := k.GetString(ParamLabelTagRegex)
+	if labelTagRegex != "" {
+		opts.LabelRegex, err = regexp.Compile(labelTagRegex)
+		if err != nil {
+			return TagOptions{}, fmt.Errorf("bad label regex: %s: %v", labelTagRegex, err)
+		}
+	}
+	if err := k.UnmarshalKey(ParamTagRules, &opts.Rules); err != nil {
+		return TagOptions{}, fmt.Errorf("bad tag rules: %v", err)
+	}
+	opts.OwnerTags = k.GetBool(ParamOwnerTags)
+	return opts, nil
+}
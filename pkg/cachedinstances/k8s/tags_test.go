@@ -0,0 +1,164 @@
+package k8s
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestTagRules(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		rule     TagRule
+		expected gostatsd.Tags
+	}{
+		"KeyOnly": {
+			rule:     TagRule{Source: TagRuleSourceLabel, KeyRegex: `^app\.kubernetes\.io/(?P<tag>name)$`},
+			expected: gostatsd.Tags{"name:web-v2"},
+		},
+		"NameTemplate": {
+			rule:     TagRule{Source: TagRuleSourceLabel, KeyRegex: `^app\.kubernetes\.io/(name)$`, Name: "service"},
+			expected: gostatsd.Tags{"service:web-v2"},
+		},
+		"ValueCapture": {
+			rule: TagRule{
+				Source:     TagRuleSourceLabel,
+				KeyRegex:   `^app\.kubernetes\.io/name$`,
+				ValueRegex: `^(?P<value>.*)-v\d+$`,
+				Name:       "service",
+			},
+			expected: gostatsd.Tags{"service:web"},
+		},
+		"ValueTemplate": {
+			rule: TagRule{
+				Source:     TagRuleSourceAnnotation,
+				KeyRegex:   `^team\.company\.com/(.*)$`,
+				ValueRegex: `^([a-z]+)@company\.com$`,
+				Name:       "team_$1",
+				Value:      "${1}",
+			},
+			expected: gostatsd.Tags{"team_owner:alice"},
+		},
+		"ValueNoMatch": {
+			rule: TagRule{
+				Source:     TagRuleSourceLabel,
+				KeyRegex:   `^app\.kubernetes\.io/name$`,
+				ValueRegex: `^api-`,
+			},
+			expected: nil,
+		},
+	}
+
+	pod := &core_v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Labels: map[string]string{
+				"app.kubernetes.io/name": "web-v2",
+			},
+			Annotations: map[string]string{
+				"team.company.com/owner": "alice@company.com",
+			},
+		},
+	}
+	for name, testCase := range tests {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			te, err := newTagExtractor(TagOptions{Rules: []TagRule{testCase.rule}})
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, te.tags(pod))
+		})
+	}
+}
+
+func TestOwnerTag(t *testing.T) {
+	t.Parallel()
+
+	controller := true
+	tests := map[string]struct {
+		ref      meta_v1.OwnerReference
+		labels   map[string]string
+		expected string
+	}{
+		"Deployment": {
+			ref:      meta_v1.OwnerReference{Kind: "ReplicaSet", Name: "web-5d8f7b9c4", Controller: &controller},
+			labels:   map[string]string{podTemplateHashLabel: "5d8f7b9c4"},
+			expected: "deployment:web",
+		},
+		"ReplicaSet": {
+			ref:      meta_v1.OwnerReference{Kind: "ReplicaSet", Name: "web", Controller: &controller},
+			expected: "replicaset:web",
+		},
+		"StatefulSet": {
+			ref:      meta_v1.OwnerReference{Kind: "StatefulSet", Name: "db", Controller: &controller},
+			expected: "statefulset:db",
+		},
+		"NotController": {
+			ref:      meta_v1.OwnerReference{Kind: "StatefulSet", Name: "db"},
+			expected: "",
+		},
+	}
+	for name, testCase := range tests {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pod := &core_v1.Pod{
+				ObjectMeta: meta_v1.ObjectMeta{
+					Labels:          testCase.labels,
+					OwnerReferences: []meta_v1.OwnerReference{testCase.ref},
+				},
+			}
+			assert.Equal(t, testCase.expected, ownerTag(pod))
+		})
+	}
+}
+
+func TestTagOptionsFromViper(t *testing.T) {
+	t.Parallel()
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(`
+label-tag-regex = '^app$'
+owner-tags = true
+
+[[tag-rules]]
+source = 'label'
+key-regex = '^version$'
+
+[namespace-overrides.payments]
+label-tag-regex = '^team$'
+`)))
+	setViperDefaults(v, "test")
+	opts, err := tagOptionsFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, opts.Rules, 1)
+	assert.Equal(t, "^version$", opts.Rules[0].KeyRegex)
+
+	te, err := newTagExtractor(opts)
+	require.NoError(t, err)
+	nsTe, err := newTagExtractor(opts.NamespaceOverrides["payments"])
+	require.NoError(t, err)
+
+	pod := &core_v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Labels: map[string]string{"app": "web", "team": "a", "version": "1"},
+		},
+	}
+	tags := te.tags(pod)
+	sort.Strings(tags)
+	assert.Equal(t, gostatsd.Tags{"app:web", "version:1"}, tags)
+	// The override replaces the label regex and inherits everything else
+	tags = nsTe.tags(pod)
+	sort.Strings(tags)
+	assert.Equal(t, gostatsd.Tags{"team:a", "version:1"}, tags)
+	assert.True(t, opts.NamespaceOverrides["payments"].OwnerTags)
+}
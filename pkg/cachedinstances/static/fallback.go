@@ -0,0 +1,102 @@
+package static
+
+import (
+	"context"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// Fallback is a CachedInstances which uses a static provider for any IP which the primary CachedInstances could not
+// resolve to an instance.  The static provider must always return a cache hit from Peek.
+//
+// The primary and static providers are not run by Fallback, they must be started independently.
+type Fallback struct {
+	primary        gostatsd.CachedInstances
+	static         gostatsd.CachedInstances
+	infoSinkSource chan gostatsd.InstanceInfo
+}
+
+// NewFallback returns a CachedInstances which falls back to static when primary does not find an instance.
+func NewFallback(primary gostatsd.CachedInstances, static gostatsd.CachedInstances) *Fallback {
+	return &Fallback{
+		primary:        primary,
+		static:         static,
+		infoSinkSource: make(chan gostatsd.InstanceInfo),
+	}
+}
+
+func (f *Fallback) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool /*is a cache hit*/) {
+	instance, cacheHit := f.primary.Peek(ip)
+	if !cacheHit {
+		return nil, false
+	}
+	if instance == nil {
+		instance, _ = f.static.Peek(ip)
+	}
+	return instance, true
+}
+
+func (f *Fallback) IpSink() chan<- gostatsd.Source {
+	return f.primary.IpSink()
+}
+
+func (f *Fallback) InfoSource() <-chan gostatsd.InstanceInfo {
+	return f.infoSinkSource
+}
+
+func (f *Fallback) EstimatedTags() int {
+	primary := f.primary.EstimatedTags()
+	static := f.static.EstimatedTags()
+	if primary > static {
+		return primary
+	}
+	return static
+}
+
+// RunMetrics runs the metrics of the primary CachedInstances, if it has any.
+func (f *Fallback) RunMetrics(ctx context.Context, statser stats.Statser) {
+	if me, ok := f.primary.(interface {
+		RunMetrics(context.Context, stats.Statser)
+	}); ok {
+		me.RunMetrics(ctx, statser)
+	}
+}
+
+// CheckReady reports the readiness of the primary CachedInstances, if it can.
+func (f *Fallback) CheckReady() error {
+	if c, ok := f.primary.(gostatsd.ReadinessChecker); ok {
+		return c.CheckReady()
+	}
+	return nil
+}
+
+func (f *Fallback) Run(ctx context.Context) {
+	var (
+		infoSink   chan<- gostatsd.InstanceInfo
+		info       gostatsd.InstanceInfo
+		infoToSend []gostatsd.InstanceInfo
+	)
+	infoSource := f.primary.InfoSource()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case primaryInfo := <-infoSource:
+			if primaryInfo.Instance == nil {
+				primaryInfo.Instance, _ = f.static.Peek(primaryInfo.IP)
+			}
+			infoToSend = append(infoToSend, primaryInfo)
+		case infoSink <- info:
+			info = gostatsd.InstanceInfo{} // enable GC
+			infoSink = nil                 // info has been sent; if there is nothing to send, the case is disabled
+		}
+		if infoSink == nil && len(infoToSend) > 0 {
+			last := len(infoToSend) - 1
+			info = infoToSend[last]
+			infoToSend[last] = gostatsd.InstanceInfo{} // enable GC
+			infoToSend = infoToSend[:last]
+			infoSink = f.infoSinkSource
+		}
+	}
+}
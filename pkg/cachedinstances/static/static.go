@@ -0,0 +1,272 @@
+package static
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+const (
+	// ProviderName is the name of the static cloud provider.
+	ProviderName = "static"
+
+	// ParamFile is the path to the file holding the CIDR to tags mappings.
+	ParamFile = "file"
+	// ParamReloadPeriod is how often the file is checked for changes. 0 disables reloading.
+	ParamReloadPeriod = "reload-period"
+	// ParamFallback is true if the static provider should be used as a fallback when the configured cloud-provider
+	// does not find an instance.
+	ParamFallback = "fallback"
+
+	// DefaultFile is the default path to the mappings file. "" means no file, which is an error.
+	DefaultFile = ""
+	// DefaultReloadPeriod is the default period for checking the file for changes.
+	DefaultReloadPeriod = 10 * time.Second
+	// DefaultFallback is the default for using the static provider as a fallback.
+	DefaultFallback = false
+)
+
+// Mapping maps a network to the tags applied to metrics sourced from it.
+type Mapping struct {
+	// CIDR is the network or single address the mapping applies to.
+	CIDR string `mapstructure:"cidr"`
+	// Source is the source to set on matching metrics.  If empty, the source IP is left as is.
+	Source string `mapstructure:"source"`
+	// Tags are the tags to add to matching metrics.
+	Tags []string `mapstructure:"tags"`
+}
+
+type network struct {
+	ipNet  *net.IPNet
+	prefix int
+	source gostatsd.Source
+	tags   gostatsd.Tags
+}
+
+// table holds networks ordered from the most to the least specific.
+type table []network
+
+func (t table) lookup(ip gostatsd.Source) *gostatsd.Instance {
+	parsed := net.ParseIP(string(ip))
+	if parsed == nil {
+		return nil
+	}
+	for _, n := range t {
+		if n.ipNet.Contains(parsed) {
+			id := n.source
+			if id == gostatsd.UnknownSource {
+				id = ip
+			}
+			return &gostatsd.Instance{
+				ID:   id,
+				Tags: n.tags,
+			}
+		}
+	}
+	return nil
+}
+
+// newTable validates mappings and returns them in lookup order.
+func newTable(mappings []Mapping) (table, error) {
+	t := make(table, 0, len(mappings))
+	for _, m := range mappings {
+		cidr := strings.TrimSpace(m.CIDR)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", m.CIDR)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %v", m.CIDR, err)
+		}
+		prefix, _ := ipNet.Mask.Size()
+		t = append(t, network{
+			ipNet:  ipNet,
+			prefix: prefix,
+			source: gostatsd.Source(m.Source),
+			tags:   gostatsd.Tags(m.Tags),
+		})
+	}
+	// Longest prefix wins
+	sort.SliceStable(t, func(i, j int) bool {
+		return t[i].prefix > t[j].prefix
+	})
+	return t, nil
+}
+
+// Provider is a CachedInstances which maps source IPs to tags using a local file.
+type Provider struct {
+	logger       logrus.FieldLogger
+	file         string
+	reloadPeriod time.Duration
+
+	table   atomic.Value // table
+	modTime time.Time    // only accessed from Run after construction
+
+	ipSinkSource   chan gostatsd.Source
+	infoSinkSource chan gostatsd.InstanceInfo
+}
+
+func (p *Provider) IpSink() chan<- gostatsd.Source {
+	return p.ipSinkSource
+}
+
+func (p *Provider) InfoSource() <-chan gostatsd.InstanceInfo {
+	return p.infoSinkSource
+}
+
+func (p *Provider) EstimatedTags() int {
+	t := p.table.Load().(table)
+	max := 0
+	for _, n := range t {
+		if len(n.tags) > max {
+			max = len(n.tags)
+		}
+	}
+	return max
+}
+
+func (p *Provider) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool /*is a cache hit*/) {
+	// it's always a cache hit
+	return p.table.Load().(table).lookup(ip), true
+}
+
+func (p *Provider) Run(ctx context.Context) {
+	var reload <-chan time.Time
+	if p.reloadPeriod > 0 {
+		ticker := time.NewTicker(p.reloadPeriod)
+		defer ticker.Stop()
+		reload = ticker.C
+	}
+	var (
+		infoSink   chan<- gostatsd.InstanceInfo
+		info       gostatsd.InstanceInfo
+		infoToSend []gostatsd.InstanceInfo
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			p.maybeReload()
+		case ip := <-p.ipSinkSource:
+			infoToSend = append(infoToSend, gostatsd.InstanceInfo{
+				IP:       ip,
+				Instance: p.table.Load().(table).lookup(ip),
+			})
+		case infoSink <- info:
+			info = gostatsd.InstanceInfo{} // enable GC
+			infoSink = nil                 // info has been sent; if there is nothing to send, the case is disabled
+		}
+		if infoSink == nil && len(infoToSend) > 0 {
+			last := len(infoToSend) - 1
+			info = infoToSend[last]
+			infoToSend[last] = gostatsd.InstanceInfo{} // enable GC
+			infoToSend = infoToSend[:last]
+			infoSink = p.infoSinkSource
+		}
+	}
+}
+
+// maybeReload reloads the file if it has been modified.  The previous mappings are kept if the file is invalid.
+func (p *Provider) maybeReload() {
+	fi, err := os.Stat(p.file)
+	if err != nil {
+		p.logger.WithError(err).Warn("failed to stat mappings file")
+		return
+	}
+	if fi.ModTime().Equal(p.modTime) {
+		return
+	}
+	t, err := loadTable(p.file)
+	if err != nil {
+		p.logger.WithError(err).Error("failed to reload mappings file, keeping previous mappings")
+		return
+	}
+	p.modTime = fi.ModTime()
+	p.table.Store(t)
+	p.logger.WithField("mappings", len(t)).Info("reloaded mappings file")
+}
+
+func loadTable(file string) (table, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var mappings []Mapping
+	if err := v.UnmarshalKey("mapping", &mappings); err != nil {
+		return nil, err
+	}
+	return newTable(mappings)
+}
+
+// NewProviderFromViper returns a new static provider.
+func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (gostatsd.CachedInstances, error) {
+	s := util.GetSubViper(v, ProviderName)
+	s.SetDefault(ParamFile, DefaultFile)
+	s.SetDefault(ParamReloadPeriod, DefaultReloadPeriod)
+
+	file := s.GetString(ParamFile)
+	if file == "" {
+		return nil, fmt.Errorf("%s.%s is required", ProviderName, ParamFile)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadTable(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", file, err)
+	}
+	p := newProvider(logger, t)
+	p.file = file
+	p.modTime = fi.ModTime()
+	p.reloadPeriod = s.GetDuration(ParamReloadPeriod)
+	return p, nil
+}
+
+// NewProvider returns a new static provider using the provided mappings.  Reloading requires a file, so is only
+// available when created through NewProviderFromViper.
+func NewProvider(logger logrus.FieldLogger, mappings []Mapping) (*Provider, error) {
+	t, err := newTable(mappings)
+	if err != nil {
+		return nil, err
+	}
+	return newProvider(logger, t), nil
+}
+
+func newProvider(logger logrus.FieldLogger, t table) *Provider {
+	p := &Provider{
+		logger:         logger,
+		ipSinkSource:   make(chan gostatsd.Source),
+		infoSinkSource: make(chan gostatsd.InstanceInfo),
+	}
+	p.table.Store(t)
+	return p
+}
+
+// IsFallback returns true if the static provider is configured to be used as a fallback for another provider.
+func IsFallback(v *viper.Viper) bool {
+	s := util.GetSubViper(v, ProviderName)
+	s.SetDefault(ParamFallback, DefaultFallback)
+	return s.GetBool(ParamFallback)
+}
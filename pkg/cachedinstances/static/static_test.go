@@ -0,0 +1,152 @@
+package static
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestLookup(t *testing.T) {
+	t.Parallel()
+	p, err := NewProvider(logrus.StandardLogger(), []Mapping{
+		{CIDR: "10.0.0.0/8", Tags: []string{"dc:syd"}},
+		{CIDR: "10.1.0.0/16", Tags: []string{"dc:syd", "team:a"}},
+		{CIDR: "10.1.2.3", Source: "host-a", Tags: []string{"host:a"}},
+		{CIDR: "2001:db8::/32", Tags: []string{"dc:mel"}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip       gostatsd.Source
+		expected *gostatsd.Instance
+	}{
+		{"10.2.0.1", &gostatsd.Instance{ID: "10.2.0.1", Tags: gostatsd.Tags{"dc:syd"}}},
+		{"10.1.0.1", &gostatsd.Instance{ID: "10.1.0.1", Tags: gostatsd.Tags{"dc:syd", "team:a"}}},
+		{"10.1.2.3", &gostatsd.Instance{ID: "host-a", Tags: gostatsd.Tags{"host:a"}}},
+		{"2001:db8::1", &gostatsd.Instance{ID: "2001:db8::1", Tags: gostatsd.Tags{"dc:mel"}}},
+		{"192.168.0.1", nil},
+		{"not-an-ip", nil},
+	}
+	for _, test := range tests {
+		instance, cacheHit := p.Peek(test.ip)
+		assert.True(t, cacheHit, test.ip)
+		assert.Equal(t, test.expected, instance, test.ip)
+	}
+	assert.Equal(t, 2, p.EstimatedTags())
+}
+
+func TestInvalidMapping(t *testing.T) {
+	t.Parallel()
+	_, err := NewProvider(logrus.StandardLogger(), []Mapping{{CIDR: "10.0.0.0/33"}})
+	require.Error(t, err)
+	_, err = NewProvider(logrus.StandardLogger(), []Mapping{{CIDR: "nope"}})
+	require.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "static")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mappings.toml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+[[mapping]]
+cidr = "10.0.0.0/8"
+tags = ["dc:syd"]
+`), 0644))
+
+	v := viper.New()
+	v.Set("static.file", file)
+	v.Set("static.reload-period", 10*time.Millisecond)
+	ci, err := NewProviderFromViper(v, logrus.StandardLogger(), "")
+	require.NoError(t, err)
+	p := ci.(*Provider)
+
+	instance, _ := p.Peek("10.0.0.1")
+	require.NotNil(t, instance)
+	assert.Equal(t, gostatsd.Tags{"dc:syd"}, instance.Tags)
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg.StartWithContext(ctx, p.Run)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+[[mapping]]
+cidr = "10.0.0.0/8"
+tags = ["dc:mel"]
+`), 0644))
+	// Ensure the modification time changes on filesystems with coarse timestamps
+	future := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(file, future, future))
+
+	require.Eventually(t, func() bool {
+		instance, _ := p.Peek("10.0.0.1")
+		return instance != nil && instance.Tags[0] == "dc:mel"
+	}, time.Second, 10*time.Millisecond)
+}
+
+type fakeCachedInstances struct {
+	ipSink     chan gostatsd.Source
+	infoSource chan gostatsd.InstanceInfo
+	instances  map[gostatsd.Source]*gostatsd.Instance
+}
+
+func (f *fakeCachedInstances) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool) {
+	instance, ok := f.instances[ip]
+	return instance, ok
+}
+func (f *fakeCachedInstances) IpSink() chan<- gostatsd.Source           { return f.ipSink }
+func (f *fakeCachedInstances) InfoSource() <-chan gostatsd.InstanceInfo { return f.infoSource }
+func (f *fakeCachedInstances) EstimatedTags() int                       { return 1 }
+
+func TestFallback(t *testing.T) {
+	t.Parallel()
+	primary := &fakeCachedInstances{
+		ipSink:     make(chan gostatsd.Source),
+		infoSource: make(chan gostatsd.InstanceInfo),
+		instances: map[gostatsd.Source]*gostatsd.Instance{
+			"10.0.0.1": {ID: "i-1", Tags: gostatsd.Tags{"primary:true"}},
+			"10.0.0.2": nil,
+		},
+	}
+	p, err := NewProvider(logrus.StandardLogger(), []Mapping{{CIDR: "10.0.0.0/8", Tags: []string{"dc:syd"}}})
+	require.NoError(t, err)
+	f := NewFallback(primary, p)
+
+	instance, cacheHit := f.Peek("10.0.0.1")
+	assert.True(t, cacheHit)
+	assert.Equal(t, gostatsd.Source("i-1"), instance.ID)
+
+	instance, cacheHit = f.Peek("10.0.0.2")
+	assert.True(t, cacheHit)
+	assert.Equal(t, gostatsd.Tags{"dc:syd"}, instance.Tags)
+
+	instance, cacheHit = f.Peek("10.0.0.3")
+	assert.False(t, cacheHit)
+	assert.Nil(t, instance)
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg.StartWithContext(ctx, f.Run)
+
+	primary.infoSource <- gostatsd.InstanceInfo{IP: "10.0.0.3"}
+	info := <-f.InfoSource()
+	assert.Equal(t, gostatsd.Source("10.0.0.3"), info.IP)
+	require.NotNil(t, info.Instance)
+	assert.Equal(t, gostatsd.Tags{"dc:syd"}, info.Instance.Tags)
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"golang.org/x/net/http2"
@@ -29,6 +32,13 @@ const (
 	ProviderName             = "aws"
 	defaultClientTimeout     = 9 * time.Second
 	defaultMaxInstancesBatch = 32
+	defaultTagRefreshPeriod  = 5 * time.Minute
+
+	// TagSourceEC2 reads instance tags from DescribeInstances.
+	TagSourceEC2 = "ec2"
+	// TagSourceTaggingAPI reads instance tags in bulk from the Resource Groups Tagging API, and resolves IPs to
+	// instances with DescribeNetworkInterfaces.
+	TagSourceTaggingAPI = "tagging_api"
 )
 
 // Provider represents an AWS provider.
@@ -38,12 +48,23 @@ type Provider struct {
 	describeInstancePages     uint64 // The cumulative number of pages from DescribeInstancesPagesWithContext
 	describeInstanceErrors    uint64 // The cumulative number of errors seen from DescribeInstancesPagesWithContext
 	describeInstanceFound     uint64 // The cumulative number of instances successfully found via DescribeInstancesPagesWithContext
+	getResourcesCount         uint64 // The cumulative number of times GetResourcesPagesWithContext has been called
+	getResourcesErrors        uint64 // The cumulative number of errors seen from GetResourcesPagesWithContext
 
 	logger logrus.FieldLogger
 
 	Metadata     *ec2metadata.EC2Metadata
 	Ec2          *ec2.EC2
 	MaxInstances int
+
+	// Tagging is nil unless tags are read from the Resource Groups Tagging API.
+	Tagging          *resourcegroupstaggingapi.ResourceGroupsTaggingAPI
+	TagRefreshPeriod time.Duration
+
+	tagsLock      sync.Mutex // Protects tags and tagsRefreshed
+	tags          map[string]gostatsd.Tags
+	tagsRefreshed time.Time
+	region        string
 }
 
 func (p *Provider) EstimatedTags() int {
@@ -65,6 +86,8 @@ func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
 			statser.Gauge("cloudprovider.aws.describeinstancepages", float64(atomic.LoadUint64(&p.describeInstancePages)), nil)
 			statser.Gauge("cloudprovider.aws.describeinstanceerrors", float64(atomic.LoadUint64(&p.describeInstanceErrors)), nil)
 			statser.Gauge("cloudprovider.aws.describeinstancefound", float64(atomic.LoadUint64(&p.describeInstanceFound)), nil)
+			statser.Gauge("cloudprovider.aws.getresourcescount", float64(atomic.LoadUint64(&p.getResourcesCount)), nil)
+			statser.Gauge("cloudprovider.aws.getresourceserrors", float64(atomic.LoadUint64(&p.getResourcesErrors)), nil)
 		}
 	}
 }
@@ -74,26 +97,72 @@ func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
 // map is returned even in case of errors because it may contain partial data.
 func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
 	instances := make(map[gostatsd.Source]*gostatsd.Instance, len(IP))
-	values := make([]*string, len(IP))
-	for i, ip := range IP {
+	var ipv4Values, ipv6Values []*string
+	for _, ip := range IP {
 		instances[ip] = nil // initialize map. Used for lookups to see if info for IP was requested
-		values[i] = aws.String(string(ip))
+		if strings.Contains(string(ip), ":") {
+			ipv6Values = append(ipv6Values, aws.String(string(ip)))
+		} else {
+			ipv4Values = append(ipv4Values, aws.String(string(ip)))
+		}
+	}
+
+	// Filters are ANDed together, so IPv4 and IPv6 addresses must be looked up separately
+	var err error
+	if p.Tagging != nil {
+		if len(ipv4Values) > 0 {
+			err = p.describeNetworkInterfaces(ctx, "addresses.private-ip-address", ipv4Values, instances)
+		}
+		if len(ipv6Values) > 0 {
+			if err6 := p.describeNetworkInterfaces(ctx, "ipv6-addresses.ipv6-address", ipv6Values, instances); err == nil {
+				err = err6
+			}
+		}
+	} else {
+		if len(ipv4Values) > 0 {
+			err = p.describeInstances(ctx, "private-ip-address", ipv4Values, instances)
+		}
+		if len(ipv6Values) > 0 {
+			if err6 := p.describeInstances(ctx, "network-interface.ipv6-addresses.ipv6-address", ipv6Values, instances); err == nil {
+				err = err6
+			}
+		}
+	}
+
+	for ip, instance := range instances {
+		if instance == nil {
+			p.logger.WithField("ip", ip).Debug("No results looking up instance")
+		}
+	}
+
+	if err != nil {
+		// Avoid spamming logs if instance id is not visible yet due to eventual consistency.
+		// https://docs.aws.amazon.com/AWSEC2/latest/APIReference/errors-overview.html#CommonErrors
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidInstanceID.NotFound" {
+			return instances, nil
+		}
+		return instances, fmt.Errorf("error listing AWS instances: %v", err)
 	}
+	return instances, nil
+}
+
+// describeInstances looks up the instances matching the filter, and adds them to instances.
+func (p *Provider) describeInstances(ctx context.Context, filter string, values []*string, instances map[gostatsd.Source]*gostatsd.Instance) error {
 	input := &ec2.DescribeInstancesInput{
 		Filters: []*ec2.Filter{
 			{
-				Name:   aws.String("private-ip-address"),
+				Name:   aws.String(filter),
 				Values: values,
 			},
 		},
 	}
 
 	atomic.AddUint64(&p.describeInstanceCount, 1)
-	atomic.AddUint64(&p.describeInstanceInstances, uint64(len(IP)))
+	atomic.AddUint64(&p.describeInstanceInstances, uint64(len(values)))
 	instancesFound := uint64(0)
 	pages := uint64(0)
 
-	p.logger.WithField("ips", IP).Debug("Looking up instances")
+	p.logger.WithField("ips", aws.StringValueSlice(values)).Debug("Looking up instances")
 	err := p.Ec2.DescribeInstancesPagesWithContext(ctx, input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
 		pages++
 		for _, reservation := range page.Reservations {
@@ -129,26 +198,135 @@ func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.Source) (map[gos
 		return true
 	})
 
-	for ip, instance := range instances {
-		if instance == nil {
-			p.logger.WithField("ip", ip).Debug("No results looking up instance")
-		}
+	atomic.AddUint64(&p.describeInstancePages, pages)
+	atomic.AddUint64(&p.describeInstanceFound, instancesFound)
+
+	if err != nil {
+		atomic.AddUint64(&p.describeInstanceErrors, 1)
+	}
+	return err
+}
+
+// describeNetworkInterfaces looks up the network interfaces matching the filter, and adds the instances they are
+// attached to to instances, with tags from the Resource Groups Tagging API.
+func (p *Provider) describeNetworkInterfaces(ctx context.Context, filter string, values []*string, instances map[gostatsd.Source]*gostatsd.Instance) error {
+	tags, err := p.instanceTags(ctx)
+	if err != nil {
+		return err
+	}
+	input := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(filter),
+				Values: values,
+			},
+		},
 	}
 
+	atomic.AddUint64(&p.describeInstanceCount, 1)
+	atomic.AddUint64(&p.describeInstanceInstances, uint64(len(values)))
+	instancesFound := uint64(0)
+	pages := uint64(0)
+
+	p.logger.WithField("ips", aws.StringValueSlice(values)).Debug("Looking up network interfaces")
+	err = p.Ec2.DescribeNetworkInterfacesPagesWithContext(ctx, input, func(page *ec2.DescribeNetworkInterfacesOutput, lastPage bool) bool {
+		pages++
+		for _, iface := range page.NetworkInterfaces {
+			if iface.Attachment == nil || iface.Attachment.InstanceId == nil {
+				// Not attached to an instance, eg, a load balancer
+				continue
+			}
+			ip := getInterestingInterfaceIP(iface, instances)
+			if ip == gostatsd.UnknownSource {
+				p.logger.Warnf("AWS returned unexpected network interface: %#v", iface)
+				continue
+			}
+			instancesFound++
+			instanceID := aws.StringValue(iface.Attachment.InstanceId)
+			instanceTags := tags[instanceID]
+			t := make(gostatsd.Tags, 0, len(instanceTags)+1)
+			t = append(t, instanceTags...)
+			t = append(t, "region:"+p.region)
+			instances[ip] = &gostatsd.Instance{
+				ID:   gostatsd.Source(instanceID),
+				Tags: t,
+			}
+			p.logger.WithFields(logrus.Fields{
+				"instance": instanceID,
+				"ip":       ip,
+				"tags":     t,
+			}).Debug("Added tags")
+		}
+		return true
+	})
+
 	atomic.AddUint64(&p.describeInstancePages, pages)
 	atomic.AddUint64(&p.describeInstanceFound, instancesFound)
 
 	if err != nil {
 		atomic.AddUint64(&p.describeInstanceErrors, 1)
+	}
+	return err
+}
 
-		// Avoid spamming logs if instance id is not visible yet due to eventual consistency.
-		// https://docs.aws.amazon.com/AWSEC2/latest/APIReference/errors-overview.html#CommonErrors
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidInstanceID.NotFound" {
-			return instances, nil
+// instanceTags returns the tags of every instance in the region, keyed by instance ID.  They are fetched from the
+// Resource Groups Tagging API if they have not been refreshed in the last TagRefreshPeriod.
+func (p *Provider) instanceTags(ctx context.Context) (map[string]gostatsd.Tags, error) {
+	p.tagsLock.Lock()
+	defer p.tagsLock.Unlock()
+	if p.tags != nil && time.Since(p.tagsRefreshed) < p.TagRefreshPeriod {
+		return p.tags, nil
+	}
+
+	input := &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceTypeFilters: []*string{aws.String("ec2:instance")},
+		ResourcesPerPage:    aws.Int64(100),
+	}
+	atomic.AddUint64(&p.getResourcesCount, 1)
+	tags := make(map[string]gostatsd.Tags, len(p.tags))
+	err := p.Tagging.GetResourcesPagesWithContext(ctx, input, func(page *resourcegroupstaggingapi.GetResourcesOutput, lastPage bool) bool {
+		for _, mapping := range page.ResourceTagMappingList {
+			// arn:aws:ec2:region:account:instance/i-0123456789abcdef0
+			arn := aws.StringValue(mapping.ResourceARN)
+			instanceID := arn[strings.LastIndexByte(arn, '/')+1:]
+			t := make(gostatsd.Tags, len(mapping.Tags))
+			for idx, tag := range mapping.Tags {
+				t[idx] = fmt.Sprintf("%s:%s",
+					gostatsd.NormalizeTagKey(aws.StringValue(tag.Key)),
+					aws.StringValue(tag.Value))
+			}
+			tags[instanceID] = t
 		}
-		return instances, fmt.Errorf("error listing AWS instances: %v", err)
+		return true
+	})
+	if err != nil {
+		atomic.AddUint64(&p.getResourcesErrors, 1)
+		if p.tags != nil {
+			// Keep using the stale tags rather than failing every lookup
+			p.logger.WithError(err).Warn("Error refreshing instance tags, using previous tags")
+			return p.tags, nil
+		}
+		return nil, fmt.Errorf("error getting instance tags: %v", err)
 	}
-	return instances, nil
+	p.tags = tags
+	p.tagsRefreshed = time.Now()
+	return tags, nil
+}
+
+func getInterestingInterfaceIP(iface *ec2.NetworkInterface, instances map[gostatsd.Source]*gostatsd.Instance) gostatsd.Source {
+	for _, privateIP := range iface.PrivateIpAddresses {
+		ip := gostatsd.Source(aws.StringValue(privateIP.PrivateIpAddress))
+		if _, ok := instances[ip]; ok {
+			return ip
+		}
+	}
+	for _, IPv6 := range iface.Ipv6Addresses {
+		ip := gostatsd.NormalizeSource(gostatsd.Source(aws.StringValue(IPv6.Ipv6Address)), true)
+		if _, ok := instances[ip]; ok {
+			return ip
+		}
+	}
+	return gostatsd.UnknownSource
 }
 
 func getInterestingInstanceIP(instance *ec2.Instance, instances map[gostatsd.Source]*gostatsd.Instance) gostatsd.Source {
@@ -168,7 +346,7 @@ func getInterestingInstanceIP(instance *ec2.Instance, instances map[gostatsd.Sou
 		}
 		// Check private IPv6 addresses on interface
 		for _, IPv6 := range iface.Ipv6Addresses {
-			ip = gostatsd.Source(aws.StringValue(IPv6.Ipv6Address))
+			ip = gostatsd.NormalizeSource(gostatsd.Source(aws.StringValue(IPv6.Ipv6Address)), true)
 			if _, ok := instances[ip]; ok {
 				return ip
 			}
@@ -203,6 +381,9 @@ func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (
 	a.SetDefault("max_retries", 3)
 	a.SetDefault("client_timeout", defaultClientTimeout)
 	a.SetDefault("max_instances_batch", defaultMaxInstancesBatch)
+	a.SetDefault("require_imdsv2", false)
+	a.SetDefault("tag_source", TagSourceEC2)
+	a.SetDefault("tag_refresh_period", defaultTagRefreshPeriod)
 	httpTimeout := a.GetDuration("client_timeout")
 	if httpTimeout <= 0 {
 		return nil, errors.New("client timeout must be positive")
@@ -211,6 +392,14 @@ func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (
 	if maxInstances <= 0 {
 		return nil, errors.New("max number of instances per batch must be positive")
 	}
+	tagSource := a.GetString("tag_source")
+	if tagSource != TagSourceEC2 && tagSource != TagSourceTaggingAPI {
+		return nil, fmt.Errorf("tag source must be %s or %s", TagSourceEC2, TagSourceTaggingAPI)
+	}
+	tagRefreshPeriod := a.GetDuration("tag_refresh_period")
+	if tagRefreshPeriod <= 0 {
+		return nil, errors.New("tag refresh period must be positive")
+	}
 
 	// This is the main config without credentials.
 	transport := &http.Transport{
@@ -242,7 +431,7 @@ func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (
 	if err != nil {
 		return nil, fmt.Errorf("error creating a new Metadata session: %v", err)
 	}
-	metadata := ec2metadata.New(metadataSession)
+	metadata := NewMetadata(metadataSession, a.GetBool("require_imdsv2"))
 	region, err := metadata.Region()
 	if err != nil {
 		return nil, fmt.Errorf("error getting AWS region: %v", err)
@@ -253,10 +442,16 @@ func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (
 	if err != nil {
 		return nil, fmt.Errorf("error creating a new EC2 session: %v", err)
 	}
-	return &Provider{
-		Metadata:     metadata,
-		Ec2:          ec2.New(ec2Session),
-		MaxInstances: maxInstances,
-		logger:       logger,
-	}, nil
+	p := &Provider{
+		Metadata:         metadata,
+		Ec2:              ec2.New(ec2Session),
+		MaxInstances:     maxInstances,
+		TagRefreshPeriod: tagRefreshPeriod,
+		logger:           logger,
+		region:           region,
+	}
+	if tagSource == TagSourceTaggingAPI {
+		p.Tagging = resourcegroupstaggingapi.New(ec2Session)
+	}
+	return p, nil
 }
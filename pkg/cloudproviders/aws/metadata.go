@@ -0,0 +1,36 @@
+package aws
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// metadataTokenHeader is the header carrying the IMDSv2 session token.
+const metadataTokenHeader = "x-aws-ec2-metadata-token"
+
+// errMetadataTokenRequired is returned by the metadata client if IMDSv2 is required, but no token could be fetched.
+var errMetadataTokenRequired = errors.New("failed to fetch an IMDSv2 token, and IMDSv1 is not allowed")
+
+// NewMetadata returns a client for the EC2 instance metadata service.  The client uses IMDSv2 session tokens, and
+// falls back to IMDSv1 if a token can not be fetched, unless requireIMDSv2 is true.
+func NewMetadata(p client.ConfigProvider, requireIMDSv2 bool) *ec2metadata.EC2Metadata {
+	metadata := ec2metadata.New(p)
+	if requireIMDSv2 {
+		// The token is added by a sign handler, if it could be fetched, so this must run after it.
+		metadata.Handlers.Sign.PushBackNamed(request.NamedHandler{
+			Name: "gostatsd.RequireIMDSv2",
+			Fn: func(r *request.Request) {
+				if r.Operation.Name == "GetToken" {
+					return
+				}
+				if r.HTTPRequest.Header.Get(metadataTokenHeader) == "" {
+					r.Error = errMetadataTokenRequired
+				}
+			},
+		})
+	}
+	return metadata
+}
@@ -0,0 +1,407 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+const (
+	// ProviderName is the name of Azure cloud provider.
+	ProviderName               = "azure"
+	defaultClientTimeout       = 9 * time.Second
+	defaultMaxInstancesBatch   = 32
+	defaultManagementEndpoint  = "https://management.azure.com"
+	defaultLoginEndpoint       = "https://login.microsoftonline.com"
+	defaultMetadataEndpoint    = "http://169.254.169.254/metadata"
+	resourceGraphAPIVersion    = "2021-03-01"
+	instanceMetadataAPIVersion = "2021-02-01"
+)
+
+// Provider represents an Azure provider.
+type Provider struct {
+	queryCount     uint64 // The cumulative number of Resource Graph queries made
+	queryInstances uint64 // The cumulative number of instances which have been looked up
+	queryErrors    uint64 // The cumulative number of errors seen from Resource Graph
+	queryFound     uint64 // The cumulative number of instances successfully found via Resource Graph
+
+	logger logrus.FieldLogger
+
+	client             *http.Client
+	token              *adal.ServicePrincipalToken
+	managementEndpoint string
+	subscriptions      []string
+	maxInstances       int
+}
+
+func (p *Provider) EstimatedTags() int {
+	return 10 + 4 // 10 for VM tags, 1 each for resource group, region, vm size and scale set
+}
+
+func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			// These are namespaced not tagged because they're very specific
+			statser.Gauge("cloudprovider.azure.querycount", float64(atomic.LoadUint64(&p.queryCount)), nil)
+			statser.Gauge("cloudprovider.azure.queryinstances", float64(atomic.LoadUint64(&p.queryInstances)), nil)
+			statser.Gauge("cloudprovider.azure.queryerrors", float64(atomic.LoadUint64(&p.queryErrors)), nil)
+			statser.Gauge("cloudprovider.azure.queryfound", float64(atomic.LoadUint64(&p.queryFound)), nil)
+		}
+	}
+}
+
+// Instance returns instances details from Azure.
+// ip -> nil pointer if instance was not found.
+// map is returned even in case of errors because it may contain partial data.
+func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	instances := make(map[gostatsd.Source]*gostatsd.Instance, len(IP))
+	for _, ip := range IP {
+		instances[ip] = nil // initialize map. Used for lookups to see if info for IP was requested
+	}
+
+	atomic.AddUint64(&p.queryInstances, uint64(len(IP)))
+	instancesFound := uint64(0)
+
+	p.logger.WithField("ips", IP).Debug("Looking up instances")
+	err := p.lookup(ctx, IP, func(ip gostatsd.Source, vm *virtualMachine) {
+		if _, ok := instances[ip]; !ok {
+			p.logger.Warnf("Azure returned unexpected VM: %#v", vm)
+			return
+		}
+		instancesFound++
+		tags := vmTags(vm)
+		instances[ip] = &gostatsd.Instance{
+			ID:   gostatsd.Source(vm.Name),
+			Tags: tags,
+		}
+		p.logger.WithFields(logrus.Fields{
+			"instance": vm.Name,
+			"ip":       ip,
+			"tags":     tags,
+		}).Debug("Added tags")
+	})
+
+	for ip, instance := range instances {
+		if instance == nil {
+			p.logger.WithField("ip", ip).Debug("No results looking up instance")
+		}
+	}
+
+	atomic.AddUint64(&p.queryFound, instancesFound)
+
+	if err != nil {
+		atomic.AddUint64(&p.queryErrors, 1)
+		return instances, fmt.Errorf("error querying Azure Resource Graph: %v", err)
+	}
+	return instances, nil
+}
+
+// lookup resolves IPs to network interfaces, and then network interfaces to the VMs they are attached to.
+// Scale sets using flexible orchestration are covered as their VMs are regular compute resources.
+func (p *Provider) lookup(ctx context.Context, ips []gostatsd.Source, fn func(gostatsd.Source, *virtualMachine)) error {
+	quotedIPs := make([]string, len(ips))
+	for i, ip := range ips {
+		quotedIPs[i] = kqlQuote(string(ip))
+	}
+	var nics []networkInterface
+	err := p.query(ctx, fmt.Sprintf(`Resources
+| where type =~ 'microsoft.network/networkinterfaces'
+| mv-expand ipconfig = properties.ipConfigurations
+| extend ip = tostring(ipconfig.properties.privateIPAddress)
+| where ip in (%s)
+| project ip, vmId = tolower(tostring(properties.virtualMachine.id))`, strings.Join(quotedIPs, ",")), func(raw json.RawMessage) error {
+		var page []networkInterface
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return err
+		}
+		nics = append(nics, page...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	vmIPs := make(map[string][]gostatsd.Source, len(nics))
+	quotedVMIDs := make([]string, 0, len(nics))
+	for _, nic := range nics {
+		if nic.VMID == "" {
+			continue // Not attached to a VM
+		}
+		if _, ok := vmIPs[nic.VMID]; !ok {
+			quotedVMIDs = append(quotedVMIDs, kqlQuote(nic.VMID))
+		}
+		vmIPs[nic.VMID] = append(vmIPs[nic.VMID], gostatsd.Source(nic.IP))
+	}
+	if len(quotedVMIDs) == 0 {
+		return nil
+	}
+
+	return p.query(ctx, fmt.Sprintf(`Resources
+| where type =~ 'microsoft.compute/virtualmachines'
+| extend vmId = tolower(id)
+| where vmId in (%s)
+| project vmId, name, resourceGroup, location, vmSize = tostring(properties.hardwareProfile.vmSize), scaleSetId = tostring(properties.virtualMachineScaleSet.id), tags`, strings.Join(quotedVMIDs, ",")), func(raw json.RawMessage) error {
+		var page []*virtualMachine
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return err
+		}
+		for _, vm := range page {
+			for _, ip := range vmIPs[vm.VMID] {
+				fn(ip, vm)
+			}
+		}
+		return nil
+	})
+}
+
+// query runs a Resource Graph query, calling fn with the data of each page.
+func (p *Provider) query(ctx context.Context, query string, fn func(json.RawMessage) error) error {
+	skipToken := ""
+	for {
+		reqBody := resourceGraphRequest{
+			Subscriptions: p.subscriptions,
+			Query:         query,
+			Options: resourceGraphOptions{
+				ResultFormat: "objectArray",
+				SkipToken:    skipToken,
+			},
+		}
+		atomic.AddUint64(&p.queryCount, 1)
+		var resp resourceGraphResponse
+		if err := p.postJSON(ctx, p.managementEndpoint+"/providers/Microsoft.ResourceGraph/resources?api-version="+resourceGraphAPIVersion, &reqBody, &resp); err != nil {
+			return err
+		}
+		if err := fn(resp.Data); err != nil {
+			return err
+		}
+		if resp.SkipToken == "" {
+			return nil
+		}
+		skipToken = resp.SkipToken
+	}
+}
+
+func (p *Provider) postJSON(ctx context.Context, u string, in, out interface{}) error {
+	if err := p.token.EnsureFreshWithContext(ctx); err != nil {
+		return fmt.Errorf("error getting access token: %v", err)
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+p.token.OAuthToken())
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		bodyStart, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("received bad status code %d: %s", resp.StatusCode, bodyStart)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func vmTags(vm *virtualMachine) gostatsd.Tags {
+	tags := make(gostatsd.Tags, 0, len(vm.Tags)+4)
+	for k, v := range vm.Tags {
+		tags = append(tags, gostatsd.NormalizeTagKey(k)+":"+v)
+	}
+	tags = append(tags,
+		"resource_group:"+vm.ResourceGroup,
+		"region:"+vm.Location,
+		"vm_size:"+vm.VMSize,
+	)
+	if vm.ScaleSetID != "" {
+		tags = append(tags, "scale_set:"+path.Base(vm.ScaleSetID))
+	}
+	return tags
+}
+
+// kqlQuote returns s as a single quoted KQL string literal.
+func kqlQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// MaxInstancesBatch returns maximum number of instances that could be requested via the Instance method.
+func (p *Provider) MaxInstancesBatch() int {
+	return p.maxInstances
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// NewProviderFromViper returns a new azure provider.
+func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (gostatsd.CloudProvider, error) {
+	a := util.GetSubViper(v, "azure")
+	a.SetDefault("client_timeout", defaultClientTimeout)
+	a.SetDefault("max_instances_batch", defaultMaxInstancesBatch)
+	a.SetDefault("subscriptions", []string{})
+	a.SetDefault("tenant_id", "")
+	a.SetDefault("client_id", "")
+	a.SetDefault("client_secret", "")
+	a.SetDefault("management_endpoint", defaultManagementEndpoint)
+	a.SetDefault("login_endpoint", defaultLoginEndpoint)
+	a.SetDefault("metadata_endpoint", defaultMetadataEndpoint)
+	httpTimeout := a.GetDuration("client_timeout")
+	if httpTimeout <= 0 {
+		return nil, errors.New("client timeout must be positive")
+	}
+	maxInstances := a.GetInt("max_instances_batch")
+	if maxInstances <= 0 {
+		return nil, errors.New("max number of instances per batch must be positive")
+	}
+
+	metadataEndpoint := strings.TrimSuffix(a.GetString("metadata_endpoint"), "/")
+	metadataURL, err := url.Parse(metadataEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata_endpoint: %v", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			// The instance metadata service must never be accessed through a proxy.
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				if req.URL.Host == metadataURL.Host {
+					return nil, nil
+				}
+				return http.ProxyFromEnvironment(req)
+			},
+			TLSHandshakeTimeout: 3 * time.Second,
+			TLSClientConfig: &tls.Config{
+				// Can't use SSLv3 because of POODLE and BEAST
+				// Can't use TLSv1.0 because of POODLE and BEAST using CBC cipher
+				// Can't use TLSv1.1 because of RC4 cipher usage
+				MinVersion: tls.VersionTLS12,
+			},
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:    50,
+			IdleConnTimeout: 1 * time.Minute,
+		},
+		Timeout: httpTimeout,
+	}
+	metadata := &metadataClient{
+		client:   client,
+		endpoint: metadataEndpoint,
+	}
+	managementEndpoint := strings.TrimSuffix(a.GetString("management_endpoint"), "/")
+
+	token, err := newToken(a, metadataEndpoint, managementEndpoint+"/")
+	if err != nil {
+		return nil, err
+	}
+	// Refresh the token through the same client, so it is not requested through a proxy from the metadata service.
+	token.SetSender(client)
+
+	subscriptions := a.GetStringSlice("subscriptions")
+	if len(subscriptions) == 0 {
+		subscriptionID, err := metadata.subscriptionID(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("error getting Azure subscription: %v", err)
+		}
+		subscriptions = []string{subscriptionID}
+	}
+
+	return &Provider{
+		logger:             logger,
+		client:             client,
+		token:              token,
+		managementEndpoint: managementEndpoint,
+		subscriptions:      subscriptions,
+		maxInstances:       maxInstances,
+	}, nil
+}
+
+// newToken returns a token for resource, for the service principal if a client secret is set, otherwise for the
+// managed identity of the VM.  client_id selects a user assigned managed identity, and may be empty to use the
+// system assigned identity.
+func newToken(a *viper.Viper, metadataEndpoint, resource string) (*adal.ServicePrincipalToken, error) {
+	clientID := a.GetString("client_id")
+	if clientSecret := a.GetString("client_secret"); clientID != "" && clientSecret != "" {
+		tenantID := a.GetString("tenant_id")
+		if tenantID == "" {
+			return nil, errors.New("tenant_id is required when using a client secret")
+		}
+		oauthConfig, err := adal.NewOAuthConfig(a.GetString("login_endpoint"), tenantID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid login_endpoint: %v", err)
+		}
+		return adal.NewServicePrincipalToken(*oauthConfig, clientID, clientSecret, resource)
+	}
+	msiEndpoint := metadataEndpoint + "/identity/oauth2/token"
+	if clientID != "" {
+		return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, resource, clientID)
+	}
+	return adal.NewServicePrincipalTokenFromMSI(msiEndpoint, resource)
+}
+
+type resourceGraphRequest struct {
+	Subscriptions []string             `json:"subscriptions"`
+	Query         string               `json:"query"`
+	Options       resourceGraphOptions `json:"options"`
+}
+
+type resourceGraphOptions struct {
+	ResultFormat string `json:"resultFormat"`
+	SkipToken    string `json:"$skipToken,omitempty"`
+}
+
+type resourceGraphResponse struct {
+	Data      json.RawMessage `json:"data"`
+	SkipToken string          `json:"$skipToken"`
+}
+
+type networkInterface struct {
+	IP   string `json:"ip"`
+	VMID string `json:"vmId"`
+}
+
+type virtualMachine struct {
+	VMID          string            `json:"vmId"`
+	Name          string            `json:"name"`
+	ResourceGroup string            `json:"resourceGroup"`
+	Location      string            `json:"location"`
+	VMSize        string            `json:"vmSize"`
+	ScaleSetID    string            `json:"scaleSetId"`
+	Tags          map[string]string `json:"tags"`
+}
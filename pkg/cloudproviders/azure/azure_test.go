@@ -0,0 +1,110 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+const vmID = "/subscriptions/sub/resourcegroups/rg/providers/microsoft.compute/virtualmachines/vm-1"
+
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata/instance", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		_, _ = w.Write([]byte(`{"compute":{"subscriptionId":"sub"}}`))
+	})
+	mux.HandleFunc("/metadata/identity/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":"3599","expires_on":"` + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + `"}`))
+	})
+	mux.HandleFunc("/tenant/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "client_credentials", r.FormValue("grant_type"))
+		assert.Equal(t, "secret", r.FormValue("client_secret"))
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":"3599","expires_on":"` + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + `"}`))
+	})
+	mux.HandleFunc("/providers/Microsoft.ResourceGraph/resources", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		var req resourceGraphRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, []string{"sub"}, req.Subscriptions)
+		switch {
+		case strings.Contains(req.Query, "networkinterfaces"):
+			assert.Contains(t, req.Query, "'10.0.0.1','10.0.0.2'")
+			_, _ = w.Write([]byte(`{"data":[{"ip":"10.0.0.1","vmId":"` + vmID + `"}]}`))
+		case strings.Contains(req.Query, "virtualmachines"):
+			assert.Contains(t, req.Query, "'"+vmID+"'")
+			_, _ = w.Write([]byte(`{"data":[{"vmId":"` + vmID + `","name":"vm-1","resourceGroup":"rg","location":"eastus","vmSize":"Standard_D2s_v3","scaleSetId":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/pool","tags":{"team":"a"}}]}`))
+		default:
+			t.Errorf("unexpected query: %s", req.Query)
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestInstance(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set("azure.management_endpoint", ts.URL)
+	v.Set("azure.metadata_endpoint", ts.URL+"/metadata")
+	p, err := NewProviderFromViper(v, logrus.StandardLogger(), "")
+	require.NoError(t, err)
+
+	instances, err := p.Instance(context.Background(), "10.0.0.1", "10.0.0.2")
+	require.NoError(t, err)
+	require.Len(t, instances, 2)
+	assert.Nil(t, instances["10.0.0.2"])
+	instance := instances["10.0.0.1"]
+	require.NotNil(t, instance)
+	assert.Equal(t, gostatsd.Source("vm-1"), instance.ID)
+	sort.Strings(instance.Tags)
+	assert.Equal(t, gostatsd.Tags{
+		"region:eastus",
+		"resource_group:rg",
+		"scale_set:pool",
+		"team:a",
+		"vm_size:Standard_D2s_v3",
+	}, instance.Tags)
+}
+
+func TestInstanceClientSecret(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set("azure.management_endpoint", ts.URL)
+	v.Set("azure.login_endpoint", ts.URL)
+	v.Set("azure.tenant_id", "tenant")
+	v.Set("azure.client_id", "client")
+	v.Set("azure.client_secret", "secret")
+	v.Set("azure.subscriptions", []string{"sub"})
+	p, err := NewProviderFromViper(v, logrus.StandardLogger(), "")
+	require.NoError(t, err)
+
+	instances, err := p.Instance(context.Background(), "10.0.0.1", "10.0.0.2")
+	require.NoError(t, err)
+	require.NotNil(t, instances["10.0.0.1"])
+}
+
+func TestKqlQuote(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, `'10.0.0.1'`, kqlQuote("10.0.0.1"))
+	assert.Equal(t, `'a\'b\\c'`, kqlQuote(`a'b\c`))
+}
@@ -0,0 +1,56 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// metadataClient talks to the Azure Instance Metadata Service.
+type metadataClient struct {
+	client   *http.Client
+	endpoint string
+}
+
+func (mc *metadataClient) getJSON(ctx context.Context, suffix string, query url.Values, out interface{}) error {
+	req, err := http.NewRequest("GET", mc.endpoint+"/"+suffix+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata", "true")
+	resp, err := mc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		bodyStart, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("metadata service returned status code %d for %s: %s", resp.StatusCode, suffix, bodyStart)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (mc *metadataClient) subscriptionID(ctx context.Context) (string, error) {
+	var instance struct {
+		Compute struct {
+			SubscriptionID string `json:"subscriptionId"`
+		} `json:"compute"`
+	}
+	err := mc.getJSON(ctx, "instance", url.Values{"api-version": []string{instanceMetadataAPIVersion}}, &instance)
+	if err != nil {
+		return "", err
+	}
+	if instance.Compute.SubscriptionID == "" {
+		return "", errors.New("metadata service returned an empty subscription")
+	}
+	return instance.Compute.SubscriptionID, nil
+}
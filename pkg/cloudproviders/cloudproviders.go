@@ -8,12 +8,18 @@ import (
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/pkg/cloudproviders/aws"
+	"github.com/hligit/gostatsd/pkg/cloudproviders/azure"
+	"github.com/hligit/gostatsd/pkg/cloudproviders/gcp"
+	"github.com/hligit/gostatsd/pkg/cloudproviders/rdns"
 )
 
 var (
 	// All registered cloud providers.
 	providers = map[string]gostatsd.CloudProviderFactory{
-		aws.ProviderName: aws.NewProviderFromViper,
+		aws.ProviderName:   aws.NewProviderFromViper,
+		azure.ProviderName: azure.NewProviderFromViper,
+		gcp.ProviderName:   gcp.NewProviderFromViper,
+		rdns.ProviderName:  rdns.NewProviderFromViper,
 	}
 
 	ErrUnknownProvider = errors.New("unknown cloud provider")
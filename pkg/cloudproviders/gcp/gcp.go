@@ -0,0 +1,337 @@
+package gcp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+const (
+	// ProviderName is the name of GCP cloud provider.
+	ProviderName             = "gcp"
+	defaultClientTimeout     = 9 * time.Second
+	defaultMaxInstancesBatch = 32
+	defaultComputeEndpoint   = "https://compute.googleapis.com/compute/v1"
+	computeReadOnlyScope     = "https://www.googleapis.com/auth/compute.readonly"
+)
+
+// Provider represents a GCP provider.
+type Provider struct {
+	listInstanceCount     uint64 // The cumulative number of times the aggregated instance list has been called
+	listInstanceInstances uint64 // The cumulative number of instances which have been fed in to the aggregated instance list
+	listInstancePages     uint64 // The cumulative number of pages from the aggregated instance list
+	listInstanceErrors    uint64 // The cumulative number of errors seen from the aggregated instance list
+	listInstanceFound     uint64 // The cumulative number of instances successfully found via the aggregated instance list
+
+	logger logrus.FieldLogger
+
+	client          *http.Client
+	tokens          oauth2.TokenSource
+	computeEndpoint string
+	project         string
+	maxInstances    int
+}
+
+func (p *Provider) EstimatedTags() int {
+	return 10 + 4 // 10 for instance labels, 1 each for project, zone, region and machine type
+}
+
+func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			// These are namespaced not tagged because they're very specific
+			statser.Gauge("cloudprovider.gcp.listinstancecount", float64(atomic.LoadUint64(&p.listInstanceCount)), nil)
+			statser.Gauge("cloudprovider.gcp.listinstanceinstances", float64(atomic.LoadUint64(&p.listInstanceInstances)), nil)
+			statser.Gauge("cloudprovider.gcp.listinstancepages", float64(atomic.LoadUint64(&p.listInstancePages)), nil)
+			statser.Gauge("cloudprovider.gcp.listinstanceerrors", float64(atomic.LoadUint64(&p.listInstanceErrors)), nil)
+			statser.Gauge("cloudprovider.gcp.listinstancefound", float64(atomic.LoadUint64(&p.listInstanceFound)), nil)
+		}
+	}
+}
+
+// Instance returns instances details from GCP.
+// ip -> nil pointer if instance was not found.
+// map is returned even in case of errors because it may contain partial data.
+func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	instances := make(map[gostatsd.Source]*gostatsd.Instance, len(IP))
+	filters := make([]string, len(IP))
+	for i, ip := range IP {
+		instances[ip] = nil // initialize map. Used for lookups to see if info for IP was requested
+		filters[i] = fmt.Sprintf("(networkInterfaces.networkIP = %q)", string(ip))
+	}
+
+	atomic.AddUint64(&p.listInstanceCount, 1)
+	atomic.AddUint64(&p.listInstanceInstances, uint64(len(IP)))
+	instancesFound := uint64(0)
+	pages := uint64(0)
+
+	p.logger.WithField("ips", IP).Debug("Looking up instances")
+	err := p.listInstancesPages(ctx, strings.Join(filters, " OR "), func(page *aggregatedInstanceList) {
+		pages++
+		for _, scoped := range page.Items {
+			for _, instance := range scoped.Instances {
+				ip := getInterestingInstanceIP(instance, instances)
+				if ip == gostatsd.UnknownSource {
+					p.logger.Warnf("GCP returned unexpected instance: %#v", instance)
+					continue
+				}
+				instancesFound++
+				tags := p.instanceTags(instance)
+				instances[ip] = &gostatsd.Instance{
+					ID:   gostatsd.Source(instance.Name),
+					Tags: tags,
+				}
+				p.logger.WithFields(logrus.Fields{
+					"instance": instance.Name,
+					"ip":       ip,
+					"tags":     tags,
+				}).Debug("Added tags")
+			}
+		}
+	})
+
+	for ip, instance := range instances {
+		if instance == nil {
+			p.logger.WithField("ip", ip).Debug("No results looking up instance")
+		}
+	}
+
+	atomic.AddUint64(&p.listInstancePages, pages)
+	atomic.AddUint64(&p.listInstanceFound, instancesFound)
+
+	if err != nil {
+		atomic.AddUint64(&p.listInstanceErrors, 1)
+		return instances, fmt.Errorf("error listing GCP instances: %v", err)
+	}
+	return instances, nil
+}
+
+func (p *Provider) instanceTags(instance *computeInstance) gostatsd.Tags {
+	zone := lastPathSegment(instance.Zone)
+	tags := make(gostatsd.Tags, 0, len(instance.Labels)+4)
+	for k, v := range instance.Labels {
+		tags = append(tags, gostatsd.NormalizeTagKey(k)+":"+v)
+	}
+	return append(tags,
+		"project:"+p.project,
+		"zone:"+zone,
+		"region:"+zoneToRegion(zone),
+		"machine_type:"+lastPathSegment(instance.MachineType),
+	)
+}
+
+// listInstancesPages calls fn for every page of the aggregated instance list matching filter.
+func (p *Provider) listInstancesPages(ctx context.Context, filter string, fn func(*aggregatedInstanceList)) error {
+	pageToken := ""
+	for {
+		q := url.Values{}
+		q.Set("filter", filter)
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		u := fmt.Sprintf("%s/projects/%s/aggregated/instances?%s", p.computeEndpoint, url.PathEscape(p.project), q.Encode())
+		var page aggregatedInstanceList
+		if err := p.getJSON(ctx, u, &page); err != nil {
+			return err
+		}
+		fn(&page)
+		if page.NextPageToken == "" {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, out interface{}) error {
+	token, err := p.tokens.Token()
+	if err != nil {
+		return fmt.Errorf("error getting access token: %v", err)
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	token.SetAuthHeader(req)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		bodyStart, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("received bad status code %d: %s", resp.StatusCode, bodyStart)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func getInterestingInstanceIP(instance *computeInstance, instances map[gostatsd.Source]*gostatsd.Instance) gostatsd.Source {
+	for _, iface := range instance.NetworkInterfaces {
+		// Check private IPv4 address on interface
+		if _, ok := instances[gostatsd.Source(iface.NetworkIP)]; ok {
+			return gostatsd.Source(iface.NetworkIP)
+		}
+		// Check IPv6 address on interface
+		if iface.IPv6Address != "" {
+			if _, ok := instances[gostatsd.Source(iface.IPv6Address)]; ok {
+				return gostatsd.Source(iface.IPv6Address)
+			}
+		}
+	}
+	return gostatsd.UnknownSource
+}
+
+// MaxInstancesBatch returns maximum number of instances that could be requested via the Instance method.
+func (p *Provider) MaxInstancesBatch() int {
+	return p.maxInstances
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// lastPathSegment returns the resource name from a fully qualified resource URL, as used by the Compute API for
+// zones and machine types.
+func lastPathSegment(s string) string {
+	if s == "" {
+		return ""
+	}
+	return path.Base(s)
+}
+
+// Derives the region from a zone name, for example us-central1-a -> us-central1.
+func zoneToRegion(zone string) string {
+	idx := strings.LastIndexByte(zone, '-')
+	if idx <= 0 {
+		return zone
+	}
+	return zone[:idx]
+}
+
+// NewProviderFromViper returns a new gcp provider.
+func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (gostatsd.CloudProvider, error) {
+	g := util.GetSubViper(v, "gcp")
+	g.SetDefault("client_timeout", defaultClientTimeout)
+	g.SetDefault("max_instances_batch", defaultMaxInstancesBatch)
+	g.SetDefault("project", "")
+	g.SetDefault("credentials_file", "")
+	g.SetDefault("compute_endpoint", defaultComputeEndpoint)
+	httpTimeout := g.GetDuration("client_timeout")
+	if httpTimeout <= 0 {
+		return nil, errors.New("client timeout must be positive")
+	}
+	maxInstances := g.GetInt("max_instances_batch")
+	if maxInstances <= 0 {
+		return nil, errors.New("max number of instances per batch must be positive")
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: 3 * time.Second,
+			TLSClientConfig: &tls.Config{
+				// Can't use SSLv3 because of POODLE and BEAST
+				// Can't use TLSv1.0 because of POODLE and BEAST using CBC cipher
+				// Can't use TLSv1.1 because of RC4 cipher usage
+				MinVersion: tls.VersionTLS12,
+			},
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:    50,
+			IdleConnTimeout: 1 * time.Minute,
+		},
+		Timeout: httpTimeout,
+	}
+	creds, err := findCredentials(client, g.GetString("credentials_file"))
+	if err != nil {
+		return nil, fmt.Errorf("error loading GCP credentials: %v", err)
+	}
+
+	project := g.GetString("project")
+	if project == "" {
+		project = creds.ProjectID
+	}
+	if project == "" {
+		return nil, errors.New("project must be set as it can not be found from the credentials")
+	}
+
+	return &Provider{
+		logger:          logger,
+		client:          client,
+		tokens:          creds.TokenSource,
+		computeEndpoint: strings.TrimSuffix(g.GetString("compute_endpoint"), "/"),
+		project:         project,
+		maxInstances:    maxInstances,
+	}, nil
+}
+
+// findCredentials loads the credentials from a service account key file, or if it is not set, the application default
+// credentials.  On GCE these are the instance's service account, and on GKE with workload identity enabled the bound
+// service account, both served by the metadata server.
+func findCredentials(client *http.Client, credentialsFile string) (*google.Credentials, error) {
+	// Tokens are requested through the client, and cached until they expire.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	if credentialsFile == "" {
+		return google.FindDefaultCredentials(ctx, computeReadOnlyScope)
+	}
+	b, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return google.CredentialsFromJSON(ctx, b, computeReadOnlyScope)
+}
+
+type aggregatedInstanceList struct {
+	Items         map[string]instancesScopedList `json:"items"`
+	NextPageToken string                         `json:"nextPageToken"`
+}
+
+type instancesScopedList struct {
+	Instances []*computeInstance `json:"instances"`
+}
+
+type computeInstance struct {
+	ID                string             `json:"id"`
+	Name              string             `json:"name"`
+	Zone              string             `json:"zone"`
+	MachineType       string             `json:"machineType"`
+	Labels            map[string]string  `json:"labels"`
+	NetworkInterfaces []networkInterface `json:"networkInterfaces"`
+}
+
+type networkInterface struct {
+	NetworkIP   string `json:"networkIP"`
+	IPv6Address string `json:"ipv6Address"`
+}
@@ -0,0 +1,110 @@
+package gcp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.FormValue("grant_type"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/compute/projects/my-project/aggregated/instances", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, `(networkInterfaces.networkIP = "10.0.0.1") OR (networkInterfaces.networkIP = "10.0.0.2")`, r.URL.Query().Get("filter"))
+		page := aggregatedInstanceList{
+			Items: map[string]instancesScopedList{
+				"zones/us-central1-a": {
+					Instances: []*computeInstance{
+						{
+							Name:              "instance-1",
+							Zone:              "https://www.googleapis.com/compute/v1/projects/my-project/zones/us-central1-a",
+							MachineType:       "https://www.googleapis.com/compute/v1/projects/my-project/zones/us-central1-a/machineTypes/n1-standard-1",
+							Labels:            map[string]string{"team": "a"},
+							NetworkInterfaces: []networkInterface{{NetworkIP: "10.0.0.1"}},
+						},
+					},
+				},
+			},
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	})
+	return httptest.NewServer(mux)
+}
+
+// writeCredentialsFile writes a service account key file which exchanges tokens with the test server.
+func writeCredentialsFile(t *testing.T, dir, tokenURI string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "my-project",
+		"private_key_id": "key-id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"client_email":   "gostatsd@my-project.iam.gserviceaccount.com",
+		"token_uri":      tokenURI,
+	})
+	require.NoError(t, err)
+	credentialsFile := filepath.Join(dir, "credentials.json")
+	require.NoError(t, ioutil.WriteFile(credentialsFile, b, 0600))
+	return credentialsFile
+}
+
+func TestInstance(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	v := viper.New()
+	v.Set("gcp.compute_endpoint", ts.URL+"/compute")
+	v.Set("gcp.credentials_file", writeCredentialsFile(t, dir, ts.URL+"/token"))
+	p, err := NewProviderFromViper(v, logrus.StandardLogger(), "")
+	require.NoError(t, err)
+
+	instances, err := p.Instance(context.Background(), "10.0.0.1", "10.0.0.2")
+	require.NoError(t, err)
+	require.Len(t, instances, 2)
+	assert.Nil(t, instances["10.0.0.2"])
+	instance := instances["10.0.0.1"]
+	require.NotNil(t, instance)
+	assert.Equal(t, gostatsd.Source("instance-1"), instance.ID)
+	sort.Strings(instance.Tags)
+	assert.Equal(t, gostatsd.Tags{
+		"machine_type:n1-standard-1",
+		"project:my-project",
+		"region:us-central1",
+		"team:a",
+		"zone:us-central1-a",
+	}, instance.Tags)
+}
+
+func TestZoneToRegion(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "us-central1", zoneToRegion("us-central1-a"))
+	assert.Equal(t, "europe-west4", zoneToRegion("europe-west4-c"))
+	assert.Equal(t, "", zoneToRegion(""))
+}
@@ -0,0 +1,233 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+const (
+	// ProviderName is the name of the reverse DNS cloud provider.
+	ProviderName             = "rdns"
+	defaultTimeout           = 2 * time.Second
+	defaultMaxInstancesBatch = 16
+)
+
+// Provider represents a reverse DNS provider.  It resolves the PTR record of a source IP, and uses the resulting
+// name as the source of the metric.
+type Provider struct {
+	lookupCount    uint64 // The cumulative number of PTR lookups
+	lookupErrors   uint64 // The cumulative number of PTR lookups which failed
+	lookupNotFound uint64 // The cumulative number of PTR lookups which found no name
+	lookupFound    uint64 // The cumulative number of PTR lookups which found a name
+
+	logger logrus.FieldLogger
+
+	resolver     resolver
+	timeout      time.Duration
+	tagRegex     *regexp.Regexp // can be nil to disable tag extraction
+	maxInstances int
+}
+
+// resolver is the subset of net.Resolver used by the provider.
+type resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+func (p *Provider) EstimatedTags() int {
+	if p.tagRegex == nil {
+		return 0
+	}
+	return len(p.tagRegex.SubexpNames()) - 1
+}
+
+func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			// These are namespaced not tagged because they're very specific
+			statser.Gauge("cloudprovider.rdns.lookupcount", float64(atomic.LoadUint64(&p.lookupCount)), nil)
+			statser.Gauge("cloudprovider.rdns.lookuperrors", float64(atomic.LoadUint64(&p.lookupErrors)), nil)
+			statser.Gauge("cloudprovider.rdns.lookupnotfound", float64(atomic.LoadUint64(&p.lookupNotFound)), nil)
+			statser.Gauge("cloudprovider.rdns.lookupfound", float64(atomic.LoadUint64(&p.lookupFound)), nil)
+		}
+	}
+}
+
+// Instance returns instances details from reverse DNS.
+// ip -> nil pointer if instance was not found.
+// map is returned even in case of errors because it may contain partial data.
+func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	instances := make(map[gostatsd.Source]*gostatsd.Instance, len(IP))
+	errs := make([]error, len(IP))
+	results := make([]*gostatsd.Instance, len(IP))
+
+	var wg sync.WaitGroup
+	wg.Add(len(IP))
+	for i, ip := range IP {
+		go func(i int, ip gostatsd.Source) {
+			defer wg.Done()
+			results[i], errs[i] = p.lookup(ctx, ip)
+		}(i, ip)
+	}
+	wg.Wait()
+
+	var firstErr error
+	errCount := 0
+	for i, ip := range IP {
+		instances[ip] = results[i]
+		if errs[i] != nil {
+			errCount++
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+		}
+	}
+	if firstErr != nil {
+		return instances, fmt.Errorf("%d of %d reverse DNS lookups failed, first error: %v", errCount, len(IP), firstErr)
+	}
+	return instances, nil
+}
+
+func (p *Provider) lookup(ctx context.Context, ip gostatsd.Source) (*gostatsd.Instance, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	atomic.AddUint64(&p.lookupCount, 1)
+	names, err := p.resolver.LookupAddr(ctx, string(ip))
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			atomic.AddUint64(&p.lookupNotFound, 1)
+			p.logger.WithField("ip", ip).Debug("No PTR record for ip")
+			return nil, nil
+		}
+		atomic.AddUint64(&p.lookupErrors, 1)
+		return nil, err
+	}
+	if len(names) == 0 {
+		atomic.AddUint64(&p.lookupNotFound, 1)
+		return nil, nil
+	}
+	atomic.AddUint64(&p.lookupFound, 1)
+
+	name := strings.TrimSuffix(names[0], ".")
+	tags := p.tagsFromName(name)
+	p.logger.WithFields(logrus.Fields{
+		"instance": name,
+		"ip":       ip,
+		"tags":     tags,
+	}).Debug("Added tags")
+	return &gostatsd.Instance{
+		ID:   gostatsd.Source(name),
+		Tags: tags,
+	}, nil
+}
+
+// tagsFromName creates a tag for every named capture group in the tag regex which matched part of the name.
+func (p *Provider) tagsFromName(name string) gostatsd.Tags {
+	if p.tagRegex == nil {
+		return nil
+	}
+	match := p.tagRegex.FindStringSubmatch(name)
+	if match == nil {
+		return nil
+	}
+	var tags gostatsd.Tags
+	for i, subexpName := range p.tagRegex.SubexpNames() {
+		if subexpName != "" && match[i] != "" {
+			tags = append(tags, subexpName+":"+match[i])
+		}
+	}
+	return tags
+}
+
+// MaxInstancesBatch returns maximum number of instances that could be requested via the Instance method.
+func (p *Provider) MaxInstancesBatch() int {
+	return p.maxInstances
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// newResolver returns a resolver which sends queries to the provided servers in a round robin fashion, or the
+// system resolver if there are none.
+func newResolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs[i] = server
+	}
+	var next uint64
+	dialer := &net.Dialer{}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr := addrs[atomic.AddUint64(&next, 1)%uint64(len(addrs))]
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// NewProviderFromViper returns a new reverse DNS provider.
+func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (gostatsd.CloudProvider, error) {
+	r := util.GetSubViper(v, ProviderName)
+	r.SetDefault("timeout", defaultTimeout)
+	r.SetDefault("max_instances_batch", defaultMaxInstancesBatch)
+	r.SetDefault("resolvers", []string{})
+	r.SetDefault("tag_regex", "")
+
+	timeout := r.GetDuration("timeout")
+	if timeout <= 0 {
+		return nil, errors.New("timeout must be positive")
+	}
+	maxInstances := r.GetInt("max_instances_batch")
+	if maxInstances <= 0 {
+		return nil, errors.New("max number of instances per batch must be positive")
+	}
+	var tagRegex *regexp.Regexp
+	if s := r.GetString("tag_regex"); s != "" {
+		var err error
+		tagRegex, err = regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad tag regex: %s: %v", s, err)
+		}
+	}
+	res := newResolver(r.GetStringSlice("resolvers"))
+	return NewProvider(logger, res, timeout, tagRegex, maxInstances), nil
+}
+
+// NewProvider returns a new reverse DNS provider.  tagRegex can be nil to disable tag extraction.
+func NewProvider(logger logrus.FieldLogger, res resolver, timeout time.Duration, tagRegex *regexp.Regexp, maxInstances int) *Provider {
+	return &Provider{
+		logger:       logger,
+		resolver:     res,
+		timeout:      timeout,
+		tagRegex:     tagRegex,
+		maxInstances: maxInstances,
+	}
+}
@@ -0,0 +1,53 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if addr == "10.0.0.99" {
+		return nil, errors.New("server misbehaving")
+	}
+	names, ok := f[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func TestInstance(t *testing.T) {
+	t.Parallel()
+	res := fakeResolver{
+		"10.0.0.1": {"web-01.syd.example.com."},
+		"10.0.0.2": {"printer.example.com."},
+	}
+	re := regexp.MustCompile(`^(?P<role>[a-z]+)-\d+\.(?P<dc>[a-z]+)\.`)
+	p := NewProvider(logrus.StandardLogger(), res, time.Second, re, 10)
+	assert.Equal(t, 2, p.EstimatedTags())
+
+	instances, err := p.Instance(context.Background(), "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	require.NoError(t, err)
+	assert.Equal(t, map[gostatsd.Source]*gostatsd.Instance{
+		"10.0.0.1": {ID: "web-01.syd.example.com", Tags: gostatsd.Tags{"role:web", "dc:syd"}},
+		"10.0.0.2": {ID: "printer.example.com"},
+		"10.0.0.3": nil,
+	}, instances)
+
+	instances, err = p.Instance(context.Background(), "10.0.0.1", "10.0.0.99")
+	require.Error(t, err)
+	assert.NotNil(t, instances["10.0.0.1"])
+	assert.Nil(t, instances["10.0.0.99"])
+}
@@ -0,0 +1,189 @@
+// Package compression compresses the payloads sent by the HTTP backends and the forwarder, so they share one
+// implementation of each Content-Encoding, with pooled writers.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+// The Content-Encodings which are supported.
+const (
+	Identity = "identity"
+	Deflate  = "deflate"
+	Gzip     = "gzip"
+	Zstd     = "zstd"
+)
+
+// Codec compresses payloads for a single Content-Encoding.  It is safe for concurrent use.
+type Codec interface {
+	// Encoding returns the Content-Encoding of the compressed payloads.
+	Encoding() string
+	// NewWriter returns a writer which compresses what is written to it in to w.  It must be closed to write the end
+	// of the payload, after which it must not be used.
+	NewWriter(w io.Writer) io.WriteCloser
+	// Compress returns raw compressed.
+	Compress(raw []byte) ([]byte, error)
+}
+
+// New returns a Codec for the named encoding.  A level of 0 uses the default level of the encoding, otherwise it is a
+// zlib level for deflate and gzip (1-9), or a zstd level for zstd.
+func New(encoding string, level int) (Codec, error) {
+	switch encoding {
+	case Identity, "none":
+		return identityCodec{}, nil
+	case Deflate:
+		if level == 0 {
+			level = zlib.BestCompression // historical default
+		}
+		if _, err := zlib.NewWriterLevel(nil, level); err != nil {
+			return nil, err
+		}
+		return newWriterCodec(Deflate, func() resetWriter {
+			w, _ := zlib.NewWriterLevel(nil, level) // The level is valid
+			return w
+		}), nil
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+			return nil, err
+		}
+		return newWriterCodec(Gzip, func() resetWriter {
+			w, _ := gzip.NewWriterLevel(nil, level) // The level is valid
+			return w
+		}), nil
+	case Zstd:
+		zstdLevel := zstd.SpeedDefault
+		if level != 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		// A nil writer is only valid for EncodeAll, which is safe for concurrent use.
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstdLevel))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCodec{
+			writerCodec: newWriterCodec(Zstd, func() resetWriter {
+				// Each writer compresses a single payload, so it does not need to compress in parallel.
+				w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+				return w
+			}),
+			encoder: encoder,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q, must be one of none, deflate, gzip, or zstd", encoding)
+	}
+}
+
+type identityCodec struct{}
+
+func (identityCodec) Encoding() string {
+	return Identity
+}
+
+func (identityCodec) NewWriter(w io.Writer) io.WriteCloser {
+	return util.NopWriteCloser(w)
+}
+
+func (identityCodec) Compress(raw []byte) ([]byte, error) {
+	return raw, nil
+}
+
+// resetWriter is a compressing writer which can be reused for another payload.
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// writerCodec compresses with writers which are pooled, as they allocate large buffers for their state.
+type writerCodec struct {
+	encoding string
+	writers  sync.Pool // of resetWriter
+}
+
+func newWriterCodec(encoding string, newWriter func() resetWriter) *writerCodec {
+	return &writerCodec{
+		encoding: encoding,
+		writers: sync.Pool{
+			New: func() interface{} {
+				return newWriter()
+			},
+		},
+	}
+}
+
+func (wc *writerCodec) Encoding() string {
+	return wc.encoding
+}
+
+func (wc *writerCodec) NewWriter(w io.Writer) io.WriteCloser {
+	rw := wc.writers.Get().(resetWriter)
+	rw.Reset(w)
+	return &pooledWriter{writer: rw, codec: wc}
+}
+
+func (wc *writerCodec) Compress(raw []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := wc.NewWriter(buf)
+	_, _ = w.Write(raw) // error is propagated through Close
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pooledWriter returns its writer to the pool when it is closed.
+type pooledWriter struct {
+	writer resetWriter
+	codec  *writerCodec
+}
+
+func (pw *pooledWriter) Write(p []byte) (int, error) {
+	return pw.writer.Write(p)
+}
+
+func (pw *pooledWriter) Close() error {
+	if pw.writer == nil {
+		return nil
+	}
+	err := pw.writer.Close()
+	if err == nil {
+		// Drop the reference to the destination, so it can be freed while the writer is in the pool.
+		pw.writer.Reset(nil)
+		pw.codec.writers.Put(pw.writer)
+	}
+	pw.writer = nil
+	return err
+}
+
+type zstdCodec struct {
+	*writerCodec
+	encoder *zstd.Encoder
+}
+
+func (zc *zstdCodec) Compress(raw []byte) ([]byte, error) {
+	return zc.encoder.EncodeAll(raw, nil), nil
+}
+
+// AcceptsEncoding returns true if the encoding is listed in the value of an Accept-Encoding header.  Quality values
+// are ignored.
+func AcceptsEncoding(acceptEncoding, encoding string) bool {
+	for _, accepted := range strings.Split(acceptEncoding, ",") {
+		accepted = strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if strings.EqualFold(accepted, encoding) || accepted == "*" {
+			return true
+		}
+	}
+	return false
+}
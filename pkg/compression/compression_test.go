@@ -0,0 +1,87 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decompress(t *testing.T, encoding string, compressed []byte) []byte {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case Identity:
+		return compressed
+	case Deflate:
+		r, err = zlib.NewReader(bytes.NewReader(compressed))
+	case Gzip:
+		r, err = gzip.NewReader(bytes.NewReader(compressed))
+	case Zstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(bytes.NewReader(compressed))
+		r = d
+	}
+	require.NoError(t, err)
+	raw, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return raw
+}
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+	raw := []byte(strings.Repeat("gostatsd.metric:1|c|#tag:value\n", 100))
+	for _, encoding := range []string{Identity, Deflate, Gzip, Zstd} {
+		encoding := encoding
+		t.Run(encoding, func(t *testing.T) {
+			t.Parallel()
+			codec, err := New(encoding, 0)
+			require.NoError(t, err)
+			require.Equal(t, encoding, codec.Encoding())
+
+			compressed, err := codec.Compress(raw)
+			require.NoError(t, err)
+			assert.Equal(t, raw, decompress(t, encoding, compressed))
+
+			// Writers are reused from the pool
+			for i := 0; i < 3; i++ {
+				var buf bytes.Buffer
+				w := codec.NewWriter(&buf)
+				_, err = w.Write(raw)
+				require.NoError(t, err)
+				require.NoError(t, w.Close())
+				require.NoError(t, w.Close())
+				assert.Equal(t, raw, decompress(t, encoding, buf.Bytes()))
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+	codec, err := New("none", 0)
+	require.NoError(t, err)
+	assert.Equal(t, Identity, codec.Encoding())
+
+	_, err = New("brotli", 0)
+	assert.Error(t, err)
+	_, err = New(Deflate, 10)
+	assert.Error(t, err)
+	_, err = New(Gzip, 10)
+	assert.Error(t, err)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	t.Parallel()
+	assert.True(t, AcceptsEncoding("gzip, deflate", Deflate))
+	assert.True(t, AcceptsEncoding("ZSTD;q=0.5", Zstd))
+	assert.True(t, AcceptsEncoding("*", Gzip))
+	assert.False(t, AcceptsEncoding("deflate, identity", Zstd))
+}
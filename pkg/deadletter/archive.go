@@ -0,0 +1,206 @@
+// Package deadletter archives the metrics and events which backends have finally dropped, so they can be replayed
+// after an incident.
+package deadletter
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hligit/gostatsd"
+)
+
+const (
+	// Suffix is the suffix of the name of every archive.
+	Suffix = ".dlq"
+	// tmpSuffix is the suffix of an archive which is still being written, so a partial archive is never replayed.
+	tmpSuffix = ".tmp"
+
+	// TypeMetrics is the type of an archive holding a flush of metrics.
+	TypeMetrics = "metrics"
+	// TypeEvent is the type of an archive holding an event.
+	TypeEvent = "event"
+)
+
+var errFull = errors.New("dead letter directory is full")
+
+// Header describes what is in an archive, and why it was dropped.  It is written as a line of json at the start of the
+// archive, so archives can be inspected with standard tools.
+type Header struct {
+	Backend    string    `json:"backend"`
+	Reason     string    `json:"reason"`
+	Timestamp  time.Time `json:"timestamp"`
+	Type       string    `json:"type"`
+	Datapoints uint64    `json:"datapoints"`
+}
+
+// Record is an archive read back from the directory.  Only one of Metrics and Event is set, depending on the Type.
+type Record struct {
+	Header
+	Metrics *gostatsd.MetricMap
+	Event   *gostatsd.Event
+}
+
+// Archive writes each batch of metrics or event dropped to its own file in a directory, named so they sort oldest
+// first.  The header is followed by the data in gob, which keeps the flushed values of every series exactly, including
+// timestamps, so replaying an archive sends what the backend would have been sent.  It is safe for concurrent use, and
+// several Archives can share a directory.
+type Archive struct {
+	dir      string
+	maxBytes int64 // 0 for no limit
+
+	lock sync.Mutex // Serializes the check of the size of the directory with writing to it
+}
+
+// New returns an Archive writing to dir, which is created if it does not exist.  Nothing more is archived once the
+// archives in the directory are maxBytes in size, unless it is 0.
+func New(dir string, maxBytes int64) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %v", err)
+	}
+	return &Archive{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}, nil
+}
+
+// WriteMetrics archives a flush of metrics which the backend dropped.
+func (a *Archive) WriteMetrics(now time.Time, backend, reason string, mm *gostatsd.MetricMap) error {
+	return a.write(Header{
+		Backend:    backend,
+		Reason:     reason,
+		Timestamp:  now,
+		Type:       TypeMetrics,
+		Datapoints: uint64(mm.Len()),
+	}, mm)
+}
+
+// WriteEvent archives an event which the backend dropped.
+func (a *Archive) WriteEvent(now time.Time, backend, reason string, e *gostatsd.Event) error {
+	return a.write(Header{
+		Backend:    backend,
+		Reason:     reason,
+		Timestamp:  now,
+		Type:       TypeEvent,
+		Datapoints: 1,
+	}, e)
+}
+
+func (a *Archive) write(header Header, data interface{}) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.maxBytes > 0 {
+		size, err := a.size()
+		if err != nil {
+			return err
+		}
+		if size >= a.maxBytes {
+			return errFull
+		}
+	}
+
+	f, err := ioutil.TempFile(a.dir, fmt.Sprintf("%020d-%s-*%s", header.Timestamp.UnixNano(), header.Backend, tmpSuffix))
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	err = encode(f, header, data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, strings.TrimSuffix(tmpName, tmpSuffix)+Suffix)
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+func encode(f *os.File, header Header, data interface{}) error {
+	w := bufio.NewWriter(f)
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(headerJSON, '\n')); err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(w).Encode(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// size returns the total size of the archives in the directory.
+func (a *Archive) size() (int64, error) {
+	files, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), Suffix) {
+			size += file.Size()
+		}
+	}
+	return size, nil
+}
+
+// List returns the paths of the archives in dir, oldest first.
+func List(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), Suffix) {
+			paths = append(paths, filepath.Join(dir, file.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Read reads back the archive at path.
+func Read(path string) (*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	headerJSON, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header of %s: %v", path, err)
+	}
+	record := &Record{}
+	if err := json.Unmarshal(headerJSON, &record.Header); err != nil {
+		return nil, fmt.Errorf("invalid header in %s: %v", path, err)
+	}
+	dec := gob.NewDecoder(r)
+	switch record.Type {
+	case TypeMetrics:
+		err = dec.Decode(&record.Metrics)
+	case TypeEvent:
+		err = dec.Decode(&record.Event)
+	default:
+		return nil, fmt.Errorf("unknown type %q in %s", record.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return record, nil
+}
@@ -0,0 +1,61 @@
+package deadletter
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "deadletter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := New(dir, 0)
+	require.NoError(t, err)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "counter", Value: 2, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"a:b"}, Timestamp: 10})
+	mm.Receive(&gostatsd.Metric{Name: "set", StringValue: "x", Type: gostatsd.SET, Timestamp: 10})
+	mm.Receive(&gostatsd.Metric{Name: "timer", Value: 5, Type: gostatsd.TIMER, Timestamp: 10})
+	e := &gostatsd.Event{Title: "title", Text: "text", DateHappened: 100}
+
+	now := time.Unix(1000, 0)
+	require.NoError(t, a.WriteMetrics(now, "datadog", "failed", mm))
+	require.NoError(t, a.WriteEvent(now.Add(time.Second), "datadog", "failed", e))
+
+	paths, err := List(dir)
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+
+	// Oldest first
+	record, err := Read(paths[0])
+	require.NoError(t, err)
+	assert.Equal(t, TypeMetrics, record.Type)
+	assert.Equal(t, "datadog", record.Backend)
+	assert.Equal(t, "failed", record.Reason)
+	assert.True(t, now.Equal(record.Timestamp))
+	assert.EqualValues(t, 3, record.Datapoints)
+	assert.Equal(t, mm, record.Metrics)
+	assert.Nil(t, record.Event)
+
+	record, err = Read(paths[1])
+	require.NoError(t, err)
+	assert.Equal(t, TypeEvent, record.Type)
+	assert.Equal(t, e, record.Event)
+
+	// Nothing more is written once the directory is full
+	full, err := New(dir, 1)
+	require.NoError(t, err)
+	require.Equal(t, errFull, full.WriteEvent(now, "datadog", "failed", e))
+	paths, err = List(dir)
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+}
@@ -0,0 +1,458 @@
+// Package diskqueue is a bounded queue of payloads persisted on disk, which survives restarts of the process.
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorName    = "cursor"
+	// headerSize is the size of the header written before each payload: the length of the payload, the checksum of
+	// the rest of the record, the time it was created, and the number of items in it.
+	headerSize = 4 + 4 + 8 + 8
+	// segmentsPerQueue is the number of segments a full queue is split in to, so making room for a new record only
+	// evicts a fraction of the queue.
+	segmentsPerQueue = 8
+)
+
+// Record is a payload in the queue.
+type Record struct {
+	Payload []byte
+	Items   uint64 // The number of datapoints or other items in the payload, reported if it is dropped
+	Created time.Time
+
+	seq    uint64
+	offset int64
+}
+
+// Dropped counts the records which were removed from the queue without being sent, because they were evicted to stay
+// within the size limit, expired, or could not be read back.
+type Dropped struct {
+	Records int
+	Items   uint64
+}
+
+// Stats describes the records in the queue.
+type Stats struct {
+	Records  int
+	Bytes    int64
+	Segments int
+}
+
+type recordIndex struct {
+	offset  int64
+	size    int64 // Including the header
+	items   uint64
+	created time.Time
+}
+
+type segment struct {
+	seq     uint64
+	size    int64         // The size of the file
+	records []recordIndex // The records which have not been removed, oldest first
+}
+
+// Queue is a bounded FIFO queue of payloads on disk.  Records are appended to segment files, and the position of the
+// oldest record is kept in a cursor file, so records are returned in the order they were pushed, across restarts.
+// When the queue is over its size limit, the oldest segment is evicted, and records older than the age limit are
+// expired as they reach the head of the queue.  Segments are checksummed, and a torn or corrupt tail is truncated
+// when the queue is opened.  It is safe for concurrent use.
+type Queue struct {
+	logger       logrus.FieldLogger
+	dir          string
+	maxBytes     int64
+	maxAge       time.Duration // 0 to never expire
+	segmentBytes int64
+
+	lock     sync.Mutex
+	segments []*segment // Oldest first, records are appended to the last
+	active   *os.File   // The last segment opened for appending, or nil if a new segment must be created
+	bytes    int64      // The size of the records which have not been removed
+	records  int
+	nextSeq  uint64
+}
+
+// Open opens the queue in dir, creating it if it doesn't exist, and recovers the records left by a previous process.
+func Open(logger logrus.FieldLogger, dir string, maxBytes int64, maxAge time.Duration) (*Queue, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("the maximum size must be positive")
+	}
+	if maxAge < 0 {
+		return nil, errors.New("the maximum age must not be negative")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %v", err)
+	}
+	q := &Queue{
+		logger:       logger,
+		dir:          dir,
+		maxBytes:     maxBytes,
+		maxAge:       maxAge,
+		segmentBytes: maxBytes / segmentsPerQueue,
+	}
+	if err := q.recover(); err != nil {
+		return nil, err
+	}
+	if q.records > 0 {
+		logger.WithFields(logrus.Fields{
+			"records":  q.records,
+			"bytes":    q.bytes,
+			"segments": len(q.segments),
+		}).Info("found queued records")
+	}
+	return q, nil
+}
+
+// recover reads the index of every segment in the directory, skipping the records before the cursor.
+func (q *Queue) recover() error {
+	infos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory: %v", err)
+	}
+	var seqs []uint64
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	cursorSeq, cursorOffset := q.readCursor()
+	q.nextSeq = cursorSeq + 1
+	for _, seq := range seqs {
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+		if seq < cursorSeq {
+			// Every record in it was removed
+			q.removeFile(seq)
+			continue
+		}
+		seg, err := q.readSegment(seq)
+		if err != nil {
+			return err
+		}
+		if seq == cursorSeq {
+			for len(seg.records) > 0 && seg.records[0].offset < cursorOffset {
+				seg.records = seg.records[1:]
+			}
+		}
+		if len(seg.records) == 0 {
+			q.removeFile(seq)
+			continue
+		}
+		q.segments = append(q.segments, seg)
+		for _, r := range seg.records {
+			q.bytes += r.size
+		}
+		q.records += len(seg.records)
+	}
+	// New records are written to a new segment, rather than after what the previous process wrote
+	return nil
+}
+
+// readSegment indexes the records in a segment.  Everything after the first record which is incomplete or fails its
+// checksum is truncated, as it was being written when the previous process stopped, or has been corrupted.
+func (q *Queue) readSegment(seq uint64) (*segment, error) {
+	path := q.segmentPath(seq)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue segment: %v", err)
+	}
+	seg := &segment{seq: seq}
+	offset := int64(0)
+	for offset < int64(len(data)) {
+		r, ok := parseRecord(data[offset:])
+		if !ok {
+			q.logger.WithFields(logrus.Fields{
+				"segment": filepath.Base(path),
+				"bytes":   int64(len(data)) - offset,
+			}).Warn("discarding incomplete or corrupt queued records")
+			if err := os.Truncate(path, offset); err != nil {
+				return nil, fmt.Errorf("failed to truncate queue segment: %v", err)
+			}
+			break
+		}
+		r.offset = offset
+		seg.records = append(seg.records, r)
+		offset += r.size
+	}
+	seg.size = offset
+	return seg, nil
+}
+
+// parseRecord returns the index of the record at the start of data, and false if it is incomplete or corrupt.
+func parseRecord(data []byte) (recordIndex, bool) {
+	if len(data) < headerSize {
+		return recordIndex{}, false
+	}
+	size := headerSize + int64(binary.BigEndian.Uint32(data[0:4]))
+	if int64(len(data)) < size {
+		return recordIndex{}, false
+	}
+	if crc32.ChecksumIEEE(data[8:size]) != binary.BigEndian.Uint32(data[4:8]) {
+		return recordIndex{}, false
+	}
+	return recordIndex{
+		size:    size,
+		created: time.Unix(0, int64(binary.BigEndian.Uint64(data[8:16]))),
+		items:   binary.BigEndian.Uint64(data[16:24]),
+	}, true
+}
+
+// Push adds a payload with the given number of items to the end of the queue.  It returns the records which were
+// evicted to make room for it.
+func (q *Queue) Push(now time.Time, payload []byte, items uint64) (Dropped, error) {
+	size := int64(headerSize + len(payload))
+	if size > q.maxBytes {
+		return Dropped{}, fmt.Errorf("record of %d bytes is larger than the queue", size)
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint64(buf[16:24], items)
+	copy(buf[headerSize:], payload)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[8:]))
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	last := q.lastSegment()
+	if q.active == nil || (last.size > 0 && last.size+size > q.segmentBytes) {
+		if err := q.rotate(); err != nil {
+			return Dropped{}, err
+		}
+		last = q.lastSegment()
+	}
+	if _, err := q.active.Write(buf); err != nil {
+		// Don't leave a partial record for the next record to be written after
+		_ = q.active.Truncate(last.size)
+		return Dropped{}, fmt.Errorf("failed to write queue segment: %v", err)
+	}
+	last.records = append(last.records, recordIndex{offset: last.size, size: size, items: items, created: now})
+	last.size += size
+	q.bytes += size
+	q.records++
+
+	var dropped Dropped
+	for q.bytes > q.maxBytes && len(q.segments) > 1 {
+		q.evictOldest(&dropped)
+	}
+	return dropped, nil
+}
+
+// rotate starts a new segment to append records to.  It must be called with the lock held.
+func (q *Queue) rotate() error {
+	if q.active != nil {
+		if err := q.active.Close(); err != nil {
+			q.logger.WithError(err).Warn("failed to close queue segment")
+		}
+		q.active = nil
+	}
+	seq := q.nextSeq
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create queue segment: %v", err)
+	}
+	q.nextSeq++
+	q.active = f
+	q.segments = append(q.segments, &segment{seq: seq})
+	return nil
+}
+
+// evictOldest removes the oldest segment, which is never the segment being written to.  It must be called with the
+// lock held.
+func (q *Queue) evictOldest(dropped *Dropped) {
+	seg := q.segments[0]
+	for _, r := range seg.records {
+		dropped.Records++
+		dropped.Items += r.items
+		q.bytes -= r.size
+	}
+	q.records -= len(seg.records)
+	q.segments = q.segments[1:]
+	q.removeFile(seg.seq)
+}
+
+// Peek returns the oldest record in the queue, or nil if it is empty, after expiring the records older than the age
+// limit and dropping any which can not be read back.
+func (q *Queue) Peek(now time.Time) (*Record, Dropped) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var dropped Dropped
+	for {
+		seg, r, ok := q.head()
+		if !ok {
+			return nil, dropped
+		}
+		if q.maxAge > 0 && now.Sub(r.created) > q.maxAge {
+			q.popHead(&dropped)
+			continue
+		}
+		payload, err := q.readPayload(seg.seq, r)
+		if err != nil {
+			q.logger.WithError(err).WithField("segment", filepath.Base(q.segmentPath(seg.seq))).Warn("discarding unreadable queued record")
+			q.popHead(&dropped)
+			continue
+		}
+		return &Record{
+			Payload: payload,
+			Items:   r.items,
+			Created: r.created,
+			seq:     seg.seq,
+			offset:  r.offset,
+		}, dropped
+	}
+}
+
+func (q *Queue) readPayload(seq uint64, r recordIndex) ([]byte, error) {
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, r.size)
+	if _, err := f.ReadAt(data, r.offset); err != nil {
+		return nil, err
+	}
+	if _, ok := parseRecord(data); !ok {
+		return nil, errors.New("checksum mismatch")
+	}
+	return data[headerSize:], nil
+}
+
+// Remove removes a record returned by Peek from the queue, once it has been sent.  It does nothing if the record has
+// already been removed, such as when it was evicted while it was being sent.
+func (q *Queue) Remove(record *Record) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	seg, r, ok := q.head()
+	if !ok || seg.seq != record.seq || r.offset != record.offset {
+		return
+	}
+	q.popHead(nil)
+}
+
+// head returns the oldest record.  It must be called with the lock held.
+func (q *Queue) head() (*segment, recordIndex, bool) {
+	for _, seg := range q.segments {
+		if len(seg.records) > 0 {
+			return seg, seg.records[0], true
+		}
+	}
+	return nil, recordIndex{}, false
+}
+
+// popHead removes the oldest record, adding it to dropped if it is not nil, and moves the cursor past it.  Segments
+// which are empty and no longer written to are deleted.  It must be called with the lock held.
+func (q *Queue) popHead(dropped *Dropped) {
+	seg, r, _ := q.head()
+	seg.records = seg.records[1:]
+	q.bytes -= r.size
+	q.records--
+	if dropped != nil {
+		dropped.Records++
+		dropped.Items += r.items
+	}
+	q.writeCursor(seg.seq, r.offset+r.size)
+	for len(q.segments) > 1 && len(q.segments[0].records) == 0 {
+		q.removeFile(q.segments[0].seq)
+		q.segments = q.segments[1:]
+	}
+	if q.active == nil && len(q.segments) == 1 && len(q.segments[0].records) == 0 {
+		// Recovered from a previous process, and never written to
+		q.removeFile(q.segments[0].seq)
+		q.segments = nil
+	}
+}
+
+// readCursor returns the position of the oldest record which has not been removed.
+func (q *Queue) readCursor() (uint64, int64) {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, cursorName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			q.logger.WithError(err).Warn("failed to read queue cursor, records may be sent again")
+		}
+		return 0, 0
+	}
+	var seq uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		q.logger.WithError(err).Warn("invalid queue cursor, records may be sent again")
+		return 0, 0
+	}
+	return seq, offset
+}
+
+// writeCursor records the position of the oldest record which has not been removed.  It is written to a temporary
+// file first, so a partial cursor is never read back.
+func (q *Queue) writeCursor(seq uint64, offset int64) {
+	path := filepath.Join(q.dir, cursorName)
+	err := ioutil.WriteFile(path+".tmp", []byte(fmt.Sprintf("%d %d\n", seq, offset)), 0600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		q.logger.WithError(err).Warn("failed to write queue cursor, records may be sent again")
+	}
+}
+
+func (q *Queue) lastSegment() *segment {
+	if len(q.segments) == 0 {
+		return &segment{}
+	}
+	return q.segments[len(q.segments)-1]
+}
+
+func (q *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+func (q *Queue) removeFile(seq uint64) {
+	if err := os.Remove(q.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+		q.logger.WithError(err).WithField("segment", filepath.Base(q.segmentPath(seq))).Warn("failed to remove queue segment")
+	}
+}
+
+// Stats returns the number of records in the queue, their total size in bytes, and the number of segments.
+func (q *Queue) Stats() Stats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return Stats{
+		Records:  q.records,
+		Bytes:    q.bytes,
+		Segments: len(q.segments),
+	}
+}
+
+// Close closes the segment being written to.  The queue can not be used afterwards.
+func (q *Queue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.active == nil {
+		return nil
+	}
+	err := q.active.Close()
+	q.active = nil
+	return err
+}
@@ -0,0 +1,160 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestQueueOrder(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Unix(1000, 0)
+
+	q, err := Open(logrus.New(), dir, 1024*1024, 0)
+	require.NoError(t, err)
+	r, dropped := q.Peek(now)
+	require.Nil(t, r)
+	require.Zero(t, dropped)
+
+	for i := 0; i < 5; i++ {
+		dropped, err := q.Push(now, []byte(fmt.Sprintf("payload-%d", i)), uint64(i))
+		require.NoError(t, err)
+		require.Zero(t, dropped)
+	}
+	assert.Equal(t, 5, q.Stats().Records)
+
+	r, _ = q.Peek(now)
+	require.NotNil(t, r)
+	assert.Equal(t, "payload-0", string(r.Payload))
+	// Peek doesn't remove the record
+	r, _ = q.Peek(now)
+	assert.Equal(t, "payload-0", string(r.Payload))
+	q.Remove(r)
+	// A record which was already removed is ignored
+	q.Remove(r)
+
+	r, _ = q.Peek(now)
+	assert.Equal(t, "payload-1", string(r.Payload))
+	assert.EqualValues(t, 1, r.Items)
+	assert.Equal(t, now, r.Created)
+	q.Remove(r)
+	require.NoError(t, q.Close())
+
+	// The records which were not removed are recovered, in order
+	q, err = Open(logrus.New(), dir, 1024*1024, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, q.Stats().Records)
+	_, err = q.Push(now, []byte("payload-5"), 5)
+	require.NoError(t, err)
+	for i := 2; i <= 5; i++ {
+		r, _ = q.Peek(now)
+		require.NotNil(t, r)
+		assert.Equal(t, fmt.Sprintf("payload-%d", i), string(r.Payload))
+		q.Remove(r)
+	}
+	r, _ = q.Peek(now)
+	assert.Nil(t, r)
+	assert.Equal(t, Stats{Segments: 1}, q.Stats())
+	require.NoError(t, q.Close())
+}
+
+func TestQueueEvictsOldestSegment(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Unix(1000, 0)
+
+	// Each record is 100 bytes, so each segment holds 1 record
+	payload := make([]byte, 100-headerSize)
+	q, err := Open(logrus.New(), dir, 8*100, 0)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		dropped, err := q.Push(now, payload, 2)
+		require.NoError(t, err)
+		require.Zero(t, dropped)
+	}
+	dropped, err := q.Push(now, payload, 2)
+	require.NoError(t, err)
+	assert.Equal(t, Dropped{Records: 1, Items: 2}, dropped)
+	assert.Equal(t, Stats{Records: 8, Bytes: 800, Segments: 8}, q.Stats())
+
+	_, err = q.Push(now, make([]byte, 800), 1)
+	require.Error(t, err)
+	require.NoError(t, q.Close())
+}
+
+func TestQueueExpires(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Unix(1000, 0)
+
+	q, err := Open(logrus.New(), dir, 1024*1024, time.Minute)
+	require.NoError(t, err)
+	_, err = q.Push(now, []byte("old"), 3)
+	require.NoError(t, err)
+	_, err = q.Push(now.Add(time.Minute), []byte("new"), 4)
+	require.NoError(t, err)
+
+	r, dropped := q.Peek(now.Add(90 * time.Second))
+	require.NotNil(t, r)
+	assert.Equal(t, "new", string(r.Payload))
+	assert.Equal(t, Dropped{Records: 1, Items: 3}, dropped)
+	require.NoError(t, q.Close())
+}
+
+func TestQueueRecoversFromCorruption(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Unix(1000, 0)
+
+	q, err := Open(logrus.New(), dir, 1024*1024, 0)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = q.Push(now, []byte(fmt.Sprintf("payload-%d", i)), 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, q.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	data, err := ioutil.ReadFile(segments[0])
+	require.NoError(t, err)
+	recordSize := len(data) / 3
+	// The last record was torn, and the second was corrupted
+	data = data[:len(data)-1]
+	data[recordSize+headerSize] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(segments[0], data, 0600))
+
+	q, err = Open(logrus.New(), dir, 1024*1024, 0)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Records: 1, Bytes: int64(recordSize), Segments: 1}, q.Stats())
+	info, err := os.Stat(segments[0])
+	require.NoError(t, err)
+	assert.EqualValues(t, recordSize, info.Size())
+
+	r, _ := q.Peek(now)
+	require.NotNil(t, r)
+	assert.Equal(t, "payload-0", string(r.Payload))
+	q.Remove(r)
+	r, _ = q.Peek(now)
+	assert.Nil(t, r)
+	require.NoError(t, q.Close())
+}
@@ -0,0 +1,332 @@
+package profiling
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+// maxWrittenProfiles is the number of triggered profiles kept in the directory, the oldest are removed first.
+const maxWrittenProfiles = 20
+
+// Options controls how profiles are captured.
+type Options struct {
+	// PushURL is the URL of a pprof ingestion endpoint, such as the /ingest endpoint of Pyroscope, profiles are pushed
+	// to every Interval.  If it is "", profiles are not pushed.
+	PushURL string
+	// AppName is the name of the application the pushed profiles belong to.
+	AppName string
+	// Interval is how often profiles are pushed.
+	Interval time.Duration
+	// CPUDuration is how long the CPU is profiled for each time profiles are captured.
+	CPUDuration time.Duration
+	// Dir is the directory profiles are written to when they are triggered.  If it is "", profiles are not triggered.
+	Dir string
+	// TriggerCooldown is the minimum time between triggered profiles.
+	TriggerCooldown time.Duration
+}
+
+// OptionsFromViper returns the profiling options from the configuration.
+func OptionsFromViper(v *viper.Viper) Options {
+	return Options{
+		PushURL:         v.GetString(gostatsd.ParamProfilingPushURL),
+		AppName:         v.GetString(gostatsd.ParamProfilingAppName),
+		Interval:        v.GetDuration(gostatsd.ParamProfilingInterval),
+		CPUDuration:     v.GetDuration(gostatsd.ParamProfilingCPUDuration),
+		Dir:             v.GetString(gostatsd.ParamProfilingDir),
+		TriggerCooldown: v.GetDuration(gostatsd.ParamProfilingTriggerCooldown),
+	}
+}
+
+// Profiler captures CPU and heap profiles, and either pushes them to a pprof ingestion endpoint periodically, or writes
+// them to disk when triggered by the server being under stress, so regressions at peak times can be analysed
+// afterwards.  Profiles are captured one at a time, as the Go runtime can only profile the CPU once at a time.
+//
+// A nil Profiler does nothing.
+type Profiler struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	lastTriggered   int64 // Time of the last triggered profile. Unix timestamp in nsec.
+	pushed          uint64
+	pushFailures    uint64
+	written         uint64
+	captureFailures uint64
+	triggersSkipped uint64
+
+	opts     Options
+	hostname gostatsd.Source
+	client   *http.Client
+	logger   logrus.FieldLogger
+	triggers chan string
+}
+
+// NewProfilerFromViper returns a new Profiler configured from the configuration, or nil if profiling is disabled.
+func NewProfilerFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool, hostname gostatsd.Source) (*Profiler, error) {
+	opts := OptionsFromViper(v)
+	if opts.PushURL == "" && opts.Dir == "" {
+		return nil, nil
+	}
+	var client *http.Client
+	if opts.PushURL != "" {
+		tc, err := pool.Get("default")
+		if err != nil {
+			return nil, err
+		}
+		client = tc.Client
+	}
+	return NewProfiler(opts, hostname, client, logger)
+}
+
+// NewProfiler returns a new Profiler.  The hostname labels the pushed profiles, and the client pushes them.
+func NewProfiler(opts Options, hostname gostatsd.Source, client *http.Client, logger logrus.FieldLogger) (*Profiler, error) {
+	if opts.CPUDuration <= 0 {
+		return nil, fmt.Errorf("%s must be positive", gostatsd.ParamProfilingCPUDuration)
+	}
+	if opts.PushURL != "" {
+		if _, err := url.Parse(opts.PushURL); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", gostatsd.ParamProfilingPushURL, err)
+		}
+		if opts.Interval <= opts.CPUDuration {
+			return nil, fmt.Errorf("%s must be longer than %s", gostatsd.ParamProfilingInterval, gostatsd.ParamProfilingCPUDuration)
+		}
+	}
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create %s: %v", gostatsd.ParamProfilingDir, err)
+		}
+	}
+	logger.WithFields(logrus.Fields{
+		"push-url":         opts.PushURL,
+		"interval":         opts.Interval,
+		"cpu-duration":     opts.CPUDuration,
+		"dir":              opts.Dir,
+		"trigger-cooldown": opts.TriggerCooldown,
+	}).Info("Profiling enabled")
+	return &Profiler{
+		opts:     opts,
+		hostname: hostname,
+		client:   client,
+		logger:   logger,
+		triggers: make(chan string, 1),
+	}, nil
+}
+
+// Run pushes profiles every interval, and writes triggered profiles, until the context is closed.
+func (p *Profiler) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	if p.opts.PushURL != "" {
+		ticker := time.NewTicker(p.opts.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			p.pushProfiles(ctx)
+		case reason := <-p.triggers:
+			p.writeProfiles(ctx, reason)
+		}
+	}
+}
+
+// TriggerProfile writes profiles to the directory, unless profiles were triggered within the cooldown, or are still
+// being captured.  It does not block.
+func (p *Profiler) TriggerProfile(reason string) {
+	if p == nil || p.opts.Dir == "" {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.lastTriggered)
+	if (last != 0 && time.Duration(now-last) < p.opts.TriggerCooldown) || !atomic.CompareAndSwapInt64(&p.lastTriggered, last, now) {
+		atomic.AddUint64(&p.triggersSkipped, 1)
+		return
+	}
+	select {
+	case p.triggers <- reason:
+	default:
+		atomic.AddUint64(&p.triggersSkipped, 1)
+	}
+}
+
+// profile is a captured profile.
+type profile struct {
+	kind  string // cpu or heap
+	from  time.Time
+	until time.Time
+	data  []byte
+}
+
+// capture profiles the CPU for CPUDuration, and then the heap.  If the CPU can not be profiled, because it is already
+// being profiled by the pprof endpoints, only the heap profile is returned.
+func (p *Profiler) capture(ctx context.Context) []profile {
+	var profiles []profile
+	var buf bytes.Buffer
+	from := time.Now()
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		atomic.AddUint64(&p.captureFailures, 1)
+		p.logger.WithError(err).Warn("Failed to profile CPU")
+	} else {
+		timer := time.NewTimer(p.opts.CPUDuration)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+		pprof.StopCPUProfile()
+		profiles = append(profiles, profile{kind: "cpu", from: from, until: time.Now(), data: buf.Bytes()})
+	}
+
+	var heap bytes.Buffer
+	now := time.Now()
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		atomic.AddUint64(&p.captureFailures, 1)
+		p.logger.WithError(err).Warn("Failed to profile heap")
+	} else {
+		profiles = append(profiles, profile{kind: "heap", from: now, until: now, data: heap.Bytes()})
+	}
+	return profiles
+}
+
+// pushProfiles captures profiles and pushes them to PushURL.
+func (p *Profiler) pushProfiles(ctx context.Context) {
+	for _, prof := range p.capture(ctx) {
+		if err := p.push(ctx, prof); err != nil {
+			atomic.AddUint64(&p.pushFailures, 1)
+			if err != context.Canceled {
+				p.logger.WithError(err).WithField("profile", prof.kind).Warn("Failed to push profile")
+			}
+			continue
+		}
+		atomic.AddUint64(&p.pushed, 1)
+	}
+}
+
+// push sends a profile to PushURL, in the format of the Pyroscope ingestion API, which takes the name of the
+// application with the type of profile and its labels, the time it covers, and the pprof encoded profile as the body.
+func (p *Profiler) push(ctx context.Context, prof profile) error {
+	u, err := url.Parse(p.opts.PushURL)
+	if err != nil {
+		return err
+	}
+	name := p.opts.AppName + "." + prof.kind
+	if p.hostname != "" {
+		name += "{host=" + string(p.hostname) + "}"
+	}
+	q := u.Query()
+	q.Set("name", name)
+	q.Set("from", strconv.FormatInt(prof.from.Unix(), 10))
+	q.Set("until", strconv.FormatInt(prof.until.Unix(), 10))
+	q.Set("format", "pprof")
+	q.Set("spyName", "gospy")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(prof.data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("received bad status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// writeProfiles captures profiles and writes them to Dir, named after the time and the reason they were triggered,
+// and removes the oldest profiles beyond maxWrittenProfiles.
+func (p *Profiler) writeProfiles(ctx context.Context, reason string) {
+	p.logger.WithField("reason", reason).Info("Capturing triggered profiles")
+	prefix := time.Now().UTC().Format("20060102T150405Z") + "-" + sanitize(reason)
+	for _, prof := range p.capture(ctx) {
+		path := filepath.Join(p.opts.Dir, prefix+"-"+prof.kind+".pprof")
+		if err := ioutil.WriteFile(path, prof.data, 0644); err != nil {
+			atomic.AddUint64(&p.captureFailures, 1)
+			p.logger.WithError(err).WithField("path", path).Warn("Failed to write profile")
+			continue
+		}
+		atomic.AddUint64(&p.written, 1)
+	}
+	p.removeOldProfiles()
+}
+
+func (p *Profiler) removeOldProfiles() {
+	paths, err := filepath.Glob(filepath.Join(p.opts.Dir, "*.pprof"))
+	if err != nil || len(paths) <= maxWrittenProfiles {
+		return
+	}
+	sort.Strings(paths) // Named by the time they were captured
+	for _, path := range paths[:len(paths)-maxWrittenProfiles] {
+		if err := os.Remove(path); err != nil {
+			p.logger.WithError(err).WithField("path", path).Warn("Failed to remove old profile")
+		}
+	}
+}
+
+// sanitize replaces the characters of a reason which are not safe in a file name.
+func sanitize(reason string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, reason)
+}
+
+// RunMetricsContext emits the number of profiles pushed and written every flush until the context is closed.
+func (p *Profiler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	var last [5]uint64
+	counters := []struct {
+		name    string
+		tags    gostatsd.Tags
+		counter *uint64
+	}{
+		{"profiling.profiles", gostatsd.Tags{"result:pushed"}, &p.pushed},
+		{"profiling.profiles", gostatsd.Tags{"result:push_failed"}, &p.pushFailures},
+		{"profiling.profiles", gostatsd.Tags{"result:written"}, &p.written},
+		{"profiling.profiles", gostatsd.Tags{"result:capture_failed"}, &p.captureFailures},
+		{"profiling.triggers_skipped", nil, &p.triggersSkipped},
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			for idx, c := range counters {
+				cur := atomic.LoadUint64(c.counter)
+				if cur > last[idx] {
+					statser.Count(c.name, float64(cur-last[idx]), c.tags)
+				}
+				last[idx] = cur
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package profiling
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The CPU can only be profiled by one test at a time, so these tests do not run in parallel.
+
+func TestPushProfiles(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, body)
+		assert.Equal(t, "/ingest", r.URL.Path)
+		assert.Equal(t, "pprof", r.URL.Query().Get("format"))
+		assert.NotEmpty(t, r.URL.Query().Get("from"))
+		mu.Lock()
+		names = append(names, r.URL.Query().Get("name"))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	p, err := NewProfiler(Options{
+		PushURL:     ts.URL + "/ingest",
+		AppName:     "gostatsd",
+		Interval:    time.Minute,
+		CPUDuration: 10 * time.Millisecond,
+	}, "host1", ts.Client(), logrus.New())
+	require.NoError(t, err)
+
+	p.pushProfiles(context.Background())
+	assert.Equal(t, []string{"gostatsd.cpu{host=host1}", "gostatsd.heap{host=host1}"}, names)
+	assert.EqualValues(t, 2, atomic.LoadUint64(&p.pushed))
+	assert.Zero(t, atomic.LoadUint64(&p.pushFailures))
+}
+
+func TestPushProfilesFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	p, err := NewProfiler(Options{
+		PushURL:     ts.URL,
+		Interval:    time.Minute,
+		CPUDuration: 10 * time.Millisecond,
+	}, "", ts.Client(), logrus.New())
+	require.NoError(t, err)
+
+	p.pushProfiles(context.Background())
+	assert.Zero(t, atomic.LoadUint64(&p.pushed))
+	assert.EqualValues(t, 2, atomic.LoadUint64(&p.pushFailures))
+}
+
+func TestTriggerProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiling")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewProfiler(Options{
+		CPUDuration:     10 * time.Millisecond,
+		Dir:             dir,
+		TriggerCooldown: time.Hour,
+	}, "", nil, logrus.New())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.Run(ctx)
+	}()
+
+	p.TriggerProfile("saturated_dispatch aggregator")
+	p.TriggerProfile("flush_overrun") // Within the cooldown
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint64(&p.written) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&p.triggersSkipped))
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pprof"))
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+	assert.Regexp(t, `-saturated_dispatch_aggregator-cpu\.pprof$`, paths[0])
+	assert.Regexp(t, `-saturated_dispatch_aggregator-heap\.pprof$`, paths[1])
+}
+
+func TestRemoveOldProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiling")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < maxWrittenProfiles+5; i++ {
+		path := filepath.Join(dir, "2020010"+strconv.Itoa(i/10)+"T0000"+strconv.Itoa(i%10)+"0Z-test-cpu.pprof")
+		require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	}
+	p := &Profiler{opts: Options{Dir: dir}, logger: logrus.New()}
+	p.removeOldProfiles()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pprof"))
+	require.NoError(t, err)
+	require.Len(t, paths, maxWrittenProfiles)
+	assert.Equal(t, "20200100T000050Z-test-cpu.pprof", filepath.Base(paths[0]))
+}
+
+func TestNilProfiler(t *testing.T) {
+	var p *Profiler
+	p.TriggerProfile("flush_overrun")
+}
+
+func TestNewProfilerValidates(t *testing.T) {
+	_, err := NewProfiler(Options{PushURL: "http://localhost", Interval: time.Second, CPUDuration: 10 * time.Second}, "", nil, logrus.New())
+	require.Error(t, err)
+	_, err = NewProfiler(Options{Dir: "/tmp"}, "", nil, logrus.New())
+	require.Error(t, err)
+}
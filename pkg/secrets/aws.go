@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// awsSecretsManagerProvider reads secrets from AWS Secrets Manager, with the credentials and region of the
+// environment.  aws-sm://NAME reads the whole secret, and aws-sm://NAME#KEY reads a key of a secret which is a JSON
+// object.
+type awsSecretsManagerProvider struct {
+	once   sync.Once
+	client *secretsmanager.SecretsManager
+	err    error
+}
+
+// Resolve reads the secret named by ref.  The client is created the first time a secret is read, so the environment
+// does not need to be configured for AWS unless it is used.
+func (ap *awsSecretsManagerProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	ap.once.Do(func() {
+		var sess *session.Session
+		if sess, ap.err = session.NewSession(); ap.err == nil {
+			ap.client = secretsmanager.New(sess)
+		}
+	})
+	if ap.err != nil {
+		return "", ap.err
+	}
+	name, key := splitKey(ref)
+	out, err := ap.client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		return "", err
+	}
+	secret := aws.StringValue(out.SecretString)
+	if key == "" {
+		return secret, nil
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &values); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object: %v", err)
+	}
+	value, ok := values[key].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no string key %q", key)
+	}
+	return value, nil
+}
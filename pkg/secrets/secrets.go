@@ -0,0 +1,180 @@
+// Package secrets resolves references to secrets in configuration values, such as vault://secret/data/app#key, so
+// secrets do not need to be written in configuration files.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+// resolveTimeout is the maximum time taken to resolve a secret.
+const resolveTimeout = 30 * time.Second
+
+// schemeSeparator separates the scheme of a reference, which selects the provider, from the rest of it.
+const schemeSeparator = "://"
+
+// Provider resolves a reference to a secret, without its scheme, to the value of the secret.
+type Provider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// ProviderFunc type is an adapter to allow the use of ordinary functions as Provider.
+type ProviderFunc func(ctx context.Context, ref string) (string, error)
+
+// Resolve calls f(ctx, ref).
+func (f ProviderFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// Resolver replaces configuration values which are a reference to a secret with the value of the secret.  The
+// provider of a secret is selected by the scheme of its reference, and a value which does not start with the scheme
+// of a provider is not a reference.  The secrets resolved are remembered, so they can be resolved again to detect when
+// they are rotated.
+type Resolver struct {
+	logger    logrus.FieldLogger
+	providers map[string]Provider // By scheme
+
+	lock     sync.Mutex
+	resolved map[string]string // The value of every reference resolved, by reference
+}
+
+// NewResolver creates a Resolver with the providers, by scheme.
+func NewResolver(logger logrus.FieldLogger, providers map[string]Provider) *Resolver {
+	return &Resolver{
+		logger:    logger,
+		providers: providers,
+		resolved:  map[string]string{},
+	}
+}
+
+// NewResolverFromViper creates a Resolver which resolves file://PATH, vault://PATH#KEY, and aws-sm://NAME[#KEY].
+// Vault is configured from ParamVaultAddress and ParamVaultToken, or VAULT_ADDR and VAULT_TOKEN if they are not set.
+func NewResolverFromViper(logger logrus.FieldLogger, v *viper.Viper) (*Resolver, error) {
+	address := v.GetString(gostatsd.ParamVaultAddress)
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	token, err := util.Expand(v.GetString(gostatsd.ParamVaultToken))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", gostatsd.ParamVaultToken, err)
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return NewResolver(logger.WithField("component", "secrets"), map[string]Provider{
+		"file":   ProviderFunc(resolveFile),
+		"vault":  newVaultProvider(address, token, &http.Client{Timeout: resolveTimeout}),
+		"aws-sm": &awsSecretsManagerProvider{},
+	}), nil
+}
+
+// Resolve returns the secret referenced by value, or value if it is not a reference.
+func (r *Resolver) Resolve(value string) (string, error) {
+	i := strings.Index(value, schemeSeparator)
+	if i < 0 {
+		return value, nil
+	}
+	provider, ok := r.providers[value[:i]]
+	if !ok {
+		return value, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	secret, err := provider.Resolve(ctx, value[i+len(schemeSeparator):])
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", value, err)
+	}
+	r.lock.Lock()
+	r.resolved[value] = secret
+	r.lock.Unlock()
+	return secret, nil
+}
+
+// IsSecret returns true if value is a secret which has been resolved, so it can be masked.
+func (r *Resolver) IsSecret(value string) bool {
+	if value == "" {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, secret := range r.resolved {
+		if secret == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh resolves every secret which has been resolved again, and returns true if any of them changed.  A secret
+// which can not be resolved is logged, and is not changed.
+func (r *Resolver) Refresh() bool {
+	r.lock.Lock()
+	previous := make(map[string]string, len(r.resolved))
+	for ref, secret := range r.resolved {
+		previous[ref] = secret
+	}
+	r.lock.Unlock()
+
+	changed := false
+	for ref, secret := range previous {
+		current, err := r.Resolve(ref)
+		if err != nil {
+			r.logger.WithError(err).Warn("Failed to refresh secret")
+			continue
+		}
+		if current != secret {
+			r.logger.WithField("ref", ref).Info("Secret changed")
+			changed = true
+		}
+	}
+	return changed
+}
+
+// RunRefresh returns a Runnable which refreshes the secrets every interval, and calls onChange when any of them
+// changed, so they can be applied.
+func (r *Resolver) RunRefresh(interval time.Duration, onChange func(ctx context.Context)) gostatsd.Runnable {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if r.Refresh() {
+					onChange(ctx)
+				}
+			}
+		}
+	}
+}
+
+// splitKey splits a reference in to the secret, and the key of the value within it after #, if any.
+func splitKey(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// resolveFile returns the contents of the file at path, without leading or trailing whitespace, such as a Kubernetes
+// secret mounted as a volume.
+func resolveFile(ctx context.Context, path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
@@ -0,0 +1,49 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolverResolvesReferences(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api-key")
+	require.NoError(t, ioutil.WriteFile(path, []byte("first\n"), 0600))
+
+	r := NewResolver(logrus.StandardLogger(), map[string]Provider{"file": ProviderFunc(resolveFile)})
+	value, err := r.Resolve("file://" + path)
+	require.NoError(t, err)
+	assert.Equal(t, "first", value)
+
+	// Values which are not a reference to a known provider are unchanged
+	value, err = r.Resolve("https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com", value)
+
+	_, err = r.Resolve("file://" + filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+
+	assert.False(t, r.Refresh())
+	require.NoError(t, ioutil.WriteFile(path, []byte("second\n"), 0600))
+	assert.True(t, r.Refresh())
+	assert.False(t, r.Refresh())
+}
+
+func TestSplitKey(t *testing.T) {
+	t.Parallel()
+	name, key := splitKey("secret/data/gostatsd#api_key")
+	assert.Equal(t, "secret/data/gostatsd", name)
+	assert.Equal(t, "api_key", key)
+	name, key = splitKey("gostatsd")
+	assert.Equal(t, "gostatsd", name)
+	assert.Equal(t, "", key)
+}
@@ -0,0 +1,68 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// vaultProvider reads secrets from the HTTP API of Vault.  Both versions of the KV secrets engine are supported, so
+// vault://secret/data/gostatsd#api_key reads the key api_key of the secret gostatsd from a version 2 engine mounted at
+// secret.
+type vaultProvider struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+func newVaultProvider(address, token string, client *http.Client) *vaultProvider {
+	return &vaultProvider{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		client:  client,
+	}
+}
+
+// Resolve reads the key of the secret at the path of ref, which is PATH#KEY.
+func (vp *vaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	if vp.address == "" {
+		return "", errors.New("the vault address is not configured")
+	}
+	path, key := splitKey(ref)
+	if key == "" {
+		return "", errors.New("a vault reference must name a key, as vault://PATH#KEY")
+	}
+	req, err := http.NewRequest(http.MethodGet, vp.address+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", vp.token)
+	resp, err := vp.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s", resp.Status)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid response from vault: %v", err)
+	}
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		// Version 2 of the KV secrets engine nests the secret alongside its metadata
+		data = nested
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no string key %q", key)
+	}
+	return value, nil
+}
@@ -0,0 +1,49 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultProvider(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/gostatsd":
+			_, _ = w.Write([]byte(`{"data":{"data":{"api_key":"v2"},"metadata":{"version":3}}}`))
+		case "/v1/kv/gostatsd":
+			_, _ = w.Write([]byte(`{"data":{"api_key":"v1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	vp := newVaultProvider(server.URL+"/", "token", server.Client())
+	value, err := vp.Resolve(ctx, "secret/data/gostatsd#api_key")
+	require.NoError(t, err)
+	assert.Equal(t, "v2", value)
+	value, err = vp.Resolve(ctx, "kv/gostatsd#api_key")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", value)
+
+	_, err = vp.Resolve(ctx, "kv/gostatsd#missing")
+	assert.Error(t, err)
+	_, err = vp.Resolve(ctx, "kv/gostatsd")
+	assert.Error(t, err)
+	_, err = vp.Resolve(ctx, "kv/missing#api_key")
+	assert.EqualError(t, err, "vault returned 404 Not Found")
+
+	_, err = newVaultProvider(server.URL, "wrong", server.Client()).Resolve(ctx, "kv/gostatsd#api_key")
+	assert.EqualError(t, err, "vault returned 403 Forbidden")
+}
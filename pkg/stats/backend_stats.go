@@ -0,0 +1,113 @@
+package stats
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/hligit/gostatsd"
+)
+
+// Reasons a batch is dropped by a backend.
+const (
+	// DropReasonSerialize is when the batch could not be serialized, so it could never be sent.
+	DropReasonSerialize = "serialize"
+	// DropReasonRetriesExhausted is when every attempt failed, and the backend's max-request-elapsed-time has passed.
+	DropReasonRetriesExhausted = "retries_exhausted"
+	// DropReasonCanceled is when the flush was canceled, usually by the next flush, while waiting to retry.
+	DropReasonCanceled = "canceled"
+	// DropReasonRetryBudget is when an attempt failed, and the retry budget shared by every backend is spent.
+	DropReasonRetryBudget = "retry_budget"
+	// DropReasonRejected is when the backend's API rejected the data as invalid, so it would be rejected again if it
+	// was retried.
+	DropReasonRejected = "rejected"
+)
+
+// BackendStats records the metrics common to the backends which send batches over http, so every backend reports them
+// the same way.  The counters are accumulated over the lifetime of the backend, and written every flush by RunMetrics,
+// the other metrics are written as requests are made.
+type BackendStats struct {
+	BatchesCreated      uint64      // Accumulated number of batches created
+	BatchesCreateFailed uint64      // Accumulated number of batches which failed to serialize (data loss, no retry is possible)
+	BatchesDropped      uint64      // Accumulated number of batches aborted (data loss)
+	BatchesSent         uint64      // Accumulated number of batches successfully sent
+	SeriesSent          uint64      // Accumulated number of series successfully sent
+	BatchesRetried      ChangeGauge // Accumulated number of batches retried (first send is not a retry)
+
+	name string
+	tags gostatsd.Tags
+}
+
+// NewBackendStats creates a new BackendStats for the named backend.
+func NewBackendStats(backendName string) *BackendStats {
+	return &BackendStats{
+		name: backendName,
+		tags: gostatsd.Tags{"backend:" + backendName},
+	}
+}
+
+// RunMetrics writes the accumulated counters every flush until the supplied context is closed.
+func (bs *BackendStats) RunMetrics(ctx context.Context, statser Statser) {
+	statser = statser.WithTags(bs.tags)
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+	defer PublishExpvar("backend."+bs.name, bs.expvar)()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&bs.BatchesCreated)), nil)
+			statser.Gauge("backend.create.failed", float64(atomic.LoadUint64(&bs.BatchesCreateFailed)), nil)
+			bs.BatchesRetried.SendIfChanged(statser, "backend.retried", nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&bs.BatchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&bs.BatchesSent)), nil)
+			statser.Gauge("backend.series.sent", float64(atomic.LoadUint64(&bs.SeriesSent)), nil)
+		}
+	}
+}
+
+// expvar returns the counters published in expvar.
+func (bs *BackendStats) expvar() interface{} {
+	return map[string]uint64{
+		"created":       atomic.LoadUint64(&bs.BatchesCreated),
+		"create_failed": atomic.LoadUint64(&bs.BatchesCreateFailed),
+		"retried":       atomic.LoadUint64(&bs.BatchesRetried.Cur),
+		"dropped":       atomic.LoadUint64(&bs.BatchesDropped),
+		"sent":          atomic.LoadUint64(&bs.BatchesSent),
+		"series_sent":   atomic.LoadUint64(&bs.SeriesSent),
+	}
+}
+
+// NewPostTimer starts a timer for a single attempt to send a batch of typeOfPost, such as metrics or events.
+func (bs *BackendStats) NewPostTimer(ctx context.Context, typeOfPost string) *Timer {
+	return FromContext(ctx).WithTags(bs.tags).NewTimer("backend.post_time", gostatsd.Tags{"type:" + typeOfPost})
+}
+
+// Payload records the size of a batch of typeOfPost before and after it was compressed.  If it was not compressed,
+// both are the same.
+func (bs *BackendStats) Payload(ctx context.Context, typeOfPost string, raw, compressed int) {
+	statser := FromContext(ctx).WithTags(bs.tags)
+	statser.Count("backend.bytes", float64(raw), gostatsd.Tags{"type:" + typeOfPost, "encoding:raw"})
+	statser.Count("backend.bytes", float64(compressed), gostatsd.Tags{"type:" + typeOfPost, "encoding:compressed"})
+}
+
+// Response records the class of the status code of a response, such as 2xx or 5xx.  If there was no response, the
+// statusCode is 0, and it is recorded as an error.
+func (bs *BackendStats) Response(ctx context.Context, typeOfPost string, statusCode int) {
+	class := "error"
+	if statusCode > 0 {
+		class = strconv.Itoa(statusCode/100) + "xx"
+	}
+	FromContext(ctx).WithTags(bs.tags).Increment("backend.responses", gostatsd.Tags{"type:" + typeOfPost, "status:" + class})
+}
+
+// Dropped records a batch of typeOfPost being dropped, and why.  The datapoints are the number of series in the batch,
+// which are attributed to the backend by the DropAccounting in the context, and are 0 for events.
+func (bs *BackendStats) Dropped(ctx context.Context, typeOfPost, reason string, datapoints uint64) {
+	atomic.AddUint64(&bs.BatchesDropped, 1)
+	FromContext(ctx).WithTags(bs.tags).Increment("backend.dropped.reason", gostatsd.Tags{"type:" + typeOfPost, "reason:" + reason})
+	DropAccountingFromContext(ctx).Dropped(DropReasonBackend, bs.name, datapoints)
+}
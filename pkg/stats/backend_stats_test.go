@@ -0,0 +1,40 @@
+package stats
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendStats(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPrometheusStatser(NewNullStatser(), "", nil)
+	da := NewDropAccounting(nil, 0)
+	ctx := NewDropAccountingContext(NewContext(context.Background(), ps), da)
+	bs := NewBackendStats("test")
+	bs.Response(ctx, "metrics", 202)
+	bs.Response(ctx, "metrics", 503)
+	bs.Response(ctx, "metrics", 0)
+	bs.Payload(ctx, "events", 100, 20)
+	bs.Dropped(ctx, "metrics", DropReasonRetriesExhausted, 5)
+	assert.EqualValues(t, 1, bs.BatchesDropped)
+	da.emit(ps)
+
+	w := httptest.NewRecorder()
+	ps.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, `# TYPE backend_bytes counter
+backend_bytes{backend="test",encoding="compressed",type="events"} 20
+backend_bytes{backend="test",encoding="raw",type="events"} 100
+# TYPE backend_dropped_reason counter
+backend_dropped_reason{backend="test",reason="retries_exhausted",type="metrics"} 1
+# TYPE backend_responses counter
+backend_responses{backend="test",status="2xx",type="metrics"} 1
+backend_responses{backend="test",status="5xx",type="metrics"} 1
+backend_responses{backend="test",status="error",type="metrics"} 1
+# TYPE dropped_datapoints counter
+dropped_datapoints{backend="test",reason="backend"} 5
+`, w.Body.String())
+}
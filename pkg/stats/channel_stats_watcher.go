@@ -2,12 +2,24 @@ package stats
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"github.com/hligit/gostatsd"
 )
 
-// ChannelStatsWatcher reports metrics about channel usage to a Statser
+const (
+	// channelSaturationThreshold is the fraction of its capacity a channel must be at to be saturated.
+	channelSaturationThreshold = 0.9
+	// defaultChannelSaturationPeriod is how long a channel must be saturated for before an event is sent.
+	defaultChannelSaturationPeriod = 30 * time.Second
+)
+
+// ChannelStatsWatcher reports metrics about channel usage to a Statser, and sends an event when the channel has been
+// at or near capacity for a sustained period, and another when it recovers.
 type ChannelStatsWatcher struct {
 	samples     int
 	accumulated int
@@ -17,17 +29,26 @@ type ChannelStatsWatcher struct {
 	capacity    int
 
 	statser        Statser
+	channelName    string
+	expvarName     string
 	lenFunc        func() int
 	sampleInterval time.Duration
+
+	saturationPeriod  time.Duration
+	saturatedSamples  int  // The number of consecutive samples the channel has been saturated for
+	saturationAlerted bool // If an event has been sent for the current saturation
 }
 
 // NewChannelStatsWatcher creates a new ChannelStatsWatcher
 func NewChannelStatsWatcher(statser Statser, channelName string, tags gostatsd.Tags, capacity int, lenFunc func() int, sampleInterval time.Duration) *ChannelStatsWatcher {
 	return &ChannelStatsWatcher{
-		statser:        statser.WithTags(tags.Concat(gostatsd.Tags{"channel:" + channelName})),
-		capacity:       capacity,
-		lenFunc:        lenFunc,
-		sampleInterval: sampleInterval,
+		statser:          statser.WithTags(tags.Concat(gostatsd.Tags{"channel:" + channelName})),
+		channelName:      channelName,
+		expvarName:       strings.Join(append([]string{"channel", channelName}, tags...), "."),
+		capacity:         capacity,
+		lenFunc:          lenFunc,
+		sampleInterval:   sampleInterval,
+		saturationPeriod: defaultChannelSaturationPeriod,
 	}
 }
 
@@ -36,6 +57,7 @@ func NewChannelStatsWatcher(statser Statser, channelName string, tags gostatsd.T
 func (csw *ChannelStatsWatcher) Run(ctx context.Context) {
 	flushed, unregister := csw.statser.RegisterFlush()
 	defer unregister()
+	defer PublishExpvar(csw.expvarName, csw.expvar)()
 
 	ticker := time.NewTicker(csw.sampleInterval)
 	defer ticker.Stop()
@@ -51,7 +73,71 @@ func (csw *ChannelStatsWatcher) Run(ctx context.Context) {
 			csw.sample() // Ensure there will always be at least one sample
 		case <-ticker.C:
 			csw.sample()
+			csw.checkSaturation(ctx)
+		}
+	}
+}
+
+// checkSaturation sends an event if the last sample was the channel being saturated for saturationPeriod, or the
+// first after it has recovered.  Only samples taken every sampleInterval should be checked, so the number of them is
+// how long the channel was saturated for.
+func (csw *ChannelStatsWatcher) checkSaturation(ctx context.Context) {
+	if csw.capacity == 0 {
+		return
+	}
+	saturatedFor := time.Duration(csw.saturatedSamples) * csw.sampleInterval
+	if float64(csw.last) >= channelSaturationThreshold*float64(csw.capacity) {
+		csw.saturatedSamples++
+		saturatedFor += csw.sampleInterval
+		if !csw.saturationAlerted && saturatedFor >= csw.saturationPeriod {
+			csw.saturationAlerted = true
+			logrus.WithFields(logrus.Fields{
+				"channel":  csw.channelName,
+				"length":   csw.last,
+				"capacity": csw.capacity,
+				"duration": saturatedFor,
+			}).Warn("channel is saturated")
+			csw.sendEvent(ctx, "Gostatsd channel saturated: "+csw.channelName, fmt.Sprintf(
+				"Channel %s has been at least %.0f%% full for %s, and is at %d of %d",
+				csw.channelName, channelSaturationThreshold*100, saturatedFor, csw.last, csw.capacity,
+			), gostatsd.AlertWarning)
+			ProfileTriggerFromContext(ctx).TriggerProfile("saturated_" + csw.channelName)
 		}
+		return
+	}
+	if csw.saturationAlerted {
+		logrus.WithFields(logrus.Fields{
+			"channel":  csw.channelName,
+			"length":   csw.last,
+			"capacity": csw.capacity,
+			"duration": saturatedFor,
+		}).Info("channel is no longer saturated")
+		csw.sendEvent(ctx, "Gostatsd channel recovered: "+csw.channelName, fmt.Sprintf(
+			"Channel %s was saturated for %s, and is at %d of %d",
+			csw.channelName, saturatedFor, csw.last, csw.capacity,
+		), gostatsd.AlertSuccess)
+	}
+	csw.saturatedSamples = 0
+	csw.saturationAlerted = false
+}
+
+// sendEvent sends the event in the background, as dispatching it may block on the very channel which is saturated.
+func (csw *ChannelStatsWatcher) sendEvent(ctx context.Context, title, text string, alertType gostatsd.AlertType) {
+	e := &gostatsd.Event{
+		Title:        title,
+		Text:         text,
+		DateHappened: time.Now().Unix(),
+		Priority:     gostatsd.PriNormal,
+		AlertType:    alertType,
+	}
+	go csw.statser.Event(ctx, e)
+}
+
+// expvar returns the current length of the channel, rather than the last sample, which is only safe to read from Run.
+func (csw *ChannelStatsWatcher) expvar() interface{} {
+	return map[string]int{
+		"length":   csw.lenFunc(),
+		"capacity": csw.capacity,
 	}
 }
 
@@ -0,0 +1,61 @@
+package stats
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelStatsWatcherSaturation(t *testing.T) {
+	t.Parallel()
+	cs := &countingStatser{}
+	length := 0
+	csw := NewChannelStatsWatcher(cs, "test", nil, 10, func() int { return length }, time.Second)
+	csw.saturationPeriod = 3 * time.Second
+
+	events := func() uint64 {
+		time.Sleep(10 * time.Millisecond) // Events are sent in the background
+		return atomic.LoadUint64(&cs.events)
+	}
+	check := func(l int) {
+		length = l
+		csw.sample()
+		csw.checkSaturation(context.Background())
+	}
+
+	// Not saturated for long enough
+	check(9)
+	check(10)
+	check(5)
+	check(9)
+	check(9)
+	require.EqualValues(t, 0, events())
+
+	// Saturated for the period, only one event is sent while it stays saturated
+	check(9)
+	require.EqualValues(t, 1, events())
+	check(10)
+	require.EqualValues(t, 1, events())
+
+	// Recovered
+	check(8)
+	require.EqualValues(t, 2, events())
+	check(8)
+	require.EqualValues(t, 2, events())
+}
+
+func TestChannelStatsWatcherNoCapacity(t *testing.T) {
+	t.Parallel()
+	cs := &countingStatser{}
+	csw := NewChannelStatsWatcher(cs, "test", nil, 0, func() int { return 0 }, time.Second)
+	csw.saturationPeriod = time.Second
+	for i := 0; i < 3; i++ {
+		csw.sample()
+		csw.checkSaturation(context.Background())
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.EqualValues(t, 0, atomic.LoadUint64(&cs.events))
+}
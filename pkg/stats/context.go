@@ -6,7 +6,22 @@ import (
 
 type statserKey int
 
-const statserContextKey = statserKey(0)
+const (
+	statserContextKey = statserKey(iota)
+	dropAccountingContextKey
+	profileTriggerContextKey
+	retryBudgetContextKey
+)
+
+// ProfileTrigger captures profiles when the server is under stress, such as when a flush takes longer than the flush
+// interval, so the cause can be found afterwards.
+type ProfileTrigger interface {
+	TriggerProfile(reason string)
+}
+
+type nullProfileTrigger struct{}
+
+func (nullProfileTrigger) TriggerProfile(reason string) {}
 
 var nullStatser = &NullStatser{}
 
@@ -23,3 +38,41 @@ func FromContext(ctx context.Context) Statser {
 	}
 	return nullStatser
 }
+
+// NewDropAccountingContext attaches a DropAccounting to a Context
+func NewDropAccountingContext(ctx context.Context, da *DropAccounting) context.Context {
+	return context.WithValue(ctx, dropAccountingContextKey, da)
+}
+
+// DropAccountingFromContext returns a DropAccounting from a Context.  Always succeeds, will return nil, which discards
+// everything, if there is no DropAccounting present.
+func DropAccountingFromContext(ctx context.Context) *DropAccounting {
+	da, _ := ctx.Value(dropAccountingContextKey).(*DropAccounting)
+	return da
+}
+
+// NewRetryBudgetContext attaches a RetryBudget to a Context
+func NewRetryBudgetContext(ctx context.Context, rb *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetContextKey, rb)
+}
+
+// RetryBudgetFromContext returns a RetryBudget from a Context.  Always succeeds, will return nil, which allows every
+// retry, if there is no RetryBudget present.
+func RetryBudgetFromContext(ctx context.Context) *RetryBudget {
+	rb, _ := ctx.Value(retryBudgetContextKey).(*RetryBudget)
+	return rb
+}
+
+// NewProfileTriggerContext attaches a ProfileTrigger to a Context
+func NewProfileTriggerContext(ctx context.Context, pt ProfileTrigger) context.Context {
+	return context.WithValue(ctx, profileTriggerContextKey, pt)
+}
+
+// ProfileTriggerFromContext returns a ProfileTrigger from a Context.  Always succeeds, will return a ProfileTrigger
+// which does nothing if there is no ProfileTrigger present.
+func ProfileTriggerFromContext(ctx context.Context) ProfileTrigger {
+	if pt, ok := ctx.Value(profileTriggerContextKey).(ProfileTrigger); ok && pt != nil {
+		return pt
+	}
+	return nullProfileTrigger{}
+}
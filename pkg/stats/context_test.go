@@ -22,3 +22,21 @@ func TestContextInvalid(t *testing.T) {
 	returnedStatser := FromContext(context.Background())
 	require.NotNil(t, returnedStatser)
 }
+
+type recordingProfileTrigger []string
+
+func (r *recordingProfileTrigger) TriggerProfile(reason string) {
+	*r = append(*r, reason)
+}
+
+func TestProfileTriggerContext(t *testing.T) {
+	t.Parallel()
+
+	// Does nothing without a ProfileTrigger
+	ProfileTriggerFromContext(context.Background()).TriggerProfile("none")
+
+	pt := &recordingProfileTrigger{}
+	ctx := NewProfileTriggerContext(context.Background(), pt)
+	ProfileTriggerFromContext(ctx).TriggerProfile("flush_overrun")
+	require.Equal(t, []string{"flush_overrun"}, []string(*pt))
+}
@@ -0,0 +1,176 @@
+package stats
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+)
+
+// Reasons datapoints are dropped, for DropAccounting.
+const (
+	// DropReasonReceiveBuffer is when the kernel drops datagrams because the receive buffer of a socket is full.  The
+	// kernel doesn't know how many datapoints they held, so each datagram is counted as one.
+	DropReasonReceiveBuffer = "receive_buffer"
+	// DropReasonParseError is when a line can not be parsed.
+	DropReasonParseError = "parse_error"
+	// DropReasonBackend is when a backend gives up sending a batch.
+	DropReasonBackend = "backend"
+	// DropReasonForwarderQueue is when the forwarder queue is full, and its policy is to drop a batch.
+	DropReasonForwarderQueue = "forwarder_queue"
+	// DropReasonForwarderSend is when the forwarder gives up sending a batch, and it can not be spooled.
+	DropReasonForwarderSend = "forwarder_send"
+	// DropReasonMemoryLimit is when datagrams are shed because the heap is close to the memory limit.  Like
+	// DropReasonReceiveBuffer, each datagram is counted as one.
+	DropReasonMemoryLimit = "memory_limit"
+	// DropReasonCircuitOpen is when a backend has failed too many times in a row, and its circuit breaker fails sends
+	// without attempting them.
+	DropReasonCircuitOpen = "circuit_open"
+	// DropReasonFlushQueue is when a backend is still sending earlier flushes, and the oldest queued flush is dropped.
+	// Each series is counted as one.
+	DropReasonFlushQueue = "flush_queue"
+	// DropReasonWatchdog is when a backend did not complete a send within its watchdog timeout, and was restarted.
+	DropReasonWatchdog = "watchdog"
+)
+
+type dropKey struct {
+	reason  string
+	backend string
+}
+
+// DropAccounting attributes every datapoint dropped by the server to a reason, and the backend which dropped it if
+// there is one, so data loss is visible in one place rather than spread across the counters of each component.  The
+// counts are written every flush by Run, and a summary is logged every summaryInterval if anything was dropped.
+//
+// A nil DropAccounting discards everything, so components can use DropAccountingFromContext unconditionally.
+type DropAccounting struct {
+	logger          logrus.FieldLogger
+	summaryInterval time.Duration
+
+	lock    sync.Mutex
+	flush   map[dropKey]uint64 // Since the last flush
+	summary map[dropKey]uint64 // Since the last summary
+	total   map[dropKey]uint64 // Since the server started
+}
+
+// NewDropAccounting creates a new DropAccounting, which logs a summary every summaryInterval, or never if it is 0.
+func NewDropAccounting(logger logrus.FieldLogger, summaryInterval time.Duration) *DropAccounting {
+	return &DropAccounting{
+		logger:          logger,
+		summaryInterval: summaryInterval,
+		flush:           map[dropKey]uint64{},
+		summary:         map[dropKey]uint64{},
+		total:           map[dropKey]uint64{},
+	}
+}
+
+// Dropped records datapoints dropped for reason.  The backend is empty if the data was not dropped by a backend.
+func (da *DropAccounting) Dropped(reason, backend string, datapoints uint64) {
+	if da == nil || datapoints == 0 {
+		return
+	}
+	key := dropKey{reason: reason, backend: backend}
+	da.lock.Lock()
+	da.flush[key] += datapoints
+	da.summary[key] += datapoints
+	da.total[key] += datapoints
+	da.lock.Unlock()
+}
+
+// Total returns the datapoints dropped since the server started.
+func (da *DropAccounting) Total() uint64 {
+	if da == nil {
+		return 0
+	}
+	da.lock.Lock()
+	defer da.lock.Unlock()
+	var total uint64
+	for _, datapoints := range da.total {
+		total += datapoints
+	}
+	return total
+}
+
+// Run writes the datapoints dropped every flush, and logs a summary every summaryInterval, until the supplied context
+// is closed.
+func (da *DropAccounting) Run(ctx context.Context) {
+	statser := FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+	defer PublishExpvar("dropped", da.expvar)()
+
+	var summary <-chan time.Time
+	if da.summaryInterval > 0 {
+		ticker := time.NewTicker(da.summaryInterval)
+		defer ticker.Stop()
+		summary = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			da.emit(statser)
+		case <-summary:
+			da.logSummary()
+		}
+	}
+}
+
+func (da *DropAccounting) emit(statser Statser) {
+	da.lock.Lock()
+	dropped := da.flush
+	da.flush = map[dropKey]uint64{}
+	da.lock.Unlock()
+
+	for key, datapoints := range dropped {
+		tags := gostatsd.Tags{"reason:" + key.reason}
+		if key.backend != "" {
+			tags = append(tags, "backend:"+key.backend)
+		}
+		statser.Count("dropped.datapoints", float64(datapoints), tags)
+	}
+}
+
+func (da *DropAccounting) logSummary() {
+	da.lock.Lock()
+	dropped := da.summary
+	da.summary = map[dropKey]uint64{}
+	da.lock.Unlock()
+
+	if len(dropped) == 0 {
+		return
+	}
+	fields := logrus.Fields{}
+	for name, datapoints := range byName(dropped) {
+		fields[name] = datapoints
+	}
+	da.logger.WithFields(fields).Warn("dropped datapoints since the last summary")
+}
+
+// expvar returns the datapoints dropped since the server started, named the same as the summary.
+func (da *DropAccounting) expvar() interface{} {
+	da.lock.Lock()
+	defer da.lock.Unlock()
+	return byName(da.total)
+}
+
+// byName returns the datapoints dropped by reason, or reason.backend for those dropped by a backend, and the total.
+func byName(dropped map[dropKey]uint64) map[string]uint64 {
+	result := make(map[string]uint64, len(dropped)+1)
+	var total uint64
+	for key, datapoints := range dropped {
+		name := key.reason
+		if key.backend != "" {
+			name += "." + key.backend
+		}
+		result[name] = datapoints
+		total += datapoints
+	}
+	result["total"] = total
+	return result
+}
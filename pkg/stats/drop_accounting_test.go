@@ -0,0 +1,43 @@
+package stats
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDropAccounting(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+
+	da := NewDropAccounting(logger, 0)
+	da.Dropped(DropReasonParseError, "", 2)
+	da.Dropped(DropReasonParseError, "", 3)
+	da.Dropped(DropReasonBackend, "datadog", 10)
+	da.Dropped(DropReasonForwarderQueue, "", 0)
+
+	cs := &countingStatser{}
+	da.emit(cs)
+	assert.EqualValues(t, 2, cs.counters) // parse_error, and backend:datadog
+	da.emit(cs)
+	assert.EqualValues(t, 2, cs.counters) // Nothing since the last flush
+
+	da.logSummary()
+	assert.Equal(t, "level=warning msg=\"dropped datapoints since the last summary\" backend.datadog=10 parse_error=5 total=15\n", buf.String())
+	buf.Reset()
+	da.logSummary()
+	assert.Empty(t, buf.String())
+
+	// The totals are kept after the flush and summary
+	assert.Equal(t, map[string]uint64{"backend.datadog": 10, "parse_error": 5, "total": 15}, da.expvar())
+	assert.EqualValues(t, 15, da.Total())
+
+	var nilAccounting *DropAccounting
+	nilAccounting.Dropped(DropReasonParseError, "", 1)
+	assert.Zero(t, nilAccounting.Total())
+}
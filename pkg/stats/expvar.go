@@ -0,0 +1,18 @@
+package stats
+
+import (
+	"expvar"
+)
+
+// expvars holds the counters published by components while they run, under gostatsd in expvar.
+var expvars = expvar.NewMap("gostatsd")
+
+// PublishExpvar publishes the value returned by f as name under gostatsd in expvar, until unpublish is called.  The
+// value is read on every request, so it is current rather than as of the last flush, and f must be safe to call
+// concurrently with the component.  If several components publish the same name, the last one is shown.
+func PublishExpvar(name string, f func() interface{}) (unpublish func()) {
+	expvars.Set(name, expvar.Func(f))
+	return func() {
+		expvars.Delete(name)
+	}
+}
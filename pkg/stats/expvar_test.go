@@ -0,0 +1,22 @@
+package stats
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	t.Parallel()
+	value := 1
+	unpublish := PublishExpvar("test_publish", func() interface{} { return map[string]int{"value": value} })
+
+	published := expvar.Get("gostatsd").(*expvar.Map)
+	assert.Equal(t, `{"value":1}`, published.Get("test_publish").String())
+	value = 2 // Read on every request
+	assert.Equal(t, `{"value":2}`, published.Get("test_publish").String())
+
+	unpublish()
+	assert.Nil(t, published.Get("test_publish"))
+}
@@ -12,6 +12,7 @@ type countingStatser struct {
 	gauges   uint64
 	counters uint64
 	timers   uint64
+	events   uint64
 }
 
 func (cs *countingStatser) NotifyFlush(ctx context.Context, d time.Duration) {}
@@ -44,6 +45,10 @@ func (cs *countingStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
 	return newTimer(cs, name, tags)
 }
 
+func (cs *countingStatser) Event(ctx context.Context, e *gostatsd.Event) {
+	atomic.AddUint64(&cs.events, 1)
+}
+
 func (cs *countingStatser) WithTags(tags gostatsd.Tags) Statser {
 	return cs
 }
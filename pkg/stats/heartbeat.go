@@ -2,14 +2,18 @@ package stats
 
 import (
 	"context"
+	"runtime"
 
 	"github.com/hligit/gostatsd"
 )
 
-// HeartBeater periodically sends a gauge for heartbeat purposes
+// HeartBeater periodically sends a gauge for heartbeat purposes.  It also sends a gostatsd.heartbeat counter, so an
+// instance which has stopped reporting is visible as a gap in its rate, and a gostatsd.build_info gauge tagged with the
+// Go version, so version skew across instances is visible.
 type HeartBeater struct {
 	metricName string
 	tags       gostatsd.Tags
+	isLeader   func() bool // If not nil, the heartbeat is only sent while it returns true
 }
 
 // NewHeartBeater creates a new HeartBeater
@@ -20,6 +24,12 @@ func NewHeartBeater(metricName string, tags gostatsd.Tags) *HeartBeater {
 	}
 }
 
+// SetLeaderCheck makes the HeartBeater only send the heartbeat while isLeader returns true, so a replicated service
+// sends one heartbeat rather than one from every replica.  It must be called before the HeartBeater is run.
+func (hb *HeartBeater) SetLeaderCheck(isLeader func() bool) {
+	hb.isLeader = isLeader
+}
+
 // Run will run a HeartBeater in the background until the supplied context is closed.
 func (hb *HeartBeater) Run(ctx context.Context) {
 	statser := FromContext(ctx).WithTags(hb.tags)
@@ -31,11 +41,15 @@ func (hb *HeartBeater) Run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-flushed:
-			hb.emit(statser)
+			if hb.isLeader == nil || hb.isLeader() {
+				hb.emit(statser)
+			}
 		}
 	}
 }
 
 func (hb *HeartBeater) emit(statser Statser) {
 	statser.Gauge(hb.metricName, 1, nil)
+	statser.Increment("gostatsd.heartbeat", nil)
+	statser.Gauge("gostatsd.build_info", 1, gostatsd.Tags{"go_version:" + runtime.Version()})
 }
@@ -0,0 +1,17 @@
+package stats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartBeaterEmit(t *testing.T) {
+	t.Parallel()
+	hb := NewHeartBeater("heartbeat", nil)
+
+	cs := &countingStatser{}
+	hb.emit(cs)
+	assert.EqualValues(t, 2, cs.gauges) // heartbeat and gostatsd.build_info
+	assert.EqualValues(t, 1, cs.counters)
+}
@@ -0,0 +1,104 @@
+package stats
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// retryBudgetWindow is how many seconds of the minimum retries per second the budget can save while nothing is failing.
+const retryBudgetWindow = 10
+
+// RetryBudget limits the retries of every backend and forwarder together, to a fraction of the payloads they send plus
+// a minimum rate, so a destination which is failing can not take the concurrency and CPU needed by those which are
+// healthy.  Each payload sent adds ratio to the budget, each retry takes one from it, and it also grows by
+// minPerSecond every second, so a server which sends rarely can still retry.  A retry which the budget can not pay for
+// is not made, and the payload is treated as if its retries were exhausted.
+//
+// A nil RetryBudget allows every retry, so components can use RetryBudgetFromContext unconditionally.
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond float64
+	maxBalance   float64
+
+	lock     sync.Mutex
+	balance  float64
+	updated  time.Time // When the balance was last grown by minPerSecond
+	rejected uint64    // Retries not made since the last flush
+}
+
+// NewRetryBudget creates a RetryBudget which allows ratio retries per payload sent, plus minPerSecond retries every
+// second.
+func NewRetryBudget(ratio, minPerSecond float64) *RetryBudget {
+	maxBalance := minPerSecond * retryBudgetWindow
+	if maxBalance < retryBudgetWindow {
+		maxBalance = retryBudgetWindow
+	}
+	return &RetryBudget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		maxBalance:   maxBalance,
+		balance:      maxBalance,
+	}
+}
+
+// Sent records a payload about to be sent for the first time, which adds to the budget.
+func (rb *RetryBudget) Sent(now time.Time) {
+	if rb == nil {
+		return
+	}
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	rb.add(now, rb.ratio)
+}
+
+// Retry returns true if a retry may be made now, and takes it from the budget.
+func (rb *RetryBudget) Retry(now time.Time) bool {
+	if rb == nil {
+		return true
+	}
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	rb.add(now, 0)
+	if rb.balance < 1 {
+		rb.rejected++
+		return false
+	}
+	rb.balance--
+	return true
+}
+
+func (rb *RetryBudget) add(now time.Time, amount float64) {
+	if now.After(rb.updated) {
+		if !rb.updated.IsZero() {
+			amount += now.Sub(rb.updated).Seconds() * rb.minPerSecond
+		}
+		rb.updated = now
+	}
+	rb.balance += amount
+	if rb.balance > rb.maxBalance {
+		rb.balance = rb.maxBalance
+	}
+}
+
+// Run writes the balance of the budget, and the retries it rejected since the last flush, every flush until the
+// supplied context is closed.
+func (rb *RetryBudget) Run(ctx context.Context) {
+	statser := FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			rb.lock.Lock()
+			balance, rejected := rb.balance, rb.rejected
+			rb.rejected = 0
+			rb.lock.Unlock()
+			statser.Gauge("retry_budget.balance", balance, nil)
+			statser.Count("retry_budget.rejected", float64(rejected), nil)
+		}
+	}
+}
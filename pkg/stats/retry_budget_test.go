@@ -0,0 +1,48 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	rb := NewRetryBudget(0.5, 1)
+
+	// It starts with the minimum rate saved for 10 seconds
+	for i := 0; i < 10; i++ {
+		require.True(t, rb.Retry(now))
+	}
+	require.False(t, rb.Retry(now))
+
+	// Each payload sent allows half a retry
+	rb.Sent(now)
+	require.False(t, rb.Retry(now))
+	rb.Sent(now)
+	require.True(t, rb.Retry(now))
+	require.False(t, rb.Retry(now))
+
+	// And each second allows one
+	now = now.Add(time.Second)
+	require.True(t, rb.Retry(now))
+	require.False(t, rb.Retry(now))
+	assert.EqualValues(t, 4, rb.rejected)
+
+	// It saves at most 10 seconds of the minimum rate
+	now = now.Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		rb.Sent(now)
+	}
+	for i := 0; i < 10; i++ {
+		require.True(t, rb.Retry(now))
+	}
+	require.False(t, rb.Retry(now))
+
+	var nilBudget *RetryBudget
+	nilBudget.Sent(now)
+	require.True(t, nilBudget.Retry(now))
+}
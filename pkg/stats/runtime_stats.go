@@ -0,0 +1,78 @@
+package stats
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"time"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+// RuntimeStats periodically sends metrics about the Go runtime, such as the size of the heap, the number of goroutines,
+// garbage collection pauses, and how long goroutines wait to be scheduled.
+type RuntimeStats struct {
+	tags gostatsd.Tags
+
+	numGC        uint32
+	schedLatency *schedLatency
+}
+
+// NewRuntimeStats creates a new RuntimeStats
+func NewRuntimeStats(tags gostatsd.Tags) *RuntimeStats {
+	return &RuntimeStats{
+		tags: tags,
+	}
+}
+
+// Run will run a RuntimeStats in the background until the supplied context is closed.  Metrics are sampled and written
+// every flush.
+func (rs *RuntimeStats) Run(ctx context.Context) {
+	statser := FromContext(ctx).WithTags(rs.tags)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	rs.numGC = memStats.NumGC // Only pauses since starting are reported
+	rs.schedLatency = newSchedLatency()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			rs.emit(statser)
+		}
+	}
+}
+
+func (rs *RuntimeStats) emit(statser Statser) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	statser.Gauge("runtime.goroutines", float64(runtime.NumGoroutine()), nil)
+	statser.Gauge("runtime.heap_alloc_bytes", float64(memStats.HeapAlloc), nil)
+	statser.Gauge("runtime.heap_inuse_bytes", float64(memStats.HeapInuse), nil)
+	statser.Gauge("runtime.heap_objects", float64(memStats.HeapObjects), nil)
+	statser.Gauge("runtime.sys_bytes", float64(memStats.Sys), nil)
+	statser.Gauge("runtime.gomaxprocs", float64(runtime.GOMAXPROCS(0)), nil)
+	if limit := util.MemoryLimit(); limit != math.MaxInt64 {
+		statser.Gauge("runtime.gomemlimit_bytes", float64(limit), nil)
+	}
+
+	// PauseNs is a circular buffer of the most recent pauses, so any more than fit in it since the last flush are lost
+	gcs := memStats.NumGC - rs.numGC
+	statser.Count("runtime.gc_count", float64(gcs), nil)
+	if gcs > uint32(len(memStats.PauseNs)) {
+		gcs = uint32(len(memStats.PauseNs))
+	}
+	for i := uint32(0); i < gcs; i++ {
+		pause := memStats.PauseNs[(memStats.NumGC-i+uint32(len(memStats.PauseNs))-1)%uint32(len(memStats.PauseNs))]
+		statser.TimingDuration("runtime.gc_pause_time", time.Duration(pause), nil)
+	}
+	rs.numGC = memStats.NumGC
+
+	rs.schedLatency.emit(statser)
+}
@@ -0,0 +1,13 @@
+//go:build !go1.17
+// +build !go1.17
+
+package stats
+
+// schedLatency is a no-op, as the scheduling latency is only available from Go 1.17.
+type schedLatency struct{}
+
+func newSchedLatency() *schedLatency {
+	return &schedLatency{}
+}
+
+func (sl *schedLatency) emit(statser Statser) {}
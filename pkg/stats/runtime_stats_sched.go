@@ -0,0 +1,73 @@
+//go:build go1.17
+// +build go1.17
+
+package stats
+
+import (
+	"math"
+	"runtime/metrics"
+)
+
+const schedLatencyMetric = "/sched/latencies:seconds"
+
+// schedLatency reports how long goroutines waited to be scheduled since the last flush.
+type schedLatency struct {
+	samples []metrics.Sample
+	counts  []uint64
+}
+
+func newSchedLatency() *schedLatency {
+	sl := &schedLatency{
+		samples: []metrics.Sample{{Name: schedLatencyMetric}},
+	}
+	metrics.Read(sl.samples)
+	if sl.samples[0].Value.Kind() == metrics.KindFloat64Histogram {
+		sl.counts = append([]uint64(nil), sl.samples[0].Value.Float64Histogram().Counts...)
+	}
+	return sl
+}
+
+func (sl *schedLatency) emit(statser Statser) {
+	metrics.Read(sl.samples)
+	if sl.samples[0].Value.Kind() != metrics.KindFloat64Histogram {
+		return
+	}
+	histogram := sl.samples[0].Value.Float64Histogram()
+
+	// The histogram is cumulative, so the difference from the last flush is the latencies in this flush interval
+	var total uint64
+	delta := make([]uint64, len(histogram.Counts))
+	for i, count := range histogram.Counts {
+		if i < len(sl.counts) {
+			delta[i] = count - sl.counts[i]
+		} else {
+			delta[i] = count
+		}
+		total += delta[i]
+	}
+	sl.counts = append(sl.counts[:0], histogram.Counts...)
+	if total == 0 {
+		return
+	}
+
+	statser.Gauge("runtime.sched_latency_p50", bucketQuantile(histogram.Buckets, delta, total, 0.5), nil)
+	statser.Gauge("runtime.sched_latency_p99", bucketQuantile(histogram.Buckets, delta, total, 0.99), nil)
+	statser.Gauge("runtime.sched_latency_max", bucketQuantile(histogram.Buckets, delta, total, 1), nil)
+}
+
+// bucketQuantile returns the upper bound in milliseconds of the bucket containing the quantile q, or the lower bound if
+// the upper bound is infinite.
+func bucketQuantile(buckets []float64, counts []uint64, total uint64, q float64) float64 {
+	target := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, count := range counts {
+		seen += count
+		if count > 0 && seen >= target {
+			if math.IsInf(buckets[i+1], 1) {
+				return buckets[i] * 1000
+			}
+			return buckets[i+1] * 1000
+		}
+	}
+	return 0
+}
@@ -0,0 +1,19 @@
+//go:build go1.17
+// +build go1.17
+
+package stats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketQuantile(t *testing.T) {
+	t.Parallel()
+	buckets := []float64{0, 0.001, 0.002, 0.004}
+	counts := []uint64{98, 1, 1}
+	assert.Equal(t, 1.0, bucketQuantile(buckets, counts, 100, 0.5))
+	assert.Equal(t, 2.0, bucketQuantile(buckets, counts, 100, 0.99))
+	assert.Equal(t, 4.0, bucketQuantile(buckets, counts, 100, 1))
+}
@@ -0,0 +1,21 @@
+package stats
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeStatsEmit(t *testing.T) {
+	t.Parallel()
+	rs := NewRuntimeStats(nil)
+	rs.schedLatency = newSchedLatency()
+	runtime.GC()
+
+	cs := &countingStatser{}
+	rs.emit(cs)
+	assert.GreaterOrEqual(t, cs.gauges, uint64(6))
+	assert.EqualValues(t, 1, cs.counters)
+	assert.GreaterOrEqual(t, cs.timers, uint64(1)) // At least the pause from runtime.GC()
+}
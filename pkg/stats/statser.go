@@ -22,5 +22,7 @@ type Statser interface {
 	TimingMS(name string, ms float64, tags gostatsd.Tags)
 	TimingDuration(name string, d time.Duration, tags gostatsd.Tags)
 	NewTimer(name string, tags gostatsd.Tags) *Timer
+	// Event sends an event about gostatsd itself, such as a channel being saturated.
+	Event(ctx context.Context, e *gostatsd.Event)
 	WithTags(tags gostatsd.Tags) Statser
 }
@@ -109,6 +109,15 @@ func (is *InternalStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
 	return newTimer(is, name, tags)
 }
 
+// Event sends an event to the handler
+func (is *InternalStatser) Event(ctx context.Context, e *gostatsd.Event) {
+	if e.Source == "" {
+		e.Source = is.hostname
+	}
+	e.Tags = e.Tags.Concat(is.tags)
+	is.handler.DispatchEvent(ctx, e)
+}
+
 // WithTags creates a new Statser with additional tags
 func (is *InternalStatser) WithTags(tags gostatsd.Tags) Statser {
 	return NewTaggedStatser(is, tags)
@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"context"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -70,6 +71,16 @@ func (ls *LoggingStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
 	return newTimer(ls, name, tags)
 }
 
+// Event sends an event
+func (ls *LoggingStatser) Event(ctx context.Context, e *gostatsd.Event) {
+	ls.logger.WithFields(logrus.Fields{
+		"title":      e.Title,
+		"text":       e.Text,
+		"tags":       ls.tags.Concat(e.Tags),
+		"alert-type": e.AlertType.StringWithEmptyDefault(),
+	}).Infof("event")
+}
+
 // WithTags creates a new Statser with additional tags
 func (ls *LoggingStatser) WithTags(tags gostatsd.Tags) Statser {
 	return NewTaggedStatser(ls, tags)
@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"context"
 	"time"
 
 	"github.com/hligit/gostatsd"
@@ -37,6 +38,9 @@ func (ns *NullStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
 	return newTimer(ns, name, tags)
 }
 
+// Event does nothing
+func (ns *NullStatser) Event(ctx context.Context, e *gostatsd.Event) {}
+
 // WithTags returns a NullStatser
 func (ns *NullStatser) WithTags(tags gostatsd.Tags) Statser {
 	return ns
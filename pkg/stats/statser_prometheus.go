@@ -0,0 +1,235 @@
+package stats
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hligit/gostatsd"
+)
+
+// PrometheusStatser is a Statser which records every metric so it can be served in the Prometheus text format, and
+// passes it on to another Statser.  Gauges are exposed as gauges, counts are accumulated and exposed as counters, and
+// timings are exposed as summaries (with only _sum and _count) in milliseconds.
+type PrometheusStatser struct {
+	statser   Statser
+	namespace string
+	tags      gostatsd.Tags
+
+	lock     sync.Mutex
+	families map[string]*promFamily
+}
+
+type promFamily struct {
+	typ    string
+	series map[string]*promSeries // keyed by the formatted labels
+}
+
+type promSeries struct {
+	value float64 // the value of a gauge or counter, or the sum of a summary
+	count uint64  // the number of samples of a summary
+}
+
+// NewPrometheusStatser creates a new Statser which records metrics for Prometheus, and sends them to statser.  The
+// namespace is prepended to every metric name, and tags are added to every metric.
+func NewPrometheusStatser(statser Statser, namespace string, tags gostatsd.Tags) *PrometheusStatser {
+	return &PrometheusStatser{
+		statser:   statser,
+		namespace: namespace,
+		tags:      tags,
+		families:  map[string]*promFamily{},
+	}
+}
+
+func (ps *PrometheusStatser) NotifyFlush(ctx context.Context, d time.Duration) {
+	ps.statser.NotifyFlush(ctx, d)
+}
+
+func (ps *PrometheusStatser) RegisterFlush() (<-chan time.Duration, func()) {
+	return ps.statser.RegisterFlush()
+}
+
+// Gauge sends a gauge metric
+func (ps *PrometheusStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	ps.record(name, "gauge", tags, func(s *promSeries) {
+		s.value = value
+	})
+	ps.statser.Gauge(name, value, tags)
+}
+
+// Count sends a counter metric
+func (ps *PrometheusStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	ps.record(name, "counter", tags, func(s *promSeries) {
+		s.value += amount
+	})
+	ps.statser.Count(name, amount, tags)
+}
+
+// Increment sends a counter metric with a value of 1
+func (ps *PrometheusStatser) Increment(name string, tags gostatsd.Tags) {
+	ps.Count(name, 1, tags)
+}
+
+// TimingMS sends a timing metric from a millisecond value
+func (ps *PrometheusStatser) TimingMS(name string, ms float64, tags gostatsd.Tags) {
+	ps.record(name, "summary", tags, func(s *promSeries) {
+		s.value += ms
+		s.count++
+	})
+	ps.statser.TimingMS(name, ms, tags)
+}
+
+// TimingDuration sends a timing metric from a time.Duration
+func (ps *PrometheusStatser) TimingDuration(name string, d time.Duration, tags gostatsd.Tags) {
+	ps.TimingMS(name, float64(d)/float64(time.Millisecond), tags)
+}
+
+// NewTimer returns a new timer with time set to now
+func (ps *PrometheusStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
+	return newTimer(ps, name, tags)
+}
+
+// Event sends an event
+func (ps *PrometheusStatser) Event(ctx context.Context, e *gostatsd.Event) {
+	ps.statser.Event(ctx, e)
+}
+
+// WithTags creates a new Statser with additional tags
+func (ps *PrometheusStatser) WithTags(tags gostatsd.Tags) Statser {
+	return NewTaggedStatser(ps, tags)
+}
+
+func (ps *PrometheusStatser) record(name, typ string, tags gostatsd.Tags, update func(*promSeries)) {
+	name = promName(ps.namespace, name)
+	labels := promLabels(ps.tags.Concat(tags))
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	family := ps.families[name]
+	if family != nil && family.typ != typ {
+		// The same name was used with a different type, which Prometheus does not allow
+		name = name + "_" + typ
+		family = ps.families[name]
+	}
+	if family == nil {
+		family = &promFamily{
+			typ:    typ,
+			series: map[string]*promSeries{},
+		}
+		ps.families[name] = family
+	}
+	series := family.series[labels]
+	if series == nil {
+		series = &promSeries{}
+		family.series[labels] = series
+	}
+	update(series)
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (ps *PrometheusStatser) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	ps.write(bw)
+	_ = bw.Flush()
+}
+
+func (ps *PrometheusStatser) write(w *bufio.Writer) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	names := make([]string, 0, len(ps.families))
+	for name := range ps.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := ps.families[name]
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, family.typ)
+		labelSets := make([]string, 0, len(family.series))
+		for labels := range family.series {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			series := family.series[labels]
+			if family.typ == "summary" {
+				fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(series.value, 'g', -1, 64))
+				fmt.Fprintf(w, "%s_count%s %d\n", name, labels, series.count)
+			} else {
+				fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(series.value, 'g', -1, 64))
+			}
+		}
+	}
+}
+
+// promName returns a valid Prometheus metric name for a namespace and name.
+func promName(namespace, name string) string {
+	if namespace != "" {
+		name = namespace + "." + name
+	}
+	return promSanitize(name, true)
+}
+
+// promLabels returns tags formatted as Prometheus labels, including the braces.  Tags without a value are given the
+// value "true".  If a label is repeated, the last value is used.
+func promLabels(tags gostatsd.Tags) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value := tag, "true"
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			key, value = tag[:idx], tag[idx+1:]
+		}
+		labels[promSanitize(key, false)] = value
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for idx, key := range keys {
+		if idx > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(key)
+		sb.WriteString(`="`)
+		sb.WriteString(promEscaper.Replace(labels[key]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promSanitize replaces every character which is not valid in a Prometheus metric or label name with an underscore,
+// and prefixes names which do not start with a letter or underscore with an underscore.
+func promSanitize(s string, allowColon bool) string {
+	b := []byte(s)
+	for idx, c := range b {
+		valid := c == '_' ||
+			(c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') ||
+			(c == ':' && allowColon)
+		if !valid {
+			b[idx] = '_'
+		}
+	}
+	if len(b) == 0 || (b[0] >= '0' && b[0] <= '9') {
+		return "_" + string(b)
+	}
+	return string(b)
+}
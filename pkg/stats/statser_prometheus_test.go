@@ -0,0 +1,52 @@
+package stats
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestPrometheusStatser(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPrometheusStatser(NewNullStatser(), "statsd", gostatsd.Tags{"env:prod"})
+	ps.Gauge("cloudprovider.cache_hit", 5, nil)
+	ps.Gauge("cloudprovider.cache_hit", 7, nil)
+	ps.Count("backend.sent", 2, gostatsd.Tags{"backend:graphite"})
+	ps.WithTags(gostatsd.Tags{"backend:graphite"}).Increment("backend.sent", nil)
+	ps.Count("backend.sent", 1, gostatsd.Tags{"backend:newrelic"})
+	ps.TimingDuration("flush.time", 1500*time.Microsecond, gostatsd.Tags{"sampled", "quote:a\"b"})
+	ps.TimingMS("flush.time", 2.5, gostatsd.Tags{"sampled", "quote:a\"b"})
+	ps.Count("cloudprovider.cache_hit", 1, nil)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	ps.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, `# TYPE statsd_backend_sent counter
+statsd_backend_sent{backend="graphite",env="prod"} 3
+statsd_backend_sent{backend="newrelic",env="prod"} 1
+# TYPE statsd_cloudprovider_cache_hit gauge
+statsd_cloudprovider_cache_hit{env="prod"} 7
+# TYPE statsd_cloudprovider_cache_hit_counter counter
+statsd_cloudprovider_cache_hit_counter{env="prod"} 1
+# TYPE statsd_flush_time summary
+statsd_flush_time_sum{env="prod",quote="a\"b",sampled="true"} 4
+statsd_flush_time_count{env="prod",quote="a\"b",sampled="true"} 2
+`, w.Body.String())
+}
+
+func TestPromSanitize(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "statsd_http_incoming", promName("statsd", "http.incoming"))
+	assert.Equal(t, "_9abc", promSanitize("9abc", false))
+	assert.Equal(t, "a:b", promSanitize("a:b", true))
+	assert.Equal(t, "a_b", promSanitize("a:b", false))
+	assert.Equal(t, "server_name", promSanitize("server-name", false))
+}
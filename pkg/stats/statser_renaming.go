@@ -0,0 +1,126 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hligit/gostatsd"
+)
+
+// RenamingStatser renames or drops metrics before submitting them to another Statser, so operators can control which
+// internal metrics are sent, and what they are called.  A rule applies to the metric with the same name, and to every
+// metric in its family, which are the metrics named with it as a prefix followed by a dot, so backend applies to
+// backend.sent.  If several rules apply, the longest is used.  The name is applied before any namespace.
+type RenamingStatser struct {
+	statser Statser
+	renames map[string]string // A rule renamed to "" drops the metric
+}
+
+// NewRenamingStatser creates a new Statser which renames the metrics in renames, and drops the metrics in disabled.
+func NewRenamingStatser(statser Statser, renames map[string]string, disabled []string) Statser {
+	if len(renames) == 0 && len(disabled) == 0 {
+		return statser
+	}
+	rules := make(map[string]string, len(renames)+len(disabled))
+	for from, to := range renames {
+		rules[from] = to
+	}
+	for _, name := range disabled {
+		rules[name] = ""
+	}
+	return &RenamingStatser{
+		statser: statser,
+		renames: rules,
+	}
+}
+
+// ParseRenames parses renames in the form from=to, such as backend=http_backend, into a map for NewRenamingStatser.
+func ParseRenames(renames []string) (map[string]string, error) {
+	result := make(map[string]string, len(renames))
+	for _, rename := range renames {
+		idx := strings.IndexByte(rename, '=')
+		if idx <= 0 || idx == len(rename)-1 {
+			return nil, fmt.Errorf("invalid rename %q, must be from=to", rename)
+		}
+		result[rename[:idx]] = rename[idx+1:]
+	}
+	return result, nil
+}
+
+func (rs *RenamingStatser) NotifyFlush(ctx context.Context, d time.Duration) {
+	rs.statser.NotifyFlush(ctx, d)
+}
+
+func (rs *RenamingStatser) RegisterFlush() (<-chan time.Duration, func()) {
+	return rs.statser.RegisterFlush()
+}
+
+// Gauge sends a gauge metric
+func (rs *RenamingStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	if name, ok := rs.rename(name); ok {
+		rs.statser.Gauge(name, value, tags)
+	}
+}
+
+// Count sends a counter metric
+func (rs *RenamingStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	if name, ok := rs.rename(name); ok {
+		rs.statser.Count(name, amount, tags)
+	}
+}
+
+// Increment sends a counter metric with a value of 1
+func (rs *RenamingStatser) Increment(name string, tags gostatsd.Tags) {
+	if name, ok := rs.rename(name); ok {
+		rs.statser.Increment(name, tags)
+	}
+}
+
+// TimingMS sends a timing metric from a millisecond value
+func (rs *RenamingStatser) TimingMS(name string, ms float64, tags gostatsd.Tags) {
+	if name, ok := rs.rename(name); ok {
+		rs.statser.TimingMS(name, ms, tags)
+	}
+}
+
+// TimingDuration sends a timing metric from a time.Duration
+func (rs *RenamingStatser) TimingDuration(name string, d time.Duration, tags gostatsd.Tags) {
+	if name, ok := rs.rename(name); ok {
+		rs.statser.TimingDuration(name, d, tags)
+	}
+}
+
+// NewTimer returns a new timer with time set to now
+func (rs *RenamingStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
+	return newTimer(rs, name, tags)
+}
+
+// Event sends an event
+func (rs *RenamingStatser) Event(ctx context.Context, e *gostatsd.Event) {
+	rs.statser.Event(ctx, e)
+}
+
+// WithTags creates a new Statser with additional tags
+func (rs *RenamingStatser) WithTags(tags gostatsd.Tags) Statser {
+	return NewTaggedStatser(rs, tags)
+}
+
+// rename returns the new name of a metric, and false if it is dropped.
+func (rs *RenamingStatser) rename(name string) (string, bool) {
+	prefix := name
+	for {
+		if to, ok := rs.renames[prefix]; ok {
+			if to == "" {
+				return "", false
+			}
+			return to + name[len(prefix):], true
+		}
+		idx := strings.LastIndexByte(prefix, '.')
+		if idx < 0 {
+			return name, true
+		}
+		prefix = prefix[:idx]
+	}
+}
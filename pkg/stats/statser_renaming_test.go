@@ -0,0 +1,63 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestRenamingStatser(t *testing.T) {
+	t.Parallel()
+
+	renames, err := ParseRenames([]string{"backend=http_backend", "backend.series.sent=series_sent", "flush.time=flush_ms"})
+	require.NoError(t, err)
+	ps := NewPrometheusStatser(NewNullStatser(), "", nil)
+	rs := NewRenamingStatser(ps, renames, []string{"runtime", "backend.bytes"})
+
+	rs.Count("backend.sent", 1, nil)
+	rs.WithTags(gostatsd.Tags{"backend:datadog"}).Gauge("backend.series.sent", 5, nil)
+	rs.Count("backend.bytes", 100, nil)
+	rs.Gauge("runtime.heap", 10, nil)
+	rs.Gauge("runtime", 10, nil)
+	rs.Gauge("runtimes", 1, nil)
+	rs.TimingDuration("flush.time", time.Millisecond, nil)
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	ps.write(w)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, `# TYPE flush_ms summary
+flush_ms_sum 1
+flush_ms_count 1
+# TYPE http_backend_sent counter
+http_backend_sent 1
+# TYPE runtimes gauge
+runtimes 1
+# TYPE series_sent gauge
+series_sent{backend="datadog"} 5
+`, buf.String())
+}
+
+func TestRenamingStatserNoRules(t *testing.T) {
+	t.Parallel()
+	ns := NewNullStatser()
+	assert.Equal(t, ns, NewRenamingStatser(ns, nil, nil))
+}
+
+func TestParseRenames(t *testing.T) {
+	t.Parallel()
+	renames, err := ParseRenames([]string{"a.b=c", "d=e=f"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a.b": "c", "d": "e=f"}, renames)
+
+	for _, invalid := range []string{"a", "=a", "a="} {
+		_, err = ParseRenames([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
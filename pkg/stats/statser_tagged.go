@@ -64,6 +64,12 @@ func (ts *TaggedStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
 	return ts.statser.NewTimer(name, ts.concatTags(ts.tags, tags))
 }
 
+// Event sends an event
+func (ts *TaggedStatser) Event(ctx context.Context, e *gostatsd.Event) {
+	e.Tags = ts.concatTags(ts.tags, e.Tags)
+	ts.statser.Event(ctx, e)
+}
+
 // WithTags creates a new Statser with additional tags
 func (ts *TaggedStatser) WithTags(tags gostatsd.Tags) Statser {
 	// There's no value wrapping it up in multiple layers
@@ -3,8 +3,8 @@ package statsd
 import (
 	"context"
 	"math"
-	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hligit/gostatsd"
@@ -33,10 +33,13 @@ type MetricAggregator struct {
 	statser               stats.Statser
 	disabledSubtypes      gostatsd.TimerSubtypes
 	histogramLimit        uint32
-	metricMap             *gostatsd.MetricMap
+	shards                []*gostatsd.MetricMap // Series are split between shards by hash, so they can be flushed in parallel
+	limits                aggregatorLimits
+	lastReset             gostatsd.Nanotime
 }
 
-// NewMetricAggregator creates a new MetricAggregator object.
+// NewMetricAggregator creates a new MetricAggregator object.  If maxSeries or maxSamples are positive, the series with
+// the least traffic are evicted when there are more series, or timer and set values, than that.
 func NewMetricAggregator(
 	percentThresholds []float64,
 	expiryIntervalCounter time.Duration,
@@ -45,7 +48,13 @@ func NewMetricAggregator(
 	expiryIntervalTimer time.Duration,
 	disabled gostatsd.TimerSubtypes,
 	histogramLimit uint32,
+	shards int,
+	maxSeries int,
+	maxSamples int,
 ) *MetricAggregator {
+	if shards < 1 {
+		shards = 1
+	}
 	a := MetricAggregator{
 		expiryIntervalCounter: expiryIntervalCounter,
 		expiryIntervalGauge:   expiryIntervalGauge,
@@ -55,10 +64,23 @@ func NewMetricAggregator(
 		percentThresholds: make(map[float64]percentStruct, len(percentThresholds)),
 		now:               time.Now,
 		statser:           stats.NewNullStatser(), // Will probably be replaced via RunMetrics
-		metricMap:         gostatsd.NewMetricMap(),
+		shards:            make([]*gostatsd.MetricMap, shards),
 		disabledSubtypes:  disabled,
 		histogramLimit:    histogramLimit,
+		limits: aggregatorLimits{
+			maxSeries:  maxSeries,
+			maxSamples: maxSamples,
+		},
+	}
+	for idx := range a.shards {
+		a.shards[idx] = gostatsd.NewMetricMap()
 	}
+	a.setPercentThresholds(percentThresholds)
+	return &a
+}
+
+// setPercentThresholds adds the names of the sub-metrics of each percentile to percentThresholds, which must be empty.
+func (a *MetricAggregator) setPercentThresholds(percentThresholds []float64) {
 	for _, pct := range percentThresholds {
 		sPct := strconv.Itoa(int(pct))
 		a.percentThresholds[pct] = percentStruct{
@@ -70,7 +92,15 @@ func NewMetricAggregator(
 			lower:      "lower_" + sPct,
 		}
 	}
-	return &a
+}
+
+// Reconfigure changes the percentiles, disabled sub-metrics, and histogram limit used for timers.  It takes effect
+// from the next flush, and does not change the aggregated data.
+func (a *MetricAggregator) Reconfigure(percentThresholds []float64, disabled gostatsd.TimerSubtypes, histogramLimit uint32) {
+	a.percentThresholds = make(map[float64]percentStruct, len(percentThresholds))
+	a.setPercentThresholds(percentThresholds)
+	a.disabledSubtypes = disabled
+	a.histogramLimit = histogramLimit
 }
 
 // round rounds a number to its nearest integer value.
@@ -84,34 +114,68 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 	a.statser.Gauge("aggregator.metricmaps_received", float64(a.metricMapsReceived), nil)
 
 	flushInSeconds := float64(flushInterval) / float64(time.Second)
+	a.eachShard(func(_ int, mm *gostatsd.MetricMap) {
+		a.flushShard(mm, flushInSeconds)
+	})
+	a.flushLimits()
+}
 
-	a.metricMap.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+// eachShard calls f with the index of every shard, and the shard, in parallel if there is more than one, and waits
+// for them to finish.
+func (a *MetricAggregator) eachShard(f func(idx int, mm *gostatsd.MetricMap)) {
+	if len(a.shards) == 1 {
+		f(0, a.shards[0])
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(a.shards))
+	for idx, mm := range a.shards {
+		go func(idx int, mm *gostatsd.MetricMap) {
+			defer wg.Done()
+			f(idx, mm)
+		}(idx, mm)
+	}
+	wg.Wait()
+}
+
+func (a *MetricAggregator) flushShard(mm *gostatsd.MetricMap, flushInSeconds float64) {
+	var scratch timerScratch
+	mm.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		counter.PerSecond = float64(counter.Value) / flushInSeconds
-		a.metricMap.Counters[key][tagsKey] = counter
+		mm.Counters[key][tagsKey] = counter
 	})
 
-	a.metricMap.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	mm.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		if hasHistogramTag(timer) {
 			timer.Histogram = latencyHistogram(timer, a.histogramLimit)
-			a.metricMap.Timers[key][tagsKey] = timer
+			mm.Timers[key][tagsKey] = timer
 			return
 		}
 
-		if count := len(timer.Values); count > 0 {
-			sort.Float64s(timer.Values)
-			timer.Min = timer.Values[0]
-			timer.Max = timer.Values[count-1]
-			n := len(timer.Values)
+		if n := len(timer.Values); n > 0 {
 			count := float64(n)
 
-			cumulativeValues := make([]float64, n)
-			cumulSumSquaresValues := make([]float64, n)
-			cumulativeValues[0] = timer.Min
-			cumulSumSquaresValues[0] = timer.Min * timer.Min
-			for i := 1; i < n; i++ {
-				cumulativeValues[i] = timer.Values[i] + cumulativeValues[i-1]
-				cumulSumSquaresValues[i] = timer.Values[i]*timer.Values[i] + cumulSumSquaresValues[i-1]
+			// Only the values at the percentile boundaries and the median need to be in sorted position, which is
+			// much cheaper than sorting every value of a large timer.
+			scratch.reset()
+			if n > 1 {
+				for pct := range a.percentThresholds {
+					if numInThreshold := int(round(math.Abs(pct) / 100 * count)); numInThreshold > 0 {
+						if pct > 0 {
+							scratch.need(numInThreshold-1, numInThreshold)
+						} else {
+							scratch.need(n-numInThreshold, n-numInThreshold)
+						}
+					}
+				}
+			}
+			mid := n / 2
+			scratch.need(mid, n)
+			if n%2 == 0 {
+				scratch.need(mid-1, n)
 			}
+			timer.Min, timer.Max = scratch.calculate(timer.Values)
+			total, totalSquares := scratch.prefix(n)
 
 			var sumSquares = timer.Min * timer.Min
 			var mean = timer.Min
@@ -127,12 +191,11 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 					}
 					if pct > 0 {
 						thresholdBoundary = timer.Values[numInThreshold-1]
-						sum = cumulativeValues[numInThreshold-1]
-						sumSquares = cumulSumSquaresValues[numInThreshold-1]
+						sum, sumSquares = scratch.prefix(numInThreshold)
 					} else {
 						thresholdBoundary = timer.Values[n-numInThreshold]
-						sum = cumulativeValues[n-1] - cumulativeValues[n-numInThreshold-1]
-						sumSquares = cumulSumSquaresValues[n-1] - cumulSumSquaresValues[n-numInThreshold-1]
+						sum, sumSquares = scratch.prefix(n - numInThreshold)
+						sum, sumSquares = total-sum, totalSquares-sumSquares
 					}
 					mean = sum / float64(numInThreshold)
 				}
@@ -160,8 +223,8 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 				}
 			}
 
-			sum = cumulativeValues[n-1]
-			sumSquares = cumulSumSquaresValues[n-1]
+			sum = total
+			sumSquares = totalSquares
 			mean = sum / count
 
 			var sumOfDiffs float64
@@ -169,8 +232,7 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 				sumOfDiffs += (timer.Values[i] - mean) * (timer.Values[i] - mean)
 			}
 
-			mid := int(math.Floor(count / 2))
-			if math.Mod(count, 2) == 0 {
+			if n%2 == 0 {
 				timer.Median = (timer.Values[mid-1] + timer.Values[mid]) / 2
 			} else {
 				timer.Median = timer.Values[mid]
@@ -188,7 +250,7 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 			timer.SampledCount = 0
 			timer.PerSecond = 0
 		}
-		a.metricMap.Timers[key][tagsKey] = timer
+		mm.Timers[key][tagsKey] = timer
 	})
 }
 
@@ -196,8 +258,14 @@ func (a *MetricAggregator) RunMetrics(ctx context.Context, statser stats.Statser
 	a.statser = statser
 }
 
+// Process calls f with the contents of the MetricAggregator.  When it has more than one shard, f is called with the
+// shards merged in to a new MetricMap, so changes made by f are not kept.
 func (a *MetricAggregator) Process(f ProcessFunc) {
-	f(a.metricMap)
+	if len(a.shards) == 1 {
+		f(a.shards[0])
+		return
+	}
+	f(gostatsd.MergeMaps(a.shards))
 }
 
 func isExpired(interval time.Duration, now, ts gostatsd.Nanotime) bool {
@@ -211,63 +279,98 @@ func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
 	}
 }
 
-// Reset clears the contents of a MetricAggregator.
-func (a *MetricAggregator) Reset() {
+// Snapshot returns the flushed MetricAggregator, with its shards merged, and resets it with new shards, so the
+// snapshot is not modified as the next interval is aggregated, and can be sent while it is.
+func (a *MetricAggregator) Snapshot() *gostatsd.MetricMap {
+	var snapshot *gostatsd.MetricMap
+	if len(a.shards) == 1 {
+		snapshot = a.shards[0]
+	} else {
+		snapshot = gostatsd.MergeMaps(a.shards)
+	}
+	a.reset()
+	return snapshot
+}
+
+// reset replaces every shard with a new one, which has the series which have not expired.
+func (a *MetricAggregator) reset() {
 	a.metricMapsReceived = 0
 	nowNano := gostatsd.Nanotime(a.now().UnixNano())
+	a.eachShard(func(idx int, mm *gostatsd.MetricMap) {
+		into := gostatsd.NewMetricMap()
+		a.resetShard(mm, into, nowNano)
+		a.shards[idx] = into
+	})
+	a.lastReset = nowNano
+	a.resetLimits()
+}
 
-	a.metricMap.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+// resetShard resets the series of mm which have not expired in to into, so mm is not modified.
+func (a *MetricAggregator) resetShard(mm, into *gostatsd.MetricMap, nowNano gostatsd.Nanotime) {
+	mm.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		if isExpired(a.expiryIntervalCounter, nowNano, counter.Timestamp) {
-			deleteMetric(key, tagsKey, a.metricMap.Counters)
-		} else {
-			a.metricMap.Counters[key][tagsKey] = gostatsd.Counter{
-				Timestamp: counter.Timestamp,
-				Source:    counter.Source,
-				Tags:      counter.Tags,
-			}
+			return
+		}
+		counters, ok := into.Counters[key]
+		if !ok {
+			counters = map[string]gostatsd.Counter{}
+			into.Counters[key] = counters
+		}
+		counters[tagsKey] = gostatsd.Counter{
+			Timestamp: counter.Timestamp,
+			Source:    counter.Source,
+			Tags:      counter.Tags,
 		}
 	})
 
-	a.metricMap.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	mm.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		if isExpired(a.expiryIntervalTimer, nowNano, timer.Timestamp) {
-			deleteMetric(key, tagsKey, a.metricMap.Timers)
-		} else {
-			if hasHistogramTag(timer) {
-				a.metricMap.Timers[key][tagsKey] = gostatsd.Timer{
-					Timestamp: timer.Timestamp,
-					Source:    timer.Source,
-					Tags:      timer.Tags,
-					Values:    timer.Values[:0],
-					Histogram: emptyHistogram(timer, a.histogramLimit),
-				}
-			} else {
-				a.metricMap.Timers[key][tagsKey] = gostatsd.Timer{
-					Timestamp: timer.Timestamp,
-					Source:    timer.Source,
-					Tags:      timer.Tags,
-					Values:    timer.Values[:0],
-				}
-			}
+			return
 		}
+		timers, ok := into.Timers[key]
+		if !ok {
+			timers = map[string]gostatsd.Timer{}
+			into.Timers[key] = timers
+		}
+		reset := gostatsd.Timer{
+			Values:    []float64{},
+			Timestamp: timer.Timestamp,
+			Source:    timer.Source,
+			Tags:      timer.Tags,
+		}
+		if hasHistogramTag(timer) {
+			reset.Histogram = emptyHistogram(timer, a.histogramLimit)
+		}
+		timers[tagsKey] = reset
 	})
 
-	a.metricMap.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+	mm.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
 		if isExpired(a.expiryIntervalGauge, nowNano, gauge.Timestamp) {
-			deleteMetric(key, tagsKey, a.metricMap.Gauges)
+			return
 		}
 		// No reset for gauges, they keep the last value until expiration
+		gauges, ok := into.Gauges[key]
+		if !ok {
+			gauges = map[string]gostatsd.Gauge{}
+			into.Gauges[key] = gauges
+		}
+		gauges[tagsKey] = gauge
 	})
 
-	a.metricMap.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+	mm.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
 		if isExpired(a.expiryIntervalSet, nowNano, set.Timestamp) {
-			deleteMetric(key, tagsKey, a.metricMap.Sets)
-		} else {
-			a.metricMap.Sets[key][tagsKey] = gostatsd.Set{
-				Values:    make(map[string]struct{}),
-				Timestamp: set.Timestamp,
-				Source:    set.Source,
-				Tags:      set.Tags,
-			}
+			return
+		}
+		sets, ok := into.Sets[key]
+		if !ok {
+			sets = map[string]gostatsd.Set{}
+			into.Sets[key] = sets
+		}
+		sets[tagsKey] = gostatsd.Set{
+			Values:    make(map[string]struct{}),
+			Timestamp: set.Timestamp,
+			Source:    set.Source,
+			Tags:      set.Tags,
 		}
 	})
 }
@@ -275,5 +378,5 @@ func (a *MetricAggregator) Reset() {
 // ReceiveMap takes a single metric map and will aggregate the values
 func (a *MetricAggregator) ReceiveMap(mm *gostatsd.MetricMap) {
 	a.metricMapsReceived++
-	a.metricMap.Merge(mm)
+	a.receive(mm)
 }
@@ -0,0 +1,186 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+)
+
+// evictionLowWaterMark is the fraction of each limit an aggregator evicts series down to when it exceeds it, so it
+// does not need to evict again until it has grown by a tenth of the limit.
+const evictionLowWaterMark = 0.9
+
+// aggregatorLimits bounds the memory held by an aggregator, so a hot shard cannot grow without bound and take the
+// process down.
+type aggregatorLimits struct {
+	maxSeries  int // The limit on the number of series, or 0 for no limit
+	maxSamples int // The limit on the number of timer and set values, or 0 for no limit
+
+	series  int // The number of series
+	samples int // The number of timer and set values
+
+	seriesHighWater  int // The most series seen since the last flush
+	samplesHighWater int // The most timer and set values seen since the last flush
+	evicted          int // The number of series evicted since the last flush
+}
+
+// evictionCandidate is a series which may be evicted.
+type evictionCandidate struct {
+	metrics   gostatsd.AggregatedMetrics
+	key       string
+	tagsKey   string
+	traffic   int // The number of samples received since the last flush
+	samples   int // The number of timer and set values held
+	timestamp gostatsd.Nanotime
+}
+
+// limited returns true if the aggregator has a limit on its series or samples.
+func (l *aggregatorLimits) limited() bool {
+	return l.maxSeries > 0 || l.maxSamples > 0
+}
+
+// exceeded returns true if series or samples exceed their limit.
+func (l *aggregatorLimits) exceeded(series, samples int) bool {
+	return (l.maxSeries > 0 && series > l.maxSeries) || (l.maxSamples > 0 && samples > l.maxSamples)
+}
+
+// receive merges mm into the aggregator, and evicts series if it has exceeded a limit.
+func (a *MetricAggregator) receive(mm *gostatsd.MetricMap) {
+	series, samples := mm.MergeSharded(a.shards)
+	l := &a.limits
+	l.series += series
+	l.samples += samples
+	if l.series > l.seriesHighWater {
+		l.seriesHighWater = l.series
+	}
+	if l.samples > l.samplesHighWater {
+		l.samplesHighWater = l.samples
+	}
+	if l.exceeded(l.series, l.samples) {
+		a.evict()
+	}
+}
+
+// evict removes the series with the least traffic since the last flush, until the aggregator is below the low water
+// mark of each limit.  Series which have not received anything since the last flush are evicted first, then counters
+// and gauges, and then timers and sets with the fewest values.  Ties are broken by evicting the least recently updated.
+func (a *MetricAggregator) evict() {
+	var candidates []evictionCandidate
+	for _, mm := range a.shards {
+		mm.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+			candidates = append(candidates, evictionCandidate{
+				metrics:   mm.Counters,
+				key:       key,
+				tagsKey:   tagsKey,
+				traffic:   a.updatedSinceReset(counter.Timestamp),
+				timestamp: counter.Timestamp,
+			})
+		})
+		mm.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+			candidates = append(candidates, evictionCandidate{
+				metrics:   mm.Gauges,
+				key:       key,
+				tagsKey:   tagsKey,
+				traffic:   a.updatedSinceReset(gauge.Timestamp),
+				timestamp: gauge.Timestamp,
+			})
+		})
+		mm.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+			candidates = append(candidates, evictionCandidate{
+				metrics:   mm.Timers,
+				key:       key,
+				tagsKey:   tagsKey,
+				traffic:   len(timer.Values),
+				samples:   len(timer.Values),
+				timestamp: timer.Timestamp,
+			})
+		})
+		mm.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+			candidates = append(candidates, evictionCandidate{
+				metrics:   mm.Sets,
+				key:       key,
+				tagsKey:   tagsKey,
+				traffic:   len(set.Values),
+				samples:   len(set.Values),
+				timestamp: set.Timestamp,
+			})
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].traffic != candidates[j].traffic {
+			return candidates[i].traffic < candidates[j].traffic
+		}
+		return candidates[i].timestamp < candidates[j].timestamp
+	})
+
+	targetSeries := int(float64(a.limits.maxSeries) * evictionLowWaterMark)
+	targetSamples := int(float64(a.limits.maxSamples) * evictionLowWaterMark)
+	series, samples := a.limits.series, a.limits.samples
+	evicted := 0
+	for _, c := range candidates {
+		if (a.limits.maxSeries == 0 || series <= targetSeries) && (a.limits.maxSamples == 0 || samples <= targetSamples) {
+			break
+		}
+		deleteMetric(c.key, c.tagsKey, c.metrics)
+		series--
+		samples -= c.samples
+		evicted++
+	}
+	a.limits.series, a.limits.samples = series, samples
+	a.limits.evicted += evicted
+}
+
+// updatedSinceReset returns 1 if a counter or gauge has been updated since the aggregator was last reset, otherwise 0.
+func (a *MetricAggregator) updatedSinceReset(timestamp gostatsd.Nanotime) int {
+	if timestamp > a.lastReset {
+		return 1
+	}
+	return 0
+}
+
+// flushLimits sends the high water marks of the series and samples since the last flush, and the number of series
+// evicted, with an event if any were.
+func (a *MetricAggregator) flushLimits() {
+	a.statser.Gauge("aggregator.series_high_water", float64(a.limits.seriesHighWater), nil)
+	a.statser.Gauge("aggregator.samples_high_water", float64(a.limits.samplesHighWater), nil)
+	if !a.limits.limited() {
+		return
+	}
+	a.statser.Count("aggregator.series_evicted", float64(a.limits.evicted), nil)
+	if a.limits.evicted == 0 {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"evicted":     a.limits.evicted,
+		"max_series":  a.limits.maxSeries,
+		"max_samples": a.limits.maxSamples,
+	}).Warn("Aggregator evicted series")
+	e := &gostatsd.Event{
+		Title: "Gostatsd aggregator evicted series",
+		Text: fmt.Sprintf(
+			"Evicted %d series with the least traffic, as the aggregator exceeded its limit of %d series or %d samples",
+			a.limits.evicted, a.limits.maxSeries, a.limits.maxSamples,
+		),
+		DateHappened: a.now().Unix(),
+		Priority:     gostatsd.PriNormal,
+		AlertType:    gostatsd.AlertWarning,
+	}
+	// Sent in the background, as dispatching it may block on the queues of the aggregators.
+	go a.statser.Event(context.Background(), e)
+}
+
+// resetLimits starts counting the series and samples for the next flush.  Every sample has been reset, but series are
+// kept until they expire.
+func (a *MetricAggregator) resetLimits() {
+	series := 0
+	for _, mm := range a.shards {
+		series += mm.Len()
+	}
+	a.limits.series, a.limits.samples = series, 0
+	a.limits.seriesHighWater, a.limits.samplesHighWater = series, 0
+	a.limits.evicted = 0
+}
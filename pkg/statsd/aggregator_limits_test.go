@@ -0,0 +1,122 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+func newLimitedAggregator(maxSeries, maxSamples int) *MetricAggregator {
+	return NewMetricAggregator([]float64{90}, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32, 2, maxSeries, maxSamples)
+}
+
+// hasSeries returns true if the aggregator has a series of the metric.
+func hasSeries(ma *MetricAggregator, name string) bool {
+	found := false
+	ma.Process(func(mm *gostatsd.MetricMap) {
+		_, counter := mm.Counters[name]
+		_, gauge := mm.Gauges[name]
+		_, timer := mm.Timers[name]
+		_, set := mm.Sets[name]
+		found = counter || gauge || timer || set
+	})
+	return found
+}
+
+func TestAggregatorEvictsSeriesWithLeastTraffic(t *testing.T) {
+	t.Parallel()
+	ma := newLimitedAggregator(10, 0)
+
+	// A counter which is kept by the reset, but receives nothing after it
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "stale", Value: 1, Rate: 1, Timestamp: 1, Type: gostatsd.COUNTER})
+	ma.ReceiveMap(mm)
+	ma.now = func() time.Time { return time.Unix(0, 100) }
+	ma.Snapshot()
+
+	mm = gostatsd.NewMetricMap()
+	for i := 0; i < 5; i++ {
+		timestamp := gostatsd.Nanotime(200 + i)
+		mm.Receive(&gostatsd.Metric{Name: fmt.Sprintf("c%d", i), Value: 1, Rate: 1, Timestamp: timestamp, Type: gostatsd.COUNTER})
+		mm.Receive(&gostatsd.Metric{Name: fmt.Sprintf("t%d", i), Value: 1, Rate: 1, Timestamp: timestamp, Type: gostatsd.TIMER})
+		mm.Receive(&gostatsd.Metric{Name: fmt.Sprintf("t%d", i), Value: 2, Rate: 1, Timestamp: timestamp, Type: gostatsd.TIMER})
+	}
+	ma.ReceiveMap(mm)
+
+	// The stale counter, and then the counter updated least recently, are evicted to get down to 9 series
+	assert.False(t, hasSeries(ma, "stale"))
+	assert.False(t, hasSeries(ma, "c0"))
+	for i := 1; i < 5; i++ {
+		assert.True(t, hasSeries(ma, fmt.Sprintf("c%d", i)))
+	}
+	for i := 0; i < 5; i++ {
+		assert.True(t, hasSeries(ma, fmt.Sprintf("t%d", i)))
+	}
+	assert.Equal(t, 9, ma.limits.series)
+	assert.Equal(t, 10, ma.limits.samples)
+	assert.Equal(t, 11, ma.limits.seriesHighWater)
+	assert.Equal(t, 10, ma.limits.samplesHighWater)
+	assert.Equal(t, 2, ma.limits.evicted)
+}
+
+func TestAggregatorEvictsSeriesOverSampleLimit(t *testing.T) {
+	t.Parallel()
+	ma := newLimitedAggregator(0, 10)
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 8; i++ {
+		mm.Receive(&gostatsd.Metric{Name: "hot", Value: float64(i), Rate: 1, Type: gostatsd.TIMER})
+	}
+	mm.Receive(&gostatsd.Metric{Name: "cold", Value: 1, Rate: 1, Type: gostatsd.TIMER})
+	for i := 0; i < 3; i++ {
+		mm.Receive(&gostatsd.Metric{Name: "users", StringValue: fmt.Sprintf("user%d", i), Rate: 1, Type: gostatsd.SET})
+	}
+	ma.ReceiveMap(mm)
+
+	assert.True(t, hasSeries(ma, "hot"))
+	assert.False(t, hasSeries(ma, "cold"))
+	assert.False(t, hasSeries(ma, "users"))
+	assert.Equal(t, 8, ma.limits.samples)
+	assert.Equal(t, 12, ma.limits.samplesHighWater)
+
+	// The samples are released by the reset
+	ma.Snapshot()
+	assert.Equal(t, 1, ma.limits.series)
+	assert.Equal(t, 0, ma.limits.samples)
+	assert.Equal(t, 0, ma.limits.evicted)
+}
+
+func TestAggregatorFlushSendsLimits(t *testing.T) {
+	t.Parallel()
+	ma := newLimitedAggregator(1, 0)
+	handler := &expectingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", handler)
+	ma.RunMetrics(context.Background(), statser)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.GAUGE})
+	mm.Receive(&gostatsd.Metric{Name: "b", Value: 1, Rate: 1, Type: gostatsd.GAUGE})
+	ma.ReceiveMap(mm)
+
+	handler.Expect(1, 1)
+	ma.Flush(time.Second)
+	statser.NotifyFlush(context.Background(), time.Second)
+	handler.WaitAll()
+
+	sent := handler.MetricMaps()[0]
+	assert.EqualValues(t, 2, sent.Gauges["aggregator.series_high_water"][""].Value)
+	assert.EqualValues(t, 0, sent.Gauges["aggregator.samples_high_water"][""].Value)
+	assert.EqualValues(t, 2, sent.Counters["aggregator.series_evicted"][""].Value)
+	events := handler.Events()
+	require.Len(t, events, 1)
+	assert.Equal(t, "Gostatsd aggregator evicted series", events[0].Title)
+	assert.Equal(t, gostatsd.AlertWarning, events[0].AlertType)
+}
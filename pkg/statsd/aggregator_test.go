@@ -1,11 +1,13 @@
 package statsd
 
 import (
+	"fmt"
 	"math"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/hligit/gostatsd"
 )
@@ -19,6 +21,9 @@ func newFakeAggregator() *MetricAggregator {
 		5*time.Minute,
 		gostatsd.TimerSubtypes{},
 		math.MaxUint32,
+		1,
+		0,
+		0,
 	)
 }
 
@@ -28,20 +33,20 @@ func TestNewAggregator(t *testing.T) {
 
 	actual := newFakeAggregator()
 
-	if assrt.NotNil(actual.metricMap.Counters) {
-		assrt.Equal(gostatsd.Counters{}, actual.metricMap.Counters)
+	if assrt.NotNil(actual.shards[0].Counters) {
+		assrt.Equal(gostatsd.Counters{}, actual.shards[0].Counters)
 	}
 
-	if assrt.NotNil(actual.metricMap.Timers) {
-		assrt.Equal(gostatsd.Timers{}, actual.metricMap.Timers)
+	if assrt.NotNil(actual.shards[0].Timers) {
+		assrt.Equal(gostatsd.Timers{}, actual.shards[0].Timers)
 	}
 
-	if assrt.NotNil(actual.metricMap.Gauges) {
-		assrt.Equal(gostatsd.Gauges{}, actual.metricMap.Gauges)
+	if assrt.NotNil(actual.shards[0].Gauges) {
+		assrt.Equal(gostatsd.Gauges{}, actual.shards[0].Gauges)
 	}
 
-	if assrt.NotNil(actual.metricMap.Sets) {
-		assrt.Equal(gostatsd.Sets{}, actual.metricMap.Sets)
+	if assrt.NotNil(actual.shards[0].Sets) {
+		assrt.Equal(gostatsd.Sets{}, actual.shards[0].Sets)
 	}
 }
 
@@ -49,14 +54,14 @@ func TestLatencyHistograms(t *testing.T) {
 	t.Parallel()
 	assrt := assert.New(t)
 	ma := newFakeAggregator()
-	ma.metricMap.Timers["testTimer"] = make(map[string]gostatsd.Timer)
+	ma.shards[0].Timers["testTimer"] = make(map[string]gostatsd.Timer)
 	values := gostatsd.NewTimerValues([]float64{10.0, 20.0, 29.9, 2000.0, -38.0, -5.0})
 	values.Tags = gostatsd.Tags{histogramThresholdsTagPrefix + "-10_0_2.5_20_50_5000"}
-	ma.metricMap.Timers["testTimer"]["simple"] = values
+	ma.shards[0].Timers["testTimer"]["simple"] = values
 
 	ma.Flush(10)
 
-	result := ma.metricMap.Timers["testTimer"]["simple"]
+	result := ma.shards[0].Timers["testTimer"]["simple"]
 	assrt.Len(result.Histogram, 7)
 	assrt.Equal(1, result.Histogram[gostatsd.HistogramThreshold(-10)])
 	assrt.Equal(2, result.Histogram[gostatsd.HistogramThreshold(0)])
@@ -70,14 +75,14 @@ func TestLatencyHistogramWithNoValuesOutputHistogramWithZeros(t *testing.T) {
 	t.Parallel()
 	assrt := assert.New(t)
 	ma := newFakeAggregator()
-	ma.metricMap.Timers["testTimer"] = make(map[string]gostatsd.Timer)
+	ma.shards[0].Timers["testTimer"] = make(map[string]gostatsd.Timer)
 	values := gostatsd.NewTimerValues([]float64{})
 	values.Tags = gostatsd.Tags{histogramThresholdsTagPrefix + "10_20_50_5000"}
-	ma.metricMap.Timers["testTimer"]["simple"] = values
+	ma.shards[0].Timers["testTimer"]["simple"] = values
 
 	ma.Flush(10)
 
-	result := ma.metricMap.Timers["testTimer"]["simple"]
+	result := ma.shards[0].Timers["testTimer"]["simple"]
 	assrt.Len(result.Histogram, 5)
 	assrt.Equal(0, result.Histogram[gostatsd.HistogramThreshold(10)])
 	assrt.Equal(0, result.Histogram[gostatsd.HistogramThreshold(20)])
@@ -90,14 +95,14 @@ func TestLatencyHistogramDisablesAggregations(t *testing.T) {
 	t.Parallel()
 	assrt := assert.New(t)
 	ma := newFakeAggregator()
-	ma.metricMap.Timers["testTimer"] = make(map[string]gostatsd.Timer)
+	ma.shards[0].Timers["testTimer"] = make(map[string]gostatsd.Timer)
 	values := gostatsd.NewTimerValues([]float64{10.0, 20.0, 29.9, 2000.0})
 	values.Tags = gostatsd.Tags{histogramThresholdsTagPrefix + "20_50_5000"}
-	ma.metricMap.Timers["testTimer"]["simple"] = values
+	ma.shards[0].Timers["testTimer"]["simple"] = values
 
 	ma.Flush(10)
 
-	result := ma.metricMap.Timers["testTimer"]["simple"]
+	result := ma.shards[0].Timers["testTimer"]["simple"]
 
 	assrt.Equal(0, result.Count)
 	assrt.Equal(0.0, result.PerSecond)
@@ -121,20 +126,20 @@ func TestFlush(t *testing.T) {
 	expected := newFakeAggregator()
 	expected.now = nowFn
 
-	ma.metricMap.Counters["some"] = make(map[string]gostatsd.Counter)
-	ma.metricMap.Counters["some"][""] = gostatsd.Counter{Value: 50}
-	ma.metricMap.Counters["some"]["thing"] = gostatsd.Counter{Value: 100}
-	ma.metricMap.Counters["some"]["other:thing"] = gostatsd.Counter{Value: 150}
+	ma.shards[0].Counters["some"] = make(map[string]gostatsd.Counter)
+	ma.shards[0].Counters["some"][""] = gostatsd.Counter{Value: 50}
+	ma.shards[0].Counters["some"]["thing"] = gostatsd.Counter{Value: 100}
+	ma.shards[0].Counters["some"]["other:thing"] = gostatsd.Counter{Value: 150}
 
-	expected.metricMap.Counters["some"] = make(map[string]gostatsd.Counter)
-	expected.metricMap.Counters["some"][""] = gostatsd.Counter{Value: 50, PerSecond: 5}
-	expected.metricMap.Counters["some"]["thing"] = gostatsd.Counter{Value: 100, PerSecond: 10}
-	expected.metricMap.Counters["some"]["other:thing"] = gostatsd.Counter{Value: 150, PerSecond: 15}
+	expected.shards[0].Counters["some"] = make(map[string]gostatsd.Counter)
+	expected.shards[0].Counters["some"][""] = gostatsd.Counter{Value: 50, PerSecond: 5}
+	expected.shards[0].Counters["some"]["thing"] = gostatsd.Counter{Value: 100, PerSecond: 10}
+	expected.shards[0].Counters["some"]["other:thing"] = gostatsd.Counter{Value: 150, PerSecond: 15}
 
-	ma.metricMap.Timers["some"] = make(map[string]gostatsd.Timer)
-	ma.metricMap.Timers["some"]["thing"] = gostatsd.NewTimerValues([]float64{2, 4, 12})
-	ma.metricMap.Timers["some"]["sampled"] = gostatsd.Timer{Values: []float64{2, 4, 12}, SampledCount: 30.0}
-	ma.metricMap.Timers["some"]["empty"] = gostatsd.Timer{Values: []float64{}}
+	ma.shards[0].Timers["some"] = make(map[string]gostatsd.Timer)
+	ma.shards[0].Timers["some"]["thing"] = gostatsd.NewTimerValues([]float64{2, 4, 12})
+	ma.shards[0].Timers["some"]["sampled"] = gostatsd.Timer{Values: []float64{2, 4, 12}, SampledCount: 30.0}
+	ma.shards[0].Timers["some"]["empty"] = gostatsd.Timer{Values: []float64{}}
 
 	expPct := gostatsd.Percentiles{}
 	expPct.Set("count_90", float64(3))
@@ -142,66 +147,66 @@ func TestFlush(t *testing.T) {
 	expPct.Set("sum_90", float64(18))
 	expPct.Set("sum_squares_90", float64(164))
 	expPct.Set("upper_90", float64(12))
-	expected.metricMap.Timers["some"] = make(map[string]gostatsd.Timer)
-	expected.metricMap.Timers["some"]["thing"] = gostatsd.Timer{
+	expected.shards[0].Timers["some"] = make(map[string]gostatsd.Timer)
+	expected.shards[0].Timers["some"]["thing"] = gostatsd.Timer{
 		Values: []float64{2, 4, 12}, Count: 3, Min: 2, Max: 12, Mean: 6, Median: 4, Sum: 18,
 		PerSecond: 0.3, SumSquares: 164, StdDev: 4.320493798938574, Percentiles: expPct,
 		SampledCount: 3.0,
 	}
-	expected.metricMap.Timers["some"]["sampled"] = gostatsd.Timer{
+	expected.shards[0].Timers["some"]["sampled"] = gostatsd.Timer{
 		Values: []float64{2, 4, 12}, Count: 30, Min: 2, Max: 12, Mean: 6, Median: 4, Sum: 18,
 		PerSecond: 3.0, SumSquares: 164, StdDev: 4.320493798938574, Percentiles: expPct,
 		SampledCount: 30.0,
 	}
-	expected.metricMap.Timers["some"]["empty"] = gostatsd.Timer{Values: []float64{}}
+	expected.shards[0].Timers["some"]["empty"] = gostatsd.Timer{Values: []float64{}}
 
-	ma.metricMap.Gauges["some"] = make(map[string]gostatsd.Gauge)
-	ma.metricMap.Gauges["some"][""] = gostatsd.Gauge{Value: 50}
-	ma.metricMap.Gauges["some"]["thing"] = gostatsd.Gauge{Value: 100}
-	ma.metricMap.Gauges["some"]["other:thing"] = gostatsd.Gauge{Value: 150}
+	ma.shards[0].Gauges["some"] = make(map[string]gostatsd.Gauge)
+	ma.shards[0].Gauges["some"][""] = gostatsd.Gauge{Value: 50}
+	ma.shards[0].Gauges["some"]["thing"] = gostatsd.Gauge{Value: 100}
+	ma.shards[0].Gauges["some"]["other:thing"] = gostatsd.Gauge{Value: 150}
 
-	expected.metricMap.Gauges["some"] = make(map[string]gostatsd.Gauge)
-	expected.metricMap.Gauges["some"][""] = gostatsd.Gauge{Value: 50}
-	expected.metricMap.Gauges["some"]["thing"] = gostatsd.Gauge{Value: 100}
-	expected.metricMap.Gauges["some"]["other:thing"] = gostatsd.Gauge{Value: 150}
+	expected.shards[0].Gauges["some"] = make(map[string]gostatsd.Gauge)
+	expected.shards[0].Gauges["some"][""] = gostatsd.Gauge{Value: 50}
+	expected.shards[0].Gauges["some"]["thing"] = gostatsd.Gauge{Value: 100}
+	expected.shards[0].Gauges["some"]["other:thing"] = gostatsd.Gauge{Value: 150}
 
-	ma.metricMap.Sets["some"] = make(map[string]gostatsd.Set)
+	ma.shards[0].Sets["some"] = make(map[string]gostatsd.Set)
 	unique := map[string]struct{}{
 		"user": {},
 	}
-	ma.metricMap.Sets["some"]["thing"] = gostatsd.Set{Values: unique}
+	ma.shards[0].Sets["some"]["thing"] = gostatsd.Set{Values: unique}
 
-	expected.metricMap.Sets["some"] = make(map[string]gostatsd.Set)
-	expected.metricMap.Sets["some"]["thing"] = gostatsd.Set{Values: unique}
+	expected.shards[0].Sets["some"] = make(map[string]gostatsd.Set)
+	expected.shards[0].Sets["some"]["thing"] = gostatsd.Set{Values: unique}
 
 	ma.Flush(10 * time.Second)
-	assrt.Equal(expected.metricMap.Counters, ma.metricMap.Counters)
-	assrt.Equal(expected.metricMap.Timers, ma.metricMap.Timers)
-	assrt.Equal(expected.metricMap.Gauges, ma.metricMap.Gauges)
-	assrt.Equal(expected.metricMap.Sets, ma.metricMap.Sets)
+	assrt.Equal(expected.shards[0].Counters, ma.shards[0].Counters)
+	assrt.Equal(expected.shards[0].Timers, ma.shards[0].Timers)
+	assrt.Equal(expected.shards[0].Gauges, ma.shards[0].Gauges)
+	assrt.Equal(expected.shards[0].Sets, ma.shards[0].Sets)
 }
 
 func BenchmarkFlush(b *testing.B) {
 	ma := newFakeAggregator()
-	ma.metricMap.Counters["some"] = make(map[string]gostatsd.Counter)
-	ma.metricMap.Counters["some"][""] = gostatsd.Counter{Value: 50}
-	ma.metricMap.Counters["some"]["thing"] = gostatsd.Counter{Value: 100}
-	ma.metricMap.Counters["some"]["other:thing"] = gostatsd.Counter{Value: 150}
+	ma.shards[0].Counters["some"] = make(map[string]gostatsd.Counter)
+	ma.shards[0].Counters["some"][""] = gostatsd.Counter{Value: 50}
+	ma.shards[0].Counters["some"]["thing"] = gostatsd.Counter{Value: 100}
+	ma.shards[0].Counters["some"]["other:thing"] = gostatsd.Counter{Value: 150}
 
-	ma.metricMap.Timers["some"] = make(map[string]gostatsd.Timer)
-	ma.metricMap.Timers["some"]["thing"] = gostatsd.NewTimerValues([]float64{2, 4, 12})
-	ma.metricMap.Timers["some"]["empty"] = gostatsd.Timer{Values: []float64{}}
+	ma.shards[0].Timers["some"] = make(map[string]gostatsd.Timer)
+	ma.shards[0].Timers["some"]["thing"] = gostatsd.NewTimerValues([]float64{2, 4, 12})
+	ma.shards[0].Timers["some"]["empty"] = gostatsd.Timer{Values: []float64{}}
 
-	ma.metricMap.Gauges["some"] = make(map[string]gostatsd.Gauge)
-	ma.metricMap.Gauges["some"][""] = gostatsd.Gauge{Value: 50}
-	ma.metricMap.Gauges["some"]["thing"] = gostatsd.Gauge{Value: 100}
-	ma.metricMap.Gauges["some"]["other:thing"] = gostatsd.Gauge{Value: 150}
+	ma.shards[0].Gauges["some"] = make(map[string]gostatsd.Gauge)
+	ma.shards[0].Gauges["some"][""] = gostatsd.Gauge{Value: 50}
+	ma.shards[0].Gauges["some"]["thing"] = gostatsd.Gauge{Value: 100}
+	ma.shards[0].Gauges["some"]["other:thing"] = gostatsd.Gauge{Value: 150}
 
-	ma.metricMap.Sets["some"] = make(map[string]gostatsd.Set)
+	ma.shards[0].Sets["some"] = make(map[string]gostatsd.Set)
 	unique := map[string]struct{}{
 		"user": {},
 	}
-	ma.metricMap.Sets["some"]["thing"] = gostatsd.Set{Values: unique}
+	ma.shards[0].Sets["some"]["thing"] = gostatsd.Set{Values: unique}
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -211,6 +216,32 @@ func BenchmarkFlush(b *testing.B) {
 	}
 }
 
+func benchmarkFlushSharded(b *testing.B, shards int) {
+	ma := NewMetricAggregator([]float64{90}, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32, shards, 0, 0)
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 10000; i++ {
+		tags := gostatsd.Tags{fmt.Sprintf("id:%d", i)}
+		for j := 0; j < 20; j++ {
+			mm.Receive(&gostatsd.Metric{Name: "timer", Value: float64(j), Rate: 1, Tags: tags, Type: gostatsd.TIMER})
+		}
+	}
+	ma.ReceiveMap(mm)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ma.Flush(1 * time.Second)
+	}
+}
+
+func BenchmarkFlushOneShard(b *testing.B) {
+	benchmarkFlushSharded(b, 1)
+}
+
+func BenchmarkFlushFourShards(b *testing.B) {
+	benchmarkFlushSharded(b, 4)
+}
+
 func TestReset(t *testing.T) {
 	t.Parallel()
 	assrt := assert.New(t)
@@ -221,39 +252,39 @@ func TestReset(t *testing.T) {
 
 	// non expired
 	actual := newFakeAggregator()
-	actual.metricMap.Counters["some"] = map[string]gostatsd.Counter{
+	actual.shards[0].Counters["some"] = map[string]gostatsd.Counter{
 		"thing":       gostatsd.NewCounter(nowNano, 50, host, nil),
 		"other:thing": gostatsd.NewCounter(nowNano, 90, host, nil),
 	}
 	actual.now = nowFn
-	actual.Reset()
+	actual.Snapshot()
 
 	expected := newFakeAggregator()
-	expected.metricMap.Counters["some"] = map[string]gostatsd.Counter{
+	expected.shards[0].Counters["some"] = map[string]gostatsd.Counter{
 		"thing":       gostatsd.NewCounter(nowNano, 0, host, nil),
 		"other:thing": gostatsd.NewCounter(nowNano, 0, host, nil),
 	}
 	expected.now = nowFn
 
-	assrt.Equal(expected.metricMap.Counters, actual.metricMap.Counters)
+	assrt.Equal(expected.shards[0].Counters, actual.shards[0].Counters)
 
 	actual = newFakeAggregator()
-	actual.metricMap.Timers["some"] = map[string]gostatsd.Timer{
+	actual.shards[0].Timers["some"] = map[string]gostatsd.Timer{
 		"thing": gostatsd.NewTimer(nowNano, []float64{50}, host, nil),
 	}
 	actual.now = nowFn
-	actual.Reset()
+	actual.Snapshot()
 
 	expected = newFakeAggregator()
-	expected.metricMap.Timers["some"] = map[string]gostatsd.Timer{
+	expected.shards[0].Timers["some"] = map[string]gostatsd.Timer{
 		"thing": gostatsd.NewTimer(nowNano, []float64{}, host, nil),
 	}
 	expected.now = nowFn
 
-	assrt.Equal(expected.metricMap.Timers, actual.metricMap.Timers)
+	assrt.Equal(expected.shards[0].Timers, actual.shards[0].Timers)
 
 	actual = newFakeAggregator()
-	actual.metricMap.Timers["histogram"] = map[string]gostatsd.Timer{
+	actual.shards[0].Timers["histogram"] = map[string]gostatsd.Timer{
 		histogramThresholdsTagPrefix + "10_20_30": gostatsd.NewTimer(nowNano, []float64{}, host, gostatsd.Tags{histogramThresholdsTagPrefix + "10_20_30"}),
 	}
 
@@ -265,45 +296,45 @@ func TestReset(t *testing.T) {
 		gostatsd.HistogramThreshold(30):          0,
 		gostatsd.HistogramThreshold(math.Inf(1)): 0,
 	}
-	expected.metricMap.Timers["histogram"] = map[string]gostatsd.Timer{
+	expected.shards[0].Timers["histogram"] = map[string]gostatsd.Timer{
 		histogramThresholdsTagPrefix + "10_20_30": expectedTimer,
 	}
 	expected.now = nowFn
 
-	actual.Reset()
-	assrt.Equal(expected.metricMap.Timers, actual.metricMap.Timers)
+	actual.Snapshot()
+	assrt.Equal(expected.shards[0].Timers, actual.shards[0].Timers)
 
 	actual = newFakeAggregator()
-	actual.metricMap.Gauges["some"] = map[string]gostatsd.Gauge{
+	actual.shards[0].Gauges["some"] = map[string]gostatsd.Gauge{
 		"thing":       gostatsd.NewGauge(nowNano, 50, host, nil),
 		"other:thing": gostatsd.NewGauge(nowNano, 90, host, nil),
 	}
 	actual.now = nowFn
-	actual.Reset()
+	actual.Snapshot()
 
 	expected = newFakeAggregator()
-	expected.metricMap.Gauges["some"] = map[string]gostatsd.Gauge{
+	expected.shards[0].Gauges["some"] = map[string]gostatsd.Gauge{
 		"thing":       gostatsd.NewGauge(nowNano, 50, host, nil),
 		"other:thing": gostatsd.NewGauge(nowNano, 90, host, nil),
 	}
 	expected.now = nowFn
 
-	assrt.Equal(expected.metricMap.Gauges, actual.metricMap.Gauges)
+	assrt.Equal(expected.shards[0].Gauges, actual.shards[0].Gauges)
 
 	actual = newFakeAggregator()
-	actual.metricMap.Sets["some"] = map[string]gostatsd.Set{
+	actual.shards[0].Sets["some"] = map[string]gostatsd.Set{
 		"thing": gostatsd.NewSet(nowNano, map[string]struct{}{"user": {}}, host, nil),
 	}
 	actual.now = nowFn
-	actual.Reset()
+	actual.Snapshot()
 
 	expected = newFakeAggregator()
-	expected.metricMap.Sets["some"] = map[string]gostatsd.Set{
+	expected.shards[0].Sets["some"] = map[string]gostatsd.Set{
 		"thing": gostatsd.NewSet(nowNano, make(map[string]struct{}), host, nil),
 	}
 	expected.now = nowFn
 
-	assrt.Equal(expected.metricMap.Sets, actual.metricMap.Sets)
+	assrt.Equal(expected.shards[0].Sets, actual.shards[0].Sets)
 
 	// expired
 	pastNano := gostatsd.Nanotime(now.Add(-30 * time.Second).UnixNano())
@@ -313,66 +344,104 @@ func TestReset(t *testing.T) {
 	actual.expiryIntervalGauge = 5 * time.Minute
 	actual.expiryIntervalSet = 5 * time.Minute
 	actual.expiryIntervalTimer = 5 * time.Minute
-	actual.metricMap.Counters["some"] = map[string]gostatsd.Counter{
+	actual.shards[0].Counters["some"] = map[string]gostatsd.Counter{
 		"thing":       gostatsd.NewCounter(pastNano, 50, host, nil),
 		"other:thing": gostatsd.NewCounter(pastNano, 90, host, nil),
 	}
 	actual.now = nowFn
-	actual.Reset()
+	actual.Snapshot()
 
 	expected = newFakeAggregator()
 	expected.now = nowFn
 
-	assrt.Equal(expected.metricMap.Counters, actual.metricMap.Counters)
+	assrt.Equal(expected.shards[0].Counters, actual.shards[0].Counters)
 
 	actual = newFakeAggregator()
 	actual.expiryIntervalCounter = 5 * time.Minute
 	actual.expiryIntervalGauge = 5 * time.Minute
 	actual.expiryIntervalSet = 5 * time.Minute
 	actual.expiryIntervalTimer = 10 * time.Second
-	actual.metricMap.Timers["some"] = map[string]gostatsd.Timer{
+	actual.shards[0].Timers["some"] = map[string]gostatsd.Timer{
 		"thing": gostatsd.NewTimer(pastNano, []float64{50}, host, nil),
 	}
 	actual.now = nowFn
-	actual.Reset()
+	actual.Snapshot()
 
 	expected = newFakeAggregator()
 	expected.now = nowFn
 
-	assrt.Equal(expected.metricMap.Timers, actual.metricMap.Timers)
+	assrt.Equal(expected.shards[0].Timers, actual.shards[0].Timers)
 
 	actual = newFakeAggregator()
 	actual.expiryIntervalCounter = 5 * time.Minute
 	actual.expiryIntervalGauge = 10 * time.Second
 	actual.expiryIntervalSet = 5 * time.Minute
 	actual.expiryIntervalTimer = 5 * time.Minute
-	actual.metricMap.Gauges["some"] = map[string]gostatsd.Gauge{
+	actual.shards[0].Gauges["some"] = map[string]gostatsd.Gauge{
 		"thing":       gostatsd.NewGauge(pastNano, 50, host, nil),
 		"other:thing": gostatsd.NewGauge(pastNano, 90, host, nil),
 	}
 	actual.now = nowFn
-	actual.Reset()
+	actual.Snapshot()
 
 	expected = newFakeAggregator()
 	expected.now = nowFn
 
-	assrt.Equal(expected.metricMap.Gauges, actual.metricMap.Gauges)
+	assrt.Equal(expected.shards[0].Gauges, actual.shards[0].Gauges)
 
 	actual = newFakeAggregator()
 	actual.expiryIntervalCounter = 5 * time.Minute
 	actual.expiryIntervalGauge = 5 * time.Minute
 	actual.expiryIntervalSet = 10 * time.Second
 	actual.expiryIntervalTimer = 5 * time.Minute
-	actual.metricMap.Sets["some"] = map[string]gostatsd.Set{
+	actual.shards[0].Sets["some"] = map[string]gostatsd.Set{
 		"thing": gostatsd.NewSet(pastNano, map[string]struct{}{"user": {}}, host, nil),
 	}
 	actual.now = nowFn
-	actual.Reset()
+	actual.Snapshot()
 
 	expected = newFakeAggregator()
 	expected.now = nowFn
 
-	assrt.Equal(expected.metricMap.Sets, actual.metricMap.Sets)
+	assrt.Equal(expected.shards[0].Sets, actual.shards[0].Sets)
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	nowNano := gostatsd.Nanotime(now.UnixNano())
+	pastNano := gostatsd.Nanotime(now.Add(-10 * time.Minute).UnixNano())
+
+	ma := newFakeAggregator()
+	ma.now = func() time.Time { return now }
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 5, Rate: 1, Timestamp: nowNano, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "g", Value: 3, Rate: 1, Timestamp: nowNano, Type: gostatsd.GAUGE})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Timestamp: nowNano, Type: gostatsd.TIMER})
+	mm.Receive(&gostatsd.Metric{Name: "s", StringValue: "user", Rate: 1, Timestamp: nowNano, Type: gostatsd.SET})
+	mm.Receive(&gostatsd.Metric{Name: "expired", Value: 1, Rate: 1, Timestamp: pastNano, Type: gostatsd.COUNTER})
+	ma.ReceiveMap(mm)
+	ma.Flush(time.Second)
+
+	snapshot := ma.Snapshot()
+	require.True(t, snapshot != ma.shards[0])
+
+	// The aggregator is reset, and keeps the series which have not expired
+	assert.Equal(t, 4, ma.shards[0].Len())
+	assert.Zero(t, ma.shards[0].Counters["c"][""].Value)
+	assert.EqualValues(t, 3, ma.shards[0].Gauges["g"][""].Value)
+	assert.Empty(t, ma.shards[0].Timers["t"][""].Values)
+	assert.Empty(t, ma.shards[0].Sets["s"][""].Values)
+
+	// The snapshot is not modified as the next interval is aggregated
+	mm = gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 7, Rate: 1, Timestamp: nowNano, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 2, Rate: 1, Timestamp: nowNano, Type: gostatsd.TIMER})
+	ma.ReceiveMap(mm)
+	assert.Equal(t, 5, snapshot.Len())
+	assert.EqualValues(t, 5, snapshot.Counters["c"][""].Value)
+	assert.Equal(t, []float64{1}, snapshot.Timers["t"][""].Values)
+	assert.Len(t, snapshot.Sets["s"][""].Values, 1)
 }
 
 func TestIsExpired(t *testing.T) {
@@ -403,7 +472,7 @@ func TestDisabledCount(t *testing.T) {
 	mm.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER})
 	ma.ReceiveMap(mm)
 	ma.Flush(1 * time.Second)
-	for _, pct := range ma.metricMap.Timers["x"][""].Percentiles {
+	for _, pct := range ma.shards[0].Timers["x"][""].Percentiles {
 		if pct.Str == "count_90" {
 			t.Error("count not disabled")
 		}
@@ -418,7 +487,7 @@ func TestDisabledMean(t *testing.T) {
 	mm.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER})
 	ma.ReceiveMap(mm)
 	ma.Flush(1 * time.Second)
-	for _, pct := range ma.metricMap.Timers["x"][""].Percentiles {
+	for _, pct := range ma.shards[0].Timers["x"][""].Percentiles {
 		if pct.Str == "mean_90" {
 			t.Error("mean not disabled")
 		}
@@ -433,7 +502,7 @@ func TestDisabledSum(t *testing.T) {
 	mm.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER})
 	ma.ReceiveMap(mm)
 	ma.Flush(1 * time.Second)
-	for _, pct := range ma.metricMap.Timers["x"][""].Percentiles {
+	for _, pct := range ma.shards[0].Timers["x"][""].Percentiles {
 		if pct.Str == "sum_90" {
 			t.Error("sum not disabled")
 		}
@@ -448,7 +517,7 @@ func TestDisabledSumSquares(t *testing.T) {
 	mm.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER})
 	ma.ReceiveMap(mm)
 	ma.Flush(1 * time.Second)
-	for _, pct := range ma.metricMap.Timers["x"][""].Percentiles {
+	for _, pct := range ma.shards[0].Timers["x"][""].Percentiles {
 		if pct.Str == "sum_squares_90" {
 			t.Error("sum_squares not disabled")
 		}
@@ -463,7 +532,7 @@ func TestDisabledUpper(t *testing.T) {
 	mm.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER})
 	ma.ReceiveMap(mm)
 	ma.Flush(1 * time.Second)
-	for _, pct := range ma.metricMap.Timers["x"][""].Percentiles {
+	for _, pct := range ma.shards[0].Timers["x"][""].Percentiles {
 		if pct.Str == "upper_90" {
 			t.Error("upper not disabled")
 		}
@@ -480,15 +549,55 @@ func TestDisabledLower(t *testing.T) {
 		5*time.Minute,
 		gostatsd.TimerSubtypes{},
 		math.MaxUint32,
+		1,
+		0,
+		0,
 	)
 	ma.disabledSubtypes.LowerPct = true
 	mm := gostatsd.NewMetricMap()
 	mm.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER})
 	ma.ReceiveMap(mm)
 	ma.Flush(1 * time.Second)
-	for _, pct := range ma.metricMap.Timers["x"][""].Percentiles {
+	for _, pct := range ma.shards[0].Timers["x"][""].Percentiles {
 		if pct.Str == "lower_-90" { // lower_-90?
 			t.Error("lower not disabled")
 		}
 	}
 }
+
+func TestShardedAggregator(t *testing.T) {
+	t.Parallel()
+	newAggregator := func(shards int) *MetricAggregator {
+		ma := NewMetricAggregator([]float64{90}, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32, shards, 0, 0)
+		for i := 0; i < 100; i++ {
+			mm := gostatsd.NewMetricMap()
+			tags := gostatsd.Tags{fmt.Sprintf("id:%d", i%10)}
+			mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.COUNTER})
+			mm.Receive(&gostatsd.Metric{Name: "t", Value: float64(i), Rate: 1, Tags: tags, Type: gostatsd.TIMER})
+			ma.ReceiveMap(mm)
+		}
+		ma.Flush(time.Second)
+		return ma
+	}
+	merged := func(ma *MetricAggregator) *gostatsd.MetricMap {
+		calls := 0
+		mm := gostatsd.NewMetricMap()
+		ma.Process(func(aggregated *gostatsd.MetricMap) {
+			calls++
+			mm.Merge(aggregated)
+		})
+		assert.Equal(t, 1, calls)
+		return mm
+	}
+
+	single := newAggregator(1)
+	sharded := newAggregator(4)
+	for _, shard := range sharded.shards {
+		assert.False(t, shard.IsEmpty())
+	}
+	assert.Equal(t, merged(single), merged(sharded))
+
+	sharded.Snapshot()
+	single.Snapshot()
+	assert.Equal(t, merged(single), merged(sharded))
+}
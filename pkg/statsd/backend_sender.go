@@ -0,0 +1,169 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// flushPayload is the metrics snapshotted from every aggregator in a flush.  They are not modified after the
+// snapshot, so every backend can send them concurrently, and at its own pace.
+type flushPayload struct {
+	ctx       context.Context // The context of the flush, so the requests made by the backends are traced as part of it
+	metrics   []*gostatsd.MetricMap
+	series    int            // The number of series in metrics
+	immediate bool           // Not delayed by the splay, as something is waiting for it, such as a drain
+	sent      sync.WaitGroup // Done by every backend when it has sent or dropped the payload
+}
+
+// backendSender sends flushes to a backend from its own goroutine, through a bounded queue, so a slow backend delays
+// neither the aggregators nor the other backends.  When the queue is full, the oldest queued flush is dropped.
+type backendSender struct {
+	backend          gostatsd.Backend
+	queue            chan *flushPayload
+	handleSendResult func(errs []error)
+	splay            time.Duration // The maximum random delay before sending each payload
+	stop             chan struct{} // Closed to stop the sender once it has sent the payloads already queued
+	done             chan struct{} // Closed when Run returns
+}
+
+func newBackendSender(backend gostatsd.Backend, queueSize int, handleSendResult func(errs []error)) *backendSender {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &backendSender{
+		backend:          backend,
+		queue:            make(chan *flushPayload, queueSize),
+		handleSendResult: handleSendResult,
+		stop:             make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+}
+
+// enqueue queues the payload to be sent, dropping the oldest queued payload if the queue is full.  It must only be
+// called from one goroutine.
+func (bs *backendSender) enqueue(ctx context.Context, payload *flushPayload) {
+	for {
+		select {
+		case bs.queue <- payload:
+			return
+		default:
+		}
+		select {
+		case dropped := <-bs.queue:
+			logrus.WithFields(logrus.Fields{
+				"backend": bs.backend.Name(),
+				"series":  dropped.series,
+			}).Warn("Backend is still sending earlier flushes, dropping the oldest")
+			stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonFlushQueue, bs.backend.Name(), uint64(dropped.series))
+			dropped.sent.Done()
+		default:
+			// The payload was taken by Run in the meantime
+		}
+	}
+}
+
+// Run sends the queued payloads one at a time until the context is closed, or until the sender is closed and the
+// queue is empty.
+func (bs *backendSender) Run(ctx context.Context) {
+	defer close(bs.done)
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + bs.backend.Name()})
+	sendNext := func(payload *flushPayload) {
+		if bs.splay > 0 && !payload.immediate && !bs.wait(ctx, randomDuration(bs.splay)) {
+			payload.sent.Done()
+			return
+		}
+		timer := statser.NewTimer("flusher.send_time", nil)
+		bs.send(payload)
+		timer.Send()
+		payload.sent.Done()
+	}
+	for {
+		// A closed context takes priority over the queue, which select would choose between at random
+		if ctx.Err() != nil {
+			bs.drain()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			bs.drain()
+			return
+		case <-bs.stop:
+			// Nothing more is queued once the sender is closed
+			for ctx.Err() == nil {
+				select {
+				case payload := <-bs.queue:
+					sendNext(payload)
+				default:
+					return
+				}
+			}
+			bs.drain()
+			return
+		case payload := <-bs.queue:
+			sendNext(payload)
+		}
+	}
+}
+
+// close stops the sender once the payloads already queued have been sent.  Nothing may be queued after it is
+// called, and it must only be called once.
+func (bs *backendSender) close() {
+	close(bs.stop)
+}
+
+// wait waits for d, so backends spread their sends over the splay, and returns false if the context is closed first.
+func (bs *backendSender) wait(ctx context.Context, d time.Duration) bool {
+	timer := clock.NewTimer(ctx, d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// send sends every MetricMap of the payload to the backend, and waits for it to finish.
+func (bs *backendSender) send(payload *flushPayload) {
+	var wg sync.WaitGroup
+	wg.Add(len(payload.metrics))
+	for _, mm := range payload.metrics {
+		bs.backend.SendMetricsAsync(payload.ctx, mm, func(errs []error) {
+			defer wg.Done()
+			bs.handleSendResult(errs)
+		})
+	}
+	wg.Wait()
+}
+
+// drain marks the payloads still queued when the sender stops as done, so nothing waits for them forever.
+func (bs *backendSender) drain() {
+	for {
+		select {
+		case payload := <-bs.queue:
+			payload.sent.Done()
+		default:
+			return
+		}
+	}
+}
+
+// wait waits for every backend to send or drop the payload, or for the context to be closed.
+func (p *flushPayload) wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		p.sent.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+	case <-done:
+	}
+}
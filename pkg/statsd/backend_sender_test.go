@@ -0,0 +1,172 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// blockingBackend records the metrics it is sent, and blocks sending them until it is released.
+type blockingBackend struct {
+	lock    sync.Mutex
+	sent    []*gostatsd.MetricMap
+	release chan struct{}
+}
+
+func (bb *blockingBackend) Name() string {
+	return "blockingBackend"
+}
+
+func (bb *blockingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	go func() {
+		<-bb.release
+		bb.lock.Lock()
+		bb.sent = append(bb.sent, m)
+		bb.lock.Unlock()
+		callback(nil)
+	}()
+}
+
+func (bb *blockingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (bb *blockingBackend) sentMaps() []*gostatsd.MetricMap {
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+	return append([]*gostatsd.MetricMap(nil), bb.sent...)
+}
+
+func newPayload(series int) *flushPayload {
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < series; i++ {
+		mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Tags: gostatsd.Tags{string(rune('a' + i))}, Type: gostatsd.COUNTER})
+	}
+	p := &flushPayload{ctx: context.Background(), metrics: []*gostatsd.MetricMap{mm}, series: series}
+	p.sent.Add(1)
+	return p
+}
+
+func TestBackendSenderDropsOldest(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := &blockingBackend{release: make(chan struct{})}
+	bs := newBackendSender(backend, 1, func(errs []error) {})
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+
+	first, second, third := newPayload(1), newPayload(2), newPayload(3)
+	bs.enqueue(ctx, first)
+	wg.StartWithContext(ctx, bs.Run)
+	require.Eventually(t, func() bool { return len(bs.queue) == 0 }, time.Second, time.Millisecond)
+
+	// first is being sent, so second is queued, and then dropped for third
+	bs.enqueue(ctx, second)
+	bs.enqueue(ctx, third)
+	second.wait(ctx)
+	assert.Empty(t, backend.sentMaps())
+
+	close(backend.release)
+	first.wait(ctx)
+	third.wait(ctx)
+	assert.Equal(t, []*gostatsd.MetricMap{first.metrics[0], third.metrics[0]}, backend.sentMaps())
+}
+
+func TestBackendSenderDrainsOnStop(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	bs := newBackendSender(&blockingBackend{}, 2, func(errs []error) {})
+	payload := newPayload(1)
+	bs.enqueue(ctx, payload)
+	bs.Run(ctx)
+	payload.sent.Wait()
+}
+
+func TestBackendSenderSendsQueuedOnClose(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := &blockingBackend{release: make(chan struct{})}
+	close(backend.release)
+	bs := newBackendSender(backend, 2, func(errs []error) {})
+	first, second := newPayload(1), newPayload(2)
+	bs.enqueue(ctx, first)
+	bs.enqueue(ctx, second)
+	bs.close()
+	bs.Run(ctx)
+	<-bs.done
+	assert.Equal(t, []*gostatsd.MetricMap{first.metrics[0], second.metrics[0]}, backend.sentMaps())
+}
+
+func TestBackendSenderSplay(t *testing.T) {
+	t.Parallel()
+	clck := clock.NewMock(time.Unix(1000, 0))
+	ctx, cancel := context.WithCancel(clock.Context(context.Background(), clck))
+	defer cancel()
+
+	backend := &blockingBackend{release: make(chan struct{})}
+	close(backend.release)
+	bs := newBackendSender(backend, 2, func(errs []error) {})
+	bs.splay = 10 * time.Second
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, bs.Run)
+
+	// A periodic flush is delayed by up to the splay
+	payload := newPayload(1)
+	bs.enqueue(ctx, payload)
+	require.Eventually(t, func() bool { return len(bs.queue) == 0 }, time.Second, time.Millisecond)
+	assert.Empty(t, backend.sentMaps())
+	require.Eventually(t, func() bool {
+		clck.Add(time.Second)
+		return len(backend.sentMaps()) == 1
+	}, time.Second, time.Millisecond)
+	payload.wait(ctx)
+
+	// And an immediate flush is not
+	payload = newPayload(1)
+	payload.immediate = true
+	bs.enqueue(ctx, payload)
+	payload.wait(ctx)
+	assert.Len(t, backend.sentMaps(), 2)
+}
+
+func TestFlusherDoesNotWaitForBackends(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := &blockingBackend{release: make(chan struct{})}
+	h := NewBackendHandler(nil, 0, 1, 0, 0, 0, newTestFactory())
+	fl := NewMetricFlusher(time.Hour, 0, false, 1, h, []gostatsd.Backend{backend})
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, h.Run)
+	wg.StartWithContext(ctx, fl.Run)
+
+	// The backend is blocked, but flushes are still made
+	for i := 0; i < 3; i++ {
+		fl.flushData(ctx, time.Second, stats.NewNullStatser(), false)
+	}
+	assert.Empty(t, backend.sentMaps())
+	close(backend.release)
+	require.NoError(t, fl.FlushNow(ctx, false))
+	assert.NotEmpty(t, backend.sentMaps())
+}
@@ -5,12 +5,15 @@ import (
 	"runtime"
 
 	"golang.org/x/net/ipv6"
+
+	"github.com/hligit/gostatsd"
 )
 
 type Message struct {
 	Buffers [][]byte
 	Addr    net.Addr
 	N       int
+	Origin  gostatsd.Source // The container of the sender, from its credentials, or UnknownSource
 }
 
 type BatchReader interface {
@@ -36,6 +39,12 @@ func NewBatchReader(conn net.PacketConn) BatchReader {
 		return &V6BatchReader{
 			conn: ipv6.NewPacketConn(c),
 		}
+	case *net.UnixConn:
+		return &UnixBatchReader{
+			conn:    c,
+			oob:     make([]byte, credentialsOOBSize),
+			origins: newOriginResolver("/proc"),
+		}
 	default:
 		return &GenericBatchReader{
 			conn: conn,
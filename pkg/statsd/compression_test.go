@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd/pb"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+func TestNewCompressors(t *testing.T) {
+	t.Parallel()
+	for compression, expected := range map[string][]string{
+		"none":     {"identity"},
+		"identity": {"identity"},
+		"deflate":  {"deflate", "identity"},
+		"gzip":     {"gzip", "deflate", "identity"},
+		"zstd":     {"zstd", "deflate", "identity"},
+	} {
+		compressors, err := newCompressors(compression, 0)
+		require.NoError(t, err)
+		var encodings []string
+		for _, c := range compressors {
+			encodings = append(encodings, c.Encoding())
+		}
+		assert.Equal(t, expected, encodings, compression)
+	}
+
+	_, err := newCompressors("brotli", 0)
+	assert.Error(t, err)
+	_, err = newCompressors("gzip", 10)
+	assert.Error(t, err)
+}
+
+func TestHttpForwarderV2NegotiatesCompression(t *testing.T) {
+	t.Parallel()
+
+	var lock sync.Mutex
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		encoding := req.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+		if encoding != "deflate" {
+			w.Header().Set("Accept-Encoding", "deflate, identity")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{server.URL}, 1, 1, "zstd", 0, time.Second, time.Second, nil, nil, GrpcOptions{}, SpoolOptions{}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	post, err := hfh.constructPost(context.Background(), logger, hfh.targets[0], "/v2/raw", nil, pb.ProtocolVersion2, "")
+	require.NoError(t, err)
+	require.Error(t, post())
+	require.NoError(t, post()) // retried with the fallback
+
+	post, err = hfh.constructPost(context.Background(), logger, hfh.targets[0], "/v2/raw", nil, pb.ProtocolVersion2, "")
+	require.NoError(t, err)
+	require.NoError(t, post())
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"zstd", "deflate", "deflate"}, encodings)
+	assert.NotZero(t, hfh.bytesCompressed)
+}
+
+func TestHttpForwarderV2UnsupportedProtocolVersion(t *testing.T) {
+	t.Parallel()
+
+	var lock sync.Mutex
+	var versions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		versions = append(versions, req.Header.Get(pb.ProtocolVersionHeader))
+		w.Header().Set(pb.ProtocolVersionsHeader, "99")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{server.URL}, 1, 1, "zstd", 0, time.Second, time.Second, nil, nil, GrpcOptions{}, SpoolOptions{}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	post, err := hfh.constructPost(context.Background(), logger, hfh.targets[0], "/v2/raw", nil, pb.ProtocolVersion2, "")
+	require.NoError(t, err)
+	require.Error(t, post())
+	require.Error(t, post())
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"2", "2"}, versions)
+	// The rejection was for the version, so the compression is kept
+	assert.Zero(t, hfh.targets[0].compressorIndex)
+	assert.EqualValues(t, pb.ProtocolVersion2, hfh.targets[0].protocolVersion)
+}
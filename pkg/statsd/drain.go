@@ -0,0 +1,144 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// drainPollInterval is how often a drain checks if the forwarder has finished sending.
+const drainPollInterval = 10 * time.Millisecond
+
+// drainer stops the server receiving, and sends everything it has received to the backends or upstreams, so it can
+// exit without losing data.
+type drainer struct {
+	logger   logrus.FieldLogger
+	receiver *DatagramReceiver
+	pending  *sync.WaitGroup // Batches received which are not parsed yet
+	flusher  *MetricFlusher
+	handler  gostatsd.PipelineHandler // The final sink
+	drops    *stats.DropAccounting
+	timeout  time.Duration   // The time a drain triggered by a signal is given
+	stopping func()          // Called when a drain starts
+	cluster  *ClusterHandler // Forwards series to the other members of a cluster, if not nil
+
+	started uint32     // atomic - 1 once a drain has started
+	done    chan error // Receives the result of the drain, which the server exits with
+}
+
+func newDrainer(logger logrus.FieldLogger, receiver *DatagramReceiver, pending *sync.WaitGroup, flusher *MetricFlusher, handler gostatsd.PipelineHandler, drops *stats.DropAccounting, timeout time.Duration, stopping func()) *drainer {
+	return &drainer{
+		logger:   logger,
+		receiver: receiver,
+		pending:  pending,
+		flusher:  flusher,
+		handler:  handler,
+		drops:    drops,
+		timeout:  timeout,
+		stopping: stopping,
+		done:     make(chan error, 1),
+	}
+}
+
+// Drain stops receiving datagrams, flushes every aggregator, and waits for the backends and forwarder to send or spool
+// everything, until the context is done.  It returns the datapoints dropped while draining, and an error if it did not
+// finish.  The server exits once it returns, with an error if anything was dropped.
+func (d *drainer) Drain(ctx context.Context) (uint64, error) {
+	if !atomic.CompareAndSwapUint32(&d.started, 0, 1) {
+		return 0, errors.New("already draining")
+	}
+	d.logger.Info("Draining")
+	d.stopping()
+	before := d.drops.Total()
+	err := d.drain(ctx)
+	dropped := d.drops.Total() - before
+
+	result := err
+	if err == nil && dropped > 0 {
+		result = fmt.Errorf("%d datapoints were dropped while draining", dropped)
+	}
+	if result != nil {
+		d.logger.WithError(result).Error("Drained, exiting")
+		result = fmt.Errorf("drain failed: %v", result)
+	} else {
+		d.logger.Info("Drained, exiting")
+	}
+	d.done <- result
+	return dropped, err
+}
+
+func (d *drainer) drain(ctx context.Context) error {
+	if err := d.receiver.Stop(ctx); err != nil {
+		return fmt.Errorf("failed to stop receiving: %v", err)
+	}
+	if err := waitContext(ctx, d.pending.Wait); err != nil {
+		return fmt.Errorf("failed to parse the datagrams received: %v", err)
+	}
+	if forwarder, ok := d.handler.(*HttpForwarderHandlerV2); ok {
+		if err := forwarder.Drain(ctx); err != nil {
+			return fmt.Errorf("failed to forward: %v", err)
+		}
+		return nil
+	}
+	if d.cluster != nil {
+		if err := d.cluster.drainPeers(ctx); err != nil {
+			return err
+		}
+	}
+	if err := d.flusher.FlushNow(ctx, true); err != nil {
+		return fmt.Errorf("failed to flush: %v", err)
+	}
+	if err := waitContext(ctx, d.handler.WaitForEvents); err != nil {
+		return fmt.Errorf("failed to send events: %v", err)
+	}
+	return nil
+}
+
+// drainOnSignal returns a Runnable which drains the server when a signal is received.
+func (d *drainer) drainOnSignal(signals <-chan os.Signal) gostatsd.Runnable {
+	return func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			d.logger.WithField("signal", sig).Info("Draining on signal")
+			ctx, cancel := context.WithTimeout(ctx, d.timeout)
+			defer cancel()
+			_, _ = d.Drain(ctx)
+		}
+	}
+}
+
+// drainableFlusher serves Drain from the flush admin endpoints.
+type drainableFlusher struct {
+	*MetricFlusher
+	drainer *drainer
+}
+
+func (df *drainableFlusher) Drain(ctx context.Context) (uint64, error) {
+	return df.drainer.Drain(ctx)
+}
+
+// waitContext calls wait, and waits for it to return, or the context to be done.
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
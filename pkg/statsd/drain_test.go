@@ -0,0 +1,132 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/fakesocket"
+)
+
+// summingBackend sums the value of every foo.bar.baz counter it is sent.
+type summingBackend struct {
+	lock  sync.Mutex
+	total int64
+}
+
+func (sb *summingBackend) Name() string {
+	return "summingBackend"
+}
+
+func (sb *summingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	sb.lock.Lock()
+	m.Counters.Each(func(name, tagset string, c gostatsd.Counter) {
+		if name == "foo.bar.baz" {
+			sb.total += c.Value
+		}
+	})
+	sb.lock.Unlock()
+	callback(nil)
+}
+
+func (sb *summingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (sb *summingBackend) sum() int64 {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return sb.total
+}
+
+func TestStatsdDrainOnSignal(t *testing.T) {
+	t.Parallel()
+	backend := &summingBackend{}
+	conn, closed := fakesocket.NewCountedFakePacketConn(1001)
+	signals := make(chan os.Signal, 1)
+	ready := make(chan struct{})
+	var stopping uint32
+	s := Server{
+		Backends:            []gostatsd.Backend{backend},
+		FlushInterval:       time.Hour, // Only the drain flushes
+		MaxReaders:          1,
+		MaxParsers:          2,
+		MaxWorkers:          2,
+		MaxQueueSize:        gostatsd.DefaultMaxQueueSize,
+		EstimatedTags:       1,
+		PercentThreshold:    gostatsd.DefaultPercentThreshold,
+		ReceiveBatchSize:    gostatsd.DefaultReceiveBatchSize,
+		MaxConcurrentEvents: 2,
+		ServerMode:          "standalone",
+		Viper:               viper.New(),
+		DrainSignals:        signals,
+		DrainTimeout:        10 * time.Second,
+		OnReady: func() {
+			close(ready)
+		},
+		OnStopping: func() {
+			atomic.StoreUint32(&stopping, 1)
+		},
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancelFunc()
+	go func() {
+		<-ready
+		<-closed // Every datagram has been read
+		signals <- syscall.SIGQUIT
+	}()
+	err := s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) {
+		return conn, nil
+	})
+	require.NoError(t, err)
+	// Every datagram is foo.bar.baz:2|c
+	require.EqualValues(t, 2*1000, backend.sum())
+	require.EqualValues(t, 1, atomic.LoadUint32(&stopping))
+}
+
+func TestStatsdFinalFlushOnShutdown(t *testing.T) {
+	t.Parallel()
+	backend := &summingBackend{}
+	conn, closed := fakesocket.NewCountedFakePacketConn(1001)
+	ready := make(chan struct{})
+	s := Server{
+		Backends:             []gostatsd.Backend{backend},
+		FlushInterval:        time.Hour, // Only the final flush flushes
+		MaxReaders:           1,
+		MaxParsers:           2,
+		MaxWorkers:           2,
+		MaxQueueSize:         gostatsd.DefaultMaxQueueSize,
+		EstimatedTags:        1,
+		PercentThreshold:     gostatsd.DefaultPercentThreshold,
+		ReceiveBatchSize:     gostatsd.DefaultReceiveBatchSize,
+		MaxConcurrentEvents:  2,
+		ServerMode:           "standalone",
+		Viper:                viper.New(),
+		ShutdownFlushTimeout: 10 * time.Second,
+		OnReady: func() {
+			close(ready)
+		},
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	go func() {
+		<-ready
+		<-closed // Every datagram has been read
+		cancelFunc()
+	}()
+	err := s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) {
+		return conn, nil
+	})
+	require.Equal(t, context.Canceled, err)
+	// Every datagram is foo.bar.baz:2|c
+	require.EqualValues(t, 2*1000, backend.sum())
+}
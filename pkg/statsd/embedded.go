@@ -0,0 +1,156 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+
+	"github.com/hligit/gostatsd"
+)
+
+// FlushHook is called by the flusher with the metrics of every flush in standalone mode, before they are sent to the
+// backends.  The MetricMaps are shared with the backends, so they must not be modified, and it is called from the
+// flusher, so it must return quickly.
+type FlushHook func(ctx context.Context, metrics []*gostatsd.MetricMap)
+
+// NewServer returns a Server in standalone mode with the default settings, which sends to the backends, for a program
+// to run in-process with Start.  MaxReaders is 0, so it does not listen for UDP unless it is set.  Any setting can be
+// changed before it is started, and the Viper can be replaced to configure filters, event routes, and the other
+// settings read from a configuration file.
+func NewServer(backends ...gostatsd.Backend) *Server {
+	return &Server{
+		Backends:                    backends,
+		DefaultTags:                 gostatsd.DefaultTags,
+		InternalTags:                gostatsd.DefaultInternalTags,
+		InternalNamespace:           gostatsd.DefaultInternalNamespace,
+		ExpiryIntervalCounter:       gostatsd.DefaultExpiryInterval,
+		ExpiryIntervalGauge:         gostatsd.DefaultExpiryInterval,
+		ExpiryIntervalSet:           gostatsd.DefaultExpiryInterval,
+		ExpiryIntervalTimer:         gostatsd.DefaultExpiryInterval,
+		FlushInterval:               gostatsd.DefaultFlushInterval,
+		FlushQueueSize:              gostatsd.DefaultFlushQueueSize,
+		MaxParsers:                  gostatsd.DefaultMaxParsers,
+		MaxWorkers:                  gostatsd.DefaultMaxWorkers,
+		AggregatorShards:            gostatsd.DefaultAggregatorShards,
+		MaxQueueSize:                gostatsd.DefaultMaxQueueSize,
+		DispatchBatchSize:           gostatsd.DefaultDispatchBatchSize,
+		DispatchBatchDelay:          gostatsd.DefaultDispatchBatchDelay,
+		MaxConcurrentEvents:         gostatsd.DefaultMaxConcurrentEvents,
+		EstimatedTags:               gostatsd.DefaultEstimatedTags,
+		MetricsAddr:                 gostatsd.DefaultMetricsAddr,
+		StatserType:                 gostatsd.DefaultStatserType,
+		PercentThreshold:            gostatsd.DefaultPercentThreshold,
+		ReceiveBatchSize:            gostatsd.DefaultReceiveBatchSize,
+		HistogramLimit:              gostatsd.DefaultTimerHistogramLimit,
+		BadLineRateLimitPerSecond:   rate.Limit(gostatsd.DefaultBadLinesPerMinute / 60.0),
+		ServerMode:                  gostatsd.DefaultServerMode,
+		DrainTimeout:                gostatsd.DefaultDrainTimeout,
+		ShutdownFlushTimeout:        gostatsd.DefaultShutdownFlushTimeout,
+		HACheckInterval:             gostatsd.DefaultHACheckInterval,
+		ShadowPercentage:            gostatsd.DefaultShadowPercentage,
+		LeaderElectionLeaseDuration: gostatsd.DefaultLeaderElectionLeaseDuration,
+		LeaderElectionRenewDeadline: gostatsd.DefaultLeaderElectionRenewDeadline,
+		LeaderElectionRetryPeriod:   gostatsd.DefaultLeaderElectionRetryPeriod,
+		Viper:                       viper.New(),
+	}
+}
+
+// Embedded is a Server running in another program, which sends it metrics and events directly, rather than over the
+// network.  They go through the same pipeline as those received over UDP, from the cloud provider and tags to the
+// backends, so the program gets the aggregation and backends of gostatsd without running it as a separate process.
+type Embedded struct {
+	server  *Server
+	handler gostatsd.PipelineHandler // The start of the pipeline
+	flusher *MetricFlusher
+	cancel  context.CancelFunc
+	done    chan struct{} // Closed when the server has stopped
+	err     error         // Why the server stopped, set before done is closed
+}
+
+// Start runs the server in the background, and returns once it is ready to be sent metrics and events.  It runs until
+// Stop is called, or the context is done, after which it flushes what it was sent, waiting up to the
+// ShutdownFlushTimeout.  It returns an error if the server could not be started.
+func (s *Server) Start(ctx context.Context) (*Embedded, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	e := &Embedded{
+		server: s,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	started := make(chan struct{})
+	s.onStarted = func(handler gostatsd.PipelineHandler, flusher *MetricFlusher) {
+		e.handler, e.flusher = handler, flusher
+		close(started)
+	}
+	sf := SocketFactory(func() (net.PacketConn, error) {
+		return nil, errors.New("the server is not listening, as MaxReaders is 0")
+	})
+	if s.MaxReaders > 0 {
+		sf = socketFactory(s.MetricsAddr, s.ConnPerReader)
+	}
+	go func() {
+		defer close(e.done)
+		if err := s.RunWithCustomSocket(ctx, sf); err != context.Canceled && err != context.DeadlineExceeded {
+			e.err = err
+		}
+	}()
+	select {
+	case <-started:
+		return e, nil
+	case <-e.done:
+		cancel()
+		return nil, e.err
+	}
+}
+
+// SendMetrics sends the metrics to be aggregated, and releases them.  The Namespace of the server is added to their
+// names, a Timestamp of 0 is the current time, and a Rate of 0 is 1.
+func (e *Embedded) SendMetrics(ctx context.Context, metrics ...*gostatsd.Metric) {
+	now := gostatsd.NanoNow()
+	mm := gostatsd.NewMetricMap()
+	for _, m := range metrics {
+		if e.server.Namespace != "" {
+			m.Name = e.server.Namespace + "." + m.Name
+		}
+		if m.Timestamp == 0 {
+			m.Timestamp = now
+		}
+		if m.Rate == 0 {
+			m.Rate = 1
+		}
+		mm.Receive(m)
+	}
+	e.SendMetricMap(ctx, mm)
+}
+
+// SendMetricMap sends the metrics of mm to be aggregated, as they are.  mm must not be used afterwards.
+func (e *Embedded) SendMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	e.handler.DispatchMetricMap(ctx, mm)
+}
+
+// SendEvent sends the event to the backends.
+func (e *Embedded) SendEvent(ctx context.Context, event *gostatsd.Event) {
+	e.handler.DispatchEvent(ctx, event)
+}
+
+// Flush flushes the aggregators immediately, and waits for the backends to send what was flushed, or for the context
+// to be done.  Metrics sent just before it is called may not be aggregated yet, and are included in the next flush.
+func (e *Embedded) Flush(ctx context.Context) error {
+	return e.flusher.FlushNow(ctx, false)
+}
+
+// Done returns a channel which is closed when the server has stopped.
+func (e *Embedded) Done() <-chan struct{} {
+	return e.done
+}
+
+// Stop stops the server, once it has flushed what it was sent, and returns why it stopped, which is nil if it was
+// stopped by Stop or the context it was started with.  Nothing may be sent to it afterwards.
+func (e *Embedded) Stop() error {
+	e.cancel()
+	<-e.done
+	return e.err
+}
@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestEmbeddedServer(t *testing.T) {
+	t.Parallel()
+	backend := &blockingBackend{release: make(chan struct{})}
+	close(backend.release)
+	var lock sync.Mutex
+	var hooked int
+	s := NewServer(backend)
+	s.FlushInterval = time.Hour
+	s.Namespace = "app"
+	s.FlushHooks = []FlushHook{func(ctx context.Context, metrics []*gostatsd.MetricMap) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, mm := range metrics {
+			hooked += mm.Len()
+		}
+	}}
+	ctx := context.Background()
+	e, err := s.Start(ctx)
+	require.NoError(t, err)
+
+	e.SendMetrics(ctx,
+		&gostatsd.Metric{Name: "requests", Value: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"path:/"}},
+		&gostatsd.Metric{Name: "requests", Value: 2, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"path:/"}},
+	)
+	e.SendEvent(ctx, &gostatsd.Event{Title: "started"})
+	require.Eventually(t, func() bool {
+		require.NoError(t, e.Flush(ctx))
+		for _, mm := range backend.sentMaps() {
+			if _, ok := mm.Counters["app.requests"]; ok {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var counter gostatsd.Counter
+	for _, mm := range backend.sentMaps() {
+		mm.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+			if name == "app.requests" {
+				counter = c
+			}
+		})
+	}
+	assert.EqualValues(t, 3, counter.Value)
+	assert.Equal(t, gostatsd.Tags{"path:/"}, counter.Tags)
+	lock.Lock()
+	assert.NotZero(t, hooked)
+	lock.Unlock()
+
+	require.NoError(t, e.Stop())
+	select {
+	case <-e.Done():
+	default:
+		t.Error("the server has not stopped")
+	}
+}
+
+func TestEmbeddedServerStartFails(t *testing.T) {
+	t.Parallel()
+	s := NewServer()
+	s.ServerMode = "invalid"
+	_, err := s.Start(context.Background())
+	assert.Error(t, err)
+}
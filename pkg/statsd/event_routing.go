@@ -0,0 +1,227 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+)
+
+// eventMatcher selects events by their tags, source, priority, and alert type.  An event matches if it matches every
+// criteria which is set, and a matcher without any criteria matches every event.
+type eventMatcher struct {
+	matchTags    gostatsd.StringMatchList // Any tag must match, if set
+	matchSources gostatsd.StringMatchList // The source must match, if set
+	priorities   []gostatsd.Priority      // The priority must be one of these, if set
+	alertTypes   []gostatsd.AlertType     // The alert type must be one of these, if set
+}
+
+// eventMatcherSettings are the settings of an eventMatcher, in the section of the event route or template using it.
+var eventMatcherSettings = []string{"match-tags", "match-sources", "match-priorities", "match-alert-types"}
+
+// eventRoute sends the events it matches to some of the backends, or drops them.
+type eventRoute struct {
+	eventMatcher
+	name     string
+	backends map[string]bool // The names of the backends matching events are sent to
+	drop     bool            // Drop matching events
+
+	matched uint64 // atomic - events matched since the last flush
+}
+
+// eventRouteSettings are the settings of an event-route section, in addition to eventMatcherSettings.
+var eventRouteSettings = []string{"backends", "drop"}
+
+var priorities = map[string]gostatsd.Priority{
+	gostatsd.PriNormal.String(): gostatsd.PriNormal,
+	gostatsd.PriLow.String():    gostatsd.PriLow,
+}
+
+var alertTypes = map[string]gostatsd.AlertType{
+	gostatsd.AlertInfo.String():    gostatsd.AlertInfo,
+	gostatsd.AlertWarning.String(): gostatsd.AlertWarning,
+	gostatsd.AlertError.String():   gostatsd.AlertError,
+	gostatsd.AlertSuccess.String(): gostatsd.AlertSuccess,
+}
+
+// eventRoutesFromViper returns the event routes named in event-routes, in order, each configured by its event-route
+// section.
+func eventRoutesFromViper(v *viper.Viper) ([]*eventRoute, error) {
+	var routes []*eventRoute
+	for _, name := range v.GetStringSlice("event-routes") {
+		vRoute := v.Sub("event-route." + name)
+		if vRoute == nil {
+			return nil, fmt.Errorf("event route %q has no event-route.%s section", name, name)
+		}
+		route, err := newEventRouteFromViper(name, vRoute)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// newEventMatcherFromViper returns the eventMatcher configured by v, which is the section named section.
+func newEventMatcherFromViper(section string, v *viper.Viper) (eventMatcher, error) {
+	var em eventMatcher
+	for _, test := range v.GetStringSlice("match-tags") {
+		sm, err := gostatsd.ParseStringMatch(test)
+		if err != nil {
+			return em, fmt.Errorf("%s.match-tags: %v", section, err)
+		}
+		em.matchTags = append(em.matchTags, sm)
+	}
+	for _, test := range v.GetStringSlice("match-sources") {
+		sm, err := gostatsd.ParseStringMatch(test)
+		if err != nil {
+			return em, fmt.Errorf("%s.match-sources: %v", section, err)
+		}
+		em.matchSources = append(em.matchSources, sm)
+	}
+	for _, p := range v.GetStringSlice("match-priorities") {
+		priority, ok := priorities[p]
+		if !ok {
+			return em, fmt.Errorf("%s.match-priorities: invalid priority %q, must be normal or low", section, p)
+		}
+		em.priorities = append(em.priorities, priority)
+	}
+	for _, a := range v.GetStringSlice("match-alert-types") {
+		alertType, ok := alertTypes[a]
+		if !ok {
+			return em, fmt.Errorf("%s.match-alert-types: invalid alert type %q, must be info, warning, error, or success", section, a)
+		}
+		em.alertTypes = append(em.alertTypes, alertType)
+	}
+	return em, nil
+}
+
+// unknownEventSettings returns an error for every setting of the section v which is not an eventMatcher setting or
+// one of settings.
+func unknownEventSettings(section string, v *viper.Viper, settings []string) []string {
+	known := map[string]bool{}
+	for _, setting := range append(append([]string{}, eventMatcherSettings...), settings...) {
+		known[setting] = true
+	}
+	var errs []string
+	for _, key := range v.AllKeys() {
+		if !known[key] {
+			errs = append(errs, fmt.Sprintf("unknown setting %s.%s", section, key))
+		}
+	}
+	return errs
+}
+
+func newEventRouteFromViper(name string, v *viper.Viper) (*eventRoute, error) {
+	em, err := newEventMatcherFromViper("event-route."+name, v)
+	if err != nil {
+		return nil, err
+	}
+	route := &eventRoute{
+		eventMatcher: em,
+		name:         name,
+		backends:     map[string]bool{},
+		drop:         v.GetBool("drop"),
+	}
+	for _, backend := range v.GetStringSlice("backends") {
+		route.backends[backend] = true
+	}
+	if route.drop == (len(route.backends) > 0) {
+		return nil, fmt.Errorf("event-route.%s must have either backends, or drop", name)
+	}
+	return route, nil
+}
+
+// CheckEventRoutes returns an error listing every problem with the event routes, including every setting of an
+// event-route section which is not known, and every backend which is not configured, so a typo is not silently
+// ignored.
+func CheckEventRoutes(v *viper.Viper) error {
+	var errs []string
+	configured := map[string]bool{}
+	for _, backend := range v.GetStringSlice(gostatsd.ParamBackends) {
+		configured[backend] = true
+	}
+	for _, name := range v.GetStringSlice("event-routes") {
+		vRoute := v.Sub("event-route." + name)
+		if vRoute == nil {
+			errs = append(errs, fmt.Sprintf("event route %q has no event-route.%s section", name, name))
+			continue
+		}
+		errs = append(errs, unknownEventSettings("event-route."+name, vRoute, eventRouteSettings)...)
+		route, err := newEventRouteFromViper(name, vRoute)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for backend := range route.backends {
+			if !configured[backend] {
+				errs = append(errs, fmt.Sprintf("event-route.%s.backends: %q is not in %s", name, backend, gostatsd.ParamBackends))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// match returns true if the event matches every criteria which is set.
+func (em *eventMatcher) match(e *gostatsd.Event) bool {
+	if len(em.matchTags) > 0 && !em.matchTags.MatchAnyMultiple(e.Tags) {
+		return false
+	}
+	if len(em.matchSources) > 0 && !em.matchSources.MatchAny(string(e.Source)) {
+		return false
+	}
+	if len(em.priorities) > 0 && !containsPriority(em.priorities, e.Priority) {
+		return false
+	}
+	if len(em.alertTypes) > 0 && !containsAlertType(em.alertTypes, e.AlertType) {
+		return false
+	}
+	return true
+}
+
+func containsPriority(priorities []gostatsd.Priority, p gostatsd.Priority) bool {
+	for _, priority := range priorities {
+		if priority == p {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAlertType(alertTypes []gostatsd.AlertType, a gostatsd.AlertType) bool {
+	for _, alertType := range alertTypes {
+		if alertType == a {
+			return true
+		}
+	}
+	return false
+}
+
+// routeEvent returns the backends the event is sent to, by the first route it matches.  An event which does not match
+// any route is sent to every backend.
+func routeEvent(routes []*eventRoute, backends []gostatsd.Backend, e *gostatsd.Event) []gostatsd.Backend {
+	for _, route := range routes {
+		if !route.match(e) {
+			continue
+		}
+		atomic.AddUint64(&route.matched, 1)
+		if route.drop {
+			return nil
+		}
+		routed := make([]gostatsd.Backend, 0, len(route.backends))
+		for _, backend := range backends {
+			if route.backends[backend.Name()] {
+				routed = append(routed, backend)
+			}
+		}
+		return routed
+	}
+	return backends
+}
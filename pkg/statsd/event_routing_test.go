@@ -0,0 +1,95 @@
+package statsd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func backendNames(backends []gostatsd.Backend) []string {
+	names := []string{}
+	for _, backend := range backends {
+		names = append(names, backend.Name())
+	}
+	return names
+}
+
+func TestEventRoutes(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+backends = ['datadog', 'graphite', 'webhook']
+event-routes = ['deploys', 'noise', 'alerts']
+[event-route.deploys]
+match-tags = ['type:deploy']
+backends = ['datadog', 'webhook']
+[event-route.noise]
+match-priorities = ['low']
+match-sources = ['test-*']
+drop = true
+[event-route.alerts]
+match-alert-types = ['error', 'warning']
+backends = ['graphite']
+`)))
+	require.NoError(t, CheckEventRoutes(v))
+	routes, err := eventRoutesFromViper(v)
+	require.NoError(t, err)
+
+	backends := []gostatsd.Backend{&namedBackend{name: "datadog"}, &namedBackend{name: "graphite"}, &namedBackend{name: "webhook"}}
+	tests := []struct {
+		name     string
+		event    gostatsd.Event
+		expected []string
+	}{
+		{"tags", gostatsd.Event{Tags: gostatsd.Tags{"env:prod", "type:deploy"}, AlertType: gostatsd.AlertError}, []string{"datadog", "webhook"}},
+		{"dropped", gostatsd.Event{Source: "test-host", Priority: gostatsd.PriLow}, []string{}},
+		{"every criteria must match", gostatsd.Event{Source: "prod-host", Priority: gostatsd.PriLow}, []string{"datadog", "graphite", "webhook"}},
+		{"alert type", gostatsd.Event{AlertType: gostatsd.AlertWarning}, []string{"graphite"}},
+		{"unmatched", gostatsd.Event{AlertType: gostatsd.AlertInfo}, []string{"datadog", "graphite", "webhook"}},
+	}
+	for _, tt := range tests {
+		e := tt.event
+		assert.Equal(t, tt.expected, backendNames(routeEvent(routes, backends, &e)), tt.name)
+	}
+	assert.EqualValues(t, 1, routes[0].matched)
+	assert.EqualValues(t, 1, routes[1].matched)
+	assert.EqualValues(t, 1, routes[2].matched)
+
+	// Without routes, every event is sent to every backend
+	assert.Equal(t, backends, routeEvent(nil, backends, &gostatsd.Event{}))
+}
+
+func TestCheckEventRoutes(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+backends = ['datadog']
+event-routes = ['typo', 'unknown', 'neither', 'priority', 'missing']
+[event-route.typo]
+match-tag = ['a']
+drop = true
+[event-route.unknown]
+backends = ['graphite']
+[event-route.neither]
+match-tags = ['a']
+[event-route.priority]
+match-priorities = ['high']
+drop = true
+`)))
+	err := CheckEventRoutes(v)
+	require.Error(t, err)
+	assert.Equal(t, `unknown setting event-route.typo.match-tag; `+
+		`event-route.unknown.backends: "graphite" is not in backends; `+
+		`event-route.neither must have either backends, or drop; `+
+		`event-route.priority.match-priorities: invalid priority "high", must be normal or low; `+
+		`event route "missing" has no event-route.missing section`, err.Error())
+	_, err = eventRoutesFromViper(v)
+	assert.Error(t, err)
+}
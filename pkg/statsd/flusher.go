@@ -3,19 +3,24 @@ package statsd
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ash2k/stager/wait"
 	"github.com/sirupsen/logrus"
 	"github.com/tilinna/clock"
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/internal/util"
 	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/tracing"
 )
 
-// MetricFlusher periodically flushes metrics from all Aggregators to Senders.
+// MetricFlusher periodically flushes metrics from all Aggregators to Senders.  The aggregators are snapshotted and
+// reset, and the snapshot is handed to a sender for each backend, so sending does not delay the next flush.
 type MetricFlusher struct {
 	// Counter fields below must be read/written only using atomic instructions.
 	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
@@ -27,18 +32,63 @@ type MetricFlusher struct {
 	flushOffset        time.Duration // Offset for when to flush if alignment is enabled
 	flushAligned       bool          // Indicate if flush is aligned to the interval or not
 	aggregateProcesser AggregateProcesser
-	backends           []gostatsd.Backend
+	queueSize          int
+	senders            []*backendSender // Only accessed by the Run goroutine once it has started
+	ha                 *haPair          // Divides the series with the peer of an active-active pair, or nil
+	rules              *ruleEngine      // Evaluates threshold rules against every flush, or nil
+	mirror             *metricMirror    // Sends a copy of every flush to the shadow backends, or nil
+	hooks              []FlushHook      // Called with the metrics of every flush, before they are sent
+	jitter             time.Duration    // The maximum random delay of each periodic flush after its tick
+	splay              time.Duration    // The maximum random delay of each backend sending a flush
+
+	requests chan *flushRequest // Requests for an immediate flush, or to pause or resume flushing
+	paused   int32              // Non-zero if periodic flushes are paused. Must be accessed atomically.
+}
+
+// flushRequest is a request to the Run goroutine to flush immediately, and optionally pause or resume periodic flushes
+// afterwards, or to replace the backends.  done is closed when it has been handled.
+type flushRequest struct {
+	flush       bool
+	pause       bool
+	resume      bool
+	setBackends bool
+	backends    []gostatsd.Backend
+	removed     []*backendSender // The senders of the backends which were removed, set by the Run goroutine
+	done        chan struct{}
 }
 
-// NewMetricFlusher creates a new MetricFlusher with provided configuration.
-func NewMetricFlusher(flushInterval, flushOffset time.Duration, aligned bool, aggregateProcesser AggregateProcesser, backends []gostatsd.Backend) *MetricFlusher {
-	return &MetricFlusher{
+// NewMetricFlusher creates a new MetricFlusher with provided configuration.  Up to queueSize flushes are queued for
+// each backend while it is sending an earlier one, after which the oldest is dropped.
+func NewMetricFlusher(flushInterval, flushOffset time.Duration, aligned bool, queueSize int, aggregateProcesser AggregateProcesser, backends []gostatsd.Backend) *MetricFlusher {
+	f := &MetricFlusher{
 		flushInterval:      flushInterval,
 		flushOffset:        flushOffset,
 		flushAligned:       aligned,
 		aggregateProcesser: aggregateProcesser,
-		backends:           backends,
+		queueSize:          queueSize,
+		requests:           make(chan *flushRequest),
+	}
+	for _, backend := range backends {
+		f.senders = append(f.senders, f.newSender(backend))
 	}
+	return f
+}
+
+// SetJitter delays each periodic flush by a random duration up to jitter after its tick, and each backend sending a
+// flush by a random duration up to splay, so many servers with the same interval do not all send at the same moment.
+// It must be called before Run.
+func (f *MetricFlusher) SetJitter(jitter, splay time.Duration) {
+	f.jitter = jitter
+	f.splay = splay
+	for _, sender := range f.senders {
+		sender.splay = splay
+	}
+}
+
+func (f *MetricFlusher) newSender(backend gostatsd.Backend) *backendSender {
+	sender := newBackendSender(backend, f.queueSize, f.handleSendResult)
+	sender.splay = f.splay
+	return sender
 }
 
 func (f *MetricFlusher) makeTicker(ctx context.Context) (<-chan time.Time, func()) {
@@ -56,27 +106,175 @@ func (f *MetricFlusher) makeTicker(ctx context.Context) (<-chan time.Time, func(
 func (f *MetricFlusher) Run(ctx context.Context) {
 	statser := stats.FromContext(ctx)
 
+	var wg wait.Group
+	defer wg.Wait()
+	for _, sender := range f.senders {
+		wg.StartWithContext(ctx, sender.Run)
+	}
+	if f.mirror != nil {
+		for _, sender := range f.mirror.senders {
+			wg.StartWithContext(ctx, sender.Run)
+		}
+	}
+
 	ch, stop := f.makeTicker(ctx)
 	defer stop()
 
-	lastFlush := time.Now()
+	clck := clock.FromContext(ctx)
+	lastFlush := clck.Now()
+	flush := func(thisFlush time.Time, immediate bool) *flushPayload {
+		flushDelta := thisFlush.Sub(lastFlush)
+		statser.NotifyFlush(ctx, flushDelta)
+		lastFlush = thisFlush
+		if f.aggregateProcesser != AggregateProcesser(nil) {
+			return f.flushData(ctx, flushDelta, statser, immediate)
+		}
+		return nil
+	}
+	var jittered <-chan time.Time // Fires when the flush delayed by the jitter is due, nil if none is
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case thisFlush := <-ch: // Time to flush to the backends
-			flushDelta := thisFlush.Sub(lastFlush)
-			statser.NotifyFlush(ctx, flushDelta)
-			if f.aggregateProcesser != AggregateProcesser(nil) {
-				f.flushData(ctx, flushDelta, statser)
+			if f.jitter > 0 {
+				if jittered == nil {
+					jittered = clck.NewTimer(randomDuration(f.jitter)).C
+				}
+				continue
+			}
+			// While paused, the data accumulates in the aggregators, and the next flush covers the whole interval
+			// since the last one, so rates are still correct.
+			if !f.Paused() {
+				flush(thisFlush, false)
 			}
-			lastFlush = thisFlush
+		case thisFlush := <-jittered:
+			jittered = nil
+			if !f.Paused() {
+				flush(thisFlush, false)
+			}
+		case req := <-f.requests:
+			if req.setBackends {
+				req.removed = f.replaceSenders(ctx, &wg, req.backends)
+			}
+			if req.flush {
+				if payload := flush(clck.Now(), true); payload != nil {
+					payload.wait(ctx)
+				}
+			}
+			if req.pause {
+				atomic.StoreInt32(&f.paused, 1)
+			} else if req.resume {
+				atomic.StoreInt32(&f.paused, 0)
+			}
+			close(req.done)
 		}
 	}
 }
 
-func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Duration, statser stats.Statser) {
-	var sendWg sync.WaitGroup
+// FlushNow flushes all aggregators immediately, outside the normal interval, and waits for the backends to finish
+// sending.  If pause is true, periodic flushes are paused after the flush, until ResumeFlush is called.
+func (f *MetricFlusher) FlushNow(ctx context.Context, pause bool) error {
+	return f.request(ctx, &flushRequest{flush: true, pause: pause})
+}
+
+// ResumeFlush resumes periodic flushes after they were paused by FlushNow.
+func (f *MetricFlusher) ResumeFlush(ctx context.Context) error {
+	return f.request(ctx, &flushRequest{resume: true})
+}
+
+// SetBackends replaces the backends metrics are sent to, from the next flush.  The backends which are kept keep their
+// queue of flushes.  The Wait returned waits until every flush queued for a removed backend has been sent, or
+// dropped as the flusher stopped, so the removed backends can be stopped.
+func (f *MetricFlusher) SetBackends(ctx context.Context, backends []gostatsd.Backend) (gostatsd.Wait, error) {
+	req := &flushRequest{setBackends: true, backends: backends}
+	if err := f.request(ctx, req); err != nil {
+		return nil, err
+	}
+	return func() {
+		for _, sender := range req.removed {
+			<-sender.done
+		}
+	}, nil
+}
+
+// replaceSenders starts a sender for every backend which does not have one, and closes the senders of the backends
+// which are not in backends.  It returns the senders which were closed.
+func (f *MetricFlusher) replaceSenders(ctx context.Context, wg *wait.Group, backends []gostatsd.Backend) []*backendSender {
+	existing := make(map[gostatsd.Backend]*backendSender, len(f.senders))
+	for _, sender := range f.senders {
+		existing[sender.backend] = sender
+	}
+	senders := make([]*backendSender, 0, len(backends))
+	for _, backend := range backends {
+		sender, ok := existing[backend]
+		if ok {
+			delete(existing, backend)
+		} else {
+			sender = f.newSender(backend)
+			wg.StartWithContext(ctx, sender.Run)
+		}
+		senders = append(senders, sender)
+	}
+	var removed []*backendSender
+	for _, sender := range f.senders {
+		if _, ok := existing[sender.backend]; ok {
+			sender.close()
+			removed = append(removed, sender)
+		}
+	}
+	f.senders = senders
+	return removed
+}
+
+// Paused returns true if periodic flushes are paused.
+func (f *MetricFlusher) Paused() bool {
+	return atomic.LoadInt32(&f.paused) != 0
+}
+
+func (f *MetricFlusher) request(ctx context.Context, req *flushRequest) error {
+	req.done = make(chan struct{})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case f.requests <- req:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-req.done:
+		return nil
+	}
+}
+
+// FlushOnSignal returns a Runnable which flushes immediately every time a signal is received on signals.
+func (f *MetricFlusher) FlushOnSignal(signals <-chan os.Signal) gostatsd.Runnable {
+	return func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-signals:
+				logrus.WithField("signal", sig).Info("Flushing on signal")
+				if err := f.FlushNow(ctx, false); err != nil && err != context.Canceled {
+					logrus.WithError(err).Warn("Failed to flush on signal")
+				}
+			}
+		}
+	}
+}
+
+// flushData flushes and snapshots every aggregator, and queues the snapshot to be sent by every backend.  It returns
+// the payload queued, which is sent once every backend has sent or dropped it.  An immediate flush is not delayed by
+// the splay, as something is waiting for it.
+func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Duration, statser stats.Statser, immediate bool) *flushPayload {
+	// The requests made by the backends are children of the flush
+	ctx, span := tracing.Start(ctx, "flush")
+	defer span.End()
+
+	var lock sync.Mutex
+	payload := &flushPayload{ctx: ctx, immediate: immediate}
+	start := time.Now()
 	timerTotal := statser.NewTimer("flusher.total_time", nil)
 	processWait := f.aggregateProcesser.Process(ctx, func(workerId int, aggr Aggregator) {
 		// This is in the flusher, but it's an aggregator action, so put it in that space.
@@ -84,31 +282,52 @@ func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Durati
 
 		timerFlush := statser.NewTimer("aggregator.aggregation_time", tags)
 		aggr.Flush(flushInterval)
-		timerFlush.SendGauge()
-
-		timerProcess := statser.NewTimer("aggregator.process_time", tags)
-		aggr.Process(func(m *gostatsd.MetricMap) {
-			f.sendMetricsAsync(ctx, &sendWg, m)
-		})
-		timerProcess.SendGauge()
+		timerFlush.Send()
 
 		timerReset := statser.NewTimer("aggregator.reset_time", tags)
-		aggr.Reset()
-		timerReset.SendGauge()
+		snapshot := aggr.Snapshot()
+		timerReset.Send()
+		if f.ha != nil {
+			snapshot = f.ha.filter(snapshot)
+		}
+
+		timerProcess := statser.NewTimer("aggregator.process_time", tags)
+		series := snapshot.Len()
+		lock.Lock()
+		payload.metrics = append(payload.metrics, snapshot)
+		payload.series += series
+		lock.Unlock()
+		timerProcess.Send()
 	})
 	processWait() // Wait for all workers to execute function
-	sendWg.Wait() // Wait for all backends to finish sending
-	timerTotal.SendGauge()
-}
 
-func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap) {
-	wg.Add(len(f.backends))
-	for _, backend := range f.backends {
-		backend.SendMetricsAsync(ctx, m, func(errs []error) {
-			defer wg.Done()
-			f.handleSendResult(errs)
-		})
+	if f.rules != nil {
+		f.rules.evaluate(ctx, payload.metrics)
+	}
+	for _, hook := range f.hooks {
+		hook(ctx, payload.metrics)
 	}
+
+	payload.sent.Add(len(f.senders))
+	for _, sender := range f.senders {
+		sender.enqueue(ctx, payload)
+		statser.Gauge("flusher.queued", float64(len(sender.queue)), gostatsd.Tags{"backend:" + sender.backend.Name()})
+	}
+	if f.mirror != nil {
+		f.mirror.enqueue(ctx, payload.metrics)
+	}
+	timerTotal.Send()
+
+	// A flush which takes longer than the interval delays the next one, so capture what it was busy with
+	if f.flushInterval > 0 && time.Since(start) > f.flushInterval {
+		stats.ProfileTriggerFromContext(ctx).TriggerProfile("flush_overrun")
+	}
+	return payload
+}
+
+// randomDuration returns a random duration from 0 up to max.
+func randomDuration(max time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(max)))
 }
 
 func (f *MetricFlusher) handleSendResult(flushResults []error) {
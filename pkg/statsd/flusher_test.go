@@ -1,9 +1,15 @@
 package statsd
 
 import (
+	"context"
 	"errors"
 	"strconv"
 	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFlusherHandleSendResultNoErrors(t *testing.T) {
@@ -17,7 +23,7 @@ func TestFlusherHandleSendResultNoErrors(t *testing.T) {
 		errs := errs
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
-			fl := NewMetricFlusher(0, 0, false, nil, nil)
+			fl := NewMetricFlusher(0, 0, false, 0, nil, nil)
 			fl.handleSendResult(errs)
 
 			if fl.lastFlush == 0 || fl.lastFlushError != 0 {
@@ -39,7 +45,7 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		errs := errs
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
-			fl := NewMetricFlusher(0, 0, false, nil, nil)
+			fl := NewMetricFlusher(0, 0, false, 0, nil, nil)
 			fl.handleSendResult(errs)
 
 			if fl.lastFlushError == 0 || fl.lastFlush != 0 {
@@ -48,3 +54,45 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		})
 	}
 }
+
+func TestFlusherFlushNow(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	factory := newTestFactory()
+	h := NewBackendHandler(nil, 0, 2, 0, 0, 0, factory)
+	fl := NewMetricFlusher(time.Hour, 0, false, 0, h, nil)
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, h.Run)
+	wg.StartWithContext(ctx, fl.Run)
+
+	flushes := func() int {
+		factory.Lock()
+		defer factory.Unlock()
+		return factory.flushInvocations[0] + factory.flushInvocations[1]
+	}
+
+	require.NoError(t, fl.FlushNow(ctx, false))
+	assert.Equal(t, 2, flushes())
+	assert.False(t, fl.Paused())
+
+	require.NoError(t, fl.FlushNow(ctx, true))
+	assert.Equal(t, 4, flushes())
+	assert.True(t, fl.Paused())
+
+	require.NoError(t, fl.ResumeFlush(ctx))
+	assert.Equal(t, 4, flushes())
+	assert.False(t, fl.Paused())
+}
+
+func TestFlusherFlushNowCancelled(t *testing.T) {
+	t.Parallel()
+	fl := NewMetricFlusher(time.Hour, 0, false, 0, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Run is never called, so the request is never received
+	assert.Equal(t, context.Canceled, fl.FlushNow(ctx, false))
+}
@@ -0,0 +1,134 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/hligit/gostatsd"
+)
+
+const (
+	// QueuePolicyBlock blocks the pipeline, and eventually the receivers, until there is room in the queue.
+	QueuePolicyBlock = "block"
+	// QueuePolicyDropNewest drops the batch being added when the queue is full.
+	QueuePolicyDropNewest = "drop-newest"
+	// QueuePolicyDropOldest drops the batch which has been queued for the longest when the queue is full.
+	QueuePolicyDropOldest = "drop-oldest"
+)
+
+// forwarderBatch is a MetricMap waiting to be sent to a target.
+type forwarderBatch struct {
+	target        *forwarderTarget
+	metricMap     *gostatsd.MetricMap
+	dynHeaderTags string
+}
+
+// batchQueue is a bounded FIFO queue of batches waiting for a request slot, with a policy for when it is full.  It
+// supports a single producer and a single consumer.
+type batchQueue struct {
+	maxSize  int
+	policy   string
+	notEmpty chan struct{}
+	notFull  chan struct{}
+
+	lock  sync.Mutex
+	items []*forwarderBatch
+}
+
+func newBatchQueue(maxSize int, policy string) (*batchQueue, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("max-queue-size must be positive")
+	}
+	switch policy {
+	case QueuePolicyBlock, QueuePolicyDropNewest, QueuePolicyDropOldest:
+	default:
+		return nil, fmt.Errorf("queue-policy must be %s, %s, or %s", QueuePolicyBlock, QueuePolicyDropNewest, QueuePolicyDropOldest)
+	}
+	return &batchQueue{
+		maxSize:  maxSize,
+		policy:   policy,
+		notEmpty: make(chan struct{}, 1),
+		notFull:  make(chan struct{}, 1),
+	}, nil
+}
+
+// push adds a batch to the queue, and returns the batch dropped to apply the policy, or nil if none was.  It returns
+// false if the context is done while blocked.
+func (bq *batchQueue) push(ctx context.Context, b *forwarderBatch) (*forwarderBatch, bool) {
+	for {
+		bq.lock.Lock()
+		if len(bq.items) < bq.maxSize {
+			bq.items = append(bq.items, b)
+			bq.lock.Unlock()
+			signal(bq.notEmpty)
+			return nil, true
+		}
+		switch bq.policy {
+		case QueuePolicyDropNewest:
+			bq.lock.Unlock()
+			return b, true
+		case QueuePolicyDropOldest:
+			dropped := bq.items[0]
+			bq.items[0] = nil
+			bq.items = append(bq.items[1:], b)
+			bq.lock.Unlock()
+			return dropped, true
+		}
+		bq.lock.Unlock()
+
+		select {
+		case <-bq.notFull:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// pop removes the oldest batch from the queue, waiting for one if it is empty.  It returns false if the context is
+// done while waiting.
+func (bq *batchQueue) pop(ctx context.Context) (*forwarderBatch, bool) {
+	for {
+		bq.lock.Lock()
+		if len(bq.items) > 0 {
+			b := bq.items[0]
+			bq.items[0] = nil
+			bq.items = bq.items[1:]
+			bq.lock.Unlock()
+			signal(bq.notFull)
+			return b, true
+		}
+		bq.lock.Unlock()
+
+		select {
+		case <-bq.notEmpty:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// drain removes and returns every batch in the queue, oldest first.
+func (bq *batchQueue) drain() []*forwarderBatch {
+	bq.lock.Lock()
+	items := bq.items
+	bq.items = nil
+	bq.lock.Unlock()
+	signal(bq.notFull)
+	return items
+}
+
+// len returns the number of batches in the queue.
+func (bq *batchQueue) len() int {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+	return len(bq.items)
+}
+
+// signal wakes up a waiter on ch, if there is one, without blocking.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
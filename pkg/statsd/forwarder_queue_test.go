@@ -0,0 +1,141 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func batchesFor(names ...string) []*forwarderBatch {
+	batches := make([]*forwarderBatch, 0, len(names))
+	for _, name := range names {
+		batches = append(batches, &forwarderBatch{dynHeaderTags: name})
+	}
+	return batches
+}
+
+func popAll(t *testing.T, bq *batchQueue) []string {
+	var names []string
+	for bq.len() > 0 {
+		b, ok := bq.pop(context.Background())
+		require.True(t, ok)
+		names = append(names, b.dynHeaderTags)
+	}
+	return names
+}
+
+func TestBatchQueueDropNewest(t *testing.T) {
+	t.Parallel()
+	bq, err := newBatchQueue(2, QueuePolicyDropNewest)
+	require.NoError(t, err)
+
+	var dropped []string
+	for _, b := range batchesFor("a", "b", "c", "d") {
+		d, ok := bq.push(context.Background(), b)
+		require.True(t, ok)
+		if d != nil {
+			dropped = append(dropped, d.dynHeaderTags)
+		}
+	}
+	assert.Equal(t, []string{"c", "d"}, dropped)
+	assert.Equal(t, []string{"a", "b"}, popAll(t, bq))
+}
+
+func TestBatchQueueDropOldest(t *testing.T) {
+	t.Parallel()
+	bq, err := newBatchQueue(2, QueuePolicyDropOldest)
+	require.NoError(t, err)
+
+	var dropped []string
+	for _, b := range batchesFor("a", "b", "c", "d") {
+		d, ok := bq.push(context.Background(), b)
+		require.True(t, ok)
+		if d != nil {
+			dropped = append(dropped, d.dynHeaderTags)
+		}
+	}
+	assert.Equal(t, []string{"a", "b"}, dropped)
+	assert.Equal(t, []string{"c", "d"}, popAll(t, bq))
+}
+
+func TestBatchQueueBlock(t *testing.T) {
+	t.Parallel()
+	bq, err := newBatchQueue(1, QueuePolicyBlock)
+	require.NoError(t, err)
+
+	batches := batchesFor("a", "b")
+	dropped, ok := bq.push(context.Background(), batches[0])
+	require.True(t, ok)
+	require.Nil(t, dropped)
+
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		dropped, ok := bq.push(context.Background(), batches[1])
+		assert.True(t, ok)
+		assert.Nil(t, dropped)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b, ok := bq.pop(context.Background())
+	require.True(t, ok)
+	assert.Equal(t, "a", b.dynHeaderTags)
+
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push did not unblock")
+	}
+	assert.Equal(t, []string{"b"}, popAll(t, bq))
+}
+
+func TestBatchQueueCancel(t *testing.T) {
+	t.Parallel()
+	bq, err := newBatchQueue(1, QueuePolicyBlock)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, ok := bq.pop(ctx)
+	assert.False(t, ok)
+
+	_, ok = bq.push(ctx, &forwarderBatch{})
+	require.True(t, ok)
+	_, ok = bq.push(ctx, &forwarderBatch{})
+	assert.False(t, ok)
+}
+
+func TestNewBatchQueueInvalid(t *testing.T) {
+	t.Parallel()
+	_, err := newBatchQueue(0, QueuePolicyBlock)
+	assert.Error(t, err)
+	_, err = newBatchQueue(1, "drop-everything")
+	assert.Error(t, err)
+}
+
+func TestBatchQueueDrain(t *testing.T) {
+	t.Parallel()
+	bq, err := newBatchQueue(3, QueuePolicyBlock)
+	require.NoError(t, err)
+	for _, b := range batchesFor("a", "b") {
+		_, ok := bq.push(context.Background(), b)
+		require.True(t, ok)
+	}
+
+	var names []string
+	for _, b := range bq.drain() {
+		names = append(names, b.dynHeaderTags)
+	}
+	assert.Equal(t, []string{"a", "b"}, names)
+	assert.Zero(t, bq.len())
+	assert.Empty(t, bq.drain())
+}
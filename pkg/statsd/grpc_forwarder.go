@@ -0,0 +1,320 @@
+package statsd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/hligit/gostatsd/pb"
+)
+
+const (
+	protocolHttp = "http"
+	protocolGrpc = "grpc"
+
+	defaultProtocol             = protocolHttp
+	defaultGrpcKeepaliveTime    = 30 * time.Second
+	defaultGrpcKeepaliveTimeout = 10 * time.Second
+)
+
+// The methods of the ForwarderV2 service in pb/gostatsd.proto.  Payloads are sent on streams opened with
+// grpcStreamDesc rather than with the generated client, as they have already been serialized.
+const (
+	grpcMetricsMethod = "/pb.ForwarderV2/Metrics"
+	grpcEventsMethod  = "/pb.ForwarderV2/Events"
+)
+
+var grpcStreamDesc = &grpc.StreamDesc{
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+var errGrpcStreamClosed = errors.New("grpc stream closed")
+
+// grpcForwarder sends serialized payloads over long lived grpc streams, with one connection per upstream, and one
+// stream per upstream, endpoint, and set of dynamic headers multiplexed over it.  A payload is sent once it has been
+// acknowledged by the upstream.
+type grpcForwarder struct {
+	logger      logrus.FieldLogger
+	headers     map[string]string
+	tlsConfig   *tls.Config // Used for https api-endpoints
+	dialOptions []grpc.DialOption
+	callOptions []grpc.CallOption
+	maxInflight int
+
+	ctx    context.Context // The lifetime of every stream
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	conns   map[string]*grpc.ClientConn
+	streams map[grpcStreamKey]*grpcStream
+}
+
+type grpcStreamKey struct {
+	apiEndpoint     string
+	method          string
+	protocolVersion int
+	dynHeaderTags   string
+}
+
+func newGrpcForwarder(logger logrus.FieldLogger, headers map[string]string, tlsConfig *tls.Config, gzipCompression bool, keepaliveTime, keepaliveTimeout time.Duration, maxInflight int) *grpcForwarder {
+	dialOptions := []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepaliveTime,
+			Timeout:             keepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+	}
+	callOptions := []grpc.CallOption{grpc.ForceCodec(preserializedCodec{})}
+	if gzipCompression {
+		callOptions = append(callOptions, grpc.UseCompressor(gzip.Name))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &grpcForwarder{
+		logger:      logger,
+		headers:     headers,
+		tlsConfig:   tlsConfig,
+		dialOptions: dialOptions,
+		callOptions: callOptions,
+		maxInflight: maxInflight,
+		ctx:         ctx,
+		cancel:      cancel,
+		conns:       map[string]*grpc.ClientConn{},
+		streams:     map[grpcStreamKey]*grpcStream{},
+	}
+}
+
+// grpcTarget returns the address to dial for an api-endpoint, and whether it uses TLS.
+func grpcTarget(apiEndpoint string) (string, bool, error) {
+	u, err := url.Parse(apiEndpoint)
+	if err != nil {
+		return "", false, err
+	}
+	var useTLS bool
+	var port string
+	switch u.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		useTLS, port = true, "443"
+	default:
+		return "", false, fmt.Errorf("api-endpoint %s must be http or https", apiEndpoint)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS, nil
+}
+
+// send sends a serialized payload to the upstream, and waits for it to be acknowledged.
+func (gf *grpcForwarder) send(ctx context.Context, apiEndpoint, endpoint string, raw []byte, protocolVersion int, dynHeaderTags string) error {
+	var method string
+	switch endpoint {
+	case "/v2/raw":
+		method = grpcMetricsMethod
+	case "/v2/event":
+		method = grpcEventsMethod
+	default:
+		return fmt.Errorf("no grpc method for %s", endpoint)
+	}
+
+	key := grpcStreamKey{apiEndpoint: apiEndpoint, method: method, protocolVersion: protocolVersion, dynHeaderTags: dynHeaderTags}
+	stream, err := gf.stream(key)
+	if err != nil {
+		return err
+	}
+	return stream.send(ctx, raw)
+}
+
+// stream returns the open stream for the key, or opens a new one if there is none, or it has failed.
+func (gf *grpcForwarder) stream(key grpcStreamKey) (*grpcStream, error) {
+	gf.lock.Lock()
+	defer gf.lock.Unlock()
+
+	if stream, ok := gf.streams[key]; ok && !stream.closed() {
+		return stream, nil
+	}
+
+	conn, ok := gf.conns[key.apiEndpoint]
+	if !ok {
+		address, useTLS, err := grpcTarget(key.apiEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		dialOptions := append([]grpc.DialOption{}, gf.dialOptions...)
+		if useTLS {
+			tlsConfig := gf.tlsConfig
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		} else {
+			dialOptions = append(dialOptions, grpc.WithInsecure())
+		}
+		// Connects in the background, and reconnects when the connection is lost
+		conn, err = grpc.DialContext(gf.ctx, address, dialOptions...)
+		if err != nil {
+			return nil, err
+		}
+		gf.conns[key.apiEndpoint] = conn
+	}
+
+	md := metadata.New(nil)
+	for header, v := range gf.headers {
+		md.Set(header, v)
+	}
+	md.Set(pb.ProtocolVersionHeader, strconv.Itoa(key.protocolVersion))
+	for _, tv := range strings.Split(key.dynHeaderTags, ",") {
+		vs := strings.SplitN(tv, ":", 2)
+		if len(vs) > 1 {
+			md.Set(strings.ReplaceAll(vs[0], "_", "-"), vs[1])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(gf.ctx, md))
+	clientStream, err := conn.NewStream(ctx, grpcStreamDesc, key.method, gf.callOptions...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stream := &grpcStream{
+		stream:  clientStream,
+		cancel:  cancel,
+		pending: make(chan chan error, gf.maxInflight),
+		done:    make(chan struct{}),
+	}
+	go stream.receiveAcks(gf.logger.WithField("api-endpoint", key.apiEndpoint))
+	gf.streams[key] = stream
+	return stream, nil
+}
+
+// close closes every stream and connection.
+func (gf *grpcForwarder) close() {
+	gf.cancel()
+	gf.lock.Lock()
+	defer gf.lock.Unlock()
+	for _, conn := range gf.conns {
+		_ = conn.Close()
+	}
+}
+
+// grpcStream is a stream of payloads, which are acknowledged in the order they are sent.
+type grpcStream struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+
+	sendLock sync.Mutex      // Serializes sends, so acknowledgements are in the same order as pending
+	pending  chan chan error // The acknowledgements being waited for
+	done     chan struct{}   // Closed when the stream has failed
+	err      error           // Why the stream failed, only read after done is closed
+}
+
+func (gs *grpcStream) closed() bool {
+	select {
+	case <-gs.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (gs *grpcStream) send(ctx context.Context, raw []byte) error {
+	ack := make(chan error, 1)
+
+	gs.sendLock.Lock()
+	if gs.closed() {
+		gs.sendLock.Unlock()
+		return gs.err
+	}
+	select {
+	case gs.pending <- ack:
+	case <-gs.stream.Context().Done():
+		// The stream failed while there were too many payloads waiting for an acknowledgement
+		gs.sendLock.Unlock()
+		return errGrpcStreamClosed
+	}
+	err := gs.stream.SendMsg(raw)
+	gs.sendLock.Unlock()
+	if err != nil {
+		// The reason the stream failed is reported by RecvMsg, and sent to ack
+		gs.cancel()
+	}
+
+	select {
+	case err = <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// receiveAcks receives acknowledgements until the stream fails, then fails every send still waiting.
+func (gs *grpcStream) receiveAcks(logger logrus.FieldLogger) {
+	var err error
+	for {
+		var ack empty.Empty
+		if err = gs.stream.RecvMsg(&ack); err != nil {
+			break
+		}
+		select {
+		case pending := <-gs.pending:
+			pending <- nil
+		default:
+			err = errors.New("unexpected acknowledgement")
+		}
+		if err != nil {
+			break
+		}
+	}
+	gs.cancel()
+	logger.WithError(err).Debug("grpc stream closed")
+
+	gs.sendLock.Lock()
+	defer gs.sendLock.Unlock()
+	gs.err = fmt.Errorf("%v: %v", errGrpcStreamClosed, err)
+	close(gs.done)
+	for {
+		select {
+		case pending := <-gs.pending:
+			pending <- gs.err
+		default:
+			return
+		}
+	}
+}
+
+// preserializedCodec sends payloads which are already serialized as is, and unmarshals responses as protobuf.  Its
+// name is proto, so the server treats the payloads as protobuf.
+type preserializedCodec struct{}
+
+func (preserializedCodec) Marshal(v interface{}) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	return proto.Marshal(v.(proto.Message))
+}
+
+func (preserializedCodec) Unmarshal(data []byte, v interface{}) error {
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+func (preserializedCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,122 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// haPair divides the series between two servers receiving the same traffic, so each series is only sent to the
+// backends once per flush.  Each series is owned by one of the pair, decided by a hash of its name and tags, and each
+// server only sends the series it owns while its peer is healthy.  When the peer is not healthy, every series is sent,
+// so there is no gap in the metrics if either server fails.
+type haPair struct {
+	logger        logrus.FieldLogger
+	index         int    // 0 or 1, which half of the series this server owns
+	peerURL       string // The health endpoint of the peer
+	checkInterval time.Duration
+	client        *http.Client
+
+	peerUp  int32  // atomic - non-zero while the peer is healthy
+	skipped uint64 // atomic - series owned by the peer, and not sent
+}
+
+func newHAPair(logger logrus.FieldLogger, index int, peerURL string, checkInterval time.Duration) (*haPair, error) {
+	if index != 0 && index != 1 {
+		return nil, fmt.Errorf("ha-index must be 0 or 1")
+	}
+	if checkInterval <= 0 {
+		return nil, fmt.Errorf("ha-check-interval must be positive")
+	}
+	return &haPair{
+		logger:        logger.WithField("component", "ha"),
+		index:         index,
+		peerURL:       peerURL,
+		checkInterval: checkInterval,
+		client:        &http.Client{Timeout: checkInterval},
+	}, nil
+}
+
+// Run checks the health of the peer every check interval, until the context is done.  The peer is assumed to be down
+// until the first check succeeds, so nothing is missed while starting.
+func (ha *haPair) Run(ctx context.Context) {
+	clck := clock.FromContext(ctx)
+	ticker := clck.NewTicker(ha.checkInterval)
+	defer ticker.Stop()
+	for {
+		ha.setPeerUp(ha.checkPeer(ctx))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ha *haPair) checkPeer(ctx context.Context) bool {
+	req, err := http.NewRequest("GET", ha.peerURL, nil)
+	if err != nil {
+		ha.logger.WithError(err).Warn("invalid ha-peer-url")
+		return false
+	}
+	resp, err := ha.client.Do(req.WithContext(ctx))
+	if err != nil {
+		ha.logger.WithError(err).Debug("peer health check failed")
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (ha *haPair) setPeerUp(up bool) {
+	var value int32
+	if up {
+		value = 1
+	}
+	if atomic.SwapInt32(&ha.peerUp, value) != value {
+		if up {
+			ha.logger.Info("peer is healthy, sending only the series owned by this server")
+		} else {
+			ha.logger.Warn("peer is not healthy, sending every series")
+		}
+	}
+}
+
+// filter returns the series in mm which this server sends.  It returns mm if the peer is not healthy.
+func (ha *haPair) filter(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	if atomic.LoadInt32(&ha.peerUp) == 0 {
+		return mm
+	}
+	owned := mm.SplitByBucket(2, func(metricName string, tagsKey string) int {
+		return int(util.HashKey(metricName, tagsKey) % 2)
+	})[ha.index]
+	atomic.AddUint64(&ha.skipped, uint64(mm.Len()-owned.Len()))
+	return owned
+}
+
+// RunMetricsContext writes if the peer is healthy, and the series skipped since the last flush, every flush until the
+// context is done.
+func (ha *haPair) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("ha.peer.up", float64(atomic.LoadInt32(&ha.peerUp)), nil)
+			statser.Count("ha.series.skipped", float64(atomic.SwapUint64(&ha.skipped, 0)), nil)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestHAPairDividesSeries(t *testing.T) {
+	t.Parallel()
+	var healthy int32 = 1
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer peer.Close()
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 100; i++ {
+		mm.Receive(&gostatsd.Metric{Name: fmt.Sprintf("counter.%d", i), Value: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"a:b"}})
+		mm.Receive(&gostatsd.Metric{Name: "gauge", Value: 1, Type: gostatsd.GAUGE, Tags: gostatsd.Tags{fmt.Sprintf("i:%d", i)}})
+	}
+
+	_, err := newHAPair(logrus.New(), 2, peer.URL, time.Second)
+	require.Error(t, err)
+	var pair [2]*haPair
+	for i := range pair {
+		pair[i], err = newHAPair(logrus.New(), i, peer.URL, time.Second)
+		require.NoError(t, err)
+		// The peer is assumed to be down until it is checked
+		assert.Equal(t, mm, pair[i].filter(mm))
+		pair[i].setPeerUp(pair[i].checkPeer(context.Background()))
+	}
+
+	// Each series is sent by exactly one of the pair
+	first, second := pair[0].filter(mm), pair[1].filter(mm)
+	assert.NotZero(t, first.Len())
+	assert.NotZero(t, second.Len())
+	assert.Equal(t, mm.Len(), first.Len()+second.Len())
+	merged := gostatsd.NewMetricMap()
+	merged.Merge(first)
+	merged.Merge(second)
+	assert.Equal(t, mm.Len(), merged.Len())
+	assert.EqualValues(t, second.Len(), pair[0].skipped)
+
+	// Everything is sent while the peer is down
+	atomic.StoreInt32(&healthy, 0)
+	pair[0].setPeerUp(pair[0].checkPeer(context.Background()))
+	assert.Equal(t, mm, pair[0].filter(mm))
+}
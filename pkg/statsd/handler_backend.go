@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ash2k/stager/wait"
@@ -29,16 +30,25 @@ func (f AggregatorFactoryFunc) Create() Aggregator {
 
 // BackendEventHandler dispatches metrics and events to all configured backends (via Aggregators)
 type BackendHandler struct {
+	running uint32 // atomic - 1 while the workers are running
+
 	eventWg          sync.WaitGroup
-	backends         []gostatsd.Backend
+	backendsLock     sync.RWMutex
+	backends         []gostatsd.Backend // Replaced when the configuration is reloaded
+	eventRoutes      []*eventRoute      // Replaced when the configuration is reloaded
 	concurrentEvents chan struct{}
 
 	numWorkers int
 	workers    []*worker
+
+	batchSize  int           // Series accumulated for a worker before they are sent to it, or 0 to send them immediately
+	batchDelay time.Duration // Interval at which partial batches are sent, or 0 to only send them when full or flushed
 }
 
-// NewBackendHandler initialises a new Handler which sends metrics and events to all backends
-func NewBackendHandler(backends []gostatsd.Backend, maxConcurrentEvents uint, numWorkers int, perWorkerBufferSize int, af AggregatorFactory) *BackendHandler {
+// NewBackendHandler initialises a new Handler which sends metrics and events to all backends.  Metrics are accumulated
+// for each worker until there are batchSize series, or until the next batchDelay tick, so the workers receive fewer,
+// larger maps.  A batchSize of 1 or less sends every map as it is dispatched.
+func NewBackendHandler(backends []gostatsd.Backend, maxConcurrentEvents uint, numWorkers int, perWorkerBufferSize int, batchSize int, batchDelay time.Duration, af AggregatorFactory) *BackendHandler {
 	workers := make([]*worker, numWorkers)
 
 	for i := 0; i < numWorkers; i++ {
@@ -57,6 +67,9 @@ func NewBackendHandler(backends []gostatsd.Backend, maxConcurrentEvents uint, nu
 
 		numWorkers: numWorkers,
 		workers:    workers,
+
+		batchSize:  batchSize,
+		batchDelay: batchDelay,
 	}
 }
 
@@ -72,9 +85,45 @@ func (bh *BackendHandler) Run(ctx context.Context) {
 	for _, worker := range bh.workers {
 		wg.Start(worker.work)
 	}
+	atomic.StoreUint32(&bh.running, 1)
+	defer atomic.StoreUint32(&bh.running, 0)
 
-	// Work until asked to stop
-	<-ctx.Done()
+	if bh.batchSize <= 1 || bh.batchDelay <= 0 {
+		// Work until asked to stop
+		<-ctx.Done()
+		return
+	}
+
+	// Send partial batches, so metrics are not held back for long at low rates.  A batch waits at most two ticks.
+	ticker := time.NewTicker(bh.batchDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, w := range bh.workers {
+				if batch := w.takeBatch(); batch != nil {
+					bh.send(ctx, w, batch)
+				}
+			}
+		}
+	}
+}
+
+// CheckReady reports if the workers are running, and every backend which can report readiness is ready.
+func (bh *BackendHandler) CheckReady() error {
+	if atomic.LoadUint32(&bh.running) == 0 {
+		return fmt.Errorf("backend handler is not running")
+	}
+	for _, backend := range bh.currentBackends() {
+		if c, ok := backend.(gostatsd.ReadinessChecker); ok {
+			if err := c.CheckReady(); err != nil {
+				return fmt.Errorf("backend %s: %v", backend.Name(), err)
+			}
+		}
+	}
+	return nil
 }
 
 // RunMetricsContext pulls a Statser from the Context and invokes RunMetrics.  Allows a BackendHandler to still
@@ -114,6 +163,36 @@ func (bh *BackendHandler) RunMetrics(ctx context.Context, statser stats.Statser)
 		time.Second,
 	)
 	wg.StartWithContext(ctx, csw.Run)
+
+	// Starts the metrics for event routes
+	wg.Start(func() {
+		flushed, unregister := statser.RegisterFlush()
+		defer unregister()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-flushed:
+				bh.backendsLock.RLock()
+				routes := bh.eventRoutes
+				bh.backendsLock.RUnlock()
+				for _, route := range routes {
+					statser.Count("backend.events.routed", float64(atomic.SwapUint64(&route.matched, 0)), gostatsd.Tags{"route:" + route.name})
+				}
+			}
+		}
+	})
+}
+
+// Overloaded returns "aggregator_queue" while the queue of any aggregator is full, as dispatching to it blocks until
+// the aggregator catches up.
+func (bh *BackendHandler) Overloaded() string {
+	for _, w := range bh.workers {
+		if c := cap(w.metricMapQueue); c > 0 && len(w.metricMapQueue) >= c {
+			return "aggregator_queue"
+		}
+	}
+	return ""
 }
 
 // EstimatedTags returns a guess for how many tags to pre-allocate
@@ -121,18 +200,29 @@ func (bh *BackendHandler) EstimatedTags() int {
 	return 0
 }
 
-// DispatchMetricMap splits a MetricMap in to per-aggregator buckets and distributes it.
+// DispatchMetricMap splits a MetricMap in to per-aggregator buckets and distributes it, either immediately, or as part
+// of a batch.
 func (bh *BackendHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
 	maps := mm.Split(bh.numWorkers)
 
 	for aggrIdx, mmSplit := range maps {
-		if !mmSplit.IsEmpty() {
-			w := bh.workers[aggrIdx]
-			select {
-			case <-ctx.Done():
-			case w.metricMapQueue <- mmSplit:
+		if mmSplit.IsEmpty() {
+			continue
+		}
+		w := bh.workers[aggrIdx]
+		if bh.batchSize > 1 {
+			if mmSplit = w.addToBatch(mmSplit, bh.batchSize); mmSplit == nil {
+				continue
 			}
 		}
+		bh.send(ctx, w, mmSplit)
+	}
+}
+
+func (bh *BackendHandler) send(ctx context.Context, w *worker, mm *gostatsd.MetricMap) {
+	select {
+	case <-ctx.Done():
+	case w.metricMapQueue <- mm:
 	}
 }
 
@@ -163,12 +253,13 @@ loop:
 
 func (bh *BackendHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
 	eventsDispatched := 0
-	bh.eventWg.Add(len(bh.backends))
-	for _, backend := range bh.backends {
+	backends := bh.eventBackends(e)
+	bh.eventWg.Add(len(backends))
+	for _, backend := range backends {
 		select {
 		case <-ctx.Done():
 			// Not all backends got the event, should decrement the wg counter
-			bh.eventWg.Add(eventsDispatched - len(bh.backends))
+			bh.eventWg.Add(eventsDispatched - len(backends))
 			return
 		case bh.concurrentEvents <- struct{}{}:
 			// Creates a new context for dispatching the event.
@@ -183,6 +274,33 @@ func (bh *BackendHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event)
 	}
 }
 
+// SetBackends replaces the backends events are sent to.  Events already being sent are sent to the previous backends.
+func (bh *BackendHandler) SetBackends(backends []gostatsd.Backend) {
+	bh.backendsLock.Lock()
+	defer bh.backendsLock.Unlock()
+	bh.backends = backends
+}
+
+// SetEventRoutes replaces the routes which decide the backends each event is sent to.
+func (bh *BackendHandler) SetEventRoutes(routes []*eventRoute) {
+	bh.backendsLock.Lock()
+	defer bh.backendsLock.Unlock()
+	bh.eventRoutes = routes
+}
+
+// eventBackends returns the backends the event is routed to.
+func (bh *BackendHandler) eventBackends(e *gostatsd.Event) []gostatsd.Backend {
+	bh.backendsLock.RLock()
+	defer bh.backendsLock.RUnlock()
+	return routeEvent(bh.eventRoutes, bh.backends, e)
+}
+
+func (bh *BackendHandler) currentBackends() []gostatsd.Backend {
+	bh.backendsLock.RLock()
+	defer bh.backendsLock.RUnlock()
+	return bh.backends
+}
+
 // WaitForEvents waits for all event-dispatching goroutines to finish.
 func (bh *BackendHandler) WaitForEvents() {
 	bh.eventWg.Wait()
@@ -0,0 +1,131 @@
+package statsd
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+// InspectAggregators returns a summary of the contents of every aggregator.  It runs on the goroutine of each
+// aggregator, so it is delayed by aggregators which are busy.
+func (bh *BackendHandler) InspectAggregators(ctx context.Context, top int, metricName string) (*web.AggregatorState, error) {
+	var lock sync.Mutex
+	state := &web.AggregatorState{
+		Series: map[string]int{},
+	}
+	topSeries := &seriesHeap{}
+	metricSeries := map[web.MetricState]int{}
+
+	wait := bh.Process(ctx, func(aggrId int, aggr Aggregator) {
+		lock.Lock()
+		state.Aggregators++
+		lock.Unlock()
+		aggr.Process(func(mm *gostatsd.MetricMap) {
+			lock.Lock()
+			defer lock.Unlock()
+			// value is only called for the requested metric, as it copies the values
+			add := func(typ, name string, source gostatsd.Source, tags gostatsd.Tags, samples int, value func() interface{}) {
+				state.Series[typ]++
+				metricSeries[web.MetricState{Type: typ, Name: name}]++
+				isTop := top > 0 && (topSeries.Len() < top || (*topSeries)[0].Samples < samples)
+				if !isTop && name != metricName {
+					return
+				}
+				// Tags are copied, as the aggregator owns them and they are read after it continues
+				series := web.SeriesState{
+					Type:    typ,
+					Name:    name,
+					Source:  source,
+					Tags:    tags.Copy(),
+					Samples: samples,
+				}
+				if isTop {
+					heap.Push(topSeries, series)
+					if topSeries.Len() > top {
+						heap.Pop(topSeries)
+					}
+				}
+				if name == metricName {
+					series.Value = value()
+					state.Metric = append(state.Metric, series)
+				}
+			}
+			mm.Counters.Each(func(name, _ string, c gostatsd.Counter) {
+				add("counter", name, c.Source, c.Tags, 1, func() interface{} { return c.Value })
+			})
+			mm.Gauges.Each(func(name, _ string, g gostatsd.Gauge) {
+				add("gauge", name, g.Source, g.Tags, 1, func() interface{} { return g.Value })
+			})
+			mm.Timers.Each(func(name, _ string, t gostatsd.Timer) {
+				add("timer", name, t.Source, t.Tags, len(t.Values), func() interface{} {
+					return append([]float64(nil), t.Values...)
+				})
+			})
+			mm.Sets.Each(func(name, _ string, s gostatsd.Set) {
+				add("set", name, s.Source, s.Tags, len(s.Values), func() interface{} {
+					values := make([]string, 0, len(s.Values))
+					for value := range s.Values {
+						values = append(values, value)
+					}
+					sort.Strings(values)
+					return values
+				})
+			})
+		})
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
+	if state.Aggregators < bh.numWorkers {
+		// The context was cancelled before every aggregator was asked
+		return nil, context.Canceled
+	}
+
+	state.TopSeries = make([]web.SeriesState, topSeries.Len())
+	for idx := len(state.TopSeries) - 1; idx >= 0; idx-- {
+		state.TopSeries[idx] = heap.Pop(topSeries).(web.SeriesState)
+	}
+
+	state.TopMetrics = make([]web.MetricState, 0, len(metricSeries))
+	for metric, series := range metricSeries {
+		metric.Series = series
+		state.TopMetrics = append(state.TopMetrics, metric)
+	}
+	sort.Slice(state.TopMetrics, func(i, j int) bool {
+		a, b := state.TopMetrics[i], state.TopMetrics[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		return a.Name < b.Name
+	})
+	if len(state.TopMetrics) > top {
+		state.TopMetrics = state.TopMetrics[:top]
+	}
+	return state, nil
+}
+
+// seriesHeap is a min-heap of series by samples, used to find the largest series.
+type seriesHeap []web.SeriesState
+
+func (sh seriesHeap) Len() int            { return len(sh) }
+func (sh seriesHeap) Less(i, j int) bool  { return sh[i].Samples < sh[j].Samples }
+func (sh seriesHeap) Swap(i, j int)       { sh[i], sh[j] = sh[j], sh[i] }
+func (sh *seriesHeap) Push(x interface{}) { *sh = append(*sh, x.(web.SeriesState)) }
+func (sh *seriesHeap) Pop() interface{} {
+	old := *sh
+	x := old[len(old)-1]
+	*sh = old[:len(old)-1]
+	return x
+}
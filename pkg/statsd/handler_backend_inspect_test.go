@@ -0,0 +1,70 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+func TestBackendHandlerInspectAggregators(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// perWorkerBufferSize is 0, so every map has been received by an aggregator before it is inspected
+	h := NewBackendHandler(nil, 0, 2, 0, 0, 0, AggregatorFactoryFunc(func() Aggregator {
+		return newFakeAggregator()
+	}))
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, h.Run)
+
+	mm := gostatsd.NewMetricMap()
+	for _, host := range []gostatsd.Source{"a", "b", "c"} {
+		mm.Receive(&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Tags: gostatsd.Tags{"env:prod"}, Source: host, Type: gostatsd.COUNTER})
+	}
+	for _, value := range []float64{3, 1, 2} {
+		mm.Receive(&gostatsd.Metric{Name: "latency", Value: value, Rate: 1, Type: gostatsd.TIMER})
+	}
+	mm.Receive(&gostatsd.Metric{Name: "users", StringValue: "bob", Rate: 1, Type: gostatsd.SET})
+	mm.Receive(&gostatsd.Metric{Name: "users", StringValue: "alice", Rate: 1, Type: gostatsd.SET})
+	h.DispatchMetricMap(ctx, mm)
+
+	state, err := h.InspectAggregators(ctx, 2, "requests")
+	require.NoError(t, err)
+	assert.Equal(t, 2, state.Aggregators)
+	assert.Equal(t, map[string]int{"counter": 3, "timer": 1, "set": 1}, state.Series)
+
+	require.Len(t, state.TopSeries, 2)
+	assert.Equal(t, web.SeriesState{Type: "timer", Name: "latency", Samples: 3}, state.TopSeries[0])
+	assert.Equal(t, web.SeriesState{Type: "set", Name: "users", Samples: 2}, state.TopSeries[1])
+
+	assert.Equal(t, []web.MetricState{
+		{Type: "counter", Name: "requests", Series: 3},
+		{Type: "timer", Name: "latency", Series: 1},
+	}, state.TopMetrics)
+
+	require.Len(t, state.Metric, 3)
+	for _, series := range state.Metric {
+		assert.Equal(t, "requests", series.Name)
+		assert.Equal(t, gostatsd.Tags{"env:prod"}, series.Tags)
+		assert.EqualValues(t, 1, series.Value)
+	}
+}
+
+func TestBackendHandlerInspectAggregatorsCancelled(t *testing.T) {
+	t.Parallel()
+	h := NewBackendHandler(nil, 0, 1, 0, 0, 0, newTestFactory())
+	cancelledCtx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+	// BackendHandler.Run is never called, so the aggregators are never asked
+	_, err := h.InspectAggregators(cancelledCtx, 10, "")
+	assert.Equal(t, context.Canceled, err)
+}
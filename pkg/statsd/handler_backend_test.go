@@ -49,10 +49,11 @@ func (a *testAggregator) Process(f ProcessFunc) {
 	f(&a.MetricMap)
 }
 
-func (a *testAggregator) Reset() {
+func (a *testAggregator) Snapshot() *gostatsd.MetricMap {
 	a.af.Mutex.Lock()
 	defer a.af.Mutex.Unlock()
 	a.af.resetInvocations[a.agrNumber]++
+	return &a.MetricMap
 }
 
 type testAggregatorFactory struct {
@@ -101,14 +102,14 @@ func TestNewBackendHandlerShouldCreateCorrectNumberOfWorkers(t *testing.T) {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	n := r.Intn(5) + 1
 	factory := newTestFactory()
-	h := NewBackendHandler(nil, 0, n, 1, factory)
+	h := NewBackendHandler(nil, 0, n, 1, 0, 0, factory)
 	assert.Equal(t, n, len(h.workers))
 	assert.Equal(t, n, factory.numAgrs)
 }
 
 func TestRunShouldReturnWhenContextCancelled(t *testing.T) {
 	t.Parallel()
-	h := NewBackendHandler(nil, 0, 5, 1, newTestFactory())
+	h := NewBackendHandler(nil, 0, 5, 1, 0, 0, newTestFactory())
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	cancelFunc()
 	h.Run(ctx)
@@ -120,7 +121,7 @@ func TestDispatchMetricMapShouldDistributeMetrics(t *testing.T) {
 	numAggregators := r.Intn(5) + 1
 	factory := newTestFactory()
 	// use a sync channel (perWorkerBufferSize = 0) to force the workers to process events before the context is cancelled
-	h := NewBackendHandler(nil, 0, numAggregators, 0, factory)
+	h := NewBackendHandler(nil, 0, numAggregators, 0, 0, 0, factory)
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 	var wgFinish wait.Group
@@ -158,7 +159,7 @@ func TestDispatchMetricMapShouldDistributeMetrics(t *testing.T) {
 
 func TestBackendHandlerDispatchMetricMapTerminates(t *testing.T) {
 	t.Parallel()
-	h := NewBackendHandler(nil, 0, 1, 0, newTestFactory())
+	h := NewBackendHandler(nil, 0, 1, 0, 0, 0, newTestFactory())
 	cancelledCtx, cancelFunc := context.WithCancel(context.Background())
 	cancelFunc()
 	mm := gostatsd.NewMetricMap()
@@ -176,7 +177,7 @@ func TestBackendHandlerDispatchMetricMapTerminates(t *testing.T) {
 
 func TestBackendHandlerProcessTerminates(t *testing.T) {
 	t.Parallel()
-	h := NewBackendHandler(nil, 0, 1, 0, newTestFactory())
+	h := NewBackendHandler(nil, 0, 1, 0, 0, 0, newTestFactory())
 	cancelledCtx, cancelFunc := context.WithCancel(context.Background())
 	cancelFunc()
 	// perWorkerBufferSize is 0 (blocking channel), and we never call BackendHandler.Run, so we can be sure to
@@ -184,3 +185,57 @@ func TestBackendHandlerProcessTerminates(t *testing.T) {
 	waitFunc := h.Process(cancelledCtx, nil)
 	waitFunc()
 }
+
+func TestDispatchMetricMapBatches(t *testing.T) {
+	t.Parallel()
+	factory := newTestFactory()
+	h := NewBackendHandler(nil, 0, 1, 10, 3, 0, factory)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	dispatch := func(name string) {
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+		h.DispatchMetricMap(ctx, mm)
+	}
+
+	// The batch is sent when it has batchSize series
+	dispatch("a")
+	dispatch("b")
+	assert.Len(t, h.workers[0].metricMapQueue, 0)
+	dispatch("c")
+	assert.Len(t, h.workers[0].metricMapQueue, 1)
+	assert.Equal(t, 3, (<-h.workers[0].metricMapQueue).Len())
+
+	// A partial batch is received before a process command
+	dispatch("d")
+	var wg wait.Group
+	wg.StartWithContext(ctx, h.Run)
+	h.Process(ctx, func(int, Aggregator) {})()
+	cancelFunc()
+	wg.Wait()
+	assert.Len(t, h.workers[0].metricMapQueue, 0)
+	assert.Equal(t, 1, factory.receiveMapInvocations[0])
+}
+
+func TestBackendHandlerSendsPartialBatches(t *testing.T) {
+	t.Parallel()
+	factory := newTestFactory()
+	h := NewBackendHandler(nil, 0, 1, 10, 100, time.Millisecond, factory)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+	h.DispatchMetricMap(ctx, mm)
+
+	var wg wait.Group
+	wg.StartWithContext(ctx, h.Run)
+	assert.Eventually(t, func() bool {
+		factory.Lock()
+		defer factory.Unlock()
+		return factory.receiveMapInvocations[0] == 1
+	}, time.Second, time.Millisecond)
+	cancelFunc()
+	wg.Wait()
+}
@@ -25,30 +25,33 @@ type CloudHandler struct {
 
 	cachedInstances gostatsd.CachedInstances
 	handler         gostatsd.PipelineHandler
-	incomingMetrics chan []*gostatsd.Metric
+	incomingMetrics chan map[gostatsd.Source]*gostatsd.MetricMap
 	incomingEvents  chan *gostatsd.Event
 
 	// emitChan triggers a write of all the current stats when it is given a Statser
 	emitChan        chan stats.Statser
 	awaitingEvents  map[gostatsd.Source][]*gostatsd.Event
-	awaitingMetrics map[gostatsd.Source][]*gostatsd.Metric
+	awaitingMetrics map[gostatsd.Source]*gostatsd.MetricMap
 	toLookupIPs     []gostatsd.Source
 	wg              sync.WaitGroup
 
 	estimatedTags int
+	stripZone     bool
 }
 
-// NewCloudHandler initialises a new cloud handler.
-func NewCloudHandler(cachedInstances gostatsd.CachedInstances, handler gostatsd.PipelineHandler) *CloudHandler {
+// NewCloudHandler initialises a new cloud handler.  If stripZone is true, the zone of IPv6 sources is ignored when
+// looking up instances.
+func NewCloudHandler(cachedInstances gostatsd.CachedInstances, handler gostatsd.PipelineHandler, stripZone bool) *CloudHandler {
 	return &CloudHandler{
 		cachedInstances: cachedInstances,
 		handler:         handler,
-		incomingMetrics: make(chan []*gostatsd.Metric),
+		incomingMetrics: make(chan map[gostatsd.Source]*gostatsd.MetricMap),
 		incomingEvents:  make(chan *gostatsd.Event),
 		emitChan:        make(chan stats.Statser),
 		awaitingEvents:  make(map[gostatsd.Source][]*gostatsd.Event),
-		awaitingMetrics: make(map[gostatsd.Source][]*gostatsd.Metric),
+		awaitingMetrics: make(map[gostatsd.Source]*gostatsd.MetricMap),
 		estimatedTags:   handler.EstimatedTags() + cachedInstances.EstimatedTags(),
+		stripZone:       stripZone,
 	}
 }
 
@@ -57,15 +60,28 @@ func (ch *CloudHandler) EstimatedTags() int {
 	return ch.estimatedTags
 }
 
-func (ch *CloudHandler) processMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+// DispatchMetricMap splits the MetricMap by source, and dispatches the metrics of every source which is in the
+// cache immediately.  Metrics from sources which are not in the cache are queued until the lookup completes.
+func (ch *CloudHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
 	mmToDispatch := gostatsd.NewMetricMap()
-	var toHandle []*gostatsd.Metric
-	for _, m := range metrics {
-		if ch.updateTagsAndHostname(m, m.Source) {
-			mmToDispatch.Receive(m)
-		} else {
-			toHandle = append(toHandle, m)
+	var toHandle map[gostatsd.Source]*gostatsd.MetricMap
+	for source, mmSource := range mm.SplitBySource() {
+		ip := gostatsd.NormalizeSource(source, ch.stripZone)
+		instance, cacheHit := ch.getInstance(ip)
+		if !cacheHit {
+			if toHandle == nil {
+				toHandle = make(map[gostatsd.Source]*gostatsd.MetricMap)
+			}
+			if queue, ok := toHandle[ip]; ok {
+				// Different forms of the same IP
+				queue.Merge(mmSource)
+			} else {
+				toHandle[ip] = mmSource
+			}
+			continue
 		}
+		updateInplace(mmSource, ip, instance)
+		mmToDispatch.Merge(mmSource)
 	}
 
 	if !mmToDispatch.IsEmpty() {
@@ -80,14 +96,6 @@ func (ch *CloudHandler) processMetrics(ctx context.Context, metrics []*gostatsd.
 	}
 }
 
-// DispatchMetricMap re-dispatches a MetricMap through CloudHandler.processMetrics
-// TODO: This is inefficient, and should be handled first class, however that is a major re-factor of
-//  the CloudHandler.  It is also recommended to not use a CloudHandler in an http receiver based
-//  service, as the IP is not propagated.
-func (ch *CloudHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
-	ch.processMetrics(ctx, mm.AsMetrics())
-}
-
 func (ch *CloudHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
 	if ch.updateTagsAndHostname(e, e.Source) {
 		ch.handler.DispatchEvent(ctx, e)
@@ -192,12 +200,12 @@ func (ch *CloudHandler) Run(ctx context.Context) {
 }
 
 func (ch *CloudHandler) handleInstanceInfo(ctx context.Context, info gostatsd.InstanceInfo) {
-	metrics := ch.awaitingMetrics[info.IP]
-	if len(metrics) > 0 {
+	mm := ch.awaitingMetrics[info.IP]
+	if mm != nil {
 		delete(ch.awaitingMetrics, info.IP)
-		ch.statsMetricItemsQueued -= uint64(len(metrics))
+		ch.statsMetricItemsQueued -= uint64(mm.Len())
 		ch.statsMetricHostsQueued--
-		go ch.updateAndDispatchMetrics(ctx, info.Instance, metrics)
+		go ch.updateAndDispatchMetrics(ctx, info.IP, info.Instance, mm)
 	}
 	events := ch.awaitingEvents[info.IP]
 	if len(events) > 0 {
@@ -208,36 +216,36 @@ func (ch *CloudHandler) handleInstanceInfo(ctx context.Context, info gostatsd.In
 	}
 }
 
-func (ch *CloudHandler) handleIncomingMetrics(metrics []*gostatsd.Metric) {
-	for _, m := range metrics {
-		queue := ch.awaitingMetrics[m.Source]
-		ch.awaitingMetrics[m.Source] = append(queue, m)
-		if len(queue) == 0 && len(ch.awaitingEvents[m.Source]) == 0 {
-			// This is the first metric for that IP in the queue. Need to fetch an Instance for this IP.
-			ch.toLookupIPs = append(ch.toLookupIPs, m.Source)
-			ch.statsMetricHostsQueued++
+func (ch *CloudHandler) handleIncomingMetrics(mms map[gostatsd.Source]*gostatsd.MetricMap) {
+	for source, mm := range mms {
+		ch.statsMetricItemsQueued += uint64(mm.Len())
+		if queue, ok := ch.awaitingMetrics[source]; ok {
+			queue.Merge(mm)
+			continue
+		}
+		ch.awaitingMetrics[source] = mm
+		ch.statsMetricHostsQueued++
+		if len(ch.awaitingEvents[source]) == 0 {
+			// This is the first item for that IP in the queue. Need to fetch an Instance for this IP.
+			ch.toLookupIPs = append(ch.toLookupIPs, source)
 		}
 	}
-	ch.statsMetricItemsQueued += uint64(len(metrics))
 }
 
 func (ch *CloudHandler) handleIncomingEvent(e *gostatsd.Event) {
-	queue := ch.awaitingEvents[e.Source]
-	ch.awaitingEvents[e.Source] = append(queue, e)
-	if len(queue) == 0 && len(ch.awaitingMetrics[e.Source]) == 0 {
+	ip := gostatsd.NormalizeSource(e.Source, ch.stripZone)
+	queue := ch.awaitingEvents[ip]
+	ch.awaitingEvents[ip] = append(queue, e)
+	if len(queue) == 0 && ch.awaitingMetrics[ip] == nil {
 		// This is the first event for that IP in the queue. Need to fetch an Instance for this IP.
-		ch.toLookupIPs = append(ch.toLookupIPs, e.Source)
+		ch.toLookupIPs = append(ch.toLookupIPs, ip)
 		ch.statsEventHostsQueued++
 	}
 	ch.statsEventItemsQueued++
 }
 
-func (ch *CloudHandler) updateAndDispatchMetrics(ctx context.Context, instance *gostatsd.Instance, metrics []*gostatsd.Metric) {
-	mm := gostatsd.NewMetricMap()
-	for _, m := range metrics {
-		updateInplace(m, instance)
-		mm.Receive(m)
-	}
+func (ch *CloudHandler) updateAndDispatchMetrics(ctx context.Context, source gostatsd.Source, instance *gostatsd.Instance, mm *gostatsd.MetricMap) {
+	updateInplace(mm, source, instance)
 	ch.handler.DispatchMetricMap(ctx, mm)
 }
 
@@ -247,20 +255,21 @@ func (ch *CloudHandler) updateAndDispatchEvents(ctx context.Context, instance *g
 		ch.wg.Add(-dispatched)
 	}()
 	for _, e := range events {
-		updateInplace(e, instance)
+		updateInplace(e, e.Source, instance)
 		dispatched++
 		ch.handler.DispatchEvent(ctx, e)
 	}
 }
 
 func (ch *CloudHandler) updateTagsAndHostname(obj TagChanger, source gostatsd.Source) bool /*is a cache hit*/ {
-	instance, cacheHit := ch.getInstance(source)
+	instance, cacheHit := ch.getInstance(gostatsd.NormalizeSource(source, ch.stripZone))
 	if cacheHit {
-		updateInplace(obj, instance)
+		updateInplace(obj, source, instance)
 	}
 	return cacheHit
 }
 
+// getInstance looks up the instance of a normalized IP.
 func (ch *CloudHandler) getInstance(ip gostatsd.Source) (*gostatsd.Instance, bool /*is a cache hit*/) {
 	if ip == gostatsd.UnknownSource {
 		return nil, true
@@ -274,8 +283,12 @@ func (ch *CloudHandler) getInstance(ip gostatsd.Source) (*gostatsd.Instance, boo
 	return instance, true
 }
 
-func updateInplace(obj TagChanger, instance *gostatsd.Instance) {
+// updateInplace adds the tags and sets the source of the instance.  If the source is a container which was not found,
+// the source is cleared, as it is not a host.
+func updateInplace(obj TagChanger, source gostatsd.Source, instance *gostatsd.Instance) {
 	if instance != nil { // It was a positive cache hit (successful lookup cache, not failed lookup cache)
 		obj.AddTagsSetSource(instance.Tags, instance.ID)
+	} else if _, ok := source.ContainerID(); ok {
+		obj.AddTagsSetSource(nil, gostatsd.UnknownSource)
 	}
 }
@@ -30,7 +30,7 @@ func BenchmarkCloudHandlerDispatchMetricMap(b *testing.B) {
 		CacheTTL:                  500 * time.Millisecond,
 		CacheNegativeTTL:          500 * time.Millisecond,
 	})
-	ch := NewCloudHandler(ci, nh)
+	ch := NewCloudHandler(ci, nh, false)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -68,7 +68,7 @@ func TestTransientInstanceFailure(t *testing.T) {
 		CacheTTL:                  1 * time.Millisecond,
 		CacheNegativeTTL:          1 * time.Millisecond,
 	})
-	ch := NewCloudHandler(ci, expecting)
+	ch := NewCloudHandler(ci, expecting, false)
 
 	// t+0: instance is queried, goes in cache
 	// t+50ms: instance refreshed (failure)
@@ -202,6 +202,173 @@ func TestCloudHandlerFailingProvider(t *testing.T) {
 	doCheck(t, fp, sm1(), se1(), sm2(), se2(), fp.IPs, expectedIps, expectedMetrics, expectedEvents)
 }
 
+// fakeCachedInstances serves instances from a fixed cache, and exposes the lookups so a test can answer them.
+type fakeCachedInstances struct {
+	cache      map[gostatsd.Source]*gostatsd.Instance
+	ipSink     chan gostatsd.Source
+	infoSource chan gostatsd.InstanceInfo
+}
+
+func newFakeCachedInstances(cache map[gostatsd.Source]*gostatsd.Instance) *fakeCachedInstances {
+	return &fakeCachedInstances{
+		cache:      cache,
+		ipSink:     make(chan gostatsd.Source, 10),
+		infoSource: make(chan gostatsd.InstanceInfo),
+	}
+}
+
+func (fci *fakeCachedInstances) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool /*is a cache hit*/) {
+	instance, ok := fci.cache[ip]
+	return instance, ok
+}
+
+func (fci *fakeCachedInstances) IpSink() chan<- gostatsd.Source {
+	return fci.ipSink
+}
+
+func (fci *fakeCachedInstances) InfoSource() <-chan gostatsd.InstanceInfo {
+	return fci.infoSource
+}
+
+func (fci *fakeCachedInstances) EstimatedTags() int {
+	return 0
+}
+
+func counterFrom(name string, source gostatsd.Source, tags ...string) *gostatsd.Metric {
+	return &gostatsd.Metric{
+		Name:   name,
+		Value:  1,
+		Rate:   1,
+		Tags:   tags,
+		Source: source,
+		Type:   gostatsd.COUNTER,
+	}
+}
+
+func requireMetrics(t *testing.T, expected []*gostatsd.Metric, mm *gostatsd.MetricMap) {
+	actual := mm.AsMetrics()
+	for _, m := range expected {
+		m.FormatTagsKey()
+	}
+	sort.Slice(expected, fixtures.SortCompare(expected))
+	sort.Slice(actual, fixtures.SortCompare(actual))
+	require.Equal(t, expected, actual)
+}
+
+func TestCloudHandlerDispatchCachedAndUncachedSources(t *testing.T) {
+	t.Parallel()
+	fci := newFakeCachedInstances(map[gostatsd.Source]*gostatsd.Instance{
+		"1.2.3.4": {ID: "i-1", Tags: gostatsd.Tags{"region:a"}},
+	})
+	expecting := &expectingHandler{}
+	ch := NewCloudHandler(fci, expecting, false)
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wg.StartWithContext(ctx, ch.Run)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(counterFrom("cached", "1.2.3.4", "a1"))
+	mm.Receive(counterFrom("uncached", "5.6.7.8", "a2"))
+
+	// The metrics of the cached source are dispatched immediately
+	expecting.Expect(1, 0)
+	ch.DispatchMetricMap(ctx, mm)
+	expecting.WaitAll()
+	require.Len(t, expecting.MetricMaps(), 1)
+	requireMetrics(t, []*gostatsd.Metric{
+		counterFrom("cached", "i-1", "a1", "region:a"),
+	}, expecting.MetricMaps()[0])
+
+	// The metrics of the uncached source are dispatched once it is looked up
+	require.Equal(t, gostatsd.Source("5.6.7.8"), <-fci.ipSink)
+	expecting.Expect(1, 0)
+	fci.infoSource <- gostatsd.InstanceInfo{
+		IP:       "5.6.7.8",
+		Instance: &gostatsd.Instance{ID: "i-2", Tags: gostatsd.Tags{"region:b"}},
+	}
+	expecting.WaitAll()
+	require.Len(t, expecting.MetricMaps(), 2)
+	requireMetrics(t, []*gostatsd.Metric{
+		counterFrom("uncached", "i-2", "a2", "region:b"),
+	}, expecting.MetricMaps()[1])
+}
+
+func TestCloudHandlerDispatchMergesNormalizedSources(t *testing.T) {
+	t.Parallel()
+	fci := newFakeCachedInstances(map[gostatsd.Source]*gostatsd.Instance{})
+	expecting := &expectingHandler{}
+	ch := NewCloudHandler(fci, expecting, false)
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wg.StartWithContext(ctx, ch.Run)
+
+	// Both forms of the address are looked up once, and dispatched together
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(counterFrom("c1", "10.0.0.1", "a1"))
+	mm.Receive(counterFrom("c2", "::ffff:10.0.0.1", "a2"))
+	ch.DispatchMetricMap(ctx, mm)
+
+	require.Equal(t, gostatsd.Source("10.0.0.1"), <-fci.ipSink)
+	expecting.Expect(1, 0)
+	fci.infoSource <- gostatsd.InstanceInfo{
+		IP:       "10.0.0.1",
+		Instance: &gostatsd.Instance{ID: "i-1", Tags: gostatsd.Tags{"region:a"}},
+	}
+	expecting.WaitAll()
+	require.Empty(t, fci.ipSink)
+	require.Len(t, expecting.MetricMaps(), 1)
+	requireMetrics(t, []*gostatsd.Metric{
+		counterFrom("c1", "i-1", "a1", "region:a"),
+		counterFrom("c2", "i-1", "a2", "region:a"),
+	}, expecting.MetricMaps()[0])
+}
+
+func TestCloudHandlerClearsUnresolvedContainerSource(t *testing.T) {
+	t.Parallel()
+	// The first container is known not to be found, and the second is looked up
+	fci := newFakeCachedInstances(map[gostatsd.Source]*gostatsd.Instance{
+		gostatsd.ContainerSource("c1"): nil,
+	})
+	expecting := &expectingHandler{}
+	ch := NewCloudHandler(fci, expecting, false)
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wg.StartWithContext(ctx, ch.Run)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(counterFrom("cached", gostatsd.ContainerSource("c1"), "a1"))
+	mm.Receive(counterFrom("uncached", gostatsd.ContainerSource("c2"), "a2"))
+	expecting.Expect(1, 1)
+	ch.DispatchMetricMap(ctx, mm)
+	ch.DispatchEvent(ctx, &gostatsd.Event{Title: "deploy", Source: gostatsd.ContainerSource("c1")})
+	expecting.WaitAll()
+
+	require.Equal(t, gostatsd.ContainerSource("c2"), <-fci.ipSink)
+	expecting.Expect(1, 0)
+	fci.infoSource <- gostatsd.InstanceInfo{IP: gostatsd.ContainerSource("c2")}
+	expecting.WaitAll()
+
+	// Neither container is sent on as the host
+	require.Len(t, expecting.MetricMaps(), 2)
+	requireMetrics(t, []*gostatsd.Metric{
+		counterFrom("cached", gostatsd.UnknownSource, "a1"),
+	}, expecting.MetricMaps()[0])
+	requireMetrics(t, []*gostatsd.Metric{
+		counterFrom("uncached", gostatsd.UnknownSource, "a2"),
+	}, expecting.MetricMaps()[1])
+	require.Len(t, expecting.Events(), 1)
+	assert.Equal(t, gostatsd.UnknownSource, expecting.Events()[0].Source)
+}
+
 func doCheck(
 	t *testing.T,
 	cloud CountingProvider,
@@ -221,7 +388,7 @@ func doCheck(
 		CacheTTL:                  gostatsd.DefaultCacheTTL,
 		CacheNegativeTTL:          gostatsd.DefaultCacheNegativeTTL,
 	})
-	ch := NewCloudHandler(ci, expecting)
+	ch := NewCloudHandler(ci, expecting, false)
 
 	var wg wait.Group
 	defer wg.Wait()
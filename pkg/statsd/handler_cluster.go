@@ -0,0 +1,152 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/transport"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+// ClusterHandler divides the series between the members of a cluster of servers, so aggregation can scale beyond one
+// server.  Each series is owned by one member, chosen by a consistent hash of its name and tags, and a member only
+// aggregates the series it owns.  The series owned by other members are forwarded to them, with the same protocol as
+// forwarder mode, and the member which receives them sends them to its local handler, so they are not tagged, or
+// divided between the members, again.
+type ClusterHandler struct {
+	forwarded uint64 // atomic - series forwarded to other members
+
+	local   gostatsd.PipelineHandler
+	members []string
+	self    int                       // The index of this server in members
+	ring    *hashRing                 // Shards series between members
+	peers   []*HttpForwarderHandlerV2 // Sends to each member, nil for this server
+}
+
+// NewClusterHandlerFromViper returns a ClusterHandler for the members in cluster-members, which sends the series this
+// server owns to local, or nil if clustering is not enabled.  Series are forwarded with the settings in the cluster
+// section, which are the same as the http-transport section.
+func NewClusterHandlerFromViper(logger logrus.FieldLogger, v *viper.Viper, local gostatsd.PipelineHandler, pool *transport.TransportPool) (*ClusterHandler, error) {
+	members := v.GetStringSlice(gostatsd.ParamClusterMembers)
+	if len(members) == 0 {
+		return nil, nil
+	}
+	self := v.GetString(gostatsd.ParamClusterSelf)
+	ch := &ClusterHandler{
+		local:   local,
+		members: members,
+		self:    -1,
+		ring:    newHashRing(members),
+		peers:   make([]*HttpForwarderHandlerV2, len(members)),
+	}
+	subViper := util.GetSubViper(v, "cluster")
+	for i, member := range members {
+		if member == self {
+			if ch.self >= 0 {
+				return nil, fmt.Errorf("%s contains %s more than once", gostatsd.ParamClusterMembers, self)
+			}
+			ch.self = i
+			continue
+		}
+		peer, err := newHttpForwarderHandlerV2FromSubViper(logger.WithField("member", member), v, subViper, []string{member}, pool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create forwarder to cluster member %s: %v", member, err)
+		}
+		// The owner sends the series straight to its local handler, as they are not divided again
+		peer.headers[web.ClusterForwardedHeader] = "true"
+		ch.peers[i] = peer
+	}
+	if ch.self < 0 {
+		return nil, fmt.Errorf("%s %q is not one of the %s", gostatsd.ParamClusterSelf, self, gostatsd.ParamClusterMembers)
+	}
+	return ch, nil
+}
+
+// Run runs the forwarders to the other members until the context is done.
+func (ch *ClusterHandler) Run(ctx context.Context) {
+	var wg wait.Group
+	defer wg.Wait()
+	for _, peer := range ch.peers {
+		if peer != nil {
+			wg.StartWithContext(ctx, peer.Run)
+			wg.StartWithContext(ctx, peer.RunMetricsContext)
+		}
+	}
+	ch.RunMetricsContext(ctx)
+}
+
+// RunMetricsContext writes the number of series forwarded since the last flush, every flush until the context is done.
+func (ch *ClusterHandler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Count("cluster.forwarded", float64(atomic.SwapUint64(&ch.forwarded, 0)), nil)
+		}
+	}
+}
+
+// LocalHandler returns the handler of the series owned by this server, which series forwarded by other members are
+// sent to.
+func (ch *ClusterHandler) LocalHandler() gostatsd.PipelineHandler {
+	return ch.local
+}
+
+// EstimatedTags returns the estimate of the local handler.
+func (ch *ClusterHandler) EstimatedTags() int {
+	return ch.local.EstimatedTags()
+}
+
+// DispatchMetricMap sends the series owned by this server to the local handler, and forwards the rest to their owners.
+func (ch *ClusterHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mms := mm.SplitByBucket(len(ch.members), func(metricName string, tagsKey string) int {
+		return ch.ring.get(metricName, tagsKey)
+	})
+	for i, mmMember := range mms {
+		if mmMember.IsEmpty() {
+			continue
+		}
+		if i == ch.self {
+			ch.local.DispatchMetricMap(ctx, mmMember)
+			continue
+		}
+		atomic.AddUint64(&ch.forwarded, uint64(mmMember.Len()))
+		ch.peers[i].DispatchMetricMap(ctx, mmMember)
+	}
+}
+
+// DispatchEvent sends events to the local handler, as they are not aggregated.
+func (ch *ClusterHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	ch.local.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for the local handler to send its events.
+func (ch *ClusterHandler) WaitForEvents() {
+	ch.local.WaitForEvents()
+}
+
+// drainPeers forwards everything waiting to be forwarded to the other members.
+func (ch *ClusterHandler) drainPeers(ctx context.Context) error {
+	for i, peer := range ch.peers {
+		if peer == nil {
+			continue
+		}
+		if err := peer.Drain(ctx); err != nil {
+			return fmt.Errorf("failed to forward to cluster member %s: %v", ch.members[i], err)
+		}
+	}
+	return nil
+}
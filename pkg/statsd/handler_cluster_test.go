@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/transport"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+func TestClusterHandlerDividesSeries(t *testing.T) {
+	t.Parallel()
+	var requests, marked int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get(web.ClusterForwardedHeader) != "" {
+			atomic.AddInt32(&marked, 1)
+		}
+	}))
+	defer peer.Close()
+
+	logger := logrus.New()
+	v := viper.New()
+	v.Set(gostatsd.ParamMaxParsers, 1)
+	pool := transport.NewTransportPool(logger, v)
+	local := &capturingHandler{}
+
+	ch, err := NewClusterHandlerFromViper(logger, v, local, pool)
+	require.NoError(t, err)
+	require.Nil(t, ch)
+
+	v.Set(gostatsd.ParamClusterMembers, []string{"http://self", peer.URL})
+	v.Set(gostatsd.ParamClusterSelf, "http://other")
+	_, err = NewClusterHandlerFromViper(logger, v, local, pool)
+	require.Error(t, err)
+	v.Set(gostatsd.ParamClusterSelf, "http://self")
+	ch, err = NewClusterHandlerFromViper(logger, v, local, pool)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ch.Run(ctx)
+	}()
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 100; i++ {
+		mm.Receive(&gostatsd.Metric{Name: fmt.Sprintf("counter.%d", i), Value: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"a:b"}})
+	}
+	ch.DispatchMetricMap(ctx, mm)
+
+	// Only the series owned by this server are aggregated here, and the rest are forwarded to their owner
+	require.Len(t, local.mm, 1)
+	owned := local.mm[0]
+	assert.NotZero(t, owned.Len())
+	owned.Counters.Each(func(name, tagsKey string, _ gostatsd.Counter) {
+		assert.Equal(t, 0, ch.ring.get(name, tagsKey))
+	})
+	assert.EqualValues(t, mm.Len()-owned.Len(), atomic.LoadUint64(&ch.forwarded))
+	require.NoError(t, ch.drainPeers(ctx))
+	assert.NotZero(t, atomic.LoadInt32(&requests))
+	// So the owner does not divide them again
+	assert.Equal(t, atomic.LoadInt32(&requests), atomic.LoadInt32(&marked))
+
+	cancel()
+	<-done
+}
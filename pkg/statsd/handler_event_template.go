@@ -0,0 +1,233 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// eventTemplate rewrites the title and text of the events it matches.
+type eventTemplate struct {
+	eventMatcher
+	name  string
+	title *template.Template // The new title, or nil to keep it
+	text  *template.Template // The new text, or nil to keep it
+
+	failed uint64 // atomic - events the template failed to rewrite, since the last flush
+}
+
+// eventTemplateSettings are the settings of an event-template section, in addition to eventMatcherSettings.
+var eventTemplateSettings = []string{"title", "text"}
+
+// eventTemplateData is what the templates are executed with.  The fields of the event are available directly, such as
+// {{.Title}} or {{.Source}}, and the value of a tag with {{.Tag "name"}}.
+type eventTemplateData struct {
+	*gostatsd.Event
+	// Hostname is the name of the server rewriting the event.
+	Hostname string
+}
+
+// Tag returns the value of the first tag of the event named name, or "" if there is none.
+func (d eventTemplateData) Tag(name string) string {
+	for _, tag := range d.Tags {
+		if tag == name {
+			return ""
+		}
+		if strings.HasPrefix(tag, name) && len(tag) > len(name) && tag[len(name)] == ':' {
+			return tag[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// eventTemplatesFromViper returns the event templates named in event-templates, in order, each configured by its
+// event-template section.
+func eventTemplatesFromViper(v *viper.Viper) ([]*eventTemplate, error) {
+	var templates []*eventTemplate
+	for _, name := range v.GetStringSlice("event-templates") {
+		vTemplate := v.Sub("event-template." + name)
+		if vTemplate == nil {
+			return nil, fmt.Errorf("event template %q has no event-template.%s section", name, name)
+		}
+		et, err := newEventTemplateFromViper(name, vTemplate)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, et)
+	}
+	return templates, nil
+}
+
+func newEventTemplateFromViper(name string, v *viper.Viper) (*eventTemplate, error) {
+	section := "event-template." + name
+	em, err := newEventMatcherFromViper(section, v)
+	if err != nil {
+		return nil, err
+	}
+	et := &eventTemplate{
+		eventMatcher: em,
+		name:         name,
+	}
+	if title := v.GetString("title"); title != "" {
+		if et.title, err = template.New(section + ".title").Parse(title); err != nil {
+			return nil, err
+		}
+	}
+	if text := v.GetString("text"); text != "" {
+		if et.text, err = template.New(section + ".text").Parse(text); err != nil {
+			return nil, err
+		}
+	}
+	if et.title == nil && et.text == nil {
+		return nil, fmt.Errorf("%s must have a title, or text", section)
+	}
+	return et, nil
+}
+
+// CheckEventTemplates returns an error listing every problem with the event templates, including every setting of an
+// event-template section which is not known, so a typo is not silently ignored.
+func CheckEventTemplates(v *viper.Viper) error {
+	var errs []string
+	for _, name := range v.GetStringSlice("event-templates") {
+		vTemplate := v.Sub("event-template." + name)
+		if vTemplate == nil {
+			errs = append(errs, fmt.Sprintf("event template %q has no event-template.%s section", name, name))
+			continue
+		}
+		errs = append(errs, unknownEventSettings("event-template."+name, vTemplate, eventTemplateSettings)...)
+		if _, err := newEventTemplateFromViper(name, vTemplate); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// apply rewrites the title and text of the event.  Neither is changed if either template fails.
+func (et *eventTemplate) apply(e *gostatsd.Event, hostname string) error {
+	data := eventTemplateData{Event: e, Hostname: hostname}
+	title, text := e.Title, e.Text
+	var buf bytes.Buffer
+	if et.title != nil {
+		if err := et.title.Execute(&buf, data); err != nil {
+			return err
+		}
+		title = buf.String()
+		buf.Reset()
+	}
+	if et.text != nil {
+		if err := et.text.Execute(&buf, data); err != nil {
+			return err
+		}
+		text = buf.String()
+	}
+	e.Title, e.Text = title, text
+	return nil
+}
+
+// EventTemplateHandler passes metrics to the next stage of the pipeline, and rewrites the title and text of events
+// with the templates they match, such as to add the name of the cluster, or a link to a runbook, before they are
+// passed on.  Every template an event matches is applied, in order.
+type EventTemplateHandler struct {
+	handler  gostatsd.PipelineHandler
+	logger   logrus.FieldLogger
+	hostname string
+
+	lock      sync.RWMutex
+	templates []*eventTemplate // Replaced when the configuration is reloaded
+}
+
+// NewEventTemplateHandlerFromViper returns a new EventTemplateHandler which passes metrics and events to handler,
+// with the event templates in v.
+func NewEventTemplateHandlerFromViper(logger logrus.FieldLogger, v *viper.Viper, handler gostatsd.PipelineHandler, hostname gostatsd.Source) (*EventTemplateHandler, error) {
+	templates, err := eventTemplatesFromViper(v)
+	if err != nil {
+		return nil, err
+	}
+	return &EventTemplateHandler{
+		handler:   handler,
+		logger:    logger.WithField("component", "event-template"),
+		hostname:  string(hostname),
+		templates: templates,
+	}, nil
+}
+
+// ReloadConfig replaces the templates with the templates in v.
+func (eth *EventTemplateHandler) ReloadConfig(ctx context.Context, v *viper.Viper) error {
+	templates, err := eventTemplatesFromViper(v)
+	if err != nil {
+		return err
+	}
+	eth.lock.Lock()
+	defer eth.lock.Unlock()
+	eth.templates = templates
+	return nil
+}
+
+func (eth *EventTemplateHandler) currentTemplates() []*eventTemplate {
+	eth.lock.RLock()
+	defer eth.lock.RUnlock()
+	return eth.templates
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (eth *EventTemplateHandler) EstimatedTags() int {
+	return eth.handler.EstimatedTags()
+}
+
+// DispatchMetricMap passes the MetricMap to the next stage in the pipeline.
+func (eth *EventTemplateHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	eth.handler.DispatchMetricMap(ctx, mm)
+}
+
+// DispatchEvent rewrites the event with every template it matches, and passes it to the next stage in the pipeline.
+// An event a template fails to rewrite is passed on as it was before that template.
+func (eth *EventTemplateHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	for _, et := range eth.currentTemplates() {
+		if !et.match(e) {
+			continue
+		}
+		if err := et.apply(e, eth.hostname); err != nil {
+			atomic.AddUint64(&et.failed, 1)
+			eth.logger.WithError(err).WithField("template", et.name).Debug("failed to rewrite event")
+		}
+	}
+	eth.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (eth *EventTemplateHandler) WaitForEvents() {
+	eth.handler.WaitForEvents()
+}
+
+// RunMetricsContext writes the events each template failed to rewrite since the last flush, every flush until the
+// context is done.
+func (eth *EventTemplateHandler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			for _, et := range eth.currentTemplates() {
+				statser.Count("events.template.failed", float64(atomic.SwapUint64(&et.failed, 0)), gostatsd.Tags{"template:" + et.name})
+			}
+		}
+	}
+}
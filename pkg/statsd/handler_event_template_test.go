@@ -0,0 +1,88 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestEventTemplateHandler(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+event-templates = ['cluster', 'runbooks', 'broken']
+[event-template.cluster]
+title = '[{{.Tag "cluster"}}] {{.Title}}'
+[event-template.runbooks]
+match-tags = ['alertname:*']
+match-alert-types = ['error']
+text = """{{.Text}}
+
+Runbook: https://runbooks.example.com/{{.Tag "alertname"}} (from {{.Source}} via {{.Hostname}})"""
+[event-template.broken]
+match-sources = ['broken']
+title = '{{.Missing}}'
+`)))
+	require.NoError(t, CheckEventTemplates(v))
+	ch := &capturingHandler{}
+	eth, err := NewEventTemplateHandlerFromViper(logrus.New(), v, ch, "gostatsd-1")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	eth.DispatchEvent(ctx, &gostatsd.Event{
+		Title:     "Disk full",
+		Text:      "/var is full",
+		Tags:      gostatsd.Tags{"cluster:prod-1", "alertname:DiskFull"},
+		Source:    "10.0.0.1",
+		AlertType: gostatsd.AlertError,
+	})
+	eth.DispatchEvent(ctx, &gostatsd.Event{Title: "Deployed", Text: "v2", Tags: gostatsd.Tags{"alertname:Deploy"}})
+	eth.DispatchEvent(ctx, &gostatsd.Event{Title: "Broken", Tags: gostatsd.Tags{"cluster:prod-1"}, Source: "broken"})
+
+	require.Len(t, ch.e, 3)
+	assert.Equal(t, "[prod-1] Disk full", ch.e[0].Title)
+	assert.Equal(t, "/var is full\n\nRunbook: https://runbooks.example.com/DiskFull (from 10.0.0.1 via gostatsd-1)", ch.e[0].Text)
+	// Only templates which match are applied
+	assert.Equal(t, "[] Deployed", ch.e[1].Title)
+	assert.Equal(t, "v2", ch.e[1].Text)
+	// A template which fails leaves the event as it was
+	assert.Equal(t, "[prod-1] Broken", ch.e[2].Title)
+	assert.EqualValues(t, 1, eth.currentTemplates()[2].failed)
+
+	v.Set("event-templates", []string{"runbooks"})
+	require.NoError(t, eth.ReloadConfig(ctx, v))
+	eth.DispatchEvent(ctx, &gostatsd.Event{Title: "Disk full", Tags: gostatsd.Tags{"cluster:prod-1"}})
+	assert.Equal(t, "Disk full", ch.e[3].Title)
+}
+
+func TestCheckEventTemplates(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+event-templates = ['typo', 'empty', 'invalid', 'missing']
+[event-template.typo]
+tittle = '{{.Title}}'
+text = '{{.Text}}'
+[event-template.empty]
+match-tags = ['a']
+[event-template.invalid]
+title = '{{.Title'
+`)))
+	err := CheckEventTemplates(v)
+	require.Error(t, err)
+	assert.Equal(t, `unknown setting event-template.typo.tittle; `+
+		`event-template.empty must have a title, or text; `+
+		`template: event-template.invalid.title:1: unclosed action; `+
+		`event template "missing" has no event-template.missing section`, err.Error())
+	_, err = eventTemplatesFromViper(v)
+	assert.Error(t, err)
+}
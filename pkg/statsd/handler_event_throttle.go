@@ -0,0 +1,185 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tilinna/clock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// EventThrottleHandler passes metrics to the next stage of the pipeline, and suppresses repeated events, so a source
+// which is failing repeatedly, such as a crash looping pod, does not send thousands of identical events.  Events are
+// grouped by their aggregation key, or by their title if they do not have one.  In each window, an event identical to
+// one already sent is dropped, and at most perKey events are sent for each key.  At the end of a window, a summary
+// event is sent for each key which had events suppressed.
+type EventThrottleHandler struct {
+	handler gostatsd.PipelineHandler
+	window  time.Duration
+	perKey  int // The events sent for each key in a window, or 0 for no limit
+
+	lock sync.Mutex
+	keys map[string]*throttledKey // Reset every window
+
+	deduplicated uint64 // atomic - events dropped as duplicates, since the last flush
+	throttled    uint64 // atomic - events dropped by the limit per key, since the last flush
+}
+
+// throttledKey is the state of a key in the current window.
+type throttledKey struct {
+	sent       int
+	seen       map[string]struct{} // The identity of every event sent
+	suppressed int
+	last       *gostatsd.Event // The last event suppressed
+}
+
+// NewEventThrottleHandler returns a new EventThrottleHandler which passes metrics and events to handler.
+func NewEventThrottleHandler(handler gostatsd.PipelineHandler, window time.Duration, perKey int) *EventThrottleHandler {
+	return &EventThrottleHandler{
+		handler: handler,
+		window:  window,
+		perKey:  perKey,
+		keys:    map[string]*throttledKey{},
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (eth *EventThrottleHandler) EstimatedTags() int {
+	return eth.handler.EstimatedTags()
+}
+
+// DispatchMetricMap passes the MetricMap to the next stage in the pipeline.
+func (eth *EventThrottleHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	eth.handler.DispatchMetricMap(ctx, mm)
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline, unless it is a duplicate, or its key has reached
+// the limit for the window.
+func (eth *EventThrottleHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	if eth.allow(e) {
+		eth.handler.DispatchEvent(ctx, e)
+	}
+}
+
+func (eth *EventThrottleHandler) allow(e *gostatsd.Event) bool {
+	key := throttleKey(e)
+	identity := eventIdentity(e)
+
+	eth.lock.Lock()
+	defer eth.lock.Unlock()
+	tk := eth.keys[key]
+	if tk == nil {
+		tk = &throttledKey{seen: map[string]struct{}{}}
+		eth.keys[key] = tk
+	}
+	if _, ok := tk.seen[identity]; ok {
+		atomic.AddUint64(&eth.deduplicated, 1)
+	} else if eth.perKey > 0 && tk.sent >= eth.perKey {
+		atomic.AddUint64(&eth.throttled, 1)
+	} else {
+		tk.sent++
+		tk.seen[identity] = struct{}{}
+		return true
+	}
+	tk.suppressed++
+	tk.last = e
+	return false
+}
+
+// Run starts a new window every window, and sends the summary events of the previous window, until the context is
+// done.
+func (eth *EventThrottleHandler) Run(ctx context.Context) {
+	ticker := clock.FromContext(ctx).NewTicker(eth.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, e := range eth.resetWindow() {
+				eth.handler.DispatchEvent(ctx, e)
+			}
+		}
+	}
+}
+
+// resetWindow starts a new window, and returns the summary events for the keys which had events suppressed.
+func (eth *EventThrottleHandler) resetWindow() []*gostatsd.Event {
+	eth.lock.Lock()
+	keys := eth.keys
+	eth.keys = map[string]*throttledKey{}
+	eth.lock.Unlock()
+
+	var summaries []*gostatsd.Event
+	for key, tk := range keys {
+		if tk.suppressed == 0 {
+			continue
+		}
+		summaries = append(summaries, &gostatsd.Event{
+			Title:          fmt.Sprintf("%s (%d similar events suppressed)", tk.last.Title, tk.suppressed),
+			Text:           fmt.Sprintf("%d events for %q were suppressed in the last %v.  The last was:\n%s", tk.suppressed, key, eth.window, tk.last.Text),
+			DateHappened:   tk.last.DateHappened,
+			AggregationKey: tk.last.AggregationKey,
+			SourceTypeName: tk.last.SourceTypeName,
+			Tags:           tk.last.Tags,
+			Source:         tk.last.Source,
+			Priority:       tk.last.Priority,
+			AlertType:      tk.last.AlertType,
+		})
+	}
+	return summaries
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (eth *EventThrottleHandler) WaitForEvents() {
+	eth.handler.WaitForEvents()
+}
+
+// RunMetricsContext writes the events suppressed since the last flush, every flush until the context is done.
+func (eth *EventThrottleHandler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Count("events.deduplicated", float64(atomic.SwapUint64(&eth.deduplicated, 0)), nil)
+			statser.Count("events.throttled", float64(atomic.SwapUint64(&eth.throttled, 0)), nil)
+		}
+	}
+}
+
+// throttleKey returns the key an event is throttled by, its aggregation key, or its title if it does not have one.
+func throttleKey(e *gostatsd.Event) string {
+	if e.AggregationKey != "" {
+		return e.AggregationKey
+	}
+	return e.Title
+}
+
+// eventIdentity returns a string which is the same for identical events, regardless of the order of their tags, or
+// when they happened.
+func eventIdentity(e *gostatsd.Event) string {
+	tags := make([]string, len(e.Tags))
+	copy(tags, e.Tags)
+	sort.Strings(tags)
+	return strings.Join([]string{
+		e.Title,
+		e.Text,
+		string(e.Source),
+		e.SourceTypeName,
+		e.Priority.String(),
+		e.AlertType.String(),
+		strings.Join(tags, ","),
+	}, "\x00")
+}
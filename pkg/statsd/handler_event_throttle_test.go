@@ -0,0 +1,56 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestEventThrottleHandler(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	eth := NewEventThrottleHandler(ch, time.Minute, 2)
+	ctx := context.Background()
+
+	crash := func(pod string) *gostatsd.Event {
+		return &gostatsd.Event{Title: "Pod crashed", Text: pod + " crashed", AggregationKey: "crashloop", Tags: gostatsd.Tags{"a:b", "c:d"}}
+	}
+	eth.DispatchEvent(ctx, crash("pod-1"))
+	// Identical, regardless of the order of the tags
+	eth.DispatchEvent(ctx, &gostatsd.Event{Title: "Pod crashed", Text: "pod-1 crashed", AggregationKey: "crashloop", Tags: gostatsd.Tags{"c:d", "a:b"}})
+	eth.DispatchEvent(ctx, crash("pod-2"))
+	// Over the limit for the key
+	eth.DispatchEvent(ctx, crash("pod-3"))
+	eth.DispatchEvent(ctx, crash("pod-4"))
+	// Other keys are not affected, and the title is the key without an aggregation key
+	eth.DispatchEvent(ctx, &gostatsd.Event{Title: "Deployed"})
+	eth.DispatchEvent(ctx, &gostatsd.Event{Title: "Deployed"})
+
+	require.Len(t, ch.e, 3)
+	assert.Equal(t, "pod-1 crashed", ch.e[0].Text)
+	assert.Equal(t, "pod-2 crashed", ch.e[1].Text)
+	assert.Equal(t, "Deployed", ch.e[2].Title)
+	assert.EqualValues(t, 2, eth.deduplicated)
+	assert.EqualValues(t, 2, eth.throttled)
+
+	summaries := eth.resetWindow()
+	require.Len(t, summaries, 2)
+	if summaries[0].Title == "Deployed (1 similar events suppressed)" {
+		summaries[0], summaries[1] = summaries[1], summaries[0]
+	}
+	assert.Equal(t, "Pod crashed (3 similar events suppressed)", summaries[0].Title)
+	assert.Equal(t, "3 events for \"crashloop\" were suppressed in the last 1m0s.  The last was:\npod-4 crashed", summaries[0].Text)
+	assert.Equal(t, "crashloop", summaries[0].AggregationKey)
+	assert.Equal(t, gostatsd.Tags{"a:b", "c:d"}, summaries[0].Tags)
+	assert.Equal(t, "Deployed (1 similar events suppressed)", summaries[1].Title)
+
+	// A new window sends the events again, and has nothing to summarise
+	eth.DispatchEvent(ctx, crash("pod-1"))
+	assert.Len(t, ch.e, 4)
+	assert.Empty(t, eth.resetWindow())
+}
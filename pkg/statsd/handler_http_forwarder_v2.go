@@ -2,12 +2,14 @@ package statsd
 
 import (
 	"bytes"
-	"compress/zlib"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,19 +25,78 @@ import (
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/internal/util"
 	"github.com/hligit/gostatsd/pb"
+	"github.com/hligit/gostatsd/pkg/compression"
+	"github.com/hligit/gostatsd/pkg/diskqueue"
 	"github.com/hligit/gostatsd/pkg/stats"
+	"github.com/hligit/gostatsd/pkg/tracing"
 	"github.com/hligit/gostatsd/pkg/transport"
 )
 
 const (
 	defaultConsolidatorFlushInterval = 1 * time.Second
 	defaultCompress                  = true
+	defaultCompression               = ""
+	defaultCompressionLevel          = 0
 	defaultApiEndpoint               = ""
 	defaultMaxRequestElapsedTime     = 30 * time.Second
 	defaultMaxRequests               = 1000
 	defaultTransport                 = "default"
+	defaultSpoolPath                 = ""
+	defaultSpoolMaxBytes             = 100 * 1024 * 1024
+	defaultSpoolMaxAge               = 1 * time.Hour
+	defaultSpoolReplayRate           = 10
+	defaultMaxQueueSize              = 100
+	defaultQueuePolicy               = QueuePolicyBlock
+	defaultEventFlushInterval        = 1 * time.Second
+	defaultMaxEventBatchSize         = 100
+
+	// spoolPollInterval is how often an empty spool is checked for payloads to replay.
+	spoolPollInterval = 1 * time.Second
+	// spoolRetryInterval is how long to wait after a payload could not be replayed.
+	spoolRetryInterval = 5 * time.Second
+	// maxEventSendTime bounds how long a batch of events is retried when max-request-elapsed-time is unlimited.
+	maxEventSendTime = 1 * time.Minute
 )
 
+// GrpcOptions configures the grpc protocol.
+type GrpcOptions struct {
+	// KeepaliveTime is how long a connection is idle before it is pinged.
+	KeepaliveTime time.Duration
+	// KeepaliveTimeout is how long to wait for a ping to be answered before the connection is closed.
+	KeepaliveTimeout time.Duration
+}
+
+// SpoolOptions configures the spooling of payloads to disk when they can not be forwarded.
+type SpoolOptions struct {
+	// Path is the directory payloads are spooled in.  Spooling is disabled if it is not set.
+	Path string
+	// MaxBytes is the maximum size of the spool, the oldest payloads are dropped to stay within it.
+	MaxBytes int64
+	// MaxAge is the maximum age of a spooled payload before it is dropped, or 0 to never drop them.
+	MaxAge time.Duration
+	// ReplayRate is the maximum number of spooled payloads replayed per second.
+	ReplayRate float64
+}
+
+// QueueOptions configures the queue of batches waiting to be sent, which bounds the memory used when the upstream
+// is slow or unavailable.
+type QueueOptions struct {
+	// MaxSize is the maximum number of batches waiting for a request slot, or 0 for the default.
+	MaxSize int
+	// Policy is what to do when the queue is full, one of QueuePolicyBlock, QueuePolicyDropNewest, or
+	// QueuePolicyDropOldest, or empty for QueuePolicyBlock.
+	Policy string
+}
+
+// EventOptions configures the batching of events, which are sent periodically rather than one at a time.
+type EventOptions struct {
+	// FlushInterval is how often the pending events are sent, or 0 for the default.
+	FlushInterval time.Duration
+	// MaxBatchSize is the maximum number of events in a batch, or 0 for the default.  The pending events are sent
+	// early once there are this many for an upstream.
+	MaxBatchSize int
+}
+
 // HttpForwarderHandlerV2 is a PipelineHandler which sends metrics to another gostatsd instance
 type HttpForwarderHandlerV2 struct {
 	postId          uint64 // atomic - used for an id in logs
@@ -44,63 +105,182 @@ type HttpForwarderHandlerV2 struct {
 	messagesSent    uint64 // atomic - messages successfully sent
 	messagesRetried uint64 // atomic - retries (first send is not a retry, final failure is not a retry)
 	messagesDropped uint64 // atomic - final failure
+	bytesRaw        uint64 // atomic - bytes before compression
+	bytesCompressed uint64 // atomic - bytes after compression
+	messagesSpooled uint64 // atomic - final failure, written to the spool instead of dropped
+	spoolReplayed   uint64 // atomic - spooled messages successfully sent
+	spoolDropped    uint64 // atomic - spooled messages evicted or expired
+	queueDropped    uint64 // atomic - batches dropped because the queue was full
+	batchesPending  int64  // atomic - batches queued or being posted, which Drain waits for
 
 	logger                logrus.FieldLogger
-	apiEndpoint           string
+	targets               []*forwarderTarget
+	ring                  *hashRing // Shards series between targets
 	maxRequestElapsedTime time.Duration
+	requestTimeout        time.Duration // The time allowed for each attempt, or 0 for the client-timeout of the transport
+	maxProtocolVersion    int           // The newest version of the forwarding protocol to negotiate
 	metricsSem            chan struct{}
+	queue                 *batchQueue // Batches waiting for a slot in metricsSem
 	client                *http.Client
 	consolidator          *gostatsd.MetricConsolidator
 	consolidatedMetrics   <-chan []*gostatsd.MetricMap
+	drainSync             chan struct{}  // Received by Run between batches, so Drain knows the flushed batches are queued
+	postWg                sync.WaitGroup // Metrics posts which are in flight
 	eventWg               sync.WaitGroup
-	compress              bool
+	compressors           []compression.Codec // The configured compression, followed by the fallbacks
 	headers               map[string]string
 	dynHeaderNames        []string
+	grpc                  *grpcForwarder   // nil unless the protocol is grpc
+	spool                 *diskqueue.Queue // nil if spooling is disabled
+	spoolReplayInterval   time.Duration
+
+	eventFlushInterval time.Duration
+	maxEventBatchSize  int
+	eventsPending      chan struct{} // Signalled when an event is dispatched
+	eventsFull         chan struct{} // Signalled when an upstream has a full batch of pending events
+	eventLock          sync.Mutex
+	pendingEvents      [][]*pb.EventV2 // The events waiting to be sent to each target
+	eventValues        context.Context // The values of the Run context, without its cancellation
+}
+
+// forwarderTarget is an upstream server, which is sent a share of the series when there are multiple upstreams.
+type forwarderTarget struct {
+	lastPostFailed  uint32 // atomic - 1 if the most recent message to finish was dropped
+	compressorIndex uint32 // atomic - index in to compressors of the compression accepted by the upstream
+	protocolVersion uint32 // atomic - version of the forwarding protocol negotiated with the upstream
+
+	apiEndpoint string
 }
 
 // NewHttpForwarderHandlerV2FromViper returns a new http API client.
 func NewHttpForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Viper, pool *transport.TransportPool) (*HttpForwarderHandlerV2, error) {
 	subViper := util.GetSubViper(v, "http-transport")
+	apiEndpoints := subViper.GetStringSlice("api-endpoints")
+	if apiEndpoint := subViper.GetString("api-endpoint"); apiEndpoint != "" {
+		if len(apiEndpoints) > 0 {
+			return nil, fmt.Errorf("only one of api-endpoint and api-endpoints can be set")
+		}
+		apiEndpoints = []string{apiEndpoint}
+	}
+	return newHttpForwarderHandlerV2FromSubViper(logger, v, subViper, apiEndpoints, pool)
+}
+
+// newHttpForwarderHandlerV2FromSubViper returns a new http API client sending to apiEndpoints, with the other settings
+// in subViper, which is a section of v.
+func newHttpForwarderHandlerV2FromSubViper(logger logrus.FieldLogger, v, subViper *viper.Viper, apiEndpoints []string, pool *transport.TransportPool) (*HttpForwarderHandlerV2, error) {
 	subViper.SetDefault("transport", defaultTransport)
+	subViper.SetDefault("protocol", defaultProtocol)
+	subViper.SetDefault("protocol-version", pb.ProtocolVersions[0])
+	subViper.SetDefault("grpc-keepalive-time", defaultGrpcKeepaliveTime)
+	subViper.SetDefault("grpc-keepalive-timeout", defaultGrpcKeepaliveTimeout)
 	subViper.SetDefault("compress", defaultCompress)
+	subViper.SetDefault("compression", defaultCompression)
+	subViper.SetDefault("compression-level", defaultCompressionLevel)
 	subViper.SetDefault("api-endpoint", defaultApiEndpoint)
 	subViper.SetDefault("max-requests", defaultMaxRequests)
 	subViper.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	subViper.SetDefault("request-timeout", 0)
 	subViper.SetDefault("consolidator-slots", v.GetInt(gostatsd.ParamMaxParsers))
 	subViper.SetDefault("flush-interval", defaultConsolidatorFlushInterval)
+	subViper.SetDefault("spool-path", defaultSpoolPath)
+	subViper.SetDefault("spool-max-bytes", defaultSpoolMaxBytes)
+	subViper.SetDefault("spool-max-age", defaultSpoolMaxAge)
+	subViper.SetDefault("spool-replay-rate", defaultSpoolReplayRate)
+	subViper.SetDefault("max-queue-size", defaultMaxQueueSize)
+	subViper.SetDefault("queue-policy", defaultQueuePolicy)
+	subViper.SetDefault("event-flush-interval", defaultEventFlushInterval)
+	subViper.SetDefault("max-event-batch-size", defaultMaxEventBatchSize)
+
+	encoding := subViper.GetString("compression")
+	if encoding == "" {
+		if subViper.GetBool("compress") {
+			encoding = compression.Deflate
+		} else {
+			encoding = compression.Identity
+		}
+	}
 
-	return NewHttpForwarderHandlerV2(
+	requestTimeout := subViper.GetDuration("request-timeout")
+	if requestTimeout < 0 {
+		return nil, fmt.Errorf("request-timeout must not be negative")
+	}
+	hfh, err := NewHttpForwarderHandlerV2(
 		logger,
 		subViper.GetString("transport"),
-		subViper.GetString("api-endpoint"),
+		subViper.GetString("protocol"),
+		subViper.GetInt("protocol-version"),
+		apiEndpoints,
 		subViper.GetInt("consolidator-slots"),
 		subViper.GetInt("max-requests"),
-		subViper.GetBool("compress"),
+		encoding,
+		subViper.GetInt("compression-level"),
 		subViper.GetDuration("max-request-elapsed-time"),
 		subViper.GetDuration("flush-interval"),
 		subViper.GetStringMapString("custom-headers"),
 		subViper.GetStringSlice("dynamic-headers"),
+		GrpcOptions{
+			KeepaliveTime:    subViper.GetDuration("grpc-keepalive-time"),
+			KeepaliveTimeout: subViper.GetDuration("grpc-keepalive-timeout"),
+		},
+		SpoolOptions{
+			Path:       subViper.GetString("spool-path"),
+			MaxBytes:   subViper.GetInt64("spool-max-bytes"),
+			MaxAge:     subViper.GetDuration("spool-max-age"),
+			ReplayRate: subViper.GetFloat64("spool-replay-rate"),
+		},
+		QueueOptions{
+			MaxSize: subViper.GetInt("max-queue-size"),
+			Policy:  subViper.GetString("queue-policy"),
+		},
+		EventOptions{
+			FlushInterval: subViper.GetDuration("event-flush-interval"),
+			MaxBatchSize:  subViper.GetInt("max-event-batch-size"),
+		},
 		pool,
 	)
+	if err != nil {
+		return nil, err
+	}
+	hfh.requestTimeout = requestTimeout
+	return hfh, nil
 }
 
 // NewHttpForwarderHandlerV2 returns a new handler which dispatches metrics over http to another gostatsd server.
 func NewHttpForwarderHandlerV2(
 	logger logrus.FieldLogger,
 	transport,
-	apiEndpoint string,
+	protocol string,
+	maxProtocolVersion int,
+	apiEndpoints []string,
 	consolidatorSlots,
 	maxRequests int,
-	compress bool,
+	encoding string,
+	compressionLevel int,
 	maxRequestElapsedTime time.Duration,
 	flushInterval time.Duration,
 	xheaders map[string]string,
 	dynHeaderNames []string,
+	grpcOpts GrpcOptions,
+	spoolOpts SpoolOptions,
+	queueOpts QueueOptions,
+	eventOpts EventOptions,
 	pool *transport.TransportPool,
 ) (*HttpForwarderHandlerV2, error) {
-	if apiEndpoint == "" {
+	if len(apiEndpoints) == 0 {
 		return nil, fmt.Errorf("api-endpoint is required")
 	}
+	targets := make([]*forwarderTarget, 0, len(apiEndpoints))
+	seen := make(map[string]bool, len(apiEndpoints))
+	for _, apiEndpoint := range apiEndpoints {
+		if apiEndpoint == "" {
+			return nil, fmt.Errorf("api-endpoints must not be empty")
+		}
+		if seen[apiEndpoint] {
+			return nil, fmt.Errorf("api-endpoints must be unique, %s is duplicated", apiEndpoint)
+		}
+		seen[apiEndpoint] = true
+		targets = append(targets, &forwarderTarget{protocolVersion: pb.ProtocolVersion2, apiEndpoint: apiEndpoint})
+	}
 	if consolidatorSlots <= 0 {
 		return nil, fmt.Errorf("consolidator-slots must be positive")
 	}
@@ -113,6 +293,54 @@ func NewHttpForwarderHandlerV2(
 	if flushInterval <= 0 {
 		return nil, fmt.Errorf("flush-interval must be positive")
 	}
+	if protocol != protocolHttp && protocol != protocolGrpc {
+		return nil, fmt.Errorf("protocol must be http or grpc")
+	}
+	if maxProtocolVersion == 0 {
+		maxProtocolVersion = pb.ProtocolVersions[0]
+	}
+	if !pb.SupportsProtocolVersion(maxProtocolVersion) {
+		return nil, fmt.Errorf("protocol-version must be one of %s", pb.FormatProtocolVersions(pb.ProtocolVersions))
+	}
+
+	if queueOpts.MaxSize == 0 {
+		queueOpts.MaxSize = defaultMaxQueueSize
+	}
+	if queueOpts.Policy == "" {
+		queueOpts.Policy = defaultQueuePolicy
+	}
+	queue, err := newBatchQueue(queueOpts.MaxSize, queueOpts.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if eventOpts.FlushInterval == 0 {
+		eventOpts.FlushInterval = defaultEventFlushInterval
+	}
+	if eventOpts.MaxBatchSize == 0 {
+		eventOpts.MaxBatchSize = defaultMaxEventBatchSize
+	}
+	if eventOpts.FlushInterval < 0 || eventOpts.MaxBatchSize < 0 {
+		return nil, fmt.Errorf("event-flush-interval and max-event-batch-size must be positive")
+	}
+
+	compressors, err := newCompressors(encoding, compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	var spool *diskqueue.Queue
+	var spoolReplayInterval time.Duration
+	if spoolOpts.Path != "" {
+		if spoolOpts.ReplayRate <= 0 {
+			return nil, fmt.Errorf("spool-replay-rate must be positive")
+		}
+		spoolReplayInterval = time.Duration(float64(time.Second) / spoolOpts.ReplayRate)
+		spool, err = diskqueue.Open(logger.WithField("component", "http-forwarder-spool"), spoolOpts.Path, spoolOpts.MaxBytes, spoolOpts.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool: %v", err)
+		}
+	}
 
 	httpClient, err := pool.Get(transport)
 	if err != nil {
@@ -121,12 +349,20 @@ func NewHttpForwarderHandlerV2(
 	}
 
 	logger.WithFields(logrus.Fields{
-		"api-endpoint":             apiEndpoint,
-		"compress":                 compress,
+		"api-endpoints":            apiEndpoints,
+		"protocol":                 protocol,
+		"protocol-version":         maxProtocolVersion,
+		"compression":              compressors[0].Encoding(),
+		"compression-level":        compressionLevel,
 		"max-request-elapsed-time": maxRequestElapsedTime,
 		"max-requests":             maxRequests,
+		"max-queue-size":           queueOpts.MaxSize,
+		"queue-policy":             queueOpts.Policy,
+		"event-flush-interval":     eventOpts.FlushInterval,
+		"max-event-batch-size":     eventOpts.MaxBatchSize,
 		"consolidator-slots":       consolidatorSlots,
 		"flush-interval":           flushInterval,
+		"spool-path":               spoolOpts.Path,
 	}).Info("created HttpForwarderHandler")
 
 	// Default set of headers used for the forwarder
@@ -160,22 +396,76 @@ func NewHttpForwarderHandlerV2(
 		metricsSem <- struct{}{}
 	}
 
+	var grpcForwarder *grpcForwarder
+	if protocol == protocolGrpc {
+		for _, apiEndpoint := range apiEndpoints {
+			if _, _, err := grpcTarget(apiEndpoint); err != nil {
+				return nil, err
+			}
+		}
+		if grpcOpts.KeepaliveTime <= 0 || grpcOpts.KeepaliveTimeout <= 0 {
+			return nil, fmt.Errorf("grpc-keepalive-time and grpc-keepalive-timeout must be positive")
+		}
+		var tlsConfig *tls.Config
+		if t, ok := httpClient.Client.Transport.(*http.Transport); ok {
+			tlsConfig = t.TLSClientConfig
+		}
+		// grpc only supports gzip of the encodings the http protocol supports
+		gzipCompression := compressors[0].Encoding() != compression.Identity
+		grpcForwarder = newGrpcForwarder(logger, headers, tlsConfig, gzipCompression, grpcOpts.KeepaliveTime, grpcOpts.KeepaliveTimeout, maxRequests)
+	}
+
 	ch := make(chan []*gostatsd.MetricMap)
 
 	return &HttpForwarderHandlerV2{
 		logger:                logger.WithField("component", "http-forwarder-handler-v2"),
-		apiEndpoint:           apiEndpoint,
+		targets:               targets,
+		ring:                  newHashRing(apiEndpoints),
 		maxRequestElapsedTime: maxRequestElapsedTime,
+		maxProtocolVersion:    maxProtocolVersion,
 		metricsSem:            metricsSem,
-		compress:              compress,
+		queue:                 queue,
+		compressors:           compressors,
 		consolidator:          gostatsd.NewMetricConsolidator(consolidatorSlots, flushInterval, ch),
 		consolidatedMetrics:   ch,
+		drainSync:             make(chan struct{}),
 		client:                httpClient.Client,
 		headers:               headers,
 		dynHeaderNames:        dynHeaderNamesWithColon,
+		grpc:                  grpcForwarder,
+		spool:                 spool,
+		spoolReplayInterval:   spoolReplayInterval,
+		eventFlushInterval:    eventOpts.FlushInterval,
+		maxEventBatchSize:     eventOpts.MaxBatchSize,
+		eventsPending:         make(chan struct{}, 1),
+		eventsFull:            make(chan struct{}, 1),
+		pendingEvents:         make([][]*pb.EventV2, len(targets)),
 	}, nil
 }
 
+// newCompressors returns the codec for the configured compression, followed by deflate and identity, which every
+// upstream supports, as fallbacks in case the upstream does not support the configured compression.
+func newCompressors(encoding string, compressionLevel int) ([]compression.Codec, error) {
+	c, err := compression.New(encoding, compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	compressors := []compression.Codec{c}
+	fallbacks := map[string][]string{
+		compression.Zstd:    {compression.Deflate, compression.Identity},
+		compression.Gzip:    {compression.Deflate, compression.Identity},
+		compression.Deflate: {compression.Identity},
+	}
+	for _, fallback := range fallbacks[c.Encoding()] {
+		c, err = compression.New(fallback, 0)
+		if err != nil {
+			return nil, err
+		}
+		compressors = append(compressors, c)
+	}
+	return compressors, nil
+}
+
 func (hfh *HttpForwarderHandlerV2) EstimatedTags() int {
 	return 0
 }
@@ -207,40 +497,201 @@ func (hfh *HttpForwarderHandlerV2) emitMetrics(statser stats.Statser) {
 	messagesSent := atomic.SwapUint64(&hfh.messagesSent, 0)
 	messagesRetried := atomic.SwapUint64(&hfh.messagesRetried, 0)
 	messagesDropped := atomic.SwapUint64(&hfh.messagesDropped, 0)
+	bytesRaw := atomic.SwapUint64(&hfh.bytesRaw, 0)
+	bytesCompressed := atomic.SwapUint64(&hfh.bytesCompressed, 0)
+	queueDropped := atomic.SwapUint64(&hfh.queueDropped, 0)
 
 	statser.Count("http.forwarder.invalid", float64(messagesInvalid), nil)
 	statser.Count("http.forwarder.created", float64(messagesCreated), nil)
 	statser.Count("http.forwarder.sent", float64(messagesSent), nil)
 	statser.Count("http.forwarder.retried", float64(messagesRetried), nil)
 	statser.Count("http.forwarder.dropped", float64(messagesDropped), nil)
+	statser.Count("http.forwarder.bytes", float64(bytesRaw), []string{"type:raw"})
+	statser.Count("http.forwarder.bytes", float64(bytesCompressed), []string{"type:compressed"})
+	statser.Count("http.forwarder.queue.dropped", float64(queueDropped), nil)
+	statser.Gauge("http.forwarder.queue.depth", float64(hfh.queue.len()), nil)
+
+	if hfh.spool != nil {
+		messagesSpooled := atomic.SwapUint64(&hfh.messagesSpooled, 0)
+		spoolReplayed := atomic.SwapUint64(&hfh.spoolReplayed, 0)
+		spoolDropped := atomic.SwapUint64(&hfh.spoolDropped, 0)
+		spoolStats := hfh.spool.Stats()
+
+		statser.Count("http.forwarder.spooled", float64(messagesSpooled), nil)
+		statser.Count("http.forwarder.spool.replayed", float64(spoolReplayed), nil)
+		statser.Count("http.forwarder.spool.dropped", float64(spoolDropped), nil)
+		statser.Gauge("http.forwarder.spool.messages", float64(spoolStats.Records), nil)
+		statser.Gauge("http.forwarder.spool.bytes", float64(spoolStats.Bytes), nil)
+	}
 }
 
 func (hfh *HttpForwarderHandlerV2) Run(ctx context.Context) {
+	drops := stats.DropAccountingFromContext(ctx)
+	hfh.eventLock.Lock()
+	hfh.eventValues = valuesContext{ctx}
+	hfh.eventLock.Unlock()
 	var wg wait.Group
-	defer wg.Wait()
+	defer func() {
+		wg.Wait()
+		// Posts which are still retrying are spooled when the context is done, and the batches which never got a
+		// request slot are spooled here, before the transport they would be sent over is closed.
+		hfh.postWg.Wait()
+		hfh.spoolQueued(ctx)
+		if hfh.spool != nil {
+			if err := hfh.spool.Close(); err != nil {
+				hfh.logger.WithError(err).Warn("failed to close spool")
+			}
+		}
+		if hfh.grpc != nil {
+			hfh.grpc.close()
+		}
+	}()
 	wg.StartWithContext(ctx, hfh.consolidator.Run)
+	if hfh.spool != nil {
+		wg.StartWithContext(ctx, hfh.replaySpool)
+	}
+	wg.StartWithContext(ctx, hfh.sendQueued)
+	wg.StartWithContext(ctx, hfh.flushEvents)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-hfh.drainSync:
 		case metricMaps := <-hfh.consolidatedMetrics:
 			mergedMetricMap := mergeMaps(metricMaps)
 			mms := mergedMetricMap.SplitByTags(hfh.dynHeaderNames)
 			for dynHeaderTags, mm := range mms {
-				if !hfh.acquireSem(ctx) {
-					return
+				for targetIdx, mmTarget := range hfh.splitByTarget(mm) {
+					if mmTarget.IsEmpty() {
+						continue
+					}
+					atomic.AddInt64(&hfh.batchesPending, 1)
+					dropped, ok := hfh.queue.push(ctx, &forwarderBatch{
+						target:        hfh.targets[targetIdx],
+						metricMap:     mmTarget,
+						dynHeaderTags: dynHeaderTags,
+					})
+					if !ok {
+						atomic.AddInt64(&hfh.batchesPending, -1)
+						return
+					}
+					if dropped != nil {
+						atomic.AddInt64(&hfh.batchesPending, -1)
+						atomic.AddUint64(&hfh.queueDropped, 1)
+						drops.Dropped(stats.DropReasonForwarderQueue, "", uint64(dropped.metricMap.Len()))
+						hfh.logger.WithField("queue-policy", hfh.queue.policy).Warn("forwarder queue is full, dropped a batch")
+					}
 				}
-				postId := atomic.AddUint64(&hfh.postId, 1) - 1
-				go func(postId uint64, metricMap *gostatsd.MetricMap, dynHeaderTags string) {
-					hfh.postMetrics(ctx, metricMap, dynHeaderTags, postId)
-					hfh.releaseSem()
-				}(postId, mm, dynHeaderTags)
 			}
 		}
 	}
 }
 
+// sendQueued sends batches from the queue as request slots become available.
+func (hfh *HttpForwarderHandlerV2) sendQueued(ctx context.Context) {
+	for {
+		if !hfh.acquireSem(ctx) {
+			return
+		}
+		batch, ok := hfh.queue.pop(ctx)
+		if !ok {
+			return
+		}
+		postId := atomic.AddUint64(&hfh.postId, 1) - 1
+		hfh.postWg.Add(1)
+		go func(postId uint64, batch *forwarderBatch) {
+			defer hfh.postWg.Done()
+			hfh.postMetrics(ctx, batch.target, batch.metricMap, batch.dynHeaderTags, postId)
+			atomic.AddInt64(&hfh.batchesPending, -1)
+			hfh.releaseSem()
+		}(postId, batch)
+	}
+}
+
+// Drain forwards the metrics consolidated so far, and waits until every batch is sent, spooled, or dropped, and every
+// event is sent, or the context is done.
+func (hfh *HttpForwarderHandlerV2) Drain(ctx context.Context) error {
+	if err := hfh.consolidator.FlushNow(ctx); err != nil {
+		return err
+	}
+	// Run received the flushed metrics before FlushNow returned, and has queued them once it receives this
+	select {
+	case hfh.drainSync <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&hfh.batchesPending) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return waitContext(ctx, hfh.WaitForEvents)
+}
+
+// spoolQueued is called on shutdown, and spools the batches still in the queue, or drops them if they can not be
+// spooled.
+func (hfh *HttpForwarderHandlerV2) spoolQueued(ctx context.Context) {
+	drops := stats.DropAccountingFromContext(ctx)
+	for _, batch := range hfh.queue.drain() {
+		atomic.AddInt64(&hfh.batchesPending, -1)
+		postId := atomic.AddUint64(&hfh.postId, 1) - 1
+		logger := hfh.postLogger(batch.target, postId, "metrics")
+		raw, err := hfh.serialize(translateToProtobufV2(batch.metricMap))
+		if err != nil {
+			atomic.AddUint64(&hfh.messagesInvalid, 1)
+			drops.Dropped(stats.DropReasonForwarderSend, "", uint64(batch.metricMap.Len()))
+			logger.WithError(err).Error("failed to serialize request")
+			continue
+		}
+		version := int(atomic.LoadUint32(&batch.target.protocolVersion))
+		if !hfh.spoolPayload(ctx, logger, batch.target, "metrics", "/v2/raw", raw, uint64(batch.metricMap.Len()), version, batch.dynHeaderTags) {
+			atomic.AddUint64(&hfh.queueDropped, 1)
+			drops.Dropped(stats.DropReasonForwarderQueue, "", uint64(batch.metricMap.Len()))
+			logger.Info("shutting down, dropped a queued batch")
+		}
+	}
+}
+
+// splitByTarget splits the MetricMap in to one MetricMap per target, by consistent hashing of the name and tags of
+// each series, so a series is always sent to the same upstream.
+func (hfh *HttpForwarderHandlerV2) splitByTarget(mm *gostatsd.MetricMap) []*gostatsd.MetricMap {
+	if len(hfh.targets) == 1 {
+		return []*gostatsd.MetricMap{mm}
+	}
+	return mm.SplitByBucket(len(hfh.targets), func(metricName string, tagsKey string) int {
+		return hfh.ring.get(metricName, tagsKey)
+	})
+}
+
+// CheckReady reports if the upstreams can be reached, based on whether the most recent message to each was sent or
+// dropped.
+func (hfh *HttpForwarderHandlerV2) CheckReady() error {
+	var failed []string
+	for _, target := range hfh.targets {
+		if atomic.LoadUint32(&target.lastPostFailed) != 0 {
+			failed = append(failed, target.apiEndpoint)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("failed to send to " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Overloaded returns "forwarder_queue" while the queue of batches waiting to be sent is full, as further batches are
+// blocked or dropped until the upstreams catch up.
+func (hfh *HttpForwarderHandlerV2) Overloaded() string {
+	if hfh.queue.len() >= hfh.queue.maxSize {
+		return "forwarder_queue"
+	}
+	return ""
+}
+
 func mergeMaps(maps []*gostatsd.MetricMap) *gostatsd.MetricMap {
 	mm := gostatsd.NewMetricMap()
 	for _, m := range maps {
@@ -321,46 +772,188 @@ func translateToProtobufV2(metricMap *gostatsd.MetricMap) *pb.RawMessageV2 {
 	return &pbMetricMap
 }
 
-func (hfh *HttpForwarderHandlerV2) postMetrics(ctx context.Context, metricMap *gostatsd.MetricMap, dynHeaderTags string, batchId uint64) {
+func (hfh *HttpForwarderHandlerV2) postMetrics(ctx context.Context, target *forwarderTarget, metricMap *gostatsd.MetricMap, dynHeaderTags string, batchId uint64) {
 	message := translateToProtobufV2(metricMap)
-	hfh.post(ctx, message, dynHeaderTags, batchId, "metrics", "/v2/raw")
+	hfh.post(ctx, target, message, uint64(metricMap.Len()), dynHeaderTags, batchId, "metrics", "/v2/raw")
+}
+
+func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, target *forwarderTarget, message proto.Message, datapoints uint64, dynHeaderTags string, id uint64, endpointType, endpoint string) {
+	logger := hfh.postLogger(target, id, endpointType)
+
+	raw, err := hfh.serialize(message)
+	if err != nil {
+		atomic.AddUint64(&hfh.messagesInvalid, 1)
+		stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonForwarderSend, "", datapoints)
+		logger.WithError(err).Error("failed to serialize request")
+		return
+	}
+	// The payload keeps the version it was encoded with across retries
+	version := int(atomic.LoadUint32(&target.protocolVersion))
+
+	hfh.send(ctx, logger, target, raw, datapoints, version, dynHeaderTags, endpointType, endpoint)
 }
 
-func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Message, dynHeaderTags string, id uint64, endpointType, endpoint string) {
+func (hfh *HttpForwarderHandlerV2) postLogger(target *forwarderTarget, id uint64, endpointType string) logrus.FieldLogger {
 	logger := hfh.logger.WithFields(logrus.Fields{
 		"id":   id,
 		"type": endpointType,
 	})
+	if len(hfh.targets) > 1 {
+		logger = logger.WithField("api-endpoint", target.apiEndpoint)
+	}
+	return logger
+}
 
-	post, err := hfh.constructPost(ctx, logger, hfh.apiEndpoint+endpoint, message, dynHeaderTags)
+// send sends a serialized payload, retrying until it is sent or max-request-elapsed-time has passed, when it is
+// spooled if possible, or dropped.  The datapoints are the number of series or events in the payload, which are
+// counted if it is dropped.
+func (hfh *HttpForwarderHandlerV2) send(ctx context.Context, logger logrus.FieldLogger, target *forwarderTarget, raw []byte, datapoints uint64, version int, dynHeaderTags string, endpointType, endpoint string) {
+	ctx, span := tracing.Start(ctx, "forwarder.send",
+		tracing.TypeKey.String(endpointType),
+		tracing.APIEndpointKey.String(target.apiEndpoint),
+		tracing.ProtocolVersionKey.Int(version),
+	)
+	attempts := 0
+	var err error
+	defer func() {
+		span.SetAttributes(tracing.AttemptsKey.Int(attempts))
+		tracing.End(span, err)
+	}()
+
+	post, err := hfh.constructPost(ctx, logger, target, endpoint, raw, version, dynHeaderTags)
 	if err != nil {
 		atomic.AddUint64(&hfh.messagesInvalid, 1)
+		stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonForwarderSend, "", datapoints)
 		logger.WithError(err).Error("failed to create request")
 		return
 	} else {
 		atomic.AddUint64(&hfh.messagesCreated, 1)
 	}
 
+	statser := stats.FromContext(ctx)
 	b := backoff.NewExponentialBackOff()
 	b.MaxElapsedTime = hfh.maxRequestElapsedTime
+	clck := clock.FromContext(ctx)
+	budget := stats.RetryBudgetFromContext(ctx)
+	budget.Sent(clck.Now())
 
 	for {
-		if err = post(); err == nil {
+		attempts++
+		postTimer := statser.NewTimer("http.forwarder.post_time", gostatsd.Tags{"type:" + endpointType})
+		err = post()
+		postTimer.Send()
+		if err == nil {
 			atomic.AddUint64(&hfh.messagesSent, 1)
+			atomic.StoreUint32(&target.lastPostFailed, 0)
 			return
 		}
 
 		next := b.NextBackOff()
+		if next != backoff.Stop && !budget.Retry(clck.Now()) {
+			logger.Debug("retry budget is spent")
+			next = backoff.Stop
+		}
+		if bp, ok := err.(*backpressureError); ok && next != backoff.Stop && bp.retryAfter > next {
+			// The upstream is overloaded, and asked for longer
+			next = bp.retryAfter
+		}
 		if next == backoff.Stop {
+			atomic.StoreUint32(&target.lastPostFailed, 1)
+			if hfh.spoolPayload(ctx, logger, target, endpointType, endpoint, raw, datapoints, version, dynHeaderTags) {
+				span.SetAttributes(tracing.OutcomeKey.String("spooled"))
+				logger.WithError(err).Info("failed to send, spooled")
+				return
+			}
+			span.SetAttributes(tracing.OutcomeKey.String("dropped"))
 			atomic.AddUint64(&hfh.messagesDropped, 1)
+			stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonForwarderSend, "", datapoints)
 			logger.WithError(err).Info("failed to send, giving up")
 			return
 		}
 
 		atomic.AddUint64(&hfh.messagesRetried, 1)
+		tracing.Retry(ctx, span, attempts, err, next)
 
 		timer := clock.NewTimer(ctx, next)
 		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// Shutting down, keep the payload for the next process if possible
+			if hfh.spoolPayload(ctx, logger, target, endpointType, endpoint, raw, datapoints, version, dynHeaderTags) {
+				span.SetAttributes(tracing.OutcomeKey.String("spooled"))
+			} else {
+				span.SetAttributes(tracing.OutcomeKey.String("dropped"))
+				atomic.AddUint64(&hfh.messagesDropped, 1)
+				stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonForwarderSend, "", datapoints)
+			}
+			err = ctx.Err()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// spoolPayload writes a payload which could not be sent to the spool, and returns true if it was spooled.  The
+// datapoints are counted as dropped if the payload is evicted or expires before it is replayed.
+func (hfh *HttpForwarderHandlerV2) spoolPayload(ctx context.Context, logger logrus.FieldLogger, target *forwarderTarget, endpointType, endpoint string, raw []byte, datapoints uint64, version int, dynHeaderTags string) bool {
+	if hfh.spool == nil {
+		return false
+	}
+	record, err := encodeSpoolEntry(&spoolEntry{
+		APIEndpoint:     target.apiEndpoint,
+		Endpoint:        endpoint,
+		EndpointType:    endpointType,
+		ProtocolVersion: version,
+		DynHeaderTags:   dynHeaderTags,
+	}, raw)
+	if err != nil {
+		logger.WithError(err).Warn("failed to spool")
+		return false
+	}
+	dropped, err := hfh.spool.Push(clock.FromContext(ctx).Now(), record, datapoints)
+	hfh.spoolDrop(ctx, dropped)
+	if err != nil {
+		logger.WithError(err).Warn("failed to spool")
+		return false
+	}
+	atomic.AddUint64(&hfh.messagesSpooled, 1)
+	return true
+}
+
+// spoolDrop counts the spooled payloads which were evicted, expired, or could not be read back.
+func (hfh *HttpForwarderHandlerV2) spoolDrop(ctx context.Context, dropped diskqueue.Dropped) {
+	if dropped.Records == 0 {
+		return
+	}
+	atomic.AddUint64(&hfh.spoolDropped, uint64(dropped.Records))
+	stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonForwarderSend, "", dropped.Items)
+}
+
+// replaySpool sends spooled payloads, oldest first, until the context is done.  A payload is only removed from the
+// spool once it has been sent.
+func (hfh *HttpForwarderHandlerV2) replaySpool(ctx context.Context) {
+	clck := clock.FromContext(ctx)
+	for {
+		wait := hfh.spoolReplayInterval
+		record, dropped := hfh.spool.Peek(clck.Now())
+		hfh.spoolDrop(ctx, dropped)
+		if record == nil {
+			wait = spoolPollInterval
+		} else if entry, raw, err := decodeSpoolEntry(record.Payload); err != nil {
+			hfh.logger.WithError(err).Warn("discarding unreadable spooled payload")
+			hfh.spool.Remove(record)
+			hfh.spoolDrop(ctx, diskqueue.Dropped{Records: 1, Items: record.Items})
+			wait = 0
+		} else if err := hfh.replay(ctx, entry, raw); err != nil {
+			hfh.logger.WithError(err).Debug("failed to replay spooled payload")
+			wait = spoolRetryInterval
+		} else {
+			hfh.spool.Remove(record)
+			atomic.AddUint64(&hfh.spoolReplayed, 1)
+		}
+
+		timer := clock.NewTimer(ctx, wait)
+		select {
 		case <-ctx.Done():
 			timer.Stop()
 			return
@@ -369,6 +962,43 @@ func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Messa
 	}
 }
 
+func (hfh *HttpForwarderHandlerV2) replay(ctx context.Context, entry *spoolEntry, raw []byte) error {
+	var target *forwarderTarget
+	for _, t := range hfh.targets {
+		if t.apiEndpoint == entry.APIEndpoint {
+			target = t
+			break
+		}
+	}
+	if target == nil {
+		// The upstream was removed from the configuration, so the payload is given to a remaining one
+		target = hfh.targets[hfh.ring.get(entry.APIEndpoint)]
+	}
+
+	logger := hfh.logger.WithFields(logrus.Fields{
+		"type":         entry.EndpointType,
+		"api-endpoint": target.apiEndpoint,
+		"spooled":      true,
+	})
+	version := entry.ProtocolVersion
+	if version == 0 {
+		// Spooled before the version was recorded
+		version = pb.ProtocolVersion2
+	}
+	ctx, span := tracing.Start(ctx, "forwarder.replay",
+		tracing.TypeKey.String(entry.EndpointType),
+		tracing.APIEndpointKey.String(target.apiEndpoint),
+		tracing.ProtocolVersionKey.Int(version),
+		tracing.AttemptsKey.Int(1),
+	)
+	post, err := hfh.constructPost(ctx, logger, target, entry.Endpoint, raw, version, entry.DynHeaderTags)
+	if err == nil {
+		err = post()
+	}
+	tracing.End(span, err)
+	return err
+}
+
 // debug rendering
 /*
 func (hh *HttpForwarderHandlerV2) serializeText(message proto.Message) ([]byte, error) {
@@ -390,49 +1020,97 @@ func (hfh *HttpForwarderHandlerV2) serialize(message proto.Message) ([]byte, err
 	return buf, nil
 }
 
-func (hfh *HttpForwarderHandlerV2) serializeAndCompress(message proto.Message) ([]byte, error) {
-	raw, err := hfh.serialize(message)
+// compress compresses the raw payload with the compression currently accepted by the target.
+func (hfh *HttpForwarderHandlerV2) compress(target *forwarderTarget, raw []byte) ([]byte, uint32, error) {
+	idx := atomic.LoadUint32(&target.compressorIndex)
+	body, err := hfh.compressors[idx].Compress(raw)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	atomic.AddUint64(&hfh.bytesRaw, uint64(len(raw)))
+	atomic.AddUint64(&hfh.bytesCompressed, uint64(len(body)))
+	return body, idx, nil
+}
 
-	buf := &bytes.Buffer{}
-	compressor, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
-	if err != nil {
-		return nil, err
+// negotiateCompression is called when the upstream rejects the compression at idx, and switches to the first fallback
+// which is listed in acceptEncoding.  If the upstream doesn't say what it accepts, the next fallback is used.
+func (hfh *HttpForwarderHandlerV2) negotiateCompression(logger logrus.FieldLogger, target *forwarderTarget, idx uint32, acceptEncoding string) {
+	next := idx + 1
+	for ; next < uint32(len(hfh.compressors))-1; next++ {
+		if acceptEncoding == "" || compression.AcceptsEncoding(acceptEncoding, hfh.compressors[next].Encoding()) {
+			break
+		}
 	}
-
-	_, _ = compressor.Write(raw) // error is propagated through Close
-	err = compressor.Close()
-	if err != nil {
-		return nil, err
+	if next >= uint32(len(hfh.compressors)) {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&target.compressorIndex, idx, next) {
+		logger.WithFields(logrus.Fields{
+			"rejected":        hfh.compressors[idx].Encoding(),
+			"compression":     hfh.compressors[next].Encoding(),
+			"accept-encoding": acceptEncoding,
+		}).Warn("upstream does not support compression, falling back")
 	}
-
-	return buf.Bytes(), nil
 }
 
-func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger logrus.FieldLogger, path string, message proto.Message, dynHeaderTags string) (func() error /*doPost*/, error) {
-	var body []byte
-	var err error
-	var encoding string
+// negotiateProtocolVersion is called with the versions listed by the upstream in a response to a payload of version,
+// and switches to the newest version supported by both.  An upstream which doesn't list its versions only supports
+// ProtocolVersion2.  It returns true if the upstream doesn't support version.
+func (hfh *HttpForwarderHandlerV2) negotiateProtocolVersion(logger logrus.FieldLogger, target *forwarderTarget, version int, versions string) bool {
+	negotiated := pb.ProtocolVersion2
+	if versions != "" {
+		var ok bool
+		if negotiated, ok = pb.NegotiateProtocolVersion(versions, hfh.maxProtocolVersion); !ok {
+			logger.WithField("versions", versions).Error("upstream does not support any protocol version")
+			return true
+		}
+	}
+	if previous := atomic.SwapUint32(&target.protocolVersion, uint32(negotiated)); previous != uint32(negotiated) {
+		logger.WithFields(logrus.Fields{
+			"previous": previous,
+			"version":  negotiated,
+			"versions": versions,
+		}).Info("negotiated protocol version")
+	}
+	if versions == "" {
+		return version != pb.ProtocolVersion2
+	}
+	accepted, ok := pb.NegotiateProtocolVersion(versions, version)
+	return !ok || accepted != version
+}
 
-	if hfh.compress {
-		body, err = hfh.serializeAndCompress(message)
-		encoding = "deflate"
-	} else {
-		body, err = hfh.serialize(message)
-		encoding = "identity"
+func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger logrus.FieldLogger, target *forwarderTarget, endpoint string, raw []byte, version int, dynHeaderTags string) (func() error /*doPost*/, error) {
+	if hfh.grpc != nil {
+		return func() error {
+			tracing.SetAttributes(ctx, tracing.PayloadBytesKey.Int(len(raw)))
+			ctx, cancel := transport.AttemptContext(ctx, hfh.requestTimeout)
+			defer cancel()
+			return hfh.grpc.send(ctx, target.apiEndpoint, endpoint, raw, version, dynHeaderTags)
+		}, nil
 	}
 
+	path := target.apiEndpoint + endpoint
+	body, idx, err := hfh.compress(target, raw)
 	if err != nil {
 		return nil, err
 	}
 
 	return func() error {
+		if atomic.LoadUint32(&target.compressorIndex) != idx {
+			// The compression was renegotiated since the body was compressed
+			var err error
+			body, idx, err = hfh.compress(target, raw)
+			if err != nil {
+				return fmt.Errorf("unable to compress: %v", err)
+			}
+		}
+		tracing.SetAttributes(ctx, tracing.PayloadBytesKey.Int(len(body)))
 		req, err := http.NewRequest("POST", path, bytes.NewReader(body))
 		if err != nil {
 			return fmt.Errorf("unable to create http.Request: %v", err)
 		}
+		ctx, cancel := transport.AttemptContext(ctx, hfh.requestTimeout)
+		defer cancel()
 		req = req.WithContext(ctx)
 		for _, tv := range strings.Split(dynHeaderTags, ",") {
 			vs := strings.SplitN(tv, ":", 2)
@@ -443,7 +1121,8 @@ func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger log
 		for header, v := range hfh.headers {
 			req.Header.Set(header, v)
 		}
-		req.Header.Set("Content-Encoding", encoding)
+		req.Header.Set("Content-Encoding", hfh.compressors[idx].Encoding())
+		req.Header.Set(pb.ProtocolVersionHeader, strconv.Itoa(version))
 		resp, err := hfh.client.Do(req)
 		if err != nil {
 			return fmt.Errorf("error POSTing: %v", err)
@@ -452,32 +1131,79 @@ func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger log
 			_, _ = io.Copy(ioutil.Discard, resp.Body)
 			resp.Body.Close()
 		}()
+		versionRejected := hfh.negotiateProtocolVersion(logger, target, version, resp.Header.Get(pb.ProtocolVersionsHeader))
+		if resp.StatusCode == http.StatusUnsupportedMediaType && !versionRejected {
+			hfh.negotiateCompression(logger, target, idx, resp.Header.Get("Accept-Encoding"))
+		}
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			bodyStart, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
 			logger.WithFields(logrus.Fields{
 				"status": resp.StatusCode,
 				"body":   string(bodyStart),
 			}).Info("failed request")
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+			err := fmt.Errorf("received bad status code %d", resp.StatusCode)
+			if retryAfter := parseRetryAfter(resp); retryAfter > 0 {
+				return &backpressureError{err: err, retryAfter: retryAfter}
+			}
+			return err
 		}
 		return nil
 	}, nil
 }
 
+// backpressureError is returned when an upstream rejects a request as it is rate limited or overloaded, and asks for
+// it to be retried later.
+type backpressureError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (bpe *backpressureError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", bpe.err, bpe.retryAfter)
+}
+
+// parseRetryAfter returns the delay in seconds in the Retry-After header of a 429 or 503 response, or 0 if there is
+// none.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 ///////// Event processing
 
-// Events are handled individually, because the context matters. If they're buffered through the consolidator, they'll
-// be processed on a goroutine with a context which will be closed during shutdown.  Events should be rare enough that
-// this isn't an issue.
+// Events are batched per upstream, and sent event-flush-interval after the first is dispatched, or once there are
+// max-event-batch-size of them.  They are sent with the values of the forwarder's context, but not its cancellation,
+// and with their own timeout, so they are sent or spooled rather than lost during shutdown.  Any events still pending
+// when the forwarder stops are sent by WaitForEvents.
 
 func (hfh *HttpForwarderHandlerV2) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
-	hfh.eventWg.Add(1)
-	go hfh.dispatchEvent(ctx, e)
-}
+	message := translateEventToProtobufV2(e)
+
+	// Events aren't aggregated, but events which may be aggregated downstream are kept together
+	key := e.AggregationKey
+	if key == "" {
+		key = e.Title
+	}
+	targetIdx := hfh.ring.get(key)
 
-func (hfh *HttpForwarderHandlerV2) dispatchEvent(ctx context.Context, e *gostatsd.Event) {
-	postId := atomic.AddUint64(&hfh.postId, 1) - 1
+	hfh.eventLock.Lock()
+	hfh.pendingEvents[targetIdx] = append(hfh.pendingEvents[targetIdx], message)
+	full := len(hfh.pendingEvents[targetIdx]) >= hfh.maxEventBatchSize
+	hfh.eventLock.Unlock()
 
+	signal(hfh.eventsPending)
+	if full {
+		signal(hfh.eventsFull)
+	}
+}
+
+func translateEventToProtobufV2(e *gostatsd.Event) *pb.EventV2 {
 	message := &pb.EventV2{
 		Title:          e.Title,
 		Text:           e.Text,
@@ -506,12 +1232,127 @@ func (hfh *HttpForwarderHandlerV2) dispatchEvent(ctx context.Context, e *gostats
 	case gostatsd.AlertSuccess:
 		message.Type = pb.EventV2_Success
 	}
+	return message
+}
 
-	hfh.post(ctx, message, "", postId, "event", "/v2/event")
+// flushEvents sends the pending events event-flush-interval after the first of them was dispatched, or sooner if an
+// upstream has a full batch.
+func (hfh *HttpForwarderHandlerV2) flushEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hfh.eventsPending:
+		}
+		timer := clock.NewTimer(ctx, hfh.eventFlushInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-hfh.eventsFull:
+			timer.Stop()
+		}
+		pending, valuesCtx := hfh.takePendingEvents()
+		hfh.sendEvents(valuesCtx, pending)
+	}
+}
+
+// takePendingEvents returns the pending events for each target, and the context they are sent with.
+func (hfh *HttpForwarderHandlerV2) takePendingEvents() ([][]*pb.EventV2, context.Context) {
+	hfh.eventLock.Lock()
+	defer hfh.eventLock.Unlock()
+	pending, valuesCtx := hfh.pendingEvents, hfh.eventValues
+	hfh.pendingEvents = make([][]*pb.EventV2, len(hfh.targets))
+	if valuesCtx == nil {
+		// Run hasn't been called
+		valuesCtx = context.Background()
+	}
+	return pending, valuesCtx
+}
 
-	defer hfh.eventWg.Done()
+// eventSendTime is how long a batch of events is given to be sent before it is spooled or dropped.
+func (hfh *HttpForwarderHandlerV2) eventSendTime() time.Duration {
+	if hfh.maxRequestElapsedTime > 0 {
+		return hfh.maxRequestElapsedTime
+	}
+	return maxEventSendTime
 }
 
+// sendEvents sends the events for each target in the background, in batches of up to max-event-batch-size.  The
+// context must not be canceled, as each batch is given its own timeout.
+func (hfh *HttpForwarderHandlerV2) sendEvents(valuesCtx context.Context, pending [][]*pb.EventV2) {
+	for targetIdx, events := range pending {
+		for len(events) > 0 {
+			batch := events
+			if len(batch) > hfh.maxEventBatchSize {
+				batch = batch[:hfh.maxEventBatchSize]
+			}
+			events = events[len(batch):]
+
+			hfh.eventWg.Add(1)
+			go func(target *forwarderTarget, batch []*pb.EventV2) {
+				defer hfh.eventWg.Done()
+				ctx, cancel := context.WithTimeout(valuesCtx, hfh.eventSendTime())
+				defer cancel()
+				hfh.postEvents(ctx, target, batch)
+			}(hfh.targets[targetIdx], batch)
+		}
+	}
+}
+
+// postEvents sends a batch of events.  An upstream which doesn't support ProtocolVersion3 is sent them one at a time
+// until it is known to, as are grpc streams, where every message is an event.
+func (hfh *HttpForwarderHandlerV2) postEvents(ctx context.Context, target *forwarderTarget, events []*pb.EventV2) {
+	for len(events) > 0 {
+		// The payload keeps the version it was encoded with across retries
+		version := int(atomic.LoadUint32(&target.protocolVersion))
+		single := version < pb.ProtocolVersion3 || hfh.grpc != nil
+		batch := events
+		if single {
+			batch = events[:1]
+		}
+		events = events[len(batch):]
+
+		postId := atomic.AddUint64(&hfh.postId, 1) - 1
+		logger := hfh.postLogger(target, postId, "event")
+		var raw []byte
+		var err error
+		if single {
+			raw, err = hfh.serialize(batch[0])
+		} else {
+			raw, err = pb.MarshalEventBatch(batch)
+		}
+		if err != nil {
+			atomic.AddUint64(&hfh.messagesInvalid, 1)
+			stats.DropAccountingFromContext(ctx).Dropped(stats.DropReasonForwarderSend, "", uint64(len(batch)))
+			logger.WithError(err).Error("failed to serialize request")
+			continue
+		}
+		hfh.send(ctx, logger, target, raw, uint64(len(batch)), version, "", "event", "/v2/event")
+	}
+}
+
+// WaitForEvents sends any pending events, and waits for every event to be sent.
 func (hfh *HttpForwarderHandlerV2) WaitForEvents() {
+	pending, valuesCtx := hfh.takePendingEvents()
+	hfh.sendEvents(valuesCtx, pending)
 	hfh.eventWg.Wait()
 }
+
+// valuesContext has the values of a context, such as its statser and drop accounting, but is never canceled.
+type valuesContext struct {
+	context.Context
+}
+
+func (valuesContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valuesContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valuesContext) Err() error {
+	return nil
+}
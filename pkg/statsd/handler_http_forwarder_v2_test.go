@@ -1,11 +1,22 @@
 package statsd
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/hligit/gostatsd"
@@ -225,9 +236,221 @@ func TestHttpForwarderV2New(t *testing.T) {
 			expected:   []string{"service:", "deploy:"},
 		},
 	} {
-		h, err := NewHttpForwarderHandlerV2(logger, "default", "endpoint", 1, 1, false, time.Second, time.Second,
-			cusHeaders, testcase.dynHeaders, pool)
+		h, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{"endpoint"}, 1, 1, "identity", 0, time.Second, time.Second,
+			cusHeaders, testcase.dynHeaders, GrpcOptions{}, SpoolOptions{}, QueueOptions{}, EventOptions{}, pool)
 		require.Nil(t, err)
 		require.Equal(t, h.dynHeaderNames, testcase.expected)
 	}
 }
+
+func TestHttpForwarderV2SplitByTarget(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	h, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{"http://a", "http://b"}, 1, 1, "identity", 0,
+		time.Second, time.Second, nil, nil, GrpcOptions{}, SpoolOptions{}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 100; i++ {
+		mm.Receive(&gostatsd.Metric{Name: "counter", Type: gostatsd.COUNTER, Value: 1, Rate: 1, Tags: gostatsd.Tags{fmt.Sprintf("id:%d", i)}})
+	}
+
+	mms := h.splitByTarget(mm)
+	require.Len(t, mms, 2)
+	for targetIdx, mmTarget := range mms {
+		// Both targets get a share, and each series is on the target the ring maps it to
+		require.NotEmpty(t, mmTarget.Counters["counter"])
+		for tagsKey := range mmTarget.Counters["counter"] {
+			require.Equal(t, targetIdx, h.ring.get("counter", tagsKey))
+		}
+	}
+	require.Equal(t, mm, gostatsd.MergeMaps(mms))
+}
+
+func TestHttpForwarderV2ApiEndpointsFromViper(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+
+	v := viper.New()
+	v.Set(gostatsd.ParamMaxParsers, 1)
+	v.Set("http-transport.api-endpoints", []string{"http://a", "http://b"})
+	h, err := NewHttpForwarderHandlerV2FromViper(logger, v, pool)
+	require.NoError(t, err)
+	require.Len(t, h.targets, 2)
+
+	v.Set("http-transport.api-endpoint", "http://c")
+	_, err = NewHttpForwarderHandlerV2FromViper(logger, v, pool)
+	require.Error(t, err)
+
+	v.Set("http-transport.api-endpoints", []string{"http://c", "http://c"})
+	v.Set("http-transport.api-endpoint", "")
+	_, err = NewHttpForwarderHandlerV2FromViper(logger, v, pool)
+	require.Error(t, err)
+}
+
+func TestHttpForwarderV2EventBatches(t *testing.T) {
+	t.Parallel()
+	var lock sync.Mutex
+	var versions []string
+	var sizes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		version := req.Header.Get(pb.ProtocolVersionHeader)
+		events := 1
+		if version == strconv.Itoa(pb.ProtocolVersion3) {
+			batch, err := pb.UnmarshalEventBatch(b)
+			require.NoError(t, err)
+			events = len(batch)
+		} else {
+			require.NoError(t, proto.Unmarshal(b, &pb.EventV2{}))
+		}
+		lock.Lock()
+		versions = append(versions, version)
+		sizes = append(sizes, events)
+		lock.Unlock()
+		w.Header().Set(pb.ProtocolVersionsHeader, "3, 2")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{server.URL}, 1, 1, "identity", 0,
+		time.Second, time.Second, nil, nil, GrpcOptions{}, SpoolOptions{}, QueueOptions{}, EventOptions{MaxBatchSize: 3}, pool)
+	require.NoError(t, err)
+
+	dispatch := func(n int) {
+		for i := 0; i < n; i++ {
+			hfh.DispatchEvent(context.Background(), &gostatsd.Event{Title: "deploy", Text: strconv.Itoa(i)})
+		}
+		hfh.WaitForEvents()
+	}
+
+	// Events are sent one at a time until the upstream is known to support batches
+	dispatch(3)
+	assert.Equal(t, []string{"2", "3"}, versions)
+	assert.Equal(t, []int{1, 2}, sizes)
+
+	// Batches are split at max-event-batch-size
+	versions, sizes = nil, nil
+	dispatch(4)
+	sort.Ints(sizes)
+	assert.Equal(t, []string{"3", "3"}, versions)
+	assert.Equal(t, []int{1, 3}, sizes)
+}
+
+func TestHttpForwarderV2EventsOutliveDispatchContext(t *testing.T) {
+	t.Parallel()
+	var attempts uint32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddUint32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{server.URL}, 1, 1, "identity", 0,
+		10*time.Millisecond, time.Second, nil, nil, GrpcOptions{}, SpoolOptions{}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	// The request which dispatched the event is long gone by the time it is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hfh.DispatchEvent(ctx, &gostatsd.Event{Title: "deploy"})
+	hfh.WaitForEvents()
+
+	assert.NotZero(t, atomic.LoadUint32(&attempts))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&hfh.messagesDropped))
+}
+
+func TestHttpForwarderV2Drain(t *testing.T) {
+	t.Parallel()
+	var posts uint32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Slow enough that the drain has to wait for the post
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddUint32(&posts, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	// The flush interval is never reached, so only the drain sends the metrics
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{server.URL}, 1, 1, "identity", 0,
+		time.Second, time.Hour, nil, nil, GrpcOptions{}, SpoolOptions{}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hfh.Run(ctx)
+	}()
+	defer wg.Wait()
+	defer cancel()
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "foo", Type: gostatsd.COUNTER, Value: 1, Rate: 1})
+	hfh.DispatchMetricMap(ctx, mm)
+
+	ctxDrain, cancelDrain := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelDrain()
+	require.NoError(t, hfh.Drain(ctxDrain))
+	assert.EqualValues(t, 1, atomic.LoadUint32(&posts))
+	assert.EqualValues(t, 0, atomic.LoadInt64(&hfh.batchesPending))
+}
+
+func TestHttpForwarderV2HonoursRetryAfter(t *testing.T) {
+	t.Parallel()
+	var lock sync.Mutex
+	var posts []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		posts = append(posts, time.Now())
+		if len(posts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{server.URL}, 1, 1, "identity", 0,
+		time.Minute, time.Hour, nil, nil, GrpcOptions{}, SpoolOptions{}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hfh.Run(ctx)
+	}()
+	defer wg.Wait()
+	defer cancel()
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "foo", Type: gostatsd.COUNTER, Value: 1, Rate: 1})
+	hfh.DispatchMetricMap(ctx, mm)
+	ctxDrain, cancelDrain := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelDrain()
+	require.NoError(t, hfh.Drain(ctxDrain))
+
+	// The retry waited for the upstream, rather than the shorter first backoff
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, posts, 2)
+	assert.True(t, posts[1].Sub(posts[0]) >= time.Second, "retried after %s", posts[1].Sub(posts[0]))
+}
@@ -0,0 +1,146 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/backends/statsdaemon"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// RelayHandler sends metrics and events to downstream statsd servers as they are received, without aggregating them,
+// so a tier of servers can spread the traffic over the tier which aggregates it.  Each metric is sent to the downstream
+// which owns its name on a consistent hash, so every series of a metric is aggregated by the same downstream, and
+// adding or removing a downstream only moves the metrics it owns.
+type RelayHandler struct {
+	logger      logrus.FieldLogger
+	ring        *hashRing
+	addresses   []string
+	downstreams []*statsdaemon.Client
+	stats       []relayStats
+	eventWg     sync.WaitGroup
+
+	// sendCtx is what metrics and events are sent with, rather than the context they are dispatched with, which is
+	// cancelled when an http request returns.  It is cancelled once the downstreams have stopped.
+	sendCtx    context.Context
+	cancelSend context.CancelFunc
+}
+
+// relayStats are the counts for a downstream, since the last flush.
+type relayStats struct {
+	series uint64 // atomic - series sent
+	failed uint64 // atomic - batches which failed to send
+}
+
+// NewRelayHandlerFromViper returns a RelayHandler for the downstreams in relay-downstreams.
+func NewRelayHandlerFromViper(logger logrus.FieldLogger, v *viper.Viper) (*RelayHandler, error) {
+	return NewRelayHandler(logger, v.GetStringSlice(gostatsd.ParamRelayDownstreams), v.GetBool(gostatsd.ParamRelayTCPTransport))
+}
+
+// NewRelayHandler returns a new RelayHandler which sends to the statsd servers at addresses, over TCP if tcp is true,
+// or UDP otherwise.
+func NewRelayHandler(logger logrus.FieldLogger, addresses []string, tcp bool) (*RelayHandler, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("%s must not be empty in relay mode", gostatsd.ParamRelayDownstreams)
+	}
+	rh := &RelayHandler{
+		logger:    logger.WithField("component", "relay"),
+		ring:      newHashRing(addresses),
+		addresses: addresses,
+		stats:     make([]relayStats, len(addresses)),
+	}
+	rh.sendCtx, rh.cancelSend = context.WithCancel(context.Background())
+	for _, address := range addresses {
+		client, err := statsdaemon.NewClient(address, statsdaemon.DefaultDialTimeout, statsdaemon.DefaultWriteTimeout, false, tcp, nil, rh.logger)
+		if err != nil {
+			return nil, fmt.Errorf("relay downstream %s: %v", address, err)
+		}
+		rh.downstreams = append(rh.downstreams, client)
+	}
+	return rh, nil
+}
+
+// Run sends to the downstreams until the context is done.
+func (rh *RelayHandler) Run(ctx context.Context) {
+	defer rh.cancelSend()
+	var wg wait.Group
+	defer wg.Wait()
+	for _, downstream := range rh.downstreams {
+		wg.StartWithContext(ctx, downstream.Run)
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (rh *RelayHandler) EstimatedTags() int {
+	return 0
+}
+
+// DispatchMetricMap splits the MetricMap by the downstream which owns the name of each metric, and sends each part.
+func (rh *RelayHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	shards := mm.SplitByBucket(len(rh.downstreams), func(metricName string, tagsKey string) int {
+		return rh.ring.get(metricName)
+	})
+	for i, shard := range shards {
+		if shard.IsEmpty() {
+			continue
+		}
+		rs := &rh.stats[i]
+		atomic.AddUint64(&rs.series, uint64(shard.Len()))
+		address := rh.addresses[i]
+		rh.downstreams[i].SendMetricsAsync(rh.sendCtx, shard, func(errs []error) {
+			for _, err := range errs {
+				if err != nil {
+					atomic.AddUint64(&rs.failed, 1)
+					rh.logger.WithError(err).WithField("downstream", address).Warn("failed to relay metrics")
+					return
+				}
+			}
+		})
+	}
+}
+
+// DispatchEvent sends the event to the downstream which owns its title.
+func (rh *RelayHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	i := rh.ring.get(e.Title)
+	rh.eventWg.Add(1)
+	go func() {
+		defer rh.eventWg.Done()
+		if err := rh.downstreams[i].SendEvent(rh.sendCtx, e); err != nil {
+			atomic.AddUint64(&rh.stats[i].failed, 1)
+			rh.logger.WithError(err).WithField("downstream", rh.addresses[i]).Warn("failed to relay event")
+		}
+	}()
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (rh *RelayHandler) WaitForEvents() {
+	rh.eventWg.Wait()
+}
+
+// RunMetricsContext writes the series relayed to each downstream, and the sends which failed, since the last flush,
+// every flush until the context is done.
+func (rh *RelayHandler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			for i := range rh.stats {
+				tags := gostatsd.Tags{"downstream:" + rh.addresses[i]}
+				statser.Count("relay.series", float64(atomic.SwapUint64(&rh.stats[i].series, 0)), tags)
+				statser.Count("relay.failed", float64(atomic.SwapUint64(&rh.stats[i].failed, 0)), tags)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+// udpCollector records the lines of every datagram it receives.
+type udpCollector struct {
+	conn  net.PacketConn
+	lock  sync.Mutex
+	lines []string
+}
+
+func newUDPCollector(t *testing.T) *udpCollector {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	uc := &udpCollector{conn: conn}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			uc.lock.Lock()
+			uc.lines = append(uc.lines, strings.Split(strings.TrimSpace(string(buf[:n])), "\n")...)
+			uc.lock.Unlock()
+		}
+	}()
+	return uc
+}
+
+func (uc *udpCollector) received() []string {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	return append([]string(nil), uc.lines...)
+}
+
+func TestRelayHandlerShardsByName(t *testing.T) {
+	t.Parallel()
+	downstreams := []*udpCollector{newUDPCollector(t), newUDPCollector(t)}
+	var addresses []string
+	for _, ds := range downstreams {
+		defer ds.conn.Close()
+		addresses = append(addresses, ds.conn.LocalAddr().String())
+	}
+
+	_, err := NewRelayHandler(logrus.New(), nil, false)
+	require.Error(t, err)
+	rh, err := NewRelayHandler(logrus.New(), addresses, false)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rh.Run(ctx)
+
+	mm := gostatsd.NewMetricMap()
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, name := range names {
+		mm.Receive(&gostatsd.Metric{Name: name, Value: 2, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:1"}})
+		mm.Receive(&gostatsd.Metric{Name: name, Value: 3, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:2"}})
+	}
+	rh.DispatchMetricMap(context.Background(), mm)
+	rh.DispatchEvent(context.Background(), &gostatsd.Event{Title: "deploy", Text: "v2"})
+	rh.WaitForEvents()
+
+	total := func() int { return len(downstreams[0].received()) + len(downstreams[1].received()) }
+	require.Eventually(t, func() bool { return total() == 2*len(names)+1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Every series of a metric is sent to the downstream which owns its name
+	for i, ds := range downstreams {
+		for _, line := range ds.received() {
+			if strings.HasPrefix(line, "_e{") {
+				assert.Equal(t, "_e{6,2}:deploy|v2", line)
+				assert.Equal(t, rh.ring.get("deploy"), i)
+				continue
+			}
+			name := line[:strings.IndexByte(line, ':')]
+			assert.Equal(t, rh.ring.get(name), i, line)
+			assert.Contains(t, []string{name + ":2|c|#x:1", name + ":3|c|#x:2"}, line)
+		}
+	}
+	assert.NotEmpty(t, downstreams[0].received())
+	assert.NotEmpty(t, downstreams[1].received())
+}
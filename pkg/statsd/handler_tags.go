@@ -2,6 +2,10 @@ package statsd
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -12,6 +16,7 @@ import (
 type TagHandler struct {
 	handler       gostatsd.PipelineHandler
 	tags          gostatsd.Tags // Tags to add to all metrics
+	filtersLock   sync.RWMutex  // Held for reading while a map is dispatched, so filters can be reloaded
 	filters       []Filter
 	estimatedTags int
 }
@@ -19,6 +24,10 @@ type TagHandler struct {
 var present = struct{}{}
 
 func NewTagHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler, tags gostatsd.Tags) *TagHandler {
+	return NewTagHandler(handler, tags, filtersFromViper(v))
+}
+
+func filtersFromViper(v *viper.Viper) []Filter {
 	filterNameList := v.GetStringSlice("filters")
 	var filters []Filter
 	for _, filterName := range filterNameList {
@@ -30,7 +39,39 @@ func NewTagHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler, ta
 		filters = append(filters, NewFilterFromViper(vFilter))
 		logrus.Infof("Loaded filter %v", filterName)
 	}
-	return NewTagHandler(handler, tags, filters)
+	return filters
+}
+
+// filterSettings are the settings of a filter section.
+var filterSettings = map[string]bool{
+	"match-metrics":   true,
+	"exclude-metrics": true,
+	"match-tags":      true,
+	"drop-tags":       true,
+	"drop-host":       true,
+	"drop-metric":     true,
+}
+
+// CheckFilters returns an error listing every filter which does not have a section, and every setting of a filter
+// section which is not known, so a typo is not silently ignored.
+func CheckFilters(v *viper.Viper) error {
+	var errs []string
+	for _, filterName := range v.GetStringSlice("filters") {
+		vFilter := v.Sub("filter." + filterName)
+		if vFilter == nil {
+			errs = append(errs, fmt.Sprintf("filter %q has no filter.%s section", filterName, filterName))
+			continue
+		}
+		for _, key := range vFilter.AllKeys() {
+			if !filterSettings[key] {
+				errs = append(errs, fmt.Sprintf("unknown setting filter.%s.%s", filterName, key))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 // NewTagHandler initialises a new handler which adds unique tags, and sends metrics/events to the next handler based
@@ -45,6 +86,16 @@ func NewTagHandler(handler gostatsd.PipelineHandler, tags gostatsd.Tags, filters
 	}
 }
 
+// ReloadConfig replaces the filters with the filters in v.  Metrics which are being dispatched are completed with the
+// previous filters.
+func (th *TagHandler) ReloadConfig(ctx context.Context, v *viper.Viper) error {
+	filters := filtersFromViper(v)
+	th.filtersLock.Lock()
+	defer th.filtersLock.Unlock()
+	th.filters = filters
+	return nil
+}
+
 // EstimatedTags returns a guess for how many tags to pre-allocate
 func (th *TagHandler) EstimatedTags() int {
 	return th.estimatedTags
@@ -58,6 +109,8 @@ func (th *TagHandler) EstimatedTags() int {
 func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
 	mmNew := gostatsd.NewMetricMap()
 
+	th.filtersLock.RLock()
+
 	mm.Counters.Each(func(metricName, _ string, cOriginal gostatsd.Counter) {
 		if th.uniqueFilterAndAddTags(metricName, &cOriginal.Source, &cOriginal.Tags) {
 			newTagsKey := gostatsd.FormatTagsKey(cOriginal.Source, cOriginal.Tags)
@@ -131,6 +184,8 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 		}
 	})
 
+	th.filtersLock.RUnlock()
+
 	if !mmNew.IsEmpty() {
 		th.handler.DispatchMetricMap(ctx, mmNew)
 	}
@@ -202,9 +257,36 @@ func (th *TagHandler) WaitForEvents() {
 	th.handler.WaitForEvents()
 }
 
+// maxLinearUniqueTags is the most tags uniqueTags de-duplicates by comparing every pair, rather than allocating a map.
+const maxLinearUniqueTags = 16
+
 // uniqueTags returns the set of t1 | t2.  It may modify the contents of t1 and t2.
 func uniqueTags(t1 gostatsd.Tags, t2 gostatsd.Tags) gostatsd.Tags {
-	return uniqueTagsWithSeen(map[string]struct{}{}, t1, t2)
+	if len(t1)+len(t2) > maxLinearUniqueTags {
+		return uniqueTagsWithSeen(map[string]struct{}{}, t1, t2)
+	}
+	// Small tag sets are de-duplicated in place, keeping their order, so they don't need to be sorted again.
+	unique := t1[:0]
+	for _, tag := range t1 {
+		if !containsTag(unique, tag) {
+			unique = append(unique, tag)
+		}
+	}
+	for _, tag := range t2 {
+		if !containsTag(unique, tag) {
+			unique = append(unique, tag)
+		}
+	}
+	return unique
+}
+
+func containsTag(tags gostatsd.Tags, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // uniqueTags returns the set of (t1 | t2) - seen.  It may modify the contents of t1, t2, and seen.
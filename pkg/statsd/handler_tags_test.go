@@ -3,6 +3,7 @@ package statsd
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"sort"
 	"strings"
 	"testing"
@@ -505,6 +506,23 @@ func TestTagEventHandlerAddsDuplicateTags(t *testing.T) {
 	assert.Equal(t, gostatsd.UnknownSource, tch.e[0].Source) // No hostname added
 }
 
+func TestUniqueTags(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, gostatsd.Tags{"c", "a", "b"}, uniqueTags(gostatsd.Tags{"c", "a", "c"}, gostatsd.Tags{"b", "a", "b"}))
+	assert.Empty(t, uniqueTags(nil, nil))
+
+	// Large tag sets are de-duplicated with a map, which does not keep their order
+	var t1, t2 gostatsd.Tags
+	for i := 0; i < maxLinearUniqueTags; i++ {
+		t1 = append(t1, fmt.Sprintf("tag%d", i))
+		t2 = append(t2, fmt.Sprintf("tag%d", i+1))
+	}
+	unique := uniqueTags(t1, t2)
+	sort.Strings(unique)
+	require.Len(t, unique, maxLinearUniqueTags+1)
+	assert.Equal(t, "tag0", unique[0])
+}
+
 func BenchmarkTagMetricHandlerAddsDuplicateTagsSmall(b *testing.B) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{
@@ -632,3 +650,51 @@ func BenchmarkTagEventHandlerAddsDuplicateTagsLarge(b *testing.B) {
 		th.DispatchEvent(context.Background(), e)
 	}
 }
+
+func TestTagHandlerReloadConfig(t *testing.T) {
+	t.Parallel()
+
+	tch := &capturingHandler{}
+	th := NewTagHandler(tch, gostatsd.Tags{}, []Filter{
+		{
+			MatchMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("name")},
+			DropMetric:   true,
+		},
+	})
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(MakeMetric())
+	th.DispatchMetricMap(context.Background(), mm)
+	require.Len(t, tch.mm, 0)
+
+	v := viper.New()
+	v.Set("filters", []string{"drop-other"})
+	v.Set("filter.drop-other.match-metrics", "other")
+	v.Set("filter.drop-other.drop-metric", true)
+	require.NoError(t, th.ReloadConfig(context.Background(), v))
+
+	mm = gostatsd.NewMetricMap()
+	mm.Receive(MakeMetric())
+	th.DispatchMetricMap(context.Background(), mm)
+	require.Len(t, tch.mm, 1)
+}
+
+func TestCheckFilters(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+filters = ['valid', 'typo', 'missing']
+[filter.valid]
+match-metrics = ['a']
+drop-metric = true
+[filter.typo]
+match-metric = ['a']
+`)))
+	err := CheckFilters(v)
+	require.Error(t, err)
+	assert.Equal(t, `unknown setting filter.typo.match-metric; filter "missing" has no filter.missing section`, err.Error())
+
+	v.Set("filters", []string{"valid"})
+	assert.NoError(t, CheckFilters(v))
+}
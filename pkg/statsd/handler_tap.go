@@ -0,0 +1,149 @@
+package statsd
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+// tapBufferSize is the number of series buffered for each tap, before they are dropped.
+const tapBufferSize = 100
+
+// TapHandler passes metrics to the next stage of the pipeline, and streams a sample of them to any taps, so they
+// can be inspected while debugging.  It costs an atomic load per MetricMap when nothing is tapping it.
+type TapHandler struct {
+	numTaps int32 // atomic - len(taps), so the lock is only taken when there are taps
+
+	handler gostatsd.PipelineHandler
+
+	lock sync.RWMutex // Held for reading while sending to taps, and for writing while adding or removing them
+	taps map[*metricTap]struct{}
+}
+
+type metricTap struct {
+	filter  web.TapFilter
+	limiter *rate.Limiter
+	series  chan web.SeriesState
+}
+
+// NewTapHandler returns a new TapHandler which passes metrics to handler.
+func NewTapHandler(handler gostatsd.PipelineHandler) *TapHandler {
+	return &TapHandler{
+		handler: handler,
+		taps:    map[*metricTap]struct{}{},
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (th *TapHandler) EstimatedTags() int {
+	return th.handler.EstimatedTags()
+}
+
+// DispatchMetricMap sends a sample of the MetricMap to any taps, and passes it to the next stage in the pipeline.
+func (th *TapHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	if atomic.LoadInt32(&th.numTaps) > 0 {
+		th.tapMetricMap(mm)
+	}
+	th.handler.DispatchMetricMap(ctx, mm)
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline.
+func (th *TapHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	th.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (th *TapHandler) WaitForEvents() {
+	th.handler.WaitForEvents()
+}
+
+// Tap returns the series matching the filter as they are received, until cancel is called.
+func (th *TapHandler) Tap(filter web.TapFilter) (<-chan web.SeriesState, func()) {
+	burst := int(filter.Rate)
+	if burst < 1 {
+		burst = 1
+	}
+	mt := &metricTap{
+		filter:  filter,
+		limiter: rate.NewLimiter(rate.Limit(filter.Rate), burst),
+		series:  make(chan web.SeriesState, tapBufferSize),
+	}
+
+	th.lock.Lock()
+	th.taps[mt] = struct{}{}
+	atomic.StoreInt32(&th.numTaps, int32(len(th.taps)))
+	th.lock.Unlock()
+
+	var once sync.Once
+	return mt.series, func() {
+		once.Do(func() {
+			th.lock.Lock()
+			delete(th.taps, mt)
+			atomic.StoreInt32(&th.numTaps, int32(len(th.taps)))
+			th.lock.Unlock()
+			close(mt.series)
+		})
+	}
+}
+
+func (th *TapHandler) tapMetricMap(mm *gostatsd.MetricMap) {
+	th.lock.RLock()
+	defer th.lock.RUnlock()
+
+	// value is only called for series which are sent, as it copies the values
+	send := func(typ, name string, source gostatsd.Source, tags gostatsd.Tags, samples int, value func() interface{}) {
+		for mt := range th.taps {
+			if len(mt.filter.MatchMetrics) > 0 && !mt.filter.MatchMetrics.MatchAny(name) {
+				continue
+			}
+			if len(mt.filter.MatchTags) > 0 && !mt.filter.MatchTags.MatchAnyMultiple(tags) {
+				continue
+			}
+			if !mt.limiter.Allow() {
+				continue
+			}
+			// Tags are copied, as the rest of the pipeline owns them
+			series := web.SeriesState{
+				Type:    typ,
+				Name:    name,
+				Source:  source,
+				Tags:    tags.Copy(),
+				Samples: samples,
+				Value:   value(),
+			}
+			select {
+			case mt.series <- series:
+			default:
+				// The tap is not keeping up
+			}
+		}
+	}
+
+	mm.Counters.Each(func(name, _ string, c gostatsd.Counter) {
+		send("counter", name, c.Source, c.Tags, 1, func() interface{} { return c.Value })
+	})
+	mm.Gauges.Each(func(name, _ string, g gostatsd.Gauge) {
+		send("gauge", name, g.Source, g.Tags, 1, func() interface{} { return g.Value })
+	})
+	mm.Timers.Each(func(name, _ string, t gostatsd.Timer) {
+		send("timer", name, t.Source, t.Tags, len(t.Values), func() interface{} {
+			return append([]float64(nil), t.Values...)
+		})
+	})
+	mm.Sets.Each(func(name, _ string, s gostatsd.Set) {
+		send("set", name, s.Source, s.Tags, len(s.Values), func() interface{} {
+			values := make([]string, 0, len(s.Values))
+			for value := range s.Values {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+			return values
+		})
+	})
+}
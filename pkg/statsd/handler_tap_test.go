@@ -0,0 +1,86 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+func tapTestMetricMap() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "app.requests", Value: 1, Rate: 1, Tags: gostatsd.Tags{"service:api"}, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "app.latency", Value: 10, Rate: 1, Tags: gostatsd.Tags{"service:api"}, Type: gostatsd.TIMER})
+	mm.Receive(&gostatsd.Metric{Name: "app.users", StringValue: "bob", Rate: 1, Tags: gostatsd.Tags{"service:web"}, Type: gostatsd.SET})
+	mm.Receive(&gostatsd.Metric{Name: "other.gauge", Value: 5, Rate: 1, Type: gostatsd.GAUGE})
+	return mm
+}
+
+func drainTap(series <-chan web.SeriesState) []web.SeriesState {
+	var result []web.SeriesState
+	for {
+		select {
+		case s := <-series:
+			result = append(result, s)
+		default:
+			return result
+		}
+	}
+}
+
+func TestTapHandlerFilters(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	th := NewTapHandler(ch)
+
+	series, cancel := th.Tap(web.TapFilter{
+		MatchMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("app.*")},
+		MatchTags:    gostatsd.StringMatchList{gostatsd.NewStringMatch("service:api")},
+		Rate:         1000,
+	})
+	defer cancel()
+
+	th.DispatchMetricMap(context.Background(), tapTestMetricMap())
+	require.Len(t, ch.mm, 1, "metrics are passed through")
+
+	tapped := drainTap(series)
+	require.Len(t, tapped, 2)
+	byType := map[string]web.SeriesState{}
+	for _, s := range tapped {
+		byType[s.Type] = s
+	}
+	assert.Equal(t, "app.requests", byType["counter"].Name)
+	assert.EqualValues(t, 1, byType["counter"].Value)
+	assert.Equal(t, gostatsd.Tags{"service:api"}, byType["counter"].Tags)
+	assert.Equal(t, "app.latency", byType["timer"].Name)
+	assert.Equal(t, []float64{10}, byType["timer"].Value)
+}
+
+func TestTapHandlerRateLimit(t *testing.T) {
+	t.Parallel()
+	th := NewTapHandler(&nopHandler{})
+
+	series, cancel := th.Tap(web.TapFilter{Rate: 1})
+	defer cancel()
+
+	th.DispatchMetricMap(context.Background(), tapTestMetricMap())
+	assert.Len(t, drainTap(series), 1)
+}
+
+func TestTapHandlerCancel(t *testing.T) {
+	t.Parallel()
+	th := NewTapHandler(&nopHandler{})
+
+	series, cancel := th.Tap(web.TapFilter{Rate: 1000})
+	cancel()
+	cancel() // safe to call more than once
+
+	_, ok := <-series
+	assert.False(t, ok)
+	assert.Zero(t, th.numTaps)
+	th.DispatchMetricMap(context.Background(), tapTestMetricMap())
+}
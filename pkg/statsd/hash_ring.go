@@ -0,0 +1,52 @@
+package statsd
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+// hashRingReplicas is the number of points each node has on a hashRing, so keys are spread evenly between nodes.
+const hashRingReplicas = 128
+
+// hashRing is a consistent hash of keys to nodes.  A key is always mapped to the same node, and when a node is added
+// or removed only the keys mapped to that node are moved.  It is immutable, and safe for concurrent use.
+type hashRing struct {
+	points []uint64 // sorted
+	nodes  []int    // the index of the node owning the point at the same index in points
+}
+
+// newHashRing creates a hashRing of the named nodes.  The nodes are identified by their index in names.
+func newHashRing(names []string) *hashRing {
+	hr := &hashRing{
+		points: make([]uint64, 0, len(names)*hashRingReplicas),
+		nodes:  make([]int, 0, len(names)*hashRingReplicas),
+	}
+	owners := make(map[uint64]int, len(names)*hashRingReplicas)
+	for node, name := range names {
+		for replica := 0; replica < hashRingReplicas; replica++ {
+			point := util.HashKey(name, strconv.Itoa(replica))
+			if _, ok := owners[point]; ok {
+				continue // A collision keeps the first owner, so the ring doesn't depend on map ordering
+			}
+			owners[point] = node
+			hr.points = append(hr.points, point)
+		}
+	}
+	sort.Slice(hr.points, func(i, j int) bool { return hr.points[i] < hr.points[j] })
+	for _, point := range hr.points {
+		hr.nodes = append(hr.nodes, owners[point])
+	}
+	return hr
+}
+
+// get returns the index of the node which owns the key made of parts.
+func (hr *hashRing) get(parts ...string) int {
+	point := util.HashKey(parts...)
+	idx := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= point })
+	if idx == len(hr.points) {
+		idx = 0
+	}
+	return hr.nodes[idx]
+}
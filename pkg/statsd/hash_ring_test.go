@@ -0,0 +1,43 @@
+package statsd
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashRingDistribution(t *testing.T) {
+	t.Parallel()
+	hr := newHashRing([]string{"http://a", "http://b", "http://c"})
+
+	const keys = 30000
+	counts := make([]int, 3)
+	for i := 0; i < keys; i++ {
+		counts[hr.get("metric", strconv.Itoa(i))]++
+	}
+	for node, count := range counts {
+		// Perfectly even would be 10000 each
+		assert.InDelta(t, keys/3, count, keys/10, "node %d", node)
+	}
+}
+
+func TestHashRingAddNode(t *testing.T) {
+	t.Parallel()
+	hr := newHashRing([]string{"http://a", "http://b", "http://c"})
+	hrAdded := newHashRing([]string{"http://a", "http://b", "http://c", "http://d"})
+
+	const keys = 10000
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		before, after := hr.get("metric", key), hrAdded.get("metric", key)
+		if before != after {
+			// Keys only move to the new node
+			require.Equal(t, 3, after)
+			moved++
+		}
+	}
+	assert.InDelta(t, keys/4, moved, keys/10)
+}
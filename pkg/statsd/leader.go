@@ -0,0 +1,204 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// serviceAccountNamespaceFile is where Kubernetes writes the namespace of the pod, used for the lease if no namespace
+// is configured.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// leaderElector elects one of the replicas of a Deployment as the leader, with a Kubernetes Lease.  Every replica
+// aggregates and sends its own series, but the outputs which would be duplicated by every replica sending them, the
+// heartbeat and the events, are only sent by the leader.
+type leaderElector struct {
+	logger logrus.FieldLogger
+	config leaderelection.LeaderElectionConfig
+
+	leading     int32  // atomic - non-zero while this server is the leader
+	transitions uint64 // atomic - times leadership was gained or lost, since the last flush
+}
+
+func newLeaderElector(logger logrus.FieldLogger, client kubernetes.Interface, namespace, name, identity string, leaseDuration, renewDeadline, retryPeriod time.Duration) (*leaderElector, error) {
+	if identity == "" {
+		return nil, errors.New("leader-election-identity must not be empty")
+	}
+	le := &leaderElector{
+		logger: logger.WithFields(logrus.Fields{
+			"component": "leader",
+			"lease":     namespace + "/" + name,
+			"identity":  identity,
+		}),
+	}
+	le.config = leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { le.setLeading(true) },
+			OnStoppedLeading: func() { le.setLeading(false) },
+		},
+	}
+	// Validate the configuration now, rather than when it is run
+	if _, err := leaderelection.NewLeaderElector(le.config); err != nil {
+		return nil, fmt.Errorf("invalid leader election: %v", err)
+	}
+	return le, nil
+}
+
+// newLeaderElectorFromServer creates the leader elector configured by s, with the Kubernetes client from s or the
+// in-cluster configuration.
+func newLeaderElectorFromServer(logger logrus.FieldLogger, s *Server) (*leaderElector, error) {
+	client := s.LeaderElectionClient
+	if client == nil {
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("leader election requires running in Kubernetes: %v", err)
+		}
+		restConfig.UserAgent = "gostatsd"
+		if client, err = kubernetes.NewForConfig(restConfig); err != nil {
+			return nil, err
+		}
+	}
+	namespace := s.LeaderElectionNamespace
+	if namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("leader-election-namespace is not set, and the namespace of the pod is unknown: %v", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	identity := s.LeaderElectionIdentity
+	if identity == "" {
+		identity = string(s.Hostname)
+	}
+	return newLeaderElector(logger, client, namespace, s.LeaderElectionLease, identity,
+		s.LeaderElectionLeaseDuration, s.LeaderElectionRenewDeadline, s.LeaderElectionRetryPeriod)
+}
+
+// Run takes part in the election until the context is done.  Each time leadership is lost, this server becomes a
+// candidate again.  The lease is released when the context is done, so another replica takes over without waiting
+// for it to expire.
+func (le *leaderElector) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(le.config)
+		if err != nil {
+			// Not possible, it was validated when created
+			le.logger.WithError(err).Error("invalid leader election")
+			return
+		}
+		elector.Run(ctx)
+	}
+}
+
+// IsLeader returns true if this server is the leader.  A nil leaderElector is always the leader, so the outputs it
+// gates are sent by every server when leader election is disabled.
+func (le *leaderElector) IsLeader() bool {
+	return le == nil || atomic.LoadInt32(&le.leading) != 0
+}
+
+func (le *leaderElector) setLeading(leading bool) {
+	var value int32
+	if leading {
+		value = 1
+	}
+	if atomic.SwapInt32(&le.leading, value) != value {
+		atomic.AddUint64(&le.transitions, 1)
+		if leading {
+			le.logger.Info("became the leader")
+		} else {
+			le.logger.Info("stopped being the leader")
+		}
+	}
+}
+
+// RunMetricsContext writes if this server is the leader, and the leadership transitions since the last flush, every
+// flush until the context is done.
+func (le *leaderElector) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("leader.is_leader", float64(atomic.LoadInt32(&le.leading)), nil)
+			statser.Count("leader.transitions", float64(atomic.SwapUint64(&le.transitions, 0)), nil)
+		}
+	}
+}
+
+// LeaderHandler passes metrics to the next stage of the pipeline, and only passes events while this server is the
+// leader, so each event received by every replica is sent once.
+type LeaderHandler struct {
+	handler gostatsd.PipelineHandler
+	leader  *leaderElector
+
+	skipped uint64 // atomic - events not sent as this server is not the leader, since the last flush
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (lh *LeaderHandler) EstimatedTags() int {
+	return lh.handler.EstimatedTags()
+}
+
+// DispatchMetricMap passes the MetricMap to the next stage in the pipeline.
+func (lh *LeaderHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	lh.handler.DispatchMetricMap(ctx, mm)
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline if this server is the leader, and drops it
+// otherwise.
+func (lh *LeaderHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	if !lh.leader.IsLeader() {
+		atomic.AddUint64(&lh.skipped, 1)
+		return
+	}
+	lh.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (lh *LeaderHandler) WaitForEvents() {
+	lh.handler.WaitForEvents()
+}
+
+// RunMetricsContext writes the events skipped since the last flush, every flush until the context is done.
+func (lh *LeaderHandler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Count("leader.events.skipped", float64(atomic.SwapUint64(&lh.skipped, 0)), nil)
+		}
+	}
+}
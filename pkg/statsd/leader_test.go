@@ -0,0 +1,68 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestLeaderElectionHandsOver(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+
+	_, err := newLeaderElector(logrus.New(), client, "default", "gostatsd", "", time.Second, 500*time.Millisecond, 100*time.Millisecond)
+	require.Error(t, err)
+	_, err = newLeaderElector(logrus.New(), client, "default", "gostatsd", "a", time.Second, 2*time.Second, 100*time.Millisecond)
+	require.Error(t, err)
+
+	var electors [2]*leaderElector
+	var cancels [2]context.CancelFunc
+	done := make(chan struct{}, len(electors))
+	for i, identity := range []string{"a", "b"} {
+		electors[i], err = newLeaderElector(logrus.New(), client, "default", "gostatsd", identity, time.Second, 500*time.Millisecond, 100*time.Millisecond)
+		require.NoError(t, err)
+		assert.False(t, electors[i].IsLeader())
+		var ctx context.Context
+		ctx, cancels[i] = context.WithCancel(context.Background())
+		defer cancels[i]()
+		go func(le *leaderElector) {
+			le.Run(ctx)
+			done <- struct{}{}
+		}(electors[i])
+		if i == 0 {
+			require.Eventually(t, electors[0].IsLeader, 5*time.Second, 10*time.Millisecond)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, electors[0].IsLeader())
+	assert.False(t, electors[1].IsLeader())
+
+	// Events are only sent by the leader
+	var handlers [2]*capturingHandler
+	for i := range handlers {
+		handlers[i] = &capturingHandler{}
+		lh := &LeaderHandler{handler: handlers[i], leader: electors[i]}
+		lh.DispatchEvent(context.Background(), &gostatsd.Event{Title: "event"})
+		lh.DispatchMetricMap(context.Background(), gostatsd.NewMetricMap())
+		assert.Len(t, handlers[i].mm, 1)
+	}
+	assert.Len(t, handlers[0].e, 1)
+	assert.Empty(t, handlers[1].e)
+
+	// The lease is released when the leader stops, so the other replica takes over before it expires
+	cancels[0]()
+	<-done
+	assert.False(t, electors[0].IsLeader())
+	require.Eventually(t, electors[1].IsLeader, 900*time.Millisecond, 10*time.Millisecond)
+
+	// Leader election disabled
+	var disabled *leaderElector
+	assert.True(t, disabled.IsLeader())
+}
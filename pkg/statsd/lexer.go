@@ -5,8 +5,10 @@ import (
 	"errors"
 	"math"
 	"strconv"
+	"unsafe"
 
 	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/intern"
 	"github.com/hligit/gostatsd/internal/pool"
 )
 
@@ -19,14 +21,19 @@ type lexer struct {
 	eventTextLen  uint32
 	m             *gostatsd.Metric
 	e             *gostatsd.Event
+	value         []byte // The value of the metric, which is part of input
 	tags          gostatsd.Tags
 	namespace     string
 	err           error
 	sampling      float64
 
 	metricPool *pool.MetricPool
+	interner   *intern.Interner // Shares the names and tags of metrics, may be nil
 }
 
+// maxNamespacedName is the longest name which is prefixed with the namespace without allocating.
+const maxNamespacedName = 256
+
 // assumes we don't have \x00 bytes in input.
 const eof byte = 0
 
@@ -41,6 +48,8 @@ var (
 	errOverflow              = errors.New("overflow")
 	errNotEnoughData         = errors.New("not enough data")
 	errNaN                   = errors.New("invalid value NaN")
+	errInvalidValue          = errors.New("invalid value")
+	errInvalidSampleRate     = errors.New("invalid sample rate")
 )
 
 var escapedNewline = []byte("\\n")
@@ -77,16 +86,17 @@ func (l *lexer) run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd
 	}
 	if l.m != nil {
 		l.m.Rate = l.sampling
-		if l.m.Type != gostatsd.SET {
-			v, err := strconv.ParseFloat(l.m.StringValue, 64)
+		if l.m.Type == gostatsd.SET {
+			l.m.StringValue = string(l.value)
+		} else {
+			v, err := strconv.ParseFloat(transientString(l.value), 64)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, errInvalidValue
 			}
 			if math.IsNaN(v) {
 				return nil, nil, errNaN
 			}
 			l.m.Value = v
-			l.m.StringValue = ""
 		}
 		l.m.Tags = l.tags
 	} else {
@@ -95,6 +105,12 @@ func (l *lexer) run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd
 	return l.m, l.e, nil
 }
 
+// transientString returns b as a string without copying it, so it must only be used while b is not modified, and not
+// kept, such as to parse a number from it.
+func transientString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
 type stateFn func(*lexer) stateFn
 
 // check the first byte for special Datadog type.
@@ -324,10 +340,12 @@ func lexKey(l *lexer) stateFn {
 		l.err = errEmptyKey
 		return nil
 	}
-	l.m.Name = string(l.input[l.start : l.pos-1])
+	name := l.input[l.start : l.pos-1]
 	if l.namespace != "" {
-		l.m.Name = l.namespace + "." + l.m.Name
+		var buf [maxNamespacedName]byte
+		name = append(append(append(buf[:0], l.namespace...), '.'), name...)
 	}
+	l.m.Name = l.interner.Bytes(name)
 	l.start = l.pos
 	return lexValueSep
 }
@@ -348,7 +366,7 @@ func lexValueSep(l *lexer) stateFn {
 
 // lex the value.
 func lexValue(l *lexer) stateFn {
-	l.m.StringValue = string(l.input[l.start : l.pos-1])
+	l.value = l.input[l.start : l.pos-1]
 	l.start = l.pos
 	return lexType
 }
@@ -427,28 +445,39 @@ func lexSampleRateOrTags(l *lexer) stateFn {
 
 // lex the sample rate.
 func lexSampleRate(l *lexer) stateFn {
-	v, err := strconv.ParseFloat(string(l.input[l.start:l.pos-1]), 64)
+	v, err := strconv.ParseFloat(transientString(l.input[l.start:l.pos-1]), 64)
 	if err != nil {
-		l.err = err
+		l.err = errInvalidSampleRate
 		return nil
 	}
 	l.sampling = v
 	if l.pos >= l.len {
 		return nil
 	}
-	return lexAssert('#', lexTags)
+	// The same as lexAssert('#', lexTags), without allocating a closure for every line
+	if l.next() != '#' {
+		l.err = errInvalidFormat
+		return nil
+	}
+	return lexTags
 }
 
-// lex the tags.
+// lex the tags.  It loops rather than using lexUntil, so it does not allocate a closure for every tag.
 func lexTags(l *lexer) stateFn {
-	return lexUntil(',', func(l *lexer, data []byte) stateFn {
-		if len(data) > 0 {
-			l.tags = append(l.tags, string(data))
+	for {
+		start := l.pos
+		switch p := bytes.IndexByte(l.input[l.pos:], ','); p {
+		case -1:
+			l.pos = l.len
+		default:
+			l.pos += uint32(p)
+		}
+		if data := l.input[start:l.pos]; len(data) > 0 {
+			l.tags = append(l.tags, l.interner.Bytes(data))
 		}
 		if l.pos == l.len { // eof
 			return nil
 		}
 		l.pos++ // consume comma
-		return lexTags
-	})
+	}
 }
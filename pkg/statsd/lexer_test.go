@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/intern"
 	"github.com/hligit/gostatsd/internal/pool"
 )
 
@@ -168,6 +169,7 @@ func benchmarkLexer(dp *DatagramParser, input string, b *testing.B) {
 	slice := []byte(input)
 	var r *gostatsd.Metric
 	dp.metricPool = pool.NewMetricPool(0)
+	dp.interner = intern.New(internedStrings)
 	b.ReportAllocs()
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
@@ -0,0 +1,267 @@
+package statsd
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// Levels of mitigation applied by the MemoryLimiter as the heap grows towards its limit.  Each level also applies the
+// mitigation of the levels below it.
+const (
+	memoryLevelNormal = iota
+	memoryLevelShrink // Caches are shrunk
+	memoryLevelShed   // A fraction of datagrams are dropped, increasing as the heap grows
+	memoryLevelPause  // Receivers stop reading, so the kernel drops datagrams instead
+	numMemoryLevels
+)
+
+var memoryLevelNames = [numMemoryLevels]string{"normal", "shrink", "shed", "pause"}
+
+// memoryLevelThresholds are the fractions of the limit at which each level is applied.
+var memoryLevelThresholds = [numMemoryLevels]float64{0, 0.70, 0.85, 0.95}
+
+const (
+	// memoryLevelHysteresis is the fraction of the limit the heap must fall below the threshold of a level before it
+	// is no longer applied, so the level does not flap as the heap grows and is collected.
+	memoryLevelHysteresis = 0.05
+	// memoryCheckInterval is how often the heap is measured.
+	memoryCheckInterval = 250 * time.Millisecond
+	// minKeepPerMille is the fraction of datagrams kept just before receivers are paused.
+	minKeepPerMille = 100
+)
+
+// MemoryLimiter measures the heap against a limit, and progressively applies mitigation as it grows towards it, so the
+// server degrades by dropping some data rather than being killed and losing all of it.  The caches are shrunk first,
+// then datagrams are sampled, and finally the receivers are paused until the heap has shrunk.
+//
+// A nil MemoryLimiter never applies any mitigation.
+type MemoryLimiter struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	heapBytes     uint64
+	shrinks       uint64
+	sheds         uint64
+	datagramsShed uint64
+	pauses        uint64
+	level         uint32
+	keepPerMille  uint32 // The fraction of datagrams kept while shedding
+
+	limit     uint64
+	logger    logrus.FieldLogger
+	shrinkers []func()
+	heapInUse func() uint64 // Measures the heap, replaceable for tests
+
+	lock   sync.Mutex
+	paused chan struct{} // Closed when the receivers are resumed, nil if they are not paused
+}
+
+// NewMemoryLimiter creates a new MemoryLimiter for a heap of limit bytes.  The shrinkers are called to shrink caches
+// when the heap reaches the first level.
+func NewMemoryLimiter(limit uint64, logger logrus.FieldLogger, shrinkers ...func()) *MemoryLimiter {
+	return &MemoryLimiter{
+		keepPerMille: 1000,
+		limit:        limit,
+		logger:       logger,
+		shrinkers:    shrinkers,
+		heapInUse:    readHeapInUse,
+	}
+}
+
+func readHeapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse
+}
+
+// Run measures the heap, and applies mitigation, until the context is closed.
+func (ml *MemoryLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	defer ml.resume() // Receivers must not be left paused
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ml.check()
+		}
+	}
+}
+
+// check measures the heap, and changes the mitigation applied if it has crossed the threshold of a level.
+func (ml *MemoryLimiter) check() {
+	heap := ml.heapInUse()
+	atomic.StoreUint64(&ml.heapBytes, heap)
+	used := float64(heap) / float64(ml.limit)
+
+	current := int(atomic.LoadUint32(&ml.level))
+	level := memoryLevelNormal
+	for l := numMemoryLevels - 1; l > memoryLevelNormal; l-- {
+		threshold := memoryLevelThresholds[l]
+		if l <= current {
+			threshold -= memoryLevelHysteresis
+		}
+		if used >= threshold {
+			level = l
+			break
+		}
+	}
+
+	keep := uint32(1000)
+	if level == memoryLevelShed {
+		// Keep fewer datagrams as the heap approaches the threshold at which the receivers are paused
+		shed, pause := memoryLevelThresholds[memoryLevelShed], memoryLevelThresholds[memoryLevelPause]
+		fraction := (pause - used) / (pause - shed)
+		keep = uint32(math.Round(minKeepPerMille + fraction*(1000-minKeepPerMille)))
+		if keep > 1000 {
+			keep = 1000
+		}
+	}
+	atomic.StoreUint32(&ml.keepPerMille, keep)
+
+	if level == current {
+		return
+	}
+	atomic.StoreUint32(&ml.level, uint32(level))
+	ml.logger.WithFields(logrus.Fields{
+		"heap_bytes":  heap,
+		"limit_bytes": ml.limit,
+		"mitigation":  memoryLevelNames[level],
+	}).Warn("Memory limiter level changed")
+
+	if current < memoryLevelShrink && level >= memoryLevelShrink {
+		atomic.AddUint64(&ml.shrinks, 1)
+		for _, shrink := range ml.shrinkers {
+			shrink()
+		}
+		debug.FreeOSMemory()
+	}
+	if current < memoryLevelShed && level >= memoryLevelShed {
+		atomic.AddUint64(&ml.sheds, 1)
+	}
+	if level == memoryLevelPause {
+		atomic.AddUint64(&ml.pauses, 1)
+		ml.pause()
+	} else if current == memoryLevelPause {
+		ml.resume()
+	}
+}
+
+func (ml *MemoryLimiter) pause() {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if ml.paused == nil {
+		ml.paused = make(chan struct{})
+	}
+}
+
+func (ml *MemoryLimiter) resume() {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if ml.paused != nil {
+		close(ml.paused)
+		ml.paused = nil
+	}
+}
+
+// Wait blocks while the receivers are paused, until they are resumed or the context is closed.
+func (ml *MemoryLimiter) Wait(ctx context.Context) {
+	if ml == nil {
+		return
+	}
+	ml.lock.Lock()
+	paused := ml.paused
+	ml.lock.Unlock()
+	if paused == nil {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-paused:
+	}
+}
+
+// Overloaded returns "memory" while datagrams are being shed or the receivers are paused, so the http ingestion
+// endpoints reject requests rather than adding to the heap.
+func (ml *MemoryLimiter) Overloaded() string {
+	if ml == nil || atomic.LoadUint32(&ml.level) < memoryLevelShed {
+		return ""
+	}
+	return "memory"
+}
+
+// Admit reports if a datagram should be kept, rather than shed.  The caller keeps the state in admitted, which must
+// not be shared between goroutines, so datagrams are shed evenly without contention.
+func (ml *MemoryLimiter) Admit(admitted *uint32) bool {
+	if ml == nil {
+		return true
+	}
+	keep := atomic.LoadUint32(&ml.keepPerMille)
+	if keep >= 1000 {
+		return true
+	}
+	*admitted += keep
+	if *admitted >= 1000 {
+		*admitted -= 1000
+		return true
+	}
+	atomic.AddUint64(&ml.datagramsShed, 1)
+	return false
+}
+
+// RunMetricsContext writes the state of the MemoryLimiter every flush until the context is closed.
+func (ml *MemoryLimiter) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+	defer stats.PublishExpvar("memory_limiter", ml.expvar)()
+
+	var shrinks, sheds, datagramsShed, pauses uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("memory_limiter.heap_bytes", float64(atomic.LoadUint64(&ml.heapBytes)), nil)
+			statser.Gauge("memory_limiter.limit_bytes", float64(ml.limit), nil)
+			statser.Gauge("memory_limiter.level", float64(atomic.LoadUint32(&ml.level)), nil)
+			shrinks = countChange(statser, "memory_limiter.actions", gostatsd.Tags{"action:shrink"}, &ml.shrinks, shrinks)
+			sheds = countChange(statser, "memory_limiter.actions", gostatsd.Tags{"action:shed"}, &ml.sheds, sheds)
+			datagramsShed = countChange(statser, "memory_limiter.datagrams_shed", nil, &ml.datagramsShed, datagramsShed)
+			pauses = countChange(statser, "memory_limiter.actions", gostatsd.Tags{"action:pause"}, &ml.pauses, pauses)
+		}
+	}
+}
+
+// countChange counts the change of an accumulated counter since it was last counted, and returns its current value.
+func countChange(statser stats.Statser, name string, tags gostatsd.Tags, counter *uint64, last uint64) uint64 {
+	cur := atomic.LoadUint64(counter)
+	if cur > last {
+		statser.Count(name, float64(cur-last), tags)
+	}
+	return cur
+}
+
+// expvar returns the state published in expvar.
+func (ml *MemoryLimiter) expvar() interface{} {
+	return map[string]interface{}{
+		"heap_bytes":     atomic.LoadUint64(&ml.heapBytes),
+		"limit_bytes":    ml.limit,
+		"level":          memoryLevelNames[atomic.LoadUint32(&ml.level)],
+		"shrinks":        atomic.LoadUint64(&ml.shrinks),
+		"sheds":          atomic.LoadUint64(&ml.sheds),
+		"datagrams_shed": atomic.LoadUint64(&ml.datagramsShed),
+		"pauses":         atomic.LoadUint64(&ml.pauses),
+	}
+}
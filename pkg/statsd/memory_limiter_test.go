@@ -0,0 +1,114 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMemoryLimiter(heap *uint64, shrinkers ...func()) *MemoryLimiter {
+	ml := NewMemoryLimiter(1000, logrus.New(), shrinkers...)
+	ml.heapInUse = func() uint64 { return *heap }
+	return ml
+}
+
+func TestMemoryLimiterLevels(t *testing.T) {
+	t.Parallel()
+	var heap uint64
+	shrinks := 0
+	ml := newTestMemoryLimiter(&heap, func() { shrinks++ })
+
+	for _, tc := range []struct {
+		heap  uint64
+		level uint32
+	}{
+		{500, memoryLevelNormal},
+		{700, memoryLevelShrink},
+		{680, memoryLevelShrink}, // Within the hysteresis
+		{640, memoryLevelNormal},
+		{900, memoryLevelShed},
+		{960, memoryLevelPause},
+		{910, memoryLevelPause}, // Within the hysteresis
+		{890, memoryLevelShed},
+		{100, memoryLevelNormal},
+	} {
+		heap = tc.heap
+		ml.check()
+		require.Equal(t, tc.level, ml.level, "heap=%d", tc.heap)
+		require.Equal(t, tc.level >= memoryLevelShed, ml.Overloaded() != "", "heap=%d", tc.heap)
+	}
+	assert.Equal(t, 2, shrinks) // Once each time the shrink level is reached from normal
+	assert.EqualValues(t, 2, ml.shrinks)
+	assert.EqualValues(t, 1, ml.sheds) // Not when the pause level falls back to it
+	assert.EqualValues(t, 1, ml.pauses)
+}
+
+func TestMemoryLimiterAdmit(t *testing.T) {
+	t.Parallel()
+	var nilLimiter *MemoryLimiter
+	var admitted uint32
+	require.True(t, nilLimiter.Admit(&admitted))
+
+	var heap uint64
+	ml := newTestMemoryLimiter(&heap)
+	count := func() int {
+		kept := 0
+		for i := 0; i < 1000; i++ {
+			if ml.Admit(&admitted) {
+				kept++
+			}
+		}
+		return kept
+	}
+
+	heap = 700
+	ml.check()
+	require.Equal(t, 1000, count())
+
+	heap = 900 // Half way between shedding and pausing
+	ml.check()
+	require.Equal(t, 550, count())
+	require.EqualValues(t, 450, ml.datagramsShed)
+
+	heap = 949
+	ml.check()
+	require.InDelta(t, minKeepPerMille, count(), 10)
+}
+
+func TestMemoryLimiterPause(t *testing.T) {
+	t.Parallel()
+	var heap uint64
+	ml := newTestMemoryLimiter(&heap)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Not paused
+	ml.Wait(ctx)
+	var nilLimiter *MemoryLimiter
+	nilLimiter.Wait(ctx)
+
+	heap = 1000
+	ml.check()
+	waited := make(chan struct{})
+	go func() {
+		ml.Wait(ctx)
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	heap = 0
+	ml.check()
+	select {
+	case <-waited:
+	case <-ctx.Done():
+		t.Fatal("Wait did not return when resumed")
+	}
+}
@@ -0,0 +1,112 @@
+package statsd
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// metricMirror sends a copy of a percentage of every flush to shadow backends, such as a backend being evaluated, as
+// well as to the backends.  Each shadow backend has its own sender and queue, and nothing waits for it, so a shadow
+// backend which is slow or failing never delays the backends, or a flush, and its errors do not count as flush errors.
+type metricMirror struct {
+	senders   []*backendSender
+	threshold uint64 // The series whose hash modulo mirrorBuckets is below the threshold are mirrored
+
+	series uint64   // atomic - series mirrored
+	failed []uint64 // atomic - sends which failed, for each shadow backend
+}
+
+// mirrorBuckets is the resolution of the percentage of series mirrored, which is to 0.01%.
+const mirrorBuckets = 10000
+
+// shadowBackend renames a shadow backend, so its queue and send time are not mistaken for those of the backend of the
+// same name.
+type shadowBackend struct {
+	gostatsd.Backend
+}
+
+func (sb shadowBackend) Name() string {
+	return "shadow-" + sb.Backend.Name()
+}
+
+// newMetricMirror returns a metricMirror which sends percentage of the series of every flush to the backends, with
+// queueSize flushes queued for each.  Which series are mirrored is decided by a hash of their name and tags, so the
+// same series are mirrored in every flush.
+func newMetricMirror(backends []gostatsd.Backend, percentage float64, queueSize int) *metricMirror {
+	mirror := &metricMirror{
+		threshold: uint64(percentage / 100 * mirrorBuckets),
+		failed:    make([]uint64, len(backends)),
+	}
+	for i, backend := range backends {
+		shadow := shadowBackend{backend}
+		failed := &mirror.failed[i]
+		mirror.senders = append(mirror.senders, newBackendSender(shadow, queueSize, func(errs []error) {
+			for _, err := range errs {
+				if err != nil {
+					atomic.AddUint64(failed, 1)
+					if err != context.DeadlineExceeded && err != context.Canceled {
+						logrus.WithError(err).WithField("backend", shadow.Name()).Warn("Sending metrics to shadow backend failed")
+					}
+					return
+				}
+			}
+		}))
+	}
+	return mirror
+}
+
+// sample returns the series of mm which are mirrored.  mm is returned if every series is mirrored.
+func (m *metricMirror) sample(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	if m.threshold >= mirrorBuckets {
+		return mm
+	}
+	return mm.SplitByBucket(2, func(metricName string, tagsKey string) int {
+		if util.HashKey(metricName, tagsKey)%mirrorBuckets < m.threshold {
+			return 0
+		}
+		return 1
+	})[0]
+}
+
+// enqueue queues the mirrored series of the metrics of a flush to be sent by every shadow backend.  It must only be
+// called from the Run goroutine of the flusher.
+func (m *metricMirror) enqueue(ctx context.Context, metrics []*gostatsd.MetricMap) {
+	payload := &flushPayload{ctx: ctx}
+	for _, mm := range metrics {
+		mirrored := m.sample(mm)
+		payload.metrics = append(payload.metrics, mirrored)
+		payload.series += mirrored.Len()
+	}
+	atomic.AddUint64(&m.series, uint64(payload.series))
+	// Nothing waits for the payload, but the senders mark it done
+	payload.sent.Add(len(m.senders))
+	for _, sender := range m.senders {
+		sender.enqueue(ctx, payload)
+	}
+}
+
+// RunMetricsContext writes the series mirrored, and the sends to each shadow backend which failed, since the last
+// flush, every flush until the context is done.
+func (m *metricMirror) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Count("mirror.series", float64(atomic.SwapUint64(&m.series, 0)), nil)
+			for i, sender := range m.senders {
+				statser.Count("mirror.failed", float64(atomic.SwapUint64(&m.failed[i], 0)), gostatsd.Tags{"backend:" + sender.backend.Name()})
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+func TestMetricMirrorDoesNotDelayBackends(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := &blockingBackend{release: make(chan struct{})}
+	close(backend.release)
+	shadow := &blockingBackend{release: make(chan struct{})}
+	h := NewBackendHandler(nil, 0, 1, 0, 0, 0, AggregatorFactoryFunc(func() Aggregator {
+		return NewMetricAggregator([]float64{90}, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32, 1, 0, 0)
+	}))
+	fl := NewMetricFlusher(time.Hour, 0, false, 1, h, []gostatsd.Backend{backend})
+	fl.mirror = newMetricMirror([]gostatsd.Backend{shadow}, 50, 1)
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, h.Run)
+	wg.StartWithContext(ctx, fl.Run)
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 100; i++ {
+		mm.Receive(&gostatsd.Metric{Name: fmt.Sprintf("c%d", i), Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+	}
+	h.DispatchMetricMap(ctx, mm)
+	h.Process(ctx, func(int, Aggregator) {})() // Wait for the metrics to be aggregated
+
+	// The shadow backend is blocked, but the flush is sent to the backend, and is not an error
+	require.NoError(t, fl.FlushNow(ctx, false))
+	require.Len(t, backend.sentMaps(), 1)
+	assert.Len(t, backend.sentMaps()[0].Counters, 100)
+	assert.Zero(t, fl.lastFlushError)
+	assert.Empty(t, shadow.sentMaps())
+	assert.Equal(t, "shadow-blockingBackend", fl.mirror.senders[0].backend.Name())
+
+	// About half the series are mirrored, chosen by their hash
+	close(shadow.release)
+	require.Eventually(t, func() bool { return len(shadow.sentMaps()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	mirrored := shadow.sentMaps()[0].Counters
+	assert.InDelta(t, 50, len(mirrored), 15)
+	for name := range mm.Counters {
+		_, ok := mirrored[name]
+		assert.Equal(t, util.HashKey(name, "")%mirrorBuckets < 5000, ok, name)
+	}
+}
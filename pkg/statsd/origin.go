@@ -0,0 +1,141 @@
+package statsd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hligit/gostatsd"
+)
+
+const (
+	// originCacheTTL is how long the container of a process is cached.  A pid is only reused once the process has
+	// exited, so it is short to limit how long a reused pid is attributed to the container of the previous process.
+	originCacheTTL = 30 * time.Second
+	// originCacheSize is the number of processes cached before the cache is cleared.
+	originCacheSize = 10000
+)
+
+// containerIDRegex matches the ID of a container in the last element of the path of a cgroup, such as
+// /kubepods/burstable/pod<uid>/<id>, or cri-containerd-<id>.scope with the systemd cgroup driver.
+var containerIDRegex = regexp.MustCompile(`([0-9a-f]{64})(?:\.scope)?$`)
+
+// UnixSocketFactory returns a SocketFactory which listens for datagrams on a unix socket at path, replacing any socket
+// already there.  If originDetection is true, the socket receives the credentials of the sender of each datagram, and
+// the pid is resolved to the container of the sender, which is the Source of its metrics and events, rather than an IP.
+func UnixSocketFactory(path string, originDetection bool) SocketFactory {
+	return func() (net.PacketConn, error) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		// Any local process may send metrics, as it could over UDP
+		if err = os.Chmod(path, 0777); err == nil && originDetection {
+			err = enablePassCred(c)
+		}
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// UnixBatchReader reads a datagram at a time from a unix socket, and the origin of each from the credentials of its
+// sender, if the socket receives them.
+type UnixBatchReader struct {
+	conn    *net.UnixConn
+	oob     []byte
+	origins *originResolver
+}
+
+func (ubr *UnixBatchReader) ReadBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		panic("attempt to read 0 packets")
+	}
+	nbytes, oobn, _, addr, err := ubr.conn.ReadMsgUnix(ms[0].Buffers[0], ubr.oob)
+	if err != nil {
+		return 0, err
+	}
+	// The sender is usually unnamed, and its nil address must not be a non-nil interface
+	ms[0].Addr = nil
+	if addr != nil {
+		ms[0].Addr = addr
+	}
+	ms[0].N = nbytes
+	ms[0].Origin = gostatsd.UnknownSource
+	if pid, ok := credentialsPID(ubr.oob[:oobn]); ok {
+		ms[0].Origin = ubr.origins.resolve(pid)
+	}
+	return 1, nil
+}
+
+type originEntry struct {
+	source  gostatsd.Source
+	expires time.Time
+}
+
+// originResolver resolves the pid of a process to the Source of the container it runs in, from its cgroup.  It is
+// only used by the goroutine reading a socket, so it is not safe for concurrent use.
+type originResolver struct {
+	procDir string
+	now     func() time.Time
+	cache   map[int32]originEntry
+}
+
+func newOriginResolver(procDir string) *originResolver {
+	return &originResolver{
+		procDir: procDir,
+		now:     time.Now,
+		cache:   make(map[int32]originEntry),
+	}
+}
+
+// resolve returns the Source of the container of the process, or UnknownSource if it is not in a container, or its
+// cgroup can not be read, such as when it is in another pid namespace.
+func (or *originResolver) resolve(pid int32) gostatsd.Source {
+	now := or.now()
+	if entry, ok := or.cache[pid]; ok && now.Before(entry.expires) {
+		return entry.source
+	}
+	source := gostatsd.UnknownSource
+	if id, err := containerIDFromCgroup(filepath.Join(or.procDir, fmt.Sprint(pid), "cgroup")); err == nil && id != "" {
+		source = gostatsd.ContainerSource(id)
+	}
+	if len(or.cache) >= originCacheSize {
+		or.cache = make(map[int32]originEntry)
+	}
+	or.cache[pid] = originEntry{source: source, expires: now.Add(originCacheTTL)}
+	return source
+}
+
+// containerIDFromCgroup returns the ID of the container from the cgroup file of a process, or "" if the process is not
+// in a container.
+func containerIDFromCgroup(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line is hierarchy-id:controllers:path, and every hierarchy has the same container
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if match := containerIDRegex.FindStringSubmatch(parts[2]); match != nil {
+			return match[1], nil
+		}
+	}
+	return "", scanner.Err()
+}
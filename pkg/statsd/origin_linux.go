@@ -0,0 +1,42 @@
+package statsd
+
+import (
+	"net"
+	"syscall"
+)
+
+// credentialsOOBSize is the size of the out of band data of a datagram with the credentials of its sender.
+var credentialsOOBSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// enablePassCred makes the socket receive the credentials of the sender of each datagram.  Datagram sockets are not
+// connected, so the credentials of each datagram are passed with SO_PASSCRED, rather than read with SO_PEERCRED.
+func enablePassCred(c *net.UnixConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// credentialsPID returns the pid of the sender from the out of band data of a datagram, if it has the credentials of
+// the sender.  The pid is 0 if the sender is in a pid namespace which the receiver can not see.
+func credentialsPID(oob []byte) (int32, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for i := range msgs {
+		cred, err := syscall.ParseUnixCredentials(&msgs[i])
+		if err == nil && cred.Pid > 0 {
+			return cred.Pid, true
+		}
+	}
+	return 0, false
+}
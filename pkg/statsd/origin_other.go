@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package statsd
+
+import (
+	"errors"
+	"net"
+)
+
+// credentialsOOBSize is the size of the out of band data of a datagram with the credentials of its sender, which are
+// only available on Linux.
+var credentialsOOBSize = 0
+
+func enablePassCred(c *net.UnixConn) error {
+	return errors.New("origin detection is only supported on Linux")
+}
+
+func credentialsPID(oob []byte) (int32, bool) {
+	return 0, false
+}
@@ -0,0 +1,85 @@
+package statsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+const testContainerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestOriginResolver(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "origin")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for pid, cgroup := range map[int]string{
+		1: "12:memory:/kubepods/burstable/pod1234/" + testContainerID + "\n",
+		2: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1234.slice/cri-containerd-" + testContainerID + ".scope\n",
+		3: "0::/system.slice/sshd.service\n",
+	} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, fmt.Sprint(pid)), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(pid), "cgroup"), []byte(cgroup), 0600))
+	}
+
+	now := time.Unix(0, 0)
+	or := newOriginResolver(dir)
+	or.now = func() time.Time { return now }
+	assert.Equal(t, gostatsd.ContainerSource(testContainerID), or.resolve(1))
+	assert.Equal(t, gostatsd.ContainerSource(testContainerID), or.resolve(2))
+	assert.Equal(t, gostatsd.UnknownSource, or.resolve(3), "not in a container")
+	assert.Equal(t, gostatsd.UnknownSource, or.resolve(4), "can not be read")
+
+	// The container of a process is cached
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "1")))
+	assert.Equal(t, gostatsd.ContainerSource(testContainerID), or.resolve(1))
+	now = now.Add(originCacheTTL)
+	assert.Equal(t, gostatsd.UnknownSource, or.resolve(1))
+}
+
+func TestUnixSocketOriginDetection(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("origin detection is only supported on Linux")
+	}
+	dir, err := ioutil.TempDir("", "origin")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The cgroup of this process is replaced, so it is in a container
+	procDir := filepath.Join(dir, "proc")
+	require.NoError(t, os.MkdirAll(filepath.Join(procDir, fmt.Sprint(os.Getpid())), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(procDir, fmt.Sprint(os.Getpid()), "cgroup"), []byte("0::/docker-"+testContainerID+".scope\n"), 0600))
+
+	path := filepath.Join(dir, "statsd.sock")
+	c, err := UnixSocketFactory(path, true)()
+	require.NoError(t, err)
+	defer c.Close()
+	br := NewBatchReader(c).(*UnixBatchReader)
+	br.origins = newOriginResolver(procDir)
+
+	sender, err := net.Dial("unixgram", path)
+	require.NoError(t, err)
+	defer sender.Close()
+	_, err = sender.Write([]byte("abc:1|c"))
+	require.NoError(t, err)
+
+	messages := []Message{{Buffers: [][]byte{make([]byte, packetSizeUDP)}}}
+	n, err := br.ReadBatch(messages)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	assert.Equal(t, "abc:1|c", string(messages[0].Buffers[0][:messages[0].N]))
+	assert.Equal(t, gostatsd.ContainerSource(testContainerID), messages[0].Origin)
+	assert.Equal(t, gostatsd.UnknownSource, getIP(messages[0].Addr))
+}
@@ -0,0 +1,19 @@
+package statsd
+
+import (
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+// overloadCheckers reports the server is overloaded when any of the components it checks is, so the http ingestion
+// endpoints push back on clients rather than accepting data which would be dropped or held up internally.
+type overloadCheckers []web.OverloadChecker
+
+// Overloaded returns the reason given by the first component which is overloaded, or "" if none are.
+func (oc overloadCheckers) Overloaded() string {
+	for _, c := range oc {
+		if reason := c.Overloaded(); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
@@ -12,6 +12,7 @@ import (
 	"golang.org/x/time/rate"
 
 	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/intern"
 	"github.com/hligit/gostatsd/internal/pool"
 	"github.com/hligit/gostatsd/pkg/stats"
 )
@@ -19,27 +20,77 @@ import (
 // Default buffer size for debug channel
 const logRawMetricChannelBufferSize = 1000
 
+// internedStrings is how many metric names and tags the parser keeps a single copy of per generation, see
+// intern.Interner.  Each is typically tens of bytes, so it is a few MB at most.
+const internedStrings = 1 << 16
+
+// badLineCategory is why a line failed to parse, so the client responsible can be found.
+type badLineCategory int
+
+const (
+	badLineMalformed badLineCategory = iota
+	badLineValue
+	badLineType
+	badLineSampleRate
+	badLineTags
+	badLineOversized
+	numBadLineCategories
+)
+
+var badLineCategoryNames = [numBadLineCategories]string{
+	badLineMalformed:  "malformed",
+	badLineValue:      "bad_value",
+	badLineType:       "unknown_type",
+	badLineSampleRate: "bad_sample_rate",
+	badLineTags:       "tag_syntax",
+	badLineOversized:  "oversized",
+}
+
+// categorizeBadLine returns the category of an error from the lexer.
+func categorizeBadLine(err error) badLineCategory {
+	switch err {
+	case errInvalidValue, errNaN:
+		return badLineValue
+	case errInvalidType:
+		return badLineType
+	case errInvalidSampleRate:
+		return badLineSampleRate
+	case errInvalidSamplingOrTags:
+		return badLineTags
+	case errOverflow:
+		return badLineOversized
+	default:
+		return badLineMalformed
+	}
+}
+
 // DatagramParser receives datagrams and parses them into Metrics/Events
 // For each Metric/Event it calls Handler.HandleMetric/Event()
 type DatagramParser struct {
 	// Counter fields below must be read/written only using atomic instructions.
 	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
 	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
-	badLines        stats.ChangeGauge
-	metricsReceived uint64
-	eventsReceived  uint64
+	badLines           stats.ChangeGauge
+	metricsReceived    uint64
+	eventsReceived     uint64
+	badLinesByCategory [numBadLineCategories]uint64 // Reset every flush
 
 	logger logrus.FieldLogger
 
+	listener string // The address metrics are received on, used to tag bad lines
+
 	ignoreHost bool
 	handler    gostatsd.PipelineHandler
 	namespace  string // Namespace to prefix all metrics
 
 	metricPool *pool.MetricPool
+	interner   *intern.Interner
+	lexers     sync.Pool // Of *lexer, which otherwise escape to the heap for every line
 
 	badLineLimiter *rate.Limiter
 
-	in <-chan []*Datagram // Input chan of datagram batches to parse
+	in      <-chan []*Datagram // Input chan of datagram batches to parse
+	pending *sync.WaitGroup    // Marked done for every batch parsed and dispatched, if it is not nil
 
 	logRawMetric         bool
 	logRawMetricInitOnce sync.Once
@@ -49,6 +100,7 @@ type DatagramParser struct {
 // NewDatagramParser initialises a new DatagramParser.
 func NewDatagramParser(
 	in <-chan []*Datagram,
+	listener string,
 	ns string,
 	ignoreHost bool,
 	estimatedTags int,
@@ -64,11 +116,13 @@ func NewDatagramParser(
 
 	return &DatagramParser{
 		logger:         logger,
+		listener:       listener,
 		in:             in,
 		ignoreHost:     ignoreHost,
 		handler:        handler,
 		namespace:      ns,
 		metricPool:     pool.NewMetricPool(estimatedTags + handler.EstimatedTags()),
+		interner:       intern.New(internedStrings),
 		badLineLimiter: limiter,
 		logRawMetric:   logRawMetric,
 	}
@@ -78,6 +132,7 @@ func (dp *DatagramParser) RunMetricsContext(ctx context.Context) {
 	statser := stats.FromContext(ctx)
 	flushed, unregister := statser.RegisterFlush()
 	defer unregister()
+	defer stats.PublishExpvar("parser", dp.expvar)()
 
 	for {
 		select {
@@ -87,12 +142,31 @@ func (dp *DatagramParser) RunMetricsContext(ctx context.Context) {
 			statser.Gauge("parser.metrics_received", float64(atomic.LoadUint64(&dp.metricsReceived)), nil)
 			statser.Gauge("parser.events_received", float64(atomic.LoadUint64(&dp.eventsReceived)), nil)
 			dp.badLines.SendIfChanged(statser, "parser.bad_lines_seen", nil)
+			for category := range dp.badLinesByCategory {
+				if count := atomic.SwapUint64(&dp.badLinesByCategory[category], 0); count > 0 {
+					tags := gostatsd.Tags{"category:" + badLineCategoryNames[category]}
+					if dp.listener != "" {
+						tags = append(tags, "listener:"+dp.listener)
+					}
+					statser.Count("parser.bad_lines", float64(count), tags)
+				}
+			}
 		}
 	}
 }
 
+// expvar returns the counters published in expvar.
+func (dp *DatagramParser) expvar() interface{} {
+	return map[string]uint64{
+		"metrics_received": atomic.LoadUint64(&dp.metricsReceived),
+		"events_received":  atomic.LoadUint64(&dp.eventsReceived),
+		"bad_lines_seen":   atomic.LoadUint64(&dp.badLines.Cur),
+	}
+}
+
 func (dp *DatagramParser) Run(ctx context.Context) {
 	dp.initLogRawMetric(ctx)
+	drops := stats.DropAccountingFromContext(ctx)
 
 	for {
 		select {
@@ -101,14 +175,17 @@ func (dp *DatagramParser) Run(ctx context.Context) {
 		case dgs := <-dp.in:
 			var metrics []*gostatsd.Metric
 
-			accumB, accumE := uint64(0), uint64(0)
+			var accumB [numBadLineCategories]uint64
+			accumE := uint64(0)
 			for _, dg := range dgs {
 				// TODO: Dispatch Events in Run, not handleDatagram, so it's consistent with Metrics
-				parsedMetrics, eventCount, badLineCount := dp.handleDatagram(ctx, dg.Timestamp, dg.IP, dg.Msg)
+				parsedMetrics, eventCount, badLineCounts := dp.handleDatagram(ctx, dg.Timestamp, dg.IP, dg.Msg)
 				dg.DoneFunc()
 				metrics = append(metrics, parsedMetrics...)
 				accumE += eventCount
-				accumB += badLineCount
+				for category, count := range badLineCounts {
+					accumB[category] += count
+				}
 			}
 			// TODO: Refactor this to use a MetricConsolidator
 			mm := gostatsd.NewMetricMap()
@@ -121,26 +198,40 @@ func (dp *DatagramParser) Run(ctx context.Context) {
 			}
 			atomic.AddUint64(&dp.metricsReceived, uint64(len(metrics)))
 			atomic.AddUint64(&dp.eventsReceived, accumE)
-			atomic.AddUint64(&dp.badLines.Cur, accumB)
+			for category, count := range accumB {
+				if count > 0 {
+					atomic.AddUint64(&dp.badLinesByCategory[category], count)
+					atomic.AddUint64(&dp.badLines.Cur, count)
+					drops.Dropped(stats.DropReasonParseError, "", count)
+				}
+			}
+			if dp.pending != nil {
+				dp.pending.Done()
+			}
 		}
 	}
 }
 
 // logBadLineRateLimited will log a line which failed to decode, if the current rate limit has not been exceeded.
-func (dp *DatagramParser) logBadLineRateLimited(line []byte, ip gostatsd.Source, err error) {
+func (dp *DatagramParser) logBadLineRateLimited(line []byte, ip gostatsd.Source, category badLineCategory, err error) {
 	if dp.badLineLimiter.Allow() {
 		logrus.WithFields(logrus.Fields{
-			"line":  string(line),
-			"ip":    ip,
-			"error": err,
+			"line":     string(line),
+			"ip":       ip,
+			"category": badLineCategoryNames[category],
+			"error":    err,
 		}).Info("error parsing line")
 	}
 }
 
 // handleDatagram handles the contents of a datagram and parsers it in to Metrics (which are returned), or
-// Events (which are sent to the pipeline via DispatchEvent).
-func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanotime, ip gostatsd.Source, msg []byte) (metrics []*gostatsd.Metric, eventCount uint64, badLineCount uint64) {
-	var numEvents, numBad uint64
+// Events (which are sent to the pipeline via DispatchEvent).  It also returns the number of events, and of lines which
+// failed to parse by category.
+func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanotime, ip gostatsd.Source, msg []byte) (metrics []*gostatsd.Metric, eventCount uint64, badLineCounts [numBadLineCategories]uint64) {
+	var numEvents uint64
+	var numBad [numBadLineCategories]uint64
+	// Usually every line is a metric, so the slice is only allocated once
+	metrics = make([]*gostatsd.Metric, 0, bytes.Count(msg, newline)+1)
 	for {
 		idx := bytes.IndexByte(msg, '\n')
 		var line []byte
@@ -159,8 +250,9 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanot
 		if err != nil {
 			// logging as debug to avoid spamming logs when a bad actor sends
 			// badly formatted messages
-			dp.logBadLineRateLimited(line, ip, err)
-			numBad++
+			category := categorizeBadLine(err)
+			dp.logBadLineRateLimited(line, ip, category, err)
+			numBad[category]++
 			continue
 		}
 		if metric != nil {
@@ -196,12 +288,27 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanot
 	return metrics, numEvents, numBad
 }
 
+// ParseLine parses a single metric or event in the statsd format, such as to validate it before it is sent.  The name
+// of a metric is prefixed with namespace, if it is not empty.
+func ParseLine(line []byte, namespace string) (*gostatsd.Metric, *gostatsd.Event, error) {
+	l := lexer{
+		metricPool: pool.NewMetricPool(0),
+	}
+	return l.run(line, namespace)
+}
+
 // parseLine with lexer.
 func (dp *DatagramParser) parseLine(line []byte) (*gostatsd.Metric, *gostatsd.Event, error) {
-	l := lexer{
-		metricPool: dp.metricPool,
+	l, _ := dp.lexers.Get().(*lexer)
+	if l == nil {
+		l = &lexer{}
 	}
-	return l.run(line, dp.namespace)
+	l.metricPool = dp.metricPool
+	l.interner = dp.interner
+	m, e, err := l.run(line, dp.namespace)
+	*l = lexer{} // Don't keep the line or the metric alive
+	dp.lexers.Put(l)
+	return m, e, err
 }
 
 func (dp *DatagramParser) initLogRawMetric(ctx context.Context) {
@@ -2,8 +2,10 @@ package statsd
 
 import (
 	"context"
+	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -23,7 +25,7 @@ const fakeIP = gostatsd.Source("127.0.0.1")
 
 func newTestParser(ignoreHost bool) (*DatagramParser, *countingHandler) {
 	ch := &countingHandler{}
-	return NewDatagramParser(nil, "", ignoreHost, 0, ch, rate.Limit(0), false, logrus.New()), ch
+	return NewDatagramParser(nil, "", "", ignoreHost, 0, ch, rate.Limit(0), false, logrus.New()), ch
 }
 
 func TestParseEmptyDatagram(t *testing.T) {
@@ -45,6 +47,46 @@ func TestParseEmptyDatagram(t *testing.T) {
 	}
 }
 
+func TestParseLine(t *testing.T) {
+	t.Parallel()
+	m, e, err := ParseLine([]byte("a.b:2|c|#x:y"), "ns")
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "ns.a.b", m.Name)
+		assert.Equal(t, 2.0, m.Value)
+		assert.Equal(t, gostatsd.Tags{"x:y"}, m.Tags)
+	}
+
+	m, e, err = ParseLine([]byte("_e{5,4}:title|text"), "ns")
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+	if assert.NotNil(t, e) {
+		assert.Equal(t, "title", e.Title)
+	}
+
+	_, _, err = ParseLine([]byte("a.b"), "")
+	assert.Error(t, err)
+}
+
+func TestParseBadLineCategories(t *testing.T) {
+	t.Parallel()
+	mr, ch := newTestParser(false)
+	datagram := "a:x|c\na:NaN|g\na:1|q\na:1|c|@x\na:1|c|x\n_e{9999999999999999999999,1}:a|b\nab\nok:1|c"
+	metrics, _, badLines := mr.handleDatagram(context.Background(), 0, fakeIP, []byte(datagram))
+	assert.Len(t, metrics, 1)
+	assert.Zero(t, len(ch.events), ch.events)
+	expected := [numBadLineCategories]uint64{
+		badLineMalformed:  1,
+		badLineValue:      2,
+		badLineType:       1,
+		badLineSampleRate: 1,
+		badLineTags:       1,
+		badLineOversized:  1,
+	}
+	assert.Equal(t, expected, badLines)
+}
+
 func TestParseDatagram(t *testing.T) {
 	t.Parallel()
 	input := map[string]metricAndEvent{
@@ -201,3 +243,28 @@ func TestParseDatagramIgnoreHost(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkParseDatagram(b *testing.B) {
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines,
+			fmt.Sprintf("service.requests.%d:1|c|#env:prod,endpoint:/api/%d", i%5, i%3),
+			fmt.Sprintf("service.latency.%d:%d.5|ms|@0.5|#env:prod,endpoint:/api/%d", i%5, i, i%3),
+			fmt.Sprintf("service.queue.%d:%d|g|#env:prod", i%5, i),
+		)
+	}
+	datagram := []byte(strings.Join(lines, "\n"))
+	msg := make([]byte, len(datagram))
+	mr, _ := newTestParser(false)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		copy(msg, datagram) // The lexer modifies the datagram
+		metrics, _, _ := mr.handleDatagram(context.Background(), 0, fakeIP, msg)
+		for _, m := range metrics {
+			m.Done()
+		}
+	}
+	b.ReportMetric(float64(len(lines)), "lines/op")
+}
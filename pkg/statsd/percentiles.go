@@ -0,0 +1,156 @@
+package statsd
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// insertionSortLimit is the length of a range which is sorted rather than partitioned further when selecting ranks.
+const insertionSortLimit = 12
+
+// selectRanks partially sorts values in place, so that for every r in ranks, values[r] is the value which would be at
+// index r if values were sorted, and every value before it is no greater.  It is a multiple quickselect, which only
+// partitions the ranges that contain a rank, so it is linear in the length of values for a handful of ranks, where
+// sorting is not.  ranks must be sorted in ascending order, and may contain duplicates.
+//
+// Like introsort, it falls back to sorting a range which is partitioned badly too many times, so it is never worse
+// than sorting.
+func selectRanks(values []float64, ranks []int) {
+	if len(values) == 0 || len(ranks) == 0 {
+		return
+	}
+	selectRanksIn(values, 0, len(values), ranks, 2*bits.Len(uint(len(values))))
+}
+
+func selectRanksIn(values []float64, lo, hi int, ranks []int, depth int) {
+	for len(ranks) > 0 {
+		if hi-lo <= insertionSortLimit {
+			insertionSort(values[lo:hi])
+			return
+		}
+		if depth == 0 {
+			sort.Float64s(values[lo:hi])
+			return
+		}
+		depth--
+
+		lt, gt := partition(values, lo, hi)
+		// Ranks in [lt, gt) are equal to the pivot, so they are already in place.
+		left := ranks[:sort.SearchInts(ranks, lt)]
+		right := ranks[sort.SearchInts(ranks, gt):]
+		// Recurse on the smaller side, and loop on the other, so the stack stays shallow.
+		if lt-lo < hi-gt {
+			selectRanksIn(values, lo, lt, left, depth)
+			lo, ranks = gt, right
+		} else {
+			selectRanksIn(values, gt, hi, right, depth)
+			hi, ranks = lt, left
+		}
+	}
+}
+
+// partition splits values[lo:hi] around the median of its first, middle, and last values, into those less than the
+// pivot in [lo, lt), equal in [lt, gt), and greater in [gt, hi), so runs of duplicates don't degrade it.
+func partition(values []float64, lo, hi int) (lt, gt int) {
+	pivot := medianOfThree(values[lo], values[lo+(hi-lo)/2], values[hi-1])
+	lt, gt = lo, hi
+	for i := lo; i < gt; {
+		switch v := values[i]; {
+		case v < pivot:
+			values[lt], values[i] = values[i], values[lt]
+			lt++
+			i++
+		case v > pivot:
+			gt--
+			values[gt], values[i] = values[i], values[gt]
+		default:
+			i++
+		}
+	}
+	return lt, gt
+}
+
+func medianOfThree(a, b, c float64) float64 {
+	if a > b {
+		a, b = b, a
+	}
+	if b > c {
+		b = c
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func insertionSort(values []float64) {
+	for i := 1; i < len(values); i++ {
+		for j := i; j > 0 && values[j] < values[j-1]; j-- {
+			values[j], values[j-1] = values[j-1], values[j]
+		}
+	}
+}
+
+// timerScratch holds the buffers used to calculate the percentiles of a timer, so they can be reused for every timer
+// in a flush.
+type timerScratch struct {
+	ranks      []int     // Indexes at which values must be in sorted position
+	prefixes   []int     // Indexes at which the sums of the values before them are needed
+	sums       []float64 // Sum of the values before each of prefixes
+	sumSquares []float64 // Sum of the squares of the values before each of prefixes
+}
+
+func (ts *timerScratch) reset() {
+	ts.ranks = ts.ranks[:0]
+	ts.prefixes = ts.prefixes[:0]
+}
+
+// need records that values[rank] must be in sorted position, and the sums of the values before prefix are needed.
+func (ts *timerScratch) need(rank, prefix int) {
+	ts.ranks = append(ts.ranks, rank)
+	ts.prefixes = append(ts.prefixes, prefix)
+}
+
+// calculate partially sorts values so every rank needed is in sorted position, calculates the sums of the values
+// before every prefix needed, and returns the minimum and maximum.  values must not be empty.
+func (ts *timerScratch) calculate(values []float64) (min, max float64) {
+	sort.Ints(ts.ranks)
+	selectRanks(values, ts.ranks)
+
+	sort.Ints(ts.prefixes)
+	if cap(ts.sums) < len(ts.prefixes) {
+		ts.sums = make([]float64, len(ts.prefixes))
+		ts.sumSquares = make([]float64, len(ts.prefixes))
+	}
+	ts.sums = ts.sums[:len(ts.prefixes)]
+	ts.sumSquares = ts.sumSquares[:len(ts.prefixes)]
+
+	var sum, sumSquares float64
+	min, max = values[0], values[0]
+	j := 0
+	for i, v := range values {
+		for ; j < len(ts.prefixes) && ts.prefixes[j] == i; j++ {
+			ts.sums[j] = sum
+			ts.sumSquares[j] = sumSquares
+		}
+		sum += v
+		sumSquares += v * v
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	for ; j < len(ts.prefixes); j++ {
+		ts.sums[j] = sum
+		ts.sumSquares[j] = sumSquares
+	}
+	return min, max
+}
+
+// prefix returns the sum, and the sum of the squares, of the values before index i, which must have been needed.
+func (ts *timerScratch) prefix(i int) (sum, sumSquares float64) {
+	j := sort.SearchInts(ts.prefixes, i)
+	return ts.sums[j], ts.sumSquares[j]
+}
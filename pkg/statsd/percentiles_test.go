@@ -0,0 +1,158 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestSelectRanks(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 5, insertionSortLimit, insertionSortLimit + 1, 100, 10000} {
+		for _, distinct := range []int{1, 3, 1 << 30} {
+			values := make([]float64, n)
+			for i := range values {
+				values[i] = float64(r.Intn(distinct))
+			}
+			sorted := append([]float64(nil), values...)
+			sort.Float64s(sorted)
+
+			ranks := []int{0, n / 2, n / 2, n - 1}
+			for i := 0; i < 5; i++ {
+				ranks = append(ranks, r.Intn(n))
+			}
+			sort.Ints(ranks)
+
+			selectRanks(values, ranks)
+			for _, rank := range ranks {
+				require.Equal(t, sorted[rank], values[rank], "n=%d distinct=%d rank=%d", n, distinct, rank)
+				for _, v := range values[:rank] {
+					require.LessOrEqual(t, v, values[rank], "n=%d distinct=%d rank=%d", n, distinct, rank)
+				}
+			}
+		}
+	}
+}
+
+func TestSelectRanksSortedInput(t *testing.T) {
+	t.Parallel()
+	// Sorted and reversed input must not degrade to quadratic time, which would time out here.
+	values := make([]float64, 1000000)
+	for i := range values {
+		values[i] = float64(i)
+	}
+	selectRanks(values, []int{500000})
+	require.EqualValues(t, 500000, values[500000])
+
+	for i := range values {
+		values[i] = float64(len(values) - i)
+	}
+	selectRanks(values, []int{10})
+	require.EqualValues(t, 11, values[10])
+}
+
+func TestFlushTimerPercentilesMatchSorting(t *testing.T) {
+	t.Parallel()
+	thresholds := []float64{-100, -10, 50, 90, 99, 100}
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{2, 3, 10, 1001, 10000} {
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = math.Round(r.ExpFloat64() * 100)
+		}
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+
+		ma := NewMetricAggregator(thresholds, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32, 1, 0, 0)
+		ma.shards[0].Timers["t"] = map[string]gostatsd.Timer{"": gostatsd.NewTimerValues(values)}
+		ma.Flush(time.Second)
+		timer := ma.shards[0].Timers["t"][""]
+
+		require.Equal(t, sorted[0], timer.Min)
+		require.Equal(t, sorted[n-1], timer.Max)
+		median := sorted[n/2]
+		if n%2 == 0 {
+			median = (sorted[n/2-1] + sorted[n/2]) / 2
+		}
+		require.Equal(t, median, timer.Median)
+
+		for _, pct := range thresholds {
+			k := int(round(math.Abs(pct) / 100 * float64(n)))
+			if k == 0 {
+				continue // No sub-metrics are sent when no values are in the threshold
+			}
+			inThreshold := sorted[:k]
+			if pct < 0 {
+				inThreshold = sorted[n-k:]
+			}
+			var sum, sumSquares float64
+			for _, v := range inThreshold {
+				sum += v
+				sumSquares += v * v
+			}
+			name := fmt.Sprintf("%d", int(pct))
+			get := func(prefix string) float64 {
+				for _, p := range timer.Percentiles {
+					if p.Str == prefix+"_"+name {
+						return p.Float
+					}
+				}
+				t.Fatalf("n=%d: %s_%s not found", n, prefix, name)
+				return 0
+			}
+			require.EqualValues(t, k, get("count"), "n=%d pct=%v", n, pct)
+			require.InDelta(t, sum, get("sum"), 1e-6*sum, "n=%d pct=%v", n, pct)
+			require.InDelta(t, sumSquares, get("sum_squares"), 1e-6*sumSquares, "n=%d pct=%v", n, pct)
+			if pct > 0 {
+				require.Equal(t, inThreshold[k-1], get("upper"), "n=%d pct=%v", n, pct)
+			} else {
+				require.Equal(t, inThreshold[0], get("lower"), "n=%d pct=%v", n, pct)
+			}
+		}
+	}
+}
+
+func benchmarkLargeTimer(b *testing.B, partial func(values []float64)) {
+	r := rand.New(rand.NewSource(1))
+	original := make([]float64, 1000000)
+	for i := range original {
+		original[i] = r.ExpFloat64() * 100
+	}
+	values := make([]float64, len(original))
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		copy(values, original)
+		b.StartTimer()
+		partial(values)
+	}
+}
+
+func BenchmarkLargeTimerSort(b *testing.B) {
+	benchmarkLargeTimer(b, sort.Float64s)
+}
+
+func BenchmarkLargeTimerSelectRanks(b *testing.B) {
+	n := 1000000
+	ranks := []int{n/2 - 1, n / 2, n*90/100 - 1, n*99/100 - 1}
+	benchmarkLargeTimer(b, func(values []float64) {
+		selectRanks(values, ranks)
+	})
+}
+
+func BenchmarkFlushLargeTimer(b *testing.B) {
+	ma := NewMetricAggregator([]float64{90, 99}, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32, 1, 0, 0)
+	benchmarkLargeTimer(b, func(values []float64) {
+		ma.shards[0].Timers["t"] = map[string]gostatsd.Timer{"": gostatsd.NewTimerValues(values)}
+		ma.Flush(time.Second)
+	})
+}
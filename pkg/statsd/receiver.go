@@ -2,8 +2,10 @@ package statsd
 
 import (
 	"context"
+	"errors"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/ash2k/stager/wait"
@@ -27,14 +29,26 @@ type DatagramReceiver struct {
 	datagramsReceived      uint64
 	batchesRead            uint64
 	cumulDatagramsReceived uint64
+	listening              uint32 // 1 once every socket is bound
+	port                   uint32 // The port the sockets are bound to, or 0 if they are not UDP sockets
+
+	kernelDrops            uint64 // The datagrams dropped by the kernel when last read
+	kernelDropsUnsupported bool   // If the datagrams dropped by the kernel can not be read on this platform
 
 	bufPool *pool.DatagramBufferPool
 
 	receiveBatchSize int // The number of datagrams to read in each batch
 	numReaders       int
 	socketFactory    SocketFactory
+	unixSocket       SocketFactory  // Creates a unix socket which is also read, if it is not nil
+	limiter          *MemoryLimiter // Sheds datagrams, or pauses reading, when the heap is close to its limit
+
+	out     chan<- []*Datagram // Output chan of read datagram batches
+	pending *sync.WaitGroup    // Batches sent to out which are not parsed yet, if it is not nil
 
-	out chan<- []*Datagram // Output chan of read datagram batches
+	stop     chan struct{} // Closed by Stop, to close the sockets before the context is done
+	stopOnce sync.Once
+	stopped  chan struct{} // Closed once every socket is closed, and every batch read is sent to out
 }
 
 // NewDatagramReceiver initialises a new DatagramReceiver.
@@ -45,6 +59,8 @@ func NewDatagramReceiver(out chan<- []*Datagram, sf SocketFactory, numReaders, r
 		numReaders:       numReaders,
 		socketFactory:    sf,
 		bufPool:          pool.NewDatagramBufferPool(packetSizeUDP),
+		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
 	}
 }
 
@@ -52,6 +68,7 @@ func (dr *DatagramReceiver) RunMetricsContext(ctx context.Context) {
 	statser := stats.FromContext(ctx)
 	flushed, unregister := statser.RegisterFlush()
 	defer unregister()
+	defer stats.PublishExpvar("receiver", dr.expvar)()
 
 	for {
 		select {
@@ -60,19 +77,46 @@ func (dr *DatagramReceiver) RunMetricsContext(ctx context.Context) {
 		case <-flushed:
 			datagramsReceived := atomic.SwapUint64(&dr.datagramsReceived, 0)
 			batchesRead := atomic.SwapUint64(&dr.batchesRead, 0)
-			dr.cumulDatagramsReceived += datagramsReceived
+			cumulDatagramsReceived := atomic.AddUint64(&dr.cumulDatagramsReceived, datagramsReceived)
 			var avgDatagramsInBatch float64
 			if batchesRead == 0 {
 				avgDatagramsInBatch = 0
 			} else {
 				avgDatagramsInBatch = float64(datagramsReceived) / float64(batchesRead)
 			}
-			statser.Gauge("receiver.datagrams_received", float64(dr.cumulDatagramsReceived), nil)
+			statser.Gauge("receiver.datagrams_received", float64(cumulDatagramsReceived), nil)
 			statser.Gauge("receiver.avg_datagrams_in_batch", avgDatagramsInBatch, nil)
+			dr.countKernelDrops(stats.DropAccountingFromContext(ctx))
 		}
 	}
 }
 
+// expvar returns the counters published in expvar, including the datagrams received since the last flush.
+func (dr *DatagramReceiver) expvar() interface{} {
+	return map[string]uint64{
+		"datagrams_received": atomic.LoadUint64(&dr.cumulDatagramsReceived) + atomic.LoadUint64(&dr.datagramsReceived),
+	}
+}
+
+// countKernelDrops attributes the datagrams dropped by the kernel since it was last called, because the receive
+// buffers of the sockets were full.  They are only available on Linux.
+func (dr *DatagramReceiver) countKernelDrops(drops *stats.DropAccounting) {
+	port := int(atomic.LoadUint32(&dr.port))
+	if port == 0 || dr.kernelDropsUnsupported {
+		return
+	}
+	kernelDrops, err := udpDrops(procNetUDP, port)
+	if err != nil {
+		logrus.WithError(err).Info("Unable to read datagrams dropped by the kernel, they will not be counted")
+		dr.kernelDropsUnsupported = true
+		return
+	}
+	if kernelDrops > dr.kernelDrops {
+		drops.Dropped(stats.DropReasonReceiveBuffer, "", kernelDrops-dr.kernelDrops)
+	}
+	dr.kernelDrops = kernelDrops
+}
+
 func (dr *DatagramReceiver) Run(ctx context.Context) {
 	wg := wait.Group{}
 	var connections []net.PacketConn
@@ -87,11 +131,31 @@ func (dr *DatagramReceiver) Run(ctx context.Context) {
 			dr.Receive(ctx, c)
 		})
 	}
+	if len(connections) > 0 {
+		if c, ok := connections[0].(*net.UDPConn); ok {
+			atomic.StoreUint32(&dr.port, uint32(c.LocalAddr().(*net.UDPAddr).Port))
+		}
+	}
+	if dr.unixSocket != nil {
+		c, err := dr.unixSocket()
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to create unix socket")
+		}
+		connections = append(connections, c)
+		wg.StartWithContext(ctx, func(ctx context.Context) {
+			dr.Receive(ctx, c)
+		})
+	}
+	atomic.StoreUint32(&dr.listening, 1)
 
-	// Work until done
-	<-ctx.Done()
+	// Work until done, or stopped
+	select {
+	case <-ctx.Done():
+	case <-dr.stop:
+	}
 
 	// Close all the sockets, which will make the receivers error out and stop
+	atomic.StoreUint32(&dr.listening, 0)
 	for _, c := range connections {
 		if e := c.Close(); e != nil && !strings.Contains(e.Error(), "use of closed network connection") {
 			logrus.WithError(e).Warn("Error closing socket")
@@ -100,10 +164,34 @@ func (dr *DatagramReceiver) Run(ctx context.Context) {
 
 	// Wait for everything to stop
 	wg.Wait()
+	close(dr.stopped)
+}
+
+// Stop closes the sockets, and waits until every batch already read is sent to be parsed, or the context is done.
+func (dr *DatagramReceiver) Stop(ctx context.Context) error {
+	dr.stopOnce.Do(func() {
+		close(dr.stop)
+	})
+	select {
+	case <-dr.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CheckReady reports if every socket is bound.
+func (dr *DatagramReceiver) CheckReady() error {
+	if atomic.LoadUint32(&dr.listening) == 0 {
+		return errors.New("receiver is not listening")
+	}
+	return nil
 }
 
 // Receive accepts incoming datagrams on c, and passes them off to be parsed
 func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
+	drops := stats.DropAccountingFromContext(ctx)
+	var admitted uint32
 	br := NewBatchReader(c)
 	messages := make([]Message, dr.receiveBatchSize)
 	retBuffers := make([]*[][]byte, dr.receiveBatchSize)
@@ -113,6 +201,7 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 		messages[i].Buffers = *retBuffers[i]
 	}
 	for {
+		dr.limiter.Wait(ctx)
 
 		datagramCount, err := br.ReadBatch(messages)
 		now := gostatsd.NanoNow()
@@ -120,6 +209,8 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 			select {
 			case <-ctx.Done():
 				return
+			case <-dr.stop:
+				return
 			default:
 			}
 			if err != fakesocket.ErrClosedConnection && !strings.Contains(err.Error(), "use of closed network connection") {
@@ -131,8 +222,13 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 		atomic.AddUint64(&dr.datagramsReceived, uint64(datagramCount))
 		atomic.AddUint64(&dr.batchesRead, 1)
 
-		dgs := make([]*Datagram, datagramCount)
+		dgs := make([]*Datagram, 0, datagramCount)
 		for i := 0; i < datagramCount; i++ {
+			if !dr.limiter.Admit(&admitted) {
+				// The buffer is reused for the next read
+				drops.Dropped(stats.DropReasonMemoryLimit, "", 1)
+				continue
+			}
 			addr := messages[i].Addr
 			nbytes := messages[i].N
 			buf := messages[i].Buffers[0][:nbytes]
@@ -142,27 +238,44 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 				dr.bufPool.Put(retBuf)
 			}
 
-			dgs[i] = &Datagram{
-				IP:        getIP(addr),
+			ip := messages[i].Origin
+			if ip == gostatsd.UnknownSource {
+				ip = getIP(addr)
+			}
+			dgs = append(dgs, &Datagram{
+				IP:        ip,
 				Msg:       buf,
 				Timestamp: now,
 				DoneFunc:  doneFn,
-			}
+			})
 			retBuffers[i] = dr.bufPool.Get()
 			messages[i].Buffers = *retBuffers[i]
 		}
+		if len(dgs) == 0 {
+			continue
+		}
+		if dr.pending != nil {
+			dr.pending.Add(1)
+		}
 		select {
 		case dr.out <- dgs:
 			// success
 		case <-ctx.Done():
+			if dr.pending != nil {
+				dr.pending.Done()
+			}
 			return
 		}
 	}
 }
 
 func getIP(addr net.Addr) gostatsd.Source {
-	if a, ok := addr.(*net.UDPAddr); ok {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
 		return gostatsd.Source(a.IP.String())
+	case *net.UnixAddr, nil:
+		// The sender on a unix socket has no IP
+		return gostatsd.UnknownSource
 	}
 	logrus.Errorf("Cannot get source address %q of type %T", addr, addr)
 	return gostatsd.UnknownSource
@@ -0,0 +1,442 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+// restartOnlySettings are the settings which are only applied when the server starts.  A reload which changes them
+// logs a warning, as they are otherwise silently ignored.
+var restartOnlySettings = []string{
+	gostatsd.ParamMetricsAddr,
+	gostatsd.ParamMetricsSocket,
+	gostatsd.ParamOriginDetection,
+	gostatsd.ParamConnPerReader,
+	gostatsd.ParamServerMode,
+	gostatsd.ParamMaxReaders,
+	gostatsd.ParamMaxParsers,
+	gostatsd.ParamMaxWorkers,
+	gostatsd.ParamAggregatorShards,
+	gostatsd.ParamFlushInterval,
+	gostatsd.ParamInternalBackends,
+	gostatsd.ParamClusterMembers,
+	gostatsd.ParamClusterSelf,
+	gostatsd.ParamRelayDownstreams,
+	gostatsd.ParamRelayTCPTransport,
+	gostatsd.ParamShadowBackends,
+	gostatsd.ParamShadowPercentage,
+	gostatsd.ParamDeadLetterPath,
+	gostatsd.ParamDeadLetterMaxBytes,
+	gostatsd.ParamLeaderElectionLease,
+	gostatsd.ParamLeaderElectionNamespace,
+	gostatsd.ParamLeaderElectionIdentity,
+	gostatsd.ParamEventThrottleWindow,
+	gostatsd.ParamEventThrottlePerKey,
+}
+
+// reloader reloads the subset of the configuration which can be changed without restarting the server, so the
+// sockets and the contents of the aggregators are kept.
+type reloader struct {
+	lock        sync.Mutex
+	logger      logrus.FieldLogger
+	v           *viper.Viper
+	reloaders   []gostatsd.ConfigReloader
+	onReload    func(*viper.Viper) error
+	restartOnly map[string]string                  // The value of every restart only setting when the server started, if not nil
+	resolve     func(value string) (string, error) // Resolves references to secrets in the configuration file, if not nil
+	isSecret    func(value string) bool            // Returns true if a value is a resolved secret, if not nil
+	lastGood    *util.ConfigFile                   // The configuration file last applied successfully, if there is one
+}
+
+// snapshotSettings returns the current value of each of the settings, formatted so they can be compared.
+func snapshotSettings(v *viper.Viper, names []string) map[string]string {
+	settings := make(map[string]string, len(names))
+	for _, name := range names {
+		settings[name] = fmt.Sprint(v.Get(name))
+	}
+	return settings
+}
+
+// Reload reads the configuration file again, if there is one, and applies it to every component which can reload its
+// configuration.  Every component is reloaded even if one of them fails.  A configuration file which is invalid is not
+// applied, and if any component fails to reload, the last configuration file which was applied successfully is
+// applied again.
+func (r *reloader) Reload(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var cf *util.ConfigFile
+	if path := r.v.ConfigFileUsed(); path != "" {
+		var err error
+		if cf, err = util.LoadConfig(r.v, r.resolve); err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if err = cf.Apply(r.v); err == nil {
+			err = validateConfig(r.v)
+		}
+		if err != nil {
+			if r.lastGood != nil {
+				if rollbackErr := r.lastGood.Apply(r.v); rollbackErr != nil {
+					r.logger.WithError(rollbackErr).Error("Failed to restore the previous configuration")
+				}
+			}
+			return fmt.Errorf("invalid configuration in %s, the previous configuration is kept: %v", path, err)
+		}
+	}
+
+	r.warnRestartOnly()
+	if err := r.apply(ctx); err != nil {
+		if cf == nil || r.lastGood == nil {
+			return err
+		}
+		rollbackErr := r.lastGood.Apply(r.v)
+		if rollbackErr == nil {
+			rollbackErr = r.apply(ctx)
+		}
+		if rollbackErr != nil {
+			r.logger.WithError(rollbackErr).Error("Failed to restore the previous configuration")
+		}
+		return fmt.Errorf("%v, the previous configuration was restored", err)
+	}
+	if cf != nil {
+		r.lastGood = cf
+	}
+	r.logger.Info("Reloaded configuration")
+	return nil
+}
+
+// validateConfig returns an error if v has settings which can be reloaded, but are invalid.
+func validateConfig(v *viper.Viper) error {
+	if err := CheckFilters(v); err != nil {
+		return err
+	}
+	if err := CheckEventRoutes(v); err != nil {
+		return err
+	}
+	if err := CheckEventTemplates(v); err != nil {
+		return err
+	}
+	if err := CheckRules(v); err != nil {
+		return err
+	}
+	if err := gostatsd.CheckMetadata(v); err != nil {
+		return err
+	}
+	_, _, err := gostatsd.AggregatedTimerSettings(
+		v,
+		append(v.GetStringSlice(gostatsd.ParamBackends), v.GetStringSlice(gostatsd.ParamInternalBackends)...),
+	)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", gostatsd.ParamPercentThreshold, err)
+	}
+	return nil
+}
+
+// warnRestartOnly logs a warning if any restart only setting has changed since the server started.
+func (r *reloader) warnRestartOnly() {
+	if r.restartOnly != nil {
+		var changed []string
+		for name, value := range snapshotSettings(r.v, restartOnlySettings) {
+			if r.restartOnly[name] != value {
+				changed = append(changed, name)
+			}
+		}
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			r.logger.WithField("settings", changed).Warn("Some settings which changed require a restart to be applied")
+		}
+	}
+}
+
+// apply reloads every component with the current configuration.
+func (r *reloader) apply(ctx context.Context) error {
+	var errs []string
+	if r.onReload != nil {
+		if err := r.onReload(r.v); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, cr := range r.reloaders {
+		if err := cr.ReloadConfig(ctx, r.v); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to reload configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// EffectiveConfig returns every setting as the server sees it, with secrets masked.
+func (r *reloader) EffectiveConfig() map[string]interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return util.EffectiveConfig(r.v, r.isSecret)
+}
+
+// watchConfig returns a Runnable which reloads the configuration when any file it was read from changes, such as a
+// mounted Kubernetes ConfigMap being updated, checking every interval.  A configuration which can not be reloaded is
+// not tried again until the files change again.
+func (r *reloader) watchConfig(interval time.Duration) gostatsd.Runnable {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		checksum := r.configChecksum()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			next := r.configChecksum()
+			if bytes.Equal(next, checksum) {
+				continue
+			}
+			checksum = next
+			r.logger.Info("Reloading configuration as the configuration file changed")
+			if err := r.Reload(ctx); err != nil {
+				r.logger.WithError(err).Error("Failed to reload configuration")
+			}
+		}
+	}
+}
+
+// configChecksum returns a checksum of the contents of every file the configuration was last read from.  A file
+// which can not be read is included as its error, so it is reloaded when it can be read again.
+func (r *reloader) configChecksum() []byte {
+	r.lock.Lock()
+	files := []string{r.v.ConfigFileUsed()}
+	if r.lastGood != nil {
+		files = r.lastGood.Files()
+	}
+	r.lock.Unlock()
+
+	h := sha256.New()
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			contents = []byte(err.Error())
+		}
+		_, _ = fmt.Fprintf(h, "%s\x00%d\x00", file, len(contents))
+		_, _ = h.Write(contents)
+	}
+	return h.Sum(nil)
+}
+
+// reloadOnSignal returns a Runnable which reloads the configuration every time a signal is received on signals.
+func (r *reloader) reloadOnSignal(signals <-chan os.Signal) gostatsd.Runnable {
+	return func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-signals:
+				r.logger.WithField("signal", sig).Info("Reloading configuration on signal")
+				if err := r.Reload(ctx); err != nil {
+					r.logger.WithError(err).Error("Failed to reload configuration")
+				}
+			}
+		}
+	}
+}
+
+// ReloadConfig applies the event routes in v, and the percentiles, disabled sub-metrics, and histogram limit in v to
+// every aggregator.  The aggregated data is kept.
+func (bh *BackendHandler) ReloadConfig(ctx context.Context, v *viper.Viper) error {
+	routes, err := eventRoutesFromViper(v)
+	if err != nil {
+		return err
+	}
+	bh.SetEventRoutes(routes)
+
+	percentThresholds, disabled, err := gostatsd.AggregatedTimerSettings(
+		v,
+		append(v.GetStringSlice(gostatsd.ParamBackends), v.GetStringSlice(gostatsd.ParamInternalBackends)...),
+	)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", gostatsd.ParamPercentThreshold, err)
+	}
+	histogramLimit := v.GetUint32(gostatsd.ParamTimerHistogramLimit)
+
+	var lock sync.Mutex
+	reconfigured := 0
+	wait := bh.Process(ctx, func(aggrId int, aggr Aggregator) {
+		if ma, ok := aggr.(*MetricAggregator); ok {
+			ma.Reconfigure(percentThresholds, disabled, histogramLimit)
+		}
+		lock.Lock()
+		reconfigured++
+		lock.Unlock()
+	})
+	wait()
+	if reconfigured < bh.numWorkers {
+		// Some aggregators may have been reconfigured, there is nothing to roll back to
+		return fmt.Errorf("only reloaded %d of %d aggregators: %v", reconfigured, bh.numWorkers, ctx.Err())
+	}
+	return nil
+}
+
+// backendReloader adds, removes, and reloads the backends metrics and events are sent to when the configuration is
+// reloaded.  A removed backend is stopped once the flushes queued for it have been sent, and the internal backends
+// are reloaded, but can not be added or removed.
+type backendReloader struct {
+	lock       sync.Mutex
+	logger     logrus.FieldLogger
+	newBackend func(name string, v *viper.Viper) (gostatsd.Backend, error)
+	handler    *BackendHandler // The handler events are sent from, or nil if it does not send them to the backends
+	flusher    *MetricFlusher
+	backends   []gostatsd.Backend
+	internal   []gostatsd.Backend
+
+	ctx     context.Context                         // The context of Run, or nil if it is not running
+	cancels map[gostatsd.Backend]context.CancelFunc // Stops the backends started by a reload
+	wg      wait.Group                              // Tracks the backends started by a reload, and their removal
+}
+
+// Run runs the backends added by a reload until the context is done.
+func (br *backendReloader) Run(ctx context.Context) {
+	br.lock.Lock()
+	br.ctx = ctx
+	br.cancels = map[gostatsd.Backend]context.CancelFunc{}
+	br.lock.Unlock()
+
+	<-ctx.Done()
+
+	br.lock.Lock()
+	br.ctx = nil
+	br.lock.Unlock()
+	br.wg.Wait()
+}
+
+// ReloadConfig creates the backends which were added to v, reloads the backends which are kept, and removes the
+// backends which are no longer in v.  If a backend can not be created, the backends are not changed, but the existing
+// backends are still reloaded.
+func (br *backendReloader) ReloadConfig(ctx context.Context, v *viper.Viper) error {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if br.ctx == nil {
+		return errors.New("backends can not be reloaded while the server is not running")
+	}
+
+	existing := make(map[string]gostatsd.Backend, len(br.backends)+len(br.internal))
+	for _, backend := range append(append([]gostatsd.Backend(nil), br.internal...), br.backends...) {
+		existing[backend.Name()] = backend
+	}
+	var backends, added []gostatsd.Backend
+	var errs []string
+	for _, name := range v.GetStringSlice(gostatsd.ParamBackends) {
+		if backend, ok := existing[name]; ok {
+			if !containsBackend(backends, backend) {
+				backends = append(backends, backend)
+			}
+			continue
+		}
+		backend, err := br.newBackend(name, v)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("could not create backend %q: %v", name, err))
+			continue
+		}
+		br.start(backend)
+		existing[name] = backend
+		backends = append(backends, backend)
+		added = append(added, backend)
+	}
+	if len(errs) > 0 {
+		for _, backend := range added {
+			br.stop(backend)
+		}
+		// Keep the current backends, with their new configuration
+		backends = br.backends
+		added = nil
+	}
+
+	// The backends which were just created already have the new configuration
+	var reloaded []gostatsd.Backend
+	for _, backend := range append(append([]gostatsd.Backend(nil), backends...), br.internal...) {
+		if containsBackend(added, backend) || containsBackend(reloaded, backend) {
+			continue
+		}
+		reloaded = append(reloaded, backend)
+		if cr, ok := backend.(gostatsd.ConfigReloader); ok {
+			if err := cr.ReloadConfig(ctx, v); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	var removed []gostatsd.Backend
+	for _, backend := range br.backends {
+		if !containsBackend(backends, backend) {
+			removed = append(removed, backend)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	if br.handler != nil {
+		br.handler.SetBackends(backends)
+	}
+	drained, err := br.flusher.SetBackends(ctx, backends)
+	if err != nil {
+		// The flusher has stopped, so the server is stopping, and the added backends are stopped with it
+		return fmt.Errorf("could not change backends: %v", err)
+	}
+	br.backends = backends
+	for _, backend := range added {
+		br.logger.WithField("backend", backend.Name()).Info("Added backend")
+	}
+	br.wg.Start(func() {
+		drained()
+		br.lock.Lock()
+		defer br.lock.Unlock()
+		for _, backend := range removed {
+			if !containsBackend(br.internal, backend) && !containsBackend(br.backends, backend) {
+				br.stop(backend)
+			}
+			br.logger.WithField("backend", backend.Name()).Info("Removed backend")
+		}
+	})
+	return nil
+}
+
+// start runs the backend until it is removed, if it is a Runner.  It must be called with the lock held.
+func (br *backendReloader) start(backend gostatsd.Backend) {
+	if runner, ok := backend.(gostatsd.Runner); ok {
+		ctx, cancel := context.WithCancel(br.ctx)
+		br.cancels[backend] = cancel
+		br.wg.StartWithContext(ctx, runner.Run)
+	}
+}
+
+// stop stops a backend which was removed.  The backends started when the server started are stopped by closing
+// them, if they can be.  It must be called with the lock held.
+func (br *backendReloader) stop(backend gostatsd.Backend) {
+	if cancel, ok := br.cancels[backend]; ok {
+		cancel()
+		delete(br.cancels, backend)
+	} else if c, ok := backend.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			br.logger.WithError(err).WithField("backend", backend.Name()).Warn("Failed to close removed backend")
+		}
+	}
+}
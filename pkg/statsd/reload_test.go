@@ -0,0 +1,254 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+)
+
+func TestReloaderReloadsConfigFile(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("percent-threshold='90'\n"), 0600))
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	require.NoError(t, v.ReadInConfig())
+
+	bh := NewBackendHandler(nil, 0, 2, 0, 0, 0, AggregatorFactoryFunc(func() Aggregator {
+		return newFakeAggregator()
+	}))
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, bh.Run)
+
+	var onReload []string
+	r := &reloader{
+		logger:    logrus.StandardLogger(),
+		v:         v,
+		reloaders: []gostatsd.ConfigReloader{bh},
+		onReload: func(v *viper.Viper) error {
+			onReload = append(onReload, v.GetString("percent-threshold"))
+			return nil
+		},
+	}
+
+	percentiles := func() []float64 {
+		var lock sync.Mutex
+		var pcts []float64
+		bh.Process(ctx, func(aggrId int, aggr Aggregator) {
+			lock.Lock()
+			defer lock.Unlock()
+			for pct := range aggr.(*MetricAggregator).percentThresholds {
+				pcts = append(pcts, pct)
+			}
+		})()
+		return pcts
+	}
+	assert.Equal(t, []float64{90, 90}, percentiles())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("percent-threshold='99'\n"), 0600))
+	require.NoError(t, r.Reload(ctx))
+	assert.Equal(t, []float64{99, 99}, percentiles())
+
+	// An invalid configuration is not applied, and the previous configuration is kept
+	require.NoError(t, ioutil.WriteFile(path, []byte("percent-threshold='high'\n"), 0600))
+	assert.Error(t, r.Reload(ctx))
+	assert.Equal(t, []float64{99, 99}, percentiles())
+	assert.Equal(t, "99", v.GetString("percent-threshold"))
+
+	assert.Equal(t, []string{"99"}, onReload)
+}
+
+// settingReloader records the value of a setting every time it is reloaded, and fails to reload if it is "bad".
+type settingReloader struct {
+	lock   sync.Mutex
+	values []string
+}
+
+func (sr *settingReloader) ReloadConfig(ctx context.Context, v *viper.Viper) error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	value := v.GetString("setting")
+	sr.values = append(sr.values, value)
+	if value == "bad" {
+		return errors.New("bad setting")
+	}
+	return nil
+}
+
+func (sr *settingReloader) Values() []string {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	return append([]string(nil), sr.values...)
+}
+
+func TestReloaderRestoresLastGoodConfig(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("setting='good'\n"), 0600))
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	require.NoError(t, util.ReadConfig(v, nil))
+	lastGood, err := util.LoadConfig(v, nil)
+	require.NoError(t, err)
+
+	sr := &settingReloader{}
+	r := &reloader{
+		logger:    logrus.StandardLogger(),
+		v:         v,
+		reloaders: []gostatsd.ConfigReloader{sr},
+		lastGood:  lastGood,
+	}
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("setting='bad'\nother='x'\n"), 0600))
+	assert.Error(t, r.Reload(context.Background()))
+	assert.Equal(t, []string{"bad", "good"}, sr.Values())
+	assert.Equal(t, "good", v.GetString("setting"))
+	assert.False(t, v.IsSet("other"))
+}
+
+func TestReloaderWatchesConfigFile(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("setting='first'\n"), 0600))
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	require.NoError(t, util.ReadConfig(v, nil))
+
+	sr := &settingReloader{}
+	r := &reloader{
+		logger:    logrus.StandardLogger(),
+		v:         v,
+		reloaders: []gostatsd.ConfigReloader{sr},
+	}
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, r.watchConfig(10*time.Millisecond))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, sr.Values())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("setting='second'\n"), 0600))
+	require.Eventually(t, func() bool {
+		return len(sr.Values()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"second"}, sr.Values())
+}
+
+// namedBackend counts the flushes it is sent, and records if it was closed.
+type namedBackend struct {
+	name    string
+	flushes uint64 // atomic
+	closed  uint32 // atomic
+}
+
+func (nb *namedBackend) Name() string {
+	return nb.name
+}
+
+func (nb *namedBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	atomic.AddUint64(&nb.flushes, 1)
+	callback(nil)
+}
+
+func (nb *namedBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (nb *namedBackend) Close() error {
+	atomic.StoreUint32(&nb.closed, 1)
+	return nil
+}
+
+func TestBackendReloaderAddsAndRemovesBackends(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := &namedBackend{name: "a"}
+	bh := NewBackendHandler([]gostatsd.Backend{a}, 0, 1, 0, 0, 0, newTestFactory())
+	fl := NewMetricFlusher(time.Hour, 0, false, 1, bh, []gostatsd.Backend{a})
+	created := map[string]*namedBackend{}
+	br := &backendReloader{
+		logger: logrus.StandardLogger(),
+		newBackend: func(name string, v *viper.Viper) (gostatsd.Backend, error) {
+			if name == "invalid" {
+				return nil, errors.New("invalid backend")
+			}
+			created[name] = &namedBackend{name: name}
+			return created[name], nil
+		},
+		handler:  bh,
+		flusher:  fl,
+		backends: []gostatsd.Backend{a},
+	}
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, bh.Run)
+	wg.StartWithContext(ctx, fl.Run)
+	wg.StartWithContext(ctx, br.Run)
+	require.Eventually(t, func() bool {
+		br.lock.Lock()
+		defer br.lock.Unlock()
+		return br.ctx != nil
+	}, time.Second, time.Millisecond)
+
+	v := viper.New()
+	v.Set(gostatsd.ParamBackends, []string{"a", "b"})
+	require.NoError(t, br.ReloadConfig(ctx, v))
+	require.Contains(t, created, "b")
+	b := created["b"]
+	assert.Equal(t, []gostatsd.Backend{a, b}, bh.currentBackends())
+	require.NoError(t, fl.FlushNow(ctx, false))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&a.flushes))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&b.flushes))
+
+	// A backend which can not be created leaves the backends unchanged
+	v.Set(gostatsd.ParamBackends, []string{"b", "invalid"})
+	assert.Error(t, br.ReloadConfig(ctx, v))
+	assert.Equal(t, []gostatsd.Backend{a, b}, bh.currentBackends())
+
+	v.Set(gostatsd.ParamBackends, []string{"b"})
+	require.NoError(t, br.ReloadConfig(ctx, v))
+	assert.Equal(t, []gostatsd.Backend{b}, bh.currentBackends())
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&a.closed) == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, fl.FlushNow(ctx, false))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&a.flushes))
+	assert.EqualValues(t, 2, atomic.LoadUint64(&b.flushes))
+}
@@ -0,0 +1,410 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+// conditionRegexp parses the condition of a rule, such as "error_rate > 0.05 for 3 intervals", or "max(latency) > 500".
+var conditionRegexp = regexp.MustCompile(`^\s*(?:(\w+)\(\s*(\S+?)\s*\)|(\S+))\s*(>=|<=|==|!=|>|<)\s*(\S+)(?:\s+for\s+(\d+)\s+intervals?)?\s*$`)
+
+// ruleFields are the values of each type of metric a rule can compare, and the first is used if none is given.
+var ruleFields = map[string][]string{
+	"counter": {"rate", "count"},
+	"gauge":   {"value"},
+	"timer":   {"mean", "count", "rate", "min", "max", "median", "sum", "stddev"},
+	"set":     {"count"},
+}
+
+// thresholdRule generates an event when a series of a metric breaches a threshold for a number of consecutive flushes,
+// and another when it recovers.
+type thresholdRule struct {
+	name      string
+	condition string
+	metric    string
+	field     string // The value compared, or "" for the default of the type of the metric
+	op        string
+	threshold float64
+	intervals int
+
+	matchTags gostatsd.StringMatchList // Any tag must match, if set
+	title     string
+	alertType gostatsd.AlertType
+	priority  gostatsd.Priority
+	recovery  bool // Send an event when a series recovers
+}
+
+// ruleSettings are the settings of a rule section.
+var ruleSettings = map[string]bool{
+	"condition":  true,
+	"match-tags": true,
+	"title":      true,
+	"alert-type": true,
+	"priority":   true,
+	"recovery":   true,
+}
+
+// rulesFromViper returns the rules named in rules, each configured by its rule section.
+func rulesFromViper(v *viper.Viper) ([]*thresholdRule, error) {
+	var rules []*thresholdRule
+	for _, name := range v.GetStringSlice("rules") {
+		vRule := v.Sub("rule." + name)
+		if vRule == nil {
+			return nil, fmt.Errorf("rule %q has no rule.%s section", name, name)
+		}
+		rule, err := newRuleFromViper(name, vRule)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func newRuleFromViper(name string, v *viper.Viper) (*thresholdRule, error) {
+	v.SetDefault("alert-type", gostatsd.AlertError.String())
+	v.SetDefault("priority", gostatsd.PriNormal.String())
+	v.SetDefault("recovery", true)
+	rule := &thresholdRule{
+		name:      name,
+		condition: v.GetString("condition"),
+		title:     v.GetString("title"),
+		recovery:  v.GetBool("recovery"),
+	}
+	m := conditionRegexp.FindStringSubmatch(rule.condition)
+	if m == nil {
+		return nil, fmt.Errorf("rule.%s.condition: invalid condition %q, must be like 'error_rate > 0.05 for 3 intervals'", name, rule.condition)
+	}
+	rule.field, rule.metric, rule.op = m[1], m[2]+m[3], m[4]
+	if rule.field != "" && !isRuleField(rule.field) {
+		return nil, fmt.Errorf("rule.%s.condition: unknown value %q, must be one of rate, count, value, mean, min, max, median, sum, or stddev", name, rule.field)
+	}
+	var err error
+	if rule.threshold, err = strconv.ParseFloat(m[5], 64); err != nil {
+		return nil, fmt.Errorf("rule.%s.condition: invalid threshold %q", name, m[5])
+	}
+	rule.intervals = 1
+	if m[6] != "" {
+		if rule.intervals, err = strconv.Atoi(m[6]); err != nil || rule.intervals < 1 {
+			return nil, fmt.Errorf("rule.%s.condition: invalid intervals %q", name, m[6])
+		}
+	}
+	if rule.title == "" {
+		rule.title = fmt.Sprintf("Rule %s: %s", name, strings.TrimSpace(rule.condition))
+	}
+	for _, test := range v.GetStringSlice("match-tags") {
+		sm, err := gostatsd.ParseStringMatch(test)
+		if err != nil {
+			return nil, fmt.Errorf("rule.%s.match-tags: %v", name, err)
+		}
+		rule.matchTags = append(rule.matchTags, sm)
+	}
+	alertType, ok := alertTypes[v.GetString("alert-type")]
+	if !ok {
+		return nil, fmt.Errorf("rule.%s.alert-type: invalid alert type %q, must be info, warning, error, or success", name, v.GetString("alert-type"))
+	}
+	rule.alertType = alertType
+	priority, ok := priorities[v.GetString("priority")]
+	if !ok {
+		return nil, fmt.Errorf("rule.%s.priority: invalid priority %q, must be normal or low", name, v.GetString("priority"))
+	}
+	rule.priority = priority
+	return rule, nil
+}
+
+func isRuleField(field string) bool {
+	for _, fields := range ruleFields {
+		for _, f := range fields {
+			if f == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckRules returns an error listing every problem with the rules, including every setting of a rule section which is
+// not known, so a typo is not silently ignored.
+func CheckRules(v *viper.Viper) error {
+	var errs []string
+	for _, name := range v.GetStringSlice("rules") {
+		vRule := v.Sub("rule." + name)
+		if vRule == nil {
+			errs = append(errs, fmt.Sprintf("rule %q has no rule.%s section", name, name))
+			continue
+		}
+		for _, key := range vRule.AllKeys() {
+			if !ruleSettings[key] {
+				errs = append(errs, fmt.Sprintf("unknown setting rule.%s.%s", name, key))
+			}
+		}
+		if _, err := newRuleFromViper(name, vRule); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// breached returns true if value breaches the threshold.
+func (r *thresholdRule) breached(value float64) bool {
+	switch r.op {
+	case ">":
+		return value > r.threshold
+	case ">=":
+		return value >= r.threshold
+	case "<":
+		return value < r.threshold
+	case "<=":
+		return value <= r.threshold
+	case "==":
+		return value == r.threshold
+	default:
+		return value != r.threshold
+	}
+}
+
+// ruleValue is the value of a series compared by a rule.
+type ruleValue struct {
+	value  float64
+	tags   gostatsd.Tags
+	source gostatsd.Source
+}
+
+// values calls f with the value of every series of the metric of the rule in mm, by the tags key of the series.
+func (r *thresholdRule) values(mm *gostatsd.MetricMap, f func(tagsKey string, v ruleValue)) {
+	if r.usesField("counter") {
+		for tagsKey, c := range mm.Counters[r.metric] {
+			value := c.PerSecond
+			if r.field == "count" {
+				value = float64(c.Value)
+			}
+			f(tagsKey, ruleValue{value: value, tags: c.Tags, source: c.Source})
+		}
+	}
+	if r.usesField("gauge") {
+		for tagsKey, g := range mm.Gauges[r.metric] {
+			f(tagsKey, ruleValue{value: g.Value, tags: g.Tags, source: g.Source})
+		}
+	}
+	if r.usesField("timer") {
+		for tagsKey, t := range mm.Timers[r.metric] {
+			var value float64
+			switch r.field {
+			case "count":
+				value = float64(t.Count)
+			case "rate":
+				value = t.PerSecond
+			case "min":
+				value = t.Min
+			case "max":
+				value = t.Max
+			case "median":
+				value = t.Median
+			case "sum":
+				value = t.Sum
+			case "stddev":
+				value = t.StdDev
+			default:
+				value = t.Mean
+			}
+			f(tagsKey, ruleValue{value: value, tags: t.Tags, source: t.Source})
+		}
+	}
+	if r.usesField("set") {
+		for tagsKey, s := range mm.Sets[r.metric] {
+			f(tagsKey, ruleValue{value: float64(len(s.Values)), tags: s.Tags, source: s.Source})
+		}
+	}
+}
+
+// usesField returns true if the rule compares a value which metrics of the type have.
+func (r *thresholdRule) usesField(metricType string) bool {
+	if r.field == "" {
+		return true
+	}
+	for _, f := range ruleFields[metricType] {
+		if f == r.field {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleSeries is the state of a rule for a series which is breaching it, or has triggered it.
+type ruleSeries struct {
+	breaches int  // Consecutive flushes the series breached the threshold
+	firing   bool // The event for the series was sent, and it has not recovered
+}
+
+// ruleEngine evaluates threshold rules against every flush, and sends an event when a series breaches a rule for the
+// number of consecutive flushes it requires, and another when it recovers.  The events are sent through the pipeline,
+// so they are processed like any other event.
+type ruleEngine struct {
+	handler gostatsd.PipelineHandler // Where the events are sent, set before the flusher is run
+
+	lock  sync.Mutex // Held while evaluating, or replacing the rules
+	rules []*thresholdRule
+	state map[*thresholdRule]map[string]*ruleSeries
+
+	fired    uint64 // atomic - events sent for rules which triggered, since the last flush
+	resolved uint64 // atomic - events sent for rules which recovered, since the last flush
+}
+
+func newRuleEngine(rules []*thresholdRule) *ruleEngine {
+	return &ruleEngine{
+		rules: rules,
+		state: map[*thresholdRule]map[string]*ruleSeries{},
+	}
+}
+
+// ReloadConfig replaces the rules with the rules in v.  The consecutive breaches counted so far are reset, and no
+// recovery events are sent for series which triggered a rule before the reload.
+func (re *ruleEngine) ReloadConfig(ctx context.Context, v *viper.Viper) error {
+	rules, err := rulesFromViper(v)
+	if err != nil {
+		return err
+	}
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	re.rules = rules
+	re.state = map[*thresholdRule]map[string]*ruleSeries{}
+	return nil
+}
+
+// evaluate compares the series of a flush with every rule, and sends the events for the series which triggered or
+// recovered.  Each series is in one of the maps.
+func (re *ruleEngine) evaluate(ctx context.Context, maps []*gostatsd.MetricMap) {
+	for _, e := range re.events(maps, time.Now()) {
+		re.handler.DispatchEvent(ctx, e)
+	}
+}
+
+func (re *ruleEngine) events(maps []*gostatsd.MetricMap, now time.Time) []*gostatsd.Event {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	var events []*gostatsd.Event
+	for _, rule := range re.rules {
+		state := re.state[rule]
+		if state == nil {
+			state = map[string]*ruleSeries{}
+			re.state[rule] = state
+		}
+		seen := map[string]struct{}{}
+		for _, mm := range maps {
+			rule.values(mm, func(tagsKey string, v ruleValue) {
+				if len(rule.matchTags) > 0 && !rule.matchTags.MatchAnyMultiple(v.tags) {
+					return
+				}
+				seen[tagsKey] = struct{}{}
+				rs := state[tagsKey]
+				if !rule.breached(v.value) {
+					if rs != nil && rs.firing && rule.recovery {
+						events = append(events, rule.event(tagsKey, v, false, now))
+						atomic.AddUint64(&re.resolved, 1)
+					}
+					delete(state, tagsKey)
+					return
+				}
+				if rs == nil {
+					rs = &ruleSeries{}
+					state[tagsKey] = rs
+				}
+				rs.breaches++
+				if rs.breaches >= rule.intervals && !rs.firing {
+					rs.firing = true
+					events = append(events, rule.event(tagsKey, v, true, now))
+					atomic.AddUint64(&re.fired, 1)
+				}
+			})
+		}
+		// A series which was not flushed is no longer breaching the rule, but its value is unknown
+		for tagsKey, rs := range state {
+			if _, ok := seen[tagsKey]; !ok {
+				if rs.firing && rule.recovery {
+					events = append(events, rule.event(tagsKey, ruleValue{value: 0}, false, now))
+					atomic.AddUint64(&re.resolved, 1)
+				}
+				delete(state, tagsKey)
+			}
+		}
+	}
+	return events
+}
+
+// event returns the event for a series triggering the rule, or recovering.
+func (r *thresholdRule) event(tagsKey string, v ruleValue, triggered bool, now time.Time) *gostatsd.Event {
+	metric := r.metric
+	if r.field != "" {
+		metric = r.field + "(" + r.metric + ")"
+	}
+	if tagsKey != "" {
+		metric += "{" + tagsKey + "}"
+	}
+	e := &gostatsd.Event{
+		DateHappened:   now.Unix(),
+		AggregationKey: "gostatsd-rule:" + r.name + ":" + tagsKey,
+		SourceTypeName: "gostatsd",
+		Tags:           append(v.tags.Copy(), "rule:"+r.name),
+		Source:         v.source,
+		Priority:       r.priority,
+	}
+	if triggered {
+		e.Title = r.title
+		e.Text = fmt.Sprintf("%s is %v, which is %s %v for %d intervals", metric, v.value, r.op, r.threshold, r.intervals)
+		e.AlertType = r.alertType
+	} else {
+		e.Title = "Recovered: " + r.title
+		e.Text = fmt.Sprintf("%s is no longer %s %v", metric, r.op, r.threshold)
+		e.AlertType = gostatsd.AlertSuccess
+	}
+	return e
+}
+
+// RunMetricsContext writes the events sent since the last flush, and the series triggering a rule, every flush until
+// the context is done.
+func (re *ruleEngine) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Count("rules.fired", float64(atomic.SwapUint64(&re.fired, 0)), nil)
+			statser.Count("rules.resolved", float64(atomic.SwapUint64(&re.resolved, 0)), nil)
+			statser.Gauge("rules.firing", float64(re.firing()), nil)
+		}
+	}
+}
+
+// firing returns the number of series which triggered a rule and have not recovered.
+func (re *ruleEngine) firing() int {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	firing := 0
+	for _, state := range re.state {
+		for _, rs := range state {
+			if rs.firing {
+				firing++
+			}
+		}
+	}
+	return firing
+}
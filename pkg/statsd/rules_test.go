@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestRuleEngineFiresAndRecovers(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+rules = ['errors', 'latency']
+[rule.errors]
+condition = 'error_rate > 0.05 for 3 intervals'
+title = 'Error rate is high'
+[rule.latency]
+condition = 'max(latency) >= 500'
+match-tags = ['env:prod']
+alert-type = 'warning'
+recovery = false
+`)))
+	require.NoError(t, CheckRules(v))
+	rules, err := rulesFromViper(v)
+	require.NoError(t, err)
+	re := newRuleEngine(rules)
+	now := time.Unix(1000, 0)
+
+	flush := func(errorRate, latency float64) []*gostatsd.Event {
+		mm := gostatsd.NewMetricMap()
+		mm.Gauges["error_rate"] = map[string]gostatsd.Gauge{
+			"service:a": {Value: errorRate, Tags: gostatsd.Tags{"service:a"}, Source: "host-a"},
+		}
+		mm.Timers["latency"] = map[string]gostatsd.Timer{
+			"env:prod": {Max: latency, Mean: 1, Tags: gostatsd.Tags{"env:prod"}},
+			"env:test": {Max: latency, Mean: 1, Tags: gostatsd.Tags{"env:test"}},
+		}
+		// The series of a flush are divided between the aggregators
+		return re.events([]*gostatsd.MetricMap{mm, gostatsd.NewMetricMap()}, now)
+	}
+
+	assert.Empty(t, flush(0.1, 0))
+	assert.Empty(t, flush(0.1, 0))
+	events := flush(0.1, 0)
+	require.Len(t, events, 1)
+	assert.Equal(t, &gostatsd.Event{
+		Title:          "Error rate is high",
+		Text:           "error_rate{service:a} is 0.1, which is > 0.05 for 3 intervals",
+		DateHappened:   1000,
+		AggregationKey: "gostatsd-rule:errors:service:a",
+		SourceTypeName: "gostatsd",
+		Tags:           gostatsd.Tags{"service:a", "rule:errors"},
+		Source:         "host-a",
+		AlertType:      gostatsd.AlertError,
+	}, events[0])
+	// It only fires once while it is breached
+	assert.Empty(t, flush(0.1, 0))
+	assert.Equal(t, 1, re.firing())
+
+	// A breach which is not consecutive is not counted
+	events = flush(0, 0)
+	require.Len(t, events, 1)
+	assert.Equal(t, "Recovered: Error rate is high", events[0].Title)
+	assert.Equal(t, gostatsd.AlertSuccess, events[0].AlertType)
+	assert.Empty(t, flush(0.1, 0))
+	assert.Empty(t, flush(0, 0))
+	assert.Empty(t, flush(0.1, 0))
+	assert.Empty(t, flush(0.1, 0))
+
+	// Only the series with matching tags are compared, and the rule does not recover
+	events = flush(0, 500)
+	require.Len(t, events, 1)
+	assert.Equal(t, "Rule latency: max(latency) >= 500", events[0].Title)
+	assert.Equal(t, "max(latency){env:prod} is 500, which is >= 500 for 1 intervals", events[0].Text)
+	assert.Equal(t, gostatsd.AlertWarning, events[0].AlertType)
+	assert.Empty(t, flush(0, 0))
+	assert.EqualValues(t, 2, re.fired)
+	assert.EqualValues(t, 1, re.resolved)
+}
+
+func TestCheckRules(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+rules = ['typo', 'syntax', 'field', 'intervals', 'missing']
+[rule.typo]
+condition = 'a > 1'
+alert-typ = 'error'
+[rule.syntax]
+condition = 'a is big'
+[rule.field]
+condition = 'p99(a) > 1'
+[rule.intervals]
+condition = 'a > 1 for 0 intervals'
+`)))
+	err := CheckRules(v)
+	require.Error(t, err)
+	assert.Equal(t, `unknown setting rule.typo.alert-typ; `+
+		`rule.syntax.condition: invalid condition "a is big", must be like 'error_rate > 0.05 for 3 intervals'; `+
+		`rule.field.condition: unknown value "p99", must be one of rate, count, value, mean, min, max, median, sum, or stddev; `+
+		`rule.intervals.condition: invalid intervals "0"; `+
+		`rule "missing" has no rule.missing section`, err.Error())
+	_, err = rulesFromViper(v)
+	assert.Error(t, err)
+}
@@ -0,0 +1,40 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// spoolEntry describes a payload which could not be forwarded.  It is stored in the spool as a line of json, followed
+// by the serialized payload.
+type spoolEntry struct {
+	APIEndpoint     string `json:"api_endpoint"`
+	Endpoint        string `json:"endpoint"`
+	EndpointType    string `json:"endpoint_type"`
+	ProtocolVersion int    `json:"protocol_version,omitempty"`
+	DynHeaderTags   string `json:"dyn_header_tags,omitempty"`
+}
+
+// encodeSpoolEntry returns the record stored in the spool for a payload.
+func encodeSpoolEntry(entry *spoolEntry, raw []byte) ([]byte, error) {
+	header, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 0, len(header)+1+len(raw))
+	return append(append(append(record, header...), '\n'), raw...), nil
+}
+
+// decodeSpoolEntry returns the entry and payload of a record read from the spool.
+func decodeSpoolEntry(record []byte) (*spoolEntry, []byte, error) {
+	end := bytes.IndexByte(record, '\n')
+	if end < 0 {
+		return nil, nil, fmt.Errorf("missing header")
+	}
+	var entry spoolEntry
+	if err := json.Unmarshal(record[:end], &entry); err != nil {
+		return nil, nil, fmt.Errorf("invalid header: %v", err)
+	}
+	return &entry, record[end+1:], nil
+}
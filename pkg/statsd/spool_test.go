@@ -0,0 +1,132 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pb"
+	"github.com/hligit/gostatsd/pkg/transport"
+)
+
+func TestSpoolEntry(t *testing.T) {
+	t.Parallel()
+	entry := &spoolEntry{APIEndpoint: "http://a", Endpoint: "/v2/raw", EndpointType: "metrics", ProtocolVersion: 3}
+	record, err := encodeSpoolEntry(entry, []byte("payload\nwith a newline"))
+	require.NoError(t, err)
+	decoded, raw, err := decodeSpoolEntry(record)
+	require.NoError(t, err)
+	assert.Equal(t, entry, decoded)
+	assert.Equal(t, "payload\nwith a newline", string(raw))
+
+	_, _, err = decodeSpoolEntry([]byte("no header"))
+	assert.Error(t, err)
+	_, _, err = decodeSpoolEntry([]byte("{\n"))
+	assert.Error(t, err)
+}
+
+func TestHttpForwarderV2SpoolsAndReplays(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var up, received uint32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadUint32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddUint32(&received, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{server.URL}, 1, 1, "identity", 0, -1, time.Second,
+		nil, nil, GrpcOptions{}, SpoolOptions{Path: dir, MaxBytes: 1024 * 1024, ReplayRate: 1000}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hfh.post(ctx, hfh.targets[0], &pb.RawMessageV2{}, 0, "", 0, "metrics", "/v2/raw")
+	hfh.post(ctx, hfh.targets[0], &pb.RawMessageV2{}, 0, "", 1, "metrics", "/v2/raw")
+	require.EqualValues(t, 2, atomic.LoadUint64(&hfh.messagesSpooled))
+	require.Zero(t, atomic.LoadUint64(&hfh.messagesDropped))
+	require.Error(t, hfh.CheckReady())
+
+	atomic.StoreUint32(&up, 1)
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, hfh.replaySpool)
+
+	require.Eventually(t, func() bool {
+		return hfh.spool.Stats().Records == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 2, atomic.LoadUint32(&received))
+	assert.EqualValues(t, 2, atomic.LoadUint64(&hfh.spoolReplayed))
+}
+
+func TestHttpForwarderV2SpoolsQueuedOnShutdown(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{"http://127.0.0.1:1"}, 1, 1, "identity", 0, -1, time.Second,
+		nil, nil, GrpcOptions{}, SpoolOptions{Path: dir, MaxBytes: 1024 * 1024, ReplayRate: 1000}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Type: gostatsd.COUNTER, Rate: 1})
+		_, ok := hfh.queue.push(context.Background(), &forwarderBatch{target: hfh.targets[0], metricMap: mm})
+		require.True(t, ok)
+	}
+
+	hfh.spoolQueued(context.Background())
+	assert.Zero(t, hfh.queue.len())
+	assert.EqualValues(t, 2, atomic.LoadUint64(&hfh.messagesSpooled))
+	assert.Zero(t, atomic.LoadUint64(&hfh.queueDropped))
+	spoolStats := hfh.spool.Stats()
+	assert.Equal(t, 2, spoolStats.Records)
+}
+
+func TestHttpForwarderV2SpoolEvictsOldest(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := logrus.New()
+	pool := transport.NewTransportPool(logger, viper.New())
+	hfh, err := NewHttpForwarderHandlerV2(logger, "default", "http", 0, []string{"http://127.0.0.1:1"}, 1, 1, "identity", 0, -1, time.Second,
+		nil, nil, GrpcOptions{}, SpoolOptions{Path: dir, MaxBytes: 300, ReplayRate: 1000}, QueueOptions{}, EventOptions{}, pool)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.True(t, hfh.spoolPayload(context.Background(), logger, hfh.targets[0], "metrics", "/v2/raw", []byte("payload"), 2, pb.ProtocolVersion2, ""))
+	}
+	spoolStats := hfh.spool.Stats()
+	assert.LessOrEqual(t, spoolStats.Bytes, int64(300))
+	assert.EqualValues(t, 5, atomic.LoadUint64(&hfh.messagesSpooled))
+	assert.EqualValues(t, 5-spoolStats.Records, atomic.LoadUint64(&hfh.spoolDropped))
+	assert.NotZero(t, atomic.LoadUint64(&hfh.spoolDropped))
+
+}
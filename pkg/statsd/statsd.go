@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/ash2k/stager"
@@ -12,44 +14,74 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"golang.org/x/time/rate"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/profiling"
+	"github.com/hligit/gostatsd/pkg/secrets"
 	"github.com/hligit/gostatsd/pkg/stats"
 	"github.com/hligit/gostatsd/pkg/transport"
 	"github.com/hligit/gostatsd/pkg/web"
 )
 
+// readyPollInterval is how often the server checks if it is receiving metrics, until it calls OnReady.
+const readyPollInterval = 100 * time.Millisecond
+
 // Server encapsulates all of the parameters necessary for starting up
 // the statsd server. These can either be set via command line or directly.
 type Server struct {
-	Runnables                 []gostatsd.Runnable
-	Backends                  []gostatsd.Backend
-	CachedInstances           gostatsd.CachedInstances
-	InternalTags              gostatsd.Tags
-	InternalNamespace         string
-	DefaultTags               gostatsd.Tags
-	ExpiryIntervalCounter     time.Duration
-	ExpiryIntervalGauge       time.Duration
-	ExpiryIntervalSet         time.Duration
-	ExpiryIntervalTimer       time.Duration
-	FlushInterval             time.Duration
-	FlushOffset               time.Duration
-	FlushAligned              bool
-	MaxReaders                int
-	MaxParsers                int
-	MaxWorkers                int
-	MaxQueueSize              int
-	MaxConcurrentEvents       int
-	MaxEventQueueSize         int
-	EstimatedTags             int
-	MetricsAddr               string
-	Namespace                 string
-	StatserType               string
-	PercentThreshold          []float64
-	IgnoreHost                bool
-	ConnPerReader             bool
-	HeartbeatEnabled          bool
-	HeartbeatTags             gostatsd.Tags
+	Runnables               []gostatsd.Runnable
+	Backends                []gostatsd.Backend
+	InternalBackends        []gostatsd.Backend
+	CachedInstances         gostatsd.CachedInstances
+	CloudStripSourceZone    bool
+	InternalTags            gostatsd.Tags
+	InternalNamespace       string
+	InternalMetricsRename   map[string]string
+	InternalMetricsDisabled []string
+	DefaultTags             gostatsd.Tags
+	ExpiryIntervalCounter   time.Duration
+	ExpiryIntervalGauge     time.Duration
+	ExpiryIntervalSet       time.Duration
+	ExpiryIntervalTimer     time.Duration
+	FlushInterval           time.Duration
+	FlushOffset             time.Duration
+	FlushAligned            bool
+	// FlushJitter is the maximum random delay of each flush after its tick, so many servers with the same interval do
+	// not all flush at the same moment.
+	FlushJitter time.Duration
+	// FlushSplay is the maximum random delay of each backend sending a flush, which spreads the sends over a window.
+	FlushSplay             time.Duration
+	FlushQueueSize         int
+	MaxReaders             int
+	MaxParsers             int
+	MaxWorkers             int
+	AggregatorShards       int
+	AggregatorMaxSeries    int
+	AggregatorMaxSamples   int
+	MaxQueueSize           int
+	DispatchBatchSize      int
+	DispatchBatchDelay     time.Duration
+	MaxConcurrentEvents    int
+	MaxEventQueueSize      int
+	EstimatedTags          int
+	MetricsAddr            string
+	Namespace              string
+	StatserType            string
+	PercentThreshold       []float64
+	IgnoreHost             bool
+	ConnPerReader          bool
+	HeartbeatEnabled       bool
+	HeartbeatTags          gostatsd.Tags
+	RuntimeMetricsEnabled  bool
+	DroppedSummaryInterval time.Duration
+	// RetryBudgetRatio is the retries allowed per payload sent, shared by every backend and the forwarder, so one
+	// failing destination can not take the capacity of the others.  0 allows every retry.
+	RetryBudgetRatio float64
+	// RetryBudgetMinPerSecond is the retries allowed every second, in addition to RetryBudgetRatio.
+	RetryBudgetMinPerSecond   float64
+	MemoryLimit               uint64
 	ReceiveBatchSize          int
 	DisabledSubTypes          gostatsd.TimerSubtypes
 	HistogramLimit            uint32
@@ -59,6 +91,85 @@ type Server struct {
 	LogRawMetric              bool
 	Viper                     *viper.Viper
 	TransportPool             *transport.TransportPool
+	// Profiler pushes profiles periodically and captures them when triggered, if it is not nil.
+	Profiler *profiling.Profiler
+	// FlushSignals triggers an immediate flush for every signal received, if it is not nil.
+	FlushSignals <-chan os.Signal
+	// DrainSignals triggers a drain for the first signal received, if it is not nil.  The server stops receiving,
+	// sends everything it has received, and exits.
+	DrainSignals <-chan os.Signal
+	// DrainTimeout is the time a drain triggered by a signal is given to finish.
+	DrainTimeout time.Duration
+	// ShutdownFlushTimeout is the time the final flush is given to send everything received when the context is done,
+	// or 0 to return immediately.
+	ShutdownFlushTimeout time.Duration
+	// HAPeerURL is the health endpoint of the other server of an active-active pair receiving the same traffic.  While
+	// it is healthy, this server only sends the half of the series it owns.  HA is disabled if it is empty.
+	HAPeerURL string
+	// HAIndex is which half of the series this server owns, 0 or 1.  It must be different on each server of the pair.
+	HAIndex int
+	// HACheckInterval is how often the health of the peer is checked.
+	HACheckInterval time.Duration
+	// ShadowBackends are sent a copy of ShadowPercentage of the series of every flush, as well as the Backends, without
+	// ever delaying the Backends.  They must be separate instances from the Backends.
+	ShadowBackends []gostatsd.Backend
+	// ShadowPercentage is the percentage of the series sent to the ShadowBackends, from 0 to 100.
+	ShadowPercentage float64
+	// MetricsSocket is the path of a unix datagram socket on which metrics are also received, if it is not empty.
+	MetricsSocket string
+	// OriginDetection resolves the sender of each datagram on the MetricsSocket to the container it runs in, which is
+	// the Source of its metrics and events, so they are attributed to the right pod even if it shares its IP.
+	OriginDetection bool
+	// LeaderElectionLease is the name of the Kubernetes Lease used to elect one of the replicas of a Deployment as the
+	// leader.  Every replica sends its own series, but only the leader sends the heartbeat and the events.  Leader
+	// election is disabled if it is empty.
+	LeaderElectionLease string
+	// LeaderElectionNamespace is the namespace of the Lease, or "" for the namespace of the pod.
+	LeaderElectionNamespace string
+	// LeaderElectionIdentity is the identity of this server in the election, or "" for the Hostname.
+	LeaderElectionIdentity string
+	// LeaderElectionLeaseDuration is how long other replicas wait before taking over the Lease of a leader which
+	// stopped renewing it.
+	LeaderElectionLeaseDuration time.Duration
+	// LeaderElectionRenewDeadline is how long the leader retries renewing the Lease before it stops being the leader.
+	LeaderElectionRenewDeadline time.Duration
+	// LeaderElectionRetryPeriod is the interval between attempts to acquire or renew the Lease.
+	LeaderElectionRetryPeriod time.Duration
+	// EventThrottleWindow is the window in which events identical to one already sent are dropped, and events are
+	// limited by EventThrottlePerKey.  A summary is sent for the events suppressed in each window.  0 disables it.
+	EventThrottleWindow time.Duration
+	// EventThrottlePerKey is the number of events sent for each aggregation key, or title, in a window, or 0 for no
+	// limit.
+	EventThrottlePerKey int
+	// LeaderElectionClient is the Kubernetes client used for the Lease, or nil to use the in-cluster configuration.
+	LeaderElectionClient kubernetes.Interface
+	// ReloadSignals triggers a reload of the configuration for every signal received, if it is not nil.
+	ReloadSignals <-chan os.Signal
+	// OnReload is called with the reloaded configuration, to reload settings owned by the caller, if it is not nil.
+	OnReload func(v *viper.Viper) error
+	// Secrets resolves references to secrets in the configuration file when it is reloaded, if it is not nil.
+	Secrets *secrets.Resolver
+	// SecretRefreshInterval is the interval at which the secrets are resolved again, and the configuration reloaded if
+	// they changed.  0 disables it.
+	SecretRefreshInterval time.Duration
+	// ConfigWatchInterval is the interval at which the configuration file is checked for changes, and reloaded if it
+	// changed.  0 disables it.
+	ConfigWatchInterval time.Duration
+	// NewBackend creates a backend added to the configuration by a reload, if it is not nil.  Otherwise the backends
+	// are reloaded, but can not be added or removed.
+	NewBackend func(name string, v *viper.Viper) (gostatsd.Backend, error)
+	// LogLevels changes the log level from the admin endpoints, if it is not nil.
+	LogLevels web.LogLevelController
+	// OnReady is called once the server is receiving metrics, to notify a service manager, if it is not nil.
+	OnReady func()
+	// OnStopping is called when the server starts to drain or stop, to notify a service manager, if it is not nil.
+	OnStopping func()
+	// FlushHooks are called with the metrics of every flush in standalone mode, before they are sent to the backends.
+	FlushHooks []FlushHook
+
+	// onStarted is called with the start of the pipeline and the flusher once every component has started, if it is
+	// not nil, so an Embedded can send to them.
+	onStarted func(handler gostatsd.PipelineHandler, flusher *MetricFlusher)
 }
 
 // Run runs the server until context signals done.
@@ -89,11 +200,8 @@ func socketFactory(metricsAddr string, connPerReader bool) SocketFactory {
 	}
 }
 
-func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
-	var runnables []gostatsd.Runnable
-
-	// Create the backend handler
-	factory := agrFactory{
+func (s *Server) aggregatorFactory() *agrFactory {
+	return &agrFactory{
 		percentThresholds:     s.PercentThreshold,
 		expiryIntervalCounter: s.ExpiryIntervalCounter,
 		expiryIntervalGauge:   s.ExpiryIntervalGauge,
@@ -101,41 +209,105 @@ func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Ru
 		expiryIntervalTimer:   s.ExpiryIntervalTimer,
 		disabledSubtypes:      s.DisabledSubTypes,
 		histogramLimit:        s.HistogramLimit,
+		shards:                s.AggregatorShards,
+		maxSeries:             s.AggregatorMaxSeries,
+		maxSamples:            s.AggregatorMaxSamples,
 	}
+}
+
+func (s *Server) createStandaloneSink(logger logrus.FieldLogger) (gostatsd.PipelineHandler, *MetricFlusher, []gostatsd.Runnable, error) {
+	var runnables []gostatsd.Runnable
 
-	backendHandler := NewBackendHandler(s.Backends, uint(s.MaxConcurrentEvents), s.MaxWorkers, s.MaxQueueSize, &factory)
+	// Create the backend handler
+	backendHandler := NewBackendHandler(s.Backends, uint(s.MaxConcurrentEvents), s.MaxWorkers, s.MaxQueueSize, s.DispatchBatchSize, s.DispatchBatchDelay, s.aggregatorFactory())
 	runnables = append(runnables, backendHandler.Run, backendHandler.RunMetricsContext)
+	eventRoutes, err := eventRoutesFromViper(s.Viper)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backendHandler.SetEventRoutes(eventRoutes)
 
 	// Create the Flusher
-	flusher := NewMetricFlusher(s.FlushInterval, s.FlushOffset, s.FlushAligned, backendHandler, s.Backends)
+	flusher := NewMetricFlusher(s.FlushInterval, s.FlushOffset, s.FlushAligned, s.FlushQueueSize, backendHandler, s.Backends)
+	flusher.SetJitter(s.FlushJitter, s.FlushSplay)
 	runnables = append(runnables, flusher.Run)
 
-	return backendHandler, runnables, nil
+	// Evaluate the threshold rules against every flush
+	rules, err := rulesFromViper(s.Viper)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	flusher.rules = newRuleEngine(rules)
+	runnables = append(runnables, flusher.rules.RunMetricsContext)
+	flusher.hooks = s.FlushHooks
+
+	// Divide the series with the other server of an active-active pair
+	if s.HAPeerURL != "" {
+		ha, err := newHAPair(logger, s.HAIndex, s.HAPeerURL, s.HACheckInterval)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		flusher.ha = ha
+		runnables = append(runnables, ha.Run, ha.RunMetricsContext)
+	}
+
+	// Mirror a percentage of every flush to the shadow backends
+	if len(s.ShadowBackends) > 0 {
+		flusher.mirror = newMetricMirror(s.ShadowBackends, s.ShadowPercentage, s.FlushQueueSize)
+		runnables = append(runnables, flusher.mirror.RunMetricsContext)
+	}
+
+	return backendHandler, flusher, runnables, nil
 }
 
-func (s *Server) createForwarderSink(logger logrus.FieldLogger) (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+func (s *Server) createForwarderSink(logger logrus.FieldLogger) (gostatsd.PipelineHandler, *MetricFlusher, []gostatsd.Runnable, error) {
 	forwarderHandler, err := NewHttpForwarderHandlerV2FromViper(
 		logger,
 		s.Viper,
 		s.TransportPool,
 	)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Create a Flusher, this is primarily for all the periodic metrics which are emitted.
-	flusher := NewMetricFlusher(s.FlushInterval, 0, false, nil, s.Backends)
+	flusher := NewMetricFlusher(s.FlushInterval, 0, false, s.FlushQueueSize, nil, s.Backends)
+
+	return forwarderHandler, flusher, []gostatsd.Runnable{forwarderHandler.Run, forwarderHandler.RunMetricsContext, flusher.Run}, nil
+}
+
+// createRelaySink creates a pipeline which relays metrics and events to the downstream statsd servers, without
+// aggregating them.  The flusher only triggers the periodic internal metrics, which are relayed too.
+func (s *Server) createRelaySink(logger logrus.FieldLogger) (gostatsd.PipelineHandler, *MetricFlusher, []gostatsd.Runnable, error) {
+	relayHandler, err := NewRelayHandlerFromViper(logger, s.Viper)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	flusher := NewMetricFlusher(s.FlushInterval, 0, false, s.FlushQueueSize, nil, s.Backends)
+	return relayHandler, flusher, []gostatsd.Runnable{relayHandler.Run, relayHandler.RunMetricsContext, flusher.Run}, nil
+}
 
-	return forwarderHandler, []gostatsd.Runnable{forwarderHandler.Run, forwarderHandler.RunMetricsContext, flusher.Run}, nil
+// createInternalSink creates a pipeline which aggregates internal metrics and sends them to the InternalBackends, so
+// they are kept apart from the metrics of clients.  Its flusher does not notify the Statser, as the main flusher does
+// that, which is what sends the internal metrics to this pipeline.
+func (s *Server) createInternalSink() (gostatsd.PipelineHandler, []gostatsd.Runnable) {
+	backendHandler := NewBackendHandler(s.InternalBackends, uint(s.MaxConcurrentEvents), 1, s.MaxQueueSize, s.DispatchBatchSize, s.DispatchBatchDelay, s.aggregatorFactory())
+	flusher := NewMetricFlusher(s.FlushInterval, s.FlushOffset, s.FlushAligned, s.FlushQueueSize, backendHandler, s.InternalBackends)
+	runFlusher := func(ctx context.Context) {
+		flusher.Run(stats.NewContext(ctx, stats.NewNullStatser()))
+	}
+	return backendHandler, []gostatsd.Runnable{backendHandler.Run, runFlusher}
 }
 
-func (s *Server) createFinalSink(logger logrus.FieldLogger) (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+func (s *Server) createFinalSink(logger logrus.FieldLogger) (gostatsd.PipelineHandler, *MetricFlusher, []gostatsd.Runnable, error) {
 	if s.ServerMode == "standalone" {
-		return s.createStandaloneSink()
+		return s.createStandaloneSink(logger)
 	} else if s.ServerMode == "forwarder" {
 		return s.createForwarderSink(logger)
+	} else if s.ServerMode == "relay" {
+		return s.createRelaySink(logger)
 	}
-	return nil, nil, errors.New("invalid server-mode, must be standalone, or forwarder")
+	return nil, nil, nil, errors.New("invalid server-mode, must be standalone, forwarder, or relay")
 }
 
 // RunWithCustomSocket runs the server until context signals done.
@@ -143,34 +315,171 @@ func (s *Server) createFinalSink(logger logrus.FieldLogger) (gostatsd.PipelineHa
 func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) error {
 	logger := logrus.StandardLogger()
 
-	handler, runnables, err := s.createFinalSink(logger)
+	handler, flusher, runnables, err := s.createFinalSink(logger)
 	if err != nil {
 		return err
 	}
+	finalHandler := handler
+	var internalHandler gostatsd.PipelineHandler
+	if len(s.InternalBackends) > 0 {
+		// Started before the final sink, so it is still running while the final sink flushes internal metrics to it
+		var internalRunnables []gostatsd.Runnable
+		internalHandler, internalRunnables = s.createInternalSink()
+		runnables = append(internalRunnables, runnables...)
+	}
+	if s.FlushSignals != nil {
+		runnables = append(runnables, flusher.FlushOnSignal(s.FlushSignals))
+	}
+	readiness := gostatsd.MaybeAppendReadinessChecker(nil, handler)
+	inspector, _ := handler.(web.AggregatorInspector) // nil unless in standalone mode
+	readiness = gostatsd.MaybeAppendReadinessChecker(readiness, s.CachedInstances)
+	reloaders := gostatsd.MaybeAppendConfigReloader(nil, handler)
+	if s.NewBackend != nil {
+		// Started before the flusher, so the backends it adds are stopped after the flusher has sent to them
+		bh, _ := handler.(*BackendHandler)
+		br := &backendReloader{
+			logger:     logger,
+			newBackend: s.NewBackend,
+			handler:    bh,
+			flusher:    flusher,
+			backends:   s.Backends,
+			internal:   s.InternalBackends,
+		}
+		runnables = append([]gostatsd.Runnable{br.Run}, runnables...)
+		reloaders = append(reloaders, br)
+	} else {
+		for _, backend := range s.Backends {
+			reloaders = gostatsd.MaybeAppendConfigReloader(reloaders, backend)
+		}
+		for _, backend := range s.InternalBackends {
+			if !containsBackend(s.Backends, backend) {
+				reloaders = gostatsd.MaybeAppendConfigReloader(reloaders, backend)
+			}
+		}
+	}
 
 	runnables = append(append(make([]gostatsd.Runnable, 0, len(s.Runnables)), s.Runnables...), runnables...)
 
+	// Divide the series with the other members of a cluster.  It is after the final handler is used for readiness and
+	// inspection, so they only see this server.
+	var cluster *ClusterHandler
+	if s.ServerMode == "standalone" {
+		if cluster, err = NewClusterHandlerFromViper(logger, s.Viper, handler, s.TransportPool); err != nil {
+			return err
+		}
+		if cluster != nil {
+			runnables = append(runnables, cluster.Run)
+			handler = cluster
+		}
+	}
+
+	// Suppress repeated events
+	if s.EventThrottleWindow > 0 {
+		if s.EventThrottlePerKey < 0 {
+			return fmt.Errorf("%s must not be negative", gostatsd.ParamEventThrottlePerKey)
+		}
+		throttleHandler := NewEventThrottleHandler(handler, s.EventThrottleWindow, s.EventThrottlePerKey)
+		runnables = append(runnables, throttleHandler.Run, throttleHandler.RunMetricsContext)
+		handler = throttleHandler
+	}
+
+	// Elect the replica which sends the outputs every replica would otherwise duplicate
+	var leader *leaderElector
+	if s.LeaderElectionLease != "" {
+		if leader, err = newLeaderElectorFromServer(logger, s); err != nil {
+			return err
+		}
+		leaderHandler := &LeaderHandler{handler: handler, leader: leader}
+		runnables = append(runnables, leader.Run, leader.RunMetricsContext, leaderHandler.RunMetricsContext)
+		handler = leaderHandler
+	}
+
+	// Rewrite events with templates, after the cloud provider and tag processor have added their tags
+	templateHandler, err := NewEventTemplateHandlerFromViper(logger, s.Viper, handler, s.Hostname)
+	if err != nil {
+		return err
+	}
+	runnables = append(runnables, templateHandler.RunMetricsContext)
+	reloaders = append(reloaders, templateHandler)
+	handler = templateHandler
+
 	// Create the tag processor
-	handler = NewTagHandlerFromViper(s.Viper, handler, s.DefaultTags)
+	tagHandler := NewTagHandlerFromViper(s.Viper, handler, s.DefaultTags)
+	reloaders = append(reloaders, tagHandler)
+	handler = tagHandler
+
+	// The events of the threshold rules are sent from here, as the series already have the tags of the earlier stages
+	if flusher.rules != nil {
+		flusher.rules.handler = tagHandler
+		reloaders = append(reloaders, flusher.rules)
+	}
+
+	// Create the reloader
+	configReloader := &reloader{
+		logger:      logger,
+		v:           s.Viper,
+		reloaders:   reloaders,
+		onReload:    s.OnReload,
+		restartOnly: snapshotSettings(s.Viper, restartOnlySettings),
+	}
+	if s.ReloadSignals != nil {
+		runnables = append(runnables, configReloader.reloadOnSignal(s.ReloadSignals))
+	}
+	if s.Secrets != nil {
+		configReloader.resolve = s.Secrets.Resolve
+		configReloader.isSecret = s.Secrets.IsSecret
+		if s.SecretRefreshInterval > 0 {
+			runnables = append(runnables, s.Secrets.RunRefresh(s.SecretRefreshInterval, func(ctx context.Context) {
+				logger.Info("Reloading configuration as secrets changed")
+				if err := configReloader.Reload(ctx); err != nil {
+					logger.WithError(err).Error("Failed to reload configuration")
+				}
+			}))
+		}
+	}
+	if s.Viper.ConfigFileUsed() != "" {
+		// The configuration the server starts with is restored if a reload fails
+		if configReloader.lastGood, err = util.LoadConfig(s.Viper, configReloader.resolve); err != nil {
+			return fmt.Errorf("failed to read %s: %v", s.Viper.ConfigFileUsed(), err)
+		}
+		if s.ConfigWatchInterval > 0 {
+			runnables = append(runnables, configReloader.watchConfig(s.ConfigWatchInterval))
+		}
+	}
 
 	// Create the cloud handler
 	if s.CachedInstances != nil {
-		cloudHandler := NewCloudHandler(s.CachedInstances, handler)
+		cloudHandler := NewCloudHandler(s.CachedInstances, handler, s.CloudStripSourceZone)
 		runnables = gostatsd.MaybeAppendRunnable(runnables, cloudHandler)
 		handler = cloudHandler
 	}
 
+	// Create the tap, so metrics can be inspected as they are received
+	tapHandler := NewTapHandler(handler)
+	handler = tapHandler
+
 	// Create the heartbeater
 	if s.HeartbeatEnabled {
 		hb := stats.NewHeartBeater("heartbeat", s.HeartbeatTags)
+		if leader != nil {
+			hb.SetLeaderCheck(leader.IsLeader)
+		}
 		runnables = gostatsd.MaybeAppendRunnable(runnables, hb)
 	}
 
-	// Open receiver <-> parser chan
+	// Create the runtime metrics, tagged the same as the heartbeat so each instance and version can be told apart
+	if s.RuntimeMetricsEnabled {
+		rs := stats.NewRuntimeStats(s.HeartbeatTags)
+		runnables = gostatsd.MaybeAppendRunnable(runnables, rs)
+	}
+
+	// Open receiver <-> parser chan, and count the batches on it which are not parsed yet for a drain
 	datagrams := make(chan []*Datagram)
+	var pending sync.WaitGroup
 
 	// Create the Parser
-	parser := NewDatagramParser(datagrams, s.Namespace, s.IgnoreHost, s.EstimatedTags, handler, s.BadLineRateLimitPerSecond, s.LogRawMetric, logger)
+	parser := NewDatagramParser(datagrams, s.MetricsAddr, s.Namespace, s.IgnoreHost, s.EstimatedTags, handler, s.BadLineRateLimitPerSecond, s.LogRawMetric, logger)
+	parser.pending = &pending
 	runnables = append(runnables, parser.RunMetricsContext)
 	for i := 0; i < s.MaxParsers; i++ {
 		runnables = append(runnables, parser.Run)
@@ -178,24 +487,85 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 
 	// Create the Receiver
 	receiver := NewDatagramReceiver(datagrams, sf, s.MaxReaders, s.ReceiveBatchSize)
+	receiver.pending = &pending
+	if s.MetricsSocket != "" {
+		// A container is only useful as a source if it is looked up, here or by the server metrics are forwarded to,
+		// otherwise it would be sent to backends as the host
+		originDetection := s.OriginDetection && (s.CachedInstances != nil || s.ServerMode == "forwarder")
+		receiver.unixSocket = UnixSocketFactory(s.MetricsSocket, originDetection)
+	}
 	runnables = gostatsd.MaybeAppendRunnable(runnables, receiver)
 
+	// Create the memory limiter, which shrinks the caches of the parsers, and throttles the receiver
+	if s.MemoryLimit > 0 {
+		receiver.limiter = NewMemoryLimiter(s.MemoryLimit, logger, parser.interner.Reset, gostatsd.ResetTagsKeys)
+		runnables = append(runnables, receiver.limiter.Run, receiver.limiter.RunMetricsContext)
+	}
+	readiness = gostatsd.MaybeAppendReadinessChecker(readiness, receiver)
+	if s.OnReady != nil {
+		runnables = append(runnables, notifyReady(receiver, s.OnReady))
+	}
+
 	// Create the Statser
 	hostname := s.Hostname
-	statser := s.createStatser(hostname, handler, logger)
+	if internalHandler == nil {
+		internalHandler = handler
+	}
+	statser := s.createStatser(hostname, internalHandler, logger)
 	runnables = gostatsd.MaybeAppendRunnable(runnables, statser)
+	// Record internal metrics so they can be scraped without a backend
+	promStatser := stats.NewPrometheusStatser(statser, s.internalNamespace(), s.InternalTags)
+	// Rename and drop internal metrics as configured, for both the backends and Prometheus
+	internalStatser := stats.NewRenamingStatser(promStatser, s.InternalMetricsRename, s.InternalMetricsDisabled)
+
+	// Attribute dropped data to a reason, available to every component from the context
+	drops := stats.NewDropAccounting(logger, s.DroppedSummaryInterval)
+	runnables = append(runnables, drops.Run)
+
+	// Create the drainer, which sends everything received before exiting
+	drain := newDrainer(logger, receiver, &pending, flusher, finalHandler, drops, s.DrainTimeout, s.stopping)
+	drain.cluster = cluster
+	if s.DrainSignals != nil {
+		runnables = append(runnables, drain.drainOnSignal(s.DrainSignals))
+	}
 
 	// Create any http servers
-	httpServers, err := web.NewHttpServersFromViper(s.Viper, logger, handler)
+	httpServers, err := web.NewHttpServersFromViper(s.Viper, logger, handler, promStatser, readiness, inspector, &drainableFlusher{MetricFlusher: flusher, drainer: drain}, configReloader, tapHandler, s.LogLevels)
 	if err != nil {
 		return err
 	}
+	// Reject ingestion requests while the queues or the heap are full, so clients back off
+	var overload overloadCheckers
+	if oc, ok := finalHandler.(web.OverloadChecker); ok {
+		overload = append(overload, oc)
+	}
+	if receiver.limiter != nil {
+		overload = append(overload, receiver.limiter)
+	}
 	for _, server := range httpServers {
+		if len(overload) > 0 {
+			server.SetOverloadChecker(overload)
+		}
+		if cluster != nil {
+			server.SetClusterHandler(cluster.LocalHandler())
+		}
 		runnables = gostatsd.MaybeAppendRunnable(runnables, server)
 	}
 
+	if s.Profiler != nil {
+		runnables = append(runnables, s.Profiler.Run, s.Profiler.RunMetricsContext)
+	}
+
 	// Start the world!
-	runCtx := stats.NewContext(context.Background(), statser)
+	runCtx := stats.NewDropAccountingContext(stats.NewContext(context.Background(), internalStatser), drops)
+	if s.RetryBudgetRatio > 0 {
+		retryBudget := stats.NewRetryBudget(s.RetryBudgetRatio, s.RetryBudgetMinPerSecond)
+		runnables = append(runnables, retryBudget.Run)
+		runCtx = stats.NewRetryBudgetContext(runCtx, retryBudget)
+	}
+	if s.Profiler != nil {
+		runCtx = stats.NewProfileTriggerContext(runCtx, s.Profiler)
+	}
 	stgr := stager.New()
 	defer stgr.Shutdown()
 	for _, runnable := range runnables {
@@ -206,10 +576,60 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	// TODO: Push these in to statser
 	defer sendStopEvent(handler, hostname)
 	sendStartEvent(runCtx, handler, hostname)
+	if s.onStarted != nil {
+		s.onStarted(handler, flusher)
+	}
+
+	// Listen until done, or drained
+	select {
+	case <-ctx.Done():
+		s.finalFlush(runCtx, logger, drain)
+		return ctx.Err()
+	case err := <-drain.done:
+		return err
+	}
+}
+
+// finalFlush sends everything received before the server was stopped, waiting up to the ShutdownFlushTimeout.  If a
+// drain has already started, it waits for it instead.
+func (s *Server) finalFlush(ctx context.Context, logger logrus.FieldLogger, drain *drainer) {
+	if s.ShutdownFlushTimeout <= 0 {
+		s.stopping()
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.ShutdownFlushTimeout)
+	defer cancel()
+	logger.WithField("timeout", s.ShutdownFlushTimeout).Info("Flushing before exiting")
+	_, _ = drain.Drain(ctx)
+	select {
+	case <-drain.done:
+		// The result has been logged by the drain
+	case <-ctx.Done():
+		logger.Warn("Timed out waiting for the final flush")
+	}
+}
+
+// stopping calls OnStopping, if it is not nil.
+func (s *Server) stopping() {
+	if s.OnStopping != nil {
+		s.OnStopping()
+	}
+}
 
-	// Listen until done
-	<-ctx.Done()
-	return ctx.Err()
+// notifyReady returns a Runnable which calls onReady once the receiver is listening.
+func notifyReady(receiver *DatagramReceiver, onReady func()) gostatsd.Runnable {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(readyPollInterval)
+		defer ticker.Stop()
+		for receiver.CheckReady() != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+		onReady()
+	}
 }
 
 func (s *Server) createStatser(hostname gostatsd.Source, handler gostatsd.PipelineHandler, logger logrus.FieldLogger) stats.Statser {
@@ -219,16 +639,31 @@ func (s *Server) createStatser(hostname gostatsd.Source, handler gostatsd.Pipeli
 	case gostatsd.StatserLogging:
 		return stats.NewLoggingStatser(s.InternalTags, logger)
 	default:
-		namespace := s.Namespace
-		if s.InternalNamespace != "" {
-			if namespace != "" {
-				namespace = namespace + "." + s.InternalNamespace
-			} else {
-				namespace = s.InternalNamespace
-			}
+		return stats.NewInternalStatser(s.InternalTags, s.internalNamespace(), hostname, handler)
+	}
+}
+
+// containsBackend returns true if backend is one of backends.
+func containsBackend(backends []gostatsd.Backend, backend gostatsd.Backend) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// internalNamespace returns the namespace of internal metrics.
+func (s *Server) internalNamespace() string {
+	namespace := s.Namespace
+	if s.InternalNamespace != "" {
+		if namespace != "" {
+			namespace = namespace + "." + s.InternalNamespace
+		} else {
+			namespace = s.InternalNamespace
 		}
-		return stats.NewInternalStatser(s.InternalTags, namespace, hostname, handler)
 	}
+	return namespace
 }
 
 func sendStartEvent(ctx context.Context, handler gostatsd.PipelineHandler, hostname gostatsd.Source) {
@@ -262,6 +697,9 @@ type agrFactory struct {
 	expiryIntervalTimer   time.Duration
 	disabledSubtypes      gostatsd.TimerSubtypes
 	histogramLimit        uint32
+	shards                int
+	maxSeries             int
+	maxSamples            int
 }
 
 func (af *agrFactory) Create() Aggregator {
@@ -273,5 +711,8 @@ func (af *agrFactory) Create() Aggregator {
 		af.expiryIntervalTimer,
 		af.disabledSubtypes,
 		af.histogramLimit,
+		af.shards,
+		af.maxSeries,
+		af.maxSamples,
 	)
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"math/rand"
 	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -11,6 +13,8 @@ import (
 	"github.com/ash2k/stager/wait"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 
 	"github.com/hligit/gostatsd"
@@ -101,6 +105,80 @@ func TestStatsdThroughput(t *testing.T) {
 		memStatsFinish.GCCPUFraction)
 }
 
+// TestStatsdInternalBackends checks internal metrics are only sent to the internal backends.
+func TestStatsdInternalBackends(t *testing.T) {
+	t.Parallel()
+	backend := &namingBackend{}
+	internalBackend := &namingBackend{}
+	s := Server{
+		Backends:            []gostatsd.Backend{backend},
+		InternalBackends:    []gostatsd.Backend{internalBackend},
+		InternalNamespace:   "internal",
+		FlushInterval:       100 * time.Millisecond,
+		MaxReaders:          1,
+		MaxParsers:          1,
+		MaxWorkers:          1,
+		MaxQueueSize:        gostatsd.DefaultMaxQueueSize,
+		EstimatedTags:       1,
+		PercentThreshold:    gostatsd.DefaultPercentThreshold,
+		ReceiveBatchSize:    gostatsd.DefaultReceiveBatchSize,
+		MaxConcurrentEvents: 2,
+		ServerMode:          "standalone",
+		Viper:               viper.New(),
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+	err := s.RunWithCustomSocket(ctx, fakesocket.Factory)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	names := backend.seen()
+	require.NotEmpty(t, names)
+	for name := range names {
+		assert.True(t, strings.HasPrefix(name, "statsd.tester."), name)
+	}
+
+	internalNames := internalBackend.seen()
+	require.Contains(t, internalNames, "internal.aggregator.metricmaps_received")
+	for name := range internalNames {
+		assert.True(t, strings.HasPrefix(name, "internal."), name)
+	}
+}
+
+// namingBackend records the name of every metric it is sent.
+type namingBackend struct {
+	lock  sync.Mutex
+	names map[string]struct{}
+}
+
+func (nb *namingBackend) Name() string {
+	return "namingBackend"
+}
+
+func (nb *namingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	nb.lock.Lock()
+	defer nb.lock.Unlock()
+	if nb.names == nil {
+		nb.names = map[string]struct{}{}
+	}
+	m.Counters.Each(func(name, tagset string, c gostatsd.Counter) {
+		nb.names[name] = struct{}{}
+	})
+	m.Gauges.Each(func(name, tagset string, g gostatsd.Gauge) {
+		nb.names[name] = struct{}{}
+	})
+	callback(nil)
+}
+
+func (nb *namingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (nb *namingBackend) seen() map[string]struct{} {
+	nb.lock.Lock()
+	defer nb.lock.Unlock()
+	return nb.names
+}
+
 type countingBackend struct {
 	metrics uint64
 	events  uint64
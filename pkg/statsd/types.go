@@ -28,7 +28,9 @@ type Aggregator interface {
 	ReceiveMap(mm *gostatsd.MetricMap)
 	Flush(interval time.Duration)
 	Process(ProcessFunc)
-	Reset()
+	// Snapshot resets the Aggregator and returns what it had flushed, which it does not modify afterwards, so the
+	// flushed metrics can be sent while the next interval is aggregated.
+	Snapshot() *gostatsd.MetricMap
 }
 
 // Datagram is a received UDP datagram that has not been parsed into Metric/Event(s)
@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// procNetUDP are the files listing the UDP sockets on Linux, with the number of datagrams each has dropped.
+var procNetUDP = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// udpDrops returns the number of datagrams dropped by every UDP socket bound to port, because their receive buffers
+// were full, from the sockets listed in files.  Files which don't exist are skipped, such as udp6 when IPv6 is
+// disabled, but it is an error if none of them exist, as on platforms other than Linux.
+func udpDrops(files []string, port int) (uint64, error) {
+	var drops uint64
+	found := false
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		found = true
+		d, err := parseUDPDrops(f, port)
+		_ = f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		drops += d
+	}
+	if !found {
+		return 0, fmt.Errorf("none of %s exist", strings.Join(files, ", "))
+	}
+	return drops, nil
+}
+
+// parseUDPDrops sums the drops column of the sockets with the local port, in the format of /proc/net/udp.
+func parseUDPDrops(f *os.File, port int) (uint64, error) {
+	var drops uint64
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		localAddress := fields[1]
+		localPort, err := strconv.ParseUint(localAddress[strings.LastIndexByte(localAddress, ':')+1:], 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid local_address %q: %v", localAddress, err)
+		}
+		if int(localPort) != port {
+			continue
+		}
+		d, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid drops %q: %v", fields[len(fields)-1], err)
+		}
+		drops += d
+	}
+	return drops, scanner.Err()
+}
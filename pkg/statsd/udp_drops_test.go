@@ -0,0 +1,38 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPDrops(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "udp_drops")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	udp := filepath.Join(dir, "udp")
+	require.NoError(t, ioutil.WriteFile(udp, []byte(
+		`   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  1: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1001 2 0000000000000000 3
+  2: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1002 2 0000000000000000 4
+  3: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1003 2 0000000000000000 100
+`), 0600))
+	udp6 := filepath.Join(dir, "udp6")
+	require.NoError(t, ioutil.WriteFile(udp6, []byte(
+		`  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  4: 00000000000000000000000000000000:1FBD 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1004 2 0000000000000000 5
+`), 0600))
+
+	drops, err := udpDrops([]string{udp, udp6, filepath.Join(dir, "missing")}, 8125)
+	require.NoError(t, err)
+	assert.EqualValues(t, 12, drops)
+
+	_, err = udpDrops([]string{filepath.Join(dir, "missing")}, 8125)
+	assert.Error(t, err)
+}
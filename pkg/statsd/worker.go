@@ -3,6 +3,7 @@ package statsd
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/ash2k/stager/wait"
@@ -21,6 +22,41 @@ type worker struct {
 	metricMapQueue chan *gostatsd.MetricMap
 	processChan    chan *processCommand
 	id             int
+
+	batchLock   sync.Mutex
+	batch       *gostatsd.MetricMap // Metrics waiting to be sent on metricMapQueue, nil if there are none
+	batchSeries int                 // The number of series in batch
+}
+
+// addToBatch merges mm into the pending batch, and returns the batch if it has reached batchSize series, so the caller
+// can send it.
+func (w *worker) addToBatch(mm *gostatsd.MetricMap, batchSize int) *gostatsd.MetricMap {
+	w.batchLock.Lock()
+	defer w.batchLock.Unlock()
+	if w.batch == nil {
+		w.batch = mm
+		w.batchSeries = mm.Len()
+	} else {
+		series, _ := mm.MergeSharded([]*gostatsd.MetricMap{w.batch})
+		w.batchSeries += series
+	}
+	if w.batchSeries < batchSize {
+		return nil
+	}
+	full := w.batch
+	w.batch = nil
+	w.batchSeries = 0
+	return full
+}
+
+// takeBatch returns the pending batch, or nil if there is none.
+func (w *worker) takeBatch() *gostatsd.MetricMap {
+	w.batchLock.Lock()
+	defer w.batchLock.Unlock()
+	batch := w.batch
+	w.batch = nil
+	w.batchSeries = 0
+	return batch
 }
 
 func (w *worker) work() {
@@ -39,9 +75,30 @@ func (w *worker) work() {
 
 func (w *worker) executeProcess(cmd *processCommand) {
 	defer cmd.done() // Done with the process command
+	// The queued maps and the pending batch are received first, so a flush includes every metric dispatched before it.
+	w.receiveQueued()
+	if batch := w.takeBatch(); batch != nil {
+		w.aggr.ReceiveMap(batch)
+	}
 	cmd.f(w.id, w.aggr)
 }
 
+// receiveQueued receives the maps already queued.  At most the capacity of the queue is received, so a flush is not
+// delayed by metrics dispatched after it.
+func (w *worker) receiveQueued() {
+	for i := 0; i < cap(w.metricMapQueue); i++ {
+		select {
+		case mm, ok := <-w.metricMapQueue:
+			if !ok {
+				return
+			}
+			w.aggr.ReceiveMap(mm)
+		default:
+			return
+		}
+	}
+}
+
 func (w *worker) RunMetrics(ctx context.Context, statser stats.Statser) {
 	wg := &wait.Group{}
 	wg.StartWithContext(ctx, stats.NewChannelStatsWatcher(
@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/hligit/gostatsd"
+)
+
+// Options controls how spans are exported.
+type Options struct {
+	// OTLPAddress is the host:port of the OTLP collector spans are exported to.  If it is "", tracing is disabled.
+	OTLPAddress string
+	// OTLPInsecure is true to connect to the collector without TLS.
+	OTLPInsecure bool
+	// SampleRatio is the fraction of traces which are sampled.
+	SampleRatio float64
+}
+
+// OptionsFromViper returns the tracing options from the configuration.
+func OptionsFromViper(v *viper.Viper) Options {
+	return Options{
+		OTLPAddress:  v.GetString(gostatsd.ParamTraceOTLPAddress),
+		OTLPInsecure: v.GetBool(gostatsd.ParamTraceOTLPInsecure),
+		SampleRatio:  v.GetFloat64(gostatsd.ParamTraceSampleRatio),
+	}
+}
+
+// Install installs a global provider which exports spans to the OTLP collector, and returns a function which sends any
+// spans still buffered and stops it.  If there is no collector, it does nothing.
+func Install(logger logrus.FieldLogger, opts Options, version string) (func(), error) {
+	if opts.OTLPAddress == "" {
+		return func() {}, nil
+	}
+	if opts.SampleRatio < 0 || opts.SampleRatio > 1 {
+		return nil, fmt.Errorf("%s must be between 0 and 1", gostatsd.ParamTraceSampleRatio)
+	}
+
+	exporterOpts := []otlp.ExporterOption{otlp.WithAddress(opts.OTLPAddress)}
+	if opts.OTLPInsecure {
+		exporterOpts = append(exporterOpts, otlp.WithInsecure())
+	} else {
+		exporterOpts = append(exporterOpts, otlp.WithTLSCredentials(credentials.NewTLS(nil)))
+	}
+	// Connects in the background, and reconnects when the connection is lost
+	exporter, err := otlp.NewExporter(exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	processor, err := sdktrace.NewBatchSpanProcessor(exporter)
+	if err != nil {
+		_ = exporter.Stop()
+		return nil, err
+	}
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ProbabilitySampler(opts.SampleRatio)}),
+		sdktrace.WithResource(resource.New(
+			standard.ServiceNameKey.String("gostatsd"),
+			standard.ServiceVersionKey.String(version),
+		)),
+	)
+	if err != nil {
+		_ = exporter.Stop()
+		return nil, err
+	}
+	provider.RegisterSpanProcessor(processor)
+	global.SetTraceProvider(provider)
+
+	logger.WithFields(logrus.Fields{
+		"address":      opts.OTLPAddress,
+		"sample-ratio": opts.SampleRatio,
+	}).Info("Exporting traces")
+
+	return func() {
+		provider.UnregisterSpanProcessor(processor) // Exports any spans still buffered
+		if err := exporter.Stop(); err != nil {
+			logger.WithError(err).Warn("Failed to stop the OTLP exporter")
+		}
+	}, nil
+}
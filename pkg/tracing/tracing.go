@@ -0,0 +1,74 @@
+// Package tracing traces the requests made to backends, upstream servers, and cloud providers with OpenTelemetry, so
+// the hop responsible for a slow flush can be found.  Spans are only recorded once a provider has been installed with
+// Install, otherwise they cost next to nothing.
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"google.golang.org/grpc/codes"
+)
+
+const instrumentationName = "github.com/hligit/gostatsd"
+
+// Attributes of the spans.
+const (
+	// BackendKey is the name of the backend a request is made to.
+	BackendKey = kv.Key("gostatsd.backend")
+	// CloudProviderKey is the name of the cloud provider a lookup is made to.
+	CloudProviderKey = kv.Key("gostatsd.cloud_provider")
+	// IPsKey is the number of IPs looked up in a request to a cloud provider.
+	IPsKey = kv.Key("gostatsd.ips")
+	// InstancesKey is the number of instances found by a request to a cloud provider.
+	InstancesKey = kv.Key("gostatsd.instances")
+	// TypeKey is the type of the data being sent, such as metrics or events.
+	TypeKey = kv.Key("gostatsd.type")
+	// APIEndpointKey is the api-endpoint of the upstream server a request is forwarded to.
+	APIEndpointKey = kv.Key("gostatsd.api_endpoint")
+	// ProtocolVersionKey is the version of the forwarding protocol of a request.
+	ProtocolVersionKey = kv.Key("gostatsd.protocol_version")
+	// PayloadBytesKey is the size of the body of a request, after compression.
+	PayloadBytesKey = kv.Key("gostatsd.payload_bytes")
+	// AttemptsKey is the number of attempts made to send a request, including the first.
+	AttemptsKey = kv.Key("gostatsd.attempts")
+	// OutcomeKey is what happened to a payload which could not be sent, such as spooled or dropped.
+	OutcomeKey = kv.Key("gostatsd.outcome")
+
+	attemptKey = kv.Key("gostatsd.attempt")
+	sleepKey   = kv.Key("gostatsd.sleep")
+	errorKey   = kv.Key("error.message")
+)
+
+// Start starts a span for a request made by gostatsd.  The span is a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	return global.Tracer(instrumentationName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// SetAttributes sets attributes on the span in ctx, if there is one.
+func SetAttributes(ctx context.Context, attrs ...kv.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// Retry records a failed attempt on the span, which will be retried after sleep.
+func Retry(ctx context.Context, span trace.Span, attempt int, err error, sleep time.Duration) {
+	span.AddEvent(ctx, "retry", attemptKey.Int(attempt), errorKey.String(err.Error()), sleepKey.String(sleep.String()))
+}
+
+// End ends the span, with an error status if err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		code := codes.Unknown
+		switch err {
+		case context.Canceled:
+			code = codes.Canceled
+		case context.DeadlineExceeded:
+			code = codes.DeadlineExceeded
+		}
+		span.SetStatus(code, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/api/global"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+)
+
+type recordingSyncer struct {
+	mu    sync.Mutex
+	spans []*export.SpanData
+}
+
+func (rs *recordingSyncer) ExportSpan(ctx context.Context, span *export.SpanData) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.spans = append(rs.spans, span)
+}
+
+func TestSpans(t *testing.T) {
+	rs := &recordingSyncer{}
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithSyncer(rs),
+	)
+	require.NoError(t, err)
+	previous := global.TraceProvider()
+	global.SetTraceProvider(provider)
+	defer global.SetTraceProvider(previous)
+
+	ctx, flush := Start(context.Background(), "flush")
+	ctx, post := Start(ctx, "backend.post", BackendKey.String("test"))
+	SetAttributes(ctx, PayloadBytesKey.Int(10))
+	Retry(ctx, post, 1, errors.New("unavailable"), time.Second)
+	post.SetAttributes(AttemptsKey.Int(2))
+	End(post, context.DeadlineExceeded)
+	End(flush, nil)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	require.Len(t, rs.spans, 2)
+
+	postData, flushData := rs.spans[0], rs.spans[1]
+	assert.Equal(t, "backend.post", postData.Name)
+	assert.Equal(t, flushData.SpanContext.SpanID, postData.ParentSpanID)
+	assert.Equal(t, codes.DeadlineExceeded, postData.StatusCode)
+	attributes := map[string]interface{}{}
+	for _, attr := range postData.Attributes {
+		attributes[string(attr.Key)] = attr.Value.AsInterface()
+	}
+	assert.Equal(t, map[string]interface{}{
+		"gostatsd.backend":       "test",
+		"gostatsd.payload_bytes": int64(10),
+		"gostatsd.attempts":      int64(2),
+	}, attributes)
+	require.Len(t, postData.MessageEvents, 1)
+	assert.Equal(t, "retry", postData.MessageEvents[0].Name)
+
+	assert.Equal(t, "flush", flushData.Name)
+	assert.Equal(t, codes.OK, flushData.StatusCode)
+}
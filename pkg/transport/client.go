@@ -1,7 +1,9 @@
 package transport
 
 import (
+	"context"
 	"net/http"
+	"time"
 )
 
 // Client is a holder of an http.Client.  In future it will have some high level logic
@@ -11,3 +13,13 @@ import (
 type Client struct {
 	Client *http.Client
 }
+
+// AttemptContext returns the context for a single attempt at a request, which is canceled after timeout, so a hung
+// connection fails the attempt rather than using up the time allowed for retries.  A timeout of 0 does not limit the
+// attempt beyond the client-timeout of the transport.
+func AttemptContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
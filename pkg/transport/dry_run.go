@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// paramDryRun is the name of the parameter which stops requests from being sent.  It is the same as
+// gostatsd.ParamDryRun, which can not be imported here.
+const paramDryRun = "dry-run"
+
+// dryRunTransport reads every request, including its body, so everything up to sending it is done, and responds
+// successfully without sending it.
+type dryRunTransport struct {
+	logger logrus.FieldLogger
+}
+
+// RoundTrip discards the request, and returns an empty 200 OK response.
+func (drt *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var size int64
+	if req.Body != nil {
+		size, _ = io.Copy(ioutil.Discard, req.Body)
+		_ = req.Body.Close()
+	}
+	drt.logger.WithFields(logrus.Fields{
+		"method": req.Method,
+		"host":   req.URL.Host,
+		"path":   req.URL.Path, // The query may contain an API key
+		"bytes":  size,
+	}).Debug("Dry run, not sending request")
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader("")),
+		ContentLength: 0,
+		Request:       req,
+	}, nil
+}
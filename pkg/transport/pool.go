@@ -80,15 +80,21 @@ func (tp *TransportPool) newClient(name string) (*Client, error) {
 		return nil, err
 	}
 
+	dryRun := tp.config.GetBool(paramDryRun)
 	tp.logger.WithFields(logrus.Fields{
 		"name":                      name,
 		paramTransportType:          transportType,
 		paramTransportClientTimeout: clientTimeout,
+		paramDryRun:                 dryRun,
 	}).Info("created client")
 
+	var roundTripper http.RoundTripper = transport
+	if dryRun {
+		roundTripper = &dryRunTransport{logger: tp.logger.WithField("name", name)}
+	}
 	return &Client{
 		Client: &http.Client{
-			Transport: transport,
+			Transport: roundTripper,
 			Timeout:   clientTimeout,
 		},
 	}, nil
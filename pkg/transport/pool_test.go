@@ -1,6 +1,9 @@
 package transport
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -104,3 +107,22 @@ func TestGetUnknownType(t *testing.T) {
 	require.Error(t, err)
 	require.Nil(t, c)
 }
+
+func TestGetDryRun(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request was sent during a dry run")
+	}))
+	defer server.Close()
+
+	v := viper.New()
+	v.Set(paramDryRun, true)
+	p := NewTransportPool(logrus.New(), v)
+	c, err := p.Get("default")
+	require.NoError(t, err)
+	resp, err := c.Client.Post(server.URL, "text/plain", strings.NewReader("metrics"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -3,7 +3,10 @@ package transport
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"time"
@@ -23,6 +26,9 @@ const paramHttpMaxIdleConnections = "max-idle-connections"
 const paramHttpNetwork = "network"
 const paramHttpTLSHandshakeTimeout = "tls-handshake-timeout"
 const paramHttpResponseHeaderTimeout = "response-header-timeout"
+const paramHttpTLSCAPath = "tls-ca-path"
+const paramHttpTLSCertPath = "tls-cert-path"
+const paramHttpTLSKeyPath = "tls-key-path"
 
 const defaultHttpDialerKeepAlive = 30 * time.Second
 const defaultHttpDialerTimeout = 5 * time.Second
@@ -32,6 +38,9 @@ const defaultHttpMaxIdleConnections = 50
 const defaultHttpNetwork = "tcp"
 const defaultHttpTLSHandshakeTimeout = 3 * time.Second
 const defaultHttpResponseHeaderTimeout = time.Duration(0)
+const defaultHttpTLSCAPath = ""
+const defaultHttpTLSCertPath = ""
+const defaultHttpTLSKeyPath = ""
 
 func (tp *TransportPool) newHttpTransport(name string, v *viper.Viper) (*http.Transport, error) {
 	v.SetDefault(paramHttpDialerKeepAlive, defaultHttpDialerKeepAlive)
@@ -42,6 +51,9 @@ func (tp *TransportPool) newHttpTransport(name string, v *viper.Viper) (*http.Tr
 	v.SetDefault(paramHttpNetwork, defaultHttpNetwork)
 	v.SetDefault(paramHttpTLSHandshakeTimeout, defaultHttpTLSHandshakeTimeout)
 	v.SetDefault(paramHttpResponseHeaderTimeout, defaultHttpResponseHeaderTimeout)
+	v.SetDefault(paramHttpTLSCAPath, defaultHttpTLSCAPath)
+	v.SetDefault(paramHttpTLSCertPath, defaultHttpTLSCertPath)
+	v.SetDefault(paramHttpTLSKeyPath, defaultHttpTLSKeyPath)
 
 	dialerKeepAlive := v.GetDuration(paramHttpDialerKeepAlive)
 	dialerTimeout := v.GetDuration(paramHttpDialerTimeout)
@@ -51,6 +63,9 @@ func (tp *TransportPool) newHttpTransport(name string, v *viper.Viper) (*http.Tr
 	network := v.GetString(paramHttpNetwork)
 	tlsHandshakeTimeout := v.GetDuration(paramHttpTLSHandshakeTimeout)
 	responseHeaderTimeout := v.GetDuration(paramHttpResponseHeaderTimeout)
+	tlsCAPath := v.GetString(paramHttpTLSCAPath)
+	tlsCertPath := v.GetString(paramHttpTLSCertPath)
+	tlsKeyPath := v.GetString(paramHttpTLSKeyPath)
 
 	if dialerKeepAlive < -1 {
 		return nil, errors.New(paramHttpDialerKeepAlive + " must be -1, 0, or positive") // -1 = disabled, 0 = keepalives enabled, not configured, >0 = keepalive interval
@@ -71,6 +86,11 @@ func (tp *TransportPool) newHttpTransport(name string, v *viper.Viper) (*http.Tr
 		return nil, errors.New(paramHttpResponseHeaderTimeout + " must not be negative") // 0 = no timeout
 	}
 
+	tlsConfig, err := newTLSClientConfig(tlsCAPath, tlsCertPath, tlsKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
 	dialer := &net.Dialer{
 		Timeout:   dialerTimeout,
 		KeepAlive: dialerKeepAlive,
@@ -79,12 +99,7 @@ func (tp *TransportPool) newHttpTransport(name string, v *viper.Viper) (*http.Tr
 	transport := &http.Transport{
 		Proxy:               http.ProxyFromEnvironment,
 		TLSHandshakeTimeout: tlsHandshakeTimeout,
-		TLSClientConfig: &tls.Config{
-			// Can't use SSLv3 because of POODLE and BEAST
-			// Can't use TLSv1.0 because of POODLE and BEAST using CBC cipher
-			// Can't use TLSv1.1 because of RC4 cipher usage
-			MinVersion: tls.VersionTLS12,
-		},
+		TLSClientConfig:     tlsConfig,
 		DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
 			// replace the network with our own
 			return dialer.DialContext(ctx, network, address)
@@ -109,7 +124,48 @@ func (tp *TransportPool) newHttpTransport(name string, v *viper.Viper) (*http.Tr
 		paramHttpMaxIdleConnections:    maxIdleConnections,
 		paramHttpNetwork:               network,
 		paramHttpTLSHandshakeTimeout:   tlsHandshakeTimeout,
+		paramHttpTLSCAPath:             tlsCAPath,
+		paramHttpTLSCertPath:           tlsCertPath,
 	}).Info("created transport")
 
 	return transport, nil
 }
+
+// newTLSClientConfig returns the TLS configuration for a client.  If caPath is set, servers are verified against it
+// instead of the system roots.  If certPath and keyPath are set, the certificate is presented to servers which request
+// a client certificate.
+func newTLSClientConfig(caPath, certPath, keyPath string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		// Can't use SSLv3 because of POODLE and BEAST
+		// Can't use TLSv1.0 because of POODLE and BEAST using CBC cipher
+		// Can't use TLSv1.1 because of RC4 cipher usage
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caPath != "" {
+		caPEM, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", paramHttpTLSCAPath, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if ok := tlsConfig.RootCAs.AppendCertsFromPEM(caPEM); !ok {
+			return nil, errors.New(paramHttpTLSCAPath + " contains no certificates")
+		}
+	}
+
+	if certPath != "" || keyPath != "" {
+		if certPath == "" {
+			return nil, errors.New(paramHttpTLSCertPath + " is required when " + paramHttpTLSKeyPath + " is set")
+		}
+		if keyPath == "" {
+			return nil, errors.New(paramHttpTLSKeyPath + " is required when " + paramHttpTLSCertPath + " is set")
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -33,6 +33,10 @@ func TestNewHttpTransportEnforceRanges(t *testing.T) {
 		{paramHttpTLSHandshakeTimeout, -1, false},
 		{paramHttpTLSHandshakeTimeout, 0, true},
 		{paramHttpTLSHandshakeTimeout, 1, true},
+		{paramHttpTLSCAPath, "", true},
+		{paramHttpTLSCAPath, "missing.crt", false},
+		{paramHttpTLSCertPath, "client.crt", false},
+		{paramHttpTLSKeyPath, "client.key", false},
 	} {
 		v := viper.New()
 		v.Set("transport.test."+config.param, config.value)
@@ -0,0 +1,356 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
+)
+
+const (
+	defaultAdminTop = 10
+	defaultTapRate  = 10
+)
+
+// AggregatorInspector exposes the live contents of the aggregators.
+type AggregatorInspector interface {
+	// InspectAggregators returns a summary of the contents of every aggregator, with the top series and metrics by
+	// size, and every series of metricName if it is not "".
+	InspectAggregators(ctx context.Context, top int, metricName string) (*AggregatorState, error)
+}
+
+// FlushController flushes the aggregators on demand.
+type FlushController interface {
+	// FlushNow flushes every aggregator immediately and waits for it to complete.  If pause is true, periodic
+	// flushes are paused afterwards, until ResumeFlush is called.
+	FlushNow(ctx context.Context, pause bool) error
+	// ResumeFlush resumes periodic flushes.
+	ResumeFlush(ctx context.Context) error
+	// Paused returns true if periodic flushes are paused.
+	Paused() bool
+}
+
+// Drainer stops the server receiving, sends everything it has received, and makes it exit.  It is served by the admin
+// endpoints if the FlushController implements it.
+type Drainer interface {
+	// Drain returns the datapoints dropped while draining, and an error if it did not finish before the context is done.
+	Drain(ctx context.Context) (uint64, error)
+}
+
+// Reloader reloads the configuration without restarting the server.
+type Reloader interface {
+	Reload(ctx context.Context) error
+}
+
+// ConfigInspector exposes the configuration.  It is served by the admin endpoints if the Reloader implements it.
+type ConfigInspector interface {
+	// EffectiveConfig returns every setting as the server sees it, with secrets masked.
+	EffectiveConfig() map[string]interface{}
+}
+
+// LogLevelController changes the log level at runtime.
+type LogLevelController interface {
+	// SetLevel sets the level of the entries with field set to value, or of every entry if field is "".
+	SetLevel(level logrus.Level, field, value string)
+	// Reset restores the configured level, and removes every scope.
+	Reset()
+	// Levels returns the level of every entry, and the level of each scope by field:value.
+	Levels() (logrus.Level, map[string]logrus.Level)
+}
+
+// MetricTap streams a live sample of the metrics flowing through the pipeline.
+type MetricTap interface {
+	// Tap returns the series matching the filter as they are received, until cancel is called.  Series are dropped
+	// if they are not read fast enough.
+	Tap(filter TapFilter) (series <-chan SeriesState, cancel func())
+}
+
+// TapFilter selects the series to stream from a MetricTap.
+type TapFilter struct {
+	// MatchMetrics are matched against the name of a series, every name matches if it is empty.
+	MatchMetrics gostatsd.StringMatchList
+	// MatchTags are matched against the tags of a series, any tag must match if it is not empty.
+	MatchTags gostatsd.StringMatchList
+	// Rate is the maximum number of series per second.
+	Rate float64
+}
+
+// AggregatorState is a summary of the contents of the aggregators.
+type AggregatorState struct {
+	Aggregators int `json:"aggregators"`
+	// Series is the number of series of each type.
+	Series map[string]int `json:"series"`
+	// TopSeries are the series holding the most samples, largest first.
+	TopSeries []SeriesState `json:"top_series"`
+	// TopMetrics are the metric names with the most series, largest first.
+	TopMetrics []MetricState `json:"top_metrics"`
+	// Metric is every series of the requested metric.
+	Metric []SeriesState `json:"metric,omitempty"`
+}
+
+// SeriesState describes a single series in an aggregator.
+type SeriesState struct {
+	Type    string          `json:"type"`
+	Name    string          `json:"name"`
+	Source  gostatsd.Source `json:"source,omitempty"`
+	Tags    gostatsd.Tags   `json:"tags"`
+	Samples int             `json:"samples"`
+	// Value is the current value, only set for a requested metric.
+	Value interface{} `json:"value,omitempty"`
+}
+
+// MetricState describes the series of a metric name across all aggregators.
+type MetricState struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+}
+
+type adminHandler struct {
+	logger    logrus.FieldLogger
+	inspector AggregatorInspector
+	flusher   FlushController
+	reloader  Reloader
+	tap       MetricTap
+	logLevels LogLevelController
+}
+
+// aggregators writes the state of the aggregators as json.  The number of top series and metrics is set by the top
+// query parameter, and every series of a metric is included if the metric query parameter is set.
+func (ah *adminHandler) aggregators(w http.ResponseWriter, req *http.Request) {
+	top := defaultAdminTop
+	if value := req.URL.Query().Get("top"); value != "" {
+		var err error
+		top, err = strconv.Atoi(value)
+		if err != nil || top < 0 {
+			http.Error(w, "top must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	state, err := ah.inspector.InspectAggregators(req.Context(), top, req.URL.Query().Get("metric"))
+	if err != nil {
+		ah.logger.WithError(err).Info("failed to inspect aggregators")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(state)
+}
+
+// flush flushes the aggregators immediately.  If the pause query parameter is true, periodic flushes are paused
+// afterwards, so the aggregators can be drained for maintenance.
+func (ah *adminHandler) flush(w http.ResponseWriter, req *http.Request) {
+	pause := false
+	if value := req.URL.Query().Get("pause"); value != "" {
+		var err error
+		pause, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "pause must be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+	ah.logger.WithField("pause", pause).Info("Flushing on request")
+	if err := ah.flusher.FlushNow(req.Context(), pause); err != nil {
+		ah.logger.WithError(err).Info("failed to flush")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ah.flushState(w, req)
+}
+
+// resume resumes periodic flushes after they were paused.
+func (ah *adminHandler) resume(w http.ResponseWriter, req *http.Request) {
+	ah.logger.Info("Resuming flushes on request")
+	if err := ah.flusher.ResumeFlush(req.Context()); err != nil {
+		ah.logger.WithError(err).Info("failed to resume flushing")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ah.flushState(w, req)
+}
+
+// flushState writes if periodic flushes are paused as json.
+func (ah *adminHandler) flushState(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Paused bool `json:"paused"`
+	}{
+		Paused: ah.flusher.Paused(),
+	})
+}
+
+// drain drains the server, and writes the datapoints dropped while draining as json.  The drain is given the timeout
+// query parameter if it is set, otherwise it is given until the request is canceled.  The server exits afterwards.
+func (ah *adminHandler) drain(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if value := req.URL.Query().Get("timeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			http.Error(w, "timeout must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ah.logger.Info("Draining on request")
+	dropped, err := ah.flusher.(Drainer).Drain(ctx)
+	result := struct {
+		Dropped uint64 `json:"dropped"`
+		Error   string `json:"error,omitempty"`
+	}{
+		Dropped: dropped,
+	}
+	status := http.StatusOK
+	if err != nil {
+		result.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// reload reloads the configuration.
+func (ah *adminHandler) reload(w http.ResponseWriter, req *http.Request) {
+	ah.logger.Info("Reloading configuration on request")
+	if err := ah.reloader.Reload(req.Context()); err != nil {
+		ah.logger.WithError(err).Error("Failed to reload configuration")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
+
+// config writes the effective configuration as json.
+func (ah *adminHandler) config(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ah.reloader.(ConfigInspector).EffectiveConfig()); err != nil {
+		ah.logger.WithError(err).Error("Failed to encode configuration")
+	}
+}
+
+// setLogLevel sets the log level from the level query parameter.  If the scope query parameter is set to field:value,
+// such as backend:datadog, only the entries with that field are changed.
+func (ah *adminHandler) setLogLevel(w http.ResponseWriter, req *http.Request) {
+	level, err := logrus.ParseLevel(req.URL.Query().Get("level"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var field, value string
+	if scope := req.URL.Query().Get("scope"); scope != "" {
+		idx := strings.IndexByte(scope, ':')
+		if idx <= 0 {
+			http.Error(w, "scope must be field:value", http.StatusBadRequest)
+			return
+		}
+		field, value = scope[:idx], scope[idx+1:]
+	}
+	ah.logger.WithFields(logrus.Fields{
+		"level": level,
+		"scope": req.URL.Query().Get("scope"),
+	}).Info("Changing log level on request")
+	ah.logLevels.SetLevel(level, field, value)
+	ah.logLevelState(w, req)
+}
+
+// resetLogLevel restores the configured log level.
+func (ah *adminHandler) resetLogLevel(w http.ResponseWriter, req *http.Request) {
+	ah.logger.Info("Resetting log level on request")
+	ah.logLevels.Reset()
+	ah.logLevelState(w, req)
+}
+
+// logLevelState writes the log level, and the level of each scope as json.
+func (ah *adminHandler) logLevelState(w http.ResponseWriter, req *http.Request) {
+	level, scopes := ah.logLevels.Levels()
+	state := struct {
+		Level  string            `json:"level"`
+		Scopes map[string]string `json:"scopes"`
+	}{
+		Level:  level.String(),
+		Scopes: make(map[string]string, len(scopes)),
+	}
+	for scope, level := range scopes {
+		state.Scopes[scope] = level.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(state)
+}
+
+// tapMetrics streams a live sample of the metrics flowing through the pipeline as lines of json, until the client
+// disconnects.  Series are selected by the metric and tag query parameters, which may be repeated, and use the same
+// syntax as filters.  The rate query parameter is the maximum number of series per second, and the stream ends after
+// the number of series in the limit query parameter, if it is set.
+func (ah *adminHandler) tapMetrics(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := TapFilter{Rate: defaultTapRate}
+	for _, value := range query["metric"] {
+		sm, err := gostatsd.ParseStringMatch(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid metric %q: %v", value, err), http.StatusBadRequest)
+			return
+		}
+		filter.MatchMetrics = append(filter.MatchMetrics, sm)
+	}
+	for _, value := range query["tag"] {
+		sm, err := gostatsd.ParseStringMatch(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid tag %q: %v", value, err), http.StatusBadRequest)
+			return
+		}
+		filter.MatchTags = append(filter.MatchTags, sm)
+	}
+	if value := query.Get("rate"); value != "" {
+		var err error
+		filter.Rate, err = strconv.ParseFloat(value, 64)
+		if err != nil || filter.Rate <= 0 {
+			http.Error(w, "rate must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	series, cancel := ah.tap.Tap(filter)
+	defer cancel()
+
+	ah.logger.WithField("query", req.URL.RawQuery).Info("Tapping metrics on request")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for sent := 0; limit == 0 || sent < limit; sent++ {
+		select {
+		case <-req.Context().Done():
+			return
+		case s := <-series:
+			if err := encoder.Encode(s); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
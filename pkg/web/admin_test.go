@@ -0,0 +1,285 @@
+package web_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/internal/util"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+type fakeTap struct {
+	filter web.TapFilter
+}
+
+func (ft *fakeTap) Tap(filter web.TapFilter) (<-chan web.SeriesState, func()) {
+	ft.filter = filter
+	series := make(chan web.SeriesState, 3)
+	for i := 0; i < 3; i++ {
+		series <- web.SeriesState{Type: "counter", Name: "app.requests", Tags: gostatsd.Tags{"service:api"}, Samples: 1, Value: i}
+	}
+	return series, func() {}
+}
+
+func TestAdminTap(t *testing.T) {
+	t.Parallel()
+
+	tap := &fakeTap{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		"TestAdminTap",
+		"",
+		false,
+		false,
+		false,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{Username: "user", Password: "secret"},
+		nil,
+		nil,
+		nil,
+		tap,
+		nil,
+	)
+	require.NoError(t, err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetBasicAuth("user", "secret")
+		w := httptest.NewRecorder()
+		hs.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/admin/tap?metric=app.*&tag=service:api&tag=regex:^env:&rate=5&limit=2")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, tap.filter.MatchMetrics, 1)
+	assert.Len(t, tap.filter.MatchTags, 2)
+	assert.Equal(t, 5.0, tap.filter.Rate)
+
+	var lines []web.SeriesState
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var s web.SeriesState
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &s))
+		lines = append(lines, s)
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, "app.requests", lines[0].Name)
+	assert.EqualValues(t, 1, lines[1].Value)
+
+	for _, path := range []string{"/admin/tap?metric=regex:(", "/admin/tap?rate=0", "/admin/tap?limit=-1"} {
+		assert.Equal(t, http.StatusBadRequest, get(path).Code, path)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logLevels := util.NewLogLevels(logger)
+	logLevels.Configure(logrus.InfoLevel, &logrus.TextFormatter{})
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		"TestAdminLogLevel",
+		"",
+		false,
+		false,
+		false,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{Username: "user", Password: "secret"},
+		nil,
+		nil,
+		nil,
+		nil,
+		logLevels,
+	)
+	require.NoError(t, err)
+
+	do := func(method, path string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("user", "secret")
+		w := httptest.NewRecorder()
+		hs.Router.ServeHTTP(w, req)
+		state := map[string]interface{}{}
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+		}
+		return w.Code, state
+	}
+
+	code, state := do("POST", "/admin/loglevel?level=debug&scope=backend:datadog")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "info", state["level"])
+	assert.Equal(t, map[string]interface{}{"backend:datadog": "debug"}, state["scopes"])
+	assert.Equal(t, logrus.DebugLevel, logger.GetLevel())
+
+	code, state = do("POST", "/admin/loglevel?level=warn")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "warning", state["level"])
+
+	code, state = do("POST", "/admin/loglevel/reset")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "info", state["level"])
+	assert.Empty(t, state["scopes"])
+	assert.Equal(t, logrus.InfoLevel, logger.GetLevel())
+
+	code, _ = do("GET", "/admin/loglevel")
+	assert.Equal(t, http.StatusOK, code)
+	for _, path := range []string{"/admin/loglevel?level=loud", "/admin/loglevel?level=debug&scope=datadog"} {
+		code, _ = do("POST", path)
+		assert.Equal(t, http.StatusBadRequest, code, path)
+	}
+}
+
+type fakeReloader struct{}
+
+func (fr *fakeReloader) Reload(ctx context.Context) error {
+	return nil
+}
+
+func (fr *fakeReloader) EffectiveConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"flush-interval": "10s",
+		"datadog":        map[string]interface{}{"api_key": "********"},
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	t.Parallel()
+
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		"TestAdminConfig",
+		"",
+		false,
+		false,
+		false,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{Username: "user", Password: "secret"},
+		nil,
+		nil,
+		&fakeReloader{},
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/admin/config", nil)
+	req.SetBasicAuth("user", "secret")
+	w := httptest.NewRecorder()
+	hs.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	config := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &config))
+	assert.Equal(t, "10s", config["flush-interval"])
+	assert.Equal(t, map[string]interface{}{"api_key": "********"}, config["datadog"])
+}
+
+type fakeDrainer struct {
+	drained bool
+}
+
+func (fd *fakeDrainer) FlushNow(ctx context.Context, pause bool) error {
+	return nil
+}
+
+func (fd *fakeDrainer) ResumeFlush(ctx context.Context) error {
+	return nil
+}
+
+func (fd *fakeDrainer) Paused() bool {
+	return false
+}
+
+func (fd *fakeDrainer) Drain(ctx context.Context) (uint64, error) {
+	fd.drained = true
+	if _, ok := ctx.Deadline(); !ok {
+		return 0, nil
+	}
+	return 3, errors.New("3 datapoints were dropped while draining")
+}
+
+func TestAdminDrain(t *testing.T) {
+	t.Parallel()
+
+	drainer := &fakeDrainer{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		"TestAdminDrain",
+		"",
+		false,
+		false,
+		false,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{Username: "user", Password: "secret"},
+		nil,
+		drainer,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+
+	serve := func(url string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", url, nil)
+		req.SetBasicAuth("user", "secret")
+		w := httptest.NewRecorder()
+		hs.Router.ServeHTTP(w, req)
+		result := map[string]interface{}{}
+		if w.Code != http.StatusBadRequest {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		}
+		return w.Code, result
+	}
+
+	code, _ := serve("/admin/drain?timeout=soon")
+	require.Equal(t, http.StatusBadRequest, code)
+	require.False(t, drainer.drained)
+
+	code, result := serve("/admin/drain")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"dropped": 0.0}, result)
+	require.True(t, drainer.drained)
+
+	code, result = serve("/admin/drain?timeout=10s")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]interface{}{"dropped": 3.0, "error": "3 datapoints were dropped while draining"}, result)
+}
@@ -0,0 +1,70 @@
+package web
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultOverloadRetryAfter is how long clients are asked to wait before retrying a request rejected as the server is
+// overloaded.
+const defaultOverloadRetryAfter = 5 * time.Second
+
+// OverloadChecker reports if the server is overloaded, so the ingestion endpoints can reject requests with data which
+// would only be dropped internally, and clients back off instead.
+type OverloadChecker interface {
+	// Overloaded returns why the server is overloaded, or "" if it is not.
+	Overloaded() string
+}
+
+// SetOverloadChecker makes the ingestion endpoints of the server reject requests while oc reports the server is
+// overloaded.  It must be called before the server is run.
+func (hs *httpServer) SetOverloadChecker(oc OverloadChecker) {
+	if hs.rawMetricsV2 != nil {
+		hs.rawMetricsV2.overload = oc
+	}
+}
+
+// allowLoad returns false if the server is overloaded, and the request has been rejected with a 503 which tells the
+// client when to retry.  The body is not read, so the bytes rejected are those the client declared.
+func (rhh *rawHttpHandlerV2) allowLoad(w http.ResponseWriter, req *http.Request) bool {
+	if rhh.overload == nil {
+		return true
+	}
+	reason := rhh.overload.Overloaded()
+	if reason == "" {
+		return true
+	}
+	var size uint64
+	if req.ContentLength > 0 {
+		size = uint64(req.ContentLength)
+	}
+	rhh.rejectOverloaded(reason, size)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rhh.overloadRetryAfter.Seconds()))))
+	http.Error(w, "server is overloaded: "+reason, http.StatusServiceUnavailable)
+	return false
+}
+
+// allowPeerLoad returns an error if the server is overloaded, for a message of size bytes on a grpc stream.
+func (rhh *rawHttpHandlerV2) allowPeerLoad(size int) error {
+	if rhh.overload == nil {
+		return nil
+	}
+	reason := rhh.overload.Overloaded()
+	if reason == "" {
+		return nil
+	}
+	rhh.rejectOverloaded(reason, uint64(size))
+	return status.Errorf(codes.Unavailable, "server is overloaded: %s", reason)
+}
+
+func (rhh *rawHttpHandlerV2) rejectOverloaded(reason string, size uint64) {
+	atomic.AddUint64(&rhh.requestFailureOverloaded, 1)
+	atomic.AddUint64(&rhh.overloadedBytes, size)
+	rhh.logger.WithField("reason", reason).Debug("overloaded, rejected request")
+}
@@ -0,0 +1,43 @@
+package web
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/hligit/gostatsd"
+)
+
+// ClusterForwardedHeader is the http header, or grpc metadata, set by a member of a cluster on the series it forwards
+// to the member which owns them.  They have already been processed by the sender, so they are sent to the handler of
+// the series this server owns, rather than being processed, and divided between the members, again.
+const ClusterForwardedHeader = "Gostatsd-Cluster-Forwarded"
+
+// SetClusterHandler makes the ingestion endpoints of the server send series forwarded by other members of a cluster
+// to handler.  It must be called before the server is run.
+func (hs *httpServer) SetClusterHandler(handler gostatsd.PipelineHandler) {
+	if hs.rawMetricsV2 != nil {
+		hs.rawMetricsV2.clusterHandler = handler
+	}
+}
+
+// metricHandler returns the handler for the metrics of a request, which is the cluster handler if they were forwarded
+// by another member of the cluster.
+func (rhh *rawHttpHandlerV2) metricHandler(req *http.Request) (gostatsd.PipelineHandler, bool /*cluster*/) {
+	if rhh.clusterHandler != nil && req.Header.Get(ClusterForwardedHeader) != "" {
+		return rhh.clusterHandler, true
+	}
+	return rhh.handler, false
+}
+
+// peerMetricHandler returns the handler for the metrics of a grpc stream, which is the cluster handler if they were
+// forwarded by another member of the cluster.
+func (rhh *rawHttpHandlerV2) peerMetricHandler(ctx context.Context) (gostatsd.PipelineHandler, bool /*cluster*/) {
+	if rhh.clusterHandler != nil {
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(ClusterForwardedHeader)) > 0 {
+			return rhh.clusterHandler, true
+		}
+	}
+	return rhh.handler, false
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// BasicAuth holds the credentials required to access the debug endpoints.  If Username is "", no credentials are
+// required.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// wrap returns a handler which requires the credentials before calling handler.
+func (ba BasicAuth) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	if ba.Username == "" {
+		return handler
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(ba.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(ba.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gostatsd"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+type gcStatsResponse struct {
+	NumGoroutine   int             `json:"num_goroutine"`
+	NumGC          int64           `json:"num_gc"`
+	LastGC         time.Time       `json:"last_gc"`
+	PauseTotal     time.Duration   `json:"pause_total_ns"`
+	PauseQuantiles []time.Duration `json:"pause_quantiles_ns"` // min, 25%, 50%, 75%, max
+	HeapAlloc      uint64          `json:"heap_alloc"`
+	HeapInuse      uint64          `json:"heap_inuse"`
+	HeapObjects    uint64          `json:"heap_objects"`
+	NextGC         uint64          `json:"next_gc"`
+	Sys            uint64          `json:"sys"`
+	GCCPUFraction  float64         `json:"gc_cpu_fraction"`
+}
+
+// gcStats writes the garbage collector and heap statistics as json.
+func gcStats(w http.ResponseWriter, req *http.Request) {
+	gc := debug.GCStats{
+		PauseQuantiles: make([]time.Duration, 5),
+	}
+	debug.ReadGCStats(&gc)
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(gcStatsResponse{
+		NumGoroutine:   runtime.NumGoroutine(),
+		NumGC:          gc.NumGC,
+		LastGC:         gc.LastGC,
+		PauseTotal:     gc.PauseTotal,
+		PauseQuantiles: gc.PauseQuantiles,
+		HeapAlloc:      ms.HeapAlloc,
+		HeapInuse:      ms.HeapInuse,
+		HeapObjects:    ms.HeapObjects,
+		NextGC:         ms.NextGC,
+		Sys:            ms.Sys,
+		GCCPUFraction:  ms.GCCPUFraction,
+	})
+}
@@ -0,0 +1,66 @@
+package web_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+func TestDebugAuth(t *testing.T) {
+	t.Parallel()
+
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		"TestDebugAuth",
+		"",
+		true,
+		true,
+		false,
+		true,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{Username: "user", Password: "secret"},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+
+	get := func(path, username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		hs.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/debug/gcstats", "/debug/pprof/goroutine", "/expvar"} {
+		assert.Equal(t, http.StatusUnauthorized, get(path, "", "").Code, path)
+		assert.Equal(t, http.StatusUnauthorized, get(path, "user", "wrong").Code, path)
+		assert.Equal(t, http.StatusOK, get(path, "user", "secret").Code, path)
+	}
+
+	// Only the debug endpoints require credentials
+	assert.Equal(t, http.StatusOK, get("/healthcheck", "", "").Code)
+
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal(get("/debug/gcstats", "user", "secret").Body.Bytes(), &stats))
+	assert.Contains(t, stats, "num_goroutine")
+	assert.Contains(t, stats, "heap_alloc")
+}
@@ -0,0 +1,177 @@
+package web
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pb"
+)
+
+// grpcKeepaliveMinTime is the most frequently a forwarder may send keepalive pings.
+const grpcKeepaliveMinTime = 10 * time.Second
+
+// grpcReceiverV2 receives metrics and events from forwarders over grpc streams.  It shares the handler and the
+// internal metrics of the http ingestion endpoints.
+type grpcReceiverV2 struct {
+	rhh *rawHttpHandlerV2
+}
+
+// protocolVersion returns the version of the forwarding protocol of the stream, from its metadata.
+func (gr *grpcReceiverV2) protocolVersion(ctx context.Context) (int, error) {
+	var value string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(pb.ProtocolVersionHeader); len(values) > 0 {
+			value = values[0]
+		}
+	}
+	version, err := pb.ParseProtocolVersion(value)
+	if err != nil || !pb.SupportsProtocolVersion(version) {
+		atomic.AddUint64(&gr.rhh.requestFailureVersion, 1)
+		return 0, status.Errorf(codes.FailedPrecondition, "unsupported protocol version %q, supported versions are %s", value, supportedProtocolVersions)
+	}
+	return version, nil
+}
+
+func (gr *grpcReceiverV2) Metrics(stream pb.ForwarderV2_MetricsServer) error {
+	ctx := stream.Context()
+	version, err := gr.protocolVersion(ctx)
+	if err != nil {
+		return err
+	}
+	source := gr.rhh.sourceOpts.peerSource(ctx)
+	tenant := gr.rhh.tenantOpts.peerTenant(ctx)
+	client := gr.rhh.peerClient(ctx)
+	handler, cluster := gr.rhh.peerMetricHandler(ctx)
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = gr.rhh.allowPeerLoad(proto.Size(msg)); err != nil {
+			return err
+		}
+		mm := translateFromProtobufV2(msg, source)
+		if err = gr.rhh.waitPeer(ctx, client, mm.Len()); err != nil {
+			return err
+		}
+		if !cluster {
+			gr.rhh.tenantOpts.tagMetricMap(mm, tenant)
+		}
+		handler.DispatchMetricMap(ctx, mm)
+		atomic.AddUint64(gr.rhh.protocolVersions[version], 1)
+		atomic.AddUint64(&gr.rhh.requestSuccess, 1)
+
+		if err = stream.Send(&empty.Empty{}); err != nil {
+			return err
+		}
+	}
+}
+
+func (gr *grpcReceiverV2) Events(stream pb.ForwarderV2_EventsServer) error {
+	ctx := stream.Context()
+	version, err := gr.protocolVersion(ctx)
+	if err != nil {
+		return err
+	}
+	peerSource := gr.rhh.sourceOpts.peerSource(ctx)
+	tenant := gr.rhh.tenantOpts.peerTenant(ctx)
+	client := gr.rhh.peerClient(ctx)
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = gr.rhh.allowPeerLoad(proto.Size(msg)); err != nil {
+			return err
+		}
+		if err = gr.rhh.waitPeer(ctx, client, 1); err != nil {
+			return err
+		}
+
+		source := gostatsd.Source(msg.Hostname)
+		if source == gostatsd.UnknownSource {
+			source = peerSource
+		}
+		event := translateEventFromProtobufV2(msg, source)
+		gr.rhh.tenantOpts.tagEvent(event, tenant)
+		gr.rhh.handler.DispatchEvent(ctx, event)
+		atomic.AddUint64(gr.rhh.protocolVersions[version], 1)
+		atomic.AddUint64(&gr.rhh.eventsProcessed, 1)
+		atomic.AddUint64(&gr.rhh.requestSuccess, 1)
+
+		if err = stream.Send(&empty.Empty{}); err != nil {
+			return err
+		}
+	}
+}
+
+// enableGrpc serves the ingestion endpoints as a grpc service on address, in addition to http.  It uses the same TLS
+// configuration as the http server.
+func (hs *httpServer) enableGrpc(address string) {
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             grpcKeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+	}
+	if hs.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(hs.tlsConfig)))
+	}
+	hs.grpcAddress = address
+	hs.grpcServer = grpc.NewServer(opts...)
+	pb.RegisterForwarderV2Server(hs.grpcServer, &grpcReceiverV2{rhh: hs.rawMetricsV2})
+}
+
+// runGrpc serves grpc until the context is done, then stops gracefully.
+func (hs *httpServer) runGrpc(ctx context.Context) {
+	listener, err := net.Listen("tcp", hs.grpcAddress)
+	if err != nil {
+		hs.logger.WithError(err).Error("grpc server failed")
+		return
+	}
+	hs.logger.WithField("address", hs.grpcAddress).Info("listening for grpc")
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		hs.logger.Info("shutting down grpc server")
+		graceful := make(chan struct{})
+		go func() {
+			hs.grpcServer.GracefulStop()
+			close(graceful)
+		}()
+		select {
+		case <-graceful:
+		case <-time.After(5 * time.Second):
+			// Forwarders keep their streams open, so they may never close by themselves
+			hs.grpcServer.Stop()
+		}
+	}()
+
+	if err = hs.grpcServer.Serve(listener); err != nil {
+		hs.logger.WithError(err).Error("grpc server failed")
+	}
+	<-stopped
+}
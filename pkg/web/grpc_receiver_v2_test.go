@@ -0,0 +1,90 @@
+package web_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/statsd"
+	"github.com/hligit/gostatsd/pkg/transport"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestForwardingEndToEndGrpc(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	grpcAddress := freeAddress(t)
+	v := viper.New()
+	v.Set("http-servers", []string{"ingest"})
+	v.Set("http.ingest.address", freeAddress(t))
+	v.Set("http.ingest.enable-ingestion", true)
+	v.Set("http.ingest.grpc-address", grpcAddress)
+
+	ch := &capturingHandler{}
+	servers, err := web.NewHttpServersFromViper(v, logrus.StandardLogger(), ch, nil, nil, nil, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	hfh, err := statsd.NewHttpForwarderHandlerV2(
+		logrus.StandardLogger(),
+		"default",
+		"grpc",
+		0,
+		[]string{"http://" + grpcAddress},
+		1,
+		10,
+		"gzip",
+		0,
+		5*time.Second,
+		10*time.Millisecond,
+		nil,
+		nil,
+		statsd.GrpcOptions{KeepaliveTime: time.Minute, KeepaliveTimeout: time.Minute},
+		statsd.SpoolOptions{},
+		statsd.QueueOptions{},
+		statsd.EventOptions{},
+		p,
+	)
+	require.NoError(t, err)
+
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, servers[0].Run)
+	wg.StartWithContext(ctx, hfh.Run)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "counter", Type: gostatsd.COUNTER, Value: 10, Rate: 1})
+	hfh.DispatchMetricMap(ctx, mm)
+	hfh.DispatchEvent(ctx, &gostatsd.Event{Title: "title", Text: "text"})
+
+	require.Eventually(t, func() bool {
+		ch.mu.Lock()
+		defer ch.mu.Unlock()
+		return len(ch.e) == 1 && len(ch.maps) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	hfh.WaitForEvents()
+
+	actual := gostatsd.MergeMaps(ch.MetricMaps()).Counters["counter"]
+	require.Len(t, actual, 1)
+	for _, c := range actual {
+		require.EqualValues(t, 10, c.Value)
+	}
+	require.NoError(t, hfh.CheckReady())
+}
@@ -2,12 +2,16 @@ package web
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/hligit/gostatsd"
 )
 
 type healthChecker struct {
-	logger logrus.FieldLogger
+	logger    logrus.FieldLogger
+	readiness []gostatsd.ReadinessChecker
 }
 
 // healthCheck reports if the server is ready to process traffic.  It does not validate downstream dependencies.
@@ -22,3 +26,27 @@ func (hc *healthChecker) deepCheck(w http.ResponseWriter, req *http.Request) {
 	hc.logger.Info("deepCheck")
 	_, _ = w.Write([]byte("OK"))
 }
+
+// healthz reports if the process is alive, and is intended for liveness probes.  It is always happy if the server
+// can respond.
+func (hc *healthChecker) healthz(w http.ResponseWriter, req *http.Request) {
+	_, _ = w.Write([]byte("OK"))
+}
+
+// readyz reports if every component is ready, and is intended for readiness probes.  If any component is not ready,
+// it responds with 503 and the reasons, one per line.
+func (hc *healthChecker) readyz(w http.ResponseWriter, req *http.Request) {
+	var reasons []string
+	for _, checker := range hc.readiness {
+		if err := checker.CheckReady(); err != nil {
+			reasons = append(reasons, err.Error())
+		}
+	}
+	if len(reasons) > 0 {
+		hc.logger.WithField("reasons", reasons).Debug("not ready")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(strings.Join(reasons, "\n")))
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
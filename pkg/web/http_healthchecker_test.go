@@ -0,0 +1,73 @@
+package web_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+type fakeChecker struct {
+	err error
+}
+
+func (fc *fakeChecker) CheckReady() error {
+	return fc.err
+}
+
+func TestReadyz(t *testing.T) {
+	t.Parallel()
+
+	receiver := &fakeChecker{}
+	informer := &fakeChecker{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		"TestReadyz",
+		"",
+		false,
+		false,
+		false,
+		true,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		[]gostatsd.ReadinessChecker{receiver, informer},
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		hs.Router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/readyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+
+	receiver.err = errors.New("receiver is not listening")
+	informer.err = errors.New("k8s pod informer has not synced")
+	w = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "receiver is not listening\nk8s pod informer has not synced", w.Body.String())
+
+	// Liveness is unaffected by readiness
+	w = get("/healthz")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
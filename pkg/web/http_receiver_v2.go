@@ -4,6 +4,7 @@ import (
 	"context"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -15,25 +16,54 @@ import (
 	"github.com/hligit/gostatsd/pkg/stats"
 )
 
+// supportedProtocolVersions is the value of the ProtocolVersionsHeader in every response.
+var supportedProtocolVersions = pb.FormatProtocolVersions(pb.ProtocolVersions)
+
 type rawHttpHandlerV2 struct {
 	requestSuccess           uint64 // atomic
 	requestFailureRead       uint64 // atomic
 	requestFailureDecompress uint64 // atomic
 	requestFailureEncoding   uint64 // atomic
 	requestFailureUnmarshal  uint64 // atomic
+	requestFailureInvalid    uint64 // atomic
+	requestFailureVersion    uint64 // atomic
+	requestFailureLimited    uint64 // atomic
+	requestFailureOverloaded uint64 // atomic
+	overloadedBytes          uint64 // atomic - bytes in requests rejected as the server is overloaded
 	metricsProcessed         uint64 // atomic
 	eventsProcessed          uint64 // atomic
 
+	protocolVersions map[int]*uint64 // atomic values - requests per version of the forwarding protocol
+
 	logger     logrus.FieldLogger
 	handler    gostatsd.PipelineHandler
 	serverName string
+	sourceOpts SourceOptions
+	tenantOpts TenantOptions
+	limiter    *rateLimiter // nil if there are no rate limits
+	namespace  string       // prefixed to the name of metrics from clients, but not those forwarded
+
+	overload           OverloadChecker // nil if requests are never rejected as the server is overloaded
+	overloadRetryAfter time.Duration   // When clients are told to retry a request rejected as the server is overloaded
+
+	clusterHandler gostatsd.PipelineHandler // nil unless series are forwarded by other members of a cluster
 }
 
-func newRawHttpHandlerV2(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler) *rawHttpHandlerV2 {
+func newRawHttpHandlerV2(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler, sourceOpts SourceOptions, tenantOpts TenantOptions, limiter *rateLimiter) *rawHttpHandlerV2 {
+	protocolVersions := make(map[int]*uint64, len(pb.ProtocolVersions))
+	for _, version := range pb.ProtocolVersions {
+		protocolVersions[version] = new(uint64)
+	}
 	return &rawHttpHandlerV2{
-		logger:     logger,
-		handler:    handler,
-		serverName: serverName,
+		protocolVersions: protocolVersions,
+		logger:           logger,
+		handler:          handler,
+		serverName:       serverName,
+		sourceOpts:       sourceOpts,
+		tenantOpts:       tenantOpts,
+		limiter:          limiter,
+
+		overloadRetryAfter: defaultOverloadRetryAfter,
 	}
 }
 
@@ -59,6 +89,11 @@ func (rhh *rawHttpHandlerV2) emitMetrics(statser stats.Statser) {
 	requestFailureDecompress := atomic.SwapUint64(&rhh.requestFailureDecompress, 0)
 	requestFailureEncoding := atomic.SwapUint64(&rhh.requestFailureEncoding, 0)
 	requestFailureUnmarshal := atomic.SwapUint64(&rhh.requestFailureUnmarshal, 0)
+	requestFailureInvalid := atomic.SwapUint64(&rhh.requestFailureInvalid, 0)
+	requestFailureVersion := atomic.SwapUint64(&rhh.requestFailureVersion, 0)
+	requestFailureLimited := atomic.SwapUint64(&rhh.requestFailureLimited, 0)
+	requestFailureOverloaded := atomic.SwapUint64(&rhh.requestFailureOverloaded, 0)
+	overloadedBytes := atomic.SwapUint64(&rhh.overloadedBytes, 0)
 	metricsProcessed := atomic.SwapUint64(&rhh.metricsProcessed, 0)
 	eventsProcessed := atomic.SwapUint64(&rhh.eventsProcessed, 0)
 
@@ -67,11 +102,39 @@ func (rhh *rawHttpHandlerV2) emitMetrics(statser stats.Statser) {
 	statser.Count("http.incoming", float64(requestFailureDecompress), []string{"result:failure", "failure:decompress"})
 	statser.Count("http.incoming", float64(requestFailureEncoding), []string{"result:failure", "failure:encoding"})
 	statser.Count("http.incoming", float64(requestFailureUnmarshal), []string{"result:failure", "failure:unmarshal"})
+	statser.Count("http.incoming", float64(requestFailureInvalid), []string{"result:failure", "failure:invalid"})
+	statser.Count("http.incoming", float64(requestFailureVersion), []string{"result:failure", "failure:version"})
+	statser.Count("http.incoming", float64(requestFailureLimited), []string{"result:failure", "failure:limited"})
+	statser.Count("http.incoming", float64(requestFailureOverloaded), []string{"result:failure", "failure:overloaded"})
+	statser.Count("http.incoming.overloaded_bytes", float64(overloadedBytes), nil)
 	statser.Count("http.incoming.metrics", float64(metricsProcessed), nil)
 	statser.Count("http.incoming.events", float64(eventsProcessed), nil)
+	for version, count := range rhh.protocolVersions {
+		statser.Count("http.incoming.version", float64(atomic.SwapUint64(count, 0)), []string{"protocol-version:" + strconv.Itoa(version)})
+	}
+	if rhh.limiter != nil {
+		rhh.limiter.emitMetrics(statser)
+	}
 }
 
-func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
+// protocolVersion returns the version of the forwarding protocol a payload is encoded with, and lists the supported
+// versions in the response.  It returns false if the version is not supported, and the response has been written.
+func (rhh *rawHttpHandlerV2) protocolVersion(w http.ResponseWriter, value string) (int, bool) {
+	w.Header().Set(pb.ProtocolVersionsHeader, supportedProtocolVersions)
+	version, err := pb.ParseProtocolVersion(value)
+	if err != nil || !pb.SupportsProtocolVersion(version) {
+		atomic.AddUint64(&rhh.requestFailureVersion, 1)
+		if len(value) > 64 {
+			value = value[0:64]
+		}
+		rhh.logger.WithField("version", value).Info("unsupported protocol version")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return 0, false
+	}
+	return version, true
+}
+
+func (rhh *rawHttpHandlerV2) readBody(w http.ResponseWriter, req *http.Request) ([]byte, int) {
 	b, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		atomic.AddUint64(&rhh.requestFailureRead, 1)
@@ -81,22 +144,20 @@ func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
 	req.Body.Close()
 
 	encoding := req.Header.Get("Content-Encoding")
-	switch encoding {
-	case "deflate":
-		b, err = decompress(b)
-		if err != nil {
-			atomic.AddUint64(&rhh.requestFailureDecompress, 1)
-			rhh.logger.WithError(err).Info("failed decompressing body")
-			return nil, http.StatusBadRequest
-		}
-	case "identity", "":
-		// no action
-	default:
+	b, ok, err := decompress(encoding, b)
+	if !ok {
 		atomic.AddUint64(&rhh.requestFailureEncoding, 1)
 		if len(encoding) > 64 {
 			encoding = encoding[0:64]
 		}
 		rhh.logger.WithField("encoding", encoding).Info("invalid encoding")
+		// Tells the forwarder which encodings it can fall back to
+		w.Header().Set("Accept-Encoding", acceptEncoding)
+		return nil, http.StatusUnsupportedMediaType
+	}
+	if err != nil {
+		atomic.AddUint64(&rhh.requestFailureDecompress, 1)
+		rhh.logger.WithError(err).Info("failed decompressing body")
 		return nil, http.StatusBadRequest
 	}
 
@@ -104,7 +165,17 @@ func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
 }
 
 func (rhh *rawHttpHandlerV2) MetricHandler(w http.ResponseWriter, req *http.Request) {
-	b, errCode := rhh.readBody(req)
+	version, ok := rhh.protocolVersion(w, req.Header.Get(pb.ProtocolVersionHeader))
+	if !ok || !rhh.allowLoad(w, req) {
+		return
+	}
+
+	client, ok := rhh.allowRequest(w, req)
+	if !ok {
+		return
+	}
+
+	b, errCode := rhh.readBody(w, req)
 
 	if errCode != 0 {
 		w.WriteHeader(errCode)
@@ -120,23 +191,40 @@ func (rhh *rawHttpHandlerV2) MetricHandler(w http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	mm := translateFromProtobufV2(&msg)
-	rhh.handler.DispatchMetricMap(req.Context(), mm)
+	mm := translateFromProtobufV2(&msg, rhh.sourceOpts.requestSource(req))
+	if !rhh.allowDatapoints(w, client, mm.Len()) {
+		return
+	}
+	handler, cluster := rhh.metricHandler(req)
+	if !cluster {
+		rhh.tenantOpts.tagMetricMap(mm, rhh.tenantOpts.requestTenant(req))
+	}
+	handler.DispatchMetricMap(req.Context(), mm)
 
+	atomic.AddUint64(rhh.protocolVersions[version], 1)
 	atomic.AddUint64(&rhh.requestSuccess, 1)
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Request) {
-	b, errCode := rhh.readBody(req)
+	version, ok := rhh.protocolVersion(w, req.Header.Get(pb.ProtocolVersionHeader))
+	if !ok || !rhh.allowLoad(w, req) {
+		return
+	}
+
+	client, ok := rhh.allowRequest(w, req)
+	if !ok {
+		return
+	}
+
+	b, errCode := rhh.readBody(w, req)
 
 	if errCode != 0 {
 		w.WriteHeader(errCode)
 		return
 	}
 
-	var msg pb.EventV2
-	err := proto.Unmarshal(b, &msg)
+	msgs, err := unmarshalEvents(b, version)
 	if err != nil {
 		atomic.AddUint64(&rhh.requestFailureUnmarshal, 1)
 		rhh.logger.WithError(err).Error("failed to unmarshal")
@@ -144,11 +232,49 @@ func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	if !rhh.allowDatapoints(w, client, len(msgs)) {
+		return
+	}
+
+	requestSource := rhh.sourceOpts.requestSource(req)
+	tenant := rhh.tenantOpts.requestTenant(req)
+	for _, msg := range msgs {
+		source := gostatsd.Source(msg.Hostname)
+		if source == gostatsd.UnknownSource {
+			source = requestSource
+		}
+		event := translateEventFromProtobufV2(msg, source)
+		rhh.tenantOpts.tagEvent(event, tenant)
+
+		rhh.handler.DispatchEvent(req.Context(), event)
+	}
+
+	atomic.AddUint64(rhh.protocolVersions[version], 1)
+	atomic.AddUint64(&rhh.eventsProcessed, uint64(len(msgs)))
+	atomic.AddUint64(&rhh.requestSuccess, 1)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// unmarshalEvents parses the body of /v2/event, which is a single event before ProtocolVersion3, and a batch of events
+// since.
+func unmarshalEvents(b []byte, version int) ([]*pb.EventV2, error) {
+	if version >= pb.ProtocolVersion3 {
+		return pb.UnmarshalEventBatch(b)
+	}
+	var msg pb.EventV2
+	if err := proto.Unmarshal(b, &msg); err != nil {
+		return nil, err
+	}
+	return []*pb.EventV2{&msg}, nil
+}
+
+// translateEventFromProtobufV2 converts an EventV2 to an Event with the given source.
+func translateEventFromProtobufV2(msg *pb.EventV2, source gostatsd.Source) *gostatsd.Event {
 	event := &gostatsd.Event{
 		Title:          msg.Title,
 		Text:           msg.Text,
 		DateHappened:   msg.DateHappened,
-		Source:         gostatsd.Source(msg.Hostname),
+		Source:         source,
 		AggregationKey: msg.AggregationKey,
 		SourceTypeName: msg.SourceTypeName,
 		Tags:           msg.Tags,
@@ -175,25 +301,31 @@ func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Reque
 	default:
 		event.AlertType = gostatsd.AlertInfo
 	}
-
-	rhh.handler.DispatchEvent(req.Context(), event)
-
-	atomic.AddUint64(&rhh.eventsProcessed, 1)
-	atomic.AddUint64(&rhh.requestSuccess, 1)
-	w.WriteHeader(http.StatusAccepted)
+	return event
 }
 
-func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
+// translateFromProtobufV2 converts a RawMessageV2 to a MetricMap.  Metrics without a hostname are given
+// defaultSource, and re-keyed if it is not gostatsd.UnknownSource.
+func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2, defaultSource gostatsd.Source) *gostatsd.MetricMap {
 	now := gostatsd.Nanotime(time.Now().UnixNano())
 	mm := gostatsd.NewMetricMap()
 
+	// source returns the source and tagsKey to use for a metric
+	source := func(hostname string, tagsKey string, tags gostatsd.Tags) (gostatsd.Source, string) {
+		if hostname != "" || defaultSource == gostatsd.UnknownSource {
+			return gostatsd.Source(hostname), tagsKey
+		}
+		return defaultSource, gostatsd.FormatTagsKey(defaultSource, tags)
+	}
+
 	for metricName, tagMap := range pbMetricMap.Gauges {
 		mm.Gauges[metricName] = map[string]gostatsd.Gauge{}
 		for tagsKey, gauge := range tagMap.TagMap {
-			mm.Gauges[metricName][tagsKey] = gostatsd.Gauge{
+			src, key := source(gauge.Hostname, tagsKey, gauge.Tags)
+			mm.Gauges[metricName][key] = gostatsd.Gauge{
 				Value:     gauge.Value,
 				Timestamp: now,
-				Source:    gostatsd.Source(gauge.Hostname),
+				Source:    src,
 				Tags:      gauge.Tags,
 			}
 		}
@@ -202,11 +334,12 @@ func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
 	for metricName, tagMap := range pbMetricMap.Counters {
 		mm.Counters[metricName] = map[string]gostatsd.Counter{}
 		for tagsKey, counter := range tagMap.TagMap {
-			mm.Counters[metricName][tagsKey] = gostatsd.Counter{
+			src, key := source(counter.Hostname, tagsKey, counter.Tags)
+			mm.Counters[metricName][key] = gostatsd.Counter{
 				Value:     counter.Value,
 				Timestamp: now,
 				Tags:      counter.Tags,
-				Source:    gostatsd.Source(counter.Hostname),
+				Source:    src,
 			}
 		}
 	}
@@ -214,11 +347,12 @@ func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
 	for metricName, tagMap := range pbMetricMap.Timers {
 		mm.Timers[metricName] = map[string]gostatsd.Timer{}
 		for tagsKey, timer := range tagMap.TagMap {
-			mm.Timers[metricName][tagsKey] = gostatsd.Timer{
+			src, key := source(timer.Hostname, tagsKey, timer.Tags)
+			mm.Timers[metricName][key] = gostatsd.Timer{
 				Values:       timer.Values,
 				Timestamp:    now,
 				Tags:         timer.Tags,
-				Source:       gostatsd.Source(timer.Hostname),
+				Source:       src,
 				SampledCount: timer.SampleCount,
 			}
 		}
@@ -227,14 +361,15 @@ func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
 	for metricName, tagMap := range pbMetricMap.Sets {
 		mm.Sets[metricName] = map[string]gostatsd.Set{}
 		for tagsKey, set := range tagMap.TagMap {
-			mm.Sets[metricName][tagsKey] = gostatsd.Set{
+			src, key := source(set.Hostname, tagsKey, set.Tags)
+			mm.Sets[metricName][key] = gostatsd.Set{
 				Values:    map[string]struct{}{},
 				Timestamp: now,
 				Tags:      set.Tags,
-				Source:    gostatsd.Source(set.Hostname),
+				Source:    src,
 			}
 			for _, value := range set.Values {
-				mm.Sets[metricName][tagsKey].Values[value] = struct{}{}
+				mm.Sets[metricName][key].Values[value] = struct{}{}
 			}
 		}
 	}
@@ -1,19 +1,24 @@
 package web_test
 
 import (
+	"bytes"
+	"net/http"
 	"net/http/httptest"
 	"sort"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/ash2k/stager/wait"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tilinna/clock"
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/internal/fixtures"
+	"github.com/hligit/gostatsd/pb"
 	"github.com/hligit/gostatsd/pkg/statsd"
 	"github.com/hligit/gostatsd/pkg/transport"
 	"github.com/hligit/gostatsd/pkg/web"
@@ -22,6 +27,16 @@ import (
 func TestForwardingEndToEndV2(t *testing.T) {
 	t.Parallel()
 
+	for _, compression := range []string{"identity", "deflate", "gzip", "zstd"} {
+		compression := compression
+		t.Run(compression, func(t *testing.T) {
+			t.Parallel()
+			testForwardingEndToEndV2(t, compression)
+		})
+	}
+}
+
+func testForwardingEndToEndV2(t *testing.T, compression string) {
 	ctxTest, testDone := testContext(t)
 	mockClock := clock.NewMock(time.Unix(0, 0))
 	ctxTest = clock.Context(ctxTest, mockClock)
@@ -37,6 +52,18 @@ func TestForwardingEndToEndV2(t *testing.T) {
 		false,
 		true,
 		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
 	)
 	require.NoError(t, err)
 
@@ -47,14 +74,21 @@ func TestForwardingEndToEndV2(t *testing.T) {
 	hfh, err := statsd.NewHttpForwarderHandlerV2(
 		logrus.StandardLogger(),
 		"default",
-		c.URL,
+		"http",
+		0,
+		[]string{c.URL},
 		5, // deliberately prime, so the loop below doesn't send the same thing to the same MetricMap every time.
 		10,
-		false,
+		compression,
+		0,
 		10*time.Second,
 		10*time.Millisecond,
 		nil,
 		nil,
+		statsd.GrpcOptions{},
+		statsd.SpoolOptions{},
+		statsd.QueueOptions{},
+		statsd.EventOptions{},
 		p,
 	)
 	require.NoError(t, err)
@@ -160,3 +194,210 @@ func TestForwardingEndToEndV2(t *testing.T) {
 	require.EqualValues(t, expected, actual)
 	testDone()
 }
+
+func TestProtocolVersionNegotiation(t *testing.T) {
+	t.Parallel()
+
+	ch := &capturingHandler{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestProtocolVersionNegotiation",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		version string
+		status  int
+	}{
+		{version: "", status: http.StatusAccepted},
+		{version: "2", status: http.StatusAccepted},
+		{version: "3", status: http.StatusAccepted},
+		{version: "99", status: http.StatusUnsupportedMediaType},
+		{version: "two", status: http.StatusUnsupportedMediaType},
+	} {
+		for _, endpoint := range []string{"/v2/raw", "/v2/event"} {
+			req := httptest.NewRequest("POST", endpoint, bytes.NewReader(nil))
+			if tc.version != "" {
+				req.Header.Set(pb.ProtocolVersionHeader, tc.version)
+			}
+			rec := httptest.NewRecorder()
+			hs.Router.ServeHTTP(rec, req)
+			require.Equal(t, tc.status, rec.Code, "version %q to %s", tc.version, endpoint)
+			require.Equal(t, pb.FormatProtocolVersions(pb.ProtocolVersions), rec.Header().Get(pb.ProtocolVersionsHeader))
+		}
+	}
+	require.Len(t, ch.MetricMaps(), 3)
+}
+
+func TestClusterForwardedMetrics(t *testing.T) {
+	t.Parallel()
+
+	ch := &capturingHandler{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestClusterForwardedMetrics",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+
+	post := func(forwarded bool) {
+		req := httptest.NewRequest("POST", "/v2/raw", bytes.NewReader(nil))
+		if forwarded {
+			req.Header.Set(web.ClusterForwardedHeader, "true")
+		}
+		rec := httptest.NewRecorder()
+		hs.Router.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+	}
+
+	// The header is ignored unless the server is in a cluster
+	post(true)
+	require.Len(t, ch.MetricMaps(), 1)
+
+	cluster := &capturingHandler{}
+	hs.SetClusterHandler(cluster)
+	post(true)
+	post(false)
+	require.Len(t, cluster.MetricMaps(), 1)
+	require.Len(t, ch.MetricMaps(), 2)
+}
+
+func TestEventBatch(t *testing.T) {
+	t.Parallel()
+
+	ch := &capturingHandler{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestEventBatch",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+
+	body, err := pb.MarshalEventBatch([]*pb.EventV2{
+		{Title: "deploy", Hostname: "host1"},
+		{Title: "rollback", Type: pb.EventV2_Error},
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/v2/event", bytes.NewReader(body))
+	req.Header.Set(pb.ProtocolVersionHeader, strconv.Itoa(pb.ProtocolVersion3))
+	rec := httptest.NewRecorder()
+	hs.Router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	require.Len(t, ch.e, 2)
+	assert.Equal(t, "deploy", ch.e[0].Title)
+	assert.Equal(t, gostatsd.Source("host1"), ch.e[0].Source)
+	assert.Equal(t, "rollback", ch.e[1].Title)
+	assert.Equal(t, gostatsd.AlertError, ch.e[1].AlertType)
+}
+
+// overloadChecker is overloaded while reason is set.
+type overloadChecker struct {
+	reason string
+}
+
+func (oc *overloadChecker) Overloaded() string {
+	return oc.reason
+}
+
+func TestOverloadedRejectsIngestion(t *testing.T) {
+	t.Parallel()
+
+	ch := &capturingHandler{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestOverloadedRejectsIngestion",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+	oc := &overloadChecker{reason: "memory"}
+	hs.SetOverloadChecker(oc)
+
+	for _, endpoint := range []string{"/v2/raw", "/v2/event", "/json/metrics", "/json/events"} {
+		req := httptest.NewRequest("POST", endpoint, bytes.NewReader([]byte("{}")))
+		rec := httptest.NewRecorder()
+		hs.Router.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code, endpoint)
+		require.Equal(t, "5", rec.Header().Get("Retry-After"), endpoint)
+	}
+	require.Empty(t, ch.MetricMaps())
+
+	// Once the server has recovered, requests are accepted again
+	oc.reason = ""
+	req := httptest.NewRequest("POST", "/v2/raw", bytes.NewReader(nil))
+	rec := httptest.NewRecorder()
+	hs.Router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Len(t, ch.MetricMaps(), 1)
+}
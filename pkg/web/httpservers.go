@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
 	"expvar"
 	"fmt"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"google.golang.org/grpc"
 
 	"github.com/hligit/gostatsd"
 	"github.com/hligit/gostatsd/internal/util"
@@ -21,8 +23,11 @@ import (
 type httpServer struct {
 	logger       logrus.FieldLogger
 	address      string
+	tlsConfig    *tls.Config
 	Router       *mux.Router // should be private, but project layout is not great.
 	rawMetricsV2 *rawHttpHandlerV2
+	grpcAddress  string
+	grpcServer   *grpc.Server // nil unless grpc ingestion is enabled
 }
 
 type route struct {
@@ -34,11 +39,24 @@ type route struct {
 
 var done = struct{}{}
 
-func NewHttpServersFromViper(v *viper.Viper, logger logrus.FieldLogger, handler gostatsd.PipelineHandler) ([]*httpServer, error) {
+// NewHttpServersFromViper creates every http server in http-servers.  The internal metrics are served by
+// metricsHandler on servers with enable-prometheus, and readiness is reported from the readiness checkers.
+func NewHttpServersFromViper(
+	v *viper.Viper,
+	logger logrus.FieldLogger,
+	handler gostatsd.PipelineHandler,
+	metricsHandler http.Handler,
+	readiness []gostatsd.ReadinessChecker,
+	inspector AggregatorInspector,
+	flusher FlushController,
+	reloader Reloader,
+	tap MetricTap,
+	logLevels LogLevelController,
+) ([]*httpServer, error) {
 	httpServerNames := v.GetStringSlice("http-servers")
 	servers := make([]*httpServer, 0, len(httpServerNames))
 	for _, httpServerName := range httpServerNames {
-		server, err := newHttpServerFromViper(logger, v, httpServerName, handler)
+		server, err := newHttpServerFromViper(logger, v, httpServerName, handler, metricsHandler, readiness, inspector, flusher, reloader, tap, logLevels)
 		if err != nil {
 			return nil, fmt.Errorf("failed to make http-server %s: %v", httpServerName, err)
 		}
@@ -52,6 +70,13 @@ func newHttpServerFromViper(
 	vMain *viper.Viper,
 	serverName string,
 	handler gostatsd.PipelineHandler,
+	metricsHandler http.Handler,
+	readiness []gostatsd.ReadinessChecker,
+	inspector AggregatorInspector,
+	flusher FlushController,
+	reloader Reloader,
+	tap MetricTap,
+	logLevels LogLevelController,
 ) (*httpServer, error) {
 	vSub := util.GetSubViper(vMain, "http."+serverName)
 	vSub.SetDefault("address", "127.0.0.1:8080")
@@ -59,8 +84,53 @@ func newHttpServerFromViper(
 	vSub.SetDefault("enable-expvar", false)
 	vSub.SetDefault("enable-ingestion", false)
 	vSub.SetDefault("enable-healthcheck", true)
+	vSub.SetDefault("enable-prometheus", false)
+	vSub.SetDefault("enable-admin", false)
+	vSub.SetDefault("debug-username", "")
+	vSub.SetDefault("debug-password", "")
+	vSub.SetDefault("source-from-request", false)
+	vSub.SetDefault("source-header", "")
+	vSub.SetDefault("trusted-proxies", []string{})
+	vSub.SetDefault("tenant-header", "")
+	vSub.SetDefault("tenant-from-client-cert", false)
+	vSub.SetDefault("tenant-tag", defaultTenantTag)
+	vSub.SetDefault("rate-limit-by", RateLimitByIP)
+	vSub.SetDefault("rate-limit-token-header", defaultRateLimitTokenHeader)
+	vSub.SetDefault("rate-limit-requests", 0)
+	vSub.SetDefault("rate-limit-requests-burst", 0)
+	vSub.SetDefault("rate-limit-datapoints", 0)
+	vSub.SetDefault("rate-limit-datapoints-burst", 0)
+	vSub.SetDefault("rate-limit-max-clients", defaultRateLimitMaxClients)
+	vSub.SetDefault("tls-cert-path", "")
+	vSub.SetDefault("tls-key-path", "")
+	vSub.SetDefault("tls-client-ca-path", "")
+	vSub.SetDefault("tls-client-cert-optional", false)
+	vSub.SetDefault("grpc-address", "")
+	vSub.SetDefault("overload-retry-after", defaultOverloadRetryAfter)
+
+	sourceOpts, err := sourceOptionsFromViper(vSub)
+	if err != nil {
+		return nil, err
+	}
+	tenantOpts, err := tenantOptionsFromViper(vSub, sourceOpts.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	if !vSub.GetBool("enable-prometheus") {
+		metricsHandler = nil
+	}
+	if !vSub.GetBool("enable-admin") {
+		inspector = nil
+		flusher = nil
+		reloader = nil
+		tap = nil
+		logLevels = nil
+	} else if inspector == nil {
+		return nil, fmt.Errorf("admin endpoints are only available in standalone mode")
+	}
 
-	return NewHttpServer(
+	server, err := NewHttpServer(
 		logger.WithField("http-server", serverName),
 		handler,
 		serverName,
@@ -69,7 +139,42 @@ func newHttpServerFromViper(
 		vSub.GetBool("enable-expvar"),
 		vSub.GetBool("enable-ingestion"),
 		vSub.GetBool("enable-healthcheck"),
+		sourceOpts,
+		tenantOpts,
+		rateLimitOptionsFromViper(vSub),
+		tlsOptionsFromViper(vSub),
+		metricsHandler,
+		readiness,
+		BasicAuth{
+			Username: vSub.GetString("debug-username"),
+			Password: vSub.GetString("debug-password"),
+		},
+		inspector,
+		flusher,
+		reloader,
+		tap,
+		logLevels,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if server.rawMetricsV2 != nil {
+		server.rawMetricsV2.namespace = vMain.GetString(gostatsd.ParamNamespace)
+		retryAfter := vSub.GetDuration("overload-retry-after")
+		if retryAfter <= 0 {
+			return nil, fmt.Errorf("overload-retry-after must be positive")
+		}
+		server.rawMetricsV2.overloadRetryAfter = retryAfter
+	}
+
+	if grpcAddress := vSub.GetString("grpc-address"); grpcAddress != "" {
+		if server.rawMetricsV2 == nil {
+			return nil, fmt.Errorf("grpc-address requires enable-ingestion")
+		}
+		server.enableGrpc(grpcAddress)
+	}
+	return server, nil
 }
 
 func NewHttpServer(
@@ -80,48 +185,128 @@ func NewHttpServer(
 	enableExpVar,
 	enableIngestion,
 	enableHealthcheck bool,
+	sourceOpts SourceOptions,
+	tenantOpts TenantOptions,
+	rateLimitOpts RateLimitOptions,
+	tlsOpts TLSOptions,
+	metricsHandler http.Handler,
+	readiness []gostatsd.ReadinessChecker,
+	debugAuth BasicAuth,
+	inspector AggregatorInspector,
+	flusher FlushController,
+	reloader Reloader,
+	tap MetricTap,
+	logLevels LogLevelController,
 ) (*httpServer, error) {
 	var routes []route
 
+	tlsConfig, err := tlsOpts.config()
+	if err != nil {
+		return nil, err
+	}
+
 	server := &httpServer{
-		logger:  logger,
-		address: address,
+		logger:    logger,
+		address:   address,
+		tlsConfig: tlsConfig,
 	}
 
 	if enableProf {
 		routes = append(routes,
-			route{path: "/debug/pprof/cmdline", handler: pprof.Cmdline, methods: []string{"GET"}, name: "pprof_cmdline"},
-			route{path: "/debug/pprof/profile", handler: pprof.Profile, methods: []string{"GET"}, name: "pprof_profile"},
-			route{path: "/debug/pprof/symbol", handler: pprof.Symbol, methods: []string{"GET"}, name: "pprof_symbol"},
-			route{path: "/debug/pprof/trace", handler: pprof.Trace, methods: []string{"GET", "POST"}, name: "pprof_trace"},
-			route{path: "/debug/pprof/{any:.*}", handler: pprof.Index, methods: []string{"GET"}, name: "pprof_index"},
+			route{path: "/debug/pprof/cmdline", handler: debugAuth.wrap(pprof.Cmdline), methods: []string{"GET"}, name: "pprof_cmdline"},
+			route{path: "/debug/pprof/profile", handler: debugAuth.wrap(pprof.Profile), methods: []string{"GET"}, name: "pprof_profile"},
+			route{path: "/debug/pprof/symbol", handler: debugAuth.wrap(pprof.Symbol), methods: []string{"GET"}, name: "pprof_symbol"},
+			route{path: "/debug/pprof/trace", handler: debugAuth.wrap(pprof.Trace), methods: []string{"GET", "POST"}, name: "pprof_trace"},
+			route{path: "/debug/pprof/{any:.*}", handler: debugAuth.wrap(pprof.Index), methods: []string{"GET"}, name: "pprof_index"},
+			route{path: "/debug/gcstats", handler: debugAuth.wrap(gcStats), methods: []string{"GET"}, name: "gcstats_get"},
 		)
 	}
 
 	if enableExpVar {
 		routes = append(routes,
-			route{path: "/expvar", handler: expvar.Handler().ServeHTTP, methods: []string{"GET"}, name: "expvar_get"},
+			route{path: "/expvar", handler: debugAuth.wrap(expvar.Handler().ServeHTTP), methods: []string{"GET"}, name: "expvar_get"},
 		)
 	}
 
 	if enableIngestion {
-		server.rawMetricsV2 = newRawHttpHandlerV2(logger, serverName, handler)
+		limiter, err := newRateLimiter(rateLimitOpts)
+		if err != nil {
+			return nil, err
+		}
+		server.rawMetricsV2 = newRawHttpHandlerV2(logger, serverName, handler, sourceOpts, tenantOpts, limiter)
 		routes = append(routes,
 			route{path: "/v2/raw", handler: server.rawMetricsV2.MetricHandler, methods: []string{"POST"}, name: "metricsv2_post"},
 			route{path: "/v2/event", handler: server.rawMetricsV2.EventHandler, methods: []string{"POST"}, name: "eventsv2_post"},
+			route{path: "/json/metrics", handler: server.rawMetricsV2.JSONMetricHandler, methods: []string{"POST"}, name: "json_metrics_post"},
+			route{path: "/json/events", handler: server.rawMetricsV2.JSONEventHandler, methods: []string{"POST"}, name: "json_events_post"},
 		)
 	}
 
 	if enableHealthcheck {
-		hc := &healthChecker{logger}
+		hc := &healthChecker{logger: logger, readiness: readiness}
 		routes = append(routes,
 			route{path: "/healthcheck", handler: hc.healthCheck, methods: []string{"GET"}, name: "healthcheck_get"},
 			route{path: "/deepcheck", handler: hc.deepCheck, methods: []string{"GET"}, name: "deepcheck_get"},
+			route{path: "/healthz", handler: hc.healthz, methods: []string{"GET"}, name: "healthz_get"},
+			route{path: "/readyz", handler: hc.readyz, methods: []string{"GET"}, name: "readyz_get"},
+		)
+	}
+
+	enableAdmin := inspector != nil || flusher != nil || reloader != nil || tap != nil || logLevels != nil
+	if enableAdmin {
+		if debugAuth.Username == "" {
+			return nil, fmt.Errorf("admin endpoints require debug-username")
+		}
+		ah := &adminHandler{logger: logger, inspector: inspector, flusher: flusher, reloader: reloader, tap: tap, logLevels: logLevels}
+		if inspector != nil {
+			routes = append(routes,
+				route{path: "/admin/aggregators", handler: debugAuth.wrap(ah.aggregators), methods: []string{"GET"}, name: "admin_aggregators_get"},
+			)
+		}
+		if flusher != nil {
+			routes = append(routes,
+				route{path: "/admin/flush", handler: debugAuth.wrap(ah.flushState), methods: []string{"GET"}, name: "admin_flush_get"},
+				route{path: "/admin/flush", handler: debugAuth.wrap(ah.flush), methods: []string{"POST"}, name: "admin_flush_post"},
+				route{path: "/admin/flush/resume", handler: debugAuth.wrap(ah.resume), methods: []string{"POST"}, name: "admin_flush_resume_post"},
+			)
+			if _, ok := flusher.(Drainer); ok {
+				routes = append(routes,
+					route{path: "/admin/drain", handler: debugAuth.wrap(ah.drain), methods: []string{"POST"}, name: "admin_drain_post"},
+				)
+			}
+		}
+		if reloader != nil {
+			routes = append(routes,
+				route{path: "/admin/reload", handler: debugAuth.wrap(ah.reload), methods: []string{"POST"}, name: "admin_reload_post"},
+			)
+			if _, ok := reloader.(ConfigInspector); ok {
+				routes = append(routes,
+					route{path: "/admin/config", handler: debugAuth.wrap(ah.config), methods: []string{"GET"}, name: "admin_config_get"},
+				)
+			}
+		}
+		if tap != nil {
+			routes = append(routes,
+				route{path: "/admin/tap", handler: debugAuth.wrap(ah.tapMetrics), methods: []string{"GET"}, name: "admin_tap_get"},
+			)
+		}
+		if logLevels != nil {
+			routes = append(routes,
+				route{path: "/admin/loglevel", handler: debugAuth.wrap(ah.logLevelState), methods: []string{"GET"}, name: "admin_loglevel_get"},
+				route{path: "/admin/loglevel", handler: debugAuth.wrap(ah.setLogLevel), methods: []string{"POST"}, name: "admin_loglevel_post"},
+				route{path: "/admin/loglevel/reset", handler: debugAuth.wrap(ah.resetLogLevel), methods: []string{"POST"}, name: "admin_loglevel_reset_post"},
+			)
+		}
+	}
+
+	if metricsHandler != nil {
+		routes = append(routes,
+			route{path: "/metrics", handler: metricsHandler.ServeHTTP, methods: []string{"GET"}, name: "metrics_get"},
 		)
 	}
 
 	if len(routes) == 0 {
-		return nil, fmt.Errorf("must enable at least one of prof, expvar, ingestion, or healthcheck")
+		return nil, fmt.Errorf("must enable at least one of prof, expvar, ingestion, healthcheck, prometheus, or admin")
 	}
 
 	router, err := createRoutes(routes)
@@ -134,10 +319,14 @@ func NewHttpServer(
 
 	logger.WithFields(logrus.Fields{
 		"address":            address,
+		"tls":                tlsConfig != nil,
+		"mtls":               tlsConfig != nil && tlsConfig.ClientCAs != nil,
 		"enable-pprof":       enableProf,
 		"enable-expvar":      enableExpVar,
 		"enable-ingestion":   enableIngestion,
 		"enable-healthcheck": enableHealthcheck,
+		"enable-prometheus":  metricsHandler != nil,
+		"enable-admin":       enableAdmin,
 	}).Info("Created server")
 
 	return server, nil
@@ -195,11 +384,15 @@ func (hs *httpServer) Run(ctx context.Context) {
 		var wg wait.Group
 		defer wg.Wait()
 		wg.StartWithContext(ctx, hs.rawMetricsV2.RunMetricsContext)
+		if hs.grpcServer != nil {
+			wg.StartWithContext(ctx, hs.runGrpc)
+		}
 	}
 
 	server := &http.Server{
-		Addr:    hs.address,
-		Handler: hs.Router,
+		Addr:      hs.address,
+		Handler:   hs.Router,
+		TLSConfig: hs.tlsConfig,
 	}
 
 	chStopped := make(chan struct{}, 1)
@@ -207,7 +400,13 @@ func (hs *httpServer) Run(ctx context.Context) {
 
 	hs.logger.WithField("address", server.Addr).Info("listening")
 
-	err := server.ListenAndServe()
+	var err error
+	if hs.tlsConfig != nil {
+		// The certificate is already in the TLSConfig
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != http.ErrServerClosed {
 		hs.logger.WithError(err).Error("web server failed")
 		return
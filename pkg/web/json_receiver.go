@@ -0,0 +1,278 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hligit/gostatsd"
+)
+
+// jsonMetrics is the body of a request to /json/metrics.
+type jsonMetrics struct {
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric is a single metric, with the same meaning as a statsd line.
+type jsonMetric struct {
+	Name string `json:"name"`
+	// Type is one of counter, gauge, timer, or set.
+	Type string `json:"type"`
+	// Value is a number, or for a set, the string or number to add to it.
+	Value json.RawMessage `json:"value"`
+	// Rate is the sample rate, defaults to 1.
+	Rate   float64  `json:"rate"`
+	Tags   []string `json:"tags"`
+	Source string   `json:"source"`
+}
+
+var jsonMetricTypes = map[string]gostatsd.MetricType{
+	"counter": gostatsd.COUNTER,
+	"gauge":   gostatsd.GAUGE,
+	"timer":   gostatsd.TIMER,
+	"set":     gostatsd.SET,
+}
+
+// jsonEvents is the body of a request to /json/events.
+type jsonEvents struct {
+	Events []jsonEvent `json:"events"`
+}
+
+// jsonEvent is a single event, with the same meaning as a statsd _e line.
+type jsonEvent struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	// DateHappened is a unix timestamp in seconds, defaults to now.
+	DateHappened   int64    `json:"date_happened"`
+	AggregationKey string   `json:"aggregation_key"`
+	SourceTypeName string   `json:"source_type_name"`
+	Tags           []string `json:"tags"`
+	Source         string   `json:"source"`
+	// Priority is one of normal or low, defaults to normal.
+	Priority string `json:"priority"`
+	// AlertType is one of info, warning, error, or success, defaults to info.
+	AlertType string `json:"alert_type"`
+}
+
+var jsonEventPriorities = map[string]gostatsd.Priority{
+	"":       gostatsd.PriNormal,
+	"normal": gostatsd.PriNormal,
+	"low":    gostatsd.PriLow,
+}
+
+var jsonEventAlertTypes = map[string]gostatsd.AlertType{
+	"":        gostatsd.AlertInfo,
+	"info":    gostatsd.AlertInfo,
+	"warning": gostatsd.AlertWarning,
+	"error":   gostatsd.AlertError,
+	"success": gostatsd.AlertSuccess,
+}
+
+// JSONMetricHandler accepts metrics as json, for producers which can't send statsd or protobuf.  The request is
+// rejected if any metric is invalid.
+func (rhh *rawHttpHandlerV2) JSONMetricHandler(w http.ResponseWriter, req *http.Request) {
+	if !rhh.allowLoad(w, req) {
+		return
+	}
+	client, ok := rhh.allowRequest(w, req)
+	if !ok {
+		return
+	}
+
+	b, errCode := rhh.readBody(w, req)
+
+	if errCode != 0 {
+		w.WriteHeader(errCode)
+		return
+	}
+
+	var msg jsonMetrics
+	err := json.Unmarshal(b, &msg)
+	if err != nil {
+		atomic.AddUint64(&rhh.requestFailureUnmarshal, 1)
+		rhh.logger.WithError(err).Info("failed to unmarshal json")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defaultSource := rhh.sourceOpts.requestSource(req)
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	metrics := make([]*gostatsd.Metric, 0, len(msg.Metrics))
+	for i := range msg.Metrics {
+		m, err := translateFromJSON(&msg.Metrics[i], defaultSource, now)
+		if err != nil {
+			atomic.AddUint64(&rhh.requestFailureInvalid, 1)
+			rhh.logger.WithError(err).Info("invalid json metric")
+			http.Error(w, fmt.Sprintf("metrics[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if rhh.namespace != "" {
+			m.Name = rhh.namespace + "." + m.Name
+		}
+		metrics = append(metrics, m)
+	}
+
+	if !rhh.allowDatapoints(w, client, len(metrics)) {
+		return
+	}
+
+	mm := gostatsd.NewMetricMap()
+	for _, m := range metrics {
+		mm.Receive(m)
+	}
+	rhh.tenantOpts.tagMetricMap(mm, rhh.tenantOpts.requestTenant(req))
+	rhh.handler.DispatchMetricMap(req.Context(), mm)
+
+	atomic.AddUint64(&rhh.metricsProcessed, uint64(len(metrics)))
+	atomic.AddUint64(&rhh.requestSuccess, 1)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// translateFromJSON converts a jsonMetric to a Metric.  Metrics without a source are given defaultSource.
+func translateFromJSON(jm *jsonMetric, defaultSource gostatsd.Source, now gostatsd.Nanotime) (*gostatsd.Metric, error) {
+	if jm.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	metricType, ok := jsonMetricTypes[jm.Type]
+	if !ok {
+		return nil, fmt.Errorf("type must be one of counter, gauge, timer, or set")
+	}
+	if len(jm.Value) == 0 {
+		return nil, fmt.Errorf("value is required")
+	}
+	rate := jm.Rate
+	if rate == 0 {
+		rate = 1
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("rate must be greater than 0, and at most 1")
+	}
+
+	m := &gostatsd.Metric{
+		Name:      jm.Name,
+		Rate:      rate,
+		Tags:      jm.Tags,
+		Source:    gostatsd.Source(jm.Source),
+		Timestamp: now,
+		Type:      metricType,
+	}
+	if m.Source == gostatsd.UnknownSource {
+		m.Source = defaultSource
+	}
+
+	raw := string(bytes.TrimSpace(jm.Value))
+	if metricType == gostatsd.SET {
+		if err := json.Unmarshal(jm.Value, &m.StringValue); err == nil {
+			return m, nil
+		}
+		// Numbers are added to the set as they are written
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return nil, fmt.Errorf("value must be a string or number")
+		}
+		m.StringValue = raw
+		return m, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+		return nil, fmt.Errorf("value must be a number")
+	}
+	m.Value = value
+	return m, nil
+}
+
+// JSONEventHandler accepts events as json, for producers such as CI systems which can't send statsd.  The request is
+// rejected if any event is invalid.
+func (rhh *rawHttpHandlerV2) JSONEventHandler(w http.ResponseWriter, req *http.Request) {
+	if !rhh.allowLoad(w, req) {
+		return
+	}
+	client, ok := rhh.allowRequest(w, req)
+	if !ok {
+		return
+	}
+
+	b, errCode := rhh.readBody(w, req)
+
+	if errCode != 0 {
+		w.WriteHeader(errCode)
+		return
+	}
+
+	var msg jsonEvents
+	err := json.Unmarshal(b, &msg)
+	if err != nil {
+		atomic.AddUint64(&rhh.requestFailureUnmarshal, 1)
+		rhh.logger.WithError(err).Info("failed to unmarshal json")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defaultSource := rhh.sourceOpts.requestSource(req)
+	now := time.Now().Unix()
+	events := make([]*gostatsd.Event, 0, len(msg.Events))
+	for i := range msg.Events {
+		e, err := translateEventFromJSON(&msg.Events[i], defaultSource, now)
+		if err != nil {
+			atomic.AddUint64(&rhh.requestFailureInvalid, 1)
+			rhh.logger.WithError(err).Info("invalid json event")
+			http.Error(w, fmt.Sprintf("events[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		events = append(events, e)
+	}
+
+	if !rhh.allowDatapoints(w, client, len(events)) {
+		return
+	}
+
+	tenant := rhh.tenantOpts.requestTenant(req)
+	for _, e := range events {
+		rhh.tenantOpts.tagEvent(e, tenant)
+		rhh.handler.DispatchEvent(req.Context(), e)
+	}
+
+	atomic.AddUint64(&rhh.eventsProcessed, uint64(len(events)))
+	atomic.AddUint64(&rhh.requestSuccess, 1)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// translateEventFromJSON converts a jsonEvent to an Event.  Events without a source are given defaultSource, and
+// events without a date are given now.
+func translateEventFromJSON(je *jsonEvent, defaultSource gostatsd.Source, now int64) (*gostatsd.Event, error) {
+	if je.Title == "" {
+		return nil, fmt.Errorf("title is required")
+	}
+	priority, ok := jsonEventPriorities[je.Priority]
+	if !ok {
+		return nil, fmt.Errorf("priority must be one of normal, or low")
+	}
+	alertType, ok := jsonEventAlertTypes[je.AlertType]
+	if !ok {
+		return nil, fmt.Errorf("alert_type must be one of info, warning, error, or success")
+	}
+
+	e := &gostatsd.Event{
+		Title:          je.Title,
+		Text:           je.Text,
+		DateHappened:   je.DateHappened,
+		AggregationKey: je.AggregationKey,
+		SourceTypeName: je.SourceTypeName,
+		Tags:           je.Tags,
+		Source:         gostatsd.Source(je.Source),
+		Priority:       priority,
+		AlertType:      alertType,
+	}
+	if e.Source == gostatsd.UnknownSource {
+		e.Source = defaultSource
+	}
+	if e.DateHappened == 0 {
+		e.DateHappened = now
+	}
+	return e, nil
+}
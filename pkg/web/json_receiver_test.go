@@ -0,0 +1,296 @@
+package web_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/web"
+)
+
+func newJSONTestServer(t *testing.T, ch *capturingHandler) *httptest.Server {
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestJSONMetricHandler",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.SourceOptions{FromRequest: true},
+		web.TenantOptions{Header: "X-Tenant", TrustedProxies: []*net.IPNet{loopback}},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+	return httptest.NewServer(hs.Router)
+}
+
+func TestJSONMetricHandler(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	s := newJSONTestServer(t, ch)
+	defer s.Close()
+
+	body := `{"metrics": [
+		{"name": "c", "type": "counter", "value": 1, "rate": 0.5, "tags": ["a:b"]},
+		{"name": "g", "type": "gauge", "value": 2.5, "source": "host1"},
+		{"name": "t", "type": "timer", "value": 10},
+		{"name": "s", "type": "set", "value": "x"},
+		{"name": "s", "type": "set", "value": 42}
+	]}`
+	resp, err := http.Post(s.URL+"/json/metrics", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	mms := ch.MetricMaps()
+	require.Len(t, mms, 1)
+	mm := mms[0]
+
+	var counter gostatsd.Counter
+	mm.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		counter = c
+	})
+	assert.EqualValues(t, 2, counter.Value)
+	assert.Equal(t, gostatsd.Tags{"a:b"}, counter.Tags)
+	assert.Equal(t, gostatsd.Source("127.0.0.1"), counter.Source)
+
+	var gauge gostatsd.Gauge
+	mm.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+		gauge = g
+	})
+	assert.Equal(t, 2.5, gauge.Value)
+	assert.Equal(t, gostatsd.Source("host1"), gauge.Source)
+
+	var timer gostatsd.Timer
+	mm.Timers.Each(func(name, tagsKey string, tm gostatsd.Timer) {
+		timer = tm
+	})
+	assert.Equal(t, []float64{10}, timer.Values)
+
+	var set gostatsd.Set
+	mm.Sets.Each(func(name, tagsKey string, st gostatsd.Set) {
+		set = st
+	})
+	assert.Equal(t, map[string]struct{}{"x": {}, "42": {}}, set.Values)
+}
+
+func TestJSONHandlerTenant(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	s := newJSONTestServer(t, ch)
+	defer s.Close()
+
+	post := func(path, tenant, body string) {
+		req, err := http.NewRequest("POST", s.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	post("/json/metrics", "team-a", `{"metrics": [{"name": "c", "type": "counter", "value": 1, "tags": ["a:b", "tenant:team-b"]}]}`)
+	post("/json/events", "team-a", `{"events": [{"title": "deploy", "tags": ["a:b"]}]}`)
+	// Without a tenant, the tenant set by the client is removed
+	post("/json/metrics", "", `{"metrics": [{"name": "c", "type": "counter", "value": 1, "tags": ["a:b", "tenant:team-b"]}]}`)
+	post("/json/events", "", `{"events": [{"title": "deploy", "tags": ["a:b", "tenant:team-b"]}]}`)
+
+	mms := ch.MetricMaps()
+	require.Len(t, mms, 2)
+	mms[0].Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		assert.Equal(t, gostatsd.Tags{"a:b", "tenant:team-a"}, c.Tags)
+	})
+	mms[1].Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		assert.Equal(t, gostatsd.Tags{"a:b"}, c.Tags)
+	})
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	require.Len(t, ch.e, 2)
+	assert.Equal(t, gostatsd.Tags{"a:b", "tenant:team-a"}, ch.e[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"a:b"}, ch.e[1].Tags)
+}
+
+func TestJSONHandlerRateLimit(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestJSONHandlerRateLimit",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{Requests: 0.1, RequestsBurst: 2, Datapoints: 100, DatapointsBurst: 2},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+	s := httptest.NewServer(hs.Router)
+	defer s.Close()
+
+	post := func(body string) *http.Response {
+		resp, err := http.Post(s.URL+"/json/metrics", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp := post(`{"metrics": [{"name": "a", "type": "counter", "value": 1}, {"name": "b", "type": "counter", "value": 1}, {"name": "c", "type": "counter", "value": 1}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = post(`{"metrics": [{"name": "a", "type": "counter", "value": 1}]}`)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp = post(`{"metrics": [{"name": "a", "type": "counter", "value": 1}]}`)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "10", resp.Header.Get("Retry-After"))
+
+	assert.Len(t, ch.MetricMaps(), 1)
+}
+
+func TestJSONMetricHandlerNamespace(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set(gostatsd.ParamNamespace, "ns")
+	v.Set("http-servers", []string{"ingest"})
+	v.Set("http.ingest.enable-ingestion", true)
+
+	ch := &capturingHandler{}
+	servers, err := web.NewHttpServersFromViper(v, logrus.StandardLogger(), ch, nil, nil, nil, nil, nil, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, servers, 1)
+	s := httptest.NewServer(servers[0].Router)
+	defer s.Close()
+
+	body := `{"metrics": [{"name": "c", "type": "counter", "value": 1}]}`
+	resp, err := http.Post(s.URL+"/json/metrics", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	mms := ch.MetricMaps()
+	require.Len(t, mms, 1)
+	var names []string
+	mms[0].Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		names = append(names, name)
+	})
+	assert.Equal(t, []string{"ns.c"}, names)
+}
+
+func TestJSONMetricHandlerInvalid(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	s := newJSONTestServer(t, ch)
+	defer s.Close()
+
+	for _, body := range []string{
+		`not json`,
+		`{"metrics": [{"type": "counter", "value": 1}]}`,
+		`{"metrics": [{"name": "a", "type": "histogram", "value": 1}]}`,
+		`{"metrics": [{"name": "a", "type": "counter"}]}`,
+		`{"metrics": [{"name": "a", "type": "counter", "value": "1"}]}`,
+		`{"metrics": [{"name": "a", "type": "counter", "value": 1, "rate": 2}]}`,
+		`{"metrics": [{"name": "a", "type": "set", "value": {}}]}`,
+		`{"metrics": [{"name": "a", "type": "gauge", "value": 1}, {"name": "b", "type": "gauge"}]}`,
+	} {
+		resp, err := http.Post(s.URL+"/json/metrics", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	assert.Empty(t, ch.MetricMaps())
+}
+
+func TestJSONEventHandler(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	s := newJSONTestServer(t, ch)
+	defer s.Close()
+
+	body := `{"events": [
+		{"title": "deploy", "text": "deployed api", "tags": ["service:api"], "alert_type": "success", "priority": "low"},
+		{"title": "rollback", "date_happened": 1000, "aggregation_key": "api", "source": "ci"}
+	]}`
+	resp, err := http.Post(s.URL+"/json/events", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	require.Len(t, ch.e, 2)
+
+	deploy := ch.e[0]
+	assert.Equal(t, "deploy", deploy.Title)
+	assert.Equal(t, "deployed api", deploy.Text)
+	assert.Equal(t, gostatsd.Tags{"service:api"}, deploy.Tags)
+	assert.Equal(t, gostatsd.AlertSuccess, deploy.AlertType)
+	assert.Equal(t, gostatsd.PriLow, deploy.Priority)
+	assert.Equal(t, gostatsd.Source("127.0.0.1"), deploy.Source)
+	assert.NotZero(t, deploy.DateHappened)
+
+	rollback := ch.e[1]
+	assert.EqualValues(t, 1000, rollback.DateHappened)
+	assert.Equal(t, "api", rollback.AggregationKey)
+	assert.Equal(t, gostatsd.Source("ci"), rollback.Source)
+	assert.Equal(t, gostatsd.AlertInfo, rollback.AlertType)
+	assert.Equal(t, gostatsd.PriNormal, rollback.Priority)
+}
+
+func TestJSONEventHandlerInvalid(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	s := newJSONTestServer(t, ch)
+	defer s.Close()
+
+	for _, body := range []string{
+		`not json`,
+		`{"events": [{"text": "no title"}]}`,
+		`{"events": [{"title": "a", "priority": "high"}]}`,
+		`{"events": [{"title": "a", "alert_type": "critical"}]}`,
+		`{"events": [{"title": "a"}, {"title": ""}]}`,
+	} {
+		resp, err := http.Post(s.URL+"/json/events", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	assert.Empty(t, ch.e)
+}
@@ -0,0 +1,390 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+const (
+	// RateLimitByIP limits each client by its source address, as determined by the SourceOptions.
+	RateLimitByIP = "ip"
+	// RateLimitByTenant limits each tenant, as determined by the TenantOptions.  Clients without a tenant are limited
+	// by their source address.
+	RateLimitByTenant = "tenant"
+	// RateLimitByToken limits each value of the TokenHeader, such as an api key.  Clients without a token are limited
+	// by their source address.
+	RateLimitByToken = "token"
+
+	defaultRateLimitTokenHeader = "Authorization"
+	defaultRateLimitMaxClients  = 10000
+
+	// rateLimitOverflowClient is the client which shares a single limit once MaxClients are tracked.
+	rateLimitOverflowClient = "overflow"
+
+	// rateLimitIdleTimeout is how long a client is remembered after its last request.
+	rateLimitIdleTimeout = 10 * time.Minute
+
+	// rateLimitTopClients is the number of clients limited the most each flush which are tagged by name, the rest are
+	// counted together as rateLimitOtherClients, so the cardinality of the metric is bounded.
+	rateLimitTopClients = 10
+	// rateLimitOtherClients is the client tag of the clients which are not among the rateLimitTopClients.
+	rateLimitOtherClients = "other"
+	// rateLimitMaxClientTag is the length client names are truncated to in tags, so a long tenant is not a long tag.
+	rateLimitMaxClientTag = 64
+	// rateLimitLogInterval is how often a client being limited is logged at warning level.
+	rateLimitLogInterval = 10 * time.Second
+)
+
+// RateLimitOptions controls the rate limits of each client on the ingestion endpoints, so one misbehaving client
+// can't starve the others.  A limit of 0 is unlimited.
+type RateLimitOptions struct {
+	// By is how clients are told apart, one of RateLimitByIP, RateLimitByTenant, or RateLimitByToken.
+	By string
+	// TokenHeader is the header holding the token of a client when By is RateLimitByToken.
+	TokenHeader string
+	// Requests is the number of requests per second allowed for each client.
+	Requests float64
+	// RequestsBurst is the number of requests allowed at once, defaults to Requests rounded up.
+	RequestsBurst int
+	// Datapoints is the number of datapoints per second allowed for each client.  A datapoint is a metric in
+	// /json/metrics, a series in /v2/raw, or an event.
+	Datapoints float64
+	// DatapointsBurst is the number of datapoints allowed at once, defaults to Datapoints rounded up.  A request with
+	// more datapoints than this is never allowed.
+	DatapointsBurst int
+	// MaxClients is the number of clients which are tracked, defaults to 10000.  Once it is reached, new tenants and
+	// tokens are limited by their source address, and new source addresses share a single limit, so rotating tokens
+	// does not get around the limits.
+	MaxClients int
+}
+
+func rateLimitOptionsFromViper(v *viper.Viper) RateLimitOptions {
+	return RateLimitOptions{
+		By:              v.GetString("rate-limit-by"),
+		TokenHeader:     v.GetString("rate-limit-token-header"),
+		Requests:        v.GetFloat64("rate-limit-requests"),
+		RequestsBurst:   v.GetInt("rate-limit-requests-burst"),
+		Datapoints:      v.GetFloat64("rate-limit-datapoints"),
+		DatapointsBurst: v.GetInt("rate-limit-datapoints-burst"),
+		MaxClients:      v.GetInt("rate-limit-max-clients"),
+	}
+}
+
+// rateLimiter holds the rate limits of every client which has been seen recently.
+type rateLimiter struct {
+	opts       RateLimitOptions
+	logLimiter *rate.Limiter // Limits the warnings logged for clients which are limited
+
+	lock    sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	limitedRequests   uint64 // atomic - requests rejected by the request limit
+	limitedDatapoints uint64 // atomic - requests rejected by the datapoint limit
+
+	requests   *rate.Limiter // nil if unlimited
+	datapoints *rate.Limiter // nil if unlimited
+	lastSeen   time.Time     // protected by the rateLimiter lock
+}
+
+// newRateLimiter returns a rateLimiter for the options, or nil if there are no limits.
+func newRateLimiter(opts RateLimitOptions) (*rateLimiter, error) {
+	switch opts.By {
+	case "":
+		opts.By = RateLimitByIP
+	case RateLimitByIP, RateLimitByTenant, RateLimitByToken:
+	default:
+		return nil, fmt.Errorf("rate-limit-by must be one of %s, %s, or %s", RateLimitByIP, RateLimitByTenant, RateLimitByToken)
+	}
+	if opts.Requests < 0 || opts.Datapoints < 0 || opts.RequestsBurst < 0 || opts.DatapointsBurst < 0 || opts.MaxClients < 0 {
+		return nil, fmt.Errorf("rate limits must not be negative")
+	}
+	if opts.Requests == 0 && opts.Datapoints == 0 {
+		return nil, nil
+	}
+	if opts.TokenHeader == "" {
+		opts.TokenHeader = defaultRateLimitTokenHeader
+	}
+	if opts.MaxClients == 0 {
+		opts.MaxClients = defaultRateLimitMaxClients
+	}
+	if opts.RequestsBurst == 0 {
+		opts.RequestsBurst = int(math.Ceil(opts.Requests))
+	}
+	if opts.DatapointsBurst == 0 {
+		opts.DatapointsBurst = int(math.Ceil(opts.Datapoints))
+	}
+	return &rateLimiter{
+		opts:       opts,
+		logLimiter: rate.NewLimiter(rate.Every(rateLimitLogInterval), 1),
+		clients:    map[string]*clientLimiter{},
+	}, nil
+}
+
+// clientName returns the name of the client the request is limited as, which is also logged.  Tokens are hashed, so
+// they aren't leaked.  Once MaxClients are tracked, a new tenant or token is limited by its source address, and a new
+// source address by the shared overflow limit.
+func (rl *rateLimiter) clientName(source gostatsd.Source, header func(key string) string, tenant string) string {
+	name := string(source)
+	switch rl.opts.By {
+	case RateLimitByTenant:
+		if tenant != "" {
+			name = "tenant-" + tenant
+		}
+	case RateLimitByToken:
+		if token := header(rl.opts.TokenHeader); token != "" {
+			hash := sha256.Sum256([]byte(token))
+			name = "token-" + hex.EncodeToString(hash[:6])
+		}
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	for _, candidate := range []string{name, string(source)} {
+		if _, ok := rl.clients[candidate]; ok || len(rl.clients) < rl.opts.MaxClients {
+			return candidate
+		}
+	}
+	return rateLimitOverflowClient
+}
+
+func (rl *rateLimiter) client(name string, now time.Time) *clientLimiter {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	cl, ok := rl.clients[name]
+	if !ok {
+		cl = &clientLimiter{}
+		if rl.opts.Requests > 0 {
+			cl.requests = rate.NewLimiter(rate.Limit(rl.opts.Requests), rl.opts.RequestsBurst)
+		}
+		if rl.opts.Datapoints > 0 {
+			cl.datapoints = rate.NewLimiter(rate.Limit(rl.opts.Datapoints), rl.opts.DatapointsBurst)
+		}
+		rl.clients[name] = cl
+	}
+	cl.lastSeen = now
+	return cl
+}
+
+// allowRequest returns true if the client is within its request limit.  If it is not, it returns how long until it
+// will be, and false if it never will be.
+func (rl *rateLimiter) allowRequest(name string, now time.Time) (retryAfter time.Duration, ok, possible bool) {
+	cl := rl.client(name, now)
+	retryAfter, ok, possible = reserve(cl.requests, 1, now)
+	if !ok {
+		atomic.AddUint64(&cl.limitedRequests, 1)
+	}
+	return retryAfter, ok, possible
+}
+
+// allowDatapoints returns true if the client is within its datapoint limit.  If it is not, it returns how long until
+// it will be, and false if it never will be.
+func (rl *rateLimiter) allowDatapoints(name string, n int, now time.Time) (retryAfter time.Duration, ok, possible bool) {
+	cl := rl.client(name, now)
+	retryAfter, ok, possible = reserve(cl.datapoints, n, now)
+	if !ok {
+		atomic.AddUint64(&cl.limitedDatapoints, 1)
+	}
+	return retryAfter, ok, possible
+}
+
+// wait waits until the client is within its request and datapoint limits, for grpc streams which are slowed down
+// rather than rejected.  It returns an error if the context is done first, or the client never will be within its
+// limits.
+func (rl *rateLimiter) wait(ctx context.Context, name string, n int) error {
+	cl := rl.client(name, time.Now())
+	for _, wait := range []struct {
+		limiter *rate.Limiter
+		n       int
+		limited *uint64
+	}{
+		{limiter: cl.requests, n: 1, limited: &cl.limitedRequests},
+		{limiter: cl.datapoints, n: n, limited: &cl.limitedDatapoints},
+	} {
+		if wait.limiter == nil {
+			continue
+		}
+		if !wait.limiter.AllowN(time.Now(), wait.n) {
+			atomic.AddUint64(wait.limited, 1)
+			if err := wait.limiter.WaitN(ctx, wait.n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reserve takes n tokens from the limiter if they are available.  If they are not, it returns how long until they
+// will be, and false if they never will be.
+func reserve(limiter *rate.Limiter, n int, now time.Time) (retryAfter time.Duration, ok, possible bool) {
+	if limiter == nil {
+		return 0, true, true
+	}
+	r := limiter.ReserveN(now, n)
+	if !r.OK() {
+		return 0, false, false
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay, false, true
+	}
+	return 0, true, true
+}
+
+// logLimited logs the client which was limited, at warning level at most once every rateLimitLogInterval, so the
+// client can be found without logging every request.
+func (rl *rateLimiter) logLimited(logger logrus.FieldLogger, client string) {
+	logger = logger.WithField("client", client)
+	if rl.logLimiter.Allow() {
+		logger.Warn("rate limited")
+	} else {
+		logger.Debug("rate limited")
+	}
+}
+
+// clientTag returns the name of a client truncated to rateLimitMaxClientTag, as it is tagged.  Tokens are already
+// hashed by clientName.
+func clientTag(client string) string {
+	if len(client) > rateLimitMaxClientTag {
+		return client[:rateLimitMaxClientTag]
+	}
+	return client
+}
+
+// limitedClient is the number of times a client was limited since the last flush.
+type limitedClient struct {
+	name       string
+	requests   uint64
+	datapoints uint64
+}
+
+// emitMetrics reports the requests rejected by each limit and the number of clients tracked, and forgets clients which
+// haven't been seen recently.  The rejections of the rateLimitTopClients clients limited the most are tagged with the
+// name of the client, and the rest are tagged as rateLimitOtherClients.
+func (rl *rateLimiter) emitMetrics(statser stats.Statser) {
+	now := time.Now()
+	var limited []limitedClient
+	rl.lock.Lock()
+	for name, cl := range rl.clients {
+		lc := limitedClient{
+			name:       clientTag(name),
+			requests:   atomic.SwapUint64(&cl.limitedRequests, 0),
+			datapoints: atomic.SwapUint64(&cl.limitedDatapoints, 0),
+		}
+		if lc.requests > 0 || lc.datapoints > 0 {
+			limited = append(limited, lc)
+		}
+		if now.Sub(cl.lastSeen) > rateLimitIdleTimeout {
+			delete(rl.clients, name)
+		}
+	}
+	clients := len(rl.clients)
+	rl.lock.Unlock()
+
+	sort.Slice(limited, func(i, j int) bool {
+		ti, tj := limited[i].requests+limited[i].datapoints, limited[j].requests+limited[j].datapoints
+		if ti != tj {
+			return ti > tj
+		}
+		return limited[i].name < limited[j].name
+	})
+	if len(limited) > rateLimitTopClients {
+		other := limitedClient{name: rateLimitOtherClients}
+		for _, lc := range limited[rateLimitTopClients:] {
+			other.requests += lc.requests
+			other.datapoints += lc.datapoints
+		}
+		limited = append(limited[:rateLimitTopClients], other)
+	}
+	for _, lc := range limited {
+		if lc.requests > 0 {
+			statser.Count("http.incoming.limited", float64(lc.requests), []string{"limit:requests", "client:" + lc.name})
+		}
+		if lc.datapoints > 0 {
+			statser.Count("http.incoming.limited", float64(lc.datapoints), []string{"limit:datapoints", "client:" + lc.name})
+		}
+	}
+	statser.Gauge("http.incoming.limited_clients", float64(clients), nil)
+}
+
+// allowRequest checks the request against the request limit of the client making it.  It returns the name of the
+// client, and false if the client is over its limit, and the response has been written.
+func (rhh *rawHttpHandlerV2) allowRequest(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if rhh.limiter == nil {
+		return "", true
+	}
+	client := rhh.limiter.clientName(rhh.sourceOpts.source(req.RemoteAddr, req.Header.Get), req.Header.Get, rhh.tenantOpts.requestTenant(req))
+	retryAfter, ok, _ := rhh.limiter.allowRequest(client, time.Now())
+	if !ok {
+		rhh.tooManyRequests(w, client, retryAfter)
+	}
+	return client, ok
+}
+
+// allowDatapoints checks n datapoints against the datapoint limit of the client.  It returns false if the client is
+// over its limit, and the response has been written.
+func (rhh *rawHttpHandlerV2) allowDatapoints(w http.ResponseWriter, client string, n int) bool {
+	if rhh.limiter == nil {
+		return true
+	}
+	retryAfter, ok, possible := rhh.limiter.allowDatapoints(client, n, time.Now())
+	if ok {
+		return true
+	}
+	if !possible {
+		atomic.AddUint64(&rhh.requestFailureLimited, 1)
+		rhh.logger.WithField("client", client).Info("request has more datapoints than the rate limit allows")
+		http.Error(w, fmt.Sprintf("%d datapoints is more than the limit of %d at once", n, rhh.limiter.opts.DatapointsBurst), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	rhh.tooManyRequests(w, client, retryAfter)
+	return false
+}
+
+// tooManyRequests rejects a request from a client which is over its rate limit, and tells it when to retry.
+func (rhh *rawHttpHandlerV2) tooManyRequests(w http.ResponseWriter, client string, retryAfter time.Duration) {
+	atomic.AddUint64(&rhh.requestFailureLimited, 1)
+	rhh.limiter.logLimited(rhh.logger, client)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// waitPeer waits until the client of a grpc stream is within its rate limits for a message with n datapoints.
+func (rhh *rawHttpHandlerV2) waitPeer(ctx context.Context, client string, n int) error {
+	if rhh.limiter == nil {
+		return nil
+	}
+	if err := rhh.limiter.wait(ctx, client, n); err != nil {
+		atomic.AddUint64(&rhh.requestFailureLimited, 1)
+		rhh.limiter.logLimited(rhh.logger, client)
+		return status.Errorf(codes.ResourceExhausted, "rate limited: %v", err)
+	}
+	return nil
+}
+
+// peerClient returns the name of the client of a grpc stream, for rate limiting.
+func (rhh *rawHttpHandlerV2) peerClient(ctx context.Context) string {
+	if rhh.limiter == nil {
+		return ""
+	}
+	remote, header := peerRequest(ctx)
+	return rhh.limiter.clientName(rhh.sourceOpts.source(remote, header), header, rhh.tenantOpts.peerTenant(ctx))
+}
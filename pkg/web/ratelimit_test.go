@@ -0,0 +1,167 @@
+package web
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pkg/stats"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	t.Parallel()
+	rl, err := newRateLimiter(RateLimitOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, rl)
+
+	_, err = newRateLimiter(RateLimitOptions{By: "user", Requests: 1})
+	assert.Error(t, err)
+	_, err = newRateLimiter(RateLimitOptions{Requests: -1})
+	assert.Error(t, err)
+
+	rl, err = newRateLimiter(RateLimitOptions{Requests: 0.5, Datapoints: 100})
+	require.NoError(t, err)
+	assert.Equal(t, RateLimitByIP, rl.opts.By)
+	assert.Equal(t, 1, rl.opts.RequestsBurst)
+	assert.Equal(t, 100, rl.opts.DatapointsBurst)
+}
+
+func TestRateLimiterClientName(t *testing.T) {
+	t.Parallel()
+	header := func(key string) string {
+		if key == "Authorization" {
+			return "secret"
+		}
+		return ""
+	}
+	noHeader := func(key string) string { return "" }
+
+	rl, err := newRateLimiter(RateLimitOptions{Requests: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.1.1", rl.clientName("10.1.1.1", header, "team-a"))
+
+	rl, err = newRateLimiter(RateLimitOptions{By: RateLimitByTenant, Requests: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-team-a", rl.clientName("10.1.1.1", header, "team-a"))
+	assert.Equal(t, "10.1.1.1", rl.clientName("10.1.1.1", header, ""))
+
+	rl, err = newRateLimiter(RateLimitOptions{By: RateLimitByToken, Requests: 1})
+	require.NoError(t, err)
+	name := rl.clientName("10.1.1.1", header, "team-a")
+	assert.Regexp(t, "^token-[0-9a-f]{12}$", name)
+	assert.NotContains(t, name, "secret")
+	assert.Equal(t, "10.1.1.1", rl.clientName("10.1.1.1", noHeader, ""))
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	t.Parallel()
+	rl, err := newRateLimiter(RateLimitOptions{Requests: 1, RequestsBurst: 2, Datapoints: 10})
+	require.NoError(t, err)
+	now := time.Now()
+
+	_, ok, _ := rl.allowRequest("a", now)
+	assert.True(t, ok)
+	_, ok, _ = rl.allowRequest("a", now)
+	assert.True(t, ok)
+	retryAfter, ok, possible := rl.allowRequest("a", now)
+	assert.False(t, ok)
+	assert.True(t, possible)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// Other clients have their own limits
+	_, ok, _ = rl.allowRequest("b", now)
+	assert.True(t, ok)
+
+	_, ok, _ = rl.allowDatapoints("a", 10, now)
+	assert.True(t, ok)
+	retryAfter, ok, possible = rl.allowDatapoints("a", 5, now)
+	assert.False(t, ok)
+	assert.True(t, possible)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+	_, ok, possible = rl.allowDatapoints("b", 11, now)
+	assert.False(t, ok)
+	assert.False(t, possible)
+
+	assert.EqualValues(t, 1, rl.clients["a"].limitedRequests)
+	assert.EqualValues(t, 1, rl.clients["a"].limitedDatapoints)
+	assert.EqualValues(t, 1, rl.clients["b"].limitedDatapoints)
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	t.Parallel()
+	token := func(value string) func(key string) string {
+		return func(key string) string { return value }
+	}
+	rl, err := newRateLimiter(RateLimitOptions{By: RateLimitByToken, Requests: 1, MaxClients: 3})
+	require.NoError(t, err)
+	now := time.Now()
+
+	first := rl.clientName("10.1.1.1", token("a"), "")
+	rl.allowRequest(first, now)
+	rl.allowRequest(rl.clientName("10.1.1.1", token(""), ""), now)
+	rl.allowRequest(rl.clientName("10.1.1.1", token("b"), ""), now)
+	// Known clients are still limited separately, new tokens are limited by the source address, and new addresses by
+	// the overflow limit.
+	assert.Equal(t, first, rl.clientName("10.1.1.1", token("a"), ""))
+	assert.Equal(t, "10.1.1.1", rl.clientName("10.1.1.1", token("c"), ""))
+	assert.Equal(t, rateLimitOverflowClient, rl.clientName("10.2.2.2", token("c"), ""))
+	assert.Len(t, rl.clients, 3)
+}
+
+func TestRateLimiterForgetsIdleClients(t *testing.T) {
+	t.Parallel()
+	rl, err := newRateLimiter(RateLimitOptions{Requests: 1})
+	require.NoError(t, err)
+
+	rl.allowRequest("idle", time.Now().Add(-2*rateLimitIdleTimeout))
+	rl.allowRequest("active", time.Now())
+	rl.emitMetrics(stats.NewNullStatser())
+
+	assert.NotContains(t, rl.clients, "idle")
+	assert.Contains(t, rl.clients, "active")
+}
+
+// countStatser records the total of each count by its tags.
+type countStatser struct {
+	stats.NullStatser
+	counts map[string]float64
+}
+
+func (cs *countStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	cs.counts[name+" "+strings.Join(tags, ",")] += amount
+}
+
+func TestRateLimiterMetricsByClient(t *testing.T) {
+	t.Parallel()
+	rl, err := newRateLimiter(RateLimitOptions{Requests: 1})
+	require.NoError(t, err)
+
+	// 10.0.0.<n> is limited n times, and the long tenant the most
+	now := time.Now()
+	longTenant := "tenant-" + strings.Repeat("t", 2*rateLimitMaxClientTag)
+	limit := func(client string, n int) {
+		for i := 0; i <= n; i++ {
+			rl.allowRequest(client, now)
+		}
+	}
+	for n := 1; n <= rateLimitTopClients+1; n++ {
+		limit(fmt.Sprintf("10.0.0.%d", n), n)
+	}
+	limit(longTenant, 20)
+	rl.allowDatapoints(longTenant, 0, now)
+
+	cs := &countStatser{counts: map[string]float64{}}
+	rl.emitMetrics(cs)
+	assert.Len(t, cs.counts, rateLimitTopClients+1)
+	assert.EqualValues(t, 20, cs.counts["http.incoming.limited limit:requests,client:"+longTenant[:rateLimitMaxClientTag]])
+	assert.EqualValues(t, 3, cs.counts["http.incoming.limited limit:requests,client:10.0.0.3"])
+	assert.NotContains(t, cs.counts, "http.incoming.limited limit:requests,client:10.0.0.2")
+	// The two least limited are counted together
+	assert.EqualValues(t, 1+2, cs.counts["http.incoming.limited limit:requests,client:other"])
+	assert.NotContains(t, cs.counts, "http.incoming.limited limit:datapoints,client:"+longTenant[:rateLimitMaxClientTag])
+}
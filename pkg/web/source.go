@@ -0,0 +1,116 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/hligit/gostatsd"
+)
+
+// SourceOptions controls how the source of metrics and events ingested over http is determined.
+type SourceOptions struct {
+	// FromRequest is true if metrics and events without a source are given the source of the request.
+	FromRequest bool
+	// Header is the name of a header, such as X-Forwarded-For, holding the address of the original client.  If it is
+	// "", missing, or the request is not from a trusted proxy, the remote address of the request is used.
+	Header string
+	// TrustedProxies are the networks allowed to set Header.  If it is empty, no peer is trusted.
+	TrustedProxies []*net.IPNet
+}
+
+func sourceOptionsFromViper(v *viper.Viper) (SourceOptions, error) {
+	opts := SourceOptions{
+		FromRequest: v.GetBool("source-from-request"),
+		Header:      v.GetString("source-header"),
+	}
+	for _, cidr := range v.GetStringSlice("trusted-proxies") {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return SourceOptions{}, fmt.Errorf("bad trusted proxy %s: %v", cidr, err)
+		}
+		opts.TrustedProxies = append(opts.TrustedProxies, ipNet)
+	}
+	if opts.Header != "" && len(opts.TrustedProxies) == 0 {
+		// Any client could set the header, and claim to be another host.
+		return SourceOptions{}, errors.New("source-header requires trusted-proxies to be set")
+	}
+	return opts, nil
+}
+
+// requestSource returns the source to use for metrics and events in the request which have none, or
+// gostatsd.UnknownSource if they should be left without a source.
+func (so *SourceOptions) requestSource(req *http.Request) gostatsd.Source {
+	if !so.FromRequest {
+		return gostatsd.UnknownSource
+	}
+	return so.source(req.RemoteAddr, req.Header.Get)
+}
+
+// peerSource returns the source to use for metrics and events on a grpc stream which have none, or
+// gostatsd.UnknownSource if they should be left without a source.  Header is read from the metadata of the stream.
+func (so *SourceOptions) peerSource(ctx context.Context) gostatsd.Source {
+	if !so.FromRequest {
+		return gostatsd.UnknownSource
+	}
+	return so.source(peerRequest(ctx))
+}
+
+// peerRequest returns the remote address of a grpc stream, and a function to read its metadata like http headers.
+func peerRequest(ctx context.Context) (string, func(key string) string) {
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	return remote, func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
+
+// source returns the source of a client at remote, or the client in the Header if remote is a trusted proxy.
+func (so *SourceOptions) source(remote string, header func(key string) string) gostatsd.Source {
+	remote = remoteHost(remote)
+	if so.Header != "" && trustedProxy(so.TrustedProxies, remote) {
+		if value := header(so.Header); value != "" {
+			// X-Forwarded-For and similar headers are a list with the original client first
+			client := strings.TrimSpace(strings.SplitN(value, ",", 2)[0])
+			if client != "" {
+				return gostatsd.Source(client)
+			}
+		}
+	}
+	return gostatsd.Source(remote)
+}
+
+// remoteHost returns the host of a remote address, without the port.
+func remoteHost(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// trustedProxy returns true if the host is in one of the trusted proxy networks.
+func trustedProxy(proxies []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range proxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
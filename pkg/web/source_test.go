@@ -0,0 +1,76 @@
+package web
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+	"github.com/hligit/gostatsd/pb"
+)
+
+func TestSourceOptionsRequestSource(t *testing.T) {
+	t.Parallel()
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		opts     SourceOptions
+		remote   string
+		header   string
+		expected gostatsd.Source
+	}{
+		{name: "disabled", opts: SourceOptions{}, remote: "10.1.1.1:1234", header: "1.2.3.4", expected: gostatsd.UnknownSource},
+		{name: "remote", opts: SourceOptions{FromRequest: true}, remote: "10.1.1.1:1234", header: "1.2.3.4", expected: "10.1.1.1"},
+		{name: "header", opts: SourceOptions{FromRequest: true, Header: "X-Forwarded-For", TrustedProxies: []*net.IPNet{proxies}}, remote: "10.1.1.1:1234", header: "1.2.3.4, 10.2.2.2", expected: "1.2.3.4"},
+		{name: "missing header", opts: SourceOptions{FromRequest: true, Header: "X-Forwarded-For", TrustedProxies: []*net.IPNet{proxies}}, remote: "10.1.1.1:1234", expected: "10.1.1.1"},
+		{name: "no trusted proxies", opts: SourceOptions{FromRequest: true, Header: "X-Forwarded-For"}, remote: "10.1.1.1:1234", header: "1.2.3.4", expected: "10.1.1.1"},
+		{name: "trusted proxy", opts: SourceOptions{FromRequest: true, Header: "X-Forwarded-For", TrustedProxies: []*net.IPNet{proxies}}, remote: "10.1.1.1:1234", header: "1.2.3.4", expected: "1.2.3.4"},
+		{name: "untrusted proxy", opts: SourceOptions{FromRequest: true, Header: "X-Forwarded-For", TrustedProxies: []*net.IPNet{proxies}}, remote: "192.168.1.1:1234", header: "1.2.3.4", expected: "192.168.1.1"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v2/raw", nil)
+			req.RemoteAddr = test.remote
+			if test.header != "" {
+				req.Header.Set("X-Forwarded-For", test.header)
+			}
+			assert.Equal(t, test.expected, test.opts.requestSource(req))
+		})
+	}
+}
+
+func TestSourceOptionsFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("source-header", "X-Forwarded-For")
+	_, err := sourceOptionsFromViper(v)
+	require.Error(t, err)
+
+	v.Set("trusted-proxies", []string{"10.0.0.0/8"})
+	opts, err := sourceOptionsFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, opts.TrustedProxies, 1)
+}
+
+func TestTranslateFromProtobufV2DefaultSource(t *testing.T) {
+	t.Parallel()
+	msg := &pb.RawMessageV2{
+		Counters: map[string]*pb.CounterTagV2{
+			"c": {TagMap: map[string]*pb.RawCounterV2{
+				"a":        {Tags: []string{"a"}, Value: 1},
+				"b,s:host": {Tags: []string{"b"}, Hostname: "host", Value: 2},
+			}},
+		},
+	}
+	mm := translateFromProtobufV2(msg, "1.2.3.4")
+	require.Len(t, mm.Counters["c"], 2)
+	assert.Equal(t, gostatsd.Source("1.2.3.4"), mm.Counters["c"]["a,s:1.2.3.4"].Source)
+	assert.Equal(t, gostatsd.Source("host"), mm.Counters["c"]["b,s:host"].Source)
+}
@@ -0,0 +1,116 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/hligit/gostatsd"
+)
+
+const defaultTenantTag = "tenant"
+
+// TenantOptions controls how metrics and events ingested over http are attributed to a tenant, so a single
+// aggregation tier can be shared by multiple teams.  The tenant is added as a tag, replacing any tag of the same name
+// set by the client.  Requests without a tenant have the tag removed, so a client can't attribute them to a tenant.
+type TenantOptions struct {
+	// Header is the name of a header holding the tenant.  If it is "", the tenant is not read from a header.
+	Header string
+	// TrustedProxies are the networks allowed to set Header.  If it is empty, no peer is trusted.
+	TrustedProxies []*net.IPNet
+	// FromClientCert is true if the tenant is the common name of a verified client certificate.  It takes precedence
+	// over Header.
+	FromClientCert bool
+	// Tag is the name of the tag holding the tenant, defaults to "tenant".
+	Tag string
+}
+
+// tenantOptionsFromViper returns the TenantOptions, allowing the header to be set by the trustedProxies.
+func tenantOptionsFromViper(v *viper.Viper, trustedProxies []*net.IPNet) (TenantOptions, error) {
+	opts := TenantOptions{
+		Header:         v.GetString("tenant-header"),
+		TrustedProxies: trustedProxies,
+		FromClientCert: v.GetBool("tenant-from-client-cert"),
+		Tag:            v.GetString("tenant-tag"),
+	}
+	if opts.Header != "" && len(opts.TrustedProxies) == 0 {
+		// Any client could set the header, and claim to be another tenant.
+		return TenantOptions{}, errors.New("tenant-header requires trusted-proxies to be set")
+	}
+	return opts, nil
+}
+
+// enabled returns true if metrics and events are attributed to a tenant.
+func (to *TenantOptions) enabled() bool {
+	return to.Header != "" || to.FromClientCert
+}
+
+func (to *TenantOptions) tag() string {
+	if to.Tag == "" {
+		return defaultTenantTag
+	}
+	return to.Tag
+}
+
+// requestTenant returns the tenant of the request, or "" if it has none.
+func (to *TenantOptions) requestTenant(req *http.Request) string {
+	if to.FromClientCert {
+		if tenant := certTenant(req.TLS); tenant != "" {
+			return tenant
+		}
+	}
+	if to.Header != "" && trustedProxy(to.TrustedProxies, remoteHost(req.RemoteAddr)) {
+		return strings.TrimSpace(req.Header.Get(to.Header))
+	}
+	return ""
+}
+
+// peerTenant returns the tenant of a grpc stream, or "" if it has none.  Header is read from the metadata of the
+// stream.
+func (to *TenantOptions) peerTenant(ctx context.Context) string {
+	if to.FromClientCert {
+		if p, ok := peer.FromContext(ctx); ok {
+			if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				if tenant := certTenant(&tlsInfo.State); tenant != "" {
+					return tenant
+				}
+			}
+		}
+	}
+	if to.Header != "" {
+		remote, header := peerRequest(ctx)
+		if trustedProxy(to.TrustedProxies, remoteHost(remote)) {
+			return strings.TrimSpace(header(to.Header))
+		}
+	}
+	return ""
+}
+
+// certTenant returns the common name of the verified client certificate, or "" if there is none.
+func certTenant(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// tagMetricMap attributes every metric in mm to the tenant.  If there is no tenant, the tag is removed.
+func (to *TenantOptions) tagMetricMap(mm *gostatsd.MetricMap, tenant string) {
+	if to.enabled() {
+		mm.ReplaceTag(to.tag(), tenant)
+	}
+}
+
+// tagEvent attributes the event to the tenant.  If there is no tenant, the tag is removed.
+func (to *TenantOptions) tagEvent(e *gostatsd.Event, tenant string) {
+	if to.enabled() {
+		e.Tags = e.Tags.ReplaceTag(to.tag(), tenant)
+	}
+}
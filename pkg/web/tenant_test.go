@@ -0,0 +1,90 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hligit/gostatsd"
+)
+
+func TestTenantOptionsRequestTenant(t *testing.T) {
+	t.Parallel()
+	verified := &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "team-cert"}}}},
+	}
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	trusted := []*net.IPNet{proxies}
+
+	tests := []struct {
+		name     string
+		opts     TenantOptions
+		remote   string
+		header   string
+		tls      *tls.ConnectionState
+		expected string
+	}{
+		{name: "disabled", opts: TenantOptions{}, header: "team-a", tls: verified, expected: ""},
+		{name: "header", opts: TenantOptions{Header: "X-Tenant", TrustedProxies: trusted}, header: " team-a ", expected: "team-a"},
+		{name: "untrusted proxy", opts: TenantOptions{Header: "X-Tenant", TrustedProxies: trusted}, remote: "192.168.1.1:1234", header: "team-a", expected: ""},
+		{name: "missing header", opts: TenantOptions{Header: "X-Tenant", TrustedProxies: trusted}, expected: ""},
+		{name: "client cert", opts: TenantOptions{Header: "X-Tenant", TrustedProxies: trusted, FromClientCert: true}, header: "team-a", tls: verified, expected: "team-cert"},
+		{name: "unverified client cert", opts: TenantOptions{Header: "X-Tenant", TrustedProxies: trusted, FromClientCert: true}, header: "team-a", tls: &tls.ConnectionState{}, expected: "team-a"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v2/raw", nil)
+			req.RemoteAddr = "10.1.1.1:1234"
+			if test.remote != "" {
+				req.RemoteAddr = test.remote
+			}
+			req.TLS = test.tls
+			if test.header != "" {
+				req.Header.Set("X-Tenant", test.header)
+			}
+			assert.Equal(t, test.expected, test.opts.requestTenant(req))
+		})
+	}
+}
+
+func TestTenantOptionsTagEvent(t *testing.T) {
+	t.Parallel()
+	opts := TenantOptions{FromClientCert: true, Tag: "team"}
+	e := &gostatsd.Event{Tags: gostatsd.Tags{"a:b", "team:spoofed"}}
+	opts.tagEvent(e, "team-a")
+	assert.Equal(t, gostatsd.Tags{"a:b", "team:team-a"}, e.Tags)
+
+	// Without a tenant, the client can't set one
+	e = &gostatsd.Event{Tags: gostatsd.Tags{"a:b", "team:spoofed"}}
+	opts.tagEvent(e, "")
+	assert.Equal(t, gostatsd.Tags{"a:b"}, e.Tags)
+
+	// Tags are left alone if tenants are not enabled
+	opts = TenantOptions{Tag: "team"}
+	e = &gostatsd.Event{Tags: gostatsd.Tags{"a:b", "team:other"}}
+	opts.tagEvent(e, "")
+	assert.Equal(t, gostatsd.Tags{"a:b", "team:other"}, e.Tags)
+}
+
+func TestTenantOptionsFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("tenant-header", "X-Tenant")
+	_, err := tenantOptionsFromViper(v, nil)
+	require.Error(t, err)
+
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	opts, err := tenantOptionsFromViper(v, []*net.IPNet{proxies})
+	require.NoError(t, err)
+	require.Equal(t, "X-Tenant", opts.Header)
+}
@@ -0,0 +1,83 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/viper"
+)
+
+// TLSOptions configures TLS for an http server.
+type TLSOptions struct {
+	// CertPath and KeyPath are the server certificate and key.  TLS is disabled if they are not set.
+	CertPath string
+	KeyPath  string
+	// ClientCAPath is the CA bundle client certificates are verified against.  Client certificates are not requested
+	// if it is not set.
+	ClientCAPath string
+	// ClientCertOptional allows clients without a certificate.  A certificate is still verified if it is given.
+	ClientCertOptional bool
+}
+
+func tlsOptionsFromViper(v *viper.Viper) TLSOptions {
+	return TLSOptions{
+		CertPath:           v.GetString("tls-cert-path"),
+		KeyPath:            v.GetString("tls-key-path"),
+		ClientCAPath:       v.GetString("tls-client-ca-path"),
+		ClientCertOptional: v.GetBool("tls-client-cert-optional"),
+	}
+}
+
+// Enabled returns true if TLS is configured.
+func (to *TLSOptions) Enabled() bool {
+	return to.CertPath != "" || to.KeyPath != ""
+}
+
+// config returns the server TLS configuration, or nil if TLS is not enabled.
+func (to *TLSOptions) config() (*tls.Config, error) {
+	if !to.Enabled() {
+		if to.ClientCAPath != "" {
+			return nil, fmt.Errorf("tls-cert-path and tls-key-path are required when tls-client-ca-path is set")
+		}
+		return nil, nil
+	}
+	if to.CertPath == "" {
+		return nil, fmt.Errorf("tls-cert-path is required when tls-key-path is set")
+	}
+	if to.KeyPath == "" {
+		return nil, fmt.Errorf("tls-key-path is required when tls-cert-path is set")
+	}
+
+	tlsConfig := &tls.Config{
+		// Can't use SSLv3 because of POODLE and BEAST
+		// Can't use TLSv1.0 because of POODLE and BEAST using CBC cipher
+		// Can't use TLSv1.1 because of RC4 cipher usage
+		MinVersion: tls.VersionTLS12,
+	}
+
+	cert, err := tls.LoadX509KeyPair(to.CertPath, to.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading server certificate: %v", err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	if to.ClientCAPath != "" {
+		caPEM, err := ioutil.ReadFile(to.ClientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS client CA: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if ok := tlsConfig.ClientCAs.AppendCertsFromPEM(caPEM); !ok {
+			return nil, fmt.Errorf("error reading TLS client CA: no certificates found")
+		}
+		if to.ClientCertOptional {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,157 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certPath string
+	keyPath  string
+}
+
+// newTestCert creates a certificate signed by parent, or a self signed CA if parent is nil, and writes it to dir.
+func newTestCert(t *testing.T, dir, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certPath: filepath.Join(dir, name+".crt"),
+		keyPath:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, ioutil.WriteFile(tc.certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(tc.keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return tc
+}
+
+func TestTLSOptionsClientCertificates(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, dir, "ca", nil)
+	server := newTestCert(t, dir, "server", ca)
+	client := newTestCert(t, dir, "client", ca)
+	otherCA := newTestCert(t, dir, "other-ca", nil)
+	other := newTestCert(t, dir, "other", otherCA)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// The certificate is always sent, even if it is not signed by a CA the server asked for
+	clientCert := func(tc *testCert) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if tc == nil {
+			return nil
+		}
+		cert, err := tls.LoadX509KeyPair(tc.certPath, tc.keyPath)
+		require.NoError(t, err)
+		return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+
+	tests := []struct {
+		name    string
+		opts    TLSOptions
+		client  *testCert
+		success bool
+	}{
+		{name: "tls", opts: TLSOptions{CertPath: server.certPath, KeyPath: server.keyPath}, success: true},
+		{name: "mtls", opts: TLSOptions{CertPath: server.certPath, KeyPath: server.keyPath, ClientCAPath: ca.certPath}, client: client, success: true},
+		{name: "mtls without certificate", opts: TLSOptions{CertPath: server.certPath, KeyPath: server.keyPath, ClientCAPath: ca.certPath}, success: false},
+		{name: "mtls with untrusted certificate", opts: TLSOptions{CertPath: server.certPath, KeyPath: server.keyPath, ClientCAPath: ca.certPath}, client: other, success: false},
+		{name: "optional mtls without certificate", opts: TLSOptions{CertPath: server.certPath, KeyPath: server.keyPath, ClientCAPath: ca.certPath, ClientCertOptional: true}, success: true},
+		{name: "optional mtls with untrusted certificate", opts: TLSOptions{CertPath: server.certPath, KeyPath: server.keyPath, ClientCAPath: ca.certPath, ClientCertOptional: true}, client: other, success: false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := tt.opts.config()
+			require.NoError(t, err)
+
+			s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = w.Write([]byte("OK"))
+			}))
+			s.TLS = tlsConfig
+			s.StartTLS()
+			defer s.Close()
+
+			c := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						RootCAs:              roots,
+						GetClientCertificate: clientCert(tt.client),
+					},
+				},
+			}
+			resp, err := c.Get(s.URL)
+			if tt.success {
+				require.NoError(t, err)
+				_ = resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestTLSOptionsConfigErrors(t *testing.T) {
+	t.Parallel()
+	tests := []TLSOptions{
+		{CertPath: "server.crt"},
+		{KeyPath: "server.key"},
+		{ClientCAPath: "ca.crt"},
+		{CertPath: "missing.crt", KeyPath: "missing.key"},
+	}
+	for _, opts := range tests {
+		_, err := opts.config()
+		assert.Error(t, err, "%+v", opts)
+	}
+	tlsConfig, err := (&TLSOptions{}).config()
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+}
@@ -2,11 +2,51 @@ package web
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is the value of the Accept-Encoding header sent when a request uses an unsupported Content-Encoding.
+const acceptEncoding = "zstd, gzip, deflate, identity"
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
 )
 
-func decompress(input []byte) ([]byte, error) {
-	decompressor, err := zlib.NewReader(bytes.NewReader(input))
+// decompress decompresses input according to the Content-Encoding.  It returns false if the encoding is not
+// supported.
+func decompress(encoding string, input []byte) ([]byte, bool, error) {
+	switch encoding {
+	case "deflate":
+		b, err := decompressReader(zlib.NewReader(bytes.NewReader(input)))
+		return b, true, err
+	case "gzip":
+		b, err := decompressReader(gzip.NewReader(bytes.NewReader(input)))
+		return b, true, err
+	case "zstd":
+		zstdDecoderOnce.Do(func() {
+			// A nil reader is only valid for DecodeAll, which is safe for concurrent use.
+			zstdDecoder, zstdDecoderErr = zstd.NewReader(nil)
+		})
+		if zstdDecoderErr != nil {
+			return nil, true, zstdDecoderErr
+		}
+		b, err := zstdDecoder.DecodeAll(input, nil)
+		return b, true, err
+	case "identity", "":
+		return input, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+func decompressReader(decompressor io.ReadCloser, err error) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
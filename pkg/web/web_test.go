@@ -23,6 +23,18 @@ func TestHttpServerShutsdown(t *testing.T) {
 		false,
 		false,
 		true,
+		web.SourceOptions{},
+		web.TenantOptions{},
+		web.RateLimitOptions{},
+		web.TLSOptions{},
+		nil,
+		nil,
+		web.BasicAuth{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
 	)
 	require.NoError(t, err)
 
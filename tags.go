@@ -26,10 +26,29 @@ func (tags Tags) String() string {
 // a comma-separated string representation of the tags.
 // Note that this method may mutate the original object.
 func (tags Tags) SortedString() string {
-	sort.Strings(tags)
+	tags.Sort()
 	return tags.String()
 }
 
+// Sort sorts the tags alphabetically.  Clients usually send the same tags in the same order, and the tags of an
+// aggregated series have been sorted already, so they are only sorted if they are not in order.
+func (tags Tags) Sort() {
+	if !sort.StringsAreSorted(tags) {
+		sort.Strings(tags)
+	}
+}
+
+// appendTo appends the comma-separated representation of the tags to b.
+func (tags Tags) appendTo(b []byte) []byte {
+	for idx, tag := range tags {
+		if idx > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, tag...)
+	}
+	return b
+}
+
 // NormalizeTagKey cleans up the key of a tag.
 func NormalizeTagKey(key string) string {
 	return strings.Replace(key, ":", "_", -1)
@@ -52,3 +71,19 @@ func (tags Tags) Copy() Tags {
 	copy(tagCopy, tags)
 	return tagCopy
 }
+
+// ReplaceTag returns a new Tags without any tag with the given name, and with "name:value" added.  If value is "",
+// the tag is only removed.
+func (tags Tags) ReplaceTag(name, value string) Tags {
+	prefix := name + ":"
+	t := make(Tags, 0, len(tags)+1)
+	for _, tag := range tags {
+		if tag != name && !strings.HasPrefix(tag, prefix) {
+			t = append(t, tag)
+		}
+	}
+	if value == "" {
+		return t
+	}
+	return append(t, prefix+value)
+}
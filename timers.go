@@ -1,6 +1,10 @@
 package gostatsd
 
-import "github.com/spf13/viper"
+import (
+	"strconv"
+
+	"github.com/spf13/viper"
+)
 
 // Timer is used for storing aggregated values for timers.
 type Timer struct {
@@ -14,7 +18,7 @@ type Timer struct {
 	StdDev       float64     // The standard deviation for the series
 	Sum          float64     // The sum for the series
 	SumSquares   float64     // The sum squares for the series
-	Values       []float64   // The numeric value of the metric
+	Values       []float64   // The numeric value of the metric, in no particular order after a flush
 	Percentiles  Percentiles // The percentile aggregations of the metric
 	Timestamp    Nanotime    // Last time value was updated
 	Source       Source      // Hostname of the source of the metric
@@ -110,3 +114,108 @@ func DisabledSubMetrics(viper *viper.Viper) TimerSubtypes {
 	}
 
 }
+
+// PercentThresholds returns the percentiles to calculate for timers, from percent-threshold.
+func PercentThresholds(viper *viper.Viper) ([]float64, error) {
+	s := viper.GetStringSlice(ParamPercentThreshold)
+	percentThresholds := make([]float64, len(s))
+	for i, sPercentThreshold := range s {
+		pt, err := strconv.ParseFloat(sPercentThreshold, 64)
+		if err != nil {
+			return nil, err
+		}
+		percentThresholds[i] = pt
+	}
+	return percentThresholds, nil
+}
+
+// BackendDisabledSubMetrics returns the disabled-sub-metrics in the section of the named backend, or the global
+// disabled-sub-metrics if the backend does not override them.
+func BackendDisabledSubMetrics(viper *viper.Viper, backendName string) TimerSubtypes {
+	if sub := viper.Sub(backendName); sub != nil && sub.IsSet("disabled-sub-metrics") {
+		return DisabledSubMetrics(sub)
+	}
+	return DisabledSubMetrics(viper)
+}
+
+// BackendPercentThresholds returns the percent-threshold in the section of the named backend, or the global
+// percent-threshold if the backend does not override it.
+func BackendPercentThresholds(viper *viper.Viper, backendName string) ([]float64, error) {
+	if sub := viper.Sub(backendName); sub != nil && sub.IsSet(ParamPercentThreshold) {
+		return PercentThresholds(sub)
+	}
+	return PercentThresholds(viper)
+}
+
+// AggregatedTimerSettings returns the percentiles and disabled sub-metrics the aggregators must use so every named
+// backend can be sent what it is configured with: every percentile of any backend, and only the sub-metrics which are
+// disabled for all of them.
+func AggregatedTimerSettings(viper *viper.Viper, backendNames []string) ([]float64, TimerSubtypes, error) {
+	percentThresholds, err := PercentThresholds(viper)
+	if err != nil {
+		return nil, TimerSubtypes{}, err
+	}
+	disabled := DisabledSubMetrics(viper)
+
+	seen := make(map[float64]struct{}, len(percentThresholds))
+	for _, pct := range percentThresholds {
+		seen[pct] = struct{}{}
+	}
+	for _, backendName := range backendNames {
+		backendThresholds, err := BackendPercentThresholds(viper, backendName)
+		if err != nil {
+			return nil, TimerSubtypes{}, err
+		}
+		for _, pct := range backendThresholds {
+			if _, ok := seen[pct]; !ok {
+				seen[pct] = struct{}{}
+				percentThresholds = append(percentThresholds, pct)
+			}
+		}
+		disabled = disabled.intersect(BackendDisabledSubMetrics(viper, backendName))
+	}
+	return percentThresholds, disabled, nil
+}
+
+// PercentileNames returns the names of the percentile sub-metrics which are calculated for the percentiles, excluding
+// any which are disabled.
+func PercentileNames(percentThresholds []float64, disabled TimerSubtypes) map[string]struct{} {
+	names := make(map[string]struct{}, 5*len(percentThresholds))
+	for _, pct := range percentThresholds {
+		sPct := strconv.Itoa(int(pct))
+		for name, isDisabled := range map[string]bool{
+			"count_":       disabled.CountPct,
+			"mean_":        disabled.MeanPct,
+			"sum_":         disabled.SumPct,
+			"sum_squares_": disabled.SumSquaresPct,
+			"upper_":       disabled.UpperPct || pct <= 0,
+			"lower_":       disabled.LowerPct || pct > 0,
+		} {
+			if !isDisabled {
+				names[name+sPct] = struct{}{}
+			}
+		}
+	}
+	return names
+}
+
+// intersect returns the sub-metrics which are disabled in both ts and other.
+func (ts TimerSubtypes) intersect(other TimerSubtypes) TimerSubtypes {
+	return TimerSubtypes{
+		Lower:          ts.Lower && other.Lower,
+		LowerPct:       ts.LowerPct && other.LowerPct,
+		Upper:          ts.Upper && other.Upper,
+		UpperPct:       ts.UpperPct && other.UpperPct,
+		Count:          ts.Count && other.Count,
+		CountPct:       ts.CountPct && other.CountPct,
+		CountPerSecond: ts.CountPerSecond && other.CountPerSecond,
+		Mean:           ts.Mean && other.Mean,
+		MeanPct:        ts.MeanPct && other.MeanPct,
+		Median:         ts.Median && other.Median,
+		StdDev:         ts.StdDev && other.StdDev,
+		Sum:            ts.Sum && other.Sum,
+		SumPct:         ts.SumPct && other.SumPct,
+		SumSquares:     ts.SumSquares && other.SumSquares,
+		SumSquaresPct:  ts.SumSquaresPct && other.SumSquaresPct,
+	}
+}
@@ -0,0 +1,45 @@
+package gostatsd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregatedTimerSettings(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set(ParamPercentThreshold, []string{"90"})
+	v.Set("disabled-sub-metrics.median", true)
+	v.Set("disabled-sub-metrics.mean-pct", true)
+	v.Set("datadog.percent-threshold", []string{"50", "90", "99"})
+	v.Set("datadog.disabled-sub-metrics.median", true)
+	v.Set("datadog.disabled-sub-metrics.upper", true)
+
+	assert.Equal(t, TimerSubtypes{Median: true, MeanPct: true}, BackendDisabledSubMetrics(v, "graphite"))
+	assert.Equal(t, TimerSubtypes{Median: true, Upper: true}, BackendDisabledSubMetrics(v, "datadog"))
+
+	pt, err := BackendPercentThresholds(v, "datadog")
+	require.NoError(t, err)
+	assert.Equal(t, []float64{50, 90, 99}, pt)
+
+	pt, disabled, err := AggregatedTimerSettings(v, []string{"graphite", "datadog"})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{90, 50, 99}, pt)
+	assert.Equal(t, TimerSubtypes{Median: true}, disabled)
+}
+
+func TestPercentileNames(t *testing.T) {
+	t.Parallel()
+	names := PercentileNames([]float64{90, -10}, TimerSubtypes{SumPct: true, SumSquaresPct: true})
+	assert.Equal(t, map[string]struct{}{
+		"count_90":  {},
+		"mean_90":   {},
+		"upper_90":  {},
+		"count_-10": {},
+		"mean_-10":  {},
+		"lower_-10": {},
+	}, names)
+}
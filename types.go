@@ -2,7 +2,11 @@ package gostatsd
 
 import (
 	"context"
+	"net"
+	"strings"
 	"time"
+
+	"github.com/spf13/viper"
 )
 
 // Nanotime is the number of nanoseconds elapsed since January 1, 1970 UTC.
@@ -27,6 +31,46 @@ type Source string
 // UnknownSource is an IP of an unknown source.
 const UnknownSource Source = ""
 
+// containerSourcePrefix prefixes the ID of a container in a Source, rather than an IP.
+const containerSourcePrefix = "container:"
+
+// ContainerSource returns the Source of a container, for a metric received on a unix socket whose sender was
+// identified as the container with the ID.
+func ContainerSource(id string) Source {
+	return Source(containerSourcePrefix + id)
+}
+
+// ContainerID returns the ID of the container of a Source returned by ContainerSource, and if it is one.
+func (s Source) ContainerID() (string, bool) {
+	if !strings.HasPrefix(string(s), containerSourcePrefix) {
+		return "", false
+	}
+	return string(s[len(containerSourcePrefix):]), true
+}
+
+// NormalizeSource returns the canonical form of an IP address, so the same address always results in the same Source.
+// IPv4-mapped IPv6 addresses are converted to IPv4, and IPv6 addresses are compressed and lower cased.  If stripZone
+// is true, the zone of an IPv6 address (eg, %eth0) is removed.  A Source which is not an IP address is returned
+// unchanged.
+func NormalizeSource(source Source, stripZone bool) Source {
+	addr, zone := string(source), ""
+	if i := strings.LastIndexByte(addr, '%'); i >= 0 {
+		addr, zone = addr[:i], addr[i:]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return source
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// Zones are only meaningful for IPv6
+		return Source(ip4.String())
+	}
+	if stripZone {
+		zone = ""
+	}
+	return Source(ip.String() + zone)
+}
+
 type Wait func()
 
 type TimerSubtypes struct {
@@ -69,6 +113,35 @@ func MaybeAppendRunnable(runnables []Runnable, maybeRunner interface{}) []Runnab
 	return runnables
 }
 
+// ReadinessChecker is implemented by components which are not ready to process data until some condition is met.
+type ReadinessChecker interface {
+	// CheckReady returns nil if the component is ready, or an error describing why it is not.  It must not block.
+	CheckReady() error
+}
+
+// MaybeAppendReadinessChecker appends maybeChecker to checkers if it is a ReadinessChecker.
+func MaybeAppendReadinessChecker(checkers []ReadinessChecker, maybeChecker interface{}) []ReadinessChecker {
+	if c, ok := maybeChecker.(ReadinessChecker); ok {
+		checkers = append(checkers, c)
+	}
+	return checkers
+}
+
+// ConfigReloader is implemented by components which can apply a new configuration without being restarted.
+type ConfigReloader interface {
+	// ReloadConfig applies the reloadable settings from v.  The settings should be validated before any are applied,
+	// so an invalid configuration leaves the previous settings in use.
+	ReloadConfig(ctx context.Context, v *viper.Viper) error
+}
+
+// MaybeAppendConfigReloader appends maybeReloader to reloaders if it is a ConfigReloader.
+func MaybeAppendConfigReloader(reloaders []ConfigReloader, maybeReloader interface{}) []ConfigReloader {
+	if r, ok := maybeReloader.(ConfigReloader); ok {
+		reloaders = append(reloaders, r)
+	}
+	return reloaders
+}
+
 // RawMetricHandler is an interface that accepts a Metric for processing.  Raw refers to pre-aggregation, not
 // pre-consolidation.
 type RawMetricHandler interface {
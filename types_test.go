@@ -0,0 +1,29 @@
+package gostatsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeSource(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		source    Source
+		stripZone bool
+		expected  Source
+	}{
+		{source: "", expected: ""},
+		{source: "host.example.com", expected: "host.example.com"},
+		{source: "1.2.3.4", expected: "1.2.3.4"},
+		{source: "::ffff:1.2.3.4", expected: "1.2.3.4"},
+		{source: "::FFFF:102:304", expected: "1.2.3.4"},
+		{source: "2001:DB8:0:0:0:0:0:1", expected: "2001:db8::1"},
+		{source: "fe80::1%eth0", expected: "fe80::1%eth0"},
+		{source: "fe80::1%eth0", stripZone: true, expected: "fe80::1"},
+		{source: "FE80:0::1%eth0", stripZone: true, expected: "fe80::1"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, NormalizeSource(test.source, test.stripZone), "%s", test.source)
+	}
+}